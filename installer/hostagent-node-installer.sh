@@ -26,9 +26,21 @@ IMAGE_TAG="${IMAGE_TAG:-latest}"
 PROVIDER_ID="${PROVIDER_ID:-$(hostname)}"
 RESOURCE_API_URL="${RESOURCE_API_URL:-}"
 AGENT_TOKEN="${AGENT_TOKEN:-}"
+ENROLLMENT_TOKEN="${ENROLLMENT_TOKEN:-}"
 KAFKA_BROKERS="${KAFKA_BROKERS:-}"
 KAFKA_TOPIC="${KAFKA_TOPIC:-host.metrics}"
 METRICS_INTERVAL_SECONDS="${METRICS_INTERVAL_SECONDS:-5}"
+# Set to false to refuse remote exec on this host regardless of server policy.
+EXEC_ENABLED="${EXEC_ENABLED:-false}"
+# Set to false to refuse file transfers; files land under FILE_SANDBOX_DIR.
+FILE_TRANSFER_ENABLED="${FILE_TRANSFER_ENABLED:-true}"
+FILE_SANDBOX_DIR="${FILE_SANDBOX_DIR:-/var/lib/sharemct/files}"
+# Set to false to refuse agent_update commands. Installed updates are kept
+# in /var/lib/sharemct/agent so they survive the container being recreated.
+UPDATE_ENABLED="${UPDATE_ENABLED:-true}"
+# Reported with each heartbeat so fleet rollouts can target this host.
+HOST_REGION="${HOST_REGION:-}"
+HOST_LABELS="${HOST_LABELS:-}"
 
 if [[ -z "${RESOURCE_API_URL}" && -z "${KAFKA_BROKERS}" ]]; then
   echo "Set RESOURCE_API_URL or KAFKA_BROKERS before installation."
@@ -36,13 +48,25 @@ if [[ -z "${RESOURCE_API_URL}" && -z "${KAFKA_BROKERS}" ]]; then
 fi
 
 mkdir -p /etc/sharemct
+# The enrolled per-host credential is kept here across agent restarts.
+mkdir -p /var/lib/sharemct
+chmod 700 /var/lib/sharemct
 cat >/etc/sharemct/hostagent.env <<EOF
 PROVIDER_ID=${PROVIDER_ID}
 RESOURCE_API_URL=${RESOURCE_API_URL}
 AGENT_TOKEN=${AGENT_TOKEN}
+ENROLLMENT_TOKEN=${ENROLLMENT_TOKEN}
+CREDENTIAL_FILE=/var/lib/sharemct/credential.json
 KAFKA_BROKERS=${KAFKA_BROKERS}
 KAFKA_TOPIC=${KAFKA_TOPIC}
 METRICS_INTERVAL_SECONDS=${METRICS_INTERVAL_SECONDS}
+EXEC_ENABLED=${EXEC_ENABLED}
+FILE_TRANSFER_ENABLED=${FILE_TRANSFER_ENABLED}
+FILE_SANDBOX_DIR=${FILE_SANDBOX_DIR}
+UPDATE_ENABLED=${UPDATE_ENABLED}
+UPDATE_DIR=/var/lib/sharemct/agent
+HOST_REGION=${HOST_REGION}
+HOST_LABELS=${HOST_LABELS}
 EOF
 
 cat >/etc/systemd/system/sharemct-hostagent.service <<EOF
@@ -56,7 +80,7 @@ Restart=always
 RestartSec=5
 EnvironmentFile=/etc/sharemct/hostagent.env
 ExecStartPre=${DOCKER_BIN} pull ${IMAGE_REPO}:${IMAGE_TAG}
-ExecStart=${DOCKER_BIN} run --rm --name sharemct-hostagent --privileged --network host --env-file /etc/sharemct/hostagent.env ${IMAGE_REPO}:${IMAGE_TAG}
+ExecStart=${DOCKER_BIN} run --rm --name sharemct-hostagent --privileged --network host -v /var/run/docker.sock:/var/run/docker.sock -v /var/lib/sharemct:/var/lib/sharemct --env-file /etc/sharemct/hostagent.env ${IMAGE_REPO}:${IMAGE_TAG}
 ExecStop=${DOCKER_BIN} stop sharemct-hostagent
 
 [Install]
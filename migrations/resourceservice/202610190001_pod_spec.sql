@@ -0,0 +1,3 @@
+-- Container spec for pods: env, start command, ports, disk, volumes and registry auth.
+
+ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS spec_json TEXT NOT NULL DEFAULT '{}';
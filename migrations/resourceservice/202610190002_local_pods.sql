@@ -0,0 +1,4 @@
+-- Local pod backend: pods scheduled onto donor hosts through hostagent.
+
+ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS backend TEXT NOT NULL DEFAULT 'runpod';
+ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS allocation_id TEXT NOT NULL DEFAULT '';
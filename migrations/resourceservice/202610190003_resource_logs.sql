@@ -0,0 +1,19 @@
+-- Structured stdout/stderr, journald and file logs shipped by vmdaemon and hostagent.
+
+CREATE TABLE IF NOT EXISTS resource_logs (
+    id TEXT PRIMARY KEY,
+    seq BIGSERIAL UNIQUE,
+    provider_id TEXT NOT NULL,
+    resource_id TEXT NOT NULL,
+    resource_type TEXT NOT NULL DEFAULT '',
+    source_type TEXT NOT NULL DEFAULT '',
+    source TEXT NOT NULL DEFAULT '',
+    stream TEXT NOT NULL DEFAULT '',
+    level TEXT NOT NULL DEFAULT 'info',
+    message TEXT NOT NULL,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_resource_logs_resource ON resource_logs(resource_id, seq DESC);
+CREATE INDEX IF NOT EXISTS idx_resource_logs_created ON resource_logs(created_at);
@@ -0,0 +1,30 @@
+-- Share grant lifecycle on shared_vms/shared_pods: invites, expiry, revocation and audit.
+
+ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS invite_email TEXT NOT NULL DEFAULT '';
+ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS accepted_at TIMESTAMPTZ;
+ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ;
+ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS idx_shared_vms_vm ON shared_vms(vm_id);
+
+ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS invite_email TEXT NOT NULL DEFAULT '';
+ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS accepted_at TIMESTAMPTZ;
+ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ;
+ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS idx_shared_pods_pod ON shared_pods(pod_code);
+
+CREATE TABLE IF NOT EXISTS share_audit_events (
+    id TEXT PRIMARY KEY,
+    grant_id TEXT NOT NULL,
+    resource_type TEXT NOT NULL,
+    resource_id TEXT NOT NULL,
+    actor_user_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_audit_resource ON share_audit_events(resource_type, resource_id, created_at DESC);
@@ -0,0 +1,5 @@
+-- Record which share grant authorized a terminal session or audit event.
+
+ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS grant_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE terminal_audit_events ADD COLUMN IF NOT EXISTS grant_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_terminal_sessions_resource ON terminal_sessions(resource_id, created_at DESC);
@@ -0,0 +1,20 @@
+-- Bookings against shared inventory offers: holds, confirmation and release.
+
+CREATE TABLE IF NOT EXISTS offer_bookings (
+    id TEXT PRIMARY KEY,
+    offer_id TEXT NOT NULL REFERENCES shared_inventory_offers(id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL,
+    provider_id TEXT NOT NULL,
+    quantity INTEGER NOT NULL,
+    price_hourly_usd DOUBLE PRECISION NOT NULL,
+    status TEXT NOT NULL DEFAULT 'held',
+    hold_expires_at TIMESTAMPTZ NOT NULL,
+    allocation_id TEXT NOT NULL DEFAULT '',
+    billing_rental_id TEXT NOT NULL DEFAULT '',
+    confirmed_at TIMESTAMPTZ,
+    closed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_offer_bookings_user ON offer_bookings(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_offer_bookings_holds ON offer_bookings(status, hold_expires_at);
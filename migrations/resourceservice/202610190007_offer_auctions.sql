@@ -0,0 +1,43 @@
+-- Auction pricing for shared inventory offers: bids and published clearings.
+
+ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS pricing_mode TEXT NOT NULL DEFAULT 'fixed';
+ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS auction_rule TEXT NOT NULL DEFAULT '';
+ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS clearing_period_minutes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS next_clearing_at TIMESTAMPTZ;
+ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS last_clearing_price_usd DOUBLE PRECISION NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_shared_inventory_clearing ON shared_inventory_offers(pricing_mode, next_clearing_at);
+
+CREATE TABLE IF NOT EXISTS offer_bids (
+    id TEXT PRIMARY KEY,
+    offer_id TEXT NOT NULL REFERENCES shared_inventory_offers(id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL,
+    provider_id TEXT NOT NULL,
+    quantity INTEGER NOT NULL,
+    max_price_hourly_usd DOUBLE PRECISION NOT NULL,
+    duration_hours INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'open',
+    allocated_qty INTEGER NOT NULL DEFAULT 0,
+    clearing_price_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+    allocation_id TEXT NOT NULL DEFAULT '',
+    billing_rental_id TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_offer_bids_offer ON offer_bids(offer_id, status);
+CREATE INDEX IF NOT EXISTS idx_offer_bids_user ON offer_bids(user_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS auction_clearings (
+    id TEXT PRIMARY KEY,
+    offer_id TEXT NOT NULL REFERENCES shared_inventory_offers(id) ON DELETE CASCADE,
+    rule TEXT NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    clearing_price_usd DOUBLE PRECISION NOT NULL,
+    offered_qty INTEGER NOT NULL,
+    allocated_qty INTEGER NOT NULL,
+    bid_count INTEGER NOT NULL,
+    awards_json TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_auction_clearings_offer ON auction_clearings(offer_id, period_start DESC);
@@ -0,0 +1,24 @@
+-- Tiered metric storage: minute and hour rollups with per-tier watermarks.
+
+CREATE INDEX IF NOT EXISTS idx_metric_points_captured ON metric_points(captured_at);
+
+CREATE TABLE IF NOT EXISTS metric_rollups (
+    resolution TEXT NOT NULL,
+    resource_type TEXT NOT NULL,
+    resource_id TEXT NOT NULL,
+    metric_type TEXT NOT NULL,
+    bucket_start TIMESTAMPTZ NOT NULL,
+    min_value DOUBLE PRECISION NOT NULL,
+    max_value DOUBLE PRECISION NOT NULL,
+    sum_value DOUBLE PRECISION NOT NULL,
+    last_value DOUBLE PRECISION NOT NULL,
+    last_at TIMESTAMPTZ NOT NULL,
+    samples BIGINT NOT NULL,
+    PRIMARY KEY (resolution, resource_type, resource_id, metric_type, bucket_start)
+);
+CREATE INDEX IF NOT EXISTS idx_metric_rollups_bucket ON metric_rollups(resolution, bucket_start);
+
+CREATE TABLE IF NOT EXISTS metric_rollup_watermarks (
+    resolution TEXT PRIMARY KEY,
+    rolled_until TIMESTAMPTZ NOT NULL
+);
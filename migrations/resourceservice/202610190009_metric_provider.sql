@@ -0,0 +1,4 @@
+-- Attribute metric points and rollups to the donor provider for grouped queries.
+
+ALTER TABLE metric_points ADD COLUMN IF NOT EXISTS provider_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE metric_rollups ADD COLUMN IF NOT EXISTS provider_id TEXT NOT NULL DEFAULT '';
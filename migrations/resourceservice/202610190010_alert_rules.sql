@@ -0,0 +1,53 @@
+-- Alert rules evaluated by resourceservice, their alert instances and silences.
+
+CREATE TABLE IF NOT EXISTS alert_rules (
+    id TEXT PRIMARY KEY,
+    owner_user_id TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    resource_type TEXT NOT NULL DEFAULT '',
+    resource_id TEXT NOT NULL DEFAULT '',
+    metric_type TEXT NOT NULL DEFAULT '',
+    comparator TEXT NOT NULL DEFAULT '',
+    threshold DOUBLE PRECISION NOT NULL DEFAULT 0,
+    check_type TEXT NOT NULL DEFAULT '',
+    health_status TEXT NOT NULL DEFAULT '',
+    for_seconds INTEGER NOT NULL DEFAULT 0,
+    severity TEXT NOT NULL,
+    channels_json TEXT NOT NULL DEFAULT '[]',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_alert_rules_owner ON alert_rules(owner_user_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS alerts (
+    id TEXT PRIMARY KEY,
+    rule_id TEXT NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+    resource_type TEXT NOT NULL,
+    resource_id TEXT NOT NULL,
+    state TEXT NOT NULL,
+    value DOUBLE PRECISION NOT NULL DEFAULT 0,
+    summary TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMPTZ NOT NULL,
+    fired_at TIMESTAMPTZ,
+    resolved_at TIMESTAMPTZ,
+    notified_state TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_open ON alerts(rule_id, resource_type, resource_id) WHERE state <> 'resolved';
+CREATE INDEX IF NOT EXISTS idx_alerts_rule ON alerts(rule_id, started_at DESC);
+
+CREATE TABLE IF NOT EXISTS alert_silences (
+    id TEXT PRIMARY KEY,
+    owner_user_id TEXT NOT NULL,
+    rule_id TEXT NOT NULL DEFAULT '',
+    resource_type TEXT NOT NULL DEFAULT '',
+    resource_id TEXT NOT NULL DEFAULT '',
+    comment TEXT NOT NULL DEFAULT '',
+    starts_at TIMESTAMPTZ NOT NULL,
+    ends_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_alert_silences_ends ON alert_silences(ends_at);
@@ -0,0 +1,36 @@
+-- Active health probes run by resourceservice and the resource health they drive.
+
+ALTER TABLE health_checks ADD COLUMN IF NOT EXISTS probe_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE health_checks ADD COLUMN IF NOT EXISTS latency_ms DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS health TEXT NOT NULL DEFAULT 'unknown';
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS health_probes_seeded BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS ip_address TEXT NOT NULL DEFAULT '';
+ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS health TEXT NOT NULL DEFAULT 'unknown';
+ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS health_probes_seeded BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS health_probes (
+    id TEXT PRIMARY KEY,
+    resource_type TEXT NOT NULL,
+    resource_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    port INTEGER NOT NULL DEFAULT 0,
+    path TEXT NOT NULL DEFAULT '',
+    expected_status INTEGER NOT NULL DEFAULT 0,
+    interval_seconds INTEGER NOT NULL,
+    timeout_seconds INTEGER NOT NULL,
+    failure_threshold INTEGER NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    last_status TEXT NOT NULL DEFAULT '',
+    last_latency_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    last_checked_at TIMESTAMPTZ,
+    next_run_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_health_probes_resource ON health_probes(resource_type, resource_id);
+CREATE INDEX IF NOT EXISTS idx_health_probes_due ON health_probes(next_run_at) WHERE enabled;
@@ -0,0 +1,25 @@
+-- Provider presence derived from heartbeats and agent polls, with its change history.
+
+CREATE TABLE IF NOT EXISTS provider_presence (
+    provider_id TEXT PRIMARY KEY,
+    state TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    last_poll_at TIMESTAMPTZ,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    flap_count INTEGER NOT NULL DEFAULT 0,
+    synced BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_provider_presence_unsynced ON provider_presence(provider_id) WHERE NOT synced;
+
+CREATE TABLE IF NOT EXISTS provider_presence_events (
+    id TEXT PRIMARY KEY,
+    provider_id TEXT NOT NULL,
+    from_state TEXT NOT NULL,
+    to_state TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_provider_presence_events_provider ON provider_presence_events(provider_id, created_at DESC);
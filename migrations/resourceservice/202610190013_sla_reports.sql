@@ -0,0 +1,28 @@
+-- Monthly uptime SLA reports per VM, pod and provider, with the credit owed for a missed target.
+
+ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS availability_tier TEXT NOT NULL DEFAULT 'low';
+
+CREATE TABLE IF NOT EXISTS sla_reports (
+    resource_type TEXT NOT NULL,
+    resource_id TEXT NOT NULL,
+    period TEXT NOT NULL,
+    user_id TEXT NOT NULL DEFAULT '',
+    provider_id TEXT NOT NULL DEFAULT '',
+    tier TEXT NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    target_pct DOUBLE PRECISION NOT NULL,
+    uptime_pct DOUBLE PRECISION NOT NULL,
+    monitored_seconds BIGINT NOT NULL DEFAULT 0,
+    downtime_seconds BIGINT NOT NULL DEFAULT 0,
+    met BOOLEAN NOT NULL,
+    credit_pct DOUBLE PRECISION NOT NULL DEFAULT 0,
+    credit_status TEXT NOT NULL DEFAULT 'none',
+    credit_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (resource_type, resource_id, period)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sla_reports_period ON sla_reports(period, credit_status);
+CREATE INDEX IF NOT EXISTS idx_sla_reports_user ON sla_reports(user_id, period DESC);
@@ -0,0 +1,4 @@
+-- Per-command sequence numbers so agents on the push channel can resume after a reconnect.
+
+ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS seq BIGSERIAL;
+CREATE INDEX IF NOT EXISTS idx_agent_commands_seq ON agent_commands(provider_id, seq);
@@ -0,0 +1,9 @@
+-- Agent command deadlines, delivery leases and bounded retries.
+
+ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS max_attempts INTEGER NOT NULL DEFAULT 3;
+ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS timeout_seconds INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS deadline_at TIMESTAMPTZ;
+ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_agent_commands_open ON agent_commands(deadline_at) WHERE status IN ('queued', 'running');
+CREATE INDEX IF NOT EXISTS idx_agent_commands_requester ON agent_commands(requested_by, created_at DESC);
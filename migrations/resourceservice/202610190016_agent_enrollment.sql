@@ -0,0 +1,32 @@
+-- One-time agent enrollment tokens and per-host agent credentials.
+
+CREATE TABLE IF NOT EXISTS agent_enrollments (
+    id TEXT PRIMARY KEY,
+    provider_id TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    label TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,
+    host_id TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_agent_enrollments_provider ON agent_enrollments(provider_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS agent_hosts (
+    id TEXT PRIMARY KEY,
+    provider_id TEXT NOT NULL,
+    hostname TEXT NOT NULL DEFAULT '',
+    label TEXT NOT NULL DEFAULT '',
+    enrollment_id TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'active',
+    credential_id TEXT NOT NULL,
+    previous_credential_id TEXT NOT NULL DEFAULT '',
+    credential_expires_at TIMESTAMPTZ NOT NULL,
+    rotated_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    revoked_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_agent_hosts_provider ON agent_hosts(provider_id, created_at DESC);
@@ -0,0 +1,40 @@
+-- Signed heartbeats, capacity challenges and host verification standing.
+
+ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS signed BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE agent_hosts ADD COLUMN IF NOT EXISTS public_key TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS capacity_challenges (
+    id TEXT PRIMARY KEY,
+    provider_id TEXT NOT NULL,
+    command_id TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    memory_mb INTEGER NOT NULL DEFAULT 0,
+    passes INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL DEFAULT 'pending',
+    detail TEXT NOT NULL DEFAULT '',
+    issued_by TEXT NOT NULL,
+    issued_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_capacity_challenges_provider ON capacity_challenges(provider_id, issued_at DESC);
+
+CREATE TABLE IF NOT EXISTS host_verifications (
+    provider_id TEXT PRIMARY KEY,
+    status TEXT NOT NULL DEFAULT 'unverified',
+    reason TEXT NOT NULL DEFAULT '',
+    consecutive_passes INTEGER NOT NULL DEFAULT 0,
+    failed_challenges INTEGER NOT NULL DEFAULT 0,
+    last_challenge_at TIMESTAMPTZ,
+    flagged_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS host_gpu_devices (
+    uuid TEXT PRIMARY KEY,
+    provider_id TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    memory_mb INTEGER NOT NULL DEFAULT 0,
+    seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_host_gpu_devices_provider ON host_gpu_devices(provider_id);
@@ -0,0 +1,37 @@
+-- Remote exec runs on provider hosts and the per-provider policy that limits them.
+
+CREATE TABLE IF NOT EXISTS exec_policies (
+    provider_id TEXT PRIMARY KEY,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    allowed_commands_json TEXT NOT NULL DEFAULT '[]',
+    allow_scripts BOOLEAN NOT NULL DEFAULT FALSE,
+    max_timeout_seconds INTEGER NOT NULL DEFAULT 300,
+    run_as TEXT NOT NULL DEFAULT 'nobody',
+    updated_by TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS exec_runs (
+    id TEXT PRIMARY KEY,
+    provider_id TEXT NOT NULL,
+    command_id TEXT NOT NULL DEFAULT '',
+    requested_by TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    script TEXT NOT NULL DEFAULT '',
+    argv_json TEXT NOT NULL DEFAULT '[]',
+    work_dir TEXT NOT NULL DEFAULT '',
+    env_keys_json TEXT NOT NULL DEFAULT '[]',
+    run_as TEXT NOT NULL DEFAULT '',
+    timeout_seconds INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL DEFAULT 'queued',
+    detail TEXT NOT NULL DEFAULT '',
+    exit_code INTEGER NOT NULL DEFAULT 0,
+    stdout TEXT NOT NULL DEFAULT '',
+    stderr TEXT NOT NULL DEFAULT '',
+    output_truncated BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_exec_runs_provider ON exec_runs(provider_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_exec_runs_requested_by ON exec_runs(requested_by, created_at DESC);
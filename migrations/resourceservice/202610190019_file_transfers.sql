@@ -0,0 +1,31 @@
+-- Chunked file transfers between clients and provider host sandboxes.
+
+CREATE TABLE IF NOT EXISTS file_transfers (
+    id TEXT PRIMARY KEY,
+    provider_id TEXT NOT NULL,
+    resource_id TEXT NOT NULL DEFAULT '',
+    requested_by TEXT NOT NULL,
+    grant_id TEXT NOT NULL DEFAULT '',
+    direction TEXT NOT NULL,
+    path TEXT NOT NULL,
+    size BIGINT NOT NULL DEFAULT 0,
+    sha256 TEXT NOT NULL DEFAULT '',
+    stored_bytes BIGINT NOT NULL DEFAULT 0,
+    host_bytes BIGINT NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    command_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_file_transfers_resource ON file_transfers(resource_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_file_transfers_provider ON file_transfers(provider_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_file_transfers_expires ON file_transfers(expires_at);
+CREATE TABLE IF NOT EXISTS file_transfer_chunks (
+    transfer_id TEXT NOT NULL REFERENCES file_transfers(id) ON DELETE CASCADE,
+    byte_offset BIGINT NOT NULL,
+    data BYTEA NOT NULL,
+    PRIMARY KEY (transfer_id, byte_offset)
+);
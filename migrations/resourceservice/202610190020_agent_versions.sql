@@ -0,0 +1,3 @@
+-- Hostagent version reported with each heartbeat, for the fleet inventory.
+
+ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS agent_version TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,39 @@
+-- Fleet-wide command rollouts with waves, and the heartbeat attributes they target.
+
+ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '';
+ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS labels_json TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS rollout_id TEXT NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS rollouts (
+    id TEXT PRIMARY KEY,
+    command TEXT NOT NULL,
+    payload TEXT NOT NULL DEFAULT '',
+    selector_json TEXT NOT NULL DEFAULT '{}',
+    waves_json TEXT NOT NULL DEFAULT '[]',
+    current_wave INTEGER NOT NULL DEFAULT 0,
+    max_concurrency INTEGER NOT NULL,
+    max_failure_pct INTEGER NOT NULL,
+    pause_between_waves BOOLEAN NOT NULL DEFAULT FALSE,
+    timeout_seconds INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,
+    failure_window_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_rollouts_status ON rollouts(status, created_at DESC);
+CREATE TABLE IF NOT EXISTS rollout_targets (
+    rollout_id TEXT NOT NULL REFERENCES rollouts(id) ON DELETE CASCADE,
+    provider_id TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    wave INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    command_id TEXT NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    PRIMARY KEY (rollout_id, provider_id)
+);
+CREATE INDEX IF NOT EXISTS idx_rollout_targets_status ON rollout_targets(rollout_id, status, position);
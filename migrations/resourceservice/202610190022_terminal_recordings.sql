@@ -0,0 +1,7 @@
+-- Terminal recordings: the initial size for the asciicast header and retention purges.
+
+ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS initial_rows INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS initial_cols INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS recording_purged_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_terminal_sessions_recording ON terminal_sessions(closed_at) WHERE recording_purged_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_terminal_audit_type ON terminal_audit_events(session_id, event_type, created_at);
@@ -0,0 +1,11 @@
+-- Shared terminal sessions: users the renter invited as drivers or viewers.
+
+CREATE TABLE IF NOT EXISTS terminal_participants (
+    session_id TEXT NOT NULL REFERENCES terminal_sessions(id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL,
+    role TEXT NOT NULL,
+    invited_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (session_id, user_id)
+);
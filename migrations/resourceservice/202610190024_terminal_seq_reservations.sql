@@ -0,0 +1,4 @@
+-- Terminal seqs reserved in blocks, so every instance hands out distinct seqs.
+
+ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS reserved_input_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS reserved_output_seq BIGINT NOT NULL DEFAULT 0;
@@ -52,7 +52,7 @@ func main() {
 
 	svc := service.NewProviderService(repo)
 	logger.Info().Msg("provider service initialized")
-	handler := httpadapter.NewHandler(svc, cfg.GitHubRepo, cfg.ReleaseTag, cfg.AgentResourceURL, cfg.AgentKafkaBrokers, cfg.AgentImageRepo)
+	handler := httpadapter.NewHandler(svc, cfg.GitHubRepo, cfg.ReleaseTag, cfg.AgentResourceURL, cfg.AgentKafkaBrokers, cfg.AgentImageRepo, cfg.ServiceToken)
 	logger.Info().Msg("http handler initialized")
 	r := chi.NewRouter()
 	r.Use(httpx.RequestLogger(logger))
@@ -62,25 +62,33 @@ func main() {
 		api.Get("/templates", handler.ListPodTemplates)
 	})
 	r.Route("/v1/admin", func(api chi.Router) {
-		api.Use(sdkauth.RequireAuth(cfg.JWTSecret))
-		api.Use(sdkauth.RequireAnyRole("admin", "super-admin", "ops-admin"))
-		api.Get("/stats", handler.Stats)
-		api.Get("/agent/install-command", handler.AgentInstallCommand)
-		api.Route("/providers", func(providers chi.Router) {
-			providers.Post("/", handler.CreateProvider)
-			providers.Get("/", handler.ListProviders)
-			providers.Get("/{providerID}", handler.GetProvider)
-			providers.Get("/{providerID}/metrics", handler.ProviderMetrics)
+		api.Route("/internal", func(internal chi.Router) {
+			internal.Use(handler.ServiceAuth)
+			internal.Get("/providers", handler.ListProviders)
+			internal.Post("/providers/{providerID}/presence", handler.UpdateProviderPresence)
 		})
-		api.Route("/pods", func(pods chi.Router) {
-			pods.Post("/", handler.UpsertPodCatalog)
-			pods.Delete("/{podID}", handler.DeletePodCatalog)
-			pods.Get("/{podID}/proxy-info", handler.PodProxyInfo)
-			pods.Handle("/{podID}/proxy/*", http.HandlerFunc(handler.PodProxy))
-		})
-		api.Route("/templates", func(templates chi.Router) {
-			templates.Post("/", handler.UpsertPodTemplate)
-			templates.Delete("/{templateID}", handler.DeletePodTemplate)
+		api.Group(func(secure chi.Router) {
+			secure.Use(sdkauth.RequireAuth(cfg.JWTSecret))
+			secure.Use(sdkauth.RequireAnyRole("admin", "super-admin", "ops-admin"))
+			secure.Get("/stats", handler.Stats)
+			secure.Get("/agent/install-command", handler.AgentInstallCommand)
+			secure.Route("/providers", func(providers chi.Router) {
+				providers.Post("/", handler.CreateProvider)
+				providers.Get("/", handler.ListProviders)
+				providers.Get("/{providerID}", handler.GetProvider)
+				providers.Get("/{providerID}/metrics", handler.ProviderMetrics)
+				providers.Get("/{providerID}/presence", handler.ProviderPresenceEvents)
+			})
+			secure.Route("/pods", func(pods chi.Router) {
+				pods.Post("/", handler.UpsertPodCatalog)
+				pods.Delete("/{podID}", handler.DeletePodCatalog)
+				pods.Get("/{podID}/proxy-info", handler.PodProxyInfo)
+				pods.Handle("/{podID}/proxy/*", http.HandlerFunc(handler.PodProxy))
+			})
+			secure.Route("/templates", func(templates chi.Router) {
+				templates.Post("/", handler.UpsertPodTemplate)
+				templates.Delete("/{templateID}", handler.DeletePodTemplate)
+			})
 		})
 	})
 
@@ -17,6 +17,7 @@ type Config struct {
 	AgentResourceURL string
 	AgentKafkaBrokers string
 	AgentImageRepo    string
+	ServiceToken      string
 	EnableSyntheticCatalogSeed bool
 }
 
@@ -31,6 +32,7 @@ func Load() Config {
 		AgentResourceURL: env("AGENT_RESOURCE_API_URL", ""),
 		AgentKafkaBrokers: env("AGENT_KAFKA_BROKERS", ""),
 		AgentImageRepo:    env("AGENT_IMAGE_REPO", "midaswr/host-hostagent"),
+		ServiceToken:      env("ADMIN_SERVICE_TOKEN", "change-me-in-production"),
 		EnableSyntheticCatalogSeed: envBool("ENABLE_SYNTHETIC_CATALOG_SEED", false),
 	}
 }
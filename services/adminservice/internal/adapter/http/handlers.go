@@ -1,12 +1,14 @@
 package httpadapter
 
 import (
+	"crypto/hmac"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/MidasWR/ShareMTC/services/adminservice/internal/models"
@@ -23,9 +25,10 @@ type Handler struct {
 	agentResourceURL  string
 	agentKafkaBrokers string
 	agentImageRepo    string
+	serviceToken      string
 }
 
-func NewHandler(svc *service.ProviderService, gitHubRepo string, releaseTag string, agentResourceURL string, agentKafkaBrokers string, agentImageRepo string) *Handler {
+func NewHandler(svc *service.ProviderService, gitHubRepo string, releaseTag string, agentResourceURL string, agentKafkaBrokers string, agentImageRepo string, serviceToken string) *Handler {
 	return &Handler{
 		svc:               svc,
 		gitHubRepo:        strings.TrimSpace(gitHubRepo),
@@ -33,9 +36,25 @@ func NewHandler(svc *service.ProviderService, gitHubRepo string, releaseTag stri
 		agentResourceURL:  strings.TrimSpace(agentResourceURL),
 		agentKafkaBrokers: strings.TrimSpace(agentKafkaBrokers),
 		agentImageRepo:    strings.TrimSpace(agentImageRepo),
+		serviceToken:      strings.TrimSpace(serviceToken),
 	}
 }
 
+func (h *Handler) ServiceAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.serviceToken == "" {
+			httpx.Error(w, http.StatusInternalServerError, "service token is not configured")
+			return
+		}
+		token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+		if token == "" || !hmac.Equal([]byte(token), []byte(h.serviceToken)) {
+			httpx.Error(w, http.StatusUnauthorized, "invalid service token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (h *Handler) CreateProvider(w http.ResponseWriter, r *http.Request) {
 	var req models.Provider
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -100,6 +119,35 @@ func (h *Handler) ProviderMetrics(w http.ResponseWriter, r *http.Request) {
 	httpx.JSON(w, http.StatusOK, metrics)
 }
 
+func (h *Handler) UpdateProviderPresence(w http.ResponseWriter, r *http.Request) {
+	var req models.ProviderPresence
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	req.ProviderID = chi.URLParam(r, "providerID")
+	if err := h.svc.UpdatePresence(r.Context(), req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, map[string]string{"status": "accepted"})
+}
+
+func (h *Handler) ProviderPresenceEvents(w http.ResponseWriter, r *http.Request) {
+	providerID := chi.URLParam(r, "providerID")
+	if providerID == "" {
+		httpx.Error(w, http.StatusBadRequest, "providerID is required")
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	items, err := h.svc.ListPresenceEvents(r.Context(), providerID, limit)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
 func (h *Handler) Health(w http.ResponseWriter, _ *http.Request) {
 	httpx.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
@@ -252,14 +300,21 @@ func (h *Handler) AgentInstallCommand(w http.ResponseWriter, r *http.Request) {
 	if userID != "" {
 		_ = h.svc.EnsureProvider(r.Context(), userID)
 	}
+	// An enrollment token from resourceservice lets the agent exchange it for
+	// a per-host credential on first start.
+	enrollment := ""
+	if token := strings.TrimSpace(r.URL.Query().Get("enrollment_token")); token != "" {
+		enrollment = " ENROLLMENT_TOKEN=" + shellQuote(token)
+	}
 	installCommand := fmt.Sprintf(
-		"curl -fsSL %s | sudo RESOURCE_API_URL=%s KAFKA_BROKERS=%s IMAGE_REPO=%s IMAGE_TAG=%s PROVIDER_ID=%s bash",
+		"curl -fsSL %s | sudo RESOURCE_API_URL=%s KAFKA_BROKERS=%s IMAGE_REPO=%s IMAGE_TAG=%s PROVIDER_ID=%s%s bash",
 		shellQuote(installerURL),
 		shellQuote(resourceURL),
 		shellQuote(kafkaBrokers),
 		shellQuote(imageRepo),
 		shellQuote(releaseTag),
 		shellQuote(providerID),
+		enrollment,
 	)
 	httpx.JSON(w, http.StatusOK, models.AgentInstallCommand{
 		Command:      installCommand,
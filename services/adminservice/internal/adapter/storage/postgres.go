@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/MidasWR/ShareMTC/services/adminservice/internal/models"
 	"github.com/google/uuid"
@@ -69,6 +70,24 @@ func (r *ProviderRepo) Migrate(ctx context.Context) error {
 			pod_id UUID NOT NULL REFERENCES pods_catalog(id) ON DELETE CASCADE,
 			template_id UUID NOT NULL REFERENCES pod_templates(id) ON DELETE CASCADE,
 			PRIMARY KEY (pod_id, template_id)
+		);
+		CREATE TABLE IF NOT EXISTS provider_presence_status (
+			provider_id TEXT PRIMARY KEY,
+			state TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			heartbeat_at TIMESTAMPTZ,
+			last_poll_at TIMESTAMPTZ,
+			changed_at TIMESTAMPTZ NOT NULL,
+			flap_count INTEGER NOT NULL DEFAULT 0,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS provider_presence_transitions (
+			provider_id TEXT NOT NULL,
+			from_state TEXT NOT NULL,
+			to_state TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			changed_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (provider_id, changed_at)
 		)
 	`)
 	if err != nil {
@@ -102,66 +121,93 @@ func (r *ProviderRepo) EnsureProvider(ctx context.Context, providerID string, di
 	return err
 }
 
-func (r *ProviderRepo) List(ctx context.Context) ([]models.Provider, error) {
+// providerBaseQuery lists registered providers plus, when resourceservice
+// shares the database, hosts that heartbeat without a providers row. Online
+// falls back to heartbeat age until a presence push arrives.
+func (r *ProviderRepo) providerBaseQuery(ctx context.Context) (string, error) {
 	hasHostResources, err := r.tableExists(ctx, "host_resources")
+	if err != nil {
+		return "", err
+	}
+	if !hasHostResources {
+		return `
+			SELECT id::text AS id, display_name, provider_type, machine_id, network_mbps, online, created_at
+			FROM providers
+		`, nil
+	}
+	return `
+		SELECT
+			p.id::text AS id,
+			p.display_name,
+			p.provider_type,
+			p.machine_id,
+			p.network_mbps,
+			COALESCE(hr.heartbeat_at >= NOW() - INTERVAL '60 seconds', p.online) AS online,
+			p.created_at
+		FROM providers p
+		LEFT JOIN host_resources hr ON hr.provider_id = p.id::text
+		UNION ALL
+		SELECT
+			hr.provider_id AS id,
+			'Auto-discovered ' || LEFT(hr.provider_id, 8) AS display_name,
+			'donor' AS provider_type,
+			'hostagent' AS machine_id,
+			hr.network_mbps,
+			(hr.heartbeat_at >= NOW() - INTERVAL '60 seconds') AS online,
+			hr.heartbeat_at AS created_at
+		FROM host_resources hr
+		WHERE NOT EXISTS (
+			SELECT 1 FROM providers p WHERE p.id::text = hr.provider_id
+		)
+	`, nil
+}
+
+// presenceJoin attaches the latest pushed presence and the number of state
+// changes over the last day to the provider base query.
+const presenceJoin = `
+	LEFT JOIN provider_presence_status ps ON ps.provider_id = base.id
+	LEFT JOIN LATERAL (
+		SELECT COUNT(*)::int AS recent_flaps
+		FROM provider_presence_transitions t
+		WHERE t.provider_id = base.id AND t.from_state <> '' AND t.changed_at >= NOW() - INTERVAL '24 hours'
+	) flaps ON TRUE
+`
+
+const providerColumns = `
+	base.id, base.display_name, base.provider_type, base.machine_id, base.network_mbps,
+	COALESCE(ps.state = 'online', base.online), COALESCE(ps.state, ''), COALESCE(ps.reason, ''), ps.changed_at,
+	COALESCE(ps.flap_count, 0), flaps.recent_flaps, base.created_at
+`
+
+// flappingThreshold is how many presence changes within a day mark a
+// provider as flapping in admin stats.
+const flappingThreshold = 3
+
+func scanProvider(row pgx.Row) (models.Provider, error) {
+	var p models.Provider
+	err := row.Scan(&p.ID, &p.DisplayName, &p.ProviderType, &p.MachineID, &p.NetworkMbps, &p.Online, &p.Presence, &p.PresenceReason, &p.PresenceChangedAt, &p.FlapCount, &p.RecentFlaps, &p.CreatedAt)
+	return p, err
+}
+
+func (r *ProviderRepo) List(ctx context.Context) ([]models.Provider, error) {
+	base, err := r.providerBaseQuery(ctx)
 	if err != nil {
 		return nil, err
 	}
-	query := `
-		SELECT id::text, display_name, provider_type, machine_id, network_mbps, online, created_at
-		FROM providers
-		ORDER BY created_at DESC
-	`
-	if hasHostResources {
-		query = `
-			WITH known AS (
-				SELECT
-					p.id::text AS id,
-					p.display_name,
-					p.provider_type,
-					p.machine_id,
-					p.network_mbps,
-					COALESCE(hr.heartbeat_at >= NOW() - INTERVAL '60 seconds', p.online) AS online,
-					p.created_at
-				FROM providers p
-				LEFT JOIN host_resources hr ON hr.provider_id = p.id::text
-			),
-			discovered AS (
-				SELECT
-					hr.provider_id AS id,
-					'Auto-discovered ' || LEFT(hr.provider_id, 8) AS display_name,
-					'donor' AS provider_type,
-					'hostagent' AS machine_id,
-					hr.network_mbps,
-					(hr.heartbeat_at >= NOW() - INTERVAL '60 seconds') AS online,
-					hr.heartbeat_at AS created_at
-				FROM host_resources hr
-				WHERE NOT EXISTS (
-					SELECT 1 FROM providers p WHERE p.id::text = hr.provider_id
-				)
-			)
-			SELECT id, display_name, provider_type, machine_id, network_mbps, online, created_at
-			FROM known
-			UNION ALL
-			SELECT id, display_name, provider_type, machine_id, network_mbps, online, created_at
-			FROM discovered
-			ORDER BY created_at DESC
-		`
-	}
-	rows, err := r.db.Query(ctx, query)
+	rows, err := r.db.Query(ctx, `SELECT `+providerColumns+` FROM (`+base+`) base`+presenceJoin+` ORDER BY base.created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	providers := make([]models.Provider, 0)
 	for rows.Next() {
-		var p models.Provider
-		if err := rows.Scan(&p.ID, &p.DisplayName, &p.ProviderType, &p.MachineID, &p.NetworkMbps, &p.Online, &p.CreatedAt); err != nil {
+		p, err := scanProvider(rows)
+		if err != nil {
 			return nil, err
 		}
 		providers = append(providers, p)
 	}
-	return providers, nil
+	return providers, rows.Err()
 }
 
 func (r *ProviderRepo) UpdateOnlineStatus(ctx context.Context, providerID string, online bool) error {
@@ -170,91 +216,108 @@ func (r *ProviderRepo) UpdateOnlineStatus(ctx context.Context, providerID string
 }
 
 func (r *ProviderRepo) GetByID(ctx context.Context, providerID string) (models.Provider, error) {
-	var p models.Provider
-	hasHostResources, err := r.tableExists(ctx, "host_resources")
+	base, err := r.providerBaseQuery(ctx)
 	if err != nil {
 		return models.Provider{}, err
 	}
-	if hasHostResources {
-		err = r.db.QueryRow(ctx, `
-			SELECT
-				p.id::text,
-				p.display_name,
-				p.provider_type,
-				p.machine_id,
-				p.network_mbps,
-				COALESCE(hr.heartbeat_at >= NOW() - INTERVAL '60 seconds', p.online) AS online,
-				p.created_at
-			FROM providers p
-			LEFT JOIN host_resources hr ON hr.provider_id = p.id::text
-			WHERE p.id::text = $1
-		`, providerID).Scan(&p.ID, &p.DisplayName, &p.ProviderType, &p.MachineID, &p.NetworkMbps, &p.Online, &p.CreatedAt)
-		if err == nil {
-			return p, nil
-		}
-		if !errors.Is(err, pgx.ErrNoRows) {
-			return models.Provider{}, err
-		}
-		err = r.db.QueryRow(ctx, `
-			SELECT provider_id, 'Auto-discovered ' || LEFT(provider_id, 8), 'donor', 'hostagent', network_mbps, (heartbeat_at >= NOW() - INTERVAL '60 seconds'), heartbeat_at
-			FROM host_resources
-			WHERE provider_id = $1
-		`, providerID).Scan(&p.ID, &p.DisplayName, &p.ProviderType, &p.MachineID, &p.NetworkMbps, &p.Online, &p.CreatedAt)
-		return p, err
-	}
-	err = r.db.QueryRow(ctx, `
-		SELECT id::text, display_name, provider_type, machine_id, network_mbps, online, created_at
-		FROM providers
-		WHERE id::text = $1
-	`, providerID).Scan(&p.ID, &p.DisplayName, &p.ProviderType, &p.MachineID, &p.NetworkMbps, &p.Online, &p.CreatedAt)
-	return p, err
+	return scanProvider(r.db.QueryRow(ctx, `SELECT `+providerColumns+` FROM (`+base+`) base`+presenceJoin+` WHERE base.id = $1`, providerID))
 }
 
 func (r *ProviderRepo) Stats(ctx context.Context) (models.AdminStats, error) {
 	var stats models.AdminStats
-	hasHostResources, err := r.tableExists(ctx, "host_resources")
+	base, err := r.providerBaseQuery(ctx)
 	if err != nil {
 		return models.AdminStats{}, err
 	}
-	query := `
+	err = r.db.QueryRow(ctx, `
 		SELECT
 			COUNT(*) AS total_providers,
-			COUNT(*) FILTER (WHERE online) AS online_providers,
-			COUNT(*) FILTER (WHERE provider_type = 'internal') AS internal_providers,
-			COUNT(*) FILTER (WHERE provider_type = 'donor') AS donor_providers
-		FROM providers
-	`
-	if hasHostResources {
-		query = `
-			WITH all_providers AS (
-				SELECT
-					p.id::text AS id,
-					p.provider_type,
-					COALESCE(hr.heartbeat_at >= NOW() - INTERVAL '60 seconds', p.online) AS online
-				FROM providers p
-				LEFT JOIN host_resources hr ON hr.provider_id = p.id::text
-				UNION ALL
-				SELECT
-					hr.provider_id AS id,
-					'donor' AS provider_type,
-					(hr.heartbeat_at >= NOW() - INTERVAL '60 seconds') AS online
-				FROM host_resources hr
-				WHERE NOT EXISTS (
-					SELECT 1 FROM providers p WHERE p.id::text = hr.provider_id
-				)
-			)
-			SELECT
-				COUNT(*) AS total_providers,
-				COUNT(*) FILTER (WHERE online) AS online_providers,
-				COUNT(*) FILTER (WHERE provider_type = 'internal') AS internal_providers,
-				COUNT(*) FILTER (WHERE provider_type = 'donor') AS donor_providers
-			FROM all_providers
-		`
-	}
-	err = r.db.QueryRow(ctx, query).Scan(&stats.TotalProviders, &stats.OnlineProviders, &stats.InternalCount, &stats.DonorCount)
+			COUNT(*) FILTER (WHERE COALESCE(ps.state = 'online', base.online)) AS online_providers,
+			COUNT(*) FILTER (WHERE ps.state = 'degraded') AS degraded_providers,
+			COUNT(*) FILTER (WHERE ps.state = 'offline' OR (ps.state IS NULL AND NOT base.online)) AS offline_providers,
+			COUNT(*) FILTER (WHERE flaps.recent_flaps >= $1) AS flapping_providers,
+			COUNT(*) FILTER (WHERE base.provider_type = 'internal') AS internal_providers,
+			COUNT(*) FILTER (WHERE base.provider_type = 'donor') AS donor_providers
+		FROM (`+base+`) base`+presenceJoin, flappingThreshold).Scan(
+		&stats.TotalProviders, &stats.OnlineProviders, &stats.DegradedProviders, &stats.OfflineProviders,
+		&stats.FlappingProviders, &stats.InternalCount, &stats.DonorCount,
+	)
 	return stats, err
 }
 
+// UpdatePresence stores a presence change pushed by resourceservice. Pushes
+// older than the stored change are ignored so retries and reordering are
+// harmless; it reports whether the change was applied.
+func (r *ProviderRepo) UpdatePresence(ctx context.Context, item models.ProviderPresence) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	var from models.PresenceState
+	var changedAt time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT state, changed_at FROM provider_presence_status WHERE provider_id = $1 FOR UPDATE
+	`, item.ProviderID).Scan(&from, &changedAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	}
+	if err == nil && !item.ChangedAt.After(changedAt) {
+		return false, nil
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO provider_presence_status (provider_id, state, reason, heartbeat_at, last_poll_at, changed_at, flap_count, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (provider_id) DO UPDATE SET
+			state = EXCLUDED.state,
+			reason = EXCLUDED.reason,
+			heartbeat_at = EXCLUDED.heartbeat_at,
+			last_poll_at = EXCLUDED.last_poll_at,
+			changed_at = EXCLUDED.changed_at,
+			flap_count = EXCLUDED.flap_count,
+			updated_at = NOW()
+		WHERE provider_presence_status.changed_at < EXCLUDED.changed_at
+	`, item.ProviderID, item.State, item.Reason, item.HeartbeatAt, item.LastPollAt, item.ChangedAt, item.FlapCount); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO provider_presence_transitions (provider_id, from_state, to_state, reason, changed_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (provider_id, changed_at) DO NOTHING
+	`, item.ProviderID, from, item.State, item.Reason, item.ChangedAt); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE providers SET online = $2 WHERE id::text = $1
+	`, item.ProviderID, item.State == models.PresenceOnline); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+func (r *ProviderRepo) ListPresenceEvents(ctx context.Context, providerID string, limit int) ([]models.ProviderPresenceEvent, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT provider_id, from_state, to_state, reason, changed_at
+		FROM provider_presence_transitions
+		WHERE provider_id = $1
+		ORDER BY changed_at DESC
+		LIMIT $2
+	`, providerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]models.ProviderPresenceEvent, 0)
+	for rows.Next() {
+		var item models.ProviderPresenceEvent
+		if err := rows.Scan(&item.ProviderID, &item.FromState, &item.ToState, &item.Reason, &item.ChangedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
 func (r *ProviderRepo) ProviderMetrics(ctx context.Context, providerID string) (models.ProviderMetrics, error) {
 	metrics := models.ProviderMetrics{ProviderID: providerID}
 
@@ -9,21 +9,57 @@ const (
 	ProviderTypeDonor    ProviderType = "donor"
 )
 
+type PresenceState string
+
+const (
+	PresenceOnline   PresenceState = "online"
+	PresenceDegraded PresenceState = "degraded"
+	PresenceOffline  PresenceState = "offline"
+)
+
 type Provider struct {
-	ID           string       `json:"id"`
-	DisplayName  string       `json:"display_name"`
-	ProviderType ProviderType `json:"provider_type"`
-	MachineID    string       `json:"machine_id"`
-	NetworkMbps  int          `json:"network_mbps"`
-	Online       bool         `json:"online"`
-	CreatedAt    time.Time    `json:"created_at"`
+	ID                string        `json:"id"`
+	DisplayName       string        `json:"display_name"`
+	ProviderType      ProviderType  `json:"provider_type"`
+	MachineID         string        `json:"machine_id"`
+	NetworkMbps       int           `json:"network_mbps"`
+	Online            bool          `json:"online"`
+	Presence          PresenceState `json:"presence,omitempty"`
+	PresenceReason    string        `json:"presence_reason,omitempty"`
+	PresenceChangedAt *time.Time    `json:"presence_changed_at,omitempty"`
+	FlapCount         int           `json:"flap_count"`
+	RecentFlaps       int           `json:"recent_flaps"`
+	CreatedAt         time.Time     `json:"created_at"`
 }
 
 type AdminStats struct {
-	TotalProviders  int `json:"total_providers"`
-	OnlineProviders int `json:"online_providers"`
-	InternalCount   int `json:"internal_providers"`
-	DonorCount      int `json:"donor_providers"`
+	TotalProviders    int `json:"total_providers"`
+	OnlineProviders   int `json:"online_providers"`
+	DegradedProviders int `json:"degraded_providers"`
+	OfflineProviders  int `json:"offline_providers"`
+	FlappingProviders int `json:"flapping_providers"`
+	InternalCount     int `json:"internal_providers"`
+	DonorCount        int `json:"donor_providers"`
+}
+
+// ProviderPresence is the presence change resourceservice pushes whenever a
+// provider moves between online, degraded and offline.
+type ProviderPresence struct {
+	ProviderID  string        `json:"provider_id"`
+	State       PresenceState `json:"state"`
+	Reason      string        `json:"reason"`
+	HeartbeatAt *time.Time    `json:"heartbeat_at,omitempty"`
+	LastPollAt  *time.Time    `json:"last_poll_at,omitempty"`
+	ChangedAt   time.Time     `json:"changed_at"`
+	FlapCount   int           `json:"flap_count"`
+}
+
+type ProviderPresenceEvent struct {
+	ProviderID string        `json:"provider_id"`
+	FromState  PresenceState `json:"from_state"`
+	ToState    PresenceState `json:"to_state"`
+	Reason     string        `json:"reason"`
+	ChangedAt  time.Time     `json:"changed_at"`
 }
 
 type ProviderMetrics struct {
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"strings"
 
 	"github.com/MidasWR/ShareMTC/services/adminservice/internal/models"
@@ -17,6 +18,8 @@ type ProviderRepository interface {
 	GetByID(ctx context.Context, providerID string) (models.Provider, error)
 	Stats(ctx context.Context) (models.AdminStats, error)
 	ProviderMetrics(ctx context.Context, providerID string) (models.ProviderMetrics, error)
+	UpdatePresence(ctx context.Context, item models.ProviderPresence) (bool, error)
+	ListPresenceEvents(ctx context.Context, providerID string, limit int) ([]models.ProviderPresenceEvent, error)
 	ListPodCatalog(ctx context.Context) ([]models.PodCatalogItem, error)
 	UpsertPodCatalog(ctx context.Context, item models.PodCatalogItem) (models.PodCatalogItem, error)
 	DeletePodCatalog(ctx context.Context, id string) error
@@ -71,6 +74,41 @@ func (s *ProviderService) ProviderMetrics(ctx context.Context, providerID string
 	return s.repo.ProviderMetrics(ctx, providerID)
 }
 
+// UpdatePresence applies a presence change pushed by resourceservice and
+// registers donors that were only known from their heartbeats.
+func (s *ProviderService) UpdatePresence(ctx context.Context, item models.ProviderPresence) error {
+	item.ProviderID = strings.TrimSpace(item.ProviderID)
+	if item.ProviderID == "" {
+		return errors.New("provider_id is required")
+	}
+	switch item.State {
+	case models.PresenceOnline, models.PresenceDegraded, models.PresenceOffline:
+	default:
+		return errors.New("state must be online, degraded or offline")
+	}
+	if item.ChangedAt.IsZero() {
+		return errors.New("changed_at is required")
+	}
+	if err := s.EnsureProvider(ctx, item.ProviderID); err != nil {
+		return err
+	}
+	applied, err := s.repo.UpdatePresence(ctx, item)
+	if err != nil {
+		return err
+	}
+	if applied {
+		log.Info().Str("provider_id", item.ProviderID).Str("state", string(item.State)).Str("reason", item.Reason).Msg("provider presence updated")
+	}
+	return nil
+}
+
+func (s *ProviderService) ListPresenceEvents(ctx context.Context, providerID string, limit int) ([]models.ProviderPresenceEvent, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListPresenceEvents(ctx, providerID, limit)
+}
+
 func (s *ProviderService) ListPodCatalog(ctx context.Context) ([]models.PodCatalogItem, error) {
 	log.Debug().Msg("listing pod catalog")
 	items, err := s.repo.ListPodCatalog(ctx)
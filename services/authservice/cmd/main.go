@@ -57,7 +57,7 @@ func main() {
 
 	svc := service.New(repo, cfg.JWTSecret, time.Duration(cfg.TokenTTLMinutes)*time.Minute)
 	logger.Info().Msg("auth service initialized")
-	handler := httpadapter.NewHandler(svc, logger, cfg.GoogleClientID, cfg.GoogleSecret, cfg.GoogleRedirect, cfg.FrontendBaseURL, cfg.JWTSecret)
+	handler := httpadapter.NewHandler(svc, logger, cfg.GoogleClientID, cfg.GoogleSecret, cfg.GoogleRedirect, cfg.FrontendBaseURL, cfg.JWTSecret, cfg.ServiceToken)
 	logger.Info().Str("google_redirect", cfg.GoogleRedirect).Msg("auth http handler initialized")
 
 	r := chi.NewRouter()
@@ -69,6 +69,7 @@ func main() {
 		api.Post("/admin/direct", handler.DirectAdminLogin)
 		api.Get("/google/start", handler.GoogleStart)
 		api.Get("/google/callback", handler.GoogleCallback)
+		api.With(handler.ServiceAuth).Get("/internal/users/lookup", handler.LookupUser)
 		api.Group(func(secure chi.Router) {
 			secure.Use(sdkauth.RequireAuth(cfg.JWTSecret))
 			secure.Get("/settings", handler.GetSettings)
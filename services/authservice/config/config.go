@@ -18,6 +18,7 @@ type Config struct {
 	MidasWriterAddr string
 	MidasWriterTLS  bool
 	TokenTTLMinutes int
+	ServiceToken    string
 }
 
 func Load() Config {
@@ -32,6 +33,7 @@ func Load() Config {
 		MidasWriterAddr: os.Getenv("MIDAS_WRITER_ADDR"),
 		MidasWriterTLS:  envBool("MIDAS_WRITER_TLS", false),
 		TokenTTLMinutes: envInt("TOKEN_TTL_MINUTES", 1440),
+		ServiceToken:    env("AUTH_SERVICE_TOKEN", "change-me-in-production"),
 	}
 }
 
@@ -31,14 +31,16 @@ type Handler struct {
 	oauth            *oauth2.Config
 	frontendBaseURL  string
 	oauthStateSecret string
+	serviceToken     string
 }
 
-func NewHandler(auth *service.AuthService, logger zerolog.Logger, googleClientID string, googleSecret string, redirectURL string, frontendBaseURL string, oauthStateSecret string) *Handler {
+func NewHandler(auth *service.AuthService, logger zerolog.Logger, googleClientID string, googleSecret string, redirectURL string, frontendBaseURL string, oauthStateSecret string, serviceToken string) *Handler {
 	return &Handler{
 		auth:             auth,
 		log:              logger,
 		frontendBaseURL:  strings.TrimRight(frontendBaseURL, "/"),
 		oauthStateSecret: oauthStateSecret,
+		serviceToken:     strings.TrimSpace(serviceToken),
 		oauth: &oauth2.Config{
 			ClientID:     googleClientID,
 			ClientSecret: googleSecret,
@@ -218,6 +220,34 @@ func (h *Handler) buildFrontendRedirect(token string, user string, section strin
 	return redirectURL.String()
 }
 
+func (h *Handler) ServiceAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.serviceToken == "" {
+			httpx.Error(w, http.StatusInternalServerError, "service token is not configured")
+			return
+		}
+		token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+		if token == "" || !hmac.Equal([]byte(token), []byte(h.serviceToken)) {
+			httpx.Error(w, http.StatusUnauthorized, "invalid service token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) LookupUser(w http.ResponseWriter, r *http.Request) {
+	user, err := h.auth.LookupUserByEmail(r.Context(), r.URL.Query().Get("email"))
+	if err != nil {
+		if err.Error() == "user not found" {
+			httpx.Error(w, http.StatusNotFound, err.Error())
+			return
+		}
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, map[string]string{"id": user.ID, "email": user.Email})
+}
+
 func (h *Handler) Health(w http.ResponseWriter, _ *http.Request) {
 	httpx.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
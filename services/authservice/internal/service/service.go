@@ -162,3 +162,20 @@ func (s *AuthService) DeleteSSHKey(ctx context.Context, userID string, keyID str
 	log.Info().Str("user_id", userID).Str("key_id", keyID).Msg("deleting ssh key")
 	return s.repo.DeleteSSHKey(ctx, userID, keyID)
 }
+
+// LookupUserByEmail resolves an account for other services, e.g. resource share
+// invites addressed by email.
+func (s *AuthService) LookupUserByEmail(ctx context.Context, email string) (models.User, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return models.User{}, errors.New("email is required")
+	}
+	user, err := s.repo.GetByEmail(ctx, email)
+	if err != nil {
+		return models.User{}, err
+	}
+	if user.ID == "" {
+		return models.User{}, errors.New("user not found")
+	}
+	return user, nil
+}
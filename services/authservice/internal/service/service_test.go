@@ -76,3 +76,22 @@ func TestRegisterAndLogin(t *testing.T) {
 		t.Fatal("token must not be empty")
 	}
 }
+
+func TestLookupUserByEmail(t *testing.T) {
+	repo := &authRepoStub{users: make(map[string]models.User)}
+	svc := New(repo, "secret", time.Hour)
+	if _, _, err := svc.Register(context.Background(), "friend@mail.com", "pass123"); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	user, err := svc.LookupUserByEmail(context.Background(), "  Friend@Mail.com ")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if user.ID != "u1" {
+		t.Fatalf("expected u1, got %q", user.ID)
+	}
+	if _, err := svc.LookupUserByEmail(context.Background(), "nobody@mail.com"); err == nil {
+		t.Fatal("expected not found error")
+	}
+}
@@ -45,25 +45,38 @@ func main() {
 	logger.Info().Msg("billing database migrations applied")
 	svc := service.New(repo)
 	logger.Info().Msg("billing service initialized")
-	handler := httpadapter.NewHandler(svc)
+	handler := httpadapter.NewHandler(svc, cfg.ServiceToken)
 	logger.Info().Msg("billing http handler initialized")
 
 	r := chi.NewRouter()
 	r.Use(httpx.RequestLogger(logger))
 	r.Get("/healthz", handler.Health)
 	r.Route("/v1/billing", func(api chi.Router) {
-		api.Use(sdkauth.RequireAuth(cfg.JWTSecret))
-		api.Post("/plans", handler.CreatePlan)
-		api.Post("/usage", handler.ProcessUsage)
-		api.Get("/accruals", handler.ListAccruals)
-		api.Get("/rental/plans", handler.ListRentalPlans)
-		api.Post("/rental/estimate", handler.EstimateServerOrder)
-		api.Post("/rental/orders", handler.CreateServerOrder)
-		api.Get("/rental/orders", handler.ListServerOrders)
-		api.Group(func(admin chi.Router) {
-			admin.Use(sdkauth.RequireAnyRole("admin", "super-admin", "ops-admin"))
-			admin.Get("/admin/accruals", handler.ListAllAccruals)
-			admin.Get("/admin/stats", handler.Stats)
+		api.Route("/internal", func(internal chi.Router) {
+			internal.Use(handler.ServiceAuth)
+			internal.Post("/rentals", handler.StartMeteredRental)
+			internal.Post("/rentals/{rentalID}/stop", handler.StopMeteredRental)
+			internal.Post("/rentals/{rentalID}/refund", handler.RefundMeteredRental)
+			internal.Post("/rentals/by-reference/{referenceID}/stop", handler.StopMeteredRentalByReference)
+			internal.Post("/credits", handler.IssueCredit)
+		})
+		api.Group(func(secure chi.Router) {
+			secure.Use(sdkauth.RequireAuth(cfg.JWTSecret))
+			secure.Post("/plans", handler.CreatePlan)
+			secure.Post("/usage", handler.ProcessUsage)
+			secure.Get("/accruals", handler.ListAccruals)
+			secure.Get("/rentals", handler.ListMeteredRentals)
+			secure.Get("/credits", handler.ListCredits)
+			secure.Get("/rental/plans", handler.ListRentalPlans)
+			secure.Post("/rental/estimate", handler.EstimateServerOrder)
+			secure.Post("/rental/orders", handler.CreateServerOrder)
+			secure.Get("/rental/orders", handler.ListServerOrders)
+			secure.Group(func(admin chi.Router) {
+				admin.Use(sdkauth.RequireAnyRole("admin", "super-admin", "ops-admin"))
+				admin.Get("/admin/accruals", handler.ListAllAccruals)
+				admin.Get("/admin/stats", handler.Stats)
+				admin.Get("/admin/credits", handler.ListAllCredits)
+			})
 		})
 	})
 
@@ -11,6 +11,7 @@ type Config struct {
 	PostgresDSN     string
 	MidasWriterAddr string
 	JWTSecret       string
+	ServiceToken    string
 }
 
 func Load() Config {
@@ -19,6 +20,7 @@ func Load() Config {
 		PostgresDSN:     postgresDSN(),
 		MidasWriterAddr: os.Getenv("MIDAS_WRITER_ADDR"),
 		JWTSecret:       env("JWT_SECRET", "change-me-in-production"),
+		ServiceToken:    env("BILLING_SERVICE_TOKEN", "change-me-in-production"),
 	}
 }
 
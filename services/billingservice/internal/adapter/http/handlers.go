@@ -1,22 +1,26 @@
 package httpadapter
 
 import (
+	"crypto/hmac"
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/MidasWR/ShareMTC/services/billingservice/internal/models"
 	"github.com/MidasWR/ShareMTC/services/billingservice/internal/service"
 	sdkauth "github.com/MidasWR/ShareMTC/services/sdk/auth"
 	"github.com/MidasWR/ShareMTC/services/sdk/httpx"
+	"github.com/go-chi/chi/v5"
 )
 
 type Handler struct {
-	svc *service.BillingService
+	svc          *service.BillingService
+	serviceToken string
 }
 
-func NewHandler(svc *service.BillingService) *Handler {
-	return &Handler{svc: svc}
+func NewHandler(svc *service.BillingService, serviceToken string) *Handler {
+	return &Handler{svc: svc, serviceToken: strings.TrimSpace(serviceToken)}
 }
 
 func (h *Handler) CreatePlan(w http.ResponseWriter, r *http.Request) {
@@ -151,3 +155,122 @@ func (h *Handler) ListServerOrders(w http.ResponseWriter, r *http.Request) {
 	}
 	httpx.JSON(w, http.StatusOK, orders)
 }
+
+func (h *Handler) ServiceAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.serviceToken == "" {
+			httpx.Error(w, http.StatusInternalServerError, "service token is not configured")
+			return
+		}
+		token := strings.TrimSpace(r.Header.Get("X-Service-Token"))
+		if token == "" || !hmac.Equal([]byte(token), []byte(h.serviceToken)) {
+			httpx.Error(w, http.StatusUnauthorized, "invalid service token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) StartMeteredRental(w http.ResponseWriter, r *http.Request) {
+	var req models.MeteredRental
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.StartMeteredRental(r.Context(), req)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) StopMeteredRental(w http.ResponseWriter, r *http.Request) {
+	item, err := h.svc.StopMeteredRental(r.Context(), chi.URLParam(r, "rentalID"))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) StopMeteredRentalByReference(w http.ResponseWriter, r *http.Request) {
+	item, err := h.svc.StopMeteredRentalByReference(r.Context(), chi.URLParam(r, "referenceID"))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+type refundRequest struct {
+	AmountUSD float64 `json:"amount_usd"`
+}
+
+func (h *Handler) RefundMeteredRental(w http.ResponseWriter, r *http.Request) {
+	var req refundRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.Error(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	item, err := h.svc.RefundMeteredRental(r.Context(), chi.URLParam(r, "rentalID"), req.AmountUSD)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) ListMeteredRentals(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListMeteredRentals(r.Context(), claims.UserID)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) IssueCredit(w http.ResponseWriter, r *http.Request) {
+	var req models.Credit
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.IssueCredit(r.Context(), req)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListCredits(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListCredits(r.Context(), claims.UserID)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListAllCredits(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	items, err := h.svc.ListAllCredits(r.Context(), limit)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
@@ -2,9 +2,11 @@ package storage
 
 import (
 	"context"
+	"errors"
 
 	"github.com/MidasWR/ShareMTC/services/billingservice/internal/models"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -76,6 +78,39 @@ func (r *Repo) Migrate(ctx context.Context) error {
 		);
 		ALTER TABLE server_orders ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '';
 		ALTER TABLE server_orders ADD COLUMN IF NOT EXISTS vm_id TEXT NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS metered_rentals (
+			id UUID PRIMARY KEY,
+			reference_id TEXT NOT NULL UNIQUE,
+			user_id TEXT NOT NULL,
+			provider_id TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			price_hourly_usd DOUBLE PRECISION NOT NULL,
+			status TEXT NOT NULL DEFAULT 'running',
+			started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			stopped_at TIMESTAMPTZ,
+			charged_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+			refunded_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_metered_rentals_user ON metered_rentals(user_id, created_at DESC);
+		CREATE TABLE IF NOT EXISTS credits (
+			id UUID PRIMARY KEY,
+			reference_id TEXT NOT NULL UNIQUE,
+			user_id TEXT NOT NULL,
+			provider_id TEXT NOT NULL DEFAULT '',
+			resource_type TEXT NOT NULL DEFAULT '',
+			resource_id TEXT NOT NULL DEFAULT '',
+			rental_id TEXT NOT NULL DEFAULT '',
+			period_start TIMESTAMPTZ NOT NULL,
+			period_end TIMESTAMPTZ NOT NULL,
+			credit_pct DOUBLE PRECISION NOT NULL,
+			basis_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+			amount_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+			reason TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_credits_user ON credits(user_id, created_at DESC);
 	`)
 	if err != nil {
 		return err
@@ -174,9 +209,10 @@ func (r *Repo) Stats(ctx context.Context) (models.BillingStats, error) {
 			COUNT(*) AS accrual_count,
 			COALESCE(SUM(amount_usd), 0) AS total_amount_usd,
 			COALESCE(SUM(vip_bonus_usd), 0) AS total_bonus_usd,
-			COALESCE(SUM(total_usd), 0) AS total_revenue_usd
+			COALESCE(SUM(total_usd), 0) AS total_revenue_usd,
+			(SELECT COALESCE(SUM(amount_usd), 0) FROM credits) AS total_credits_usd
 		FROM accruals
-	`).Scan(&stats.AccrualCount, &stats.TotalAmountUSD, &stats.TotalBonusUSD, &stats.TotalRevenueUSD)
+	`).Scan(&stats.AccrualCount, &stats.TotalAmountUSD, &stats.TotalBonusUSD, &stats.TotalRevenueUSD, &stats.TotalCreditsUSD)
 	return stats, err
 }
 
@@ -278,6 +314,187 @@ func (r *Repo) ListServerOrders(ctx context.Context, userID string) ([]models.Se
 	return items, nil
 }
 
+// ListServerOrdersForResource returns the orders a user placed for one VM or
+// pod.
+func (r *Repo) ListServerOrdersForResource(ctx context.Context, userID string, resourceID string) ([]models.ServerOrder, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, user_id, plan_id, name, vm_id, os_name, network_mbps, cpu_cores, ram_gb, gpu_units, period, estimated_price_usd, status, created_at
+		FROM server_orders
+		WHERE user_id = $1 AND vm_id = $2
+		ORDER BY created_at
+	`, userID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]models.ServerOrder, 0)
+	for rows.Next() {
+		var item models.ServerOrder
+		if err := rows.Scan(
+			&item.ID,
+			&item.UserID,
+			&item.PlanID,
+			&item.Name,
+			&item.VMID,
+			&item.OSName,
+			&item.NetworkMbps,
+			&item.CPUCores,
+			&item.RAMGB,
+			&item.GPUUnits,
+			&item.Period,
+			&item.EstimatedPrice,
+			&item.Status,
+			&item.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+const meteredRentalColumns = `id, reference_id, user_id, provider_id, description, price_hourly_usd, status, started_at, stopped_at, charged_usd, refunded_usd, created_at, updated_at`
+
+func scanMeteredRental(row pgx.Row) (models.MeteredRental, error) {
+	var item models.MeteredRental
+	err := row.Scan(
+		&item.ID,
+		&item.ReferenceID,
+		&item.UserID,
+		&item.ProviderID,
+		&item.Description,
+		&item.PriceHourly,
+		&item.Status,
+		&item.StartedAt,
+		&item.StoppedAt,
+		&item.ChargedUSD,
+		&item.RefundedUSD,
+		&item.CreatedAt,
+		&item.UpdatedAt,
+	)
+	return item, err
+}
+
+// CreateMeteredRental is idempotent on reference_id: starting the same
+// reference twice returns the rental created first.
+func (r *Repo) CreateMeteredRental(ctx context.Context, item models.MeteredRental) (models.MeteredRental, error) {
+	return scanMeteredRental(r.db.QueryRow(ctx, `
+		INSERT INTO metered_rentals (id, reference_id, user_id, provider_id, description, price_hourly_usd, status, started_at)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+		ON CONFLICT (reference_id) DO UPDATE SET reference_id = EXCLUDED.reference_id
+		RETURNING `+meteredRentalColumns,
+		uuid.NewString(), item.ReferenceID, item.UserID, item.ProviderID, item.Description, item.PriceHourly, item.Status, item.StartedAt,
+	))
+}
+
+func (r *Repo) GetMeteredRental(ctx context.Context, rentalID string) (models.MeteredRental, error) {
+	return scanMeteredRental(r.db.QueryRow(ctx, `SELECT `+meteredRentalColumns+` FROM metered_rentals WHERE id = $1`, rentalID))
+}
+
+func (r *Repo) FindMeteredRentalByReference(ctx context.Context, referenceID string) (models.MeteredRental, bool, error) {
+	item, err := scanMeteredRental(r.db.QueryRow(ctx, `SELECT `+meteredRentalColumns+` FROM metered_rentals WHERE reference_id = $1`, referenceID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.MeteredRental{}, false, nil
+	}
+	return item, err == nil, err
+}
+
+func (r *Repo) UpdateMeteredRental(ctx context.Context, item models.MeteredRental) (models.MeteredRental, error) {
+	return scanMeteredRental(r.db.QueryRow(ctx, `
+		UPDATE metered_rentals
+		SET status = $2,
+		    stopped_at = $3,
+		    charged_usd = $4,
+		    refunded_usd = $5,
+		    updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+meteredRentalColumns,
+		item.ID, item.Status, item.StoppedAt, item.ChargedUSD, item.RefundedUSD,
+	))
+}
+
+func (r *Repo) ListMeteredRentals(ctx context.Context, userID string) ([]models.MeteredRental, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+meteredRentalColumns+`
+		FROM metered_rentals
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]models.MeteredRental, 0)
+	for rows.Next() {
+		item, err := scanMeteredRental(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+const creditColumns = `id, reference_id, user_id, provider_id, resource_type, resource_id, rental_id, period_start, period_end, credit_pct, basis_usd, amount_usd, reason, created_at`
+
+func scanCredit(row pgx.Row) (models.Credit, error) {
+	var item models.Credit
+	err := row.Scan(
+		&item.ID,
+		&item.ReferenceID,
+		&item.UserID,
+		&item.ProviderID,
+		&item.ResourceType,
+		&item.ResourceID,
+		&item.RentalID,
+		&item.PeriodStart,
+		&item.PeriodEnd,
+		&item.CreditPct,
+		&item.BasisUSD,
+		&item.AmountUSD,
+		&item.Reason,
+		&item.CreatedAt,
+	)
+	return item, err
+}
+
+// CreateCredit is idempotent on reference_id: issuing the same reference twice
+// returns the credit created first.
+func (r *Repo) CreateCredit(ctx context.Context, item models.Credit) (models.Credit, error) {
+	return scanCredit(r.db.QueryRow(ctx, `
+		INSERT INTO credits (id, reference_id, user_id, provider_id, resource_type, resource_id, rental_id, period_start, period_end, credit_pct, basis_usd, amount_usd, reason)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+		ON CONFLICT (reference_id) DO UPDATE SET reference_id = EXCLUDED.reference_id
+		RETURNING `+creditColumns,
+		uuid.NewString(), item.ReferenceID, item.UserID, item.ProviderID, item.ResourceType, item.ResourceID, item.RentalID,
+		item.PeriodStart, item.PeriodEnd, item.CreditPct, item.BasisUSD, item.AmountUSD, item.Reason,
+	))
+}
+
+// ListCredits returns a user's credits, or every credit when userID is empty.
+func (r *Repo) ListCredits(ctx context.Context, userID string, limit int) ([]models.Credit, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+creditColumns+`
+		FROM credits
+		WHERE ($1 = '' OR user_id = $1)
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]models.Credit, 0)
+	for rows.Next() {
+		item, err := scanCredit(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
 func (r *Repo) seedRentalPlans(ctx context.Context) error {
 	var count int
 	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM rental_plans`).Scan(&count); err != nil {
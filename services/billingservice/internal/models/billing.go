@@ -39,6 +39,7 @@ type BillingStats struct {
 	TotalAmountUSD  float64 `json:"total_amount_usd"`
 	TotalBonusUSD   float64 `json:"total_bonus_usd"`
 	TotalRevenueUSD float64 `json:"total_revenue_usd"`
+	TotalCreditsUSD float64 `json:"total_credits_usd"`
 }
 
 type RentalPlan struct {
@@ -58,7 +59,7 @@ type ServerOrder struct {
 	UserID         string    `json:"user_id"`
 	PlanID         string    `json:"plan_id"`
 	Name           string    `json:"name"`
-	VMID           string    `json:"vm_id"`
+	VMID           string    `json:"vm_id"` // the VM or pod the order pays for
 	OSName         string    `json:"os_name"`
 	NetworkMbps    int       `json:"network_mbps"`
 	CPUCores       int       `json:"cpu_cores"`
@@ -69,3 +70,49 @@ type ServerOrder struct {
 	Status         string    `json:"status"`
 	CreatedAt      time.Time `json:"created_at"`
 }
+
+type MeteredRentalStatus string
+
+const (
+	MeteredRentalRunning MeteredRentalStatus = "running"
+	MeteredRentalStopped MeteredRentalStatus = "stopped"
+)
+
+type MeteredRental struct {
+	ID          string              `json:"id"`
+	ReferenceID string              `json:"reference_id"`
+	UserID      string              `json:"user_id"`
+	ProviderID  string              `json:"provider_id"`
+	Description string              `json:"description"`
+	PriceHourly float64             `json:"price_hourly_usd"`
+	Status      MeteredRentalStatus `json:"status"`
+	StartedAt   time.Time           `json:"started_at"`
+	StoppedAt   *time.Time          `json:"stopped_at,omitempty"`
+	ChargedUSD  float64             `json:"charged_usd"`
+	RefundedUSD float64             `json:"refunded_usd"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+}
+
+// Credit is money given back to a user, such as for a missed uptime SLA. The
+// amount is credit_pct of what the user was charged for the resource or
+// rental during the period.
+type Credit struct {
+	ID           string    `json:"id"`
+	ReferenceID  string    `json:"reference_id"`
+	UserID       string    `json:"user_id"`
+	ProviderID   string    `json:"provider_id"`
+	ResourceType string    `json:"resource_type"`
+	ResourceID   string    `json:"resource_id"`
+	RentalID     string    `json:"rental_id,omitempty"`
+	PeriodStart  time.Time `json:"period_start"`
+	PeriodEnd    time.Time `json:"period_end"`
+	// ResourceEndedAt is when the credited VM or pod was terminated. It caps
+	// hourly charges and is not stored.
+	ResourceEndedAt *time.Time `json:"resource_ended_at,omitempty"`
+	CreditPct       float64    `json:"credit_pct"`
+	BasisUSD        float64    `json:"basis_usd"`
+	AmountUSD       float64    `json:"amount_usd"`
+	Reason          string     `json:"reason"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
@@ -3,6 +3,8 @@ package service
 import (
 	"context"
 	"errors"
+	"math"
+	"time"
 
 	"github.com/MidasWR/ShareMTC/services/billingservice/internal/models"
 	"github.com/rs/zerolog/log"
@@ -20,6 +22,14 @@ type Repository interface {
 	GetRentalPlan(ctx context.Context, planID string) (models.RentalPlan, error)
 	CreateServerOrder(ctx context.Context, order models.ServerOrder) (models.ServerOrder, error)
 	ListServerOrders(ctx context.Context, userID string) ([]models.ServerOrder, error)
+	CreateMeteredRental(ctx context.Context, item models.MeteredRental) (models.MeteredRental, error)
+	GetMeteredRental(ctx context.Context, rentalID string) (models.MeteredRental, error)
+	FindMeteredRentalByReference(ctx context.Context, referenceID string) (models.MeteredRental, bool, error)
+	UpdateMeteredRental(ctx context.Context, item models.MeteredRental) (models.MeteredRental, error)
+	ListMeteredRentals(ctx context.Context, userID string) ([]models.MeteredRental, error)
+	ListServerOrdersForResource(ctx context.Context, userID string, resourceID string) ([]models.ServerOrder, error)
+	CreateCredit(ctx context.Context, item models.Credit) (models.Credit, error)
+	ListCredits(ctx context.Context, userID string, limit int) ([]models.Credit, error)
 }
 
 type BillingService struct {
@@ -140,3 +150,200 @@ func (s *BillingService) CreateServerOrder(ctx context.Context, order models.Ser
 func (s *BillingService) ListServerOrders(ctx context.Context, userID string) ([]models.ServerOrder, error) {
 	return s.repo.ListServerOrders(ctx, userID)
 }
+
+func meteredCharge(item models.MeteredRental, until time.Time) float64 {
+	hours := until.Sub(item.StartedAt).Hours()
+	if hours < 0 {
+		hours = 0
+	}
+	return math.Round(hours*item.PriceHourly*100) / 100
+}
+
+// StartMeteredRental opens an hourly meter for a booking made in another
+// service. The reference id makes retries safe.
+func (s *BillingService) StartMeteredRental(ctx context.Context, item models.MeteredRental) (models.MeteredRental, error) {
+	log.Info().Str("reference_id", item.ReferenceID).Str("user_id", item.UserID).Float64("price_hourly", item.PriceHourly).Msg("starting metered rental")
+	if item.ReferenceID == "" || item.UserID == "" || item.ProviderID == "" {
+		return models.MeteredRental{}, errors.New("reference_id, user_id and provider_id are required")
+	}
+	if item.PriceHourly < 0 {
+		return models.MeteredRental{}, errors.New("price_hourly_usd must not be negative")
+	}
+	item.Status = models.MeteredRentalRunning
+	if item.StartedAt.IsZero() {
+		item.StartedAt = time.Now().UTC()
+	}
+	return s.repo.CreateMeteredRental(ctx, item)
+}
+
+// StopMeteredRental closes the meter and fixes the charge for the elapsed time.
+// Stopping an already stopped rental returns it unchanged.
+func (s *BillingService) StopMeteredRental(ctx context.Context, rentalID string) (models.MeteredRental, error) {
+	item, err := s.repo.GetMeteredRental(ctx, rentalID)
+	if err != nil {
+		return models.MeteredRental{}, err
+	}
+	if item.Status == models.MeteredRentalStopped {
+		return item, nil
+	}
+	now := time.Now().UTC()
+	item.Status = models.MeteredRentalStopped
+	item.StoppedAt = &now
+	item.ChargedUSD = meteredCharge(item, now)
+	updated, err := s.repo.UpdateMeteredRental(ctx, item)
+	if err != nil {
+		log.Error().Err(err).Str("rental_id", rentalID).Msg("stop metered rental failed on update")
+		return models.MeteredRental{}, err
+	}
+	log.Info().Str("rental_id", rentalID).Float64("charged_usd", updated.ChargedUSD).Msg("metered rental stopped")
+	return updated, nil
+}
+
+// StopMeteredRentalByReference stops the rental started for a reference, for
+// callers that lost the response of the start. It returns an empty rental when
+// the reference never started one.
+func (s *BillingService) StopMeteredRentalByReference(ctx context.Context, referenceID string) (models.MeteredRental, error) {
+	if referenceID == "" {
+		return models.MeteredRental{}, errors.New("reference_id is required")
+	}
+	item, found, err := s.repo.FindMeteredRentalByReference(ctx, referenceID)
+	if err != nil || !found {
+		return models.MeteredRental{}, err
+	}
+	return s.StopMeteredRental(ctx, item.ID)
+}
+
+// RefundMeteredRental stops the rental if needed and refunds amountUSD of its
+// charge. A non-positive amount refunds everything not refunded yet.
+func (s *BillingService) RefundMeteredRental(ctx context.Context, rentalID string, amountUSD float64) (models.MeteredRental, error) {
+	item, err := s.StopMeteredRental(ctx, rentalID)
+	if err != nil {
+		return models.MeteredRental{}, err
+	}
+	remaining := item.ChargedUSD - item.RefundedUSD
+	if amountUSD <= 0 {
+		amountUSD = remaining
+	}
+	if amountUSD > remaining+1e-9 {
+		return models.MeteredRental{}, errors.New("refund exceeds charged amount")
+	}
+	item.RefundedUSD += amountUSD
+	updated, err := s.repo.UpdateMeteredRental(ctx, item)
+	if err != nil {
+		log.Error().Err(err).Str("rental_id", rentalID).Msg("refund metered rental failed on update")
+		return models.MeteredRental{}, err
+	}
+	log.Info().Str("rental_id", rentalID).Float64("refunded_usd", amountUSD).Msg("metered rental refunded")
+	return updated, nil
+}
+
+func (s *BillingService) ListMeteredRentals(ctx context.Context, userID string) ([]models.MeteredRental, error) {
+	items, err := s.repo.ListMeteredRentals(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	for i := range items {
+		if items[i].Status == models.MeteredRentalRunning {
+			items[i].ChargedUSD = meteredCharge(items[i], now)
+		}
+	}
+	return items, nil
+}
+
+// IssueCredit gives a user credit_pct of what they were charged for a rental
+// or VM during the period. Retrying with the same reference id returns the
+// credit issued first.
+func (s *BillingService) IssueCredit(ctx context.Context, item models.Credit) (models.Credit, error) {
+	log.Info().Str("reference_id", item.ReferenceID).Str("user_id", item.UserID).Float64("credit_pct", item.CreditPct).Msg("issuing credit")
+	if item.ReferenceID == "" || item.UserID == "" {
+		return models.Credit{}, errors.New("reference_id and user_id are required")
+	}
+	if item.CreditPct <= 0 || item.CreditPct > 100 {
+		return models.Credit{}, errors.New("credit_pct must be between 0 and 100")
+	}
+	if !item.PeriodEnd.After(item.PeriodStart) {
+		return models.Credit{}, errors.New("period_end must be after period_start")
+	}
+	basis, err := s.creditBasis(ctx, item)
+	if err != nil {
+		log.Error().Err(err).Str("reference_id", item.ReferenceID).Msg("issue credit failed on basis")
+		return models.Credit{}, err
+	}
+	item.BasisUSD = basis
+	item.AmountUSD = math.Round(basis*item.CreditPct) / 100
+	created, err := s.repo.CreateCredit(ctx, item)
+	if err != nil {
+		log.Error().Err(err).Str("reference_id", item.ReferenceID).Msg("issue credit failed on create")
+		return models.Credit{}, err
+	}
+	log.Info().Str("credit_id", created.ID).Str("user_id", created.UserID).Float64("amount_usd", created.AmountUSD).Msg("credit issued")
+	return created, nil
+}
+
+// creditBasis is what the user was charged for the credited rental, VM or pod
+// within the period. Hourly charges count the hours that overlap the period,
+// up to when the rental stopped or the resource ended. A monthly order covers
+// the month from its creation and counts by the share of that month that
+// falls in the period.
+func (s *BillingService) creditBasis(ctx context.Context, item models.Credit) (float64, error) {
+	if item.RentalID != "" {
+		rental, err := s.repo.GetMeteredRental(ctx, item.RentalID)
+		if err != nil {
+			return 0, err
+		}
+		if rental.UserID != item.UserID {
+			return 0, errors.New("rental does not belong to user")
+		}
+		end := item.PeriodEnd
+		if rental.StoppedAt != nil && rental.StoppedAt.Before(end) {
+			end = *rental.StoppedAt
+		}
+		return math.Round(overlapHours(rental.StartedAt, end, item.PeriodStart, item.PeriodEnd)*rental.PriceHourly*100) / 100, nil
+	}
+	if (item.ResourceType != "vm" && item.ResourceType != "pod") || item.ResourceID == "" {
+		return 0, nil
+	}
+	orders, err := s.repo.ListServerOrdersForResource(ctx, item.UserID, item.ResourceID)
+	if err != nil {
+		return 0, err
+	}
+	end := item.PeriodEnd
+	if item.ResourceEndedAt != nil && item.ResourceEndedAt.Before(end) {
+		end = *item.ResourceEndedAt
+	}
+	basis := 0.0
+	for _, order := range orders {
+		if order.Period == "hourly" {
+			basis += overlapHours(order.CreatedAt, end, item.PeriodStart, item.PeriodEnd) * order.EstimatedPrice
+			continue
+		}
+		windowEnd := order.CreatedAt.AddDate(0, 1, 0)
+		basis += overlapHours(order.CreatedAt, windowEnd, item.PeriodStart, item.PeriodEnd) / windowEnd.Sub(order.CreatedAt).Hours() * order.EstimatedPrice
+	}
+	return math.Round(basis*100) / 100, nil
+}
+
+func overlapHours(from time.Time, to time.Time, periodStart time.Time, periodEnd time.Time) float64 {
+	if from.Before(periodStart) {
+		from = periodStart
+	}
+	if to.After(periodEnd) {
+		to = periodEnd
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from).Hours()
+}
+
+func (s *BillingService) ListCredits(ctx context.Context, userID string) ([]models.Credit, error) {
+	return s.repo.ListCredits(ctx, userID, 500)
+}
+
+func (s *BillingService) ListAllCredits(ctx context.Context, limit int) ([]models.Credit, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 200
+	}
+	return s.repo.ListCredits(ctx, "", limit)
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
@@ -9,7 +10,10 @@ import (
 )
 
 type billingRepoStub struct {
-	plan models.Plan
+	plan    models.Plan
+	rentals []models.MeteredRental
+	orders  []models.ServerOrder
+	credits []models.Credit
 }
 
 func (r *billingRepoStub) CreatePlan(_ context.Context, plan models.Plan) (models.Plan, error) {
@@ -50,6 +54,72 @@ func (r *billingRepoStub) CreateServerOrder(_ context.Context, order models.Serv
 func (r *billingRepoStub) ListServerOrders(_ context.Context, _ string) ([]models.ServerOrder, error) {
 	return nil, nil
 }
+func (r *billingRepoStub) CreateMeteredRental(_ context.Context, item models.MeteredRental) (models.MeteredRental, error) {
+	for _, existing := range r.rentals {
+		if existing.ReferenceID == item.ReferenceID {
+			return existing, nil
+		}
+	}
+	item.ID = "rental-1"
+	r.rentals = append(r.rentals, item)
+	return item, nil
+}
+func (r *billingRepoStub) GetMeteredRental(_ context.Context, rentalID string) (models.MeteredRental, error) {
+	for _, item := range r.rentals {
+		if item.ID == rentalID {
+			return item, nil
+		}
+	}
+	return models.MeteredRental{}, errors.New("not found")
+}
+func (r *billingRepoStub) FindMeteredRentalByReference(_ context.Context, referenceID string) (models.MeteredRental, bool, error) {
+	for _, item := range r.rentals {
+		if item.ReferenceID == referenceID {
+			return item, true, nil
+		}
+	}
+	return models.MeteredRental{}, false, nil
+}
+func (r *billingRepoStub) UpdateMeteredRental(_ context.Context, item models.MeteredRental) (models.MeteredRental, error) {
+	for i := range r.rentals {
+		if r.rentals[i].ID == item.ID {
+			r.rentals[i] = item
+			return item, nil
+		}
+	}
+	return models.MeteredRental{}, errors.New("not found")
+}
+func (r *billingRepoStub) ListMeteredRentals(_ context.Context, _ string) ([]models.MeteredRental, error) {
+	return append([]models.MeteredRental(nil), r.rentals...), nil
+}
+func (r *billingRepoStub) ListServerOrdersForResource(_ context.Context, userID string, resourceID string) ([]models.ServerOrder, error) {
+	out := make([]models.ServerOrder, 0)
+	for _, item := range r.orders {
+		if item.UserID == userID && item.VMID == resourceID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *billingRepoStub) CreateCredit(_ context.Context, item models.Credit) (models.Credit, error) {
+	for _, existing := range r.credits {
+		if existing.ReferenceID == item.ReferenceID {
+			return existing, nil
+		}
+	}
+	item.ID = "credit-" + item.ReferenceID
+	r.credits = append(r.credits, item)
+	return item, nil
+}
+func (r *billingRepoStub) ListCredits(_ context.Context, userID string, _ int) ([]models.Credit, error) {
+	out := make([]models.Credit, 0)
+	for _, item := range r.credits {
+		if userID == "" || item.UserID == userID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
 
 func TestUsageCreatesVipBonus(t *testing.T) {
 	repo := &billingRepoStub{
@@ -81,3 +151,142 @@ func TestUsageCreatesVipBonus(t *testing.T) {
 		t.Fatal("total must include bonus")
 	}
 }
+
+func TestMeteredRentalChargesAndRefunds(t *testing.T) {
+	repo := &billingRepoStub{}
+	svc := New(repo)
+	ctx := context.Background()
+
+	rental, err := svc.StartMeteredRental(ctx, models.MeteredRental{
+		ReferenceID: "booking-1",
+		UserID:      "user-1",
+		ProviderID:  "provider-1",
+		PriceHourly: 2,
+		StartedAt:   time.Now().UTC().Add(-90 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("start rental: %v", err)
+	}
+	again, err := svc.StartMeteredRental(ctx, models.MeteredRental{ReferenceID: "booking-1", UserID: "user-1", ProviderID: "provider-1", PriceHourly: 2})
+	if err != nil || again.ID != rental.ID || len(repo.rentals) != 1 {
+		t.Fatalf("expected idempotent start, got %+v err=%v", again, err)
+	}
+	listed, err := svc.ListMeteredRentals(ctx, "user-1")
+	if err != nil || len(listed) != 1 || listed[0].ChargedUSD != 3 {
+		t.Fatalf("expected live charge of 3, got %+v err=%v", listed, err)
+	}
+
+	stopped, err := svc.StopMeteredRental(ctx, rental.ID)
+	if err != nil || stopped.Status != models.MeteredRentalStopped || stopped.ChargedUSD != 3 {
+		t.Fatalf("expected stopped rental charged 3, got %+v err=%v", stopped, err)
+	}
+	if _, err := svc.RefundMeteredRental(ctx, rental.ID, 5); err == nil {
+		t.Fatal("expected refund above charge to be rejected")
+	}
+	refunded, err := svc.RefundMeteredRental(ctx, rental.ID, 1)
+	if err != nil || refunded.RefundedUSD != 1 {
+		t.Fatalf("expected partial refund of 1, got %+v err=%v", refunded, err)
+	}
+	refunded, err = svc.RefundMeteredRental(ctx, rental.ID, 0)
+	if err != nil || refunded.RefundedUSD != 3 {
+		t.Fatalf("expected full refund of remaining charge, got %+v err=%v", refunded, err)
+	}
+}
+
+func TestStopMeteredRentalByReference(t *testing.T) {
+	repo := &billingRepoStub{}
+	svc := New(repo)
+	ctx := context.Background()
+
+	none, err := svc.StopMeteredRentalByReference(ctx, "booking-1")
+	if err != nil || none.ID != "" {
+		t.Fatalf("expected nothing to stop before the rental starts, got %+v err=%v", none, err)
+	}
+	rental, err := svc.StartMeteredRental(ctx, models.MeteredRental{ReferenceID: "booking-1", UserID: "user-1", ProviderID: "provider-1", PriceHourly: 2})
+	if err != nil {
+		t.Fatalf("start rental: %v", err)
+	}
+	stopped, err := svc.StopMeteredRentalByReference(ctx, "booking-1")
+	if err != nil || stopped.ID != rental.ID || stopped.Status != models.MeteredRentalStopped {
+		t.Fatalf("expected the rental stopped by reference, got %+v err=%v", stopped, err)
+	}
+}
+
+func TestIssueCreditFromCharges(t *testing.T) {
+	start := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	stoppedAt := start.Add(10 * time.Hour)
+	repo := &billingRepoStub{
+		rentals: []models.MeteredRental{{ID: "rental-1", UserID: "user-1", PriceHourly: 3, StartedAt: start.Add(-2 * time.Hour), StoppedAt: &stoppedAt}},
+		orders: []models.ServerOrder{
+			{ID: "order-1", UserID: "user-1", VMID: "vm-1", Period: "monthly", EstimatedPrice: 200, CreatedAt: start},
+			{ID: "order-2", UserID: "user-1", VMID: "vm-1", Period: "hourly", EstimatedPrice: 0.5, CreatedAt: end.Add(-4 * time.Hour)},
+			{ID: "order-3", UserID: "user-1", VMID: "vm-1", Period: "monthly", EstimatedPrice: 300, CreatedAt: end},
+		},
+	}
+	svc := New(repo)
+	ctx := context.Background()
+
+	if _, err := svc.IssueCredit(ctx, models.Credit{ReferenceID: "sla-1", UserID: "user-1", CreditPct: 150, PeriodStart: start, PeriodEnd: end}); err == nil {
+		t.Fatal("expected credit above 100 percent to be rejected")
+	}
+	vmCredit, err := svc.IssueCredit(ctx, models.Credit{ReferenceID: "sla:vm:vm-1:2026-09", UserID: "user-1", ResourceType: "vm", ResourceID: "vm-1", CreditPct: 10, PeriodStart: start, PeriodEnd: end})
+	if err != nil || vmCredit.BasisUSD != 202 || vmCredit.AmountUSD != 20.2 {
+		t.Fatalf("expected 10%% of 202 for the vm, got %+v err=%v", vmCredit, err)
+	}
+	rentalCredit, err := svc.IssueCredit(ctx, models.Credit{ReferenceID: "sla:provider:p1:2026-09:b1", UserID: "user-1", RentalID: "rental-1", CreditPct: 25, PeriodStart: start, PeriodEnd: end})
+	if err != nil || rentalCredit.BasisUSD != 30 || rentalCredit.AmountUSD != 7.5 {
+		t.Fatalf("expected 25%% of the 10 hours charged in the period, got %+v err=%v", rentalCredit, err)
+	}
+	if _, err := svc.IssueCredit(ctx, models.Credit{ReferenceID: "sla-2", UserID: "user-2", RentalID: "rental-1", CreditPct: 25, PeriodStart: start, PeriodEnd: end}); err == nil {
+		t.Fatal("expected credit on another user's rental to be rejected")
+	}
+	again, err := svc.IssueCredit(ctx, models.Credit{ReferenceID: "sla:vm:vm-1:2026-09", UserID: "user-1", ResourceType: "vm", ResourceID: "vm-1", CreditPct: 10, PeriodStart: start, PeriodEnd: end})
+	if err != nil || again.ID != vmCredit.ID || len(repo.credits) != 2 {
+		t.Fatalf("expected idempotent credit, got %+v err=%v", again, err)
+	}
+}
+
+func TestCreditBasisCountsOnlyChargesInThePeriod(t *testing.T) {
+	start := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	endedAt := start.Add(48 * time.Hour)
+	repo := &billingRepoStub{
+		orders: []models.ServerOrder{
+			{ID: "july", UserID: "user-1", VMID: "vm-1", Period: "monthly", EstimatedPrice: 200, CreatedAt: time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)},
+			{ID: "mid-august", UserID: "user-1", VMID: "vm-1", Period: "monthly", EstimatedPrice: 310, CreatedAt: time.Date(2026, 8, 16, 0, 0, 0, 0, time.UTC)},
+			{ID: "hourly", UserID: "user-1", VMID: "vm-2", Period: "hourly", EstimatedPrice: 0.5, CreatedAt: start.Add(-24 * time.Hour)},
+			{ID: "pod", UserID: "user-1", VMID: "pod-1", Period: "hourly", EstimatedPrice: 2, CreatedAt: end.Add(-10 * time.Hour)},
+		},
+	}
+	svc := New(repo)
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		item models.Credit
+		want float64
+	}{
+		// The July order's month ended before September; the mid-August one
+		// covers 15 of its 31 days in September.
+		{"multi-month orders", models.Credit{ReferenceID: "vm-1", ResourceType: "vm", ResourceID: "vm-1"}, 150},
+		{"running hourly vm", models.Credit{ReferenceID: "vm-2-running", ResourceType: "vm", ResourceID: "vm-2"}, 360},
+		{"stopped hourly vm", models.Credit{ReferenceID: "vm-2-stopped", ResourceType: "vm", ResourceID: "vm-2", ResourceEndedAt: &endedAt}, 24},
+		{"pod", models.Credit{ReferenceID: "pod-1", ResourceType: "pod", ResourceID: "pod-1"}, 20},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.item.UserID = "user-1"
+			tc.item.CreditPct = 10
+			tc.item.PeriodStart = start
+			tc.item.PeriodEnd = end
+			credit, err := svc.IssueCredit(ctx, tc.item)
+			if err != nil {
+				t.Fatalf("issue credit: %v", err)
+			}
+			if credit.BasisUSD != tc.want {
+				t.Fatalf("expected basis %.2f, got %.2f", tc.want, credit.BasisUSD)
+			}
+		})
+	}
+}
@@ -1,6 +1,6 @@
 import { API_BASE } from "../../../config/apiBase";
 import { apiClient } from "../../../lib/http";
-import { AdminStats, PodCatalogItem, PodTemplate, Provider, ProviderMetrics } from "../../../types/api";
+import { AdminStats, PodCatalogItem, PodTemplate, Provider, ProviderMetrics, ProviderPresenceEvent } from "../../../types/api";
 
 export function listProviders() {
   return apiClient.get<unknown>(`${API_BASE.admin}/v1/admin/providers/`, { preserveSessionOnAuthError: true }).then(normalizeProvidersResponse);
@@ -76,6 +76,10 @@ export function getProviderMetrics(providerID: string) {
   return apiClient.get<ProviderMetrics>(`${API_BASE.admin}/v1/admin/providers/${encodeURIComponent(providerID)}/metrics`);
 }
 
+export function getProviderPresenceEvents(providerID: string, limit = 100) {
+  return apiClient.get<ProviderPresenceEvent[]>(`${API_BASE.admin}/v1/admin/providers/${encodeURIComponent(providerID)}/presence?limit=${limit}`);
+}
+
 export function listPodCatalog() {
   return apiClient.get<PodCatalogItem[]>(`${API_BASE.admin}/v1/catalog/pods`);
 }
@@ -100,9 +104,10 @@ export function deletePodTemplate(templateID: string) {
   return apiClient.del<{ status: string }>(`${API_BASE.admin}/v1/admin/templates/${encodeURIComponent(templateID)}`);
 }
 
-export function getAgentInstallCommand(params?: { user_id?: string }) {
+export function getAgentInstallCommand(params?: { user_id?: string; enrollment_token?: string }) {
   const search = new URLSearchParams();
   if (params?.user_id) search.set("user_id", params.user_id);
+  if (params?.enrollment_token) search.set("enrollment_token", params.enrollment_token);
   const query = search.toString();
   return apiClient.get<{ command: string; installer_url: string }>(
     `${API_BASE.admin}/v1/admin/agent/install-command${query ? `?${query}` : ""}`,
@@ -12,6 +12,7 @@ import { fetchJSON } from "../../../lib/http";
 import { copyTextToClipboard } from "../../../lib/clipboard";
 import { useProviderOptions } from "../../providers/useProviderOptions";
 import { getAgentInstallCommand } from "../../admin/api/adminApi";
+import { createAgentEnrollment } from "../../resources/api/resourcesApi";
 import { readUser } from "../../../lib/auth";
 import { buildInstallCommand } from "../installCommand";
 
@@ -31,6 +32,8 @@ export function AgentOnboardingPanel() {
   const [installCommand, setInstallCommand] = useState(() => buildInstallCommand("", "", currentUser?.id).command);
   const [verificationState, setVerificationState] = useState("Not verified");
   const [loading, setLoading] = useState(false);
+  const [enrolling, setEnrolling] = useState(false);
+  const [enrollmentExpiresAt, setEnrollmentExpiresAt] = useState("");
   const [error, setError] = useState("");
   const { push } = useToast();
 
@@ -57,6 +60,25 @@ export function AgentOnboardingPanel() {
     [installCommand]
   );
 
+  async function generateEnrollment() {
+    setEnrolling(true);
+    setError("");
+    try {
+      const providerID = providerState.providerID || currentUser?.id;
+      const enrollment = await createAgentEnrollment({ provider_id: providerID });
+      const payload = await getAgentInstallCommand({ user_id: providerID, enrollment_token: enrollment.token });
+      setInstallCommand(buildInstallCommand(payload.command, payload.installer_url, providerID).command);
+      setEnrollmentExpiresAt(enrollment.expires_at);
+      push("success", "One-time enrollment token added to the install command");
+    } catch (requestError) {
+      const message = requestError instanceof Error ? requestError.message : "Enrollment failed";
+      setError(message);
+      push("error", "Could not create enrollment token");
+    } finally {
+      setEnrolling(false);
+    }
+  }
+
   async function copyCommand() {
     const copied = await copyTextToClipboard(commandByOS[os]);
     if (copied) {
@@ -133,8 +155,16 @@ export function AgentOnboardingPanel() {
         <div className="mt-4 rounded-md border border-border bg-canvas p-3">
           <p className="mb-2 text-xs uppercase tracking-wide text-textMuted">Install command</p>
           <pre className="overflow-auto font-mono text-xs text-textSecondary">{commandByOS[os]}</pre>
+          {enrollmentExpiresAt ? (
+            <p className="mt-2 text-xs text-textMuted">
+              Enrollment token is single use and expires at {new Date(enrollmentExpiresAt).toLocaleString()}.
+            </p>
+          ) : null}
         </div>
         <div className="mt-3 flex flex-wrap gap-2">
+          <Button variant="secondary" onClick={generateEnrollment} loading={enrolling}>
+            Generate enrollment token
+          </Button>
           <Button variant="secondary" onClick={copyCommand}>
             Copy command
           </Button>
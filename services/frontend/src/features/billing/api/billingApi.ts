@@ -1,6 +1,6 @@
 import { API_BASE } from "../../../config/apiBase";
 import { apiClient } from "../../../lib/http";
-import { BillingStats, RentalPlan, ServerOrder, UsageAccrual } from "../../../types/api";
+import { BillingStats, Credit, RentalPlan, ServerOrder, UsageAccrual } from "../../../types/api";
 
 export function listAccruals(providerID: string) {
   return apiClient.get<UsageAccrual[]>(`${API_BASE.billing}/v1/billing/accruals?provider_id=${encodeURIComponent(providerID)}`);
@@ -26,6 +26,14 @@ export function getBillingStats() {
   return apiClient.get<BillingStats>(`${API_BASE.billing}/v1/billing/admin/stats`);
 }
 
+export function listCredits(limit = 100) {
+  return apiClient.get<Credit[]>(`${API_BASE.billing}/v1/billing/credits?limit=${limit}`);
+}
+
+export function listAllCredits(limit = 100) {
+  return apiClient.get<Credit[]>(`${API_BASE.billing}/v1/billing/admin/credits?limit=${limit}`);
+}
+
 export function listRentalPlans() {
   return apiClient.get<RentalPlan[]>(`${API_BASE.billing}/v1/billing/rental/plans`);
 }
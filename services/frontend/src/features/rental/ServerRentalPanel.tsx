@@ -19,20 +19,22 @@ import {
   closeTerminalSession,
   createTerminalSession,
   getVM,
+  inviteTerminalParticipant,
   listPods,
   listSharedOffers,
-  listTerminalOutput,
   listVMs,
+  openTerminalStream,
   rebootVM,
   reserveSharedOffer,
   startVM,
   stopVM,
   terminatePod,
+  sendTerminalFrame,
   terminateVM,
   writeTerminalInput
 } from "../resources/api/resourcesApi";
 import { formatDateTime } from "../hifi/formatters";
-import { Pod, SharedInventoryOffer, VM } from "../../types/api";
+import { Pod, SharedInventoryOffer, TerminalFrame, TerminalParticipant, TerminalPresence, VM } from "../../types/api";
 import { useAutoRefresh } from "../../design/hooks/useAutoRefresh";
 
 type RuntimeRow = {
@@ -92,8 +94,12 @@ export function ServerRentalPanel() {
   const [terminalInput, setTerminalInput] = useState("");
   const [terminalBusy, setTerminalBusy] = useState(false);
   const [terminalError, setTerminalError] = useState("");
+  const [terminalPresence, setTerminalPresence] = useState<TerminalPresence[]>([]);
+  const [inviteUserID, setInviteUserID] = useState("");
+  const [inviteRole, setInviteRole] = useState<TerminalParticipant["role"]>("viewer");
   const terminalOutputRef = useRef<HTMLPreElement | null>(null);
   const terminalSeqRef = useRef(0);
+  const terminalSocketRef = useRef<WebSocket | null>(null);
 
   const refreshRows = useCallback(async (silent = false) => {
     setLoading(true);
@@ -239,37 +245,57 @@ export function ServerRentalPanel() {
       return;
     }
     let cancelled = false;
-    let running = false;
-    const poll = async () => {
-      if (running) {
-        return;
-      }
-      running = true;
-      try {
-        const chunks = await listTerminalOutput(activeTerminalSessionID, { after_seq: terminalSeqRef.current, limit: 300 });
-        if (cancelled || chunks.length === 0) {
-          return;
+    let retryTimer = 0;
+    let retryDelay = 1000;
+    // Reconnects resume after the last output seq shown, so nothing is
+    // printed twice or skipped.
+    const connect = () => {
+      const socket = openTerminalStream(activeTerminalSessionID, terminalSeqRef.current);
+      terminalSocketRef.current = socket;
+      let ended = false;
+      socket.onopen = () => {
+        retryDelay = 1000;
+      };
+      socket.onmessage = (message) => {
+        const frame = JSON.parse(String(message.data)) as TerminalFrame;
+        switch (frame.type) {
+          case "output":
+            if (frame.seq && frame.seq > terminalSeqRef.current) {
+              terminalSeqRef.current = frame.seq;
+              setTerminalOutput((prev) => appendTerminalChunk(prev, frame.data ?? ""));
+            }
+            break;
+          case "ping":
+            sendTerminalFrame(socket, { type: "pong" });
+            break;
+          case "presence":
+            setTerminalPresence(frame.participants ?? []);
+            break;
+          case "closed":
+            ended = true;
+            setTerminalError(`Terminal session ${frame.status ?? "closed"}`);
+            break;
+          case "error":
+            setTerminalError(frame.error ?? "Terminal stream failed");
+            break;
         }
-        const merged = chunks.map((item) => item.data).join("");
-        const nextSeq = chunks[chunks.length - 1]?.seq ?? terminalSeqRef.current;
-        terminalSeqRef.current = nextSeq;
-        setTerminalOutput((prev) => appendTerminalChunk(prev, merged));
-      } catch (error) {
-        if (!cancelled) {
-          const message = error instanceof Error ? error.message : "Failed to fetch terminal output";
-          setTerminalError(message);
+      };
+      socket.onclose = () => {
+        if (terminalSocketRef.current === socket) {
+          terminalSocketRef.current = null;
         }
-      } finally {
-        running = false;
-      }
+        if (!cancelled && !ended) {
+          retryTimer = window.setTimeout(connect, retryDelay);
+          retryDelay = Math.min(retryDelay * 2, 30_000);
+        }
+      };
     };
-    void poll();
-    const timer = window.setInterval(() => {
-      void poll();
-    }, 1000);
+    connect();
     return () => {
       cancelled = true;
-      window.clearInterval(timer);
+      window.clearTimeout(retryTimer);
+      terminalSocketRef.current?.close();
+      terminalSocketRef.current = null;
     };
   }, [activeTerminalSessionID]);
 
@@ -314,6 +340,12 @@ export function ServerRentalPanel() {
       return;
     }
     const payload = terminalInput.endsWith("\n") ? terminalInput : `${terminalInput}\n`;
+    const socket = terminalSocketRef.current;
+    if (socket && socket.readyState === WebSocket.OPEN) {
+      sendTerminalFrame(socket, { type: "input", data: payload });
+      setTerminalInput("");
+      return;
+    }
     try {
       await writeTerminalInput(activeTerminalSessionID, { data: payload });
       setTerminalInput("");
@@ -324,6 +356,20 @@ export function ServerRentalPanel() {
     }
   }
 
+  async function inviteToTerminal() {
+    if (!activeTerminalSessionID || !inviteUserID.trim()) {
+      return;
+    }
+    try {
+      await inviteTerminalParticipant(activeTerminalSessionID, { user_id: inviteUserID.trim(), role: inviteRole });
+      push("success", `${inviteUserID.trim()} invited as ${inviteRole}`, "Terminal");
+      setInviteUserID("");
+    } catch (error) {
+      const message = error instanceof Error ? error.message : "Failed to invite participant";
+      push("error", message, "Terminal");
+    }
+  }
+
   async function closeActiveTerminal() {
     if (!activeTerminalSessionID) {
       return;
@@ -336,6 +382,7 @@ export function ServerRentalPanel() {
     }
     setActiveTerminalSessionID("");
     setActiveTerminalResourceID("");
+    setTerminalPresence([]);
     terminalSeqRef.current = 0;
     setTerminalOutput("");
     setTerminalInput("");
@@ -485,6 +532,36 @@ export function ServerRentalPanel() {
                 Close session
               </Button>
             </div>
+            {terminalPresence.length > 0 ? (
+              <div className="flex flex-wrap items-center gap-2 text-xs text-textSecondary">
+                {terminalPresence.map((item) => (
+                  <span key={item.user_id} className={item.online ? "font-mono text-textPrimary" : "font-mono"}>
+                    {item.online ? "● " : "○ "}
+                    {item.user_id} ({item.role})
+                  </span>
+                ))}
+              </div>
+            ) : null}
+            <div className="flex items-end gap-2">
+              <Input
+                label="Invite user"
+                value={inviteUserID}
+                onChange={(event) => setInviteUserID(event.target.value)}
+                placeholder="User ID"
+              />
+              <Select
+                label="Role"
+                value={inviteRole}
+                onChange={(event) => setInviteRole(event.target.value as TerminalParticipant["role"])}
+                options={[
+                  { value: "viewer", label: "viewer" },
+                  { value: "driver", label: "driver" }
+                ]}
+              />
+              <Button size="sm" variant="secondary" onClick={inviteToTerminal} disabled={!inviteUserID.trim()}>
+                Invite
+              </Button>
+            </div>
             <pre ref={terminalOutputRef} className="max-h-80 overflow-auto rounded-md border border-border bg-canvas p-3 font-mono text-xs text-textPrimary">
               {terminalOutput || "$ "}
             </pre>
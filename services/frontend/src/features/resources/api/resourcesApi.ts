@@ -1,14 +1,24 @@
 import { API_BASE } from "../../../config/apiBase";
 import { apiClient } from "../../../lib/http";
+import { readToken } from "../../../lib/auth";
 import {
   Allocation,
   HealthCheck,
+  HealthProbe,
   KubernetesCluster,
+  Alert,
+  AlertRule,
+  AlertSilence,
   MetricPoint,
+  MetricQuery,
+  MetricQueryResult,
   MetricSummary,
   ResourceStats,
   RuntimeInventory,
   SharedInventoryOffer,
+  OfferBooking,
+  OfferBid,
+  AuctionClearing,
   SharedPod,
   SharedVM,
   VM,
@@ -16,9 +26,28 @@ import {
   CatalogFilter,
   AgentLog,
   AgentCommand,
+  AgentEnrollment,
+  AgentHost,
+  HostVerification,
+  ExecRun,
+  ExecPolicy,
+  HostVerificationState,
+  CapacityChallenge,
   TerminalSession,
   TerminalChunk,
+  TerminalFrame,
+  TerminalParticipant,
+  TerminalPresence,
+  FileTransfer,
+  AgentVersionInventory,
+  Rollout,
+  RolloutSelector,
+  RolloutTarget,
   Pod,
+  SLAReport,
+  SLATarget,
+  StreamEvent,
+  StreamEventType,
   RootInputLog
 } from "../../../types/api";
 
@@ -164,7 +193,40 @@ export function listSharedOffers(params?: { status?: "active" | "paused" | "sold
 }
 
 export function reserveSharedOffer(payload: { offer_id: string; quantity: number }) {
-  return apiClient.post<SharedInventoryOffer>(`${API_BASE.resource}/v1/resources/shared/offers/reserve`, payload);
+  return apiClient.post<OfferBooking>(`${API_BASE.resource}/v1/resources/shared/offers/reserve`, payload);
+}
+
+export function listOfferBookings(status?: OfferBooking["status"]) {
+  const query = status ? `?status=${encodeURIComponent(status)}` : "";
+  return apiClient.get<OfferBooking[]>(`${API_BASE.resource}/v1/resources/shared/bookings${query}`);
+}
+
+export function confirmOfferBooking(bookingID: string) {
+  return apiClient.post<OfferBooking>(`${API_BASE.resource}/v1/resources/shared/bookings/${encodeURIComponent(bookingID)}/confirm`);
+}
+
+export function cancelOfferBooking(bookingID: string) {
+  return apiClient.post<OfferBooking>(`${API_BASE.resource}/v1/resources/shared/bookings/${encodeURIComponent(bookingID)}/cancel`);
+}
+
+export function placeOfferBid(offerID: string, payload: { quantity: number; max_price_hourly_usd: number; duration_hours: number }) {
+  return apiClient.post<OfferBid>(`${API_BASE.resource}/v1/resources/shared/offers/${encodeURIComponent(offerID)}/bids`, payload);
+}
+
+export function listOfferBids(params?: { offer_id?: string; status?: OfferBid["status"] }) {
+  const search = new URLSearchParams();
+  if (params?.offer_id) search.set("offer_id", params.offer_id);
+  if (params?.status) search.set("status", params.status);
+  const query = search.toString();
+  return apiClient.get<OfferBid[]>(`${API_BASE.resource}/v1/resources/shared/bids${query ? `?${query}` : ""}`);
+}
+
+export function cancelOfferBid(bidID: string) {
+  return apiClient.post<OfferBid>(`${API_BASE.resource}/v1/resources/shared/bids/${encodeURIComponent(bidID)}/cancel`);
+}
+
+export function listAuctionClearings(offerID: string) {
+  return apiClient.get<AuctionClearing[]>(`${API_BASE.resource}/v1/resources/shared/offers/${encodeURIComponent(offerID)}/clearings`);
 }
 
 export function recordHealthCheck(payload: HealthCheck) {
@@ -188,21 +250,71 @@ export function listMetrics(params?: {
   resource_type?: string;
   resource_id?: string;
   metric_type?: string;
+  provider_id?: string;
   from?: string;
   to?: string;
+  resolution?: "raw" | "1m" | "1h";
   limit?: number;
 }) {
   const search = new URLSearchParams();
   if (params?.resource_type) search.set("resource_type", params.resource_type);
   if (params?.resource_id) search.set("resource_id", params.resource_id);
   if (params?.metric_type) search.set("metric_type", params.metric_type);
+  if (params?.provider_id) search.set("provider_id", params.provider_id);
   if (params?.from) search.set("from", params.from);
   if (params?.to) search.set("to", params.to);
+  if (params?.resolution) search.set("resolution", params.resolution);
   if (params?.limit) search.set("limit", String(params.limit));
   const query = search.toString();
   return apiClient.get<MetricPoint[]>(`${API_BASE.resource}/v1/resources/metrics${query ? `?${query}` : ""}`);
 }
 
+export function createHealthProbe(payload: HealthProbe) {
+  return apiClient.post<HealthProbe>(`${API_BASE.resource}/v1/resources/health-probes`, payload);
+}
+
+export function listHealthProbes(resourceID: string) {
+  return apiClient.get<HealthProbe[]>(`${API_BASE.resource}/v1/resources/health-probes?resource_id=${encodeURIComponent(resourceID)}`);
+}
+
+export function deleteHealthProbe(probeID: string) {
+  return apiClient.del<{ status: string }>(`${API_BASE.resource}/v1/resources/health-probes/${encodeURIComponent(probeID)}`);
+}
+
+export function queryMetrics(payload: MetricQuery) {
+  return apiClient.post<MetricQueryResult>(`${API_BASE.resource}/v1/resources/metrics/query`, payload);
+}
+
+export function createAlertRule(payload: AlertRule) {
+  return apiClient.post<AlertRule>(`${API_BASE.resource}/v1/resources/alerts/rules`, payload);
+}
+
+export function listAlertRules() {
+  return apiClient.get<AlertRule[]>(`${API_BASE.resource}/v1/resources/alerts/rules`);
+}
+
+export function deleteAlertRule(ruleID: string) {
+  return apiClient.del<{ status: string }>(`${API_BASE.resource}/v1/resources/alerts/rules/${encodeURIComponent(ruleID)}`);
+}
+
+export function listAlerts(state?: Alert["state"], limit = 100) {
+  const search = new URLSearchParams({ limit: String(limit) });
+  if (state) search.set("state", state);
+  return apiClient.get<Alert[]>(`${API_BASE.resource}/v1/resources/alerts?${search.toString()}`);
+}
+
+export function createAlertSilence(payload: AlertSilence) {
+  return apiClient.post<AlertSilence>(`${API_BASE.resource}/v1/resources/alerts/silences`, payload);
+}
+
+export function listAlertSilences() {
+  return apiClient.get<AlertSilence[]>(`${API_BASE.resource}/v1/resources/alerts/silences`);
+}
+
+export function endAlertSilence(silenceID: string) {
+  return apiClient.post<AlertSilence>(`${API_BASE.resource}/v1/resources/alerts/silences/${encodeURIComponent(silenceID)}/end`);
+}
+
 export function listMetricSummaries(limit = 100) {
   return apiClient.get<MetricSummary[]>(`${API_BASE.resource}/v1/resources/metrics/summary?limit=${limit}`);
 }
@@ -226,7 +338,12 @@ export function listAgentLogs(params?: {
   return apiClient.get<AgentLog[]>(`${API_BASE.resource}/v1/resources/agent-logs${query ? `?${query}` : ""}`);
 }
 
-export function queueAgentCommand(payload: { provider_id: string; command: "status" | "start" | "stop" | "restart" }) {
+export function queueAgentCommand(payload: {
+  provider_id: string;
+  command: "status" | "start" | "stop" | "restart";
+  timeout_seconds?: number;
+  max_attempts?: number;
+}) {
   return apiClient.post<AgentCommand>(`${API_BASE.resource}/v1/resources/admin/agent/commands`, payload);
 }
 
@@ -238,6 +355,124 @@ export function listAgentCommands(params?: { provider_id?: string; limit?: numbe
   return apiClient.get<AgentCommand[]>(`${API_BASE.resource}/v1/resources/admin/agent/commands${query ? `?${query}` : ""}`);
 }
 
+export function requestAgentUpdate(payload: { provider_id: string; version: string; health_timeout_seconds?: number }) {
+  return apiClient.post<AgentCommand>(`${API_BASE.resource}/v1/resources/admin/agent/updates`, payload);
+}
+
+export function getAgentVersions() {
+  return apiClient.get<AgentVersionInventory>(`${API_BASE.resource}/v1/resources/admin/agent/versions`);
+}
+
+export function createRollout(payload: {
+  command: Rollout["command"];
+  selector: RolloutSelector;
+  version?: string;
+  health_timeout_seconds?: number;
+  waves?: number[];
+  max_concurrency?: number;
+  max_failure_pct?: number;
+  pause_between_waves?: boolean;
+  timeout_seconds?: number;
+  max_attempts?: number;
+}) {
+  return apiClient.post<Rollout>(`${API_BASE.resource}/v1/resources/admin/rollouts`, payload);
+}
+
+export function listRollouts(status?: Rollout["status"]) {
+  const query = status ? `?status=${encodeURIComponent(status)}` : "";
+  return apiClient.get<Rollout[]>(`${API_BASE.resource}/v1/resources/admin/rollouts${query}`);
+}
+
+export function getRollout(rolloutID: string) {
+  return apiClient.get<{ rollout: Rollout; targets: RolloutTarget[] }>(`${API_BASE.resource}/v1/resources/admin/rollouts/${encodeURIComponent(rolloutID)}`);
+}
+
+export function changeRollout(rolloutID: string, action: "pause" | "resume" | "cancel") {
+  return apiClient.post<Rollout>(`${API_BASE.resource}/v1/resources/admin/rollouts/${encodeURIComponent(rolloutID)}/${action}`, {});
+}
+
+export function runExec(payload: {
+  provider_id: string;
+  script?: string;
+  argv?: string[];
+  work_dir?: string;
+  env?: Record<string, string>;
+  timeout_seconds?: number;
+  reason?: string;
+}) {
+  return apiClient.post<ExecRun>(`${API_BASE.resource}/v1/resources/admin/exec`, payload);
+}
+
+export function listExecRuns(params?: { provider_id?: string; requested_by?: string; limit?: number }) {
+  const search = new URLSearchParams();
+  if (params?.provider_id) search.set("provider_id", params.provider_id);
+  if (params?.requested_by) search.set("requested_by", params.requested_by);
+  if (params?.limit) search.set("limit", String(params.limit));
+  const query = search.toString();
+  return apiClient.get<ExecRun[]>(`${API_BASE.resource}/v1/resources/admin/exec${query ? `?${query}` : ""}`);
+}
+
+export function getExecRun(execID: string) {
+  return apiClient.get<ExecRun>(`${API_BASE.resource}/v1/resources/admin/exec/${encodeURIComponent(execID)}`);
+}
+
+export function listMyExecRuns(limit?: number) {
+  const query = limit ? `?limit=${limit}` : "";
+  return apiClient.get<ExecRun[]>(`${API_BASE.resource}/v1/resources/exec/runs${query}`);
+}
+
+export function getExecPolicy(providerID: string) {
+  return apiClient.get<ExecPolicy>(`${API_BASE.resource}/v1/resources/exec/policies/${encodeURIComponent(providerID)}`);
+}
+
+export function updateExecPolicy(providerID: string, payload: Omit<ExecPolicy, "provider_id" | "updated_by" | "updated_at">) {
+  return apiClient.put<ExecPolicy>(`${API_BASE.resource}/v1/resources/admin/exec/policies/${encodeURIComponent(providerID)}`, payload);
+}
+
+export function listMyAgentCommands(limit?: number) {
+  const query = limit ? `?limit=${limit}` : "";
+  return apiClient.get<AgentCommand[]>(`${API_BASE.resource}/v1/resources/commands${query}`);
+}
+
+export function cancelAgentCommand(commandID: string, reason?: string) {
+  return apiClient.post<AgentCommand>(`${API_BASE.resource}/v1/resources/commands/${encodeURIComponent(commandID)}/cancel`, { reason: reason ?? "" });
+}
+
+export function createAgentEnrollment(payload?: { provider_id?: string; label?: string }) {
+  return apiClient.post<AgentEnrollment>(`${API_BASE.resource}/v1/resources/agent/enrollments`, payload ?? {});
+}
+
+export function listAgentEnrollments(providerID?: string) {
+  const query = providerID ? `?provider_id=${encodeURIComponent(providerID)}` : "";
+  return apiClient.get<AgentEnrollment[]>(`${API_BASE.resource}/v1/resources/agent/enrollments${query}`);
+}
+
+export function listAgentHosts(providerID?: string) {
+  const query = providerID ? `?provider_id=${encodeURIComponent(providerID)}` : "";
+  return apiClient.get<AgentHost[]>(`${API_BASE.resource}/v1/resources/agent/hosts${query}`);
+}
+
+export function revokeAgentHost(hostID: string) {
+  return apiClient.post<AgentHost>(`${API_BASE.resource}/v1/resources/agent/hosts/${encodeURIComponent(hostID)}/revoke`, {});
+}
+
+export function getHostVerification(providerID: string) {
+  return apiClient.get<HostVerification>(`${API_BASE.resource}/v1/resources/hosts/${encodeURIComponent(providerID)}/verification`);
+}
+
+export function listHostVerifications(status?: HostVerificationState) {
+  const query = status ? `?status=${encodeURIComponent(status)}` : "";
+  return apiClient.get<HostVerification[]>(`${API_BASE.resource}/v1/resources/hosts/verifications${query}`);
+}
+
+export function listCapacityChallenges(providerID: string) {
+  return apiClient.get<CapacityChallenge[]>(`${API_BASE.resource}/v1/resources/hosts/${encodeURIComponent(providerID)}/challenges`);
+}
+
+export function issueCapacityChallenge(providerID: string, kind: CapacityChallenge["kind"] = "cpu_memory") {
+  return apiClient.post<CapacityChallenge>(`${API_BASE.resource}/v1/resources/hosts/${encodeURIComponent(providerID)}/challenges`, { kind });
+}
+
 export function recordRootInputLog(payload: RootInputLog) {
   return apiClient.post<RootInputLog>(`${API_BASE.resource}/v1/resources/root-input-logs`, payload);
 }
@@ -291,6 +526,23 @@ export function listTerminalOutput(sessionID: string, params?: { after_seq?: num
   return apiClient.get<TerminalChunk[]>(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/output${query ? `?${query}` : ""}`);
 }
 
+export const TERMINAL_PROTOCOL = "sharemtc.terminal.v1";
+
+// openTerminalStream connects a terminal WebSocket that replays output after
+// afterSeq. WebSockets cannot carry the bearer header, so the token is offered
+// as a "bearer.<token>" subprotocol next to TERMINAL_PROTOCOL.
+export function openTerminalStream(sessionID: string, afterSeq: number) {
+  const url = new URL(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/ws`, window.location.href);
+  url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+  url.searchParams.set("after_seq", String(afterSeq));
+  const token = readToken();
+  return new WebSocket(url.toString(), token ? [TERMINAL_PROTOCOL, `bearer.${token}`] : [TERMINAL_PROTOCOL]);
+}
+
+export function sendTerminalFrame(socket: WebSocket, frame: TerminalFrame) {
+  socket.send(JSON.stringify(frame));
+}
+
 export function resizeTerminalSession(sessionID: string, payload: { rows: number; cols: number }) {
   return apiClient.post<TerminalSession>(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/resize`, payload);
 }
@@ -298,3 +550,189 @@ export function resizeTerminalSession(sessionID: string, payload: { rows: number
 export function closeTerminalSession(sessionID: string) {
   return apiClient.post<TerminalSession>(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/close`);
 }
+
+export function listTerminalParticipants(sessionID: string) {
+  return apiClient.get<TerminalPresence[]>(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/participants`);
+}
+
+export function inviteTerminalParticipant(sessionID: string, payload: { user_id: string; role: TerminalParticipant["role"] }) {
+  return apiClient.post<TerminalParticipant>(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/participants`, payload);
+}
+
+export function removeTerminalParticipant(sessionID: string, userID: string) {
+  return apiClient.del<void>(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/participants/${encodeURIComponent(userID)}`);
+}
+
+export type FileTransferPayload = {
+  resource_id?: string;
+  provider_id?: string;
+  direction: "upload" | "download";
+  path: string;
+  size?: number;
+  sha256?: string;
+};
+
+export function startFileTransfer(payload: FileTransferPayload) {
+  return apiClient.post<FileTransfer>(`${API_BASE.resource}/v1/resources/files/transfers`, payload);
+}
+
+export function listFileTransfers(params?: { resource_id?: string; limit?: number }) {
+  const search = new URLSearchParams();
+  if (params?.resource_id) search.set("resource_id", params.resource_id);
+  if (params?.limit) search.set("limit", String(params.limit));
+  const query = search.toString();
+  return apiClient.get<FileTransfer[]>(`${API_BASE.resource}/v1/resources/files/transfers${query ? `?${query}` : ""}`);
+}
+
+export function getFileTransfer(transferID: string) {
+  return apiClient.get<FileTransfer>(`${API_BASE.resource}/v1/resources/files/transfers/${encodeURIComponent(transferID)}`);
+}
+
+export function resumeFileTransfer(transferID: string) {
+  return apiClient.post<FileTransfer>(`${API_BASE.resource}/v1/resources/files/transfers/${encodeURIComponent(transferID)}/resume`);
+}
+
+export function cancelFileTransfer(transferID: string) {
+  return apiClient.post<FileTransfer>(`${API_BASE.resource}/v1/resources/files/transfers/${encodeURIComponent(transferID)}/cancel`);
+}
+
+// downloadTerminalRecording fetches a session as an asciicast v2 file, which
+// players such as asciinema play as is.
+export async function downloadTerminalRecording(sessionID: string) {
+  const token = readToken();
+  const headers: Record<string, string> = {};
+  if (token) headers.Authorization = `Bearer ${token}`;
+  const response = await fetch(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/recording`, { headers });
+  if (!response.ok) {
+    throw new Error(`recording download failed with status ${response.status}`);
+  }
+  return response.blob();
+}
+
+// replayTerminalRecording streams a recording paced at speed times the
+// original; the body yields one asciicast line per event as it is due.
+export async function replayTerminalRecording(sessionID: string, params?: { speed?: number; max_idle?: number; signal?: AbortSignal }) {
+  const search = new URLSearchParams();
+  if (typeof params?.speed === "number") search.set("speed", String(params.speed));
+  if (typeof params?.max_idle === "number") search.set("max_idle", String(params.max_idle));
+  const query = search.toString();
+  const token = readToken();
+  const headers: Record<string, string> = {};
+  if (token) headers.Authorization = `Bearer ${token}`;
+  const response = await fetch(`${API_BASE.resource}/v1/resources/terminal/sessions/${encodeURIComponent(sessionID)}/recording/replay${query ? `?${query}` : ""}`, {
+    headers,
+    signal: params?.signal
+  });
+  if (!response.ok || !response.body) {
+    throw new Error(`recording replay failed with status ${response.status}`);
+  }
+  return response.body;
+}
+
+export function listAdminTerminalSessions(params: { provider_id?: string; resource_id?: string; limit?: number }) {
+  const search = new URLSearchParams();
+  if (params.provider_id) search.set("provider_id", params.provider_id);
+  if (params.resource_id) search.set("resource_id", params.resource_id);
+  if (params.limit) search.set("limit", String(params.limit));
+  const query = search.toString();
+  return apiClient.get<TerminalSession[]>(`${API_BASE.resource}/v1/resources/admin/terminal/sessions${query ? `?${query}` : ""}`);
+}
+
+// uploadFileTransferChunk sends raw bytes, so it uses fetch directly; chunks
+// must be sent in order starting at the transfer's stored_bytes.
+export async function uploadFileTransferChunk(transferID: string, offset: number, chunk: Blob) {
+  const token = readToken();
+  const headers: Record<string, string> = { "Content-Type": "application/octet-stream" };
+  if (token) headers.Authorization = `Bearer ${token}`;
+  const response = await fetch(`${API_BASE.resource}/v1/resources/files/transfers/${encodeURIComponent(transferID)}/chunks?offset=${offset}`, {
+    method: "PUT",
+    headers,
+    body: chunk
+  });
+  if (!response.ok) {
+    throw new Error(`chunk upload failed with status ${response.status}`);
+  }
+  return (await response.json()) as FileTransfer;
+}
+
+export async function downloadFileTransferContent(transferID: string, offset = 0) {
+  const token = readToken();
+  const headers: Record<string, string> = {};
+  if (token) headers.Authorization = `Bearer ${token}`;
+  if (offset > 0) headers.Range = `bytes=${offset}-`;
+  const response = await fetch(`${API_BASE.resource}/v1/resources/files/transfers/${encodeURIComponent(transferID)}/content`, { headers });
+  if (!response.ok) {
+    throw new Error(`download failed with status ${response.status}`);
+  }
+  return response.blob();
+}
+
+export function startHostFileTransfer(payload: FileTransferPayload) {
+  return apiClient.post<FileTransfer>(`${API_BASE.resource}/v1/resources/admin/files/transfers`, payload);
+}
+
+export function listAdminFileTransfers(params?: { provider_id?: string; resource_id?: string; limit?: number }) {
+  const search = new URLSearchParams();
+  if (params?.provider_id) search.set("provider_id", params.provider_id);
+  if (params?.resource_id) search.set("resource_id", params.resource_id);
+  if (params?.limit) search.set("limit", String(params.limit));
+  const query = search.toString();
+  return apiClient.get<FileTransfer[]>(`${API_BASE.resource}/v1/resources/admin/files/transfers${query ? `?${query}` : ""}`);
+}
+
+export function listSLAReports(period?: string) {
+  const query = period ? `?period=${encodeURIComponent(period)}` : "";
+  return apiClient.get<SLAReport[]>(`${API_BASE.resource}/v1/resources/sla${query}`);
+}
+
+export function listSLATargets() {
+  return apiClient.get<SLATarget[]>(`${API_BASE.resource}/v1/resources/sla/targets`);
+}
+
+export function getResourceSLAReport(resourceID: string, period?: string) {
+  const query = period ? `?period=${encodeURIComponent(period)}` : "";
+  return apiClient.get<SLAReport>(`${API_BASE.resource}/v1/resources/sla/${encodeURIComponent(resourceID)}${query}`);
+}
+
+// streamResources follows /v1/resources/stream with fetch, since EventSource
+// cannot send the bearer token. onEvent also receives "reset" and "revoked"
+// control events; the stream ends after either and on abort.
+export async function streamResources(
+  params: { resource_ids?: string[]; provider_ids?: string[]; types?: StreamEventType[] },
+  onEvent: (name: string, event: StreamEvent | Record<string, string>) => void,
+  signal?: AbortSignal
+) {
+  const search = new URLSearchParams();
+  params.resource_ids?.forEach((id) => search.append("resource_id", id));
+  params.provider_ids?.forEach((id) => search.append("provider_id", id));
+  if (params.types?.length) search.set("types", params.types.join(","));
+  const token = readToken();
+  const response = await fetch(`${API_BASE.resource}/v1/resources/stream?${search.toString()}`, {
+    headers: token ? { Authorization: `Bearer ${token}`, Accept: "text/event-stream" } : { Accept: "text/event-stream" },
+    signal
+  });
+  if (!response.ok || !response.body) {
+    throw new Error(`stream failed with status ${response.status}`);
+  }
+  const reader = response.body.getReader();
+  const decoder = new TextDecoder();
+  let buffer = "";
+  for (;;) {
+    const { done, value } = await reader.read();
+    if (done) return;
+    buffer += decoder.decode(value, { stream: true });
+    let boundary = buffer.indexOf("\n\n");
+    while (boundary >= 0) {
+      const block = buffer.slice(0, boundary);
+      buffer = buffer.slice(boundary + 2);
+      boundary = buffer.indexOf("\n\n");
+      let name = "message";
+      let data = "";
+      for (const line of block.split("\n")) {
+        if (line.startsWith("event: ")) name = line.slice(7);
+        else if (line.startsWith("data: ")) data += line.slice(6);
+      }
+      if (data) onEvent(name, JSON.parse(data));
+    }
+  }
+}
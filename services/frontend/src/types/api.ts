@@ -5,9 +5,24 @@ export type Provider = {
   machine_id: string;
   network_mbps: number;
   online: boolean;
+  presence?: PresenceState;
+  presence_reason?: string;
+  presence_changed_at?: string;
+  flap_count?: number;
+  recent_flaps?: number;
   created_at?: string;
 };
 
+export type PresenceState = "online" | "degraded" | "offline";
+
+export type ProviderPresenceEvent = {
+  provider_id: string;
+  from_state: PresenceState | "";
+  to_state: PresenceState;
+  reason: string;
+  changed_at: string;
+};
+
 export type Allocation = {
   id: string;
   provider_id: string;
@@ -31,6 +46,9 @@ export type UsageAccrual = {
 export type AdminStats = {
   total_providers: number;
   online_providers: number;
+  degraded_providers?: number;
+  offline_providers?: number;
+  flapping_providers?: number;
   internal_providers: number;
   donor_providers: number;
 };
@@ -78,6 +96,24 @@ export type BillingStats = {
   total_amount_usd: number;
   total_bonus_usd: number;
   total_revenue_usd: number;
+  total_credits_usd?: number;
+};
+
+export type Credit = {
+  id: string;
+  reference_id: string;
+  user_id: string;
+  provider_id?: string;
+  resource_type?: string;
+  resource_id?: string;
+  rental_id?: string;
+  period_start: string;
+  period_end: string;
+  credit_pct: number;
+  basis_usd: number;
+  amount_usd: number;
+  reason: string;
+  created_at: string;
 };
 
 export type ApiError = {
@@ -152,6 +188,7 @@ export type UserSettings = {
 
 export type VMStatus = "provisioning" | "running" | "stopped" | "terminated" | "expired";
 export type PodStatus = "provisioning" | "running" | "stopped" | "terminated" | "expired";
+export type ResourceHealth = "unknown" | "healthy" | "degraded";
 
 export type VM = {
   id?: string;
@@ -177,6 +214,7 @@ export type VM = {
   external_id?: string;
   expires_at?: string;
   status?: VMStatus;
+  health?: ResourceHealth;
   created_at?: string;
   updated_at?: string;
 };
@@ -192,8 +230,11 @@ export type Pod = {
   cpu_count: number;
   memory_gb: number;
   external_id?: string;
+  ip_address?: string;
   expires_at?: string;
   status?: PodStatus;
+  health?: ResourceHealth;
+  availability_tier?: AvailabilityTier;
   created_at?: string;
   updated_at?: string;
 };
@@ -241,11 +282,67 @@ export type SharedInventoryOffer = {
   available_qty: number;
   price_hourly_usd: number;
   status: "active" | "paused" | "sold_out";
+  pricing_mode?: "fixed" | "auction";
+  auction_rule?: "uniform" | "second_price";
+  clearing_period_minutes?: number;
+  next_clearing_at?: string;
+  last_clearing_price_usd?: number;
+  provider_presence?: PresenceState;
+  provider_verification?: HostVerificationState;
   created_by?: string;
   created_at?: string;
   updated_at?: string;
 };
 
+export type OfferBid = {
+  id: string;
+  offer_id: string;
+  user_id: string;
+  provider_id: string;
+  quantity: number;
+  max_price_hourly_usd: number;
+  duration_hours: number;
+  status: "open" | "winning" | "outbid" | "expired" | "cancelled";
+  allocated_qty: number;
+  clearing_price_usd?: number;
+  allocation_id?: string;
+  billing_rental_id?: string;
+  expires_at: string;
+  created_at: string;
+  updated_at: string;
+};
+
+export type AuctionClearing = {
+  id: string;
+  offer_id: string;
+  rule: "uniform" | "second_price";
+  period_start: string;
+  period_end: string;
+  clearing_price_usd: number;
+  offered_qty: number;
+  allocated_qty: number;
+  bid_count: number;
+  awards: { bid_id: string; user_id: string; quantity: number; price_hourly_usd: number }[];
+  created_at: string;
+};
+
+export type OfferBooking = {
+  id: string;
+  offer_id: string;
+  user_id: string;
+  provider_id: string;
+  quantity: number;
+  price_hourly_usd: number;
+  status: "held" | "confirmed" | "released" | "cancelled" | "refunded";
+  hold_expires_at: string;
+  allocation_id?: string;
+  billing_rental_id?: string;
+  confirmed_at?: string;
+  closed_at?: string;
+  created_at: string;
+  updated_at: string;
+};
+
 export type CatalogFilter = {
   search?: string;
   region?: string;
@@ -283,16 +380,158 @@ export type HealthCheck = {
   check_type: string;
   status: "ok" | "warning" | "critical";
   details: string;
+  probe_id?: string;
+  latency_ms?: number;
   checked_at?: string;
 };
 
+export type AvailabilityTier = "low" | "medium" | "high";
+
+export type SLATarget = {
+  tier: AvailabilityTier;
+  target_pct: number;
+  credit_pct: number;
+};
+
+export type SLAReport = {
+  resource_type: "vm" | "pod" | "provider";
+  resource_id: string;
+  user_id?: string;
+  provider_id?: string;
+  tier: AvailabilityTier;
+  period: string;
+  period_start: string;
+  period_end: string;
+  target_pct: number;
+  uptime_pct: number;
+  monitored_seconds: number;
+  downtime_seconds: number;
+  met: boolean;
+  final: boolean;
+  credit_pct?: number;
+  credit_status: "none" | "pending" | "issued";
+  credit_usd?: number;
+  created_at?: string;
+  updated_at?: string;
+};
+
+export type HealthProbe = {
+  id?: string;
+  resource_type?: "vm" | "pod";
+  resource_id: string;
+  kind: "tcp" | "http" | "reachability" | "ssh";
+  port?: number;
+  path?: string;
+  expected_status?: number;
+  interval_seconds?: number;
+  timeout_seconds?: number;
+  failure_threshold?: number;
+  enabled?: boolean;
+  consecutive_failures?: number;
+  last_status?: HealthCheck["status"];
+  last_latency_ms?: number;
+  last_checked_at?: string;
+  next_run_at?: string;
+  created_by?: string;
+  created_at?: string;
+  updated_at?: string;
+};
+
 export type MetricPoint = {
   id?: string;
   resource_type: string;
   resource_id: string;
   metric_type: string;
+  provider_id?: string;
   value: number;
   captured_at?: string;
+  resolution?: "raw" | "1m" | "1h";
+  rollup?: { min: number; max: number; last: number; last_at: string; samples: number };
+};
+
+export type MetricQueryFunction = "avg" | "min" | "max" | "sum" | "count" | "last" | "rate" | "delta" | "p95" | "p99";
+
+export type MetricQuerySeries = {
+  name?: string;
+  metric_type: string;
+  resource_type?: string;
+  resource_id?: string;
+  provider_id?: string;
+  group_by?: "resource" | "provider";
+  function: MetricQueryFunction;
+};
+
+export type MetricQuery = {
+  from?: string;
+  to?: string;
+  step_seconds?: number;
+  resolution?: "raw" | "1m" | "1h";
+  series: MetricQuerySeries[];
+};
+
+export type MetricQueryResult = {
+  from: string;
+  to: string;
+  step_seconds: number;
+  resolution: "raw" | "1m" | "1h";
+  series: {
+    name: string;
+    function: MetricQueryFunction;
+    labels: Record<string, string>;
+    points: { t: string; v: number }[];
+  }[];
+};
+
+export type AlertChannel = { type: "webhook" | "email"; target: string };
+
+export type AlertRule = {
+  id?: string;
+  owner_user_id?: string;
+  scope?: "user" | "admin";
+  name: string;
+  kind: "metric" | "health_check" | "heartbeat";
+  resource_type?: string;
+  resource_id?: string;
+  metric_type?: string;
+  comparator?: ">" | ">=" | "<" | "<=" | "==" | "!=";
+  threshold?: number;
+  check_type?: string;
+  health_status?: "ok" | "warning" | "critical";
+  for_seconds?: number;
+  severity?: "info" | "warning" | "critical";
+  channels: AlertChannel[];
+  enabled?: boolean;
+  created_at?: string;
+  updated_at?: string;
+};
+
+export type Alert = {
+  id: string;
+  rule_id: string;
+  rule_name?: string;
+  severity?: string;
+  resource_type: string;
+  resource_id: string;
+  state: "pending" | "firing" | "resolved";
+  value: number;
+  summary: string;
+  started_at: string;
+  fired_at?: string;
+  resolved_at?: string;
+  notified_state?: string;
+  updated_at: string;
+};
+
+export type AlertSilence = {
+  id?: string;
+  owner_user_id?: string;
+  rule_id?: string;
+  resource_type?: string;
+  resource_id?: string;
+  comment: string;
+  starts_at?: string;
+  ends_at: string;
+  created_at?: string;
 };
 
 export type MetricSummary = {
@@ -318,21 +557,164 @@ export type AgentLog = {
 
 export type AgentCommand = {
   id: string;
+  seq: number;
   provider_id: string;
   resource_id: string;
   session_id: string;
-  command: "status" | "start" | "stop" | "restart" | "terminal_open" | "terminal_data" | "terminal_resize" | "terminal_close";
+  command: "status" | "start" | "stop" | "restart" | "terminal_open" | "terminal_data" | "terminal_resize" | "terminal_close" | "agent_update";
   payload: string;
   rows: number;
   cols: number;
-  status: "queued" | "running" | "succeeded" | "failed";
+  status: "queued" | "running" | "succeeded" | "failed" | "timed_out" | "cancelled";
   requested_by: string;
   result_message: string;
+  attempts: number;
+  max_attempts: number;
+  timeout_seconds: number;
+  rollout_id?: string;
+  deadline_at?: string;
+  lease_expires_at?: string;
   acknowledged_at?: string;
   created_at?: string;
   updated_at?: string;
 };
 
+export type AgentVersionInventory = {
+  versions: { agent_version: string; providers: number; online: number }[];
+  providers: { provider_id: string; agent_version: string; heartbeat_at: string; online: boolean }[];
+};
+
+export type RolloutSelector = {
+  all?: boolean;
+  provider_ids?: string[];
+  labels?: string[];
+  regions?: string[];
+  provider_types?: string[];
+};
+
+export type Rollout = {
+  id: string;
+  command: "status" | "start" | "stop" | "restart" | "agent_update";
+  payload: string;
+  selector: RolloutSelector;
+  waves: number[];
+  current_wave: number;
+  max_concurrency: number;
+  max_failure_pct: number;
+  pause_between_waves: boolean;
+  timeout_seconds: number;
+  max_attempts: number;
+  status: "running" | "paused" | "halted" | "completed" | "cancelled";
+  detail: string;
+  created_by: string;
+  failure_window_at: string;
+  created_at: string;
+  updated_at: string;
+  finished_at?: string;
+  progress: { total: number; pending: number; running: number; succeeded: number; failed: number; cancelled: number };
+};
+
+export type RolloutTarget = {
+  rollout_id: string;
+  provider_id: string;
+  position: number;
+  wave: number;
+  status: "pending" | "running" | "succeeded" | "failed" | "cancelled";
+  command_id: string;
+  detail: string;
+  started_at?: string;
+  finished_at?: string;
+};
+
+export type AgentEnrollment = {
+  id: string;
+  provider_id: string;
+  label: string;
+  created_by: string;
+  host_id: string;
+  token?: string;
+  expires_at: string;
+  used_at?: string;
+  created_at: string;
+};
+
+export type AgentHost = {
+  id: string;
+  provider_id: string;
+  hostname: string;
+  label: string;
+  enrollment_id: string;
+  status: "active" | "revoked";
+  credential_expires_at: string;
+  rotated_at?: string;
+  revoked_at?: string;
+  revoked_by: string;
+  public_key?: string;
+  created_at: string;
+  updated_at: string;
+};
+
+export type ExecRun = {
+  id: string;
+  provider_id: string;
+  command_id: string;
+  requested_by: string;
+  reason: string;
+  script?: string;
+  argv?: string[];
+  work_dir: string;
+  env_keys: string[];
+  run_as: string;
+  timeout_seconds: number;
+  status: "queued" | "running" | "succeeded" | "failed" | "timed_out" | "cancelled" | "rejected";
+  detail: string;
+  exit_code: number;
+  stdout: string;
+  stderr: string;
+  output_truncated: boolean;
+  created_at: string;
+  started_at?: string;
+  finished_at?: string;
+};
+
+export type ExecPolicy = {
+  provider_id: string;
+  enabled: boolean;
+  allowed_commands: string[];
+  allow_scripts: boolean;
+  max_timeout_seconds: number;
+  run_as: string;
+  updated_by?: string;
+  updated_at?: string;
+};
+
+export type HostVerificationState = "unverified" | "verified" | "flagged";
+
+export type HostVerification = {
+  provider_id: string;
+  status: HostVerificationState;
+  reason: string;
+  consecutive_passes: number;
+  failed_challenges: number;
+  last_challenge_at?: string;
+  flagged_at?: string;
+  updated_at?: string;
+};
+
+export type CapacityChallenge = {
+  id: string;
+  provider_id: string;
+  command_id: string;
+  kind: "cpu_memory" | "gpu_enum";
+  memory_mb?: number;
+  passes?: number;
+  status: "pending" | "passed" | "failed";
+  detail: string;
+  issued_by: string;
+  issued_at: string;
+  completed_at?: string;
+};
+
 export type TerminalSession = {
   id: string;
   provider_id: string;
@@ -341,11 +723,14 @@ export type TerminalSession = {
   status: "queued" | "open" | "closed" | "expired";
   rows: number;
   cols: number;
+  initial_rows: number;
+  initial_cols: number;
   last_input_seq: number;
   last_output_seq: number;
   last_active_at: string;
   closed_at?: string;
   exit_code: number;
+  recording_purged_at?: string;
   created_at: string;
   updated_at: string;
 };
@@ -360,6 +745,57 @@ export type TerminalChunk = {
   created_at: string;
 };
 
+export type TerminalParticipantRole = "owner" | "driver" | "viewer";
+
+export type TerminalParticipant = {
+  session_id: string;
+  user_id: string;
+  role: Exclude<TerminalParticipantRole, "owner">;
+  invited_by: string;
+  created_at: string;
+  updated_at: string;
+};
+
+export type TerminalPresence = {
+  user_id: string;
+  role: TerminalParticipantRole;
+  invited: boolean;
+  online: boolean;
+  connections: number;
+};
+
+export type TerminalFrame = {
+  type: "input" | "resize" | "output" | "input_ack" | "ping" | "pong" | "closed" | "error" | "presence";
+  seq?: number;
+  data?: string;
+  rows?: number;
+  cols?: number;
+  status?: TerminalSession["status"];
+  error?: string;
+  participants?: TerminalPresence[];
+};
+
+export type FileTransfer = {
+  id: string;
+  provider_id: string;
+  resource_id?: string;
+  requested_by: string;
+  grant_id?: string;
+  direction: "upload" | "download";
+  path: string;
+  size: number;
+  sha256?: string;
+  stored_bytes: number;
+  host_bytes: number;
+  status: "receiving" | "pushing" | "pulling" | "completed" | "failed" | "cancelled" | "expired";
+  detail?: string;
+  command_id?: string;
+  created_at: string;
+  updated_at: string;
+  completed_at?: string;
+  expires_at: string;
+};
+
 export type RootInputLog = {
   id?: string;
   provider_id: string;
@@ -394,3 +830,14 @@ export type SSHKey = {
   public_key: string;
   created_at?: string;
 };
+
+export type StreamEventType = "state" | "health_check" | "metric" | "agent_log" | "exec_output";
+
+export type StreamEvent = {
+  type: StreamEventType;
+  resource_type?: string;
+  resource_id?: string;
+  provider_id?: string;
+  data: unknown;
+  at: string;
+};
@@ -2,21 +2,43 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/MidasWR/ShareMTC/services/hostagent/config"
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/adapter/agentchannel"
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/adapter/credentials"
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/adapter/docker"
 	"github.com/MidasWR/ShareMTC/services/hostagent/internal/adapter/httpclient"
 	"github.com/MidasWR/ShareMTC/services/hostagent/internal/adapter/kafka"
 	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
 	"github.com/MidasWR/ShareMTC/services/hostagent/internal/service"
+	"github.com/MidasWR/ShareMTC/services/sdk/agentupdate"
 	"github.com/MidasWR/ShareMTC/services/sdk/logging"
+	"github.com/MidasWR/ShareMTC/services/sdk/logtail"
+	"github.com/rs/zerolog"
+)
+
+// version and releaseKey are set at build time with -ldflags "-X
+// main.version=v1.2.0 -X main.releaseKey=<base64 ed25519 public key>". A
+// build without a release key cannot update itself.
+var (
+	version    = "dev"
+	releaseKey = ""
 )
 
 func main() {
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version)
+		return
+	}
 	cfg := config.Load()
 	logger, err := logging.New(logging.Config{
 		ServiceName: "hostagent",
@@ -27,6 +49,7 @@ func main() {
 		os.Exit(1)
 	}
 	logger.Info().
+		Str("version", version).
 		Str("provider_id", cfg.ProviderID).
 		Dur("interval", cfg.Interval).
 		Str("resource_api_url", cfg.ResourceAPIURL).
@@ -34,6 +57,23 @@ func main() {
 		Str("kafka_topic", cfg.KafkaTopic).
 		Msg("hostagent configuration loaded")
 
+	updateDir := ""
+	if cfg.UpdateEnabled {
+		updateDir = cfg.UpdateDir
+	}
+	updater := service.NewUpdater(updateDir, version, releaseKey)
+	if next, err := updater.Launch(time.Now().UTC()); err != nil {
+		logger.Error().Err(err).Str("update_dir", updateDir).Msg("agent update state check failed")
+	} else if next != "" {
+		logger.Info().Str("binary", next).Msg("starting installed agent version")
+		if err := service.ExecBinary(next); err != nil {
+			logger.Error().Err(err).Str("binary", next).Msg("agent exec failed")
+			if _, err := updater.Rollback("installed version failed to start: " + err.Error()); err != nil {
+				logger.Error().Err(err).Msg("agent update rollback failed")
+			}
+		}
+	}
+
 	var producer *kafka.Producer
 	if len(cfg.KafkaBrokers) > 0 {
 		producer, err = kafka.New(cfg.KafkaBrokers)
@@ -47,93 +87,394 @@ func main() {
 		logger.Fatal().Err(errors.New("no output configured")).Msg("set KAFKA_BROKERS or RESOURCE_API_URL")
 	}
 
+	creds := credentials.NewStore(cfg.CredentialFile, cfg.ResourceAPIURL, cfg.AgentToken)
+	if cfg.ResourceAPIURL != "" {
+		hostname, _ := os.Hostname()
+		if err := creds.Load(context.Background(), cfg.EnrollmentToken, hostname); err != nil {
+			logger.Fatal().Err(err).Str("credential_file", cfg.CredentialFile).Msg("agent enrollment failed")
+		}
+		if cred := creds.Credential(); cred.HostID != "" {
+			// An enrolled credential is bound to its provider; PROVIDER_ID
+			// cannot override it.
+			cfg.ProviderID = cred.ProviderID
+			logger.Info().Str("host_id", cred.HostID).Str("provider_id", cred.ProviderID).Time("rotate_after", cred.RotateAfter).Msg("agent credential loaded")
+		} else if cfg.AgentToken != "" {
+			logger.Warn().Msg("using static AGENT_TOKEN; enroll the host with ENROLLMENT_TOKEN for a per-host credential")
+		}
+	}
+
 	ticker := time.NewTicker(cfg.Interval)
 	defer ticker.Stop()
 
 	state := service.NetState{}
 	collectionEnabled := true
+	// Commands arrive over the agent channel when it is connected; the
+	// ticker keeps polling over HTTP while it is not.
+	var channel *agentchannel.Client
+	var channelCommands <-chan models.AgentCommand
+	if cfg.AgentChannel && cfg.ResourceAPIURL != "" && creds.Token() != "" {
+		channel = agentchannel.New(cfg.ResourceAPIURL, creds.Token, cfg.ProviderID, logger)
+		channelCommands = channel.Commands()
+		go channel.Run(context.Background())
+	}
+	execRunner := service.NewExecRunner(cfg.ExecEnabled, cfg.ExecMaxOutputKB*1024, func(execID string, stream string, data string) {
+		if cfg.ResourceAPIURL == "" || creds.Token() == "" {
+			return
+		}
+		if channel != nil && channel.Connected() {
+			if err := channel.SendExecOutput(execID, stream, data); err == nil {
+				return
+			}
+		}
+		if err := httpclient.ReportExecOutput(context.Background(), cfg.ResourceAPIURL, creds.Token(), execID, cfg.ProviderID, stream, data); err != nil {
+			logger.Error().Err(err).Str("exec_id", execID).Msg("exec output report failed")
+		}
+	})
+	fileSandboxDir := ""
+	if cfg.FilesEnabled {
+		fileSandboxDir = cfg.FileSandboxDir
+	}
+	fileTransfers := service.NewFileTransfers(fileSandboxDir, func(transferID string, offset int64, data []byte) error {
+		if cfg.ResourceAPIURL == "" || creds.Token() == "" {
+			return errors.New("resource api is not configured")
+		}
+		if channel != nil && channel.Connected() {
+			if err := channel.SendFileChunk(transferID, offset, data); err == nil {
+				return nil
+			}
+		}
+		return httpclient.ReportFileChunk(context.Background(), cfg.ResourceAPIURL, creds.Token(), transferID, cfg.ProviderID, offset, data)
+	})
 	terminalManager := service.NewTerminalManager(func(sessionID string, payload string) {
-		if cfg.ResourceAPIURL == "" || cfg.AgentToken == "" || strings.TrimSpace(payload) == "" {
+		if cfg.ResourceAPIURL == "" || creds.Token() == "" || strings.TrimSpace(payload) == "" {
 			return
 		}
-		if err := httpclient.ReportTerminalOutput(context.Background(), cfg.ResourceAPIURL, cfg.AgentToken, sessionID, cfg.ProviderID, payload); err != nil {
+		if channel != nil && channel.Connected() {
+			if err := channel.SendTerminalOutput(sessionID, payload); err == nil {
+				return
+			}
+		}
+		if err := httpclient.ReportTerminalOutput(context.Background(), cfg.ResourceAPIURL, creds.Token(), sessionID, cfg.ProviderID, payload); err != nil {
 			logger.Error().Err(err).Str("session_id", sessionID).Msg("terminal output report failed")
 		}
 	})
+	if channel != nil {
+		// Terminal frames are applied off the command loop, which may be busy
+		// with a slow command while the user types.
+		go func() {
+			for frame := range channel.Terminal() {
+				var err error
+				if frame.Type == models.AgentFrameTerminalResize {
+					err = terminalManager.Resize(frame.SessionID, frame.Rows, frame.Cols)
+				} else {
+					err = terminalManager.Write(frame.SessionID, frame.Data)
+				}
+				if err != nil {
+					logger.Warn().Err(err).Str("session_id", frame.SessionID).Str("frame_type", frame.Type).Msg("terminal frame failed")
+				}
+			}
+		}()
+	}
+	logBuffer := service.NewLogBuffer(5000)
+	podManager := service.NewPodManager(docker.NewRuntime(cfg.PodRuntimeBin), cfg.PodCgroupParent, logBuffer.Add)
+	if err := podManager.SetFileSandbox(fileSandboxDir); err != nil {
+		logger.Fatal().Err(err).Msg("invalid FILE_SANDBOX_DIR")
+	}
+	// Pods can start before the first collection tick, so count the GPUs now;
+	// each tick refreshes the count.
+	podManager.SetGPUTotal(service.GPUTotalUnits())
+	if adopted, err := podManager.Recover(context.Background()); err != nil {
+		logger.Warn().Err(err).Msg("existing pod containers could not be listed")
+	} else if adopted > 0 {
+		logger.Info().Int("pod_count", adopted).Msg("adopted existing pod containers")
+	}
+	logSources, err := logtail.ParseSources(cfg.LogSources)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid LOG_SOURCES")
+	}
+	if len(logSources) > 0 {
+		// Host level sources are attributed to the provider itself.
+		go logtail.Run(context.Background(), logSources, 10*time.Second, func(entry logtail.Entry) {
+			logBuffer.Add(models.ResourceLog{
+				ResourceID: cfg.ProviderID,
+				SourceType: entry.SourceType,
+				Source:     entry.Source,
+				Stream:     entry.Stream,
+				Level:      entry.Level,
+				Message:    entry.Message,
+				OccurredAt: entry.OccurredAt,
+			})
+		})
+		logger.Info().Int("log_source_count", len(logSources)).Msg("host log tailing started")
+	}
+	completeCommand := func(cmd models.AgentCommand, status string, message string) {
+		sent := channel != nil && channel.Connected() && channel.SendResult(cmd.ID, status, message) == nil
+		if !sent {
+			if err := httpclient.CompleteAgentCommand(context.Background(), cfg.ResourceAPIURL, creds.Token(), cmd.ID, cfg.ProviderID, status, message); err != nil {
+				logger.Error().Err(err).Str("command_id", cmd.ID).Str("command", cmd.Command).Msg("agent command completion failed")
+			}
+		}
+		logger.Info().
+			Str("command_id", cmd.ID).
+			Str("command", cmd.Command).
+			Str("result_status", status).
+			Str("result_message", message).
+			Msg("agent command processed")
+	}
+	// An update is reported by whichever version ends up running: the new
+	// one after its first delivered heartbeat, or the previous one after a
+	// rollback.
+	reportRolledBack := func() {
+		if state, ok := updater.TakeRolledBack(); ok {
+			logger.Warn().Str("to_version", state.ToVersion).Str("reason", state.Detail).Msg("agent update rolled back")
+			message, _ := json.Marshal(state.Result(version))
+			completeCommand(models.AgentCommand{ID: state.CommandID, Command: "agent_update"}, "failed", string(message))
+		}
+	}
+	rollbackUpdate := func(reason string) {
+		next, err := updater.Rollback(reason)
+		if err != nil {
+			logger.Error().Err(err).Msg("agent update rollback failed")
+			return
+		}
+		if next != "" {
+			logger.Warn().Str("reason", reason).Str("binary", next).Msg("restoring previous agent version")
+			if err := service.ExecBinary(next); err != nil {
+				logger.Error().Err(err).Str("binary", next).Msg("agent exec failed")
+			}
+		}
+		reportRolledBack()
+	}
+	reportRolledBack()
+	trial, onTrial := updater.Trial()
+	if onTrial {
+		logger.Info().Str("from_version", trial.FromVersion).Time("deadline", trial.Deadline).Msg("agent update on trial until the first delivered heartbeat")
+		time.AfterFunc(time.Until(trial.Deadline), func() {
+			rollbackUpdate(fmt.Sprintf("version %s did not deliver a heartbeat before the health timeout", trial.ToVersion))
+		})
+	}
+	// Commands off the command loop run until their deadline, or until a
+	// command_cancel for them arrives. An update waits for them to finish.
+	asyncCommands := service.NewAsyncCommands()
+	runAsync := func(cmd models.AgentCommand, run func(ctx context.Context)) {
+		ctx, done, err := asyncCommands.Start(cmd.ID, cmd.DeadlineAt)
+		if err != nil {
+			completeCommand(cmd, "failed", err.Error())
+			return
+		}
+		go func() {
+			defer done()
+			run(ctx)
+		}()
+	}
+	executeCommand := func(cmd models.AgentCommand) {
+		resultStatus := "succeeded"
+		resultMessage := "command executed"
+		async := false
+		switch cmd.Command {
+		case "status":
+			if collectionEnabled {
+				resultMessage = "collector is running"
+			} else {
+				resultMessage = "collector is stopped"
+			}
+		case "start":
+			collectionEnabled = true
+			resultMessage = "collector started"
+		case "stop":
+			collectionEnabled = false
+			resultMessage = "collector stopped"
+		case "restart":
+			collectionEnabled = false
+			collectionEnabled = true
+			resultMessage = "collector restarted"
+		case "terminal_open":
+			err := asyncCommands.Admit(func() error {
+				return terminalManager.Open(cmd.SessionID, cmd.Rows, cmd.Cols)
+			})
+			if err != nil {
+				resultStatus = "failed"
+				resultMessage = err.Error()
+			} else {
+				resultMessage = "terminal opened"
+			}
+		case "terminal_data":
+			if err := terminalManager.Write(cmd.SessionID, cmd.Payload); err != nil {
+				resultStatus = "failed"
+				resultMessage = err.Error()
+			} else {
+				resultMessage = "terminal input delivered"
+			}
+		case "terminal_resize":
+			if err := terminalManager.Resize(cmd.SessionID, cmd.Rows, cmd.Cols); err != nil {
+				resultStatus = "failed"
+				resultMessage = err.Error()
+			} else {
+				resultMessage = "terminal resized"
+			}
+		case "terminal_close":
+			if err := terminalManager.Close(cmd.SessionID); err != nil {
+				resultStatus = "failed"
+				resultMessage = err.Error()
+			} else {
+				resultMessage = "terminal closed"
+			}
+		case "pod_start":
+			// Image pulls can take minutes, so the pod starts off the command loop
+			// and completes its command on its own.
+			async = true
+			runAsync(cmd, func(ctx context.Context) {
+				status := "succeeded"
+				message, err := podManager.Start(ctx, cmd.Payload)
+				if err != nil {
+					status = "failed"
+					message = err.Error()
+				}
+				completeCommand(cmd, status, message)
+			})
+		case "capacity_challenge":
+			// The memory workload takes seconds; keep the command loop free.
+			async = true
+			runAsync(cmd, func(ctx context.Context) {
+				status := "succeeded"
+				message, err := service.RunCapacityChallenge(ctx, cmd.Payload)
+				if err != nil {
+					status = "failed"
+					message = err.Error()
+				}
+				completeCommand(cmd, status, message)
+			})
+		case "exec":
+			async = true
+			runAsync(cmd, func(ctx context.Context) {
+				result := execRunner.Run(ctx, cmd.Payload)
+				status := "succeeded"
+				if !result.Succeeded() {
+					status = "failed"
+				}
+				message, _ := json.Marshal(result)
+				completeCommand(cmd, status, string(message))
+			})
+		case "file_write":
+			result := fileTransfers.Write(cmd.Payload)
+			if result.Error != "" {
+				resultStatus = "failed"
+			}
+			message, _ := json.Marshal(result)
+			resultMessage = string(message)
+		case "file_read":
+			// Large files stream for a while; chunks go out before the result.
+			async = true
+			runAsync(cmd, func(ctx context.Context) {
+				result := fileTransfers.Read(ctx, cmd.Payload)
+				status := "succeeded"
+				if result.Error != "" {
+					status = "failed"
+				}
+				message, _ := json.Marshal(result)
+				completeCommand(cmd, status, string(message))
+			})
+		case "agent_update":
+			// The download runs off the command loop. On success this process
+			// is replaced and the new version reports the result. Replacing it
+			// would cut off running commands and terminals, so the update
+			// waits until there are none and holds new ones off meanwhile.
+			async = true
+			go func(cmd models.AgentCommand) {
+				var req agentupdate.Request
+				_ = json.Unmarshal([]byte(cmd.Payload), &req)
+				result := agentupdate.Result{FromVersion: version, ToVersion: req.Version, Running: version}
+				ctx, cancel := context.WithCancel(context.Background())
+				if !cmd.DeadlineAt.IsZero() {
+					ctx, cancel = context.WithDeadline(context.Background(), cmd.DeadlineAt)
+				}
+				defer cancel()
+				release, err := asyncCommands.Hold(ctx, func() bool { return terminalManager.Count() == 0 })
+				if err != nil {
+					result.Error = "agent stayed busy with running commands or terminal sessions"
+					message, _ := json.Marshal(result)
+					completeCommand(cmd, "failed", string(message))
+					return
+				}
+				defer release()
+				next, err := updater.Stage(ctx, cmd.ID, cmd.Payload, time.Now().UTC())
+				switch {
+				case errors.Is(err, service.ErrUpdateInTrial):
+					return
+				case errors.Is(err, service.ErrUpdateCurrent):
+					message, _ := json.Marshal(result)
+					completeCommand(cmd, "succeeded", string(message))
+				case err != nil:
+					result.Error = err.Error()
+					message, _ := json.Marshal(result)
+					completeCommand(cmd, "failed", string(message))
+				default:
+					logger.Info().Str("to_version", req.Version).Str("binary", next).Msg("restarting into the new agent version")
+					if err := service.ExecBinary(next); err != nil {
+						rollbackUpdate("restart failed: " + err.Error())
+					}
+				}
+			}(cmd)
+		case "command_cancel":
+			if asyncCommands.Cancel(cmd.Payload) {
+				resultMessage = "command cancelled"
+			} else {
+				resultMessage = "command is not running"
+			}
+		case "pod_stop":
+			if err := podManager.Stop(context.Background(), cmd.ResourceID); err != nil {
+				resultStatus = "failed"
+				resultMessage = err.Error()
+			} else {
+				resultMessage = "container removed"
+			}
+		case "pod_status":
+			message, err := podManager.Status(context.Background(), cmd.ResourceID)
+			if err != nil {
+				resultStatus = "failed"
+				resultMessage = err.Error()
+			} else {
+				resultMessage = message
+			}
+		default:
+			resultStatus = "failed"
+			resultMessage = "unsupported command"
+		}
+		if !async {
+			completeCommand(cmd, resultStatus, resultMessage)
+		}
+	}
 	logger.Info().
 		Strs("brokers", cfg.KafkaBrokers).
 		Str("topic", cfg.KafkaTopic).
 		Str("resource_api_url", cfg.ResourceAPIURL).
 		Msg("hostagent started")
-	for range ticker.C {
-		if cfg.ResourceAPIURL != "" && cfg.AgentToken != "" {
-			cmd, pollErr := httpclient.PollAgentCommand(context.Background(), cfg.ResourceAPIURL, cfg.AgentToken, cfg.ProviderID)
+	for {
+		select {
+		case cmd := <-channelCommands:
+			executeCommand(cmd)
+			continue
+		case <-ticker.C:
+		}
+		if rotated, err := creds.RotateIfDue(context.Background(), time.Now().UTC()); err != nil {
+			logger.Error().Err(err).Msg("agent credential rotation failed")
+		} else if rotated {
+			logger.Info().Time("rotate_after", creds.Credential().RotateAfter).Msg("agent credential rotated")
+		}
+		if cfg.ResourceAPIURL != "" && creds.Token() != "" && (channel == nil || !channel.Connected()) {
+			cmd, pollErr := httpclient.PollAgentCommand(context.Background(), cfg.ResourceAPIURL, creds.Token(), cfg.ProviderID)
 			if pollErr != nil {
 				logger.Error().Err(pollErr).Msg("agent command poll failed")
 			} else if cmd.ID != "" {
-				resultStatus := "succeeded"
-				resultMessage := "command executed"
-				switch cmd.Command {
-				case "status":
-					if collectionEnabled {
-						resultMessage = "collector is running"
-					} else {
-						resultMessage = "collector is stopped"
-					}
-				case "start":
-					collectionEnabled = true
-					resultMessage = "collector started"
-				case "stop":
-					collectionEnabled = false
-					resultMessage = "collector stopped"
-				case "restart":
-					collectionEnabled = false
-					collectionEnabled = true
-					resultMessage = "collector restarted"
-				case "terminal_open":
-					if err := terminalManager.Open(cmd.SessionID, cmd.Rows, cmd.Cols); err != nil {
-						resultStatus = "failed"
-						resultMessage = err.Error()
-					} else {
-						resultMessage = "terminal opened"
-					}
-				case "terminal_data":
-					if err := terminalManager.Write(cmd.SessionID, cmd.Payload); err != nil {
-						resultStatus = "failed"
-						resultMessage = err.Error()
-					} else {
-						resultMessage = "terminal input delivered"
-					}
-				case "terminal_resize":
-					if err := terminalManager.Resize(cmd.SessionID, cmd.Rows, cmd.Cols); err != nil {
-						resultStatus = "failed"
-						resultMessage = err.Error()
-					} else {
-						resultMessage = "terminal resized"
-					}
-				case "terminal_close":
-					if err := terminalManager.Close(cmd.SessionID); err != nil {
-						resultStatus = "failed"
-						resultMessage = err.Error()
-					} else {
-						resultMessage = "terminal closed"
-					}
-				default:
-					resultStatus = "failed"
-					resultMessage = "unsupported command"
+				if channel != nil {
+					channel.Observe(cmd.Seq)
 				}
-				if err := httpclient.CompleteAgentCommand(context.Background(), cfg.ResourceAPIURL, cfg.AgentToken, cmd.ID, cfg.ProviderID, resultStatus, resultMessage); err != nil {
-					logger.Error().Err(err).Str("command_id", cmd.ID).Str("command", cmd.Command).Msg("agent command completion failed")
-				}
-				logger.Info().
-					Str("command_id", cmd.ID).
-					Str("command", cmd.Command).
-					Str("result_status", resultStatus).
-					Str("result_message", resultMessage).
-					Msg("agent command processed")
+				executeCommand(cmd)
 			}
 		}
 
+		flushResourceLogs(logger, cfg, creds.Token(), producer, logBuffer)
+
 		if !collectionEnabled {
 			logger.Debug().Msg("collector is paused by command")
 			continue
@@ -146,13 +487,24 @@ func main() {
 			continue
 		}
 		state = nextState
+		metric.AgentVersion = version
+		metric.Region = cfg.Region
+		metric.Labels = cfg.Labels
+		delivered := false
+		podManager.SetGPUTotal(metric.GPUTotalUnits)
 		logger.Debug().
 			Int64("last_net_bytes", state.LastBytes).
 			Time("last_at", state.LastAt).
 			Msg("network state updated")
 		if producer != nil {
-			if err := producer.PublishMetric(context.Background(), cfg.KafkaTopic, metric); err != nil {
-				logger.Error().Err(err).Msg("publish metric failed")
+			// Enrolled hosts send their heartbeat signed over HTTP only; the
+			// resource service drops unsigned Kafka heartbeats from them.
+			if creds.Credential().HostID == "" {
+				if err := producer.PublishMetric(context.Background(), cfg.KafkaTopic, metric); err != nil {
+					logger.Error().Err(err).Msg("publish metric failed")
+				} else {
+					delivered = true
+				}
 			}
 			for _, evt := range metricEvents(metric) {
 				if err := producer.PublishEvent(context.Background(), cfg.KafkaTopic, evt); err != nil {
@@ -166,8 +518,10 @@ func main() {
 			}
 		}
 		if cfg.ResourceAPIURL != "" {
-			if err := httpclient.SendHeartbeat(context.Background(), cfg.ResourceAPIURL, cfg.AgentToken, metric); err != nil {
+			if err := httpclient.SendHeartbeat(context.Background(), cfg.ResourceAPIURL, creds.Token(), creds.Sign, metric); err != nil {
 				logger.Error().Err(err).Msg("heartbeat http failed")
+			} else {
+				delivered = true
 			}
 			logLevel := "info"
 			if metric.GPUFreeUnits == 0 {
@@ -178,10 +532,18 @@ func main() {
 				logLevel = "warning"
 				logMessage = "network throughput is zero on heartbeat"
 			}
-			if err := httpclient.SendAgentLog(context.Background(), cfg.ResourceAPIURL, cfg.AgentToken, serviceLog(metric.ProviderID, logLevel, logMessage)); err != nil {
+			if err := httpclient.SendAgentLog(context.Background(), cfg.ResourceAPIURL, creds.Token(), serviceLog(metric.ProviderID, logLevel, logMessage)); err != nil {
 				logger.Error().Err(err).Msg("agent log http failed")
 			}
 		}
+		if delivered && onTrial {
+			if trial, ok := updater.Commit(); ok {
+				onTrial = false
+				logger.Info().Str("from_version", trial.FromVersion).Str("to_version", trial.ToVersion).Msg("agent update committed")
+				message, _ := json.Marshal(trial.Result(version))
+				completeCommand(models.AgentCommand{ID: trial.CommandID, Command: "agent_update"}, "succeeded", string(message))
+			}
+		}
 		logger.Info().
 			Str("provider_id", metric.ProviderID).
 			Int("cpu_total_cores", metric.CPUTotalCores).
@@ -201,6 +563,50 @@ func main() {
 	}
 }
 
+func flushResourceLogs(logger zerolog.Logger, cfg config.Config, token string, producer *kafka.Producer, buffer *service.LogBuffer) {
+	for {
+		entries, dropped := buffer.Drain(500)
+		if dropped > 0 {
+			logger.Warn().Int("dropped_count", dropped).Msg("resource log buffer overflowed")
+		}
+		if len(entries) == 0 {
+			return
+		}
+		if producer != nil {
+			for _, entry := range entries {
+				if err := producer.PublishEvent(context.Background(), cfg.KafkaTopic, resourceLogEvent(cfg.ProviderID, entry)); err != nil {
+					logger.Error().Err(err).Str("resource_id", entry.ResourceID).Msg("publish resource log failed")
+					return
+				}
+			}
+		} else if cfg.ResourceAPIURL != "" {
+			if err := httpclient.SendResourceLogs(context.Background(), cfg.ResourceAPIURL, token, cfg.ProviderID, entries); err != nil {
+				logger.Error().Err(err).Int("entry_count", len(entries)).Msg("resource log http failed")
+				return
+			}
+		}
+		if len(entries) < 500 {
+			return
+		}
+	}
+}
+
+func resourceLogEvent(providerID string, entry models.ResourceLog) kafka.Event {
+	return kafka.Event{
+		EventType:  "resource_log",
+		ProviderID: providerID,
+		ResourceID: entry.ResourceID,
+		OccurredAt: entry.OccurredAt,
+		Payload: map[string]interface{}{
+			"source_type": entry.SourceType,
+			"source":      entry.Source,
+			"stream":      entry.Stream,
+			"level":       entry.Level,
+			"message":     entry.Message,
+		},
+	}
+}
+
 func serviceLog(providerID string, level string, message string) models.AgentLog {
 	return models.AgentLog{
 		ProviderID: providerID,
@@ -240,6 +646,8 @@ func metricEvents(metric models.HostMetric) []kafka.Event {
 		makeMetric("host_gpu_memory_used_mb", float64(metric.GPUMemoryUsedMB)),
 		makeMetric("host_disk_total_mb", float64(metric.DiskTotalMB)),
 		makeMetric("host_disk_free_mb", float64(metric.DiskFreeMB)),
+		makeMetric("host_disk_free_pct", ratio(metric.DiskFreeMB, metric.DiskTotalMB)*100),
+		makeMetric("host_ram_free_pct", ratio(metric.RAMFreeMB, metric.RAMTotalMB)*100),
 		makeMetric("host_network_mbps", float64(metric.NetworkMbps)),
 		makeMetric("host_load_avg_1m", metric.LoadAvg1m),
 		makeMetric("host_uptime_seconds", float64(metric.UptimeSeconds)),
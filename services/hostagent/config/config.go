@@ -14,6 +14,20 @@ type Config struct {
 	AgentToken      string
 	Interval        time.Duration
 	MidasWriterAddr string
+	PodRuntimeBin   string
+	PodCgroupParent string
+	LogSources      string
+	AgentChannel    bool
+	EnrollmentToken string
+	CredentialFile  string
+	ExecEnabled     bool
+	ExecMaxOutputKB int
+	FilesEnabled    bool
+	FileSandboxDir  string
+	UpdateEnabled   bool
+	UpdateDir       string
+	Region          string
+	Labels          []string
 }
 
 func Load() Config {
@@ -25,6 +39,20 @@ func Load() Config {
 		AgentToken:      env("AGENT_TOKEN", ""),
 		Interval:        time.Duration(envInt("METRICS_INTERVAL_SECONDS", 5)) * time.Second,
 		MidasWriterAddr: os.Getenv("MIDAS_WRITER_ADDR"),
+		PodRuntimeBin:   env("POD_RUNTIME_BIN", "docker"),
+		PodCgroupParent: env("POD_CGROUP_PARENT", "/sharemtc"),
+		LogSources:      os.Getenv("LOG_SOURCES"),
+		AgentChannel:    env("AGENT_CHANNEL", "true") != "false",
+		EnrollmentToken: os.Getenv("ENROLLMENT_TOKEN"),
+		CredentialFile:  env("CREDENTIAL_FILE", "/var/lib/sharemct/credential.json"),
+		ExecEnabled:     env("EXEC_ENABLED", "false") == "true",
+		ExecMaxOutputKB: envInt("EXEC_MAX_OUTPUT_KB", 1024),
+		FilesEnabled:    env("FILE_TRANSFER_ENABLED", "true") != "false",
+		FileSandboxDir:  env("FILE_SANDBOX_DIR", "/var/lib/sharemct/files"),
+		UpdateEnabled:   env("UPDATE_ENABLED", "true") != "false",
+		UpdateDir:       env("UPDATE_DIR", "/var/lib/sharemct/agent"),
+		Region:          os.Getenv("HOST_REGION"),
+		Labels:          splitCSV(os.Getenv("HOST_LABELS")),
 	}
 }
 
@@ -5,6 +5,8 @@ go 1.25.0
 require (
 	github.com/IBM/sarama v1.45.0
 	github.com/MidasWR/ShareMTC/services/sdk v0.0.0
+	github.com/rs/zerolog v1.34.0
+	golang.org/x/net v0.41.0
 )
 
 require (
@@ -28,9 +30,7 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/pierrec/lz4/v4 v4.1.22 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475 // indirect
-	github.com/rs/zerolog v1.34.0 // indirect
 	golang.org/x/crypto v0.39.0 // indirect
-	golang.org/x/net v0.41.0 // indirect
 	golang.org/x/sys v0.36.0 // indirect
 	golang.org/x/text v0.26.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250707201910-8d1bb00bc6a7 // indirect
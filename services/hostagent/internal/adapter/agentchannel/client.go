@@ -0,0 +1,222 @@
+package agentchannel
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// readTimeout matches the server, which pings every 15s; three missed
+	// pings mean the connection is gone.
+	readTimeout  = 45 * time.Second
+	writeTimeout = 10 * time.Second
+	maxBackoff   = 30 * time.Second
+)
+
+// Client keeps a WebSocket open to resourceservice over which commands are
+// pushed as soon as they are queued. It reconnects on failure and resumes
+// from the highest command seq it has received, so commands still running
+// server-side are replayed once rather than lost.
+type Client struct {
+	baseURL    string
+	token      func() string
+	providerID string
+	logger     zerolog.Logger
+	commands   chan models.AgentCommand
+	terminal   chan models.AgentChannelFrame
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	lastSeq int64
+}
+
+// New takes the token as a function so a rotated credential is used on the
+// next reconnect.
+func New(baseURL string, token func() string, providerID string, logger zerolog.Logger) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		providerID: providerID,
+		logger:     logger,
+		commands:   make(chan models.AgentCommand, 64),
+		terminal:   make(chan models.AgentChannelFrame, 256),
+	}
+}
+
+// Commands delivers pushed commands in seq order.
+func (c *Client) Commands() <-chan models.AgentCommand {
+	return c.commands
+}
+
+// Terminal delivers terminal input and resizes, which the server pushes
+// outside the command queue so typing reaches the shell at once.
+func (c *Client) Terminal() <-chan models.AgentChannelFrame {
+	return c.terminal
+}
+
+// Connected reports whether the channel is open. While it is, commands do not
+// need to be polled over HTTP.
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Run connects and reconnects until ctx ends.
+func (c *Client) Run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			c.logger.Warn().Err(err).Dur("retry_in", backoff).Msg("agent channel connect failed")
+		} else {
+			backoff = time.Second
+			err = c.serve(ctx, conn)
+			c.logger.Warn().Err(err).Msg("agent channel disconnected")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *Client) SendResult(commandID string, status string, message string) error {
+	return c.send(models.AgentChannelFrame{Type: models.AgentFrameResult, CommandID: commandID, Status: status, ResultMessage: message})
+}
+
+func (c *Client) SendTerminalOutput(sessionID string, data string) error {
+	return c.send(models.AgentChannelFrame{Type: models.AgentFrameTerminalOutput, SessionID: sessionID, Data: data})
+}
+
+func (c *Client) SendExecOutput(execID string, stream string, data string) error {
+	return c.send(models.AgentChannelFrame{Type: models.AgentFrameExecOutput, ExecID: execID, Stream: stream, Data: data})
+}
+
+func (c *Client) SendFileChunk(transferID string, offset int64, data []byte) error {
+	return c.send(models.AgentChannelFrame{Type: models.AgentFrameFileChunk, TransferID: transferID, Offset: offset, Data: base64.StdEncoding.EncodeToString(data)})
+}
+
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	c.mu.Lock()
+	resumeSeq := c.lastSeq
+	c.mu.Unlock()
+	endpoint, err := url.Parse(c.baseURL + "/v1/resources/agent/channel")
+	if err != nil {
+		return nil, err
+	}
+	switch endpoint.Scheme {
+	case "https":
+		endpoint.Scheme = "wss"
+	case "http":
+		endpoint.Scheme = "ws"
+	default:
+		return nil, errors.New("resource api url must be http or https")
+	}
+	query := endpoint.Query()
+	query.Set("provider_id", c.providerID)
+	query.Set("resume_seq", strconv.FormatInt(resumeSeq, 10))
+	endpoint.RawQuery = query.Encode()
+	config, err := websocket.NewConfig(endpoint.String(), c.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if token := c.token(); token != "" {
+		config.Header.Set("Authorization", "Bearer "+token)
+	}
+	return config.DialContext(ctx)
+}
+
+func (c *Client) serve(ctx context.Context, conn *websocket.Conn) error {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+	}()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+		var frame models.AgentChannelFrame
+		if err := websocket.JSON.Receive(conn, &frame); err != nil {
+			return err
+		}
+		switch frame.Type {
+		case models.AgentFrameHello:
+			c.logger.Info().Int64("resume_seq", frame.Seq).Msg("agent channel connected")
+		case models.AgentFramePing:
+			if err := c.send(models.AgentChannelFrame{Type: models.AgentFramePong}); err != nil {
+				return err
+			}
+		case models.AgentFrameCommand:
+			if frame.Command == nil || !c.Observe(frame.Seq) {
+				continue
+			}
+			// Unacknowledged commands are pushed again once their lease runs out.
+			if err := c.send(models.AgentChannelFrame{Type: models.AgentFrameAck, CommandID: frame.Command.ID}); err != nil {
+				return err
+			}
+			select {
+			case c.commands <- *frame.Command:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case models.AgentFrameTerminalInput, models.AgentFrameTerminalResize:
+			select {
+			case c.terminal <- frame:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case models.AgentFrameError:
+			c.logger.Warn().Str("command_id", frame.CommandID).Str("session_id", frame.SessionID).Str("error", frame.Error).Msg("agent channel frame rejected")
+		}
+	}
+}
+
+// Observe records the seq of a delivered command and reports whether it had
+// not been seen yet. Commands claimed over the HTTP fallback are observed too,
+// so a later resume does not replay them.
+func (c *Client) Observe(seq int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq <= c.lastSeq {
+		return false
+	}
+	c.lastSeq = seq
+	return true
+}
+
+func (c *Client) send(frame models.AgentChannelFrame) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return errors.New("agent channel is not connected")
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return websocket.JSON.Send(conn, frame)
+}
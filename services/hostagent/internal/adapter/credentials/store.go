@@ -0,0 +1,165 @@
+package credentials
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/adapter/httpclient"
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
+)
+
+// Store holds the agent's host credential and persists it across restarts.
+// Without an enrolled credential it falls back to the static token, if any.
+type Store struct {
+	path        string
+	baseURL     string
+	staticToken string
+
+	mu   sync.Mutex
+	cred models.AgentCredential
+}
+
+func NewStore(path string, baseURL string, staticToken string) *Store {
+	return &Store{path: path, baseURL: baseURL, staticToken: staticToken}
+}
+
+// Load reads a saved credential, or enrolls with enrollmentToken when there is
+// none. An agent that is neither enrolled nor given a token keeps using the
+// static token.
+func (s *Store) Load(ctx context.Context, enrollmentToken string, hostname string) error {
+	raw, err := os.ReadFile(s.path)
+	switch {
+	case err == nil:
+		var cred models.AgentCredential
+		if err := json.Unmarshal(raw, &cred); err != nil {
+			return err
+		}
+		s.set(cred)
+		return nil
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	case enrollmentToken == "":
+		return nil
+	}
+	privateKey, publicKey, err := generateKey()
+	if err != nil {
+		return err
+	}
+	cred, err := httpclient.EnrollAgent(ctx, s.baseURL, enrollmentToken, hostname, publicKey)
+	if err != nil {
+		return err
+	}
+	cred.PrivateKey = privateKey
+	return s.save(cred)
+}
+
+// RotateIfDue swaps in a new credential once the current one passes its
+// rotate_after time, or right away when the host has no signing key yet. It
+// reports whether a rotation happened.
+func (s *Store) RotateIfDue(ctx context.Context, now time.Time) (bool, error) {
+	s.mu.Lock()
+	cred := s.cred
+	s.mu.Unlock()
+	if cred.Token == "" || (cred.PrivateKey != "" && now.Before(cred.RotateAfter)) {
+		return false, nil
+	}
+	// Hosts enrolled before heartbeats were signed register a key on rotation;
+	// their unsigned heartbeats are refused until they do.
+	privateKey := cred.PrivateKey
+	if privateKey == "" {
+		var err error
+		if privateKey, _, err = generateKey(); err != nil {
+			return false, err
+		}
+	}
+	publicKey, err := publicKeyOf(privateKey)
+	if err != nil {
+		return false, err
+	}
+	next, err := httpclient.RotateAgentCredential(ctx, s.baseURL, cred.Token, publicKey)
+	if err != nil {
+		return false, err
+	}
+	next.PrivateKey = privateKey
+	return true, s.save(next)
+}
+
+// Sign returns a base64 ed25519 signature over payload, or "" when the host
+// has no signing key.
+func (s *Store) Sign(payload []byte) string {
+	s.mu.Lock()
+	privateKey := s.cred.PrivateKey
+	s.mu.Unlock()
+	raw, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(raw), payload))
+}
+
+func (s *Store) Token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cred.Token != "" {
+		return s.cred.Token
+	}
+	return s.staticToken
+}
+
+// Credential returns the enrolled credential; it is zero for a static token.
+func (s *Store) Credential() models.AgentCredential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cred
+}
+
+func generateKey() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(privateKey), base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+func publicKeyOf(privateKey string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		return "", errors.New("stored signing key is invalid")
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.PrivateKey(raw).Public().(ed25519.PublicKey)), nil
+}
+
+func (s *Store) set(cred models.AgentCredential) {
+	s.mu.Lock()
+	s.cred = cred
+	s.mu.Unlock()
+}
+
+// save writes the credential before using it, so a crash after a rotation
+// does not leave the agent holding only the retired token.
+func (s *Store) save(cred models.AgentCredential) error {
+	raw, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.set(cred)
+	return nil
+}
@@ -0,0 +1,253 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
+)
+
+// Runtime drives the local container engine through its CLI so hostagent does
+// not link against engine client libraries.
+type Runtime struct {
+	binary string
+}
+
+func NewRuntime(binary string) *Runtime {
+	if binary == "" {
+		binary = "docker"
+	}
+	return &Runtime{binary: binary}
+}
+
+func (r *Runtime) Pull(ctx context.Context, image string) error {
+	_, err := r.run(ctx, "pull", "--quiet", "--", image)
+	return err
+}
+
+func (r *Runtime) Run(ctx context.Context, spec models.ContainerSpec) (string, error) {
+	args := []string{
+		"run", "--detach",
+		"--name", spec.Name,
+		"--cpus", strconv.Itoa(spec.CPUCount),
+		"--memory", strconv.Itoa(spec.MemoryMB) + "m",
+	}
+	if spec.DiskGB > 0 {
+		// Needs a storage driver with quota support, such as overlay2 on xfs
+		// mounted with pquota; the engine refuses the run otherwise.
+		args = append(args, "--storage-opt", "size="+strconv.Itoa(spec.DiskGB)+"G")
+	}
+	if spec.CgroupParent != "" {
+		args = append(args, "--cgroup-parent", spec.CgroupParent)
+	}
+	if len(spec.GPUDevices) > 0 {
+		devices := make([]string, 0, len(spec.GPUDevices))
+		for _, idx := range spec.GPUDevices {
+			devices = append(devices, strconv.Itoa(idx))
+		}
+		args = append(args, "--gpus", `"device=`+strings.Join(devices, ",")+`"`)
+	}
+	for key, value := range spec.Labels {
+		args = append(args, "--label", key+"="+value)
+	}
+	for _, item := range spec.Env {
+		args = append(args, "--env", item)
+	}
+	for _, port := range spec.Ports {
+		args = append(args, "--publish", strconv.Itoa(port))
+	}
+	for _, item := range spec.Volumes {
+		source := item.Name
+		if item.HostPath != "" {
+			source = item.HostPath
+		}
+		args = append(args, "--volume", source+":"+item.MountPath)
+	}
+	if len(spec.Command) > 0 {
+		args = append(args, "--entrypoint", spec.Command[0])
+	}
+	// "--" ends the options, so an image that starts with "-" cannot pass as one.
+	args = append(args, "--", spec.Image)
+	if len(spec.Command) > 1 {
+		args = append(args, spec.Command[1:]...)
+	}
+	args = append(args, spec.Args...)
+	out, err := r.run(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (r *Runtime) Remove(ctx context.Context, name string) error {
+	if _, err := r.run(ctx, "rm", "--force", "--volumes", name); err != nil && !strings.Contains(err.Error(), "No such container") {
+		return err
+	}
+	volumes, err := r.run(ctx, "volume", "ls", "--quiet", "--filter", "name=^"+name+"-")
+	if err != nil {
+		return err
+	}
+	for _, volume := range strings.Fields(volumes) {
+		if _, err := r.run(ctx, "volume", "rm", "--force", volume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runtime) Inspect(ctx context.Context, name string) (models.ContainerState, error) {
+	out, err := r.run(ctx, "inspect", "--format", "{{.State.Running}} {{.State.ExitCode}} {{.State.Status}}", name)
+	if err != nil {
+		if strings.Contains(err.Error(), "No such object") {
+			return models.ContainerState{Status: "missing", ExitCode: -1}, nil
+		}
+		return models.ContainerState{}, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return models.ContainerState{}, fmt.Errorf("unexpected inspect output: %q", out)
+	}
+	exitCode, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return models.ContainerState{}, err
+	}
+	return models.ContainerState{Running: fields[0] == "true", ExitCode: exitCode, Status: fields[2]}, nil
+}
+
+// podInspectFormat prints one "|" separated line per container: name, pod
+// and allocation labels, whether it runs and the GPU device ids it was
+// started with.
+const podInspectFormat = `{{.Name}}|{{index .Config.Labels "sharemtc.pod_id"}}|{{index .Config.Labels "sharemtc.allocation_id"}}|{{.State.Running}}|{{range .HostConfig.DeviceRequests}}{{join .DeviceIDs ","}}{{end}}`
+
+// List returns every container, running or not, that carries a
+// sharemtc.pod_id label.
+func (r *Runtime) List(ctx context.Context) ([]models.ContainerInfo, error) {
+	ids, err := r.run(ctx, "ps", "--all", "--quiet", "--no-trunc", "--filter", "label=sharemtc.pod_id")
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.Fields(ids)) == 0 {
+		return nil, nil
+	}
+	out, err := r.run(ctx, append([]string{"inspect", "--format", podInspectFormat}, strings.Fields(ids)...)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseContainers(out)
+}
+
+// parseContainers reads the lines printed with podInspectFormat.
+func parseContainers(out string) ([]models.ContainerInfo, error) {
+	containers := make([]models.ContainerInfo, 0)
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected inspect output: %q", line)
+		}
+		item := models.ContainerInfo{
+			Name:         strings.TrimPrefix(fields[0], "/"),
+			PodID:        fields[1],
+			AllocationID: fields[2],
+			Running:      fields[3] == "true",
+		}
+		for _, id := range strings.Split(fields[4], ",") {
+			if idx, err := strconv.Atoi(strings.Trim(strings.TrimSpace(id), `"`)); err == nil {
+				item.GPUDevices = append(item.GPUDevices, idx)
+			}
+		}
+		containers = append(containers, item)
+	}
+	return containers, nil
+}
+
+// Ports maps each published container port to the host port the engine bound
+// it to.
+func (r *Runtime) Ports(ctx context.Context, name string) (map[int]int, error) {
+	out, err := r.run(ctx, "port", name)
+	if err != nil {
+		return nil, err
+	}
+	return parsePorts(out)
+}
+
+// parsePorts reads "docker port" lines such as "8000/tcp -> 0.0.0.0:32768".
+// IPv4 and IPv6 bindings of one port share the host port.
+func parsePorts(out string) (map[int]int, error) {
+	ports := make(map[int]int)
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		container, host, ok := strings.Cut(line, " -> ")
+		if !ok {
+			return nil, fmt.Errorf("unexpected port output: %q", line)
+		}
+		container, _, _ = strings.Cut(container, "/")
+		containerPort, err := strconv.Atoi(container)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected port output: %q", line)
+		}
+		hostPort, err := strconv.Atoi(host[strings.LastIndex(host, ":")+1:])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected port output: %q", line)
+		}
+		if _, seen := ports[containerPort]; !seen {
+			ports[containerPort] = hostPort
+		}
+	}
+	return ports, nil
+}
+
+func (r *Runtime) StreamLogs(ctx context.Context, name string, sink func(line string, stderr bool)) error {
+	cmd := exec.CommandContext(ctx, r.binary, "logs", "--follow", "--tail", "0", name)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	pump := func(reader io.Reader, isStderr bool) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			mu.Lock()
+			sink(scanner.Text(), isStderr)
+			mu.Unlock()
+		}
+	}
+	wg.Add(2)
+	go pump(stdout, false)
+	go pump(stderr, true)
+	wg.Wait()
+	return cmd.Wait()
+}
+
+func (r *Runtime) run(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, r.binary, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", r.binary, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,89 @@
+package docker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
+)
+
+func TestParsePorts(t *testing.T) {
+	out := "8000/tcp -> 0.0.0.0:32768\n8000/tcp -> [::]:32768\n22/tcp -> 0.0.0.0:32769\n"
+	got, err := parsePorts(out)
+	if err != nil {
+		t.Fatalf("parse ports: %v", err)
+	}
+	if want := map[int]int{8000: 32768, 22: 32769}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if _, err := parsePorts("8000/tcp"); err == nil {
+		t.Fatal("expected error for malformed output")
+	}
+}
+
+func TestParseContainers(t *testing.T) {
+	out := "/sharemtc-pod-a|pod-a|alloc-a|true|0,1\n/sharemtc-pod-b|pod-b|alloc-b|false|\n"
+	got, err := parseContainers(out)
+	if err != nil {
+		t.Fatalf("parse containers: %v", err)
+	}
+	want := []models.ContainerInfo{
+		{Name: "sharemtc-pod-a", PodID: "pod-a", AllocationID: "alloc-a", Running: true, GPUDevices: []int{0, 1}},
+		{Name: "sharemtc-pod-b", PodID: "pod-b", AllocationID: "alloc-b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if _, err := parseContainers("sharemtc-pod-a|pod-a"); err == nil {
+		t.Fatal("expected error for malformed output")
+	}
+}
+
+// recordingEngine returns a fake engine binary that writes its arguments, one
+// per line, to the returned file.
+func recordingEngine(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	binary := filepath.Join(dir, "engine")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + argsFile + "\necho container-1\n"
+	if err := os.WriteFile(binary, []byte(script), 0o755); err != nil {
+		t.Fatalf("write engine: %v", err)
+	}
+	return binary, argsFile
+}
+
+func recordedArgs(t *testing.T, argsFile string) []string {
+	t.Helper()
+	raw, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read engine args: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+}
+
+func TestRuntimeEndsOptionsBeforeImage(t *testing.T) {
+	binary, argsFile := recordingEngine(t)
+	runtime := NewRuntime(binary)
+	ctx := context.Background()
+
+	if err := runtime.Pull(ctx, "-v"); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if got, want := recordedArgs(t, argsFile), []string{"pull", "--quiet", "--", "-v"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected pull args %q, got %q", want, got)
+	}
+
+	id, err := runtime.Run(ctx, models.ContainerSpec{Name: "pod-a", Image: "app:latest", CPUCount: 1, MemoryMB: 512, Command: []string{"python", "serve.py"}, Args: []string{"--port", "80"}})
+	if err != nil || id != "container-1" {
+		t.Fatalf("run: %q %v", id, err)
+	}
+	got := recordedArgs(t, argsFile)
+	if want := []string{"--", "app:latest", "serve.py", "--port", "80"}; !reflect.DeepEqual(got[len(got)-len(want):], want) {
+		t.Fatalf("expected run args to end with %q, got %q", want, got)
+	}
+}
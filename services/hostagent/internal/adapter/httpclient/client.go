@@ -10,7 +10,9 @@ import (
 	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
 )
 
-func SendHeartbeat(ctx context.Context, baseURL string, token string, metric models.HostMetric) error {
+// SendHeartbeat posts a heartbeat. sign, when set, returns a signature over
+// the exact body, sent in X-Agent-Signature.
+func SendHeartbeat(ctx context.Context, baseURL string, token string, sign func([]byte) string, metric models.HostMetric) error {
 	url := strings.TrimRight(baseURL, "/") + "/v1/resources/heartbeat"
 	payload, err := json.Marshal(metric)
 	if err != nil {
@@ -24,6 +26,11 @@ func SendHeartbeat(ctx context.Context, baseURL string, token string, metric mod
 	if token != "" {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
+	if sign != nil {
+		if signature := sign(payload); signature != "" {
+			req.Header.Set("X-Agent-Signature", signature)
+		}
+	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -60,6 +67,34 @@ func SendAgentLog(ctx context.Context, baseURL string, token string, log models.
 	return nil
 }
 
+func SendResourceLogs(ctx context.Context, baseURL string, token string, providerID string, entries []models.ResourceLog) error {
+	url := strings.TrimRight(baseURL, "/") + "/v1/resources/agent/resource-logs"
+	payload, err := json.Marshal(map[string]interface{}{
+		"provider_id": providerID,
+		"entries":     entries,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &httpStatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
 func PollAgentCommand(ctx context.Context, baseURL string, token string, providerID string) (models.AgentCommand, error) {
 	url := strings.TrimRight(baseURL, "/") + "/v1/resources/agent/commands/poll"
 	payload, err := json.Marshal(map[string]string{
@@ -148,6 +183,115 @@ func ReportTerminalOutput(ctx context.Context, baseURL string, token string, ses
 	return nil
 }
 
+func ReportExecOutput(ctx context.Context, baseURL string, token string, execID string, providerID string, stream string, data string) error {
+	url := strings.TrimRight(baseURL, "/") + "/v1/resources/agent/exec/" + execID + "/output"
+	payload, err := json.Marshal(map[string]string{
+		"provider_id": providerID,
+		"stream":      stream,
+		"data":        data,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &httpStatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+func ReportFileChunk(ctx context.Context, baseURL string, token string, transferID string, providerID string, offset int64, data []byte) error {
+	url := strings.TrimRight(baseURL, "/") + "/v1/resources/agent/files/" + transferID + "/chunks"
+	payload, err := json.Marshal(map[string]interface{}{
+		"provider_id": providerID,
+		"offset":      offset,
+		"data":        data,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &httpStatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// EnrollAgent exchanges a one-time enrollment token for the host's first
+// credential and registers the host's heartbeat signing key. It needs no
+// bearer token.
+func EnrollAgent(ctx context.Context, baseURL string, enrollmentToken string, hostname string, publicKey string) (models.AgentCredential, error) {
+	url := strings.TrimRight(baseURL, "/") + "/v1/resources/agent/enroll"
+	payload, err := json.Marshal(map[string]string{
+		"token":      enrollmentToken,
+		"hostname":   hostname,
+		"public_key": publicKey,
+	})
+	if err != nil {
+		return models.AgentCredential{}, err
+	}
+	return postCredential(ctx, url, "", payload)
+}
+
+// RotateAgentCredential trades the current credential for a fresh one. The
+// public key is registered only if the host enrolled without one.
+func RotateAgentCredential(ctx context.Context, baseURL string, token string, publicKey string) (models.AgentCredential, error) {
+	url := strings.TrimRight(baseURL, "/") + "/v1/resources/agent/credentials/rotate"
+	payload, err := json.Marshal(map[string]string{"public_key": publicKey})
+	if err != nil {
+		return models.AgentCredential{}, err
+	}
+	return postCredential(ctx, url, token, payload)
+}
+
+func postCredential(ctx context.Context, url string, token string, payload []byte) (models.AgentCredential, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return models.AgentCredential{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return models.AgentCredential{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return models.AgentCredential{}, &httpStatusError{Code: resp.StatusCode}
+	}
+	var out models.AgentCredential
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return models.AgentCredential{}, err
+	}
+	return out, nil
+}
+
 type httpStatusError struct {
 	Code int
 }
@@ -18,6 +18,9 @@ type HostMetric struct {
 	LoadAvg1m        float64   `json:"load_avg_1m"`
 	UptimeSeconds    int64     `json:"uptime_seconds"`
 	HeartbeatAt      time.Time `json:"heartbeat_at"`
+	AgentVersion     string    `json:"agent_version,omitempty"`
+	Region           string    `json:"region,omitempty"`
+	Labels           []string  `json:"labels,omitempty"`
 }
 
 type AgentLog struct {
@@ -29,16 +32,142 @@ type AgentLog struct {
 	CreatedAt  time.Time `json:"created_at"`
 }
 
+type ResourceLog struct {
+	ResourceID string    `json:"resource_id"`
+	SourceType string    `json:"source_type"`
+	Source     string    `json:"source"`
+	Stream     string    `json:"stream"`
+	Level      string    `json:"level"`
+	Message    string    `json:"message"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
 type AgentCommand struct {
-	ID            string `json:"id"`
-	ProviderID    string `json:"provider_id"`
-	ResourceID    string `json:"resource_id"`
-	SessionID     string `json:"session_id"`
-	Command       string `json:"command"`
-	Payload       string `json:"payload"`
-	Rows          int    `json:"rows"`
-	Cols          int    `json:"cols"`
-	Status        string `json:"status"`
-	RequestedBy   string `json:"requested_by"`
-	ResultMessage string `json:"result_message"`
+	ID            string    `json:"id"`
+	Seq           int64     `json:"seq"`
+	ProviderID    string    `json:"provider_id"`
+	ResourceID    string    `json:"resource_id"`
+	SessionID     string    `json:"session_id"`
+	Command       string    `json:"command"`
+	Payload       string    `json:"payload"`
+	Rows          int       `json:"rows"`
+	Cols          int       `json:"cols"`
+	Status        string    `json:"status"`
+	RequestedBy   string    `json:"requested_by"`
+	ResultMessage string    `json:"result_message"`
+	DeadlineAt    time.Time `json:"deadline_at"`
+}
+
+const (
+	AgentFrameHello          = "hello"
+	AgentFrameCommand        = "command"
+	AgentFramePing           = "ping"
+	AgentFramePong           = "pong"
+	AgentFrameAck            = "ack"
+	AgentFrameResult         = "result"
+	AgentFrameTerminalOutput = "terminal_output"
+	AgentFrameTerminalInput  = "terminal_input"
+	AgentFrameTerminalResize = "terminal_resize"
+	AgentFrameExecOutput     = "exec_output"
+	AgentFrameFileChunk      = "file_chunk"
+	AgentFrameError          = "error"
+)
+
+type AgentChannelFrame struct {
+	Type          string        `json:"type"`
+	Seq           int64         `json:"seq,omitempty"`
+	Command       *AgentCommand `json:"command,omitempty"`
+	CommandID     string        `json:"command_id,omitempty"`
+	Status        string        `json:"status,omitempty"`
+	ResultMessage string        `json:"result_message,omitempty"`
+	SessionID     string        `json:"session_id,omitempty"`
+	ExecID        string        `json:"exec_id,omitempty"`
+	Stream        string        `json:"stream,omitempty"`
+	TransferID    string        `json:"transfer_id,omitempty"`
+	Offset        int64         `json:"offset,omitempty"`
+	Rows          int           `json:"rows,omitempty"`
+	Cols          int           `json:"cols,omitempty"`
+	Data          string        `json:"data,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+type PodEnvVar struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type PodPort struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type PodVolumeMount struct {
+	MountPath string `json:"mount_path"`
+	SizeGB    int    `json:"size_gb"`
+}
+
+type PodSpec struct {
+	PodID           string           `json:"pod_id"`
+	AllocationID    string           `json:"allocation_id"`
+	ImageName       string           `json:"image_name"`
+	Env             []PodEnvVar      `json:"env"`
+	Command         []string         `json:"command"`
+	Args            []string         `json:"args"`
+	Ports           []PodPort        `json:"ports"`
+	CPUCount        int              `json:"cpu_count"`
+	MemoryGB        int              `json:"memory_gb"`
+	GPUCount        int              `json:"gpu_count"`
+	ContainerDiskGB int              `json:"container_disk_gb"`
+	VolumeMounts    []PodVolumeMount `json:"volume_mounts"`
+}
+
+// ContainerVolume is a named volume, or a bind mount of HostPath when set.
+type ContainerVolume struct {
+	Name      string
+	HostPath  string
+	MountPath string
+}
+
+type ContainerSpec struct {
+	Name         string
+	Image        string
+	Env          []string
+	Command      []string
+	Args         []string
+	Ports        []int
+	CPUCount     int
+	MemoryMB     int
+	DiskGB       int
+	GPUDevices   []int
+	CgroupParent string
+	Volumes      []ContainerVolume
+	Labels       map[string]string
+}
+
+type ContainerState struct {
+	Running  bool
+	ExitCode int
+	Status   string
+}
+
+// ContainerInfo describes a pod container found on the engine by its
+// sharemtc labels, with the GPU devices it was started on.
+type ContainerInfo struct {
+	Name         string
+	PodID        string
+	AllocationID string
+	Running      bool
+	GPUDevices   []int
+}
+
+// AgentCredential is the host-bound token issued on enrollment and rotation.
+type AgentCredential struct {
+	HostID      string    `json:"host_id"`
+	ProviderID  string    `json:"provider_id"`
+	Token       string    `json:"token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	RotateAfter time.Time `json:"rotate_after"`
+	// PrivateKey signs heartbeats. It is generated on the host and never
+	// leaves it; only the public half is sent on enrollment.
+	PrivateKey string `json:"private_key,omitempty"`
 }
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrAgentUpdating refuses new work while an agent update is being applied.
+var ErrAgentUpdating = errors.New("agent update in progress; retry once the agent restarts")
+
+// holdPoll is how often Hold checks whether the agent went idle.
+const holdPoll = 500 * time.Millisecond
+
+// AsyncCommands tracks the commands that run off the command loop, so the
+// server can cancel them and an update can wait until none are in flight.
+type AsyncCommands struct {
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	held    bool
+}
+
+func NewAsyncCommands() *AsyncCommands {
+	return &AsyncCommands{running: make(map[string]context.CancelFunc)}
+}
+
+// Start returns the context a command runs under. It ends at the command's
+// deadline, when Cancel is called for it, or when done is called. It fails
+// with ErrAgentUpdating while an update holds the agent.
+func (a *AsyncCommands) Start(commandID string, deadline time.Time) (context.Context, func(), error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.held {
+		return nil, nil, ErrAgentUpdating
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	}
+	a.running[commandID] = cancel
+	return ctx, func() {
+		cancel()
+		a.mu.Lock()
+		delete(a.running, commandID)
+		a.mu.Unlock()
+	}, nil
+}
+
+// Admit runs fn, which starts other long lived work such as a terminal,
+// unless an update holds the agent.
+func (a *AsyncCommands) Admit(fn func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.held {
+		return ErrAgentUpdating
+	}
+	return fn()
+}
+
+// Hold waits until no command is running and idle reports true, then
+// refuses new commands and admissions until release is called. It gives up
+// when ctx ends.
+func (a *AsyncCommands) Hold(ctx context.Context, idle func() bool) (func(), error) {
+	ticker := time.NewTicker(holdPoll)
+	defer ticker.Stop()
+	for {
+		a.mu.Lock()
+		if !a.held && len(a.running) == 0 && idle() {
+			a.held = true
+			a.mu.Unlock()
+			return func() {
+				a.mu.Lock()
+				a.held = false
+				a.mu.Unlock()
+			}, nil
+		}
+		a.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Cancel stops a running command and reports whether one was running.
+func (a *AsyncCommands) Cancel(commandID string) bool {
+	a.mu.Lock()
+	cancel, ok := a.running[commandID]
+	a.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// Active is the number of commands still running.
+func (a *AsyncCommands) Active() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.running)
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAsyncCommandsCancelAndDeadline(t *testing.T) {
+	commands := NewAsyncCommands()
+
+	ctx, done, err := commands.Start("cmd-1", time.Time{})
+	if err != nil || commands.Active() != 1 {
+		t.Fatalf("expected one active command, got %d (%v)", commands.Active(), err)
+	}
+	if !commands.Cancel("cmd-1") || !errors.Is(ctx.Err(), context.Canceled) {
+		t.Fatalf("expected cancel to end the command context, got %v", ctx.Err())
+	}
+	done()
+	if commands.Active() != 0 || commands.Cancel("cmd-1") {
+		t.Fatal("expected a finished command to be forgotten")
+	}
+
+	ctx, done, err = commands.Start("cmd-2", time.Now().Add(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer done()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the command context to end at its deadline")
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", ctx.Err())
+	}
+}
+
+func TestAsyncCommandsHoldWaitsForIdleAndRefusesNewWork(t *testing.T) {
+	commands := NewAsyncCommands()
+	_, done, err := commands.Start("exec-1", time.Time{})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	terminals := 1
+
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := commands.Hold(short, func() bool { return terminals == 0 }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the hold to give up while busy, got %v", err)
+	}
+
+	done()
+	terminals = 0
+	release, err := commands.Hold(context.Background(), func() bool { return terminals == 0 })
+	if err != nil {
+		t.Fatalf("hold once idle: %v", err)
+	}
+	if _, _, err := commands.Start("exec-2", time.Time{}); !errors.Is(err, ErrAgentUpdating) {
+		t.Fatalf("expected new commands refused during the hold, got %v", err)
+	}
+	if err := commands.Admit(func() error { return nil }); !errors.Is(err, ErrAgentUpdating) {
+		t.Fatalf("expected new terminals refused during the hold, got %v", err)
+	}
+	release()
+	if err := commands.Admit(func() error { return nil }); err != nil {
+		t.Fatalf("expected work admitted after release, got %v", err)
+	}
+}
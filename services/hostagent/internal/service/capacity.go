@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/sdk/capacity"
+)
+
+// RunCapacityChallenge answers a capacity_challenge command payload and
+// returns the response to report as the command result.
+func RunCapacityChallenge(ctx context.Context, payload string) (string, error) {
+	var challenge capacity.Challenge
+	if err := json.Unmarshal([]byte(payload), &challenge); err != nil {
+		return "", errors.New("invalid capacity challenge payload")
+	}
+	started := time.Now()
+	resp := capacity.Response{ChallengeID: challenge.ID}
+	switch challenge.Kind {
+	case capacity.KindCPUMemory:
+		digest, err := capacity.Solve(challenge.Nonce, challenge.MemoryMB, challenge.Passes)
+		if err != nil {
+			return "", err
+		}
+		resp.Digest = digest
+	case capacity.KindGPUEnum:
+		gpus, err := enumerateGPUs(ctx)
+		if err != nil {
+			return "", err
+		}
+		resp.GPUs = gpus
+	default:
+		return "", errors.New("unsupported capacity challenge kind")
+	}
+	resp.ElapsedMS = time.Since(started).Milliseconds()
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+func enumerateGPUs(ctx context.Context) ([]capacity.GPUDevice, error) {
+	out, err := exec.CommandContext(ctx, "nvidia-smi", "--query-gpu=index,uuid,name,memory.total", "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseGPUEnumeration(string(out))
+}
+
+func parseGPUEnumeration(raw string) ([]capacity.GPUDevice, error) {
+	devices := make([]capacity.GPUDevice, 0)
+	for _, line := range strings.Split(strings.TrimSpace(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, ",")
+		if len(parts) != 4 {
+			return nil, errors.New("unexpected nvidia-smi output format")
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		memoryMB, err := strconv.Atoi(strings.TrimSpace(parts[3]))
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, capacity.GPUDevice{
+			Index:    index,
+			UUID:     strings.TrimSpace(parts[1]),
+			Name:     strings.TrimSpace(parts[2]),
+			MemoryMB: memoryMB,
+		})
+	}
+	return devices, nil
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/MidasWR/ShareMTC/services/sdk/capacity"
+)
+
+func TestParseGPUEnumeration(t *testing.T) {
+	devices, err := parseGPUEnumeration("0, GPU-1a2b, NVIDIA A100-SXM4-80GB, 81920\n1, GPU-3c4d, NVIDIA A100-SXM4-80GB, 81920\n")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(devices) != 2 || devices[1].Index != 1 || devices[1].UUID != "GPU-3c4d" || devices[0].MemoryMB != 81920 {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+	if _, err := parseGPUEnumeration("0, GPU-1a2b, 81920"); err == nil {
+		t.Fatal("expected malformed line to be rejected")
+	}
+}
+
+func TestRunCapacityChallengeCPUMemory(t *testing.T) {
+	payload, _ := json.Marshal(capacity.Challenge{ID: "c1", Kind: capacity.KindCPUMemory, Nonce: "abc", MemoryMB: capacity.MinMemoryMB, Passes: 1})
+	raw, err := RunCapacityChallenge(context.Background(), string(payload))
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var resp capacity.Response
+	if err := json.Unmarshal([]byte(raw), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	expected, _ := capacity.Solve("abc", capacity.MinMemoryMB, 1)
+	if resp.ChallengeID != "c1" || resp.Digest != expected {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
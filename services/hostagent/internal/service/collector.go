@@ -77,3 +77,9 @@ func Collect(providerID string, state NetState) (models.HostMetric, NetState, er
 		HeartbeatAt:      now,
 	}, NetState{LastBytes: currentBytes, LastAt: now, LastCPU: nextCPUState}, nil
 }
+
+// GPUTotalUnits counts the GPU devices on this host, as Collect reports them.
+func GPUTotalUnits() int {
+	_, total, _, _ := gpuMetrics()
+	return total
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// execDefaultUser is who commands run as when the request names no user.
+const execDefaultUser = "nobody"
+
+// configureExecProcess puts the command in its own process group, so a
+// timeout kills everything it started, and drops to runAs (nobody when empty).
+// The agent must run as root to switch users, and never runs exec as root
+// itself.
+func configureExecProcess(cmd *exec.Cmd, runAs string) error {
+	if runAs == "" {
+		runAs = execDefaultUser
+	}
+	account, err := user.Lookup(runAs)
+	if err != nil {
+		return fmt.Errorf("exec user %q not found", runAs)
+	}
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(account.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return errors.New("refusing to run exec as root")
+	}
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	if uint64(os.Geteuid()) != uid {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("hostagent must run as root to switch to %q", runAs)
+		}
+		attr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}
+	}
+	if os.Geteuid() == 0 && attr.Credential == nil {
+		return errors.New("refusing to run exec as root")
+	}
+	cmd.SysProcAttr = attr
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package service
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func configureExecProcess(cmd *exec.Cmd, runAs string) error {
+	if runAs != "" {
+		return errors.New("exec as another user is supported on Linux provider nodes only")
+	}
+	if os.Geteuid() == 0 {
+		return errors.New("refusing to run exec as root")
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/MidasWR/ShareMTC/services/sdk/agentexec"
+)
+
+// execPath is the only PATH exec commands see; argv[0] without a slash is
+// resolved against it rather than the agent's own PATH.
+var execPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+type ExecOutputSink func(execID string, stream string, data string)
+
+// ExecRunner runs exec commands as the user their policy names, with a
+// minimal environment, and streams their output while they run.
+type ExecRunner struct {
+	enabled   bool
+	maxOutput int
+	sink      ExecOutputSink
+}
+
+func NewExecRunner(enabled bool, maxOutputBytes int, sink ExecOutputSink) *ExecRunner {
+	return &ExecRunner{enabled: enabled, maxOutput: maxOutputBytes, sink: sink}
+}
+
+// Run executes an exec command payload until it exits or its timeout ends,
+// when the whole process group is killed.
+func (r *ExecRunner) Run(ctx context.Context, payload string) agentexec.Result {
+	if !r.enabled {
+		return agentexec.Result{ExitCode: -1, Error: "exec is disabled on this host"}
+	}
+	var req agentexec.Request
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return agentexec.Result{ExitCode: -1, Error: "invalid exec payload"}
+	}
+	name, args := "/bin/sh", []string{"-c", req.Script}
+	if len(req.Argv) > 0 {
+		resolved, err := lookExecPath(req.Argv[0])
+		if err != nil {
+			return agentexec.Result{ExitCode: -1, Error: err.Error()}
+		}
+		name, args = resolved, req.Argv[1:]
+	} else if req.Script == "" {
+		return agentexec.Result{ExitCode: -1, Error: "script or argv is required"}
+	}
+	timeout := time.Duration(req.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = req.WorkDir
+	if cmd.Dir == "" {
+		cmd.Dir = "/"
+	}
+	cmd.Env = execEnv(req.Env)
+	cmd.WaitDelay = 5 * time.Second
+	if err := configureExecProcess(cmd, req.RunAs); err != nil {
+		return agentexec.Result{ExitCode: -1, Error: err.Error()}
+	}
+	out := &execOutput{execID: req.ExecID, remaining: r.maxOutput, sink: r.sink}
+	stdout := out.writer(agentexec.StreamStdout)
+	stderr := out.writer(agentexec.StreamStderr)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	stdout.flush()
+	stderr.flush()
+
+	result := agentexec.Result{ExitCode: -1, Truncated: out.isTruncated()}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.TimedOut = true
+	case errors.Is(ctx.Err(), context.Canceled):
+		result.Error = "cancelled"
+	case err != nil && cmd.ProcessState == nil:
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func lookExecPath(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		if !filepath.IsAbs(name) {
+			return "", errors.New("argv[0] must be a bare name or an absolute path")
+		}
+		return name, nil
+	}
+	for _, dir := range execPath {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0o111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: command not found", name)
+}
+
+// execEnv lists the request's variables first: exec keeps the last value of
+// a duplicate, so they cannot replace the fixed ones.
+func execEnv(extra map[string]string) []string {
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys)+3)
+	for _, key := range keys {
+		env = append(env, key+"="+extra[key])
+	}
+	return append(env, "PATH="+strings.Join(execPath, ":"), "HOME=/", "LANG=C.UTF-8")
+}
+
+// execOutput forwards output until the combined limit of both streams is
+// reached, and drops the rest.
+type execOutput struct {
+	execID string
+	sink   ExecOutputSink
+
+	mu        sync.Mutex
+	remaining int
+	truncated bool
+}
+
+func (o *execOutput) writer(stream string) *execStreamWriter {
+	return &execStreamWriter{out: o, stream: stream}
+}
+
+func (o *execOutput) forward(stream string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	o.mu.Lock()
+	if len(data) > o.remaining {
+		data = data[:o.remaining]
+		o.truncated = true
+	}
+	o.remaining -= len(data)
+	o.mu.Unlock()
+	if len(data) > 0 && o.sink != nil {
+		o.sink(o.execID, stream, string(data))
+	}
+}
+
+func (o *execOutput) isTruncated() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.truncated
+}
+
+// execStreamWriter holds back a rune split across writes so each forwarded
+// chunk is valid UTF-8 where the output is.
+type execStreamWriter struct {
+	out     *execOutput
+	stream  string
+	pending []byte
+}
+
+func (w *execStreamWriter) Write(p []byte) (int, error) {
+	data := append(w.pending, p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	w.out.forward(w.stream, data[:cut])
+	w.pending = append([]byte(nil), data[cut:]...)
+	return len(p), nil
+}
+
+func (w *execStreamWriter) flush() {
+	w.out.forward(w.stream, w.pending)
+	w.pending = nil
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MidasWR/ShareMTC/services/sdk/agentexec"
+)
+
+type execCapture struct {
+	mu     sync.Mutex
+	stdout strings.Builder
+	stderr strings.Builder
+}
+
+func (c *execCapture) sink(_ string, stream string, data string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stream == agentexec.StreamStderr {
+		c.stderr.WriteString(data)
+		return
+	}
+	c.stdout.WriteString(data)
+}
+
+func execPayload(t *testing.T, req agentexec.Request) string {
+	t.Helper()
+	raw, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return string(raw)
+}
+
+func TestExecRunnerStreamsOutputAndExitCode(t *testing.T) {
+	capture := &execCapture{}
+	runner := NewExecRunner(true, 1<<20, capture.sink)
+	result := runner.Run(context.Background(), execPayload(t, agentexec.Request{
+		ExecID:         "e1",
+		Script:         `echo "$GREETING from $PWD"; echo oops >&2; exit 3`,
+		WorkDir:        "/tmp",
+		Env:            map[string]string{"GREETING": "hello", "PATH": "/nowhere"},
+		TimeoutSeconds: 10,
+	}))
+	if result.ExitCode != 3 || result.Succeeded() || result.TimedOut {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if capture.stdout.String() != "hello from /tmp\n" || capture.stderr.String() != "oops\n" {
+		t.Fatalf("unexpected output %q / %q", capture.stdout.String(), capture.stderr.String())
+	}
+
+	capture = &execCapture{}
+	runner = NewExecRunner(true, 1<<20, capture.sink)
+	result = runner.Run(context.Background(), execPayload(t, agentexec.Request{ExecID: "e2", Argv: []string{"sh", "-c", "echo $PATH"}, TimeoutSeconds: 10}))
+	if !result.Succeeded() || !strings.HasPrefix(capture.stdout.String(), "/usr/local/sbin:") {
+		t.Fatalf("expected argv to run with the fixed PATH, got %+v %q", result, capture.stdout.String())
+	}
+}
+
+func TestExecRunnerTimeoutTruncationAndDisabled(t *testing.T) {
+	runner := NewExecRunner(true, 1<<20, nil)
+	result := runner.Run(context.Background(), execPayload(t, agentexec.Request{ExecID: "e1", Script: "sleep 30 & sleep 30", TimeoutSeconds: 1}))
+	if !result.TimedOut || result.Succeeded() {
+		t.Fatalf("expected timeout, got %+v", result)
+	}
+
+	capture := &execCapture{}
+	runner = NewExecRunner(true, 8, capture.sink)
+	result = runner.Run(context.Background(), execPayload(t, agentexec.Request{ExecID: "e2", Script: "printf 'héllo world'", TimeoutSeconds: 10}))
+	if !result.Truncated || len(capture.stdout.String()) != 8 {
+		t.Fatalf("expected output truncated to 8 bytes, got %+v %q", result, capture.stdout.String())
+	}
+
+	result = runner.Run(context.Background(), execPayload(t, agentexec.Request{ExecID: "e3", Argv: []string{"no-such-tool"}, TimeoutSeconds: 10}))
+	if result.Error == "" || result.ExitCode != -1 {
+		t.Fatalf("expected missing command to fail to start, got %+v", result)
+	}
+
+	result = NewExecRunner(false, 8, nil).Run(context.Background(), execPayload(t, agentexec.Request{ExecID: "e4", Script: "true"}))
+	if result.Error == "" {
+		t.Fatal("expected disabled runner to refuse")
+	}
+}
+
+func TestExecStreamWriterKeepsRunesWhole(t *testing.T) {
+	capture := &execCapture{}
+	out := &execOutput{execID: "e1", remaining: 1 << 20, sink: capture.sink}
+	w := out.writer(agentexec.StreamStdout)
+	raw := []byte("añb")
+	_, _ = w.Write(raw[:2])
+	if capture.stdout.String() != "a" {
+		t.Fatalf("expected split rune to be held back, got %q", capture.stdout.String())
+	}
+	_, _ = w.Write(raw[2:])
+	w.flush()
+	if capture.stdout.String() != "añb" {
+		t.Fatalf("unexpected output %q", capture.stdout.String())
+	}
+}
+
+func TestConfigureExecProcessNeverRunsAsRoot(t *testing.T) {
+	if err := configureExecProcess(exec.Command("true"), "root"); err == nil {
+		t.Fatal("expected run_as root to be refused")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	cmd := exec.Command("true")
+	if err := configureExecProcess(cmd, ""); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if cmd.SysProcAttr.Credential == nil || cmd.SysProcAttr.Credential.Uid == 0 {
+		t.Fatalf("expected an empty run_as to drop to %s, got %+v", execDefaultUser, cmd.SysProcAttr.Credential)
+	}
+}
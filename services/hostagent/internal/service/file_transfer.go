@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MidasWR/ShareMTC/services/sdk/filetransfer"
+)
+
+type FileChunkSink func(transferID string, offset int64, data []byte) error
+
+// FileTransfers serves file_write and file_read commands. Every path lives
+// under the sandbox directory: resources/<pod_id>/ for transfers tied to a
+// local pod, which sees it at filetransfer.PodMountPath, and host/ for the
+// provider's own transfers. All file operations go through an os.Root opened
+// on that directory, so nothing a pod does inside it, such as swapping a
+// directory for a symlink, can reach a file outside it.
+type FileTransfers struct {
+	root string
+	sink FileChunkSink
+}
+
+func NewFileTransfers(root string, sink FileChunkSink) *FileTransfers {
+	return &FileTransfers{root: root, sink: sink}
+}
+
+// Write applies one chunk of an upload and returns the command result.
+func (t *FileTransfers) Write(payload string) filetransfer.WriteResult {
+	if t.root == "" {
+		return filetransfer.WriteResult{Error: "file transfer is disabled on this host"}
+	}
+	var req filetransfer.WriteRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return filetransfer.WriteResult{Error: "invalid file_write payload"}
+	}
+	root, err := t.scope(req.ResourceID, true)
+	if err != nil {
+		return filetransfer.WriteResult{Error: err.Error()}
+	}
+	defer root.Close()
+	target, err := resolve(root, req.Path, true)
+	if err != nil {
+		return filetransfer.WriteResult{Error: err.Error()}
+	}
+	end := req.Offset + int64(len(req.Data))
+	if req.Offset < 0 || end > req.Size {
+		return filetransfer.WriteResult{Error: "chunk is outside the file"}
+	}
+	part := target + ".part"
+	if info, err := root.Lstat(part); err == nil && !info.Mode().IsRegular() {
+		return filetransfer.WriteResult{Error: "partial file is not a regular file"}
+	}
+	file, err := root.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return filetransfer.WriteResult{Error: err.Error()}
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return filetransfer.WriteResult{Error: err.Error()}
+	}
+	if !info.Mode().IsRegular() {
+		return filetransfer.WriteResult{Error: "partial file is not a regular file"}
+	}
+	if req.Offset > info.Size() {
+		return filetransfer.WriteResult{Written: info.Size(), Error: fmt.Sprintf("offset %d is past the partial file", req.Offset)}
+	}
+	if err := file.Truncate(req.Offset); err != nil {
+		return filetransfer.WriteResult{Error: err.Error()}
+	}
+	if _, err := file.WriteAt(req.Data, req.Offset); err != nil {
+		return filetransfer.WriteResult{Written: req.Offset, Error: err.Error()}
+	}
+	if end < req.Size {
+		return filetransfer.WriteResult{Written: end}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return filetransfer.WriteResult{Written: end, Error: err.Error()}
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return filetransfer.WriteResult{Written: end, Error: err.Error()}
+	}
+	if !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), req.SHA256) {
+		_ = root.Remove(part)
+		return filetransfer.WriteResult{Error: "checksum mismatch"}
+	}
+	if err := file.Sync(); err != nil {
+		return filetransfer.WriteResult{Written: end, Error: err.Error()}
+	}
+	if info, err := root.Lstat(target); err == nil && !info.Mode().IsRegular() {
+		return filetransfer.WriteResult{Written: end, Error: "target is not a regular file"}
+	}
+	if err := root.Rename(part, target); err != nil {
+		return filetransfer.WriteResult{Written: end, Error: err.Error()}
+	}
+	return filetransfer.WriteResult{Written: end, Complete: true}
+}
+
+// Read streams a file from the requested offset through the sink and returns
+// the command result. The checksum always covers the whole file.
+func (t *FileTransfers) Read(ctx context.Context, payload string) filetransfer.ReadResult {
+	if t.root == "" {
+		return filetransfer.ReadResult{Error: "file transfer is disabled on this host"}
+	}
+	var req filetransfer.ReadRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return filetransfer.ReadResult{Error: "invalid file_read payload"}
+	}
+	root, err := t.scope(req.ResourceID, false)
+	if err != nil {
+		return filetransfer.ReadResult{Error: err.Error()}
+	}
+	defer root.Close()
+	target, err := resolve(root, req.Path, false)
+	if err != nil {
+		return filetransfer.ReadResult{Error: err.Error()}
+	}
+	info, err := root.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return filetransfer.ReadResult{Error: "file not found"}
+	}
+	if err != nil {
+		return filetransfer.ReadResult{Error: err.Error()}
+	}
+	if !info.Mode().IsRegular() {
+		return filetransfer.ReadResult{Error: "path is not a regular file"}
+	}
+	file, err := root.OpenFile(target, os.O_RDONLY, 0)
+	if err != nil {
+		return filetransfer.ReadResult{Error: err.Error()}
+	}
+	defer file.Close()
+	// Check what was opened, not what Lstat saw, in case the pod swapped it.
+	if info, err = file.Stat(); err != nil {
+		return filetransfer.ReadResult{Error: err.Error()}
+	}
+	if !info.Mode().IsRegular() {
+		return filetransfer.ReadResult{Error: "path is not a regular file"}
+	}
+	if req.MaxBytes > 0 && info.Size() > req.MaxBytes {
+		return filetransfer.ReadResult{Size: info.Size(), Error: fmt.Sprintf("file is larger than the %d byte limit", req.MaxBytes)}
+	}
+	if req.Offset < 0 || req.Offset > info.Size() {
+		return filetransfer.ReadResult{Size: info.Size(), Error: "offset is outside the file"}
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, file, req.Offset); err != nil {
+		return filetransfer.ReadResult{Error: err.Error()}
+	}
+	offset := req.Offset
+	buf := make([]byte, filetransfer.ChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return filetransfer.ReadResult{Error: err.Error()}
+		}
+		n, readErr := io.ReadFull(file, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			if t.sink != nil {
+				if err := t.sink(req.TransferID, offset, buf[:n]); err != nil {
+					return filetransfer.ReadResult{Error: err.Error()}
+				}
+			}
+			offset += int64(n)
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			return filetransfer.ReadResult{Error: readErr.Error()}
+		}
+	}
+	return filetransfer.ReadResult{Size: offset, SHA256: hex.EncodeToString(hash.Sum(nil))}
+}
+
+// scope opens the sandbox directory of a transfer as an os.Root, creating it
+// when asked to.
+func (t *FileTransfers) scope(resourceID string, create bool) (*os.Root, error) {
+	dir := filepath.Join(t.root, "host")
+	if resourceID != "" {
+		var err error
+		if dir, err = podSandboxDir(t.root, resourceID); err != nil {
+			return nil, err
+		}
+	}
+	if create {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, err
+		}
+	}
+	root, err := os.OpenRoot(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.New("file not found")
+	}
+	return root, err
+}
+
+// resolve maps a transfer path to a name inside root, creating missing parent
+// directories when asked to. The root refuses any path, symlinks included,
+// that would leave it.
+func resolve(root *os.Root, rel string, create bool) (string, error) {
+	cleaned, err := filetransfer.CleanPath(rel)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.FromSlash(cleaned)
+	if info, err := root.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", errors.New("path leaves the sandbox directory")
+	}
+	if create {
+		if dir := filepath.Dir(target); dir != "." {
+			if err := root.MkdirAll(dir, 0o750); err != nil {
+				return "", err
+			}
+		}
+	}
+	return target, nil
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MidasWR/ShareMTC/services/sdk/filetransfer"
+)
+
+func writePayload(t *testing.T, req filetransfer.WriteRequest) string {
+	t.Helper()
+	raw, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return string(raw)
+}
+
+func TestFileTransferWriteResumesAndVerifiesChecksum(t *testing.T) {
+	root := t.TempDir()
+	transfers := NewFileTransfers(root, nil)
+	content := bytes.Repeat([]byte("model-config;"), 100)
+	sum := sha256.Sum256(content)
+	base := filetransfer.WriteRequest{TransferID: "t1", ResourceID: "vm-1", Path: "configs/model.yaml", Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}
+
+	first := base
+	first.Data = content[:600]
+	if res := transfers.Write(writePayload(t, first)); res.Error != "" || res.Written != 600 || res.Complete {
+		t.Fatalf("unexpected first chunk result %+v", res)
+	}
+	gap := base
+	gap.Offset = 900
+	gap.Data = content[900:]
+	if res := transfers.Write(writePayload(t, gap)); res.Error == "" || res.Written != 600 {
+		t.Fatalf("expected a chunk past the partial file to be refused with the resume offset, got %+v", res)
+	}
+	// Resending a chunk the agent already wrote is harmless.
+	again := base
+	again.Offset = 300
+	again.Data = content[300:]
+	res := transfers.Write(writePayload(t, again))
+	if res.Error != "" || !res.Complete || res.Written != int64(len(content)) {
+		t.Fatalf("unexpected final chunk result %+v", res)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "resources", "vm-1", "configs", "model.yaml"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("file not moved into place: %v", err)
+	}
+
+	bad := base
+	bad.Path = "configs/other.yaml"
+	bad.Data = content
+	bad.SHA256 = hex.EncodeToString(make([]byte, 32))
+	if res := transfers.Write(writePayload(t, bad)); res.Error != "checksum mismatch" {
+		t.Fatalf("expected checksum mismatch, got %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(root, "resources", "vm-1", "configs", "other.yaml.part")); !os.IsNotExist(err) {
+		t.Fatalf("expected partial file to be removed after a mismatch: %v", err)
+	}
+}
+
+func TestFileTransferStaysInSandbox(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	transfers := NewFileTransfers(filepath.Join(root, "files"), nil)
+	for _, p := range []string{"../escape", "/etc/passwd", "a/../../escape", ""} {
+		req := filetransfer.WriteRequest{Path: p, Size: 1, Data: []byte("x")}
+		if res := transfers.Write(writePayload(t, req)); res.Error == "" {
+			t.Fatalf("expected path %q to be rejected", p)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "files", "host"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "files", "host", "link")); err != nil {
+		t.Fatal(err)
+	}
+	req := filetransfer.WriteRequest{Path: "link/dump.bin", Size: 1, Data: []byte("x")}
+	if res := transfers.Write(writePayload(t, req)); res.Error == "" {
+		t.Fatal("expected a symlinked directory to be rejected")
+	}
+	read, _ := json.Marshal(filetransfer.ReadRequest{Path: "link"})
+	if res := transfers.Read(context.Background(), string(read)); res.Error == "" {
+		t.Fatal("expected a symlink to be refused for reading")
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	read, _ = json.Marshal(filetransfer.ReadRequest{Path: "link/secret"})
+	if res := transfers.Read(context.Background(), string(read)); res.Error == "" {
+		t.Fatal("expected a file behind a symlinked directory to be refused for reading")
+	}
+}
+
+func TestFileTransferReadStreamsFromOffset(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte{0xab, 0xcd}, filetransfer.ChunkSize)
+	if err := os.MkdirAll(filepath.Join(root, "host", "crash"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "host", "crash", "core.1"), content, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	var received []byte
+	offsets := make([]int64, 0)
+	transfers := NewFileTransfers(root, func(transferID string, offset int64, data []byte) error {
+		offsets = append(offsets, offset)
+		received = append(received, data...)
+		return nil
+	})
+	raw, _ := json.Marshal(filetransfer.ReadRequest{TransferID: "t2", Path: "crash/core.1", Offset: 1000, MaxBytes: int64(len(content))})
+	res := transfers.Read(context.Background(), string(raw))
+	sum := sha256.Sum256(content)
+	if res.Error != "" || res.Size != int64(len(content)) || res.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected read result %+v", res)
+	}
+	if len(offsets) != 2 || offsets[0] != 1000 || offsets[1] != 1000+filetransfer.ChunkSize || !bytes.Equal(received, content[1000:]) {
+		t.Fatalf("unexpected chunks at %v", offsets)
+	}
+
+	raw, _ = json.Marshal(filetransfer.ReadRequest{Path: "crash/core.1", MaxBytes: 10})
+	if res := transfers.Read(context.Background(), string(raw)); res.Error == "" {
+		t.Fatal("expected the size limit to be enforced")
+	}
+}
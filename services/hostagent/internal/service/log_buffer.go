@@ -0,0 +1,48 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
+)
+
+// LogBuffer holds resource log lines between flushes. When the control plane is
+// unreachable the oldest lines are dropped so memory stays bounded.
+type LogBuffer struct {
+	mu      sync.Mutex
+	max     int
+	items   []models.ResourceLog
+	dropped int
+}
+
+func NewLogBuffer(max int) *LogBuffer {
+	if max <= 0 {
+		max = 5000
+	}
+	return &LogBuffer{max: max}
+}
+
+func (b *LogBuffer) Add(item models.ResourceLog) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.items) >= b.max {
+		b.items = b.items[1:]
+		b.dropped++
+	}
+	b.items = append(b.items, item)
+}
+
+// Drain returns up to limit buffered lines and how many were dropped since the
+// previous drain.
+func (b *LogBuffer) Drain(limit int) ([]models.ResourceLog, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit <= 0 || limit > len(b.items) {
+		limit = len(b.items)
+	}
+	out := append([]models.ResourceLog(nil), b.items[:limit]...)
+	b.items = b.items[limit:]
+	dropped := b.dropped
+	b.dropped = 0
+	return out, dropped
+}
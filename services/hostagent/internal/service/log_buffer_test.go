@@ -0,0 +1,23 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
+)
+
+func TestLogBufferDropsOldestWhenFull(t *testing.T) {
+	buffer := NewLogBuffer(2)
+	buffer.Add(models.ResourceLog{Message: "one"})
+	buffer.Add(models.ResourceLog{Message: "two"})
+	buffer.Add(models.ResourceLog{Message: "three"})
+
+	items, dropped := buffer.Drain(1)
+	if dropped != 1 || len(items) != 1 || items[0].Message != "two" {
+		t.Fatalf("expected oldest dropped and first drain to return two, got %+v dropped=%d", items, dropped)
+	}
+	items, dropped = buffer.Drain(0)
+	if dropped != 0 || len(items) != 1 || items[0].Message != "three" {
+		t.Fatalf("expected remaining line three, got %+v dropped=%d", items, dropped)
+	}
+}
@@ -0,0 +1,420 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
+	"github.com/MidasWR/ShareMTC/services/sdk/filetransfer"
+	"github.com/MidasWR/ShareMTC/services/sdk/logtail"
+)
+
+type ContainerRuntime interface {
+	Pull(ctx context.Context, image string) error
+	Run(ctx context.Context, spec models.ContainerSpec) (string, error)
+	Remove(ctx context.Context, name string) error
+	Inspect(ctx context.Context, name string) (models.ContainerState, error)
+	List(ctx context.Context) ([]models.ContainerInfo, error)
+	Ports(ctx context.Context, name string) (map[int]int, error)
+	StreamLogs(ctx context.Context, name string, sink func(line string, stderr bool)) error
+}
+
+type PodLogSink func(entry models.ResourceLog)
+
+type localPod struct {
+	name       string
+	gpuDevices []int
+	stopLogs   context.CancelFunc
+}
+
+type PodManager struct {
+	mu           sync.Mutex
+	runtime      ContainerRuntime
+	cgroupParent string
+	gpuTotal     int
+	gpuOwners    map[int]string
+	pods         map[string]*localPod
+	sink         PodLogSink
+	fileRoot     string
+}
+
+func NewPodManager(runtime ContainerRuntime, cgroupParent string, sink PodLogSink) *PodManager {
+	return &PodManager{
+		runtime:      runtime,
+		cgroupParent: cgroupParent,
+		gpuOwners:    make(map[int]string),
+		pods:         make(map[string]*localPod),
+		sink:         sink,
+	}
+}
+
+func (m *PodManager) SetGPUTotal(total int) {
+	m.mu.Lock()
+	m.gpuTotal = total
+	m.mu.Unlock()
+}
+
+// SetFileSandbox mounts each pod's resources/<pod_id> directory under root
+// into the container at filetransfer.PodMountPath, so file transfers for the
+// pod reach it. An empty root leaves pods without the mount.
+func (m *PodManager) SetFileSandbox(root string) error {
+	if root != "" {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		root = abs
+	}
+	m.mu.Lock()
+	m.fileRoot = root
+	m.mu.Unlock()
+	return nil
+}
+
+// Recover adopts the pod containers already on the engine, such as those
+// started before an agent restart or self-update, so their GPUs stay reserved
+// and pod_stop, pod_status and logs reach them. It returns how many it adopted.
+func (m *PodManager) Recover(ctx context.Context) (int, error) {
+	containers, err := m.runtime.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	adopted := 0
+	for _, item := range containers {
+		if item.PodID == "" || item.Name != ContainerName(item.PodID) {
+			continue
+		}
+		if _, exists := m.pods[item.PodID]; exists {
+			continue
+		}
+		pod := &localPod{name: item.Name, gpuDevices: append([]int(nil), item.GPUDevices...)}
+		for _, idx := range pod.gpuDevices {
+			m.gpuOwners[idx] = item.PodID
+		}
+		if item.Running {
+			logCtx, cancel := context.WithCancel(context.Background())
+			pod.stopLogs = cancel
+			go m.pumpLogs(logCtx, item.PodID, item.Name)
+		}
+		m.pods[item.PodID] = pod
+		adopted++
+	}
+	return adopted, nil
+}
+
+func ContainerName(podID string) string {
+	return "sharemtc-pod-" + podID
+}
+
+// Start pulls the image and runs the pod described by a pod_start payload under
+// the allocation's cgroup, pinning it to free GPU devices on this host. A pod
+// whose container already exists, as after a redelivered pod_start, succeeds
+// with that container's GPUs and ports.
+func (m *PodManager) Start(ctx context.Context, payload string) (string, error) {
+	var spec models.PodSpec
+	if err := json.Unmarshal([]byte(payload), &spec); err != nil {
+		return "", fmt.Errorf("invalid pod spec: %w", err)
+	}
+	if spec.PodID == "" || spec.AllocationID == "" || spec.ImageName == "" {
+		return "", errors.New("pod_id, allocation_id and image_name are required")
+	}
+	if spec.CPUCount <= 0 || spec.MemoryGB <= 0 || spec.GPUCount < 0 {
+		return "", errors.New("cpu_count and memory_gb must be positive")
+	}
+	name := ContainerName(spec.PodID)
+
+	m.mu.Lock()
+	_, known := m.pods[spec.PodID]
+	m.mu.Unlock()
+	if !known {
+		// A container the agent did not adopt at startup would block the run
+		// on its name.
+		state, err := m.runtime.Inspect(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		if state.Status != "missing" {
+			if _, err := m.Recover(ctx); err != nil {
+				return "", fmt.Errorf("existing container lookup failed: %w", err)
+			}
+		}
+	}
+	m.mu.Lock()
+	if existing, exists := m.pods[spec.PodID]; exists {
+		devices := append([]int(nil), existing.gpuDevices...)
+		m.mu.Unlock()
+		var published map[int]int
+		if len(spec.Ports) > 0 {
+			published, _ = m.runtime.Ports(ctx, name)
+		}
+		return startMessage("container already exists", devices, published), nil
+	}
+	devices, err := m.reserveGPUs(spec.PodID, spec.GPUCount)
+	if err != nil {
+		m.mu.Unlock()
+		return "", err
+	}
+	pod := &localPod{name: name, gpuDevices: devices}
+	m.pods[spec.PodID] = pod
+	fileRoot := m.fileRoot
+	m.mu.Unlock()
+
+	if err := m.runtime.Pull(ctx, spec.ImageName); err != nil {
+		m.forget(spec.PodID)
+		return "", fmt.Errorf("image pull failed: %w", err)
+	}
+	container := containerSpec(spec, name, m.cgroupParent, devices)
+	if fileRoot != "" {
+		dir, err := podSandboxDir(fileRoot, spec.PodID)
+		if err == nil {
+			err = os.MkdirAll(dir, 0o750)
+		}
+		if err != nil {
+			m.forget(spec.PodID)
+			return "", fmt.Errorf("file sandbox setup failed: %w", err)
+		}
+		container.Volumes = append(container.Volumes, models.ContainerVolume{HostPath: dir, MountPath: filetransfer.PodMountPath})
+	}
+	containerID, err := m.runtime.Run(ctx, container)
+	if err != nil {
+		m.forget(spec.PodID)
+		return "", fmt.Errorf("container start failed: %w", err)
+	}
+	var published map[int]int
+	if len(spec.Ports) > 0 {
+		if published, err = m.runtime.Ports(ctx, name); err != nil {
+			_ = m.runtime.Remove(context.WithoutCancel(ctx), name)
+			m.forget(spec.PodID)
+			return "", fmt.Errorf("published ports lookup failed: %w", err)
+		}
+	}
+
+	logCtx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	pod.stopLogs = cancel
+	m.mu.Unlock()
+	go m.pumpLogs(logCtx, spec.PodID, name)
+
+	return startMessage("container started: "+containerID, devices, published), nil
+}
+
+// startMessage is the pod_start result: a summary, then the gpus= and ports=
+// fields resourceservice reads back.
+func startMessage(summary string, devices []int, published map[int]int) string {
+	message := summary
+	if len(devices) > 0 {
+		message += " gpus=" + joinInts(devices)
+	}
+	if len(published) > 0 {
+		message += " ports=" + joinPorts(published)
+	}
+	return message
+}
+
+func (m *PodManager) Stop(ctx context.Context, podID string) error {
+	if podID == "" {
+		return errors.New("pod id is required")
+	}
+	m.mu.Lock()
+	pod, ok := m.pods[podID]
+	m.mu.Unlock()
+	if ok && pod.stopLogs != nil {
+		pod.stopLogs()
+	}
+	if err := m.runtime.Remove(ctx, ContainerName(podID)); err != nil {
+		return err
+	}
+	m.forget(podID)
+	m.mu.Lock()
+	fileRoot := m.fileRoot
+	m.mu.Unlock()
+	if fileRoot != "" {
+		dir, err := podSandboxDir(fileRoot, podID)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("file sandbox cleanup failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// podSandboxDir is the directory a pod is given for file transfers, and the
+// one FileTransfers opens for the pod's resource id.
+func podSandboxDir(root string, podID string) (string, error) {
+	if strings.ContainsAny(podID, `/\`) || podID == "." || podID == ".." {
+		return "", errors.New("invalid pod id")
+	}
+	return filepath.Join(root, "resources", podID), nil
+}
+
+// Status returns an error when the pod container is not running so the command
+// completes as failed and resourceservice marks the pod stopped.
+func (m *PodManager) Status(ctx context.Context, podID string) (string, error) {
+	if podID == "" {
+		return "", errors.New("pod id is required")
+	}
+	state, err := m.runtime.Inspect(ctx, ContainerName(podID))
+	if err != nil {
+		return "", err
+	}
+	if !state.Running {
+		return "", fmt.Errorf("container %s with code %d", state.Status, state.ExitCode)
+	}
+	return "container running", nil
+}
+
+func (m *PodManager) AssignedGPUs(podID string) []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pod, ok := m.pods[podID]
+	if !ok {
+		return nil
+	}
+	return append([]int(nil), pod.gpuDevices...)
+}
+
+func (m *PodManager) reserveGPUs(podID string, count int) ([]int, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	free := make([]int, 0, m.gpuTotal)
+	for idx := 0; idx < m.gpuTotal; idx++ {
+		if _, used := m.gpuOwners[idx]; !used {
+			free = append(free, idx)
+		}
+	}
+	if len(free) < count {
+		return nil, fmt.Errorf("not enough free gpu devices: need %d, have %d", count, len(free))
+	}
+	devices := free[:count]
+	for _, idx := range devices {
+		m.gpuOwners[idx] = podID
+	}
+	return devices, nil
+}
+
+func (m *PodManager) forget(podID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pod, ok := m.pods[podID]
+	if !ok {
+		return
+	}
+	for _, idx := range pod.gpuDevices {
+		if m.gpuOwners[idx] == podID {
+			delete(m.gpuOwners, idx)
+		}
+	}
+	delete(m.pods, podID)
+}
+
+func (m *PodManager) pumpLogs(ctx context.Context, podID string, name string) {
+	emit := func(stream string, level string, message string) {
+		m.sink(models.ResourceLog{
+			ResourceID: podID,
+			SourceType: logtail.SourceContainer,
+			Source:     name,
+			Stream:     stream,
+			Level:      level,
+			Message:    message,
+			OccurredAt: time.Now().UTC(),
+		})
+	}
+	err := m.runtime.StreamLogs(ctx, name, func(line string, stderr bool) {
+		if m.sink == nil || strings.TrimSpace(line) == "" {
+			return
+		}
+		level := logtail.DetectLevel(line)
+		stream := "stdout"
+		if stderr {
+			stream = "stderr"
+			if level == "info" {
+				level = "warning"
+			}
+		}
+		emit(stream, level, line)
+	})
+	if ctx.Err() != nil || m.sink == nil {
+		return
+	}
+	if err != nil {
+		emit("system", "warning", "container log stream ended: "+err.Error())
+	}
+	state, inspectErr := m.runtime.Inspect(context.Background(), name)
+	if inspectErr != nil || state.Running {
+		return
+	}
+	level := "info"
+	if state.ExitCode != 0 {
+		level = "error"
+	}
+	emit("system", level, fmt.Sprintf("container exited with code %d", state.ExitCode))
+}
+
+func containerSpec(spec models.PodSpec, name string, cgroupParent string, devices []int) models.ContainerSpec {
+	out := models.ContainerSpec{
+		Name:         name,
+		Image:        spec.ImageName,
+		Command:      spec.Command,
+		Args:         spec.Args,
+		CPUCount:     spec.CPUCount,
+		MemoryMB:     spec.MemoryGB * 1024,
+		DiskGB:       spec.ContainerDiskGB,
+		GPUDevices:   devices,
+		CgroupParent: path.Join(cgroupParent, spec.AllocationID),
+		Labels: map[string]string{
+			"sharemtc.pod_id":        spec.PodID,
+			"sharemtc.allocation_id": spec.AllocationID,
+		},
+	}
+	for _, item := range spec.Env {
+		out.Env = append(out.Env, item.Key+"="+item.Value)
+	}
+	for _, item := range spec.Ports {
+		out.Ports = append(out.Ports, item.Port)
+	}
+	sort.Ints(out.Ports)
+	for i, item := range spec.VolumeMounts {
+		out.Volumes = append(out.Volumes, models.ContainerVolume{
+			Name:      fmt.Sprintf("%s-%d", name, i),
+			MountPath: item.MountPath,
+		})
+	}
+	return out
+}
+
+// joinPorts formats container to host port pairs as "8000:32768,22:32769",
+// the form resourceservice reads back from the pod_start result.
+func joinPorts(ports map[int]int) string {
+	keys := make([]int, 0, len(ports))
+	for port := range ports {
+		keys = append(keys, port)
+	}
+	sort.Ints(keys)
+	parts := make([]string, 0, len(keys))
+	for _, port := range keys {
+		parts = append(parts, fmt.Sprintf("%d:%d", port, ports[port]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, fmt.Sprint(v))
+	}
+	return strings.Join(parts, ",")
+}
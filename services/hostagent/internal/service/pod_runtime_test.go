@@ -0,0 +1,344 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/hostagent/internal/models"
+	"github.com/MidasWR/ShareMTC/services/sdk/filetransfer"
+)
+
+type fakeRuntime struct {
+	mu       sync.Mutex
+	pulled   []string
+	runs     []models.ContainerSpec
+	removed  []string
+	states   map[string]models.ContainerState
+	logs     []string
+	existing []models.ContainerInfo
+	pullErr  error
+	portsErr error
+}
+
+func (f *fakeRuntime) Pull(_ context.Context, image string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulled = append(f.pulled, image)
+	return f.pullErr
+}
+
+func (f *fakeRuntime) Run(_ context.Context, spec models.ContainerSpec) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.runs = append(f.runs, spec)
+	if f.states == nil {
+		f.states = make(map[string]models.ContainerState)
+	}
+	f.states[spec.Name] = models.ContainerState{Running: true, Status: "running"}
+	return "ctr-" + spec.Name, nil
+}
+
+func (f *fakeRuntime) Remove(_ context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = append(f.removed, name)
+	delete(f.states, name)
+	return nil
+}
+
+func (f *fakeRuntime) Inspect(_ context.Context, name string) (models.ContainerState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state, ok := f.states[name]
+	if !ok {
+		return models.ContainerState{Status: "missing", ExitCode: -1}, nil
+	}
+	return state, nil
+}
+
+func (f *fakeRuntime) List(_ context.Context) ([]models.ContainerInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]models.ContainerInfo(nil), f.existing...), nil
+}
+
+func (f *fakeRuntime) Ports(_ context.Context, name string) (map[int]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.portsErr != nil {
+		return nil, f.portsErr
+	}
+	ports := make(map[int]int)
+	for _, run := range f.runs {
+		if run.Name == name {
+			for i, port := range run.Ports {
+				ports[port] = 32768 + i
+			}
+		}
+	}
+	return ports, nil
+}
+
+func (f *fakeRuntime) StreamLogs(ctx context.Context, name string, sink func(line string, stderr bool)) error {
+	f.mu.Lock()
+	lines := append([]string(nil), f.logs...)
+	f.mu.Unlock()
+	for _, line := range lines {
+		sink(line, strings.HasPrefix(line, "ERR"))
+	}
+	f.mu.Lock()
+	f.states[name] = models.ContainerState{Running: false, ExitCode: 3, Status: "exited"}
+	f.mu.Unlock()
+	return nil
+}
+
+func podPayload(t *testing.T, spec models.PodSpec) string {
+	t.Helper()
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatalf("marshal pod spec: %v", err)
+	}
+	return string(raw)
+}
+
+func TestPodManagerStartAssignsGPUsAndCgroup(t *testing.T) {
+	runtime := &fakeRuntime{}
+	manager := NewPodManager(runtime, "/sharemtc", nil)
+	manager.SetGPUTotal(3)
+	ctx := context.Background()
+
+	message, err := manager.Start(ctx, podPayload(t, models.PodSpec{
+		PodID:           "pod-a",
+		AllocationID:    "alloc-a",
+		ImageName:       "nginx:latest",
+		Env:             []models.PodEnvVar{{Key: "MODE", Value: "serve"}},
+		Command:         []string{"nginx", "-g"},
+		Args:            []string{"daemon off;"},
+		Ports:           []models.PodPort{{Port: 8080, Protocol: "http"}, {Port: 22, Protocol: "tcp"}},
+		CPUCount:        2,
+		MemoryGB:        4,
+		GPUCount:        2,
+		ContainerDiskGB: 40,
+		VolumeMounts:    []models.PodVolumeMount{{MountPath: "/data", SizeGB: 10}},
+	}))
+	if err != nil {
+		t.Fatalf("start pod: %v", err)
+	}
+	if message != "container started: ctr-sharemtc-pod-pod-a gpus=0,1 ports=22:32768,8080:32769" {
+		t.Fatalf("unexpected start message %q", message)
+	}
+	if len(runtime.runs) != 1 {
+		t.Fatalf("expected one container run, got %d", len(runtime.runs))
+	}
+	spec := runtime.runs[0]
+	if spec.CgroupParent != "/sharemtc/alloc-a" {
+		t.Fatalf("expected allocation cgroup parent, got %q", spec.CgroupParent)
+	}
+	if spec.MemoryMB != 4096 || spec.CPUCount != 2 || spec.DiskGB != 40 {
+		t.Fatalf("unexpected limits: %+v", spec)
+	}
+	if len(spec.GPUDevices) != 2 || spec.GPUDevices[0] != 0 || spec.GPUDevices[1] != 1 {
+		t.Fatalf("expected gpu devices 0,1, got %v", spec.GPUDevices)
+	}
+	if len(spec.Env) != 1 || spec.Env[0] != "MODE=serve" || len(spec.Volumes) != 1 || spec.Volumes[0].MountPath != "/data" {
+		t.Fatalf("unexpected env or volumes: %+v", spec)
+	}
+
+	_, err = manager.Start(ctx, podPayload(t, models.PodSpec{
+		PodID: "pod-b", AllocationID: "alloc-b", ImageName: "nginx:latest", CPUCount: 1, MemoryGB: 1, GPUCount: 2,
+	}))
+	if err == nil {
+		t.Fatal("expected gpu exhaustion error")
+	}
+	if got := manager.AssignedGPUs("pod-b"); len(got) != 0 {
+		t.Fatalf("expected failed pod to hold no gpus, got %v", got)
+	}
+
+	if err := manager.Stop(ctx, "pod-a"); err != nil {
+		t.Fatalf("stop pod: %v", err)
+	}
+	_, err = manager.Start(ctx, podPayload(t, models.PodSpec{
+		PodID: "pod-b", AllocationID: "alloc-b", ImageName: "nginx:latest", CPUCount: 1, MemoryGB: 1, GPUCount: 2,
+	}))
+	if err != nil {
+		t.Fatalf("start pod after gpus freed: %v", err)
+	}
+}
+
+func TestPodManagerRecoversContainersAfterRestart(t *testing.T) {
+	runtime := &fakeRuntime{
+		existing: []models.ContainerInfo{
+			{Name: ContainerName("pod-a"), PodID: "pod-a", AllocationID: "alloc-a", Running: true, GPUDevices: []int{0, 1}},
+			{Name: "unrelated", PodID: "pod-x"},
+		},
+		states: map[string]models.ContainerState{
+			ContainerName("pod-a"): {Running: true, Status: "running"},
+		},
+	}
+	manager := NewPodManager(runtime, "/sharemtc", nil)
+	manager.SetGPUTotal(3)
+	ctx := context.Background()
+
+	adopted, err := manager.Recover(ctx)
+	if err != nil || adopted != 1 {
+		t.Fatalf("expected one adopted pod, got %d (%v)", adopted, err)
+	}
+	if got := manager.AssignedGPUs("pod-a"); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatalf("expected the adopted pod to keep gpus 0,1, got %v", got)
+	}
+	if _, err := manager.Start(ctx, podPayload(t, models.PodSpec{
+		PodID: "pod-b", AllocationID: "alloc-b", ImageName: "nginx:latest", CPUCount: 1, MemoryGB: 1, GPUCount: 2,
+	})); err == nil {
+		t.Fatal("expected the adopted pod's gpus to stay reserved")
+	}
+	message, err := manager.Start(ctx, podPayload(t, models.PodSpec{
+		PodID: "pod-a", AllocationID: "alloc-a", ImageName: "nginx:latest", CPUCount: 1, MemoryGB: 1, GPUCount: 2,
+	}))
+	if err != nil || message != "container already exists gpus=0,1" {
+		t.Fatalf("expected a redelivered start to succeed, got %q (%v)", message, err)
+	}
+	if len(runtime.runs) != 0 {
+		t.Fatalf("expected no container run for an existing pod, got %d", len(runtime.runs))
+	}
+	if err := manager.Stop(ctx, "pod-a"); err != nil {
+		t.Fatalf("stop adopted pod: %v", err)
+	}
+	if _, err := manager.Start(ctx, podPayload(t, models.PodSpec{
+		PodID: "pod-b", AllocationID: "alloc-b", ImageName: "nginx:latest", CPUCount: 1, MemoryGB: 1, GPUCount: 2,
+	})); err != nil {
+		t.Fatalf("start pod after the adopted pod stopped: %v", err)
+	}
+}
+
+func TestPodManagerStartAdoptsUnknownExistingContainer(t *testing.T) {
+	runtime := &fakeRuntime{
+		existing: []models.ContainerInfo{{Name: ContainerName("pod-a"), PodID: "pod-a", AllocationID: "alloc-a", GPUDevices: []int{1}}},
+		states:   map[string]models.ContainerState{ContainerName("pod-a"): {Status: "exited", ExitCode: 1}},
+	}
+	manager := NewPodManager(runtime, "/sharemtc", nil)
+	manager.SetGPUTotal(2)
+
+	message, err := manager.Start(context.Background(), podPayload(t, models.PodSpec{
+		PodID: "pod-a", AllocationID: "alloc-a", ImageName: "nginx:latest", CPUCount: 1, MemoryGB: 1, GPUCount: 1,
+	}))
+	if err != nil || message != "container already exists gpus=1" || len(runtime.runs) != 0 {
+		t.Fatalf("expected the existing container adopted instead of a duplicate run, got %q (%v), runs=%d", message, err, len(runtime.runs))
+	}
+}
+
+func TestPodManagerPullFailureReleasesGPUs(t *testing.T) {
+	runtime := &fakeRuntime{pullErr: errors.New("manifest unknown")}
+	manager := NewPodManager(runtime, "/sharemtc", nil)
+	manager.SetGPUTotal(1)
+
+	_, err := manager.Start(context.Background(), podPayload(t, models.PodSpec{
+		PodID: "pod-a", AllocationID: "alloc-a", ImageName: "missing:latest", CPUCount: 1, MemoryGB: 1, GPUCount: 1,
+	}))
+	if err == nil || !strings.Contains(err.Error(), "image pull failed") {
+		t.Fatalf("expected pull failure, got %v", err)
+	}
+	if got := manager.AssignedGPUs("pod-a"); len(got) != 0 {
+		t.Fatalf("expected gpus released, got %v", got)
+	}
+}
+
+func TestPodManagerPortLookupFailureRemovesContainer(t *testing.T) {
+	runtime := &fakeRuntime{portsErr: errors.New("no such container")}
+	manager := NewPodManager(runtime, "/sharemtc", nil)
+	manager.SetGPUTotal(1)
+
+	_, err := manager.Start(context.Background(), podPayload(t, models.PodSpec{
+		PodID: "pod-a", AllocationID: "alloc-a", ImageName: "app:latest", CPUCount: 1, MemoryGB: 1, GPUCount: 1,
+		Ports: []models.PodPort{{Port: 8000, Protocol: "http"}},
+	}))
+	if err == nil || !strings.Contains(err.Error(), "published ports lookup failed") {
+		t.Fatalf("expected port lookup failure, got %v", err)
+	}
+	if len(runtime.removed) != 1 || runtime.removed[0] != "sharemtc-pod-pod-a" {
+		t.Fatalf("expected container removed, got %v", runtime.removed)
+	}
+	if got := manager.AssignedGPUs("pod-a"); len(got) != 0 {
+		t.Fatalf("expected gpus released, got %v", got)
+	}
+}
+
+func TestPodManagerMountsFileSandbox(t *testing.T) {
+	runtime := &fakeRuntime{}
+	manager := NewPodManager(runtime, "/sharemtc", nil)
+	root := t.TempDir()
+	if err := manager.SetFileSandbox(root); err != nil {
+		t.Fatalf("set file sandbox: %v", err)
+	}
+
+	if _, err := manager.Start(context.Background(), podPayload(t, models.PodSpec{
+		PodID: "pod-a", AllocationID: "alloc-a", ImageName: "app:latest", CPUCount: 1, MemoryGB: 1,
+	})); err != nil {
+		t.Fatalf("start pod: %v", err)
+	}
+	dir := filepath.Join(root, "resources", "pod-a")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("expected the pod sandbox directory to exist, got %v", err)
+	}
+	volumes := runtime.runs[0].Volumes
+	if len(volumes) != 1 || volumes[0].HostPath != dir || volumes[0].MountPath != filetransfer.PodMountPath {
+		t.Fatalf("expected the sandbox bind mounted at %s, got %+v", filetransfer.PodMountPath, volumes)
+	}
+
+	if err := manager.Stop(context.Background(), "pod-a"); err != nil {
+		t.Fatalf("stop pod: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected the pod sandbox directory to be removed, got %v", err)
+	}
+	if _, err := manager.Start(context.Background(), podPayload(t, models.PodSpec{
+		PodID: "..", AllocationID: "alloc-b", ImageName: "app:latest", CPUCount: 1, MemoryGB: 1,
+	})); err == nil {
+		t.Fatal("expected a pod id outside the sandbox to be rejected")
+	}
+}
+
+func TestPodManagerReportsLogsAndExit(t *testing.T) {
+	runtime := &fakeRuntime{logs: []string{"listening on :8080", "ERR disk almost full", "ERR fatal: cannot bind"}}
+	type entry struct{ level, message string }
+	received := make(chan entry, 8)
+	manager := NewPodManager(runtime, "/sharemtc", func(item models.ResourceLog) {
+		if item.ResourceID == "pod-a" && item.SourceType == "container" {
+			received <- entry{item.Level, item.Message}
+		}
+	})
+	ctx := context.Background()
+
+	if _, err := manager.Start(ctx, podPayload(t, models.PodSpec{
+		PodID: "pod-a", AllocationID: "alloc-a", ImageName: "app:latest", CPUCount: 1, MemoryGB: 1,
+	})); err != nil {
+		t.Fatalf("start pod: %v", err)
+	}
+
+	want := []entry{
+		{"info", "listening on :8080"},
+		{"warning", "ERR disk almost full"},
+		{"error", "ERR fatal: cannot bind"},
+		{"error", "container exited with code 3"},
+	}
+	for _, expected := range want {
+		select {
+		case got := <-received:
+			if got != expected {
+				t.Fatalf("expected %+v, got %+v", expected, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("did not receive %+v", expected)
+		}
+	}
+
+	if _, err := manager.Status(ctx, "pod-a"); err == nil {
+		t.Fatal("expected status error for exited container")
+	}
+}
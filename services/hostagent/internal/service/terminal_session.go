@@ -62,6 +62,13 @@ func (m *TerminalManager) Open(sessionID string, rows int, cols int) error {
 	return nil
 }
 
+// Count is the number of open terminal sessions.
+func (m *TerminalManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
 func (m *TerminalManager) Write(sessionID string, payload string) error {
 	m.mu.Lock()
 	proc, ok := m.sessions[sessionID]
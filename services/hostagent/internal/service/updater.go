@@ -0,0 +1,427 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/sdk/agentupdate"
+)
+
+const (
+	updatePending    = "pending"
+	updateRolledBack = "rolled_back"
+
+	// maxTrialBoots is how often a new version may start without delivering
+	// a heartbeat before the previous one is restored.
+	maxTrialBoots = 3
+
+	defaultHealthTimeout = 2 * time.Minute
+)
+
+var (
+	// ErrUpdateCurrent is returned when the requested version already runs.
+	ErrUpdateCurrent = errors.New("already running the requested version")
+	// ErrUpdateInTrial is returned for a redelivered command whose new
+	// version is still proving itself; the trial reports the result.
+	ErrUpdateInTrial = errors.New("update is waiting for a heartbeat from the new version")
+)
+
+// UpdateState is kept next to the installed binaries while a new version is
+// on trial and after a rollback until the result has been reported.
+type UpdateState struct {
+	CommandID    string    `json:"command_id"`
+	FromVersion  string    `json:"from_version"`
+	ToVersion    string    `json:"to_version"`
+	ToPath       string    `json:"to_path"`
+	PreviousPath string    `json:"previous_path"`
+	PreviousLink string    `json:"previous_link"`
+	Deadline     time.Time `json:"deadline"`
+	Boots        int       `json:"boots"`
+	Status       string    `json:"status"`
+	Detail       string    `json:"detail,omitempty"`
+}
+
+// Result is the command result describing this update.
+func (s UpdateState) Result(running string) agentupdate.Result {
+	return agentupdate.Result{
+		FromVersion: s.FromVersion,
+		ToVersion:   s.ToVersion,
+		Running:     running,
+		RolledBack:  s.Status == updateRolledBack,
+		Error:       s.Detail,
+	}
+}
+
+// Updater installs signed releases into dir and points dir/current at the
+// one that should run. Binaries live in dir so that they survive a container
+// being recreated from the original image; every start goes through Launch,
+// which execs the current binary.
+type Updater struct {
+	mu        sync.Mutex
+	dir       string
+	version   string
+	publicKey ed25519.PublicKey
+	self      string
+	client    *http.Client
+}
+
+func NewUpdater(dir string, version string, publicKey string) *Updater {
+	u := &Updater{dir: dir, version: version, client: &http.Client{Timeout: 10 * time.Minute}}
+	if key, err := base64.StdEncoding.DecodeString(publicKey); err == nil && len(key) == ed25519.PublicKeySize {
+		u.publicKey = ed25519.PublicKey(key)
+	}
+	if self, err := os.Executable(); err == nil {
+		if resolved, err := filepath.EvalSymlinks(self); err == nil {
+			self = resolved
+		}
+		u.self = self
+	}
+	return u
+}
+
+func (u *Updater) Version() string {
+	return u.version
+}
+
+// Launch returns the binary this process should exec instead of running, or
+// an empty path. A new version on trial counts its starts here, and a trial
+// that restarted too often or ran out of time is rolled back first.
+func (u *Updater) Launch(now time.Time) (string, error) {
+	if u.dir == "" {
+		return "", nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state, err := u.loadState()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if state.Status == updatePending {
+		if state.ToPath == u.self {
+			state.Boots++
+			if state.Boots > maxTrialBoots {
+				return u.rollbackLocked(state, fmt.Sprintf("version %s restarted %d times without delivering a heartbeat", state.ToVersion, maxTrialBoots))
+			}
+		}
+		if now.After(state.Deadline) {
+			return u.rollbackLocked(state, fmt.Sprintf("version %s did not deliver a heartbeat before the health timeout", state.ToVersion))
+		}
+		if state.ToPath == u.self {
+			return "", u.saveState(state)
+		}
+	}
+	target, err := u.currentTarget()
+	if err != nil || target == "" || target == u.self {
+		return "", err
+	}
+	return target, nil
+}
+
+// Trial returns the pending update when this process is its new version.
+func (u *Updater) Trial() (UpdateState, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state, err := u.loadState()
+	if err != nil || state.Status != updatePending || state.ToPath != u.self {
+		return UpdateState{}, false
+	}
+	return state, true
+}
+
+// Commit ends a trial after the new version delivered a heartbeat and
+// removes binaries that are neither current nor the rollback target.
+func (u *Updater) Commit() (UpdateState, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state, err := u.loadState()
+	if err != nil || state.Status != updatePending || state.ToPath != u.self {
+		return UpdateState{}, false
+	}
+	if err := os.Remove(u.statePath()); err != nil {
+		return UpdateState{}, false
+	}
+	entries, _ := os.ReadDir(u.dir)
+	for _, entry := range entries {
+		path := filepath.Join(u.dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), "hostagent-") && path != state.ToPath && path != state.PreviousLink {
+			_ = os.Remove(path)
+		}
+	}
+	return state, true
+}
+
+// Rollback restores the previous version of a pending trial and returns the
+// binary to exec. It does nothing once the trial has been committed.
+func (u *Updater) Rollback(reason string) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state, err := u.loadState()
+	if err != nil || state.Status != updatePending {
+		return "", nil
+	}
+	return u.rollbackLocked(state, reason)
+}
+
+// TakeRolledBack returns an update that was rolled back and forgets it, so
+// the restored version reports the result exactly once.
+func (u *Updater) TakeRolledBack() (UpdateState, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state, err := u.loadState()
+	if err != nil || state.Status != updateRolledBack {
+		return UpdateState{}, false
+	}
+	if err := os.Remove(u.statePath()); err != nil {
+		return UpdateState{}, false
+	}
+	return state, true
+}
+
+// Stage downloads and verifies the requested release, makes it current and
+// returns the binary to exec. The previous version stays installed until the
+// new one commits.
+func (u *Updater) Stage(ctx context.Context, commandID string, payload string, now time.Time) (string, error) {
+	if !selfUpdateSupported {
+		return "", errors.New("self-update is supported on Linux provider nodes only")
+	}
+	if u.dir == "" {
+		return "", errors.New("self-update is disabled on this host")
+	}
+	if u.publicKey == nil {
+		return "", errors.New("self-update is disabled: no release key is embedded in this build")
+	}
+	var req agentupdate.Request
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return "", errors.New("invalid agent_update payload")
+	}
+	if !agentupdate.ValidVersion(req.Version) {
+		return "", errors.New("invalid version")
+	}
+	if !strings.HasPrefix(req.URL, "https://") && !strings.HasPrefix(req.URL, "http://") {
+		return "", errors.New("release url must be http or https")
+	}
+	timeout := defaultHealthTimeout
+	if req.HealthTimeoutSeconds > 0 {
+		timeout = time.Duration(req.HealthTimeoutSeconds) * time.Second
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if state, err := u.loadState(); err == nil && state.Status == updatePending {
+		if state.CommandID == commandID {
+			return "", ErrUpdateInTrial
+		}
+		return "", fmt.Errorf("update to %s is still on trial", state.ToVersion)
+	}
+	if req.Version == u.version {
+		return "", ErrUpdateCurrent
+	}
+	if err := os.MkdirAll(u.dir, 0o750); err != nil {
+		return "", err
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	url := agentupdate.ArtifactURL(req.URL, req.Version, runtime.GOOS, runtime.GOARCH)
+	download := filepath.Join(u.dir, "hostagent-"+req.Version+".download")
+	digest, err := u.download(ctx, url, download)
+	if err != nil {
+		_ = os.Remove(download)
+		return "", err
+	}
+	signature, err := u.fetch(ctx, url+agentupdate.SignatureSuffix, 4<<10)
+	if err == nil {
+		err = agentupdate.Verify(u.publicKey, req.Version, platform, digest, string(signature))
+	}
+	if err != nil {
+		_ = os.Remove(download)
+		return "", err
+	}
+	target := filepath.Join(u.dir, "hostagent-"+req.Version)
+	if err := os.Chmod(download, 0o755); err != nil {
+		_ = os.Remove(download)
+		return "", err
+	}
+	if err := os.Rename(download, target); err != nil {
+		_ = os.Remove(download)
+		return "", err
+	}
+	if err := preflight(ctx, target, req.Version); err != nil {
+		_ = os.Remove(target)
+		return "", err
+	}
+	previous, err := u.currentTarget()
+	if err != nil {
+		return "", err
+	}
+	state := UpdateState{
+		CommandID:    commandID,
+		FromVersion:  u.version,
+		ToVersion:    req.Version,
+		ToPath:       target,
+		PreviousPath: u.self,
+		PreviousLink: previous,
+		Deadline:     now.Add(timeout),
+		Status:       updatePending,
+	}
+	if err := u.saveState(state); err != nil {
+		return "", err
+	}
+	if err := u.setCurrent(target); err != nil {
+		_ = os.Remove(u.statePath())
+		return "", err
+	}
+	return target, nil
+}
+
+func (u *Updater) rollbackLocked(state UpdateState, reason string) (string, error) {
+	if err := u.setCurrent(state.PreviousLink); err != nil {
+		return "", err
+	}
+	state.Status = updateRolledBack
+	state.Detail = reason
+	if err := u.saveState(state); err != nil {
+		return "", err
+	}
+	next := state.PreviousLink
+	if next == "" {
+		next = state.PreviousPath
+	}
+	if next == u.self {
+		return "", nil
+	}
+	return next, nil
+}
+
+func (u *Updater) download(ctx context.Context, url string, path string) ([]byte, error) {
+	resp, err := u.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(resp.Body, agentupdate.MaxArtifactBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > agentupdate.MaxArtifactBytes {
+		return nil, errors.New("release artifact is too large")
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func (u *Updater) fetch(ctx context.Context, url string, limit int64) ([]byte, error) {
+	resp, err := u.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+func (u *Updater) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download %s failed with status %d", url, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// preflight runs the new binary with -version, which catches a binary built
+// for another platform or tagged with another version before it is swapped in.
+func preflight(ctx context.Context, path string, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return fmt.Errorf("new binary failed to start: %w", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != version {
+		return fmt.Errorf("new binary reports version %q", got)
+	}
+	return nil
+}
+
+func (u *Updater) currentPath() string {
+	return filepath.Join(u.dir, "current")
+}
+
+func (u *Updater) statePath() string {
+	return filepath.Join(u.dir, "update.json")
+}
+
+func (u *Updater) currentTarget() (string, error) {
+	target, err := os.Readlink(u.currentPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return target, err
+}
+
+// setCurrent swaps the current link atomically; an empty target removes it
+// so the original binary runs.
+func (u *Updater) setCurrent(target string) error {
+	if target == "" {
+		if err := os.Remove(u.currentPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	tmp := u.currentPath() + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.currentPath())
+}
+
+func (u *Updater) loadState() (UpdateState, error) {
+	raw, err := os.ReadFile(u.statePath())
+	if err != nil {
+		return UpdateState{}, err
+	}
+	var state UpdateState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return UpdateState{}, err
+	}
+	return state, nil
+}
+
+func (u *Updater) saveState(state UpdateState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := u.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.statePath())
+}
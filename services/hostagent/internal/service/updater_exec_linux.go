@@ -0,0 +1,16 @@
+//go:build linux
+
+package service
+
+import (
+	"os"
+	"syscall"
+)
+
+const selfUpdateSupported = true
+
+// ExecBinary replaces this process with path, keeping its arguments and
+// environment, so a service manager sees the same process restart in place.
+func ExecBinary(path string) error {
+	return syscall.Exec(path, os.Args, os.Environ())
+}
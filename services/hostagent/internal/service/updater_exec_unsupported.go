@@ -0,0 +1,11 @@
+//go:build !linux
+
+package service
+
+import "errors"
+
+const selfUpdateSupported = false
+
+func ExecBinary(path string) error {
+	return errors.New("self-update is supported on Linux provider nodes only")
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/sdk/agentupdate"
+)
+
+func releaseServer(t *testing.T, key ed25519.PrivateKey, version string, artifact []byte) *httptest.Server {
+	t.Helper()
+	sum := sha256.Sum256(artifact)
+	signature := ed25519.Sign(key, agentupdate.SignedMessage(version, runtime.GOOS+"/"+runtime.GOARCH, sum[:]))
+	mux := http.NewServeMux()
+	name := "/" + version + "/hostagent-" + runtime.GOOS + "-" + runtime.GOARCH
+	mux.HandleFunc(name, func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write(artifact) })
+	mux.HandleFunc(name+agentupdate.SignatureSuffix, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(signature)))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func updatePayload(t *testing.T, server *httptest.Server, version string) string {
+	t.Helper()
+	raw, err := json.Marshal(agentupdate.Request{Version: version, URL: server.URL + "/{version}/hostagent-{os}-{arch}", HealthTimeoutSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestUpdaterStagesSignedReleaseAndCommits(t *testing.T) {
+	if !selfUpdateSupported {
+		t.Skip("self-update is Linux only")
+	}
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	dir := t.TempDir()
+	server := releaseServer(t, private, "v2.0.0", []byte("#!/bin/sh\necho v2.0.0\n"))
+	old := NewUpdater(dir, "v1.0.0", base64.StdEncoding.EncodeToString(public))
+	old.self = "/hostagent"
+	now := time.Now().UTC()
+
+	if _, err := old.Stage(context.Background(), "cmd-1", updatePayload(t, server, "v1.0.0"), now); err != ErrUpdateCurrent {
+		t.Fatalf("expected the running version to be reported as current, got %v", err)
+	}
+	next, err := old.Stage(context.Background(), "cmd-1", updatePayload(t, server, "v2.0.0"), now)
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	if target, _ := os.Readlink(filepath.Join(dir, "current")); target != next || next != filepath.Join(dir, "hostagent-v2.0.0") {
+		t.Fatalf("current link not swapped: %q -> %q", next, target)
+	}
+	if _, err := old.Stage(context.Background(), "cmd-2", updatePayload(t, server, "v2.0.0"), now); err == nil {
+		t.Fatal("expected a second update to be refused while one is on trial")
+	}
+
+	// The launcher execs the current binary; the new version counts its boot.
+	if launch, err := old.Launch(now); err != nil || launch != next {
+		t.Fatalf("expected launcher to exec %q, got %q %v", next, launch, err)
+	}
+	fresh := NewUpdater(dir, "v2.0.0", base64.StdEncoding.EncodeToString(public))
+	fresh.self = next
+	if launch, err := fresh.Launch(now); err != nil || launch != "" {
+		t.Fatalf("expected the new version to keep running, got %q %v", launch, err)
+	}
+	if _, err := fresh.Stage(context.Background(), "cmd-1", updatePayload(t, server, "v2.0.0"), now); err != ErrUpdateInTrial {
+		t.Fatalf("expected a redelivered command to wait for the trial, got %v", err)
+	}
+	state, ok := fresh.Commit()
+	if !ok || state.CommandID != "cmd-1" || state.Result("v2.0.0").RolledBack {
+		t.Fatalf("unexpected commit %+v %v", state, ok)
+	}
+	if _, ok := fresh.Trial(); ok {
+		t.Fatal("expected no trial after commit")
+	}
+}
+
+func TestUpdaterRollsBackUnhealthyVersion(t *testing.T) {
+	if !selfUpdateSupported {
+		t.Skip("self-update is Linux only")
+	}
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	dir := t.TempDir()
+	server := releaseServer(t, private, "v2.0.0", []byte("#!/bin/sh\necho v2.0.0\n"))
+	old := NewUpdater(dir, "v1.0.0", base64.StdEncoding.EncodeToString(public))
+	old.self = "/hostagent"
+	now := time.Now().UTC()
+	next, err := old.Stage(context.Background(), "cmd-1", updatePayload(t, server, "v2.0.0"), now)
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	fresh := NewUpdater(dir, "v2.0.0", "")
+	fresh.self = next
+	for i := 0; i < maxTrialBoots; i++ {
+		if launch, err := fresh.Launch(now); err != nil || launch != "" {
+			t.Fatalf("boot %d: unexpected launch %q %v", i, launch, err)
+		}
+	}
+	launch, err := fresh.Launch(now)
+	if err != nil || launch != "/hostagent" {
+		t.Fatalf("expected a crash-looping version to be rolled back to the image binary, got %q %v", launch, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "current")); !os.IsNotExist(err) {
+		t.Fatalf("expected current link to be removed: %v", err)
+	}
+	state, ok := old.TakeRolledBack()
+	if !ok || !state.Result("v1.0.0").RolledBack || state.Detail == "" {
+		t.Fatalf("unexpected rolled back state %+v %v", state, ok)
+	}
+	if _, ok := old.TakeRolledBack(); ok {
+		t.Fatal("expected the rollback to be reported once")
+	}
+}
+
+func TestUpdaterRejectsBadSignature(t *testing.T) {
+	if !selfUpdateSupported {
+		t.Skip("self-update is Linux only")
+	}
+	public, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	dir := t.TempDir()
+	server := releaseServer(t, other, "v2.0.0", []byte("#!/bin/sh\necho v2.0.0\n"))
+	updater := NewUpdater(dir, "v1.0.0", base64.StdEncoding.EncodeToString(public))
+	if _, err := updater.Stage(context.Background(), "cmd-1", updatePayload(t, server, "v2.0.0"), time.Now()); err == nil || err.Error() != "release signature is invalid" {
+		t.Fatalf("expected signature rejection, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("expected no files left behind, got %d", len(entries))
+	}
+	if _, err := NewUpdater(dir, "v1.0.0", "").Stage(context.Background(), "cmd-1", updatePayload(t, server, "v2.0.0"), time.Now()); err == nil {
+		t.Fatal("expected a build without a release key to refuse updates")
+	}
+}
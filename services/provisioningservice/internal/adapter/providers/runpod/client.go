@@ -19,12 +19,25 @@ type Client struct {
 }
 
 type CreatePodRequest struct {
-	Name      string
-	ImageName string
-	GPUTypeID string
-	GPUCount  int
-	CPUCount  int
-	MemoryGB  int
+	Name                    string
+	ImageName               string
+	GPUTypeID               string
+	GPUCount                int
+	CPUCount                int
+	MemoryGB                int
+	Env                     []EnvVar
+	DockerArgs              string
+	Ports                   string
+	ContainerDiskGB         int
+	VolumeGB                int
+	VolumeMountPath         string
+	NetworkVolumeID         string
+	ContainerRegistryAuthID string
+}
+
+type EnvVar struct {
+	Key   string
+	Value string
 }
 
 type CreatePodResult struct {
@@ -45,11 +58,7 @@ func (c *Client) CreatePod(ctx context.Context, req CreatePodRequest) (CreatePod
 	if c.apiKey == "" {
 		return CreatePodResult{}, errors.New("runpod api key is empty")
 	}
-	query := fmt.Sprintf(
-		`mutation { podFindAndDeployOnDemand(input: { name: %q, imageName: %q, gpuTypeId: %q, gpuCount: %d, containerDiskInGb: 20, volumeInGb: 20, minVcpuCount: %d, minMemoryInGb: %d }) { id } }`,
-		req.Name, req.ImageName, req.GPUTypeID, req.GPUCount, req.CPUCount, req.MemoryGB,
-	)
-	responseBody, err := c.callGraphQL(ctx, query)
+	responseBody, err := c.callGraphQL(ctx, buildCreatePodMutation(req))
 	if err != nil {
 		return CreatePodResult{}, err
 	}
@@ -75,6 +84,50 @@ func (c *Client) CreatePod(ctx context.Context, req CreatePodRequest) (CreatePod
 	return CreatePodResult{ID: response.Data.Pod.ID}, nil
 }
 
+func buildCreatePodMutation(req CreatePodRequest) string {
+	containerDiskGB := req.ContainerDiskGB
+	if containerDiskGB <= 0 {
+		containerDiskGB = 20
+	}
+	fields := []string{
+		fmt.Sprintf("name: %q", req.Name),
+		fmt.Sprintf("imageName: %q", req.ImageName),
+		fmt.Sprintf("gpuTypeId: %q", req.GPUTypeID),
+		fmt.Sprintf("gpuCount: %d", req.GPUCount),
+		fmt.Sprintf("containerDiskInGb: %d", containerDiskGB),
+		fmt.Sprintf("minVcpuCount: %d", req.CPUCount),
+		fmt.Sprintf("minMemoryInGb: %d", req.MemoryGB),
+	}
+	switch {
+	case req.NetworkVolumeID != "":
+		fields = append(fields, fmt.Sprintf("networkVolumeId: %q", req.NetworkVolumeID))
+	case req.VolumeGB > 0:
+		fields = append(fields, fmt.Sprintf("volumeInGb: %d", req.VolumeGB))
+	case req.VolumeMountPath == "":
+		fields = append(fields, "volumeInGb: 20")
+	}
+	if req.VolumeMountPath != "" {
+		fields = append(fields, fmt.Sprintf("volumeMountPath: %q", req.VolumeMountPath))
+	}
+	if req.DockerArgs != "" {
+		fields = append(fields, fmt.Sprintf("dockerArgs: %q", req.DockerArgs))
+	}
+	if req.Ports != "" {
+		fields = append(fields, fmt.Sprintf("ports: %q", req.Ports))
+	}
+	if req.ContainerRegistryAuthID != "" {
+		fields = append(fields, fmt.Sprintf("containerRegistryAuthId: %q", req.ContainerRegistryAuthID))
+	}
+	if len(req.Env) > 0 {
+		env := make([]string, 0, len(req.Env))
+		for _, item := range req.Env {
+			env = append(env, fmt.Sprintf("{ key: %q, value: %q }", item.Key, item.Value))
+		}
+		fields = append(fields, "env: ["+strings.Join(env, ", ")+"]")
+	}
+	return "mutation { podFindAndDeployOnDemand(input: { " + strings.Join(fields, ", ") + " }) { id } }"
+}
+
 func (c *Client) DeletePod(ctx context.Context, podID string) error {
 	if c.apiKey == "" {
 		return errors.New("runpod api key is empty")
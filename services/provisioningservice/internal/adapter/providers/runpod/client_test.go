@@ -0,0 +1,87 @@
+package runpod
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildCreatePodMutation(t *testing.T) {
+	cases := []struct {
+		name    string
+		req     CreatePodRequest
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "defaults",
+			req:  CreatePodRequest{Name: "pod-1", ImageName: "runpod/pytorch:2.1", GPUTypeID: "NVIDIA A100", GPUCount: 1, CPUCount: 8, MemoryGB: 32},
+			want: []string{
+				`name: "pod-1"`,
+				`imageName: "runpod/pytorch:2.1"`,
+				`gpuTypeId: "NVIDIA A100"`,
+				`gpuCount: 1`,
+				`minVcpuCount: 8`,
+				`minMemoryInGb: 32`,
+				`containerDiskInGb: 20`,
+				`volumeInGb: 20`,
+			},
+			notWant: []string{"env:", "ports:", "dockerArgs:", "volumeMountPath:"},
+		},
+		{
+			name: "gpus, disk and ports",
+			req:  CreatePodRequest{Name: "pod-2", ImageName: "vllm/vllm-openai:latest", GPUTypeID: "NVIDIA H100 80GB HBM3", GPUCount: 4, ContainerDiskGB: 80, VolumeGB: 200, VolumeMountPath: "/workspace", Ports: "8000/http,22/tcp"},
+			want: []string{
+				`gpuTypeId: "NVIDIA H100 80GB HBM3"`,
+				`gpuCount: 4`,
+				`containerDiskInGb: 80`,
+				`volumeInGb: 200`,
+				`volumeMountPath: "/workspace"`,
+				`ports: "8000/http,22/tcp"`,
+			},
+		},
+		{
+			name: "env and start command are quoted",
+			req: CreatePodRequest{
+				Name:       "pod-3",
+				ImageName:  "ghcr.io/acme/train:v2",
+				Env:        []EnvVar{{Key: "HF_TOKEN", Value: `a"b`}, {Key: "MODE", Value: "train"}},
+				DockerArgs: `bash -c "python train.py"`,
+			},
+			want: []string{
+				`imageName: "ghcr.io/acme/train:v2"`,
+				`env: [{ key: "HF_TOKEN", value: "a\"b" }, { key: "MODE", value: "train" }]`,
+				`dockerArgs: "bash -c \"python train.py\""`,
+			},
+		},
+		{
+			name:    "network volume replaces the pod volume",
+			req:     CreatePodRequest{Name: "pod-4", ImageName: "ubuntu:22.04", NetworkVolumeID: "vol-9", VolumeGB: 50, VolumeMountPath: "/data", ContainerRegistryAuthID: "auth-1"},
+			want:    []string{`networkVolumeId: "vol-9"`, `volumeMountPath: "/data"`, `containerRegistryAuthId: "auth-1"`},
+			notWant: []string{"volumeInGb:"},
+		},
+		{
+			name:    "mount path without size leaves the volume to runpod",
+			req:     CreatePodRequest{Name: "pod-5", ImageName: "ubuntu:22.04", VolumeMountPath: "/data"},
+			want:    []string{`volumeMountPath: "/data"`},
+			notWant: []string{"volumeInGb:", "networkVolumeId:"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutation := buildCreatePodMutation(tc.req)
+			if !strings.HasPrefix(mutation, "mutation { podFindAndDeployOnDemand(input: { ") || !strings.HasSuffix(mutation, " }) { id } }") {
+				t.Fatalf("unexpected mutation shape: %s", mutation)
+			}
+			for _, field := range tc.want {
+				if !strings.Contains(mutation, field) {
+					t.Errorf("expected %s in %s", field, mutation)
+				}
+			}
+			for _, field := range tc.notWant {
+				if strings.Contains(mutation, field) {
+					t.Errorf("did not expect %s in %s", field, mutation)
+				}
+			}
+		})
+	}
+}
@@ -48,18 +48,42 @@ type ProvisionVMRequest struct {
 }
 
 type ProvisionPodRequest struct {
-	RequestID  string         `json:"request_id"`
-	TraceID    string         `json:"trace_id"`
-	UserID     string         `json:"user_id"`
-	ProviderID string         `json:"provider_id"`
-	Name       string         `json:"name"`
-	ImageName  string         `json:"image_name"`
-	GPUTypeID  string         `json:"gpu_type_id"`
-	GPUCount   int            `json:"gpu_count"`
-	CPUCount   int            `json:"cpu_count"`
-	MemoryGB   int            `json:"memory_gb"`
-	ExpiresAt  time.Time      `json:"expires_at"`
-	Metadata   map[string]any `json:"metadata"`
+	RequestID       string           `json:"request_id"`
+	TraceID         string           `json:"trace_id"`
+	UserID          string           `json:"user_id"`
+	ProviderID      string           `json:"provider_id"`
+	Name            string           `json:"name"`
+	ImageName       string           `json:"image_name"`
+	GPUTypeID       string           `json:"gpu_type_id"`
+	GPUCount        int              `json:"gpu_count"`
+	CPUCount        int              `json:"cpu_count"`
+	MemoryGB        int              `json:"memory_gb"`
+	Env             []PodEnvVar      `json:"env"`
+	Command         []string         `json:"command"`
+	Args            []string         `json:"args"`
+	Ports           []PodPort        `json:"ports"`
+	ContainerDiskGB int              `json:"container_disk_gb"`
+	VolumeMounts    []PodVolumeMount `json:"volume_mounts"`
+	RegistryAuthID  string           `json:"registry_auth_id"`
+	ExpiresAt       time.Time        `json:"expires_at"`
+	Metadata        map[string]any   `json:"metadata"`
+}
+
+type PodEnvVar struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	SecretRef string `json:"secret_ref"`
+}
+
+type PodPort struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type PodVolumeMount struct {
+	MountPath       string `json:"mount_path"`
+	SizeGB          int    `json:"size_gb"`
+	NetworkVolumeID string `json:"network_volume_id"`
 }
 
 type DeleteResourceRequest struct {
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/MidasWR/ShareMTC/services/provisioningservice/internal/adapter/providers/digitalocean"
@@ -163,14 +165,7 @@ func (s *ProvisioningService) CreatePod(ctx context.Context, req models.Provisio
 		return models.ProvisionResult{}, err
 	}
 
-	provisioned, err := s.runPodProvider.CreatePod(ctx, runpod.CreatePodRequest{
-		Name:      req.Name,
-		ImageName: req.ImageName,
-		GPUTypeID: req.GPUTypeID,
-		GPUCount:  req.GPUCount,
-		CPUCount:  req.CPUCount,
-		MemoryGB:  req.MemoryGB,
-	})
+	provisioned, err := s.runPodProvider.CreatePod(ctx, runPodCreateRequest(req))
 	if err != nil {
 		log.Error().Err(err).Str("job_id", job.ID).Str("request_id", req.RequestID).Msg("provision pod failed on provider create")
 		nextRetry := time.Now().UTC().Add(30 * time.Second)
@@ -321,3 +316,52 @@ func (s *ProvisioningService) jobToResult(job models.Job) models.ProvisionResult
 	}
 	return result
 }
+
+func runPodCreateRequest(req models.ProvisionPodRequest) runpod.CreatePodRequest {
+	out := runpod.CreatePodRequest{
+		Name:                    req.Name,
+		ImageName:               req.ImageName,
+		GPUTypeID:               req.GPUTypeID,
+		GPUCount:                req.GPUCount,
+		CPUCount:                req.CPUCount,
+		MemoryGB:                req.MemoryGB,
+		ContainerDiskGB:         req.ContainerDiskGB,
+		ContainerRegistryAuthID: req.RegistryAuthID,
+	}
+	for _, item := range req.Env {
+		value := item.Value
+		if item.SecretRef != "" {
+			value = "{{ RUNPOD_SECRET_" + item.SecretRef + " }}"
+		}
+		out.Env = append(out.Env, runpod.EnvVar{Key: item.Key, Value: value})
+	}
+	if len(req.Command) > 0 {
+		parts := make([]string, 0, len(req.Command)+len(req.Args))
+		for _, part := range append(append([]string{}, req.Command...), req.Args...) {
+			parts = append(parts, shellQuote(part))
+		}
+		out.DockerArgs = strings.Join(parts, " ")
+	}
+	ports := make([]string, 0, len(req.Ports))
+	for _, item := range req.Ports {
+		ports = append(ports, strconv.Itoa(item.Port)+"/"+item.Protocol)
+	}
+	out.Ports = strings.Join(ports, ",")
+	if len(req.VolumeMounts) > 0 {
+		mount := req.VolumeMounts[0]
+		out.VolumeMountPath = mount.MountPath
+		out.VolumeGB = mount.SizeGB
+		out.NetworkVolumeID = mount.NetworkVolumeID
+	}
+	return out
+}
+
+func shellQuote(value string) string {
+	if value != "" && strings.IndexFunc(value, func(r rune) bool {
+		return !(r == '-' || r == '_' || r == '.' || r == '/' || r == '=' || r == ':' || r == ',' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+	}) < 0 {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
@@ -7,10 +7,16 @@ import (
 	"time"
 
 	"github.com/MidasWR/ShareMTC/services/resourceservice/config"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/adminclient"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/agentauth"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/authclient"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/billing"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/cgroups"
 	httpadapter "github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/http"
 	kafkaadapter "github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/kafka"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/notify"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/orchestrator"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/prober"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/provisioning"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/storage"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
@@ -58,21 +64,83 @@ func main() {
 	logger.Info().Msg("resource database migrations applied")
 	provisioningClient := provisioning.NewClient(cfg.ProvisioningURL, cfg.ProvisioningServiceToken, cfg.ProvisioningHTTPTimeout)
 	logger.Info().Str("provisioning_url", cfg.ProvisioningURL).Dur("provisioning_timeout", cfg.ProvisioningHTTPTimeout).Msg("provisioning client initialized")
-	svc := service.NewResourceService(
-		repo,
-		cgroups.NewV2Applier(cfg.CGroupRoot, cfg.CGroupSoftFail),
-		orchestrator.NewInternalRuntime(),
-		provisioningClient,
-		cfg.HeartbeatMaxAge,
-		cfg.CreateRateLimitRPM,
-		time.Duration(cfg.VMTTLMinutes)*time.Minute,
-		cfg.VMDaemonDownloadURL,
-		joinCSV(cfg.KafkaBrokers),
-		cfg.VMDaemonKafkaTopic,
-	)
+	authClient := authclient.NewClient(cfg.AuthServiceURL, cfg.AuthServiceToken, 10*time.Second)
+	logger.Info().Str("auth_service_url", cfg.AuthServiceURL).Msg("auth client initialized")
+	billingClient := billing.NewClient(cfg.BillingServiceURL, cfg.BillingServiceToken, 10*time.Second)
+	logger.Info().Str("billing_service_url", cfg.BillingServiceURL).Msg("billing client initialized")
+	adminClient := adminclient.NewClient(cfg.AdminServiceURL, cfg.AdminServiceToken, 10*time.Second)
+	logger.Info().Str("admin_service_url", cfg.AdminServiceURL).Msg("admin client initialized")
+	svc := service.NewResourceService(repo, cgroups.NewV2Applier(cfg.CGroupRoot, cfg.CGroupSoftFail), service.Options{
+		Orchestrator:         orchestrator.NewInternalRuntime(),
+		Provisioning:         provisioningClient,
+		Users:                authClient,
+		Billing:              billingClient,
+		HeartbeatMaxAge:      cfg.HeartbeatMaxAge,
+		CreateRateLimitRPM:   cfg.CreateRateLimitRPM,
+		VMTTL:                time.Duration(cfg.VMTTLMinutes) * time.Minute,
+		VMDaemonDownloadURL:  cfg.VMDaemonDownloadURL,
+		VMDaemonKafkaBrokers: joinCSV(cfg.KafkaBrokers),
+		VMDaemonKafkaTopic:   cfg.VMDaemonKafkaTopic,
+		MetricRetention: service.MetricRetention{
+			Raw:    cfg.MetricRawRetention,
+			Minute: cfg.MetricMinuteRetention,
+			Hour:   cfg.MetricHourRetention,
+		},
+		AlertNotifiers: map[models.AlertChannelType]service.AlertNotifier{
+			models.AlertChannelWebhook: notify.NewWebhook(cfg.AlertWebhookTimeout),
+			models.AlertChannelEmail:   notify.NewEmailLog(),
+		},
+		Prober:   prober.NewNetwork(),
+		Presence: adminClient,
+		SLA: service.SLAPolicy{
+			Targets: map[string]models.SLATarget{
+				models.AvailabilityTierLow:    {TargetPct: cfg.SLATargetLowPct, CreditPct: cfg.SLACreditLowPct},
+				models.AvailabilityTierMedium: {TargetPct: cfg.SLATargetMediumPct, CreditPct: cfg.SLACreditMediumPct},
+				models.AvailabilityTierHigh:   {TargetPct: cfg.SLATargetHighPct, CreditPct: cfg.SLACreditHighPct},
+			},
+			ProviderTier: cfg.SLAProviderTier,
+		},
+		AgentAuth: service.AgentAuthPolicy{
+			Issuer:            agentauth.NewIssuer(cfg.JWTSecret),
+			CredentialTTL:     cfg.AgentCredentialTTL,
+			CredentialGrace:   cfg.AgentCredentialGrace,
+			EnrollmentTTL:     cfg.AgentEnrollmentTTL,
+			AllowStaticTokens: cfg.AgentStaticTokens,
+			Providers:         adminClient,
+		},
+		Verification: service.VerificationPolicy{
+			ChallengeInterval: cfg.ChallengeInterval,
+			MaxMemoryMB:       cfg.ChallengeMaxMemoryMB,
+		},
+		AgentUpdates: service.AgentUpdatePolicy{
+			ReleaseURL:    cfg.AgentReleaseURL,
+			HealthTimeout: cfg.AgentUpdateHealthTimeout,
+		},
+		Rollouts: service.RolloutPolicy{
+			Providers:      adminClient,
+			MaxConcurrency: cfg.RolloutMaxConcurrency,
+		},
+		Recordings: service.RecordingPolicy{
+			Retention: cfg.TerminalRecordingRetention,
+		},
+	})
 	logger.Info().Msg("resource service initialized")
 	go runExpiryWorker(logger, svc)
 	logger.Info().Msg("resource expiry worker started")
+	go runMetricCompactionWorker(logger, svc)
+	logger.Info().Msg("metric compaction worker started")
+	go runAlertWorker(logger, svc, cfg.AlertEvalInterval)
+	logger.Info().Dur("interval", cfg.AlertEvalInterval).Msg("alert evaluation worker started")
+	go runHealthProbeWorker(logger, svc)
+	logger.Info().Msg("health probe worker started")
+	go runPresenceWorker(logger, svc)
+	logger.Info().Msg("provider presence worker started")
+	go runSLAWorker(logger, svc)
+	logger.Info().Msg("sla evaluation worker started")
+	go runCapacityChallengeWorker(context.Background(), logger, svc)
+	logger.Info().Msg("capacity challenge worker started")
+	go runStreamRelayWorker(logger, svc)
+	logger.Info().Msg("stream relay worker started")
 	if len(cfg.KafkaBrokers) > 0 {
 		consumer := kafkaadapter.NewConsumer(cfg.KafkaBrokers, cfg.VMDaemonKafkaTopic, cfg.VMDaemonKafkaGroup, kafkaIngestHandler(svc))
 		go func() {
@@ -89,22 +157,57 @@ func main() {
 	r := chi.NewRouter()
 	r.Use(httpx.RequestLogger(logger))
 	r.Get("/healthz", handler.Health)
+	r.Post("/v1/resources/agent/enroll", handler.EnrollAgent)
+	// Host tokens only open the agent routes, and only while the host and
+	// credential they name are current; RequireAuth refuses them elsewhere.
+	r.Group(func(agent chi.Router) {
+		agent.Use(sdkauth.RequireAgentAuth(cfg.JWTSecret, handler.AuthorizeAgentClaims))
+		agent.Post("/v1/resources/heartbeat", handler.Heartbeat)
+		agent.Post("/v1/resources/agent-logs", handler.RecordAgentLog)
+		agent.Post("/v1/resources/agent/commands/poll", handler.PollAgentCommand)
+		agent.Get("/v1/resources/agent/channel", handler.AgentChannel)
+		agent.Post("/v1/resources/agent/credentials/rotate", handler.RotateAgentCredential)
+		agent.Post("/v1/resources/agent/commands/{commandID}/complete", handler.CompleteAgentCommand)
+		agent.Post("/v1/resources/agent/terminal/sessions/{sessionID}/output", handler.ReportTerminalOutput)
+		agent.Post("/v1/resources/agent/exec/{execID}/output", handler.ReportExecOutput)
+		agent.Post("/v1/resources/agent/files/{transferID}/chunks", handler.ReportFileChunk)
+		agent.Post("/v1/resources/root-input-logs", handler.RecordRootInputLog)
+		agent.Post("/v1/resources/agent/resource-logs", handler.RecordResourceLogs)
+	})
 	r.Route("/v1/resources", func(api chi.Router) {
 		api.Use(sdkauth.RequireAuth(cfg.JWTSecret))
-		api.Post("/heartbeat", handler.Heartbeat)
 		api.Post("/health-checks", handler.RecordHealthCheck)
 		api.Post("/metrics", handler.RecordMetric)
-		api.Post("/agent-logs", handler.RecordAgentLog)
-		api.Post("/agent/commands/poll", handler.PollAgentCommand)
-		api.Post("/agent/commands/{commandID}/complete", handler.CompleteAgentCommand)
-		api.Post("/agent/terminal/sessions/{sessionID}/output", handler.ReportTerminalOutput)
-		api.Post("/root-input-logs", handler.RecordRootInputLog)
+		api.Post("/agent/enrollments", handler.CreateAgentEnrollment)
+		api.Get("/agent/enrollments", handler.ListAgentEnrollments)
+		api.Get("/agent/hosts", handler.ListAgentHosts)
+		api.Post("/agent/hosts/{hostID}/revoke", handler.RevokeAgentHost)
+		api.Get("/hosts/{providerID}/verification", handler.GetHostVerification)
+		api.Get("/hosts/{providerID}/challenges", handler.ListCapacityChallenges)
+		api.Get("/exec/runs", handler.ListMyExecRuns)
+		api.Get("/exec/policies/{providerID}", handler.GetExecPolicy)
+		api.Get("/commands", handler.ListMyAgentCommands)
+		api.Post("/commands/{commandID}/cancel", handler.CancelAgentCommand)
 		api.Post("/terminal/sessions", handler.CreateTerminalSession)
+		api.Get("/terminal/sessions", handler.ListTerminalSessions)
 		api.Get("/terminal/sessions/{sessionID}", handler.GetTerminalSession)
 		api.Post("/terminal/sessions/{sessionID}/input", handler.WriteTerminalInput)
 		api.Get("/terminal/sessions/{sessionID}/output", handler.ListTerminalOutput)
+		api.Get("/terminal/sessions/{sessionID}/ws", handler.TerminalStream)
+		api.Get("/terminal/sessions/{sessionID}/recording", handler.TerminalRecording)
+		api.Get("/terminal/sessions/{sessionID}/recording/replay", handler.ReplayTerminalRecording)
 		api.Post("/terminal/sessions/{sessionID}/resize", handler.ResizeTerminalSession)
 		api.Post("/terminal/sessions/{sessionID}/close", handler.CloseTerminalSession)
+		api.Get("/terminal/sessions/{sessionID}/participants", handler.ListTerminalParticipants)
+		api.Post("/terminal/sessions/{sessionID}/participants", handler.InviteTerminalParticipant)
+		api.Delete("/terminal/sessions/{sessionID}/participants/{userID}", handler.RemoveTerminalParticipant)
+		api.Post("/files/transfers", handler.StartFileTransfer)
+		api.Get("/files/transfers", handler.ListFileTransfers)
+		api.Get("/files/transfers/{transferID}", handler.GetFileTransfer)
+		api.Put("/files/transfers/{transferID}/chunks", handler.WriteFileTransferChunk)
+		api.Get("/files/transfers/{transferID}/content", handler.ReadFileTransferContent)
+		api.Post("/files/transfers/{transferID}/resume", handler.ResumeFileTransfer)
+		api.Post("/files/transfers/{transferID}/cancel", handler.CancelFileTransfer)
 		api.Post("/allocate", handler.Allocate)
 		api.Post("/release/{allocationID}", handler.Release)
 		api.Get("/allocations", handler.List)
@@ -125,25 +228,86 @@ func main() {
 		api.Get("/shared/vms", handler.ListSharedVMs)
 		api.Post("/shared/pods", handler.SharePod)
 		api.Get("/shared/pods", handler.ListSharedPods)
+		api.Get("/shares/received", handler.ListReceivedShareGrants)
+		api.Post("/shares/{resourceType}/{resourceID}/grants", handler.GrantShare)
+		api.Get("/shares/{resourceType}/{resourceID}/grants", handler.ListShareGrants)
+		api.Get("/shares/{resourceType}/{resourceID}/audit", handler.ListShareAuditEvents)
+		api.Patch("/shares/{resourceType}/grants/{grantID}", handler.UpdateShareGrant)
+		api.Post("/shares/{resourceType}/grants/{grantID}/accept", handler.AcceptShareGrant)
+		api.Post("/shares/{resourceType}/grants/{grantID}/revoke", handler.RevokeShareGrant)
 		api.Post("/shared/offers", handler.UpsertSharedInventoryOffer)
 		api.Get("/shared/offers", handler.ListSharedInventoryOffers)
 		api.Post("/shared/offers/reserve", handler.ReserveSharedInventoryOffer)
+		api.Post("/shared/offers/{offerID}/bids", handler.PlaceOfferBid)
+		api.Get("/shared/offers/{offerID}/clearings", handler.ListAuctionClearings)
+		api.Get("/shared/bids", handler.ListOfferBids)
+		api.Post("/shared/bids/{bidID}/cancel", handler.CancelOfferBid)
+		api.Get("/shared/bookings", handler.ListOfferBookings)
+		api.Post("/shared/bookings/{bookingID}/confirm", handler.ConfirmOfferBooking)
+		api.Post("/shared/bookings/{bookingID}/cancel", handler.CancelOfferBooking)
 		api.Get("/health-checks", handler.ListHealthChecks)
+		api.Post("/health-probes", handler.CreateHealthProbe)
+		api.Get("/health-probes", handler.ListHealthProbes)
+		api.Delete("/health-probes/{probeID}", handler.DeleteHealthProbe)
+		api.Get("/stream", handler.Stream)
+		api.Get("/sla", handler.ListSLAReports)
+		api.Get("/sla/targets", handler.SLATargets)
+		api.Get("/sla/{resourceID}", handler.GetResourceSLAReport)
 		api.Get("/metrics", handler.ListMetrics)
 		api.Get("/metrics/summary", handler.MetricSummaries)
+		api.Post("/metrics/query", handler.QueryMetrics)
+		api.Post("/alerts/rules", handler.CreateAlertRule)
+		api.Get("/alerts/rules", handler.ListAlertRules)
+		api.Delete("/alerts/rules/{ruleID}", handler.DeleteAlertRule)
+		api.Get("/alerts", handler.ListAlerts)
+		api.Post("/alerts/silences", handler.CreateAlertSilence)
+		api.Get("/alerts/silences", handler.ListAlertSilences)
+		api.Post("/alerts/silences/{silenceID}/end", handler.EndAlertSilence)
 		api.Get("/agent-logs", handler.ListAgentLogs)
 		api.Get("/root-input-logs", handler.ListRootInputLogs)
+		api.Get("/logs/{resourceID}", handler.ListResourceLogs)
 		api.Post("/k8s/clusters", handler.CreateKubernetesCluster)
 		api.Get("/k8s/clusters", handler.ListKubernetesClusters)
 		api.Post("/k8s/clusters/{clusterID}/refresh", handler.RefreshKubernetesCluster)
 		api.Delete("/k8s/clusters/{clusterID}", handler.DeleteKubernetesCluster)
 		api.Group(func(admin chi.Router) {
 			admin.Use(sdkauth.RequireAnyRole("admin", "super-admin", "ops-admin"))
+			admin.Get("/hosts/verifications", handler.ListHostVerifications)
+			admin.Post("/hosts/{providerID}/challenges", handler.IssueCapacityChallenge)
 			admin.Get("/admin/allocations", handler.ListAll)
 			admin.Get("/admin/stats", handler.Stats)
 			admin.Get("/admin/runtime-inventory", handler.RuntimeInventory)
+			admin.Get("/admin/presence", handler.ListProviderPresence)
+			admin.Get("/admin/presence/{providerID}/events", handler.ListProviderPresenceEvents)
+			admin.Get("/admin/sla", handler.ListSLAReportsAdmin)
+			admin.Get("/admin/sla/providers/{providerID}", handler.GetProviderSLAReport)
 			admin.Post("/admin/agent/commands", handler.QueueAgentCommand)
 			admin.Get("/admin/agent/commands", handler.ListAgentCommands)
+			admin.Post("/admin/agent/updates", handler.RequestAgentUpdate)
+			admin.Get("/admin/agent/versions", handler.AgentVersions)
+			admin.Post("/admin/rollouts", handler.CreateRollout)
+			admin.Get("/admin/rollouts", handler.ListRollouts)
+			admin.Get("/admin/rollouts/{rolloutID}", handler.GetRollout)
+			admin.Post("/admin/rollouts/{rolloutID}/pause", handler.PauseRollout)
+			admin.Post("/admin/rollouts/{rolloutID}/resume", handler.ResumeRollout)
+			admin.Post("/admin/rollouts/{rolloutID}/cancel", handler.CancelRollout)
+			admin.Post("/admin/exec", handler.RunExec)
+			admin.Get("/admin/exec", handler.ListExecRuns)
+			admin.Get("/admin/exec/{execID}", handler.GetExecRun)
+			admin.Put("/admin/exec/policies/{providerID}", handler.UpdateExecPolicy)
+			admin.Post("/admin/files/transfers", handler.StartHostFileTransfer)
+			admin.Get("/admin/files/transfers", handler.ListFileTransfersAdmin)
+			admin.Get("/admin/terminal/sessions", handler.ListTerminalSessionsAdmin)
+			admin.Get("/admin/logs/{resourceID}", handler.ListResourceLogsAdmin)
+			admin.Get("/admin/bookings", handler.ListOfferBookingsAdmin)
+			admin.Post("/admin/bookings/{bookingID}/refund", handler.RefundOfferBooking)
+			admin.Post("/admin/alerts/rules", handler.CreateAlertRuleAdmin)
+			admin.Get("/admin/alerts/rules", handler.ListAlertRulesAdmin)
+			admin.Delete("/admin/alerts/rules/{ruleID}", handler.DeleteAlertRuleAdmin)
+			admin.Get("/admin/alerts", handler.ListAlertsAdmin)
+			admin.Post("/admin/alerts/silences", handler.CreateAlertSilenceAdmin)
+			admin.Get("/admin/alerts/silences", handler.ListAlertSilencesAdmin)
+			admin.Post("/admin/alerts/silences/{silenceID}/end", handler.EndAlertSilenceAdmin)
 		})
 	})
 
@@ -170,6 +334,93 @@ func runExpiryWorker(logger zerolog.Logger, svc *service.ResourceService) {
 	}
 }
 
+func runMetricCompactionWorker(logger zerolog.Logger, svc *service.ResourceService) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	logger.Debug().Dur("interval", time.Minute).Msg("metric compaction ticker initialized")
+	for {
+		if err := svc.CompactMetrics(context.Background(), time.Now().UTC()); err != nil {
+			logger.Error().Err(err).Msg("metric compaction pass failed")
+		}
+		<-ticker.C
+	}
+}
+
+func runAlertWorker(logger zerolog.Logger, svc *service.ResourceService, interval time.Duration) {
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := svc.EvaluateAlerts(context.Background(), time.Now().UTC()); err != nil {
+			logger.Error().Err(err).Msg("alert evaluation pass failed")
+		}
+		<-ticker.C
+	}
+}
+
+// runHealthProbeWorker ticks often enough for the shortest probe interval;
+// each probe is only run once its own next_run_at is due.
+func runHealthProbeWorker(logger zerolog.Logger, svc *service.ResourceService) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		if _, err := svc.RunHealthProbes(context.Background(), time.Now().UTC()); err != nil {
+			logger.Error().Err(err).Msg("health probe pass failed")
+		}
+		<-ticker.C
+	}
+}
+
+func runPresenceWorker(logger zerolog.Logger, svc *service.ResourceService) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := svc.EvaluatePresence(context.Background(), time.Now().UTC()); err != nil {
+			logger.Error().Err(err).Msg("provider presence pass failed")
+		}
+		<-ticker.C
+	}
+}
+
+func runSLAWorker(logger zerolog.Logger, svc *service.ResourceService) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := svc.EvaluateSLAs(context.Background(), time.Now().UTC()); err != nil {
+			logger.Error().Err(err).Msg("sla evaluation pass failed")
+		}
+		<-ticker.C
+	}
+}
+
+func runStreamRelayWorker(logger zerolog.Logger, svc *service.ResourceService) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if err := svc.RelayStreamEvents(context.Background(), time.Now().UTC()); err != nil {
+			logger.Error().Err(err).Msg("stream relay pass failed")
+		}
+		<-ticker.C
+	}
+}
+
+func runCapacityChallengeWorker(ctx context.Context, logger zerolog.Logger, svc *service.ResourceService) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := svc.IssueCapacityChallenges(ctx, time.Now().UTC()); err != nil {
+			logger.Error().Err(err).Msg("capacity challenge pass failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func runConsumerWithRetry(ctx context.Context, logger zerolog.Logger, name string, consumer *kafkaadapter.Consumer, brokers []string, topic string, group string) {
 	backoff := 2 * time.Second
 	const maxBackoff = 30 * time.Second
@@ -216,6 +467,8 @@ func kafkaIngestHandler(svc *service.ResourceService) func(context.Context, kafk
 			return handleAgentLogEvent(ctx, svc, event)
 		case "root_input_log":
 			return handleRootInputLogEvent(ctx, svc, event)
+		case "resource_log":
+			return handleResourceLogEvent(ctx, svc, event)
 		case "host_metric":
 			return handleHostMetricEvent(ctx, svc, event)
 		default:
@@ -240,6 +493,9 @@ func handleHostMetricEvent(ctx context.Context, svc *service.ResourceService, ev
 		GPUMemoryUsedMB:  event.GPUMemoryUsedMB,
 		NetworkMbps:      event.NetworkMbps,
 		HeartbeatAt:      event.HeartbeatAt,
+		AgentVersion:     event.AgentVersion,
+		Region:           event.Region,
+		Labels:           event.Labels,
 	}
 	if item.HeartbeatAt.IsZero() {
 		item.HeartbeatAt = time.Now().UTC()
@@ -275,6 +531,7 @@ func handleMetricEvent(ctx context.Context, svc *service.ResourceService, event
 		MetricType:   getString(event.Payload, "metric_type", "unknown"),
 		Value:        getFloat(event.Payload, "value", 0),
 		CapturedAt:   event.OccurredAt,
+		ProviderID:   event.ProviderID,
 	}
 	_, err := svc.RecordMetric(ctx, item)
 	return err
@@ -306,6 +563,24 @@ func handleRootInputLogEvent(ctx context.Context, svc *service.ResourceService,
 	return err
 }
 
+func handleResourceLogEvent(ctx context.Context, svc *service.ResourceService, event kafkaadapter.Event) error {
+	resourceID := event.ResourceID
+	if resourceID == "" {
+		resourceID = getString(event.Payload, "resource_id", event.ProviderID)
+	}
+	item := models.ResourceLog{
+		ResourceID: resourceID,
+		SourceType: getString(event.Payload, "source_type", ""),
+		Source:     getString(event.Payload, "source", ""),
+		Stream:     getString(event.Payload, "stream", ""),
+		Level:      models.ResourceLogLevel(getString(event.Payload, "level", "info")),
+		Message:    getString(event.Payload, "message", ""),
+		OccurredAt: event.OccurredAt,
+	}
+	_, err := svc.RecordResourceLogs(ctx, event.ProviderID, []models.ResourceLog{item})
+	return err
+}
+
 func getString(payload map[string]interface{}, key string, fallback string) string {
 	value, ok := payload[key]
 	if !ok {
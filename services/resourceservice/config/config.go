@@ -10,46 +10,102 @@ import (
 )
 
 type Config struct {
-	Port                     string
-	PostgresDSN              string
-	MidasWriterAddr          string
-	JWTSecret                string
-	CGroupRoot               string
-	CGroupSoftFail           bool
-	HeartbeatMaxAge          time.Duration
-	ProvisioningURL          string
-	ProvisioningServiceToken string
-	ProvisioningHTTPTimeout  time.Duration
-	CreateRateLimitRPM       int
-	VMTTLMinutes             int
-	VMDaemonDownloadURL      string
-	KafkaBrokers             []string
-	VMDaemonKafkaTopic       string
-	VMDaemonKafkaGroup       string
-	HostAgentKafkaTopic      string
-	HostAgentKafkaGroup      string
+	Port                       string
+	PostgresDSN                string
+	MidasWriterAddr            string
+	JWTSecret                  string
+	CGroupRoot                 string
+	CGroupSoftFail             bool
+	HeartbeatMaxAge            time.Duration
+	ProvisioningURL            string
+	ProvisioningServiceToken   string
+	ProvisioningHTTPTimeout    time.Duration
+	AuthServiceURL             string
+	AuthServiceToken           string
+	BillingServiceURL          string
+	BillingServiceToken        string
+	AdminServiceURL            string
+	AdminServiceToken          string
+	CreateRateLimitRPM         int
+	VMTTLMinutes               int
+	VMDaemonDownloadURL        string
+	KafkaBrokers               []string
+	VMDaemonKafkaTopic         string
+	VMDaemonKafkaGroup         string
+	HostAgentKafkaTopic        string
+	HostAgentKafkaGroup        string
+	MetricRawRetention         time.Duration
+	MetricMinuteRetention      time.Duration
+	MetricHourRetention        time.Duration
+	AlertEvalInterval          time.Duration
+	AlertWebhookTimeout        time.Duration
+	SLATargetLowPct            float64
+	SLATargetMediumPct         float64
+	SLATargetHighPct           float64
+	SLACreditLowPct            float64
+	SLACreditMediumPct         float64
+	SLACreditHighPct           float64
+	SLAProviderTier            string
+	AgentCredentialTTL         time.Duration
+	AgentCredentialGrace       time.Duration
+	AgentEnrollmentTTL         time.Duration
+	AgentStaticTokens          bool
+	ChallengeInterval          time.Duration
+	ChallengeMaxMemoryMB       int
+	AgentReleaseURL            string
+	AgentUpdateHealthTimeout   time.Duration
+	RolloutMaxConcurrency      int
+	TerminalRecordingRetention time.Duration
 }
 
 func Load() Config {
 	return Config{
-		Port:                     env("PORT", "8083"),
-		PostgresDSN:              postgresDSN(),
-		MidasWriterAddr:          os.Getenv("MIDAS_WRITER_ADDR"),
-		JWTSecret:                env("JWT_SECRET", "change-me-in-production"),
-		CGroupRoot:               env("CGROUP_ROOT", "/sys/fs/cgroup"),
-		CGroupSoftFail:           envBool("CGROUP_SOFT_FAIL", false),
-		HeartbeatMaxAge:          time.Duration(envInt("HEARTBEAT_MAX_AGE_SECONDS", 30)) * time.Second,
-		ProvisioningURL:          env("PROVISIONING_BASE_URL", "http://provisioningservice:8085"),
-		ProvisioningServiceToken: env("PROVISIONING_SERVICE_TOKEN", "change-me-in-production"),
-		ProvisioningHTTPTimeout:  time.Duration(envInt("PROVISIONING_HTTP_TIMEOUT_SECONDS", 25)) * time.Second,
-		CreateRateLimitRPM:       envInt("CREATE_RATE_LIMIT_RPM", 5),
-		VMTTLMinutes:             envInt("VM_TTL_MINUTES", 5),
-		VMDaemonDownloadURL:      env("VMDAEMON_DOWNLOAD_URL", "https://github.com/MidasWR/ShareMTC/releases/latest/download/sharemtc-vmdaemon"),
-		KafkaBrokers:             splitCSV(env("KAFKA_BROKERS", "")),
-		VMDaemonKafkaTopic:       env("VMDAEMON_KAFKA_TOPIC", "vmdaemon.events"),
-		VMDaemonKafkaGroup:       env("VMDAEMON_KAFKA_GROUP", "resourceservice-vmdaemon"),
-		HostAgentKafkaTopic:      env("HOSTAGENT_KAFKA_TOPIC", "host.metrics"),
-		HostAgentKafkaGroup:      env("HOSTAGENT_KAFKA_GROUP", "resourceservice-hostagent"),
+		Port:                       env("PORT", "8083"),
+		PostgresDSN:                postgresDSN(),
+		MidasWriterAddr:            os.Getenv("MIDAS_WRITER_ADDR"),
+		JWTSecret:                  env("JWT_SECRET", "change-me-in-production"),
+		CGroupRoot:                 env("CGROUP_ROOT", "/sys/fs/cgroup"),
+		CGroupSoftFail:             envBool("CGROUP_SOFT_FAIL", false),
+		HeartbeatMaxAge:            time.Duration(envInt("HEARTBEAT_MAX_AGE_SECONDS", 30)) * time.Second,
+		ProvisioningURL:            env("PROVISIONING_BASE_URL", "http://provisioningservice:8085"),
+		ProvisioningServiceToken:   env("PROVISIONING_SERVICE_TOKEN", "change-me-in-production"),
+		ProvisioningHTTPTimeout:    time.Duration(envInt("PROVISIONING_HTTP_TIMEOUT_SECONDS", 25)) * time.Second,
+		AuthServiceURL:             env("AUTH_SERVICE_URL", "http://authservice:8081"),
+		AuthServiceToken:           env("AUTH_SERVICE_TOKEN", "change-me-in-production"),
+		BillingServiceURL:          env("BILLING_SERVICE_URL", "http://billingservice:8084"),
+		BillingServiceToken:        env("BILLING_SERVICE_TOKEN", "change-me-in-production"),
+		AdminServiceURL:            env("ADMIN_SERVICE_URL", "http://adminservice:8082"),
+		AdminServiceToken:          env("ADMIN_SERVICE_TOKEN", "change-me-in-production"),
+		CreateRateLimitRPM:         envInt("CREATE_RATE_LIMIT_RPM", 5),
+		VMTTLMinutes:               envInt("VM_TTL_MINUTES", 5),
+		VMDaemonDownloadURL:        env("VMDAEMON_DOWNLOAD_URL", "https://github.com/MidasWR/ShareMTC/releases/latest/download/sharemtc-vmdaemon"),
+		KafkaBrokers:               splitCSV(env("KAFKA_BROKERS", "")),
+		VMDaemonKafkaTopic:         env("VMDAEMON_KAFKA_TOPIC", "vmdaemon.events"),
+		VMDaemonKafkaGroup:         env("VMDAEMON_KAFKA_GROUP", "resourceservice-vmdaemon"),
+		HostAgentKafkaTopic:        env("HOSTAGENT_KAFKA_TOPIC", "host.metrics"),
+		HostAgentKafkaGroup:        env("HOSTAGENT_KAFKA_GROUP", "resourceservice-hostagent"),
+		MetricRawRetention:         time.Duration(envInt("METRIC_RAW_RETENTION_HOURS", 24)) * time.Hour,
+		MetricMinuteRetention:      time.Duration(envInt("METRIC_MINUTE_RETENTION_DAYS", 7)) * 24 * time.Hour,
+		MetricHourRetention:        time.Duration(envInt("METRIC_HOUR_RETENTION_DAYS", 90)) * 24 * time.Hour,
+		AlertEvalInterval:          time.Duration(envInt("ALERT_EVAL_INTERVAL_SECONDS", 15)) * time.Second,
+		AlertWebhookTimeout:        time.Duration(envInt("ALERT_WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second,
+		SLATargetLowPct:            envFloat("SLA_TARGET_LOW_PCT", 99),
+		SLATargetMediumPct:         envFloat("SLA_TARGET_MEDIUM_PCT", 99.5),
+		SLATargetHighPct:           envFloat("SLA_TARGET_HIGH_PCT", 99.9),
+		SLACreditLowPct:            envFloat("SLA_CREDIT_LOW_PCT", 5),
+		SLACreditMediumPct:         envFloat("SLA_CREDIT_MEDIUM_PCT", 10),
+		SLACreditHighPct:           envFloat("SLA_CREDIT_HIGH_PCT", 25),
+		SLAProviderTier:            env("SLA_PROVIDER_TIER", "medium"),
+		AgentCredentialTTL:         time.Duration(envInt("AGENT_CREDENTIAL_TTL_HOURS", 168)) * time.Hour,
+		AgentCredentialGrace:       time.Duration(envInt("AGENT_CREDENTIAL_GRACE_MINUTES", 10)) * time.Minute,
+		AgentEnrollmentTTL:         time.Duration(envInt("AGENT_ENROLLMENT_TTL_MINUTES", 60)) * time.Minute,
+		AgentStaticTokens:          envBool("AGENT_STATIC_TOKENS", false),
+		ChallengeInterval:          time.Duration(envInt("CAPACITY_CHALLENGE_INTERVAL_MINUTES", 360)) * time.Minute,
+		ChallengeMaxMemoryMB:       envInt("CAPACITY_CHALLENGE_MAX_MEMORY_MB", 64),
+		AgentReleaseURL:            os.Getenv("AGENT_RELEASE_URL"),
+		AgentUpdateHealthTimeout:   time.Duration(envInt("AGENT_UPDATE_HEALTH_TIMEOUT_SECONDS", 120)) * time.Second,
+		RolloutMaxConcurrency:      envInt("ROLLOUT_MAX_CONCURRENCY", 100),
+		TerminalRecordingRetention: time.Duration(envInt("TERMINAL_RECORDING_RETENTION_DAYS", 90)) * 24 * time.Hour,
 	}
 }
 
@@ -73,6 +129,18 @@ func envInt(name string, fallback int) int {
 	return parsed
 }
 
+func envFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
 func envBool(name string, fallback bool) bool {
 	value := strings.TrimSpace(strings.ToLower(os.Getenv(name)))
 	if value == "" {
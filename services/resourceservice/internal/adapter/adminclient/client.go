@@ -0,0 +1,87 @@
+package adminclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+)
+
+type Client struct {
+	baseURL      string
+	serviceToken string
+	httpClient   *http.Client
+}
+
+func NewClient(baseURL string, serviceToken string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		serviceToken: strings.TrimSpace(serviceToken),
+		httpClient:   &http.Client{Timeout: timeout},
+	}
+}
+
+// PublishPresence pushes a provider presence change to adminservice. Pushing
+// the same change twice is harmless.
+func (c *Client) PublishPresence(ctx context.Context, presence models.ProviderPresence) error {
+	raw, err := json.Marshal(presence)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/v1/admin/internal/providers/"+url.PathEscape(presence.ProviderID)+"/presence", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Service-Token", c.serviceToken)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("adminservice %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// ProviderTypes maps every provider registered in adminservice to its type.
+func (c *Client) ProviderTypes(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/admin/internal/providers", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Service-Token", c.serviceToken)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("adminservice %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var providers []struct {
+		ID           string `json:"id"`
+		ProviderType string `json:"provider_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&providers); err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(providers))
+	for _, provider := range providers {
+		out[provider.ID] = provider.ProviderType
+	}
+	return out, nil
+}
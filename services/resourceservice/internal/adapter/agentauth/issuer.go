@@ -0,0 +1,21 @@
+package agentauth
+
+import (
+	"time"
+
+	sdkauth "github.com/MidasWR/ShareMTC/services/sdk/auth"
+)
+
+// Issuer signs per-host agent credentials with the same secret the API
+// verifies bearer tokens with.
+type Issuer struct {
+	secret string
+}
+
+func NewIssuer(secret string) *Issuer {
+	return &Issuer{secret: secret}
+}
+
+func (i *Issuer) Issue(providerID string, hostID string, credentialID string, ttl time.Duration) (string, error) {
+	return sdkauth.SignHost(i.secret, providerID, hostID, credentialID, ttl)
+}
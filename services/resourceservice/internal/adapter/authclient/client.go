@@ -0,0 +1,66 @@
+package authclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+type Client struct {
+	baseURL      string
+	serviceToken string
+	httpClient   *http.Client
+}
+
+func NewClient(baseURL string, serviceToken string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		serviceToken: strings.TrimSpace(serviceToken),
+		httpClient:   &http.Client{Timeout: timeout},
+	}
+}
+
+// LookupUserByEmail resolves an email to a user id through authservice.
+func (c *Client) LookupUserByEmail(ctx context.Context, email string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/auth/internal/users/lookup?email="+url.QueryEscape(email), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Service-Token", c.serviceToken)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrUserNotFound
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("authservice %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", err
+	}
+	if out.ID == "" {
+		return "", ErrUserNotFound
+	}
+	return out.ID, nil
+}
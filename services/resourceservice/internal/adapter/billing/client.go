@@ -0,0 +1,141 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type StartRentalRequest struct {
+	ReferenceID string  `json:"reference_id"`
+	UserID      string  `json:"user_id"`
+	ProviderID  string  `json:"provider_id"`
+	Description string  `json:"description"`
+	PriceHourly float64 `json:"price_hourly_usd"`
+}
+
+type Rental struct {
+	ID          string     `json:"id"`
+	ReferenceID string     `json:"reference_id"`
+	Status      string     `json:"status"`
+	PriceHourly float64    `json:"price_hourly_usd"`
+	StartedAt   time.Time  `json:"started_at"`
+	StoppedAt   *time.Time `json:"stopped_at,omitempty"`
+	ChargedUSD  float64    `json:"charged_usd"`
+	RefundedUSD float64    `json:"refunded_usd"`
+}
+
+type CreditRequest struct {
+	ReferenceID  string    `json:"reference_id"`
+	UserID       string    `json:"user_id"`
+	ProviderID   string    `json:"provider_id"`
+	ResourceType string    `json:"resource_type"`
+	ResourceID   string    `json:"resource_id"`
+	RentalID     string    `json:"rental_id,omitempty"`
+	PeriodStart  time.Time `json:"period_start"`
+	PeriodEnd    time.Time `json:"period_end"`
+	// ResourceEndedAt caps hourly charges of a terminated VM or pod.
+	ResourceEndedAt *time.Time `json:"resource_ended_at,omitempty"`
+	CreditPct       float64    `json:"credit_pct"`
+	Reason          string     `json:"reason"`
+}
+
+type Credit struct {
+	ID          string  `json:"id"`
+	ReferenceID string  `json:"reference_id"`
+	BasisUSD    float64 `json:"basis_usd"`
+	AmountUSD   float64 `json:"amount_usd"`
+}
+
+type Client struct {
+	baseURL      string
+	serviceToken string
+	httpClient   *http.Client
+}
+
+func NewClient(baseURL string, serviceToken string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		serviceToken: strings.TrimSpace(serviceToken),
+		httpClient:   &http.Client{Timeout: timeout},
+	}
+}
+
+// StartRental opens an hourly meter in billingservice. Retrying with the same
+// reference id returns the rental that is already running.
+func (c *Client) StartRental(ctx context.Context, req StartRentalRequest) (Rental, error) {
+	var out Rental
+	err := c.post(ctx, "/v1/billing/internal/rentals", req, &out)
+	return out, err
+}
+
+func (c *Client) StopRental(ctx context.Context, rentalID string) (Rental, error) {
+	var out Rental
+	err := c.post(ctx, "/v1/billing/internal/rentals/"+url.PathEscape(rentalID)+"/stop", nil, &out)
+	return out, err
+}
+
+// StopRentalByReference stops whatever rental was started for the reference,
+// for when the response of StartRental was lost. A reference that never
+// started a rental returns an empty rental.
+func (c *Client) StopRentalByReference(ctx context.Context, referenceID string) (Rental, error) {
+	var out Rental
+	err := c.post(ctx, "/v1/billing/internal/rentals/by-reference/"+url.PathEscape(referenceID)+"/stop", nil, &out)
+	return out, err
+}
+
+// RefundRental stops the rental and refunds amountUSD; zero refunds the whole
+// charge.
+func (c *Client) RefundRental(ctx context.Context, rentalID string, amountUSD float64) (Rental, error) {
+	var out Rental
+	err := c.post(ctx, "/v1/billing/internal/rentals/"+url.PathEscape(rentalID)+"/refund", map[string]float64{"amount_usd": amountUSD}, &out)
+	return out, err
+}
+
+// IssueCredit credits the user a share of what billingservice charged them for
+// the resource or rental during the period. The reference id makes retries
+// safe.
+func (c *Client) IssueCredit(ctx context.Context, req CreditRequest) (Credit, error) {
+	var out Credit
+	err := c.post(ctx, "/v1/billing/internal/credits", req, &out)
+	return out, err
+}
+
+func (c *Client) post(ctx context.Context, path string, payload any, out any) error {
+	var body io.Reader = http.NoBody
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Service-Token", c.serviceToken)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("billingservice %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return json.Unmarshal(respBody, out)
+}
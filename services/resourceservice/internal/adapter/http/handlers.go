@@ -1,9 +1,13 @@
 package httpadapter
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -11,8 +15,11 @@ import (
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/service"
 	sdkauth "github.com/MidasWR/ShareMTC/services/sdk/auth"
+	"github.com/MidasWR/ShareMTC/services/sdk/filetransfer"
 	"github.com/MidasWR/ShareMTC/services/sdk/httpx"
 	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
 )
 
 type Handler struct {
@@ -29,17 +36,27 @@ func (h *Handler) Heartbeat(w http.ResponseWriter, r *http.Request) {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
+	// The signature covers the exact bytes sent, so keep them.
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid body")
+		return
+	}
 	var req models.HostResource
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.Unmarshal(body, &req); err != nil {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := validateAgentIdentity(claims, req.ProviderID); err != nil {
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
 		httpx.Error(w, http.StatusForbidden, err.Error())
 		return
 	}
-	if err := h.svc.UpdateHeartbeat(r.Context(), req); err != nil {
-		httpx.Error(w, http.StatusInternalServerError, err.Error())
+	sig := service.HeartbeatSignature{Body: body, Signature: r.Header.Get("X-Agent-Signature")}
+	if claims.Role == sdkauth.RoleAgent {
+		sig.HostID = claims.Subject
+	}
+	if err := h.svc.RecordHeartbeat(r.Context(), req, sig); err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
 		return
 	}
 	httpx.JSON(w, http.StatusOK, map[string]string{"status": "updated"})
@@ -193,30 +210,45 @@ func (h *Handler) GetVM(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) StartVM(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
 	vmID := chi.URLParam(r, "vmID")
-	item, err := h.svc.StartVM(r.Context(), vmID)
+	item, err := h.svc.StartVM(r.Context(), claims.UserID, vmID)
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusOK, item)
 }
 
 func (h *Handler) StopVM(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
 	vmID := chi.URLParam(r, "vmID")
-	item, err := h.svc.StopVM(r.Context(), vmID)
+	item, err := h.svc.StopVM(r.Context(), claims.UserID, vmID)
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusOK, item)
 }
 
 func (h *Handler) RebootVM(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
 	vmID := chi.URLParam(r, "vmID")
-	item, err := h.svc.RebootVM(r.Context(), vmID)
+	item, err := h.svc.RebootVM(r.Context(), claims.UserID, vmID)
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusOK, item)
@@ -296,6 +328,20 @@ type shareRequest struct {
 	PodCode     string                   `json:"pod_code"`
 	SharedWith  []string                 `json:"shared_with"`
 	AccessLevel models.SharedAccessLevel `json:"access_level"`
+	ExpiresAt   string                   `json:"expires_at"`
+}
+
+type shareGrantRequest struct {
+	UserID      string                   `json:"user_id"`
+	Email       string                   `json:"email"`
+	AccessLevel models.SharedAccessLevel `json:"access_level"`
+	ExpiresAt   string                   `json:"expires_at"`
+}
+
+type shareGrantUpdateRequest struct {
+	AccessLevel models.SharedAccessLevel `json:"access_level"`
+	ExpiresAt   string                   `json:"expires_at"`
+	ClearExpiry bool                     `json:"clear_expiry"`
 }
 
 type sharedInventoryReserveRequest struct {
@@ -304,19 +350,28 @@ type sharedInventoryReserveRequest struct {
 }
 
 type sharedInventoryUpsertRequest struct {
-	ID           string  `json:"id"`
-	ProviderID   string  `json:"provider_id"`
-	ResourceType string  `json:"resource_type"`
-	Title        string  `json:"title"`
-	Description  string  `json:"description"`
-	CPUCores     int     `json:"cpu_cores"`
-	RAMMB        int     `json:"ram_mb"`
-	GPUUnits     int     `json:"gpu_units"`
-	NetworkMbps  int     `json:"network_mbps"`
-	Quantity     int     `json:"quantity"`
-	AvailableQty int     `json:"available_qty"`
-	PriceHourly  float64 `json:"price_hourly_usd"`
-	Status       string  `json:"status"`
+	ID                string  `json:"id"`
+	ProviderID        string  `json:"provider_id"`
+	ResourceType      string  `json:"resource_type"`
+	Title             string  `json:"title"`
+	Description       string  `json:"description"`
+	CPUCores          int     `json:"cpu_cores"`
+	RAMMB             int     `json:"ram_mb"`
+	GPUUnits          int     `json:"gpu_units"`
+	NetworkMbps       int     `json:"network_mbps"`
+	Quantity          int     `json:"quantity"`
+	AvailableQty      int     `json:"available_qty"`
+	PriceHourly       float64 `json:"price_hourly_usd"`
+	Status            string  `json:"status"`
+	PricingMode       string  `json:"pricing_mode"`
+	AuctionRule       string  `json:"auction_rule"`
+	ClearingPeriodMin int     `json:"clearing_period_minutes"`
+}
+
+type offerBidRequest struct {
+	Quantity       int     `json:"quantity"`
+	MaxPriceHourly float64 `json:"max_price_hourly_usd"`
+	DurationHours  int     `json:"duration_hours"`
 }
 
 type agentLogRequest struct {
@@ -337,9 +392,50 @@ type rootInputLogRequest struct {
 	ExecutedAt string `json:"executed_at"`
 }
 
+type resourceLogEntryRequest struct {
+	ResourceID string `json:"resource_id"`
+	SourceType string `json:"source_type"`
+	Source     string `json:"source"`
+	Stream     string `json:"stream"`
+	Level      string `json:"level"`
+	Message    string `json:"message"`
+	OccurredAt string `json:"occurred_at"`
+}
+
+type resourceLogBatchRequest struct {
+	ProviderID string                    `json:"provider_id"`
+	Entries    []resourceLogEntryRequest `json:"entries"`
+}
+
 type agentCommandRequest struct {
+	ProviderID     string `json:"provider_id"`
+	Command        string `json:"command"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	MaxAttempts    int    `json:"max_attempts"`
+}
+
+type agentCommandCancelRequest struct {
+	Reason string `json:"reason"`
+}
+
+type agentEnrollmentRequest struct {
 	ProviderID string `json:"provider_id"`
-	Command    string `json:"command"`
+	Label      string `json:"label"`
+}
+
+type agentEnrollRequest struct {
+	Token     string `json:"token"`
+	Hostname  string `json:"hostname"`
+	Label     string `json:"label"`
+	PublicKey string `json:"public_key"`
+}
+
+type agentRotateRequest struct {
+	PublicKey string `json:"public_key"`
+}
+
+type capacityChallengeRequest struct {
+	Kind string `json:"kind"`
 }
 
 type agentCommandPollRequest struct {
@@ -367,11 +463,66 @@ type terminalResizeRequest struct {
 	Cols int `json:"cols"`
 }
 
+type terminalParticipantRequest struct {
+	UserID string                         `json:"user_id"`
+	Role   models.TerminalParticipantRole `json:"role"`
+}
+
 type terminalOutputReportRequest struct {
 	ProviderID string `json:"provider_id"`
 	Data       string `json:"data"`
 }
 
+type execOutputReportRequest struct {
+	ProviderID string `json:"provider_id"`
+	Stream     string `json:"stream"`
+	Data       string `json:"data"`
+}
+
+type fileChunkReportRequest struct {
+	ProviderID string `json:"provider_id"`
+	Offset     int64  `json:"offset"`
+	Data       []byte `json:"data"`
+}
+
+type fileTransferRequest struct {
+	ResourceID string `json:"resource_id"`
+	ProviderID string `json:"provider_id"`
+	Direction  string `json:"direction"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+type execRequest struct {
+	ProviderID     string            `json:"provider_id"`
+	Script         string            `json:"script"`
+	Argv           []string          `json:"argv"`
+	WorkDir        string            `json:"work_dir"`
+	Env            map[string]string `json:"env"`
+	TimeoutSeconds int               `json:"timeout_seconds"`
+	Reason         string            `json:"reason"`
+}
+
+type agentUpdateRequest struct {
+	ProviderID           string `json:"provider_id"`
+	Version              string `json:"version"`
+	HealthTimeoutSeconds int    `json:"health_timeout_seconds"`
+}
+
+type rolloutRequest struct {
+	Command              string                 `json:"command"`
+	Version              string                 `json:"version"`
+	HealthTimeoutSeconds int                    `json:"health_timeout_seconds"`
+	Selector             models.RolloutSelector `json:"selector"`
+	Waves                []int                  `json:"waves"`
+	MaxConcurrency       int                    `json:"max_concurrency"`
+	MaxFailurePct        *int                   `json:"max_failure_pct"`
+	PauseBetweenWaves    bool                   `json:"pause_between_waves"`
+	TimeoutSeconds       int                    `json:"timeout_seconds"`
+	MaxAttempts          int                    `json:"max_attempts"`
+}
+
 func (h *Handler) ShareVM(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
@@ -388,6 +539,7 @@ func (h *Handler) ShareVM(w http.ResponseWriter, r *http.Request) {
 		OwnerUserID: claims.UserID,
 		SharedWith:  req.SharedWith,
 		AccessLevel: req.AccessLevel,
+		ExpiresAt:   optionalTime(req.ExpiresAt),
 	})
 	if err != nil {
 		httpx.Error(w, http.StatusBadRequest, err.Error())
@@ -426,6 +578,7 @@ func (h *Handler) SharePod(w http.ResponseWriter, r *http.Request) {
 		OwnerUserID: claims.UserID,
 		SharedWith:  req.SharedWith,
 		AccessLevel: req.AccessLevel,
+		ExpiresAt:   optionalTime(req.ExpiresAt),
 	})
 	if err != nil {
 		httpx.Error(w, http.StatusBadRequest, err.Error())
@@ -448,161 +601,165 @@ func (h *Handler) ListSharedPods(w http.ResponseWriter, r *http.Request) {
 	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) UpsertSharedInventoryOffer(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GrantShare(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	var req sharedInventoryUpsertRequest
+	var req shareGrantRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	item, err := h.svc.UpsertSharedInventoryOffer(r.Context(), models.SharedInventoryOffer{
-		ID:           req.ID,
-		ProviderID:   req.ProviderID,
-		ResourceType: req.ResourceType,
-		Title:        req.Title,
-		Description:  req.Description,
-		CPUCores:     req.CPUCores,
-		RAMMB:        req.RAMMB,
-		GPUUnits:     req.GPUUnits,
-		NetworkMbps:  req.NetworkMbps,
-		Quantity:     req.Quantity,
-		AvailableQty: req.AvailableQty,
-		PriceHourly:  req.PriceHourly,
-		Status:       models.SharedInventoryStatus(req.Status),
-		CreatedBy:    claims.UserID,
+	item, err := h.svc.GrantShare(r.Context(), claims.UserID, models.ShareGrant{
+		ResourceType:  chi.URLParam(r, "resourceType"),
+		ResourceID:    chi.URLParam(r, "resourceID"),
+		GranteeUserID: req.UserID,
+		InviteEmail:   req.Email,
+		AccessLevel:   req.AccessLevel,
+		ExpiresAt:     optionalTime(req.ExpiresAt),
 	})
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusCreated, item)
 }
 
-func (h *Handler) ListSharedInventoryOffers(w http.ResponseWriter, r *http.Request) {
-	status := strings.TrimSpace(r.URL.Query().Get("status"))
-	providerID := strings.TrimSpace(r.URL.Query().Get("provider_id"))
-	items, err := h.svc.ListSharedInventoryOffers(r.Context(), status, providerID)
+func (h *Handler) ListShareGrants(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListShareGrants(r.Context(), claims.UserID, chi.URLParam(r, "resourceType"), chi.URLParam(r, "resourceID"))
 	if err != nil {
-		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) ReserveSharedInventoryOffer(w http.ResponseWriter, r *http.Request) {
-	var req sharedInventoryReserveRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		httpx.Error(w, http.StatusBadRequest, "invalid json")
+func (h *Handler) ListReceivedShareGrants(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	item, err := h.svc.ReserveSharedInventoryOffer(r.Context(), req.OfferID, req.Quantity)
+	items, err := h.svc.ListReceivedShareGrants(r.Context(), claims.UserID)
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	httpx.JSON(w, http.StatusOK, item)
+	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) RecordHealthCheck(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) UpdateShareGrant(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	var req models.HealthCheck
+	var req shareGrantUpdateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	item, err := h.svc.RecordHealthCheck(r.Context(), req)
+	item, err := h.svc.UpdateShareGrant(r.Context(), claims.UserID, chi.URLParam(r, "resourceType"), chi.URLParam(r, "grantID"), models.ShareGrantUpdate{
+		AccessLevel: req.AccessLevel,
+		ExpiresAt:   optionalTime(req.ExpiresAt),
+		ClearExpiry: req.ClearExpiry,
+	})
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
-	httpx.JSON(w, http.StatusCreated, item)
+	httpx.JSON(w, http.StatusOK, item)
 }
 
-func (h *Handler) ListHealthChecks(w http.ResponseWriter, r *http.Request) {
-	resourceType := r.URL.Query().Get("resource_type")
-	resourceID := r.URL.Query().Get("resource_id")
-	limit := intQuery(r, "limit", 100)
-	items, err := h.svc.ListHealthChecks(r.Context(), resourceType, resourceID, limit)
+func (h *Handler) AcceptShareGrant(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	item, err := h.svc.AcceptShareGrant(r.Context(), claims.UserID, chi.URLParam(r, "resourceType"), chi.URLParam(r, "grantID"))
 	if err != nil {
-		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		writeShareError(w, err)
 		return
 	}
-	httpx.JSON(w, http.StatusOK, items)
+	httpx.JSON(w, http.StatusOK, item)
 }
 
-func (h *Handler) RecordMetric(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) RevokeShareGrant(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	var req models.MetricPoint
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		httpx.Error(w, http.StatusBadRequest, "invalid json")
-		return
-	}
-	item, err := h.svc.RecordMetric(r.Context(), req)
+	item, err := h.svc.RevokeShareGrant(r.Context(), claims.UserID, chi.URLParam(r, "resourceType"), chi.URLParam(r, "grantID"))
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
-	httpx.JSON(w, http.StatusCreated, item)
+	httpx.JSON(w, http.StatusOK, item)
 }
 
-func (h *Handler) ListMetrics(w http.ResponseWriter, r *http.Request) {
-	resourceType := r.URL.Query().Get("resource_type")
-	resourceID := r.URL.Query().Get("resource_id")
-	metricType := r.URL.Query().Get("metric_type")
-	limit := intQuery(r, "limit", 500)
-	from := parseTimeQuery(r.URL.Query().Get("from"))
-	to := parseTimeQuery(r.URL.Query().Get("to"))
-	items, err := h.svc.ListMetrics(r.Context(), resourceType, resourceID, metricType, from, to, limit)
+func (h *Handler) ListShareAuditEvents(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListShareAuditEvents(r.Context(), claims.UserID, chi.URLParam(r, "resourceType"), chi.URLParam(r, "resourceID"), intQuery(r, "limit", 100))
 	if err != nil {
-		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) MetricSummaries(w http.ResponseWriter, r *http.Request) {
-	limit := intQuery(r, "limit", 100)
-	items, err := h.svc.MetricSummaries(r.Context(), limit)
-	if err != nil {
-		httpx.Error(w, http.StatusInternalServerError, err.Error())
-		return
+func writeShareError(w http.ResponseWriter, err error) {
+	switch {
+	case strings.HasPrefix(err.Error(), "forbidden"):
+		httpx.Error(w, http.StatusForbidden, err.Error())
+	case strings.HasSuffix(err.Error(), "not found"):
+		httpx.Error(w, http.StatusNotFound, err.Error())
+	default:
+		httpx.Error(w, http.StatusBadRequest, err.Error())
 	}
-	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) RecordAgentLog(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) UpsertSharedInventoryOffer(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	var req agentLogRequest
+	var req sharedInventoryUpsertRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := validateAgentIdentity(claims, req.ProviderID); err != nil {
-		httpx.Error(w, http.StatusForbidden, err.Error())
-		return
-	}
-	item, err := h.svc.RecordAgentLog(r.Context(), models.AgentLog{
-		ProviderID: req.ProviderID,
-		ResourceID: req.ResourceID,
-		Level:      models.AgentLogLevel(req.Level),
-		Message:    req.Message,
-		Source:     req.Source,
+	item, err := h.svc.UpsertSharedInventoryOffer(r.Context(), models.SharedInventoryOffer{
+		ID:                req.ID,
+		ProviderID:        req.ProviderID,
+		ResourceType:      req.ResourceType,
+		Title:             req.Title,
+		Description:       req.Description,
+		CPUCores:          req.CPUCores,
+		RAMMB:             req.RAMMB,
+		GPUUnits:          req.GPUUnits,
+		NetworkMbps:       req.NetworkMbps,
+		Quantity:          req.Quantity,
+		AvailableQty:      req.AvailableQty,
+		PriceHourly:       req.PriceHourly,
+		Status:            models.SharedInventoryStatus(req.Status),
+		PricingMode:       models.OfferPricingMode(req.PricingMode),
+		AuctionRule:       models.AuctionRule(req.AuctionRule),
+		ClearingPeriodMin: req.ClearingPeriodMin,
+		CreatedBy:         claims.UserID,
 	})
 	if err != nil {
 		httpx.Error(w, http.StatusBadRequest, err.Error())
@@ -611,12 +768,10 @@ func (h *Handler) RecordAgentLog(w http.ResponseWriter, r *http.Request) {
 	httpx.JSON(w, http.StatusCreated, item)
 }
 
-func (h *Handler) ListAgentLogs(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) ListSharedInventoryOffers(w http.ResponseWriter, r *http.Request) {
+	status := strings.TrimSpace(r.URL.Query().Get("status"))
 	providerID := strings.TrimSpace(r.URL.Query().Get("provider_id"))
-	resourceID := strings.TrimSpace(r.URL.Query().Get("resource_id"))
-	level := strings.TrimSpace(r.URL.Query().Get("level"))
-	limit := intQuery(r, "limit", 200)
-	items, err := h.svc.ListAgentLogs(r.Context(), providerID, resourceID, level, limit)
+	items, err := h.svc.ListSharedInventoryOffers(r.Context(), status, providerID)
 	if err != nil {
 		httpx.Error(w, http.StatusInternalServerError, err.Error())
 		return
@@ -624,22 +779,18 @@ func (h *Handler) ListAgentLogs(w http.ResponseWriter, r *http.Request) {
 	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) QueueAgentCommand(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) ReserveSharedInventoryOffer(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	var req agentCommandRequest
+	var req sharedInventoryReserveRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	item, err := h.svc.QueueAgentCommand(r.Context(), models.AgentCommand{
-		ProviderID:  strings.TrimSpace(req.ProviderID),
-		Command:     models.AgentCommandAction(strings.TrimSpace(req.Command)),
-		RequestedBy: claims.UserID,
-	})
+	item, err := h.svc.ReserveSharedInventoryOffer(r.Context(), claims.UserID, req.OfferID, req.Quantity)
 	if err != nil {
 		httpx.Error(w, http.StatusBadRequest, err.Error())
 		return
@@ -647,10 +798,13 @@ func (h *Handler) QueueAgentCommand(w http.ResponseWriter, r *http.Request) {
 	httpx.JSON(w, http.StatusCreated, item)
 }
 
-func (h *Handler) ListAgentCommands(w http.ResponseWriter, r *http.Request) {
-	providerID := strings.TrimSpace(r.URL.Query().Get("provider_id"))
-	limit := intQuery(r, "limit", 100)
-	items, err := h.svc.ListAgentCommands(r.Context(), providerID, limit)
+func (h *Handler) ListOfferBookings(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListOfferBookings(r.Context(), claims.UserID, strings.TrimSpace(r.URL.Query().Get("status")))
 	if err != nil {
 		httpx.Error(w, http.StatusInternalServerError, err.Error())
 		return
@@ -658,143 +812,1537 @@ func (h *Handler) ListAgentCommands(w http.ResponseWriter, r *http.Request) {
 	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) PollAgentCommand(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) ConfirmOfferBooking(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	var req agentCommandPollRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		httpx.Error(w, http.StatusBadRequest, "invalid json")
-		return
-	}
-	if err := validateAgentIdentity(claims, req.ProviderID); err != nil {
-		httpx.Error(w, http.StatusForbidden, err.Error())
-		return
-	}
-	item, err := h.svc.ClaimNextAgentCommand(r.Context(), strings.TrimSpace(req.ProviderID))
+	item, err := h.svc.ConfirmOfferBooking(r.Context(), claims.UserID, chi.URLParam(r, "bookingID"))
 	if err != nil {
-		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusOK, item)
 }
 
-func (h *Handler) CompleteAgentCommand(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) CancelOfferBooking(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	commandID := chi.URLParam(r, "commandID")
-	var req agentCommandCompleteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		httpx.Error(w, http.StatusBadRequest, "invalid json")
+	item, err := h.svc.CancelOfferBooking(r.Context(), claims.UserID, chi.URLParam(r, "bookingID"))
+	if err != nil {
+		writeShareError(w, err)
 		return
 	}
-	if err := validateAgentIdentity(claims, req.ProviderID); err != nil {
-		httpx.Error(w, http.StatusForbidden, err.Error())
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) ListOfferBookingsAdmin(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListOfferBookingsAdmin(r.Context(), strings.TrimSpace(r.URL.Query().Get("status")))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	item, err := h.svc.CompleteAgentCommand(
-		r.Context(),
-		commandID,
-		strings.TrimSpace(req.ProviderID),
-		models.AgentCommandState(strings.TrimSpace(req.Status)),
-		strings.TrimSpace(req.ResultMessage),
-	)
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+type offerBookingRefundRequest struct {
+	AmountUSD float64 `json:"amount_usd"`
+}
+
+func (h *Handler) RefundOfferBooking(w http.ResponseWriter, r *http.Request) {
+	var req offerBookingRefundRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.Error(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	item, err := h.svc.RefundOfferBooking(r.Context(), chi.URLParam(r, "bookingID"), req.AmountUSD)
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusOK, item)
 }
 
-func (h *Handler) CreateTerminalSession(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) PlaceOfferBid(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	var req createTerminalSessionRequest
+	var req offerBidRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	item, err := h.svc.CreateTerminalSession(r.Context(), claims.UserID, strings.TrimSpace(req.ResourceID), req.Rows, req.Cols)
+	item, err := h.svc.PlaceOfferBid(r.Context(), claims.UserID, chi.URLParam(r, "offerID"), req.Quantity, req.MaxPriceHourly, req.DurationHours)
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
 	httpx.JSON(w, http.StatusCreated, item)
 }
 
-func (h *Handler) GetTerminalSession(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) ListOfferBids(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	sessionID := chi.URLParam(r, "sessionID")
-	item, err := h.svc.GetTerminalSession(r.Context(), claims.UserID, sessionID)
+	items, err := h.svc.ListOfferBids(r.Context(), claims.UserID, strings.TrimSpace(r.URL.Query().Get("offer_id")), strings.TrimSpace(r.URL.Query().Get("status")))
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	httpx.JSON(w, http.StatusOK, item)
+	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) WriteTerminalInput(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) CancelOfferBid(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	sessionID := chi.URLParam(r, "sessionID")
-	var req terminalInputRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		httpx.Error(w, http.StatusBadRequest, "invalid json")
+	item, err := h.svc.CancelOfferBid(r.Context(), claims.UserID, chi.URLParam(r, "bidID"))
+	if err != nil {
+		writeShareError(w, err)
 		return
 	}
-	item, err := h.svc.WriteTerminalInput(r.Context(), claims.UserID, sessionID, req.Data)
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) ListAuctionClearings(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListAuctionClearings(r.Context(), chi.URLParam(r, "offerID"))
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
+		writeShareError(w, err)
 		return
 	}
-	httpx.JSON(w, http.StatusCreated, item)
+	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) ListTerminalOutput(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) RecordHealthCheck(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	sessionID := chi.URLParam(r, "sessionID")
-	afterSeq := int64(intQuery(r, "after_seq", 0))
-	limit := intQuery(r, "limit", 200)
-	items, err := h.svc.ListTerminalOutput(r.Context(), claims.UserID, sessionID, afterSeq, limit)
-	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, err.Error())
-		return
+	var req models.HealthCheck
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.RecordHealthCheck(r.Context(), req)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListHealthChecks(w http.ResponseWriter, r *http.Request) {
+	resourceType := r.URL.Query().Get("resource_type")
+	resourceID := r.URL.Query().Get("resource_id")
+	limit := intQuery(r, "limit", 100)
+	items, err := h.svc.ListHealthChecks(r.Context(), resourceType, resourceID, limit)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListProviderPresence(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListProviderPresence(r.Context(), r.URL.Query().Get("state"))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListProviderPresenceEvents(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListProviderPresenceEvents(r.Context(), chi.URLParam(r, "providerID"), intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) SLATargets(w http.ResponseWriter, r *http.Request) {
+	httpx.JSON(w, http.StatusOK, h.svc.SLATargets())
+}
+
+func (h *Handler) ListSLAReports(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListSLAReports(r.Context(), claims.UserID, r.URL.Query().Get("period"))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) GetResourceSLAReport(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	item, err := h.svc.ResourceSLAReport(r.Context(), claims.UserID, chi.URLParam(r, "resourceID"), r.URL.Query().Get("period"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) ListSLAReportsAdmin(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	items, err := h.svc.AdminListSLAReports(r.Context(), models.SLAReportFilter{
+		Period:       query.Get("period"),
+		ResourceType: query.Get("resource_type"),
+		UserID:       query.Get("user_id"),
+		ProviderID:   query.Get("provider_id"),
+		MissedOnly:   query.Get("missed") == "true",
+		CreditStatus: models.SLACreditStatus(query.Get("credit_status")),
+		Limit:        intQuery(r, "limit", 200),
+	})
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) GetProviderSLAReport(w http.ResponseWriter, r *http.Request) {
+	item, err := h.svc.ProviderSLAReport(r.Context(), chi.URLParam(r, "providerID"), r.URL.Query().Get("period"))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+// streamKeepalive also paces the ownership re-check of open streams, which
+// happens every streamRecheckTicks keepalives.
+const (
+	streamKeepalive    = 15 * time.Second
+	streamRecheckTicks = 4
+)
+
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	query := r.URL.Query()
+	sub := models.StreamSubscription{ResourceIDs: query["resource_id"], ProviderIDs: query["provider_id"]}
+	for _, raw := range strings.Split(query.Get("types"), ",") {
+		if raw = strings.TrimSpace(raw); raw != "" {
+			sub.Types = append(sub.Types, models.StreamEventType(raw))
+		}
+	}
+	admin := isAdminRole(claims.Role)
+	sub, err := h.svc.AuthorizeStream(r.Context(), claims.UserID, admin, sub)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	events, cancel := h.svc.SubscribeStream(sub)
+	defer cancel()
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, ": connected\n\n"); err != nil || rc.Flush() != nil {
+		return
+	}
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	ticks := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			ticks++
+			if ticks%streamRecheckTicks == 0 {
+				if _, err := h.svc.AuthorizeStream(r.Context(), claims.UserID, admin, sub); err != nil {
+					writeStreamEvent(w, "revoked", map[string]string{"error": err.Error()})
+					_ = rc.Flush()
+					return
+				}
+			}
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				writeStreamEvent(w, "reset", map[string]string{"reason": "stream fell behind; reload and reconnect"})
+				_ = rc.Flush()
+				return
+			}
+			if err := writeStreamEvent(w, string(event.Type), event); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeStreamEvent(w io.Writer, name string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
+
+func isAdminRole(role string) bool {
+	switch role {
+	case "admin", "super-admin", "ops-admin":
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *Handler) CreateHealthProbe(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req models.HealthProbe
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.CreateHealthProbe(r.Context(), claims.UserID, req.ResourceID, req)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListHealthProbes(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListHealthProbes(r.Context(), claims.UserID, r.URL.Query().Get("resource_id"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) DeleteHealthProbe(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if err := h.svc.DeleteHealthProbe(r.Context(), claims.UserID, chi.URLParam(r, "probeID")); err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *Handler) RecordMetric(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req models.MetricPoint
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.RecordMetric(r.Context(), req)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListMetrics(w http.ResponseWriter, r *http.Request) {
+	filter := models.MetricFilter{
+		ResourceType: r.URL.Query().Get("resource_type"),
+		ResourceID:   r.URL.Query().Get("resource_id"),
+		MetricType:   r.URL.Query().Get("metric_type"),
+		ProviderID:   strings.TrimSpace(r.URL.Query().Get("provider_id")),
+	}
+	limit := intQuery(r, "limit", 500)
+	from := parseTimeQuery(r.URL.Query().Get("from"))
+	to := parseTimeQuery(r.URL.Query().Get("to"))
+	resolution := strings.TrimSpace(r.URL.Query().Get("resolution"))
+	items, err := h.svc.ListMetrics(r.Context(), filter, resolution, from, to, limit)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) QueryMetrics(w http.ResponseWriter, r *http.Request) {
+	var req models.MetricQuery
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	result, err := h.svc.QueryMetrics(r.Context(), req)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) MetricSummaries(w http.ResponseWriter, r *http.Request) {
+	limit := intQuery(r, "limit", 100)
+	items, err := h.svc.MetricSummaries(r.Context(), limit)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	h.createAlertRule(w, r, h.svc.CreateAlertRule)
+}
+
+func (h *Handler) CreateAlertRuleAdmin(w http.ResponseWriter, r *http.Request) {
+	h.createAlertRule(w, r, h.svc.CreateAlertRuleAdmin)
+}
+
+func (h *Handler) createAlertRule(w http.ResponseWriter, r *http.Request, create func(context.Context, string, models.AlertRule) (models.AlertRule, error)) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req models.AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := create(r.Context(), claims.UserID, req)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListAlertRules(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListAlertRules(r.Context(), claims.UserID)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListAlertRulesAdmin(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListAlertRulesAdmin(r.Context())
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if err := h.svc.DeleteAlertRule(r.Context(), claims.UserID, chi.URLParam(r, "ruleID")); err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *Handler) DeleteAlertRuleAdmin(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.DeleteAlertRuleAdmin(r.Context(), chi.URLParam(r, "ruleID")); err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *Handler) ListAlerts(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListAlerts(r.Context(), claims.UserID, strings.TrimSpace(r.URL.Query().Get("state")), intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListAlertsAdmin(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListAlertsAdmin(r.Context(), strings.TrimSpace(r.URL.Query().Get("state")), intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) CreateAlertSilence(w http.ResponseWriter, r *http.Request) {
+	h.createAlertSilence(w, r, h.svc.CreateAlertSilence)
+}
+
+func (h *Handler) CreateAlertSilenceAdmin(w http.ResponseWriter, r *http.Request) {
+	h.createAlertSilence(w, r, h.svc.CreateAlertSilenceAdmin)
+}
+
+func (h *Handler) createAlertSilence(w http.ResponseWriter, r *http.Request, create func(context.Context, string, models.AlertSilence) (models.AlertSilence, error)) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req models.AlertSilence
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := create(r.Context(), claims.UserID, req)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListAlertSilences(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListAlertSilences(r.Context(), claims.UserID)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListAlertSilencesAdmin(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListAlertSilencesAdmin(r.Context())
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) EndAlertSilence(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	item, err := h.svc.EndAlertSilence(r.Context(), claims.UserID, chi.URLParam(r, "silenceID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) EndAlertSilenceAdmin(w http.ResponseWriter, r *http.Request) {
+	item, err := h.svc.EndAlertSilenceAdmin(r.Context(), chi.URLParam(r, "silenceID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) RecordAgentLog(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req agentLogRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
+		return
+	}
+	item, err := h.svc.RecordAgentLog(r.Context(), models.AgentLog{
+		ProviderID: req.ProviderID,
+		ResourceID: req.ResourceID,
+		Level:      models.AgentLogLevel(req.Level),
+		Message:    req.Message,
+		Source:     req.Source,
+	})
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListAgentLogs(w http.ResponseWriter, r *http.Request) {
+	providerID := strings.TrimSpace(r.URL.Query().Get("provider_id"))
+	resourceID := strings.TrimSpace(r.URL.Query().Get("resource_id"))
+	level := strings.TrimSpace(r.URL.Query().Get("level"))
+	limit := intQuery(r, "limit", 200)
+	items, err := h.svc.ListAgentLogs(r.Context(), providerID, resourceID, level, limit)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) QueueAgentCommand(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req agentCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.QueueAgentCommand(r.Context(), models.AgentCommand{
+		ProviderID:     strings.TrimSpace(req.ProviderID),
+		Command:        models.AgentCommandAction(strings.TrimSpace(req.Command)),
+		RequestedBy:    claims.UserID,
+		TimeoutSeconds: req.TimeoutSeconds,
+		MaxAttempts:    req.MaxAttempts,
+	})
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListAgentCommands(w http.ResponseWriter, r *http.Request) {
+	providerID := strings.TrimSpace(r.URL.Query().Get("provider_id"))
+	limit := intQuery(r, "limit", 100)
+	items, err := h.svc.ListAgentCommands(r.Context(), providerID, limit)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListMyAgentCommands(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListRequestedAgentCommands(r.Context(), claims.UserID, intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) CancelAgentCommand(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req agentCommandCancelRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.Error(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	item, err := h.svc.CancelAgentCommand(r.Context(), claims.UserID, isAdminRole(claims.Role), chi.URLParam(r, "commandID"), req.Reason)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) CreateAgentEnrollment(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if claims.Role == sdkauth.RoleAgent {
+		httpx.Error(w, http.StatusForbidden, "agents cannot enroll hosts")
+		return
+	}
+	var req agentEnrollmentRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.Error(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	item, err := h.svc.CreateAgentEnrollment(r.Context(), claims.UserID, isAdminRole(claims.Role), req.ProviderID, req.Label)
+	if err != nil {
+		writeAgentHostError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListAgentEnrollments(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListAgentEnrollments(r.Context(), agentOwnerScope(r, claims), intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+// EnrollAgent is unauthenticated: the one-time enrollment token is the
+// credential.
+func (h *Handler) EnrollAgent(w http.ResponseWriter, r *http.Request) {
+	var req agentEnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.EnrollAgent(r.Context(), req.Token, req.Hostname, req.Label, req.PublicKey)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if strings.HasPrefix(err.Error(), "enrollment token") {
+			status = http.StatusUnauthorized
+		}
+		httpx.Error(w, status, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) RotateAgentCredential(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil || claims.Role != sdkauth.RoleAgent {
+		httpx.Error(w, http.StatusUnauthorized, "agent credential required")
+		return
+	}
+	var req agentRotateRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.Error(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	item, err := h.svc.RotateAgentCredential(r.Context(), agentIdentity(claims), req.PublicKey)
+	if err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) ListAgentHosts(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListAgentHosts(r.Context(), agentOwnerScope(r, claims), intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) RevokeAgentHost(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if claims.Role == sdkauth.RoleAgent {
+		httpx.Error(w, http.StatusForbidden, "agents cannot revoke hosts")
+		return
+	}
+	item, err := h.svc.RevokeAgentHost(r.Context(), claims.UserID, isAdminRole(claims.Role), chi.URLParam(r, "hostID"))
+	if err != nil {
+		writeAgentHostError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+// writeAgentHostError maps enrollment and host management errors. Anything
+// not caused by the request, such as a failed query, is a server error.
+func writeAgentHostError(w http.ResponseWriter, err error) {
+	switch {
+	case strings.HasPrefix(err.Error(), "forbidden"):
+		httpx.Error(w, http.StatusForbidden, err.Error())
+	case strings.HasSuffix(err.Error(), "not found"):
+		httpx.Error(w, http.StatusNotFound, err.Error())
+	case strings.HasSuffix(err.Error(), "already revoked"):
+		httpx.Error(w, http.StatusConflict, err.Error())
+	case strings.HasPrefix(err.Error(), "provider registry unavailable"):
+		httpx.Error(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *Handler) IssueCapacityChallenge(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req capacityChallengeRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.Error(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	item, err := h.svc.IssueCapacityChallenge(r.Context(), chi.URLParam(r, "providerID"), models.CapacityChallengeKind(req.Kind), claims.UserID)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListCapacityChallenges(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	providerID := chi.URLParam(r, "providerID")
+	if claims == nil || (!isAdminRole(claims.Role) && claims.UserID != providerID) {
+		httpx.Error(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	items, err := h.svc.ListCapacityChallenges(r.Context(), providerID, intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) GetHostVerification(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	providerID := chi.URLParam(r, "providerID")
+	if claims == nil || (!isAdminRole(claims.Role) && claims.UserID != providerID) {
+		httpx.Error(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	item, err := h.svc.GetHostVerification(r.Context(), providerID)
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) ListHostVerifications(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListHostVerifications(r.Context(), models.HostVerificationState(r.URL.Query().Get("status")))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+// agentOwnerScope is the provider whose hosts a caller may list: admins may
+// pick any provider (or all), everyone else sees their own.
+func agentOwnerScope(r *http.Request, claims *sdkauth.Claims) string {
+	if isAdminRole(claims.Role) {
+		return strings.TrimSpace(r.URL.Query().Get("provider_id"))
+	}
+	return claims.UserID
+}
+
+func (h *Handler) PollAgentCommand(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req agentCommandPollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
+		return
+	}
+	item, err := h.svc.ClaimNextAgentCommand(r.Context(), strings.TrimSpace(req.ProviderID))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+// agentChannelConn frames the agent channel as JSON WebSocket messages. An
+// agent that misses three pings in a row is treated as gone.
+type agentChannelConn struct {
+	ws *websocket.Conn
+}
+
+func (c agentChannelConn) Send(frame models.AgentChannelFrame) error {
+	if err := c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	return websocket.JSON.Send(c.ws, frame)
+}
+
+func (c agentChannelConn) Receive() (models.AgentChannelFrame, error) {
+	var frame models.AgentChannelFrame
+	if err := c.ws.SetReadDeadline(time.Now().Add(3 * service.AgentChannelPing)); err != nil {
+		return frame, err
+	}
+	err := websocket.JSON.Receive(c.ws, &frame)
+	return frame, err
+}
+
+func (h *Handler) AgentChannel(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	providerID := strings.TrimSpace(r.URL.Query().Get("provider_id"))
+	if err := h.validateAgentIdentity(r.Context(), claims, providerID); err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
+		return
+	}
+	resumeSeq, _ := strconv.ParseInt(r.URL.Query().Get("resume_seq"), 10, 64)
+	websocket.Server{
+		// Agents are not browsers and send no Origin; the bearer token is the
+		// check.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			authorize := func(ctx context.Context) error { return h.validateAgentIdentity(ctx, claims, providerID) }
+			err := h.svc.ServeAgentChannel(r.Context(), providerID, resumeSeq, agentChannelConn{ws: ws}, authorize)
+			log.Info().Err(err).Str("provider_id", providerID).Msg("agent channel closed")
+		},
+	}.ServeHTTP(w, r)
+}
+
+// terminalProtocol is the WebSocket subprotocol of terminal streams. Browsers
+// cannot set headers on a WebSocket, so they offer the bearer token as a
+// second subprotocol and the server answers with this one only.
+const terminalProtocol = "sharemtc.terminal.v1"
+
+// terminalStreamConn frames a terminal stream as JSON WebSocket messages.
+type terminalStreamConn struct {
+	ws *websocket.Conn
+}
+
+func (c terminalStreamConn) Send(frame models.TerminalFrame) error {
+	if err := c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	return websocket.JSON.Send(c.ws, frame)
+}
+
+func (c terminalStreamConn) Receive() (models.TerminalFrame, error) {
+	var frame models.TerminalFrame
+	if err := c.ws.SetReadDeadline(time.Now().Add(3 * service.TerminalStreamPing)); err != nil {
+		return frame, err
+	}
+	err := websocket.JSON.Receive(c.ws, &frame)
+	return frame, err
+}
+
+func (h *Handler) TerminalStream(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sessionID := chi.URLParam(r, "sessionID")
+	afterSeq, _ := strconv.ParseInt(r.URL.Query().Get("after_seq"), 10, 64)
+	websocket.Server{
+		// The token comes from the request, not a cookie, so a foreign
+		// Origin cannot act for the user.
+		Handshake: func(config *websocket.Config, _ *http.Request) error {
+			config.Protocol = []string{terminalProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			err := h.svc.ServeTerminalStream(r.Context(), claims.UserID, sessionID, afterSeq, terminalStreamConn{ws: ws})
+			log.Info().Err(err).Str("session_id", sessionID).Str("user_id", claims.UserID).Msg("terminal stream closed")
+		},
+	}.ServeHTTP(w, r)
+}
+
+func (h *Handler) CompleteAgentCommand(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	commandID := chi.URLParam(r, "commandID")
+	var req agentCommandCompleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
+		return
+	}
+	item, err := h.svc.CompleteAgentCommand(
+		r.Context(),
+		commandID,
+		strings.TrimSpace(req.ProviderID),
+		models.AgentCommandState(strings.TrimSpace(req.Status)),
+		strings.TrimSpace(req.ResultMessage),
+	)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) CreateTerminalSession(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req createTerminalSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.CreateTerminalSession(r.Context(), claims.UserID, strings.TrimSpace(req.ResourceID), req.Rows, req.Cols)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListTerminalSessions(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	resourceID := strings.TrimSpace(r.URL.Query().Get("resource_id"))
+	if resourceID == "" {
+		httpx.Error(w, http.StatusBadRequest, "resource_id is required")
+		return
+	}
+	items, err := h.svc.ListTerminalSessions(r.Context(), claims.UserID, resourceID)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) GetTerminalSession(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sessionID := chi.URLParam(r, "sessionID")
+	item, err := h.svc.GetTerminalSession(r.Context(), claims.UserID, sessionID)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) WriteTerminalInput(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sessionID := chi.URLParam(r, "sessionID")
+	var req terminalInputRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.WriteTerminalInput(r.Context(), claims.UserID, sessionID, req.Data)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListTerminalOutput(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sessionID := chi.URLParam(r, "sessionID")
+	afterSeq := int64(intQuery(r, "after_seq", 0))
+	limit := intQuery(r, "limit", 200)
+	items, err := h.svc.ListTerminalOutput(r.Context(), claims.UserID, sessionID, afterSeq, limit)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) TerminalRecording(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	recording, err := h.svc.TerminalRecording(r.Context(), claims.UserID, isAdminRole(claims.Role), chi.URLParam(r, "sessionID"), "export")
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "terminal-"+recording.Session.ID+".cast"))
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(recording.Header); err != nil {
+		return
+	}
+	for _, event := range recording.Events {
+		if err := enc.Encode(event); err != nil {
+			return
+		}
+	}
+}
+
+// ReplayTerminalRecording streams a recording as asciicast lines paced like
+// the session, so a plain HTTP client can watch it without a player.
+func (h *Handler) ReplayTerminalRecording(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	query := r.URL.Query()
+	speed := 1.0
+	if raw := strings.TrimSpace(query.Get("speed")); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed < service.MinReplaySpeed || parsed > service.MaxReplaySpeed {
+			httpx.Error(w, http.StatusBadRequest, fmt.Sprintf("speed must be between %g and %g", service.MinReplaySpeed, service.MaxReplaySpeed))
+			return
+		}
+		speed = parsed
+	}
+	var maxIdle time.Duration
+	if raw := strings.TrimSpace(query.Get("max_idle")); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed < 0 {
+			httpx.Error(w, http.StatusBadRequest, "max_idle must be a non-negative number of seconds")
+			return
+		}
+		maxIdle = time.Duration(parsed * float64(time.Second))
+	}
+	recording, err := h.svc.TerminalRecording(r.Context(), claims.UserID, isAdminRole(claims.Role), chi.URLParam(r, "sessionID"), "replay")
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(recording.Header); err != nil || rc.Flush() != nil {
+		return
+	}
+	_ = service.ReplayTerminalRecording(r.Context(), recording.Events, speed, maxIdle, func(event models.AsciicastEvent) error {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+}
+
+func (h *Handler) ResizeTerminalSession(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sessionID := chi.URLParam(r, "sessionID")
+	var req terminalResizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.ResizeTerminalSession(r.Context(), claims.UserID, sessionID, req.Rows, req.Cols)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) CloseTerminalSession(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sessionID := chi.URLParam(r, "sessionID")
+	item, err := h.svc.CloseTerminalSession(r.Context(), claims.UserID, sessionID)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) ListTerminalParticipants(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListTerminalParticipants(r.Context(), claims.UserID, chi.URLParam(r, "sessionID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) InviteTerminalParticipant(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req terminalParticipantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.InviteTerminalParticipant(r.Context(), claims.UserID, chi.URLParam(r, "sessionID"), req.UserID, req.Role)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) RemoveTerminalParticipant(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if err := h.svc.RemoveTerminalParticipant(r.Context(), claims.UserID, chi.URLParam(r, "sessionID"), chi.URLParam(r, "userID")); err != nil {
+		writeShareError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) ReportTerminalOutput(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	sessionID := chi.URLParam(r, "sessionID")
+	var req terminalOutputReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
+		return
+	}
+	item, err := h.svc.RecordTerminalOutput(r.Context(), strings.TrimSpace(req.ProviderID), sessionID, req.Data)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ReportExecOutput(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req execOutputReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := h.svc.RecordExecOutput(r.Context(), strings.TrimSpace(req.ProviderID), chi.URLParam(r, "execID"), req.Stream, req.Data); err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) RunExec(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req execRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.RunExec(r.Context(), claims.UserID, service.ExecRequest{
+		ProviderID:     req.ProviderID,
+		Script:         req.Script,
+		Argv:           req.Argv,
+		WorkDir:        req.WorkDir,
+		Env:            req.Env,
+		TimeoutSeconds: req.TimeoutSeconds,
+		Reason:         req.Reason,
+	})
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListExecRuns(w http.ResponseWriter, r *http.Request) {
+	providerID := strings.TrimSpace(r.URL.Query().Get("provider_id"))
+	requestedBy := strings.TrimSpace(r.URL.Query().Get("requested_by"))
+	items, err := h.svc.ListExecRuns(r.Context(), providerID, requestedBy, intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) RequestAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req agentUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.RequestAgentUpdate(r.Context(), claims.UserID, service.AgentUpdateRequest{
+		ProviderID:           req.ProviderID,
+		Version:              req.Version,
+		HealthTimeoutSeconds: req.HealthTimeoutSeconds,
+	})
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) AgentVersions(w http.ResponseWriter, r *http.Request) {
+	item, err := h.svc.AgentVersions(r.Context())
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) CreateRollout(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req rolloutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.CreateRollout(r.Context(), claims.UserID, service.RolloutRequest{
+		Command:              models.AgentCommandAction(strings.TrimSpace(req.Command)),
+		Version:              req.Version,
+		HealthTimeoutSeconds: req.HealthTimeoutSeconds,
+		Selector:             req.Selector,
+		Waves:                req.Waves,
+		MaxConcurrency:       req.MaxConcurrency,
+		MaxFailurePct:        req.MaxFailurePct,
+		PauseBetweenWaves:    req.PauseBetweenWaves,
+		TimeoutSeconds:       req.TimeoutSeconds,
+		MaxAttempts:          req.MaxAttempts,
+	})
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (h *Handler) ListRollouts(w http.ResponseWriter, r *http.Request) {
+	status := models.RolloutStatus(strings.TrimSpace(r.URL.Query().Get("status")))
+	items, err := h.svc.ListRollouts(r.Context(), status, intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 	httpx.JSON(w, http.StatusOK, items)
 }
 
-func (h *Handler) ResizeTerminalSession(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetRollout(w http.ResponseWriter, r *http.Request) {
+	item, err := h.svc.GetRollout(r.Context(), chi.URLParam(r, "rolloutID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) PauseRollout(w http.ResponseWriter, r *http.Request) {
+	h.changeRollout(w, r, h.svc.PauseRollout)
+}
+
+func (h *Handler) ResumeRollout(w http.ResponseWriter, r *http.Request) {
+	h.changeRollout(w, r, h.svc.ResumeRollout)
+}
+
+func (h *Handler) CancelRollout(w http.ResponseWriter, r *http.Request) {
+	h.changeRollout(w, r, h.svc.CancelRollout)
+}
+
+func (h *Handler) changeRollout(w http.ResponseWriter, r *http.Request, change func(context.Context, string, string) (models.Rollout, error)) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	sessionID := chi.URLParam(r, "sessionID")
-	var req terminalResizeRequest
+	item, err := change(r.Context(), claims.UserID, chi.URLParam(r, "rolloutID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) GetExecRun(w http.ResponseWriter, r *http.Request) {
+	item, err := h.svc.GetExecRun(r.Context(), chi.URLParam(r, "execID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+// ListMyExecRuns shows providers what was run on their hosts.
+func (h *Handler) ListMyExecRuns(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	items, err := h.svc.ListExecRuns(r.Context(), claims.UserID, "", intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) GetExecPolicy(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	providerID := chi.URLParam(r, "providerID")
+	if claims == nil || (!isAdminRole(claims.Role) && claims.UserID != providerID) {
+		httpx.Error(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	item, err := h.svc.GetExecPolicy(r.Context(), providerID)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) UpdateExecPolicy(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req models.ExecPolicy
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	item, err := h.svc.ResizeTerminalSession(r.Context(), claims.UserID, sessionID, req.Rows, req.Cols)
+	req.ProviderID = chi.URLParam(r, "providerID")
+	item, err := h.svc.UpdateExecPolicy(r.Context(), claims.UserID, req)
 	if err != nil {
 		httpx.Error(w, http.StatusBadRequest, err.Error())
 		return
@@ -802,43 +2350,245 @@ func (h *Handler) ResizeTerminalSession(w http.ResponseWriter, r *http.Request)
 	httpx.JSON(w, http.StatusOK, item)
 }
 
-func (h *Handler) CloseTerminalSession(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) StartFileTransfer(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	sessionID := chi.URLParam(r, "sessionID")
-	item, err := h.svc.CloseTerminalSession(r.Context(), claims.UserID, sessionID)
+	var req fileTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.StartFileTransfer(r.Context(), claims.UserID, req.toService())
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+// StartHostFileTransfer lets admins move files to and from the host sandbox
+// of any provider.
+func (h *Handler) StartHostFileTransfer(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req fileTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	item, err := h.svc.StartHostFileTransfer(r.Context(), claims.UserID, req.toService())
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, item)
+}
+
+func (req fileTransferRequest) toService() service.FileTransferRequest {
+	return service.FileTransferRequest{
+		ResourceID: req.ResourceID,
+		ProviderID: req.ProviderID,
+		Direction:  models.FileTransferDirection(strings.TrimSpace(req.Direction)),
+		Path:       req.Path,
+		Size:       req.Size,
+		SHA256:     req.SHA256,
+	}
+}
+
+func (h *Handler) ListFileTransfers(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	query := r.URL.Query()
+	items, err := h.svc.ListFileTransfers(r.Context(), claims.UserID, false, "", strings.TrimSpace(query.Get("resource_id")), intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListFileTransfersAdmin(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	query := r.URL.Query()
+	items, err := h.svc.ListFileTransfers(r.Context(), claims.UserID, true, strings.TrimSpace(query.Get("provider_id")), strings.TrimSpace(query.Get("resource_id")), intQuery(r, "limit", 100))
+	if err != nil {
+		httpx.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListTerminalSessionsAdmin(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	items, err := h.svc.ListTerminalSessionsAdmin(r.Context(), query.Get("provider_id"), query.Get("resource_id"), intQuery(r, "limit", 100))
 	if err != nil {
 		httpx.Error(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) GetFileTransfer(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	item, err := h.svc.GetFileTransfer(r.Context(), claims.UserID, isAdminRole(claims.Role), chi.URLParam(r, "transferID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
 	httpx.JSON(w, http.StatusOK, item)
 }
 
-func (h *Handler) ReportTerminalOutput(w http.ResponseWriter, r *http.Request) {
+// WriteFileTransferChunk takes the raw bytes of the chunk starting at the
+// offset query parameter.
+func (h *Handler) WriteFileTransferChunk(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	sessionID := chi.URLParam(r, "sessionID")
-	var req terminalOutputReportRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, "offset is required")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, filetransfer.ChunkSize+1))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	item, err := h.svc.WriteFileTransferChunk(r.Context(), claims.UserID, isAdminRole(claims.Role), chi.URLParam(r, "transferID"), offset, data)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+// ReadFileTransferContent serves a completed download. A Range header of the
+// form bytes=N- resumes an interrupted fetch.
+func (h *Handler) ReadFileTransferContent(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var offset int64
+	if raw, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok && strings.HasSuffix(raw, "-") {
+		parsed, err := strconv.ParseInt(strings.TrimSuffix(raw, "-"), 10, 64)
+		if err != nil {
+			httpx.Error(w, http.StatusRequestedRangeNotSatisfiable, "invalid range")
+			return
+		}
+		offset = parsed
+	}
+	transferID := chi.URLParam(r, "transferID")
+	item, chunks, err := h.svc.ReadFileTransferContent(r.Context(), claims.UserID, isAdminRole(claims.Role), transferID, offset, 0)
+	if err != nil {
+		if err.Error() == "offset is outside the file" {
+			httpx.Error(w, http.StatusRequestedRangeNotSatisfiable, err.Error())
+			return
+		}
+		writeShareError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(item.Path)))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("X-Content-SHA256", item.SHA256)
+	w.Header().Set("Content-Length", strconv.FormatInt(item.Size-offset, 10))
+	status := http.StatusOK
+	if offset > 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, item.Size-1, item.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	// The service hands out the file a page of chunks at a time.
+	for len(chunks) > 0 {
+		for _, chunk := range chunks {
+			data := chunk.Data
+			if chunk.Offset < offset {
+				data = data[offset-chunk.Offset:]
+			}
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			offset = chunk.Offset + int64(len(chunk.Data))
+		}
+		if offset >= item.Size {
+			return
+		}
+		if _, chunks, err = h.svc.ReadFileTransferContent(r.Context(), claims.UserID, isAdminRole(claims.Role), transferID, offset, 0); err != nil {
+			log.Warn().Err(err).Str("transfer_id", transferID).Msg("file transfer content read failed")
+			return
+		}
+	}
+}
+
+func (h *Handler) ResumeFileTransfer(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	item, err := h.svc.ResumeFileTransfer(r.Context(), claims.UserID, isAdminRole(claims.Role), chi.URLParam(r, "transferID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) CancelFileTransfer(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	item, err := h.svc.CancelFileTransfer(r.Context(), claims.UserID, isAdminRole(claims.Role), chi.URLParam(r, "transferID"))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	httpx.JSON(w, http.StatusOK, item)
+}
+
+func (h *Handler) ReportFileChunk(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req fileChunkReportRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := validateAgentIdentity(claims, req.ProviderID); err != nil {
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
 		httpx.Error(w, http.StatusForbidden, err.Error())
 		return
 	}
-	item, err := h.svc.RecordTerminalOutput(r.Context(), strings.TrimSpace(req.ProviderID), sessionID, req.Data)
-	if err != nil {
+	if err := h.svc.RecordFileChunk(r.Context(), strings.TrimSpace(req.ProviderID), chi.URLParam(r, "transferID"), req.Offset, req.Data); err != nil {
 		httpx.Error(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	httpx.JSON(w, http.StatusCreated, item)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *Handler) RecordRootInputLog(w http.ResponseWriter, r *http.Request) {
@@ -852,7 +2602,7 @@ func (h *Handler) RecordRootInputLog(w http.ResponseWriter, r *http.Request) {
 		httpx.Error(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := validateAgentIdentity(claims, req.ProviderID); err != nil {
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
 		httpx.Error(w, http.StatusForbidden, err.Error())
 		return
 	}
@@ -885,6 +2635,93 @@ func (h *Handler) ListRootInputLogs(w http.ResponseWriter, r *http.Request) {
 	httpx.JSON(w, http.StatusOK, items)
 }
 
+func (h *Handler) RecordResourceLogs(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var req resourceLogBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := h.validateAgentIdentity(r.Context(), claims, req.ProviderID); err != nil {
+		httpx.Error(w, http.StatusForbidden, err.Error())
+		return
+	}
+	items := make([]models.ResourceLog, 0, len(req.Entries))
+	for _, entry := range req.Entries {
+		items = append(items, models.ResourceLog{
+			ResourceID: entry.ResourceID,
+			SourceType: entry.SourceType,
+			Source:     entry.Source,
+			Stream:     entry.Stream,
+			Level:      models.ResourceLogLevel(entry.Level),
+			Message:    entry.Message,
+			OccurredAt: parseTimeQuery(entry.OccurredAt),
+		})
+	}
+	created, err := h.svc.RecordResourceLogs(r.Context(), strings.TrimSpace(req.ProviderID), items)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusCreated, map[string]int{"accepted": len(created)})
+}
+
+func (h *Handler) ListResourceLogs(w http.ResponseWriter, r *http.Request) {
+	claims := sdkauth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		httpx.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	query := readResourceLogQuery(r)
+	var (
+		items []models.ResourceLog
+		err   error
+	)
+	if r.URL.Query().Get("follow") == "true" {
+		wait := time.Duration(intQuery(r, "wait_seconds", 20)) * time.Second
+		items, err = h.svc.FollowResourceLogs(r.Context(), claims.UserID, query, wait)
+	} else {
+		items, err = h.svc.ListResourceLogs(r.Context(), claims.UserID, query)
+	}
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "forbidden") {
+			httpx.Error(w, http.StatusForbidden, err.Error())
+			return
+		}
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func (h *Handler) ListResourceLogsAdmin(w http.ResponseWriter, r *http.Request) {
+	items, err := h.svc.ListResourceLogsAdmin(r.Context(), readResourceLogQuery(r))
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	httpx.JSON(w, http.StatusOK, items)
+}
+
+func readResourceLogQuery(r *http.Request) models.ResourceLogQuery {
+	query := models.ResourceLogQuery{
+		ResourceID: chi.URLParam(r, "resourceID"),
+		Text:       strings.TrimSpace(r.URL.Query().Get("q")),
+		Source:     strings.TrimSpace(r.URL.Query().Get("source")),
+		AfterSeq:   int64(intQuery(r, "after_seq", 0)),
+		BeforeSeq:  int64(intQuery(r, "before_seq", 0)),
+		Limit:      intQuery(r, "limit", 200),
+	}
+	if raw := strings.TrimSpace(r.URL.Query().Get("level")); raw != "" {
+		query.Levels = strings.Split(raw, ",")
+	}
+	return query
+}
+
 func (h *Handler) CreateKubernetesCluster(w http.ResponseWriter, r *http.Request) {
 	claims := sdkauth.ClaimsFromContext(r.Context())
 	if claims == nil {
@@ -961,6 +2798,14 @@ func parseTimeQuery(raw string) time.Time {
 	return parsed
 }
 
+func optionalTime(raw string) *time.Time {
+	parsed := parseTimeQuery(raw)
+	if parsed.IsZero() {
+		return nil
+	}
+	return &parsed
+}
+
 func readCatalogFilter(r *http.Request) models.CatalogFilter {
 	return models.CatalogFilter{
 		Search:                    strings.TrimSpace(r.URL.Query().Get("search")),
@@ -975,19 +2820,29 @@ func readCatalogFilter(r *http.Request) models.CatalogFilter {
 	}
 }
 
-func validateAgentIdentity(claims *sdkauth.Claims, providerID string) error {
+// validateAgentIdentity checks that the caller may act as the agent of
+// providerID. Agent tokens must name an enrolled, unrevoked host and one of
+// its live credentials; the provider_id in the payload is never trusted alone.
+func (h *Handler) validateAgentIdentity(ctx context.Context, claims *sdkauth.Claims, providerID string) error {
 	if strings.TrimSpace(providerID) == "" {
 		return errors.New("provider_id is required")
 	}
 	switch claims.Role {
 	case "admin", "super-admin", "ops-admin":
 		return nil
-	case "agent":
-		if claims.UserID == providerID {
-			return nil
-		}
-		return errors.New("agent token does not match provider_id")
+	case sdkauth.RoleAgent:
+		return h.svc.AuthorizeAgent(ctx, agentIdentity(claims), providerID)
 	default:
 		return errors.New("insufficient role for agent telemetry")
 	}
 }
+
+// AuthorizeAgentClaims is the check the agent routes run on every host
+// token, so a revoked host or rotated-out credential is refused up front.
+func (h *Handler) AuthorizeAgentClaims(ctx context.Context, claims *sdkauth.Claims) error {
+	return h.svc.AuthorizeAgent(ctx, agentIdentity(claims), claims.UserID)
+}
+
+func agentIdentity(claims *sdkauth.Claims) service.AgentIdentity {
+	return service.AgentIdentity{ProviderID: claims.UserID, HostID: claims.Subject, CredentialID: claims.ID}
+}
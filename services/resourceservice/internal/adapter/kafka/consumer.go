@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/IBM/sarama"
+	"github.com/rs/zerolog/log"
 )
 
 type Event struct {
@@ -22,6 +23,9 @@ type Event struct {
 	GPUMemoryUsedMB  int                    `json:"gpu_memory_used_mb"`
 	NetworkMbps      int                    `json:"network_mbps"`
 	HeartbeatAt      time.Time              `json:"heartbeat_at"`
+	AgentVersion     string                 `json:"agent_version"`
+	Region           string                 `json:"region"`
+	Labels           []string               `json:"labels"`
 }
 
 type Consumer struct {
@@ -73,8 +77,16 @@ func (h *groupHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
 func (h *groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 	for msg := range claim.Messages() {
 		var event Event
-		if err := json.Unmarshal(msg.Value, &event); err == nil {
-			_ = h.callback(session.Context(), event)
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			log.Warn().Err(err).Str("topic", msg.Topic).Int64("offset", msg.Offset).Msg("kafka event is not valid JSON; skipped")
+		} else if err := h.callback(session.Context(), event); err != nil {
+			log.Warn().
+				Err(err).
+				Str("topic", msg.Topic).
+				Int64("offset", msg.Offset).
+				Str("event_type", event.EventType).
+				Str("provider_id", event.ProviderID).
+				Msg("kafka event rejected")
 		}
 		session.MarkMessage(msg, "")
 	}
@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// Webhook posts alert notifications as JSON to the channel target URL. Targets
+// are set by users, so connections are only made to public addresses, checked
+// after name resolution, and redirects are not followed.
+type Webhook struct {
+	httpClient *http.Client
+}
+
+func NewWebhook(timeout time.Duration) *Webhook {
+	return newWebhook(timeout, publicAddr)
+}
+
+func newWebhook(timeout time.Duration, allow func(netip.Addr) bool) *Webhook {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_ string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allow(addrPort.Addr().Unmap()) {
+				return fmt.Errorf("alert webhook address %s is not public", addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &Webhook{httpClient: &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return errors.New("alert webhook redirects are not followed")
+		},
+	}}
+}
+
+func publicAddr(addr netip.Addr) bool {
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified()
+}
+
+func (w *Webhook) Notify(ctx context.Context, target string, notification models.AlertNotification) error {
+	raw, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-ShareMTC-Alert-State", string(notification.State))
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// EmailLog stands in for an email sender until SMTP is wired up: it writes the
+// message it would have sent to the service log.
+type EmailLog struct{}
+
+func NewEmailLog() EmailLog {
+	return EmailLog{}
+}
+
+func (EmailLog) Notify(_ context.Context, target string, notification models.AlertNotification) error {
+	log.Info().
+		Str("to", target).
+		Str("subject", fmt.Sprintf("[%s] %s %s", notification.Severity, notification.RuleName, notification.State)).
+		Str("alert_id", notification.AlertID).
+		Str("resource_id", notification.ResourceID).
+		Str("summary", notification.Summary).
+		Msg("alert email queued")
+	return nil
+}
@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+)
+
+func TestPublicAddr(t *testing.T) {
+	cases := map[string]bool{
+		"8.8.8.8":         true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"fd00::1":         false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"0.0.0.0":         false,
+		"::":              false,
+		"224.0.0.1":       false,
+	}
+	for raw, want := range cases {
+		if got := publicAddr(netip.MustParseAddr(raw)); got != want {
+			t.Errorf("publicAddr(%s) = %v, want %v", raw, got, want)
+		}
+	}
+	if publicAddr(netip.MustParseAddr("::ffff:127.0.0.1").Unmap()) {
+		t.Error("expected mapped loopback to be refused")
+	}
+}
+
+func TestWebhookRefusesPrivateTargets(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	err := NewWebhook(time.Second).Notify(context.Background(), server.URL, models.AlertNotification{State: "firing"})
+	if err == nil || !strings.Contains(err.Error(), "is not public") {
+		t.Fatalf("expected loopback target to be refused, got %v", err)
+	}
+	localhost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if err := NewWebhook(time.Second).Notify(context.Background(), localhost, models.AlertNotification{State: "firing"}); err == nil {
+		t.Fatal("expected a name resolving to loopback to be refused")
+	}
+	if hits.Load() != 0 {
+		t.Fatalf("expected no request to reach the server, got %d", hits.Load())
+	}
+}
+
+func TestWebhookDoesNotFollowRedirects(t *testing.T) {
+	var redirected atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		redirected.Add(1)
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-ShareMTC-Alert-State") != "firing" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+		}
+	}))
+	defer server.Close()
+
+	webhook := newWebhook(time.Second, func(netip.Addr) bool { return true })
+	if err := webhook.Notify(context.Background(), server.URL+"/ok", models.AlertNotification{State: "firing"}); err != nil {
+		t.Fatalf("notify allowed target: %v", err)
+	}
+	err := webhook.Notify(context.Background(), server.URL+"/redirect", models.AlertNotification{State: "firing"})
+	if err == nil || !strings.Contains(err.Error(), "redirects are not followed") {
+		t.Fatalf("expected redirect to be refused, got %v", err)
+	}
+	if redirected.Load() != 0 {
+		t.Fatal("expected the redirect target not to be contacted")
+	}
+}
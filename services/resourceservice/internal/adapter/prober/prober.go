@@ -0,0 +1,120 @@
+package prober
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+)
+
+// Network probes VMs and pods over the network. The probe context carries the
+// per-probe timeout.
+type Network struct {
+	dialer     net.Dialer
+	httpClient *http.Client
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		httpClient: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (n *Network) Probe(ctx context.Context, probe models.HealthProbe) (time.Duration, error) {
+	addr := net.JoinHostPort(probe.Address, strconv.Itoa(probe.Port))
+	started := time.Now()
+	var err error
+	switch probe.Kind {
+	case models.HealthProbeTCP:
+		err = n.tcp(ctx, addr)
+	case models.HealthProbeHTTP:
+		err = n.http(ctx, addr, probe.Path, probe.ExpectedStatus)
+	case models.HealthProbeReachability:
+		err = n.reachability(ctx, addr)
+	case models.HealthProbeSSH:
+		err = n.ssh(ctx, addr)
+	default:
+		err = fmt.Errorf("unsupported probe kind %q", probe.Kind)
+	}
+	return time.Since(started), err
+}
+
+func (n *Network) tcp(ctx context.Context, addr string) error {
+	conn, err := n.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (n *Network) http(ctx context.Context, addr string, path string, expected int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if expected != 0 {
+		if resp.StatusCode != expected {
+			return fmt.Errorf("status %d, expected %d", resp.StatusCode, expected)
+		}
+		return nil
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// reachability stands in for ICMP echo, which needs raw sockets: a host that
+// accepts or actively refuses the connection is up.
+func (n *Network) reachability(ctx context.Context, addr string) error {
+	conn, err := n.dialer.DialContext(ctx, "tcp", addr)
+	if err == nil {
+		return conn.Close()
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return err
+}
+
+func (n *Network) ssh(ctx context.Context, addr string) error {
+	conn, err := n.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+	}
+	// RFC 4253 lets servers send other lines before the identification string.
+	reader := bufio.NewReaderSize(conn, 512)
+	for i := 0; i < 5; i++ {
+		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, "SSH-") {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("no ssh banner: %w", err)
+		}
+	}
+	return errors.New("no ssh banner")
+}
@@ -35,18 +35,25 @@ type CreateVMRequest struct {
 }
 
 type CreatePodRequest struct {
-	RequestID  string         `json:"request_id"`
-	TraceID    string         `json:"trace_id"`
-	UserID     string         `json:"user_id"`
-	ProviderID string         `json:"provider_id"`
-	Name       string         `json:"name"`
-	ImageName  string         `json:"image_name"`
-	GPUTypeID  string         `json:"gpu_type_id"`
-	GPUCount   int            `json:"gpu_count"`
-	CPUCount   int            `json:"cpu_count"`
-	MemoryGB   int            `json:"memory_gb"`
-	ExpiresAt  time.Time      `json:"expires_at"`
-	Metadata   map[string]any `json:"metadata"`
+	RequestID       string                  `json:"request_id"`
+	TraceID         string                  `json:"trace_id"`
+	UserID          string                  `json:"user_id"`
+	ProviderID      string                  `json:"provider_id"`
+	Name            string                  `json:"name"`
+	ImageName       string                  `json:"image_name"`
+	GPUTypeID       string                  `json:"gpu_type_id"`
+	GPUCount        int                     `json:"gpu_count"`
+	CPUCount        int                     `json:"cpu_count"`
+	MemoryGB        int                     `json:"memory_gb"`
+	Env             []models.PodEnvVar      `json:"env,omitempty"`
+	Command         []string                `json:"command,omitempty"`
+	Args            []string                `json:"args,omitempty"`
+	Ports           []models.PodPort        `json:"ports,omitempty"`
+	ContainerDiskGB int                     `json:"container_disk_gb,omitempty"`
+	VolumeMounts    []models.PodVolumeMount `json:"volume_mounts,omitempty"`
+	RegistryAuthID  string                  `json:"registry_auth_id,omitempty"`
+	ExpiresAt       time.Time               `json:"expires_at"`
+	Metadata        map[string]any          `json:"metadata"`
 }
 
 type DeleteRequest struct {
@@ -112,6 +119,7 @@ write_files:
       RESOURCE_TYPE=vm
       KAFKA_BROKERS=%s
       KAFKA_TOPIC=%s
+      LOG_SOURCES=journald:cloud-final.service
 runcmd:
   - curl -fsSL %s -o /usr/local/bin/sharemtc-vmdaemon
   - chmod +x /usr/local/bin/sharemtc-vmdaemon
@@ -3,7 +3,10 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -38,6 +41,10 @@ func (r *Repo) Migrate(ctx context.Context) error {
 		ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS gpu_total_units INTEGER NOT NULL DEFAULT 0;
 		ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS gpu_memory_total_mb INTEGER NOT NULL DEFAULT 0;
 		ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS gpu_memory_used_mb INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS signed BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS agent_version TEXT NOT NULL DEFAULT '';
+		ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '';
+		ALTER TABLE host_resources ADD COLUMN IF NOT EXISTS labels_json TEXT NOT NULL DEFAULT '[]';
 		CREATE TABLE IF NOT EXISTS allocations (
 			id TEXT PRIMARY KEY,
 			provider_id TEXT NOT NULL,
@@ -131,6 +138,31 @@ func (r *Repo) Migrate(ctx context.Context) error {
 			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		);
 		CREATE INDEX IF NOT EXISTS idx_shared_pods_owner ON shared_pods(owner_user_id);
+		ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+		ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS invite_email TEXT NOT NULL DEFAULT '';
+		ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+		ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS accepted_at TIMESTAMPTZ;
+		ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ;
+		ALTER TABLE shared_vms ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+		CREATE INDEX IF NOT EXISTS idx_shared_vms_vm ON shared_vms(vm_id);
+		ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+		ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS invite_email TEXT NOT NULL DEFAULT '';
+		ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+		ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS accepted_at TIMESTAMPTZ;
+		ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ;
+		ALTER TABLE shared_pods ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+		CREATE INDEX IF NOT EXISTS idx_shared_pods_pod ON shared_pods(pod_code);
+		CREATE TABLE IF NOT EXISTS share_audit_events (
+			id TEXT PRIMARY KEY,
+			grant_id TEXT NOT NULL,
+			resource_type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			actor_user_id TEXT NOT NULL,
+			action TEXT NOT NULL,
+			details TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_share_audit_resource ON share_audit_events(resource_type, resource_id, created_at DESC);
 		CREATE TABLE IF NOT EXISTS shared_inventory_offers (
 			id TEXT PRIMARY KEY,
 			provider_id TEXT NOT NULL,
@@ -151,6 +183,63 @@ func (r *Repo) Migrate(ctx context.Context) error {
 		);
 		CREATE INDEX IF NOT EXISTS idx_shared_inventory_status ON shared_inventory_offers(status, updated_at DESC);
 		CREATE INDEX IF NOT EXISTS idx_shared_inventory_provider ON shared_inventory_offers(provider_id, updated_at DESC);
+		CREATE TABLE IF NOT EXISTS offer_bookings (
+			id TEXT PRIMARY KEY,
+			offer_id TEXT NOT NULL REFERENCES shared_inventory_offers(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL,
+			provider_id TEXT NOT NULL,
+			quantity INTEGER NOT NULL,
+			price_hourly_usd DOUBLE PRECISION NOT NULL,
+			status TEXT NOT NULL DEFAULT 'held',
+			hold_expires_at TIMESTAMPTZ NOT NULL,
+			allocation_id TEXT NOT NULL DEFAULT '',
+			billing_rental_id TEXT NOT NULL DEFAULT '',
+			confirmed_at TIMESTAMPTZ,
+			closed_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_offer_bookings_user ON offer_bookings(user_id, created_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_offer_bookings_holds ON offer_bookings(status, hold_expires_at);
+		ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS pricing_mode TEXT NOT NULL DEFAULT 'fixed';
+		ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS auction_rule TEXT NOT NULL DEFAULT '';
+		ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS clearing_period_minutes INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS next_clearing_at TIMESTAMPTZ;
+		ALTER TABLE shared_inventory_offers ADD COLUMN IF NOT EXISTS last_clearing_price_usd DOUBLE PRECISION NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS idx_shared_inventory_clearing ON shared_inventory_offers(pricing_mode, next_clearing_at);
+		CREATE TABLE IF NOT EXISTS offer_bids (
+			id TEXT PRIMARY KEY,
+			offer_id TEXT NOT NULL REFERENCES shared_inventory_offers(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL,
+			provider_id TEXT NOT NULL,
+			quantity INTEGER NOT NULL,
+			max_price_hourly_usd DOUBLE PRECISION NOT NULL,
+			duration_hours INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'open',
+			allocated_qty INTEGER NOT NULL DEFAULT 0,
+			clearing_price_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+			allocation_id TEXT NOT NULL DEFAULT '',
+			billing_rental_id TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_offer_bids_offer ON offer_bids(offer_id, status);
+		CREATE INDEX IF NOT EXISTS idx_offer_bids_user ON offer_bids(user_id, created_at DESC);
+		CREATE TABLE IF NOT EXISTS auction_clearings (
+			id TEXT PRIMARY KEY,
+			offer_id TEXT NOT NULL REFERENCES shared_inventory_offers(id) ON DELETE CASCADE,
+			rule TEXT NOT NULL,
+			period_start TIMESTAMPTZ NOT NULL,
+			period_end TIMESTAMPTZ NOT NULL,
+			clearing_price_usd DOUBLE PRECISION NOT NULL,
+			offered_qty INTEGER NOT NULL,
+			allocated_qty INTEGER NOT NULL,
+			bid_count INTEGER NOT NULL,
+			awards_json TEXT NOT NULL DEFAULT '[]',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_auction_clearings_offer ON auction_clearings(offer_id, period_start DESC);
 		CREATE TABLE IF NOT EXISTS health_checks (
 			id TEXT PRIMARY KEY,
 			resource_type TEXT NOT NULL,
@@ -170,6 +259,150 @@ func (r *Repo) Migrate(ctx context.Context) error {
 			captured_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		);
 		CREATE INDEX IF NOT EXISTS idx_metric_points_rt ON metric_points(resource_type, resource_id, metric_type, captured_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_metric_points_captured ON metric_points(captured_at);
+		ALTER TABLE metric_points ADD COLUMN IF NOT EXISTS provider_id TEXT NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS metric_rollups (
+			resolution TEXT NOT NULL,
+			resource_type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			metric_type TEXT NOT NULL,
+			bucket_start TIMESTAMPTZ NOT NULL,
+			min_value DOUBLE PRECISION NOT NULL,
+			max_value DOUBLE PRECISION NOT NULL,
+			sum_value DOUBLE PRECISION NOT NULL,
+			last_value DOUBLE PRECISION NOT NULL,
+			last_at TIMESTAMPTZ NOT NULL,
+			samples BIGINT NOT NULL,
+			PRIMARY KEY (resolution, resource_type, resource_id, metric_type, bucket_start)
+		);
+		CREATE INDEX IF NOT EXISTS idx_metric_rollups_bucket ON metric_rollups(resolution, bucket_start);
+		ALTER TABLE metric_rollups ADD COLUMN IF NOT EXISTS provider_id TEXT NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS metric_rollup_watermarks (
+			resolution TEXT PRIMARY KEY,
+			rolled_until TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS alert_rules (
+			id TEXT PRIMARY KEY,
+			owner_user_id TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			resource_type TEXT NOT NULL DEFAULT '',
+			resource_id TEXT NOT NULL DEFAULT '',
+			metric_type TEXT NOT NULL DEFAULT '',
+			comparator TEXT NOT NULL DEFAULT '',
+			threshold DOUBLE PRECISION NOT NULL DEFAULT 0,
+			check_type TEXT NOT NULL DEFAULT '',
+			health_status TEXT NOT NULL DEFAULT '',
+			for_seconds INTEGER NOT NULL DEFAULT 0,
+			severity TEXT NOT NULL,
+			channels_json TEXT NOT NULL DEFAULT '[]',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_alert_rules_owner ON alert_rules(owner_user_id, created_at DESC);
+		CREATE TABLE IF NOT EXISTS alerts (
+			id TEXT PRIMARY KEY,
+			rule_id TEXT NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+			resource_type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			state TEXT NOT NULL,
+			value DOUBLE PRECISION NOT NULL DEFAULT 0,
+			summary TEXT NOT NULL DEFAULT '',
+			started_at TIMESTAMPTZ NOT NULL,
+			fired_at TIMESTAMPTZ,
+			resolved_at TIMESTAMPTZ,
+			notified_state TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_open ON alerts(rule_id, resource_type, resource_id) WHERE state <> 'resolved';
+		CREATE INDEX IF NOT EXISTS idx_alerts_rule ON alerts(rule_id, started_at DESC);
+		CREATE TABLE IF NOT EXISTS alert_silences (
+			id TEXT PRIMARY KEY,
+			owner_user_id TEXT NOT NULL,
+			rule_id TEXT NOT NULL DEFAULT '',
+			resource_type TEXT NOT NULL DEFAULT '',
+			resource_id TEXT NOT NULL DEFAULT '',
+			comment TEXT NOT NULL DEFAULT '',
+			starts_at TIMESTAMPTZ NOT NULL,
+			ends_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_alert_silences_ends ON alert_silences(ends_at);
+		ALTER TABLE health_checks ADD COLUMN IF NOT EXISTS probe_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE health_checks ADD COLUMN IF NOT EXISTS latency_ms DOUBLE PRECISION NOT NULL DEFAULT 0;
+		ALTER TABLE vms ADD COLUMN IF NOT EXISTS health TEXT NOT NULL DEFAULT 'unknown';
+		ALTER TABLE vms ADD COLUMN IF NOT EXISTS health_probes_seeded BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS ip_address TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS health TEXT NOT NULL DEFAULT 'unknown';
+		ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS health_probes_seeded BOOLEAN NOT NULL DEFAULT FALSE;
+		CREATE TABLE IF NOT EXISTS health_probes (
+			id TEXT PRIMARY KEY,
+			resource_type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			port INTEGER NOT NULL DEFAULT 0,
+			path TEXT NOT NULL DEFAULT '',
+			expected_status INTEGER NOT NULL DEFAULT 0,
+			interval_seconds INTEGER NOT NULL,
+			timeout_seconds INTEGER NOT NULL,
+			failure_threshold INTEGER NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			consecutive_failures INTEGER NOT NULL DEFAULT 0,
+			last_status TEXT NOT NULL DEFAULT '',
+			last_latency_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+			last_checked_at TIMESTAMPTZ,
+			next_run_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_health_probes_resource ON health_probes(resource_type, resource_id);
+		CREATE INDEX IF NOT EXISTS idx_health_probes_due ON health_probes(next_run_at) WHERE enabled;
+		CREATE TABLE IF NOT EXISTS provider_presence (
+			provider_id TEXT PRIMARY KEY,
+			state TEXT NOT NULL DEFAULT '',
+			reason TEXT NOT NULL DEFAULT '',
+			last_poll_at TIMESTAMPTZ,
+			changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			flap_count INTEGER NOT NULL DEFAULT 0,
+			synced BOOLEAN NOT NULL DEFAULT TRUE,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_provider_presence_unsynced ON provider_presence(provider_id) WHERE NOT synced;
+		CREATE TABLE IF NOT EXISTS provider_presence_events (
+			id TEXT PRIMARY KEY,
+			provider_id TEXT NOT NULL,
+			from_state TEXT NOT NULL,
+			to_state TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_provider_presence_events_provider ON provider_presence_events(provider_id, created_at DESC);
+		CREATE TABLE IF NOT EXISTS sla_reports (
+			resource_type TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			period TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			provider_id TEXT NOT NULL DEFAULT '',
+			tier TEXT NOT NULL,
+			period_start TIMESTAMPTZ NOT NULL,
+			period_end TIMESTAMPTZ NOT NULL,
+			target_pct DOUBLE PRECISION NOT NULL,
+			uptime_pct DOUBLE PRECISION NOT NULL,
+			monitored_seconds BIGINT NOT NULL DEFAULT 0,
+			downtime_seconds BIGINT NOT NULL DEFAULT 0,
+			met BOOLEAN NOT NULL,
+			credit_pct DOUBLE PRECISION NOT NULL DEFAULT 0,
+			credit_status TEXT NOT NULL DEFAULT 'none',
+			credit_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (resource_type, resource_id, period)
+		);
+		CREATE INDEX IF NOT EXISTS idx_sla_reports_period ON sla_reports(period, credit_status);
+		CREATE INDEX IF NOT EXISTS idx_sla_reports_user ON sla_reports(user_id, period DESC);
 		CREATE TABLE IF NOT EXISTS agent_logs (
 			id TEXT PRIMARY KEY,
 			provider_id TEXT NOT NULL,
@@ -204,6 +437,189 @@ func (r *Repo) Migrate(ctx context.Context) error {
 		ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS cols INTEGER NOT NULL DEFAULT 0;
 		CREATE INDEX IF NOT EXISTS idx_agent_commands_provider ON agent_commands(provider_id, created_at DESC);
 		CREATE INDEX IF NOT EXISTS idx_agent_commands_queue ON agent_commands(provider_id, status, created_at ASC);
+		ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS seq BIGSERIAL;
+		CREATE INDEX IF NOT EXISTS idx_agent_commands_seq ON agent_commands(provider_id, seq);
+		ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS max_attempts INTEGER NOT NULL DEFAULT 3;
+		ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS timeout_seconds INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS deadline_at TIMESTAMPTZ;
+		ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS idx_agent_commands_open ON agent_commands(deadline_at) WHERE status IN ('queued', 'running');
+		CREATE INDEX IF NOT EXISTS idx_agent_commands_requester ON agent_commands(requested_by, created_at DESC);
+		ALTER TABLE agent_commands ADD COLUMN IF NOT EXISTS rollout_id TEXT NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS rollouts (
+			id TEXT PRIMARY KEY,
+			command TEXT NOT NULL,
+			payload TEXT NOT NULL DEFAULT '',
+			selector_json TEXT NOT NULL DEFAULT '{}',
+			waves_json TEXT NOT NULL DEFAULT '[]',
+			current_wave INTEGER NOT NULL DEFAULT 0,
+			max_concurrency INTEGER NOT NULL,
+			max_failure_pct INTEGER NOT NULL,
+			pause_between_waves BOOLEAN NOT NULL DEFAULT FALSE,
+			timeout_seconds INTEGER NOT NULL DEFAULT 0,
+			max_attempts INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL,
+			failure_window_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			finished_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS idx_rollouts_status ON rollouts(status, created_at DESC);
+		CREATE TABLE IF NOT EXISTS rollout_targets (
+			rollout_id TEXT NOT NULL REFERENCES rollouts(id) ON DELETE CASCADE,
+			provider_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			wave INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			command_id TEXT NOT NULL DEFAULT '',
+			detail TEXT NOT NULL DEFAULT '',
+			started_at TIMESTAMPTZ,
+			finished_at TIMESTAMPTZ,
+			PRIMARY KEY (rollout_id, provider_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_rollout_targets_status ON rollout_targets(rollout_id, status, position);
+		CREATE TABLE IF NOT EXISTS agent_enrollments (
+			id TEXT PRIMARY KEY,
+			provider_id TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			label TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL,
+			host_id TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_agent_enrollments_provider ON agent_enrollments(provider_id, created_at DESC);
+		CREATE TABLE IF NOT EXISTS agent_hosts (
+			id TEXT PRIMARY KEY,
+			provider_id TEXT NOT NULL,
+			hostname TEXT NOT NULL DEFAULT '',
+			label TEXT NOT NULL DEFAULT '',
+			enrollment_id TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'active',
+			credential_id TEXT NOT NULL,
+			previous_credential_id TEXT NOT NULL DEFAULT '',
+			credential_expires_at TIMESTAMPTZ NOT NULL,
+			rotated_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ,
+			revoked_by TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_agent_hosts_provider ON agent_hosts(provider_id, created_at DESC);
+		ALTER TABLE agent_hosts ADD COLUMN IF NOT EXISTS public_key TEXT NOT NULL DEFAULT '';
+		UPDATE agent_hosts h
+		SET status = 'revoked',
+		    revoked_at = NOW(),
+		    revoked_by = 'enrollment',
+		    updated_at = NOW()
+		WHERE h.status = 'active'
+		  AND EXISTS (
+			SELECT 1 FROM agent_hosts newer
+			WHERE newer.provider_id = h.provider_id
+			  AND newer.status = 'active'
+			  AND (newer.created_at, newer.id) > (h.created_at, h.id)
+		  );
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_agent_hosts_one_active ON agent_hosts(provider_id) WHERE status = 'active';
+		CREATE TABLE IF NOT EXISTS capacity_challenges (
+			id TEXT PRIMARY KEY,
+			provider_id TEXT NOT NULL,
+			command_id TEXT NOT NULL DEFAULT '',
+			kind TEXT NOT NULL,
+			nonce TEXT NOT NULL,
+			memory_mb INTEGER NOT NULL DEFAULT 0,
+			passes INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'pending',
+			detail TEXT NOT NULL DEFAULT '',
+			issued_by TEXT NOT NULL,
+			issued_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			completed_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS idx_capacity_challenges_provider ON capacity_challenges(provider_id, issued_at DESC);
+		CREATE TABLE IF NOT EXISTS host_verifications (
+			provider_id TEXT PRIMARY KEY,
+			status TEXT NOT NULL DEFAULT 'unverified',
+			reason TEXT NOT NULL DEFAULT '',
+			consecutive_passes INTEGER NOT NULL DEFAULT 0,
+			failed_challenges INTEGER NOT NULL DEFAULT 0,
+			last_challenge_at TIMESTAMPTZ,
+			flagged_at TIMESTAMPTZ,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS host_gpu_devices (
+			uuid TEXT PRIMARY KEY,
+			provider_id TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			memory_mb INTEGER NOT NULL DEFAULT 0,
+			seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_host_gpu_devices_provider ON host_gpu_devices(provider_id);
+		CREATE TABLE IF NOT EXISTS exec_policies (
+			provider_id TEXT PRIMARY KEY,
+			enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			allowed_commands_json TEXT NOT NULL DEFAULT '[]',
+			allow_scripts BOOLEAN NOT NULL DEFAULT FALSE,
+			max_timeout_seconds INTEGER NOT NULL DEFAULT 300,
+			run_as TEXT NOT NULL DEFAULT 'nobody',
+			updated_by TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS exec_runs (
+			id TEXT PRIMARY KEY,
+			provider_id TEXT NOT NULL,
+			command_id TEXT NOT NULL DEFAULT '',
+			requested_by TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			script TEXT NOT NULL DEFAULT '',
+			argv_json TEXT NOT NULL DEFAULT '[]',
+			work_dir TEXT NOT NULL DEFAULT '',
+			env_keys_json TEXT NOT NULL DEFAULT '[]',
+			run_as TEXT NOT NULL DEFAULT '',
+			timeout_seconds INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'queued',
+			detail TEXT NOT NULL DEFAULT '',
+			exit_code INTEGER NOT NULL DEFAULT 0,
+			stdout TEXT NOT NULL DEFAULT '',
+			stderr TEXT NOT NULL DEFAULT '',
+			output_truncated BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			started_at TIMESTAMPTZ,
+			finished_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS idx_exec_runs_provider ON exec_runs(provider_id, created_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_exec_runs_requested_by ON exec_runs(requested_by, created_at DESC);
+		CREATE TABLE IF NOT EXISTS file_transfers (
+			id TEXT PRIMARY KEY,
+			provider_id TEXT NOT NULL,
+			resource_id TEXT NOT NULL DEFAULT '',
+			requested_by TEXT NOT NULL,
+			grant_id TEXT NOT NULL DEFAULT '',
+			direction TEXT NOT NULL,
+			path TEXT NOT NULL,
+			size BIGINT NOT NULL DEFAULT 0,
+			sha256 TEXT NOT NULL DEFAULT '',
+			stored_bytes BIGINT NOT NULL DEFAULT 0,
+			host_bytes BIGINT NOT NULL DEFAULT 0,
+			status TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT '',
+			command_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			completed_at TIMESTAMPTZ,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_file_transfers_resource ON file_transfers(resource_id, created_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_file_transfers_provider ON file_transfers(provider_id, created_at DESC);
+		CREATE INDEX IF NOT EXISTS idx_file_transfers_expires ON file_transfers(expires_at);
+		CREATE TABLE IF NOT EXISTS file_transfer_chunks (
+			transfer_id TEXT NOT NULL REFERENCES file_transfers(id) ON DELETE CASCADE,
+			byte_offset BIGINT NOT NULL,
+			data BYTEA NOT NULL,
+			PRIMARY KEY (transfer_id, byte_offset)
+		);
 		CREATE TABLE IF NOT EXISTS terminal_sessions (
 			id TEXT PRIMARY KEY,
 			provider_id TEXT NOT NULL,
@@ -245,6 +661,25 @@ func (r *Repo) Migrate(ctx context.Context) error {
 		);
 		CREATE INDEX IF NOT EXISTS idx_terminal_audit_session ON terminal_audit_events(session_id, created_at DESC);
 		CREATE INDEX IF NOT EXISTS idx_terminal_audit_provider ON terminal_audit_events(provider_id, created_at DESC);
+		ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS grant_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE terminal_audit_events ADD COLUMN IF NOT EXISTS grant_id TEXT NOT NULL DEFAULT '';
+		CREATE INDEX IF NOT EXISTS idx_terminal_sessions_resource ON terminal_sessions(resource_id, created_at DESC);
+		ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS initial_rows INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS initial_cols INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS recording_purged_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS idx_terminal_sessions_recording ON terminal_sessions(closed_at) WHERE recording_purged_at IS NULL;
+		CREATE INDEX IF NOT EXISTS idx_terminal_audit_type ON terminal_audit_events(session_id, event_type, created_at);
+		CREATE TABLE IF NOT EXISTS terminal_participants (
+			session_id TEXT NOT NULL REFERENCES terminal_sessions(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			invited_by TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (session_id, user_id)
+		);
+		ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS reserved_input_seq BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE terminal_sessions ADD COLUMN IF NOT EXISTS reserved_output_seq BIGINT NOT NULL DEFAULT 0;
 		CREATE TABLE IF NOT EXISTS root_input_logs (
 			id TEXT PRIMARY KEY,
 			provider_id TEXT NOT NULL,
@@ -258,6 +693,22 @@ func (r *Repo) Migrate(ctx context.Context) error {
 		);
 		CREATE INDEX IF NOT EXISTS idx_root_input_logs_provider ON root_input_logs(provider_id, created_at DESC);
 		CREATE INDEX IF NOT EXISTS idx_root_input_logs_resource ON root_input_logs(resource_id, executed_at DESC);
+		CREATE TABLE IF NOT EXISTS resource_logs (
+			id TEXT PRIMARY KEY,
+			seq BIGSERIAL UNIQUE,
+			provider_id TEXT NOT NULL,
+			resource_id TEXT NOT NULL,
+			resource_type TEXT NOT NULL DEFAULT '',
+			source_type TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL DEFAULT '',
+			stream TEXT NOT NULL DEFAULT '',
+			level TEXT NOT NULL DEFAULT 'info',
+			message TEXT NOT NULL,
+			occurred_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_resource_logs_resource ON resource_logs(resource_id, seq DESC);
+		CREATE INDEX IF NOT EXISTS idx_resource_logs_created ON resource_logs(created_at);
 		CREATE TABLE IF NOT EXISTS pod_instances (
 			id TEXT PRIMARY KEY,
 			user_id TEXT NOT NULL,
@@ -274,6 +725,10 @@ func (r *Repo) Migrate(ctx context.Context) error {
 			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
 			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		);
+		ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS spec_json TEXT NOT NULL DEFAULT '{}';
+		ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS backend TEXT NOT NULL DEFAULT 'runpod';
+		ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS allocation_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pod_instances ADD COLUMN IF NOT EXISTS availability_tier TEXT NOT NULL DEFAULT 'low';
 		CREATE INDEX IF NOT EXISTS idx_pod_instances_user ON pod_instances(user_id, updated_at DESC);
 		CREATE INDEX IF NOT EXISTS idx_pod_instances_expiry ON pod_instances(status, expires_at);
 		CREATE TABLE IF NOT EXISTS create_rate_limit_events (
@@ -298,6 +753,13 @@ func (r *Repo) Migrate(ctx context.Context) error {
 			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		);
 		CREATE INDEX IF NOT EXISTS idx_k8s_clusters_user ON kubernetes_clusters(user_id, updated_at DESC);
+		CREATE TABLE IF NOT EXISTS stream_events (
+			id BIGSERIAL PRIMARY KEY,
+			origin TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_stream_events_created ON stream_events(created_at);
 	`)
 	if err != nil {
 		return err
@@ -309,11 +771,18 @@ func (r *Repo) UpsertHostResource(ctx context.Context, resource models.HostResou
 	if resource.ID == "" {
 		resource.ID = uuid.NewString()
 	}
-	_, err := r.db.Exec(ctx, `
+	if resource.Labels == nil {
+		resource.Labels = []string{}
+	}
+	labels, err := json.Marshal(resource.Labels)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(ctx, `
 		INSERT INTO host_resources (
-			id, provider_id, cpu_free_cores, ram_free_mb, gpu_free_units, gpu_total_units, gpu_memory_total_mb, gpu_memory_used_mb, network_mbps, heartbeat_at
+			id, provider_id, cpu_free_cores, ram_free_mb, gpu_free_units, gpu_total_units, gpu_memory_total_mb, gpu_memory_used_mb, network_mbps, heartbeat_at, signed, agent_version, region, labels_json
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 		ON CONFLICT (provider_id) DO UPDATE SET
 			cpu_free_cores = EXCLUDED.cpu_free_cores,
 			ram_free_mb = EXCLUDED.ram_free_mb,
@@ -322,20 +791,34 @@ func (r *Repo) UpsertHostResource(ctx context.Context, resource models.HostResou
 			gpu_memory_total_mb = EXCLUDED.gpu_memory_total_mb,
 			gpu_memory_used_mb = EXCLUDED.gpu_memory_used_mb,
 			network_mbps = EXCLUDED.network_mbps,
-			heartbeat_at = EXCLUDED.heartbeat_at
-	`, resource.ID, resource.ProviderID, resource.CPUFreeCores, resource.RAMFreeMB, resource.GPUFreeUnits, resource.GPUTotalUnits, resource.GPUMemoryTotalMB, resource.GPUMemoryUsedMB, resource.NetworkMbps, resource.HeartbeatAt)
+			heartbeat_at = EXCLUDED.heartbeat_at,
+			signed = EXCLUDED.signed,
+			agent_version = EXCLUDED.agent_version,
+			region = EXCLUDED.region,
+			labels_json = EXCLUDED.labels_json
+	`, resource.ID, resource.ProviderID, resource.CPUFreeCores, resource.RAMFreeMB, resource.GPUFreeUnits, resource.GPUTotalUnits, resource.GPUMemoryTotalMB, resource.GPUMemoryUsedMB, resource.NetworkMbps, resource.HeartbeatAt, resource.Signed, resource.AgentVersion, resource.Region, string(labels))
 	return err
 }
 
-func (r *Repo) GetHostResource(ctx context.Context, providerID string) (models.HostResource, error) {
+const hostResourceColumns = `id, provider_id, cpu_free_cores, ram_free_mb, gpu_free_units, gpu_total_units, gpu_memory_total_mb, gpu_memory_used_mb, network_mbps, heartbeat_at, signed, agent_version, region, labels_json`
+
+func scanHostResource(row pgx.Row) (models.HostResource, error) {
 	var out models.HostResource
-	err := r.db.QueryRow(ctx, `
-		SELECT id, provider_id, cpu_free_cores, ram_free_mb, gpu_free_units, gpu_total_units, gpu_memory_total_mb, gpu_memory_used_mb, network_mbps, heartbeat_at
+	var labels string
+	if err := row.Scan(&out.ID, &out.ProviderID, &out.CPUFreeCores, &out.RAMFreeMB, &out.GPUFreeUnits, &out.GPUTotalUnits, &out.GPUMemoryTotalMB, &out.GPUMemoryUsedMB, &out.NetworkMbps, &out.HeartbeatAt, &out.Signed, &out.AgentVersion, &out.Region, &labels); err != nil {
+		return models.HostResource{}, err
+	}
+	if err := json.Unmarshal([]byte(labels), &out.Labels); err != nil {
+		return models.HostResource{}, err
+	}
+	return out, nil
+}
+
+func (r *Repo) GetHostResource(ctx context.Context, providerID string) (models.HostResource, error) {
+	return scanHostResource(r.db.QueryRow(ctx, `
+		SELECT `+hostResourceColumns+`
 		FROM host_resources WHERE provider_id = $1
-	`, providerID).Scan(
-		&out.ID, &out.ProviderID, &out.CPUFreeCores, &out.RAMFreeMB, &out.GPUFreeUnits, &out.GPUTotalUnits, &out.GPUMemoryTotalMB, &out.GPUMemoryUsedMB, &out.NetworkMbps, &out.HeartbeatAt,
-	)
-	return out, err
+	`, providerID))
 }
 
 func (r *Repo) CreateAllocation(ctx context.Context, alloc models.Allocation) (models.Allocation, error) {
@@ -541,7 +1024,7 @@ func (r *Repo) CreateVM(ctx context.Context, vm models.VM) (models.VM, error) {
 			gpu_units, vram_gb, network_mbps, network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status
 		)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)
-		RETURNING created_at, updated_at
+		RETURNING created_at, updated_at, health
 	`,
 		vm.ID,
 		vm.UserID,
@@ -566,7 +1049,7 @@ func (r *Repo) CreateVM(ctx context.Context, vm models.VM) (models.VM, error) {
 		vm.ExternalID,
 		vm.ExpiresAt,
 		vm.Status,
-	).Scan(&vm.CreatedAt, &vm.UpdatedAt)
+	).Scan(&vm.CreatedAt, &vm.UpdatedAt, &vm.Health)
 	return vm, err
 }
 
@@ -574,14 +1057,14 @@ func (r *Repo) GetVM(ctx context.Context, vmID string) (models.VM, error) {
 	var out models.VM
 	err := r.db.QueryRow(ctx, `
 		SELECT id, user_id, provider_id, name, template, os_name, ip_address, region, cloud_type, cpu_cores, vcpu, ram_mb, system_ram_gb, gpu_units, vram_gb, network_mbps,
-		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at
+		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at, health
 		FROM vms
 		WHERE id = $1
 	`, vmID).Scan(
 		&out.ID, &out.UserID, &out.ProviderID, &out.Name, &out.Template, &out.OSName, &out.IPAddress, &out.Region, &out.CloudType,
 		&out.CPUCores, &out.VCPU, &out.RAMMB, &out.SystemRAMGB, &out.GPUUnits, &out.VRAMGB, &out.NetworkMbps,
 		&out.NetworkVolumeSupported, &out.GlobalNetworkingSupport, &out.AvailabilityTier, &out.MaxInstances, &out.ExternalID, &out.ExpiresAt,
-		&out.Status, &out.CreatedAt, &out.UpdatedAt,
+		&out.Status, &out.CreatedAt, &out.UpdatedAt, &out.Health,
 	)
 	return out, err
 }
@@ -598,7 +1081,7 @@ func (r *Repo) ListVMs(ctx context.Context, userID string, filter models.Catalog
 	}
 	rows, err := r.db.Query(ctx, `
 		SELECT id, user_id, provider_id, name, template, os_name, ip_address, region, cloud_type, cpu_cores, vcpu, ram_mb, system_ram_gb, gpu_units, vram_gb, network_mbps,
-		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at
+		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at, health
 		FROM vms
 		WHERE user_id = $1
 		  AND ($2 = '' OR status = $2)
@@ -622,7 +1105,7 @@ func (r *Repo) ListVMs(ctx context.Context, userID string, filter models.Catalog
 			&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.Template, &item.OSName, &item.IPAddress,
 			&item.Region, &item.CloudType, &item.CPUCores, &item.VCPU, &item.RAMMB, &item.SystemRAMGB, &item.GPUUnits, &item.VRAMGB, &item.NetworkMbps,
 			&item.NetworkVolumeSupported, &item.GlobalNetworkingSupport, &item.AvailabilityTier, &item.MaxInstances, &item.ExternalID, &item.ExpiresAt,
-			&item.Status, &item.CreatedAt, &item.UpdatedAt,
+			&item.Status, &item.CreatedAt, &item.UpdatedAt, &item.Health,
 		); err != nil {
 			return nil, err
 		}
@@ -637,7 +1120,7 @@ func (r *Repo) ListAllVMs(ctx context.Context, limit int) ([]models.VM, error) {
 	}
 	rows, err := r.db.Query(ctx, `
 		SELECT id, user_id, provider_id, name, template, os_name, ip_address, region, cloud_type, cpu_cores, vcpu, ram_mb, system_ram_gb, gpu_units, vram_gb, network_mbps,
-		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at
+		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at, health
 		FROM vms
 		ORDER BY updated_at DESC
 		LIMIT $1
@@ -653,7 +1136,7 @@ func (r *Repo) ListAllVMs(ctx context.Context, limit int) ([]models.VM, error) {
 			&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.Template, &item.OSName, &item.IPAddress,
 			&item.Region, &item.CloudType, &item.CPUCores, &item.VCPU, &item.RAMMB, &item.SystemRAMGB, &item.GPUUnits, &item.VRAMGB, &item.NetworkMbps,
 			&item.NetworkVolumeSupported, &item.GlobalNetworkingSupport, &item.AvailabilityTier, &item.MaxInstances, &item.ExternalID, &item.ExpiresAt,
-			&item.Status, &item.CreatedAt, &item.UpdatedAt,
+			&item.Status, &item.CreatedAt, &item.UpdatedAt, &item.Health,
 		); err != nil {
 			return nil, err
 		}
@@ -665,10 +1148,13 @@ func (r *Repo) ListAllVMs(ctx context.Context, limit int) ([]models.VM, error) {
 func (r *Repo) UpdateVMStatus(ctx context.Context, vmID string, status models.VMStatus) error {
 	_, err := r.db.Exec(ctx, `
 		UPDATE vms
-		SET status = $2, updated_at = NOW()
+		SET status = $2, health = CASE WHEN $2 = 'running' THEN health ELSE 'unknown' END, updated_at = NOW()
 		WHERE id = $1
 	`, vmID, status)
-	return err
+	if err != nil || status == models.VMStatusRunning {
+		return err
+	}
+	return r.resetHealthProbes(ctx, "vm", vmID)
 }
 
 func (r *Repo) UpdateVMExternalRef(ctx context.Context, vmID string, externalID string, ipAddress string) error {
@@ -683,7 +1169,7 @@ func (r *Repo) UpdateVMExternalRef(ctx context.Context, vmID string, externalID
 func (r *Repo) ListExpiredVMs(ctx context.Context, now time.Time, limit int) ([]models.VM, error) {
 	rows, err := r.db.Query(ctx, `
 		SELECT id, user_id, provider_id, name, template, os_name, ip_address, region, cloud_type, cpu_cores, vcpu, ram_mb, system_ram_gb, gpu_units, vram_gb, network_mbps,
-		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at
+		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at, health
 		FROM vms
 		WHERE status IN ('running', 'stopped')
 		  AND expires_at <= $1
@@ -701,7 +1187,7 @@ func (r *Repo) ListExpiredVMs(ctx context.Context, now time.Time, limit int) ([]
 			&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.Template, &item.OSName, &item.IPAddress, &item.Region, &item.CloudType,
 			&item.CPUCores, &item.VCPU, &item.RAMMB, &item.SystemRAMGB, &item.GPUUnits, &item.VRAMGB, &item.NetworkMbps,
 			&item.NetworkVolumeSupported, &item.GlobalNetworkingSupport, &item.AvailabilityTier, &item.MaxInstances, &item.ExternalID, &item.ExpiresAt,
-			&item.Status, &item.CreatedAt, &item.UpdatedAt,
+			&item.Status, &item.CreatedAt, &item.UpdatedAt, &item.Health,
 		); err != nil {
 			return nil, err
 		}
@@ -713,42 +1199,96 @@ func (r *Repo) ListExpiredVMs(ctx context.Context, now time.Time, limit int) ([]
 func (r *Repo) MarkVMExpired(ctx context.Context, vmID string) error {
 	_, err := r.db.Exec(ctx, `
 		UPDATE vms
-		SET status = $2, updated_at = NOW()
+		SET status = $2, health = 'unknown', updated_at = NOW()
 		WHERE id = $1
 	`, vmID, models.VMStatusExpired)
-	return err
+	if err != nil {
+		return err
+	}
+	return r.resetHealthProbes(ctx, "vm", vmID)
 }
 
 func (r *Repo) CreatePod(ctx context.Context, pod models.Pod) (models.Pod, error) {
 	if pod.ID == "" {
 		pod.ID = uuid.NewString()
 	}
-	err := r.db.QueryRow(ctx, `
+	specJSON, err := encodePodSpec(pod)
+	if err != nil {
+		return models.Pod{}, err
+	}
+	err = r.db.QueryRow(ctx, `
 		INSERT INTO pod_instances (
-			id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status
+			id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, spec_json, backend, allocation_id, availability_tier
 		)
-		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
-		RETURNING created_at, updated_at
-	`, pod.ID, pod.UserID, pod.ProviderID, pod.Name, pod.ImageName, pod.GPUTypeID, pod.GPUCount, pod.CPUCount, pod.MemoryGB, pod.ExternalID, pod.ExpiresAt, pod.Status).Scan(&pod.CreatedAt, &pod.UpdatedAt)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)
+		RETURNING created_at, updated_at, health
+	`, pod.ID, pod.UserID, pod.ProviderID, pod.Name, pod.ImageName, pod.GPUTypeID, pod.GPUCount, pod.CPUCount, pod.MemoryGB, pod.ExternalID, pod.ExpiresAt, pod.Status, specJSON, pod.Backend, pod.AllocationID, pod.AvailabilityTier).Scan(&pod.CreatedAt, &pod.UpdatedAt, &pod.Health)
 	return pod, err
 }
 
-func (r *Repo) GetPod(ctx context.Context, podID string) (models.Pod, error) {
+type podSpecRecord struct {
+	Env             []models.PodEnvVar      `json:"env,omitempty"`
+	Command         []string                `json:"command,omitempty"`
+	Args            []string                `json:"args,omitempty"`
+	Ports           []models.PodPort        `json:"ports,omitempty"`
+	ContainerDiskGB int                     `json:"container_disk_gb,omitempty"`
+	VolumeMounts    []models.PodVolumeMount `json:"volume_mounts,omitempty"`
+	RegistryAuthID  string                  `json:"registry_auth_id,omitempty"`
+}
+
+func encodePodSpec(pod models.Pod) (string, error) {
+	raw, err := json.Marshal(podSpecRecord{
+		Env:             pod.Env,
+		Command:         pod.Command,
+		Args:            pod.Args,
+		Ports:           pod.Ports,
+		ContainerDiskGB: pod.ContainerDiskGB,
+		VolumeMounts:    pod.VolumeMounts,
+		RegistryAuthID:  pod.RegistryAuthID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+func scanPod(row pgx.Row) (models.Pod, error) {
 	var item models.Pod
-	err := r.db.QueryRow(ctx, `
-		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at
+	var specJSON string
+	if err := row.Scan(
+		&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.ImageName, &item.GPUTypeID, &item.GPUCount, &item.CPUCount, &item.MemoryGB,
+		&item.ExternalID, &item.ExpiresAt, &item.Status, &item.CreatedAt, &item.UpdatedAt, &specJSON, &item.Backend, &item.AllocationID,
+		&item.IPAddress, &item.Health, &item.AvailabilityTier,
+	); err != nil {
+		return models.Pod{}, err
+	}
+	var spec podSpecRecord
+	if specJSON != "" {
+		if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+			return models.Pod{}, err
+		}
+	}
+	item.Env = spec.Env
+	item.Command = spec.Command
+	item.Args = spec.Args
+	item.Ports = spec.Ports
+	item.ContainerDiskGB = spec.ContainerDiskGB
+	item.VolumeMounts = spec.VolumeMounts
+	item.RegistryAuthID = spec.RegistryAuthID
+	return item, nil
+}
+
+func (r *Repo) GetPod(ctx context.Context, podID string) (models.Pod, error) {
+	return scanPod(r.db.QueryRow(ctx, `
+		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at, spec_json, backend, allocation_id, ip_address, health, availability_tier
 		FROM pod_instances
 		WHERE id = $1
-	`, podID).Scan(
-		&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.ImageName, &item.GPUTypeID, &item.GPUCount, &item.CPUCount, &item.MemoryGB,
-		&item.ExternalID, &item.ExpiresAt, &item.Status, &item.CreatedAt, &item.UpdatedAt,
-	)
-	return item, err
+	`, podID))
 }
 
 func (r *Repo) ListPods(ctx context.Context, userID string, _ models.CatalogFilter) ([]models.Pod, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at
+		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at, spec_json, backend, allocation_id, ip_address, health, availability_tier
 		FROM pod_instances
 		WHERE user_id = $1
 		ORDER BY updated_at DESC
@@ -759,11 +1299,8 @@ func (r *Repo) ListPods(ctx context.Context, userID string, _ models.CatalogFilt
 	defer rows.Close()
 	out := make([]models.Pod, 0)
 	for rows.Next() {
-		var item models.Pod
-		if err := rows.Scan(
-			&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.ImageName, &item.GPUTypeID, &item.GPUCount, &item.CPUCount, &item.MemoryGB,
-			&item.ExternalID, &item.ExpiresAt, &item.Status, &item.CreatedAt, &item.UpdatedAt,
-		); err != nil {
+		item, err := scanPod(rows)
+		if err != nil {
 			return nil, err
 		}
 		out = append(out, item)
@@ -776,7 +1313,7 @@ func (r *Repo) ListAllPods(ctx context.Context, limit int) ([]models.Pod, error)
 		limit = 500
 	}
 	rows, err := r.db.Query(ctx, `
-		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at
+		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at, spec_json, backend, allocation_id, ip_address, health, availability_tier
 		FROM pod_instances
 		ORDER BY updated_at DESC
 		LIMIT $1
@@ -787,11 +1324,8 @@ func (r *Repo) ListAllPods(ctx context.Context, limit int) ([]models.Pod, error)
 	defer rows.Close()
 	out := make([]models.Pod, 0)
 	for rows.Next() {
-		var item models.Pod
-		if err := rows.Scan(
-			&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.ImageName, &item.GPUTypeID, &item.GPUCount, &item.CPUCount, &item.MemoryGB,
-			&item.ExternalID, &item.ExpiresAt, &item.Status, &item.CreatedAt, &item.UpdatedAt,
-		); err != nil {
+		item, err := scanPod(rows)
+		if err != nil {
 			return nil, err
 		}
 		out = append(out, item)
@@ -799,27 +1333,66 @@ func (r *Repo) ListAllPods(ctx context.Context, limit int) ([]models.Pod, error)
 	return out, nil
 }
 
+// ListRunningLocalPods returns every running pod on the local backend.
+func (r *Repo) ListRunningLocalPods(ctx context.Context) ([]models.Pod, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at, spec_json, backend, allocation_id, ip_address, health, availability_tier
+		FROM pod_instances
+		WHERE backend = 'local' AND status = 'running'
+		ORDER BY provider_id, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.Pod, 0)
+	for rows.Next() {
+		item, err := scanPod(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
 func (r *Repo) UpdatePodStatus(ctx context.Context, podID string, status models.PodStatus) error {
 	_, err := r.db.Exec(ctx, `
 		UPDATE pod_instances
-		SET status = $2, updated_at = NOW()
+		SET status = $2, health = CASE WHEN $2 = 'running' THEN health ELSE 'unknown' END, updated_at = NOW()
 		WHERE id = $1
 	`, podID, status)
-	return err
+	if err != nil || status == models.PodStatusRunning {
+		return err
+	}
+	return r.resetHealthProbes(ctx, "pod", podID)
 }
 
-func (r *Repo) UpdatePodExternalRef(ctx context.Context, podID string, externalID string) error {
+func (r *Repo) UpdatePodExternalRef(ctx context.Context, podID string, externalID string, ipAddress string) error {
 	_, err := r.db.Exec(ctx, `
 		UPDATE pod_instances
-		SET external_id = $2, updated_at = NOW()
+		SET external_id = $2, ip_address = COALESCE(NULLIF($3, ''), ip_address), updated_at = NOW()
+		WHERE id = $1
+	`, podID, externalID, ipAddress)
+	return err
+}
+
+func (r *Repo) UpdatePodPorts(ctx context.Context, podID string, ports []models.PodPort) error {
+	raw, err := json.Marshal(ports)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(ctx, `
+		UPDATE pod_instances
+		SET spec_json = jsonb_set(spec_json::jsonb, '{ports}', $2::jsonb)::text, updated_at = NOW()
 		WHERE id = $1
-	`, podID, externalID)
+	`, podID, string(raw))
 	return err
 }
 
 func (r *Repo) ListExpiredPods(ctx context.Context, now time.Time, limit int) ([]models.Pod, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at
+		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at, spec_json, backend, allocation_id, ip_address, health, availability_tier
 		FROM pod_instances
 		WHERE status IN ('running', 'stopped')
 		  AND expires_at <= $1
@@ -832,11 +1405,8 @@ func (r *Repo) ListExpiredPods(ctx context.Context, now time.Time, limit int) ([
 	defer rows.Close()
 	out := make([]models.Pod, 0)
 	for rows.Next() {
-		var item models.Pod
-		if err := rows.Scan(
-			&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.ImageName, &item.GPUTypeID, &item.GPUCount, &item.CPUCount, &item.MemoryGB,
-			&item.ExternalID, &item.ExpiresAt, &item.Status, &item.CreatedAt, &item.UpdatedAt,
-		); err != nil {
+		item, err := scanPod(rows)
+		if err != nil {
 			return nil, err
 		}
 		out = append(out, item)
@@ -853,23 +1423,12 @@ func (r *Repo) MarkPodExpired(ctx context.Context, podID string) error {
 	return err
 }
 
-func (r *Repo) CreateSharedVM(ctx context.Context, item models.SharedVM) (models.SharedVM, error) {
-	if item.ID == "" {
-		item.ID = uuid.NewString()
-	}
-	err := r.db.QueryRow(ctx, `
-		INSERT INTO shared_vms (id, vm_id, owner_user_id, shared_with, access_level)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING created_at
-	`, item.ID, item.VMID, item.OwnerUserID, joinCSV(item.SharedWith), item.AccessLevel).Scan(&item.CreatedAt)
-	return item, err
-}
-
 func (r *Repo) ListSharedVMs(ctx context.Context, userID string) ([]models.SharedVM, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, vm_id, owner_user_id, shared_with, access_level, created_at
+		SELECT id, vm_id, owner_user_id, shared_with, access_level, status, invite_email, expires_at, created_at
 		FROM shared_vms
-		WHERE owner_user_id = $1 OR shared_with LIKE '%' || $1 || '%'
+		WHERE (owner_user_id = $1 OR $1 = ANY(string_to_array(shared_with, ',')))
+		  AND status IN ('pending', 'active')
 		ORDER BY created_at DESC
 	`, userID)
 	if err != nil {
@@ -880,7 +1439,7 @@ func (r *Repo) ListSharedVMs(ctx context.Context, userID string) ([]models.Share
 	for rows.Next() {
 		var item models.SharedVM
 		var sharedWith string
-		if err := rows.Scan(&item.ID, &item.VMID, &item.OwnerUserID, &sharedWith, &item.AccessLevel, &item.CreatedAt); err != nil {
+		if err := rows.Scan(&item.ID, &item.VMID, &item.OwnerUserID, &sharedWith, &item.AccessLevel, &item.Status, &item.InviteEmail, &item.ExpiresAt, &item.CreatedAt); err != nil {
 			return nil, err
 		}
 		item.SharedWith = splitCSV(sharedWith)
@@ -889,23 +1448,12 @@ func (r *Repo) ListSharedVMs(ctx context.Context, userID string) ([]models.Share
 	return out, nil
 }
 
-func (r *Repo) CreateSharedPod(ctx context.Context, item models.SharedPod) (models.SharedPod, error) {
-	if item.ID == "" {
-		item.ID = uuid.NewString()
-	}
-	err := r.db.QueryRow(ctx, `
-		INSERT INTO shared_pods (id, pod_code, owner_user_id, shared_with, access_level)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING created_at
-	`, item.ID, item.PodCode, item.OwnerUserID, joinCSV(item.SharedWith), item.AccessLevel).Scan(&item.CreatedAt)
-	return item, err
-}
-
 func (r *Repo) ListSharedPods(ctx context.Context, userID string) ([]models.SharedPod, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, pod_code, owner_user_id, shared_with, access_level, created_at
+		SELECT id, pod_code, owner_user_id, shared_with, access_level, status, invite_email, expires_at, created_at
 		FROM shared_pods
-		WHERE owner_user_id = $1 OR shared_with LIKE '%' || $1 || '%'
+		WHERE (owner_user_id = $1 OR $1 = ANY(string_to_array(shared_with, ',')))
+		  AND status IN ('pending', 'active')
 		ORDER BY created_at DESC
 	`, userID)
 	if err != nil {
@@ -916,7 +1464,7 @@ func (r *Repo) ListSharedPods(ctx context.Context, userID string) ([]models.Shar
 	for rows.Next() {
 		var item models.SharedPod
 		var sharedWith string
-		if err := rows.Scan(&item.ID, &item.PodCode, &item.OwnerUserID, &sharedWith, &item.AccessLevel, &item.CreatedAt); err != nil {
+		if err := rows.Scan(&item.ID, &item.PodCode, &item.OwnerUserID, &sharedWith, &item.AccessLevel, &item.Status, &item.InviteEmail, &item.ExpiresAt, &item.CreatedAt); err != nil {
 			return nil, err
 		}
 		item.SharedWith = splitCSV(sharedWith)
@@ -925,35 +1473,245 @@ func (r *Repo) ListSharedPods(ctx context.Context, userID string) ([]models.Shar
 	return out, nil
 }
 
-func (r *Repo) CreateHealthCheck(ctx context.Context, item models.HealthCheck) (models.HealthCheck, error) {
-	if item.ID == "" {
-		item.ID = uuid.NewString()
+// shareTable maps a grant resource type onto the legacy share table holding it.
+func shareTable(resourceType string) (string, string, error) {
+	switch resourceType {
+	case "vm":
+		return "shared_vms", "vm_id", nil
+	case "pod":
+		return "shared_pods", "pod_code", nil
+	default:
+		return "", "", errors.New("resource_type must be vm or pod")
 	}
-	err := r.db.QueryRow(ctx, `
-		INSERT INTO health_checks (id, resource_type, resource_id, check_type, status, details, checked_at)
-		VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, NOW()))
-		RETURNING checked_at
-	`, item.ID, item.ResourceType, item.ResourceID, item.CheckType, item.Status, item.Details, nullableTime(item.CheckedAt)).Scan(&item.CheckedAt)
+}
+
+func shareGrantColumns(idColumn string) string {
+	return `id, ` + idColumn + `, owner_user_id, shared_with, invite_email, access_level, status, expires_at, accepted_at, revoked_at, created_at, updated_at`
+}
+
+func scanShareGrant(row pgx.Row, resourceType string) (models.ShareGrant, error) {
+	item := models.ShareGrant{ResourceType: resourceType}
+	err := row.Scan(&item.ID, &item.ResourceID, &item.OwnerUserID, &item.GranteeUserID, &item.InviteEmail, &item.AccessLevel, &item.Status, &item.ExpiresAt, &item.AcceptedAt, &item.RevokedAt, &item.CreatedAt, &item.UpdatedAt)
 	return item, err
 }
 
-func (r *Repo) ListHealthChecks(ctx context.Context, resourceType string, resourceID string, limit int) ([]models.HealthCheck, error) {
-	rows, err := r.db.Query(ctx, `
-		SELECT id, resource_type, resource_id, check_type, status, details, checked_at
-		FROM health_checks
-		WHERE ($1 = '' OR resource_type = $1)
-		  AND ($2 = '' OR resource_id = $2)
-		ORDER BY checked_at DESC
-		LIMIT $3
-	`, resourceType, resourceID, limit)
+func (r *Repo) CreateShareGrant(ctx context.Context, item models.ShareGrant) (models.ShareGrant, error) {
+	return insertShareGrant(ctx, r.db.QueryRow, item)
+}
+
+// CreateShareGrants stores all grants or, on the first failure, none.
+func (r *Repo) CreateShareGrants(ctx context.Context, items []models.ShareGrant) ([]models.ShareGrant, error) {
+	tx, err := r.db.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	out := make([]models.HealthCheck, 0)
-	for rows.Next() {
-		var item models.HealthCheck
-		if err := rows.Scan(&item.ID, &item.ResourceType, &item.ResourceID, &item.CheckType, &item.Status, &item.Details, &item.CheckedAt); err != nil {
+	defer tx.Rollback(ctx)
+
+	out := make([]models.ShareGrant, 0, len(items))
+	for _, item := range items {
+		created, err := insertShareGrant(ctx, tx.QueryRow, item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, created)
+	}
+	return out, tx.Commit(ctx)
+}
+
+func insertShareGrant(ctx context.Context, queryRow func(context.Context, string, ...any) pgx.Row, item models.ShareGrant) (models.ShareGrant, error) {
+	table, idColumn, err := shareTable(item.ResourceType)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanShareGrant(queryRow(ctx, `
+		INSERT INTO `+table+` (id, `+idColumn+`, owner_user_id, shared_with, invite_email, access_level, status, expires_at, accepted_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+shareGrantColumns(idColumn)+`
+	`, item.ID, item.ResourceID, item.OwnerUserID, item.GranteeUserID, item.InviteEmail, item.AccessLevel, item.Status, item.ExpiresAt, item.AcceptedAt), item.ResourceType)
+}
+
+func (r *Repo) GetShareGrant(ctx context.Context, resourceType string, grantID string) (models.ShareGrant, error) {
+	table, idColumn, err := shareTable(resourceType)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	return scanShareGrant(r.db.QueryRow(ctx, `
+		SELECT `+shareGrantColumns(idColumn)+`
+		FROM `+table+`
+		WHERE id = $1
+	`, grantID), resourceType)
+}
+
+func (r *Repo) ListShareGrants(ctx context.Context, resourceType string, resourceID string) ([]models.ShareGrant, error) {
+	table, idColumn, err := shareTable(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.Query(ctx, `
+		SELECT `+shareGrantColumns(idColumn)+`
+		FROM `+table+`
+		WHERE `+idColumn+` = $1
+		ORDER BY created_at DESC
+	`, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.ShareGrant, 0)
+	for rows.Next() {
+		item, err := scanShareGrant(rows, resourceType)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) ListShareGrantsForGrantee(ctx context.Context, userID string) ([]models.ShareGrant, error) {
+	out := make([]models.ShareGrant, 0)
+	for _, resourceType := range []string{"vm", "pod"} {
+		table, idColumn, _ := shareTable(resourceType)
+		rows, err := r.db.Query(ctx, `
+			SELECT `+shareGrantColumns(idColumn)+`
+			FROM `+table+`
+			WHERE $1 = ANY(string_to_array(shared_with, ','))
+			  AND status IN ('pending', 'active')
+			ORDER BY created_at DESC
+		`, userID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			item, err := scanShareGrant(rows, resourceType)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out = append(out, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (r *Repo) UpdateShareGrant(ctx context.Context, item models.ShareGrant) (models.ShareGrant, error) {
+	table, idColumn, err := shareTable(item.ResourceType)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	return scanShareGrant(r.db.QueryRow(ctx, `
+		UPDATE `+table+`
+		SET access_level = $2, status = $3, expires_at = $4, accepted_at = $5, revoked_at = $6, updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+shareGrantColumns(idColumn)+`
+	`, item.ID, item.AccessLevel, item.Status, item.ExpiresAt, item.AcceptedAt, item.RevokedAt), item.ResourceType)
+}
+
+func (r *Repo) ExpireShareGrants(ctx context.Context, now time.Time, limit int) ([]models.ShareGrant, error) {
+	out := make([]models.ShareGrant, 0)
+	for _, resourceType := range []string{"vm", "pod"} {
+		table, idColumn, _ := shareTable(resourceType)
+		rows, err := r.db.Query(ctx, `
+			UPDATE `+table+`
+			SET status = 'expired', updated_at = NOW()
+			WHERE id IN (
+				SELECT id FROM `+table+`
+				WHERE status IN ('pending', 'active') AND expires_at IS NOT NULL AND expires_at <= $1
+				ORDER BY expires_at ASC
+				LIMIT $2
+			)
+			RETURNING `+shareGrantColumns(idColumn)+`
+		`, now, limit)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			item, err := scanShareGrant(rows, resourceType)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out = append(out, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (r *Repo) CreateShareAuditEvent(ctx context.Context, event models.ShareAuditEvent) (models.ShareAuditEvent, error) {
+	if event.ID == "" {
+		event.ID = uuid.NewString()
+	}
+	err := r.db.QueryRow(ctx, `
+		INSERT INTO share_audit_events (id, grant_id, resource_type, resource_id, actor_user_id, action, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created_at
+	`, event.ID, event.GrantID, event.ResourceType, event.ResourceID, event.ActorUserID, event.Action, event.Details).Scan(&event.CreatedAt)
+	return event, err
+}
+
+func (r *Repo) ListShareAuditEvents(ctx context.Context, resourceType string, resourceID string, limit int) ([]models.ShareAuditEvent, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, grant_id, resource_type, resource_id, actor_user_id, action, details, created_at
+		FROM share_audit_events
+		WHERE resource_type = $1 AND resource_id = $2
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, resourceType, resourceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.ShareAuditEvent, 0)
+	for rows.Next() {
+		var item models.ShareAuditEvent
+		if err := rows.Scan(&item.ID, &item.GrantID, &item.ResourceType, &item.ResourceID, &item.ActorUserID, &item.Action, &item.Details, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) CreateHealthCheck(ctx context.Context, item models.HealthCheck) (models.HealthCheck, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	err := r.db.QueryRow(ctx, `
+		INSERT INTO health_checks (id, resource_type, resource_id, check_type, status, details, checked_at, probe_id, latency_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, NOW()), $8, $9)
+		RETURNING checked_at
+	`, item.ID, item.ResourceType, item.ResourceID, item.CheckType, item.Status, item.Details, nullableTime(item.CheckedAt), item.ProbeID, item.LatencyMS).Scan(&item.CheckedAt)
+	return item, err
+}
+
+func (r *Repo) ListHealthChecks(ctx context.Context, resourceType string, resourceID string, limit int) ([]models.HealthCheck, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, resource_type, resource_id, check_type, status, details, checked_at, probe_id, latency_ms
+		FROM health_checks
+		WHERE ($1 = '' OR resource_type = $1)
+		  AND ($2 = '' OR resource_id = $2)
+		ORDER BY checked_at DESC
+		LIMIT $3
+	`, resourceType, resourceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.HealthCheck, 0)
+	for rows.Next() {
+		var item models.HealthCheck
+		if err := rows.Scan(&item.ID, &item.ResourceType, &item.ResourceID, &item.CheckType, &item.Status, &item.Details, &item.CheckedAt, &item.ProbeID, &item.LatencyMS); err != nil {
 			return nil, err
 		}
 		out = append(out, item)
@@ -966,25 +1724,26 @@ func (r *Repo) CreateMetricPoint(ctx context.Context, item models.MetricPoint) (
 		item.ID = uuid.NewString()
 	}
 	err := r.db.QueryRow(ctx, `
-		INSERT INTO metric_points (id, resource_type, resource_id, metric_type, value, captured_at)
-		VALUES ($1, $2, $3, $4, $5, COALESCE($6, NOW()))
+		INSERT INTO metric_points (id, resource_type, resource_id, metric_type, value, captured_at, provider_id)
+		VALUES ($1, $2, $3, $4, $5, COALESCE($6, NOW()), $7)
 		RETURNING captured_at
-	`, item.ID, item.ResourceType, item.ResourceID, item.MetricType, item.Value, nullableTime(item.CapturedAt)).Scan(&item.CapturedAt)
+	`, item.ID, item.ResourceType, item.ResourceID, item.MetricType, item.Value, nullableTime(item.CapturedAt), item.ProviderID).Scan(&item.CapturedAt)
 	return item, err
 }
 
-func (r *Repo) ListMetricPoints(ctx context.Context, resourceType string, resourceID string, metricType string, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error) {
+func (r *Repo) ListMetricPoints(ctx context.Context, filter models.MetricFilter, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, resource_type, resource_id, metric_type, value, captured_at
+		SELECT id, resource_type, resource_id, metric_type, value, captured_at, provider_id
 		FROM metric_points
 		WHERE ($1 = '' OR resource_type = $1)
 		  AND ($2 = '' OR resource_id = $2)
 		  AND ($3 = '' OR metric_type = $3)
 		  AND ($4::timestamptz IS NULL OR captured_at >= $4::timestamptz)
 		  AND ($5::timestamptz IS NULL OR captured_at <= $5::timestamptz)
+		  AND ($7 = '' OR provider_id = $7)
 		ORDER BY captured_at DESC
 		LIMIT $6
-	`, resourceType, resourceID, metricType, nullableTime(from), nullableTime(to), limit)
+	`, filter.ResourceType, filter.ResourceID, filter.MetricType, nullableTime(from), nullableTime(to), limit, filter.ProviderID)
 	if err != nil {
 		return nil, err
 	}
@@ -992,7 +1751,7 @@ func (r *Repo) ListMetricPoints(ctx context.Context, resourceType string, resour
 	out := make([]models.MetricPoint, 0)
 	for rows.Next() {
 		var item models.MetricPoint
-		if err := rows.Scan(&item.ID, &item.ResourceType, &item.ResourceID, &item.MetricType, &item.Value, &item.CapturedAt); err != nil {
+		if err := rows.Scan(&item.ID, &item.ResourceType, &item.ResourceID, &item.MetricType, &item.Value, &item.CapturedAt, &item.ProviderID); err != nil {
 			return nil, err
 		}
 		out = append(out, item)
@@ -1031,225 +1790,2847 @@ func (r *Repo) MetricSummaries(ctx context.Context, limit int) ([]models.MetricS
 	return out, nil
 }
 
-func (r *Repo) UpsertSharedInventoryOffer(ctx context.Context, item models.SharedInventoryOffer) (models.SharedInventoryOffer, error) {
-	if item.ID == "" {
-		item.ID = uuid.NewString()
+// metricRollupSources builds each rollup tier from the tier below it: minute
+// buckets from raw points, hour buckets from minute buckets. Buckets are cut
+// in UTC so they do not move with the session time zone.
+var metricRollupSources = map[models.MetricResolution]string{
+	models.MetricResolutionMinute: `
+		SELECT resource_type, resource_id, metric_type,
+			date_trunc('minute', captured_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS bucket_start,
+			MIN(value), MAX(value), SUM(value),
+			(ARRAY_AGG(value ORDER BY captured_at DESC))[1], MAX(captured_at), COUNT(*), MAX(provider_id)
+		FROM metric_points
+		WHERE ($2::timestamptz IS NULL OR captured_at >= $2::timestamptz)
+		  AND captured_at < $3
+		GROUP BY 1, 2, 3, 4`,
+	models.MetricResolutionHour: `
+		SELECT resource_type, resource_id, metric_type,
+			date_trunc('hour', bucket_start AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS bucket_start,
+			MIN(min_value), MAX(max_value), SUM(sum_value),
+			(ARRAY_AGG(last_value ORDER BY last_at DESC))[1], MAX(last_at), SUM(samples), MAX(provider_id)
+		FROM metric_rollups
+		WHERE resolution = '1m'
+		  AND ($2::timestamptz IS NULL OR bucket_start >= $2::timestamptz)
+		  AND bucket_start < $3
+		GROUP BY 1, 2, 3, 4`,
+}
+
+// RollupMetrics recomputes every bucket of resolution in [from, to) from the
+// tier below and moves the tier watermark to to. Buckets are replaced rather
+// than merged, so rerunning a window is harmless. A zero from means the tier
+// has never run and everything before to is rolled up.
+func (r *Repo) RollupMetrics(ctx context.Context, resolution models.MetricResolution, from time.Time, to time.Time) (int64, error) {
+	source, ok := metricRollupSources[resolution]
+	if !ok {
+		return 0, fmt.Errorf("unsupported rollup resolution %s", resolution)
 	}
+	var rolled int64
 	err := r.db.QueryRow(ctx, `
-		INSERT INTO shared_inventory_offers (
-			id, provider_id, resource_type, title, description, cpu_cores, ram_mb, gpu_units, network_mbps,
-			quantity, available_qty, price_hourly_usd, status, created_by
+		WITH rolled AS (
+			INSERT INTO metric_rollups (resource_type, resource_id, metric_type, bucket_start, min_value, max_value, sum_value, last_value, last_at, samples, provider_id, resolution)
+			SELECT source.*, $1 FROM (`+source+`) source
+			ON CONFLICT (resolution, resource_type, resource_id, metric_type, bucket_start) DO UPDATE SET
+				min_value = EXCLUDED.min_value,
+				max_value = EXCLUDED.max_value,
+				sum_value = EXCLUDED.sum_value,
+				last_value = EXCLUDED.last_value,
+				last_at = EXCLUDED.last_at,
+				samples = EXCLUDED.samples,
+				provider_id = EXCLUDED.provider_id
+			RETURNING 1
+		),
+		marked AS (
+			INSERT INTO metric_rollup_watermarks (resolution, rolled_until)
+			VALUES ($1, $3)
+			ON CONFLICT (resolution) DO UPDATE SET rolled_until = GREATEST(metric_rollup_watermarks.rolled_until, EXCLUDED.rolled_until)
 		)
-		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)
-		ON CONFLICT (id) DO UPDATE SET
-			resource_type = EXCLUDED.resource_type,
-			title = EXCLUDED.title,
-			description = EXCLUDED.description,
-			cpu_cores = EXCLUDED.cpu_cores,
-			ram_mb = EXCLUDED.ram_mb,
-			gpu_units = EXCLUDED.gpu_units,
-			network_mbps = EXCLUDED.network_mbps,
-			quantity = EXCLUDED.quantity,
-			available_qty = EXCLUDED.available_qty,
-			price_hourly_usd = EXCLUDED.price_hourly_usd,
-			status = EXCLUDED.status,
-			updated_at = NOW()
-		RETURNING created_at, updated_at
-	`, item.ID, item.ProviderID, item.ResourceType, item.Title, item.Description, item.CPUCores, item.RAMMB, item.GPUUnits, item.NetworkMbps, item.Quantity, item.AvailableQty, item.PriceHourly, item.Status, item.CreatedBy).Scan(&item.CreatedAt, &item.UpdatedAt)
-	return item, err
+		SELECT COUNT(*) FROM rolled
+	`, resolution, nullableTime(from), to).Scan(&rolled)
+	return rolled, err
 }
 
-func (r *Repo) ListSharedInventoryOffers(ctx context.Context, status string, providerID string) ([]models.SharedInventoryOffer, error) {
+func (r *Repo) MetricRollupWatermark(ctx context.Context, resolution models.MetricResolution) (time.Time, error) {
+	var out time.Time
+	err := r.db.QueryRow(ctx, `SELECT rolled_until FROM metric_rollup_watermarks WHERE resolution = $1`, resolution).Scan(&out)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return out, err
+}
+
+func (r *Repo) ListMetricRollups(ctx context.Context, resolution models.MetricResolution, filter models.MetricFilter, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, provider_id, resource_type, title, description, cpu_cores, ram_mb, gpu_units, network_mbps, quantity, available_qty, price_hourly_usd, status, created_by, created_at, updated_at
-		FROM shared_inventory_offers
-		WHERE ($1 = '' OR status = $1)
-		  AND ($2 = '' OR provider_id = $2)
-		ORDER BY updated_at DESC
-	`, status, providerID)
+		SELECT resource_type, resource_id, metric_type, bucket_start, min_value, max_value, sum_value, last_value, last_at, samples, provider_id
+		FROM metric_rollups
+		WHERE resolution = $1
+		  AND ($2 = '' OR resource_type = $2)
+		  AND ($3 = '' OR resource_id = $3)
+		  AND ($4 = '' OR metric_type = $4)
+		  AND ($5::timestamptz IS NULL OR bucket_start >= $5::timestamptz)
+		  AND ($6::timestamptz IS NULL OR bucket_start <= $6::timestamptz)
+		  AND ($8 = '' OR provider_id = $8)
+		ORDER BY bucket_start DESC
+		LIMIT $7
+	`, resolution, filter.ResourceType, filter.ResourceID, filter.MetricType, nullableTime(from), nullableTime(to), limit, filter.ProviderID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	out := make([]models.SharedInventoryOffer, 0)
+	out := make([]models.MetricPoint, 0)
 	for rows.Next() {
-		var item models.SharedInventoryOffer
-		if err := rows.Scan(&item.ID, &item.ProviderID, &item.ResourceType, &item.Title, &item.Description, &item.CPUCores, &item.RAMMB, &item.GPUUnits, &item.NetworkMbps, &item.Quantity, &item.AvailableQty, &item.PriceHourly, &item.Status, &item.CreatedBy, &item.CreatedAt, &item.UpdatedAt); err != nil {
+		item := models.MetricPoint{Resolution: resolution, Rollup: &models.MetricRollupStats{}}
+		var sum float64
+		if err := rows.Scan(&item.ResourceType, &item.ResourceID, &item.MetricType, &item.CapturedAt, &item.Rollup.Min, &item.Rollup.Max, &sum, &item.Rollup.Last, &item.Rollup.LastAt, &item.Rollup.Samples, &item.ProviderID); err != nil {
 			return nil, err
 		}
+		if item.Rollup.Samples > 0 {
+			item.Value = sum / float64(item.Rollup.Samples)
+		}
 		out = append(out, item)
 	}
-	return out, nil
+	return out, rows.Err()
 }
 
-func (r *Repo) ReserveSharedInventoryOffer(ctx context.Context, offerID string, quantity int) (models.SharedInventoryOffer, error) {
-	cmd, err := r.db.Exec(ctx, `
-		UPDATE shared_inventory_offers
-		SET available_qty = available_qty - $2,
-		    status = CASE WHEN available_qty - $2 <= 0 THEN 'sold_out' ELSE status END,
-		    updated_at = NOW()
-		WHERE id = $1
-		  AND available_qty >= $2
-	`, offerID, quantity)
+func (r *Repo) DeleteMetricPointsBefore(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	tag, err := r.db.Exec(ctx, `
+		DELETE FROM metric_points
+		WHERE id IN (
+			SELECT id FROM metric_points
+			WHERE captured_at < $1
+			ORDER BY captured_at ASC
+			LIMIT $2
+		)
+	`, cutoff, limit)
 	if err != nil {
-		return models.SharedInventoryOffer{}, err
+		return 0, err
 	}
-	if cmd.RowsAffected() == 0 {
-		return models.SharedInventoryOffer{}, errors.New("offer not found or insufficient available quantity")
+	return tag.RowsAffected(), nil
+}
+
+func (r *Repo) DeleteMetricRollupsBefore(ctx context.Context, resolution models.MetricResolution, cutoff time.Time, limit int) (int64, error) {
+	tag, err := r.db.Exec(ctx, `
+		DELETE FROM metric_rollups
+		WHERE ctid IN (
+			SELECT ctid FROM metric_rollups
+			WHERE resolution = $1 AND bucket_start < $2
+			ORDER BY bucket_start ASC
+			LIMIT $3
+		)
+	`, resolution, cutoff, limit)
+	if err != nil {
+		return 0, err
 	}
+	return tag.RowsAffected(), nil
+}
+
+const sharedOfferColumns = `id, provider_id, resource_type, title, description, cpu_cores, ram_mb, gpu_units, network_mbps, quantity, available_qty, price_hourly_usd, status, pricing_mode, auction_rule, clearing_period_minutes, next_clearing_at, last_clearing_price_usd, created_by, created_at, updated_at`
+
+func scanSharedOffer(row pgx.Row) (models.SharedInventoryOffer, error) {
 	var item models.SharedInventoryOffer
-	err = r.db.QueryRow(ctx, `
-		SELECT id, provider_id, resource_type, title, description, cpu_cores, ram_mb, gpu_units, network_mbps, quantity, available_qty, price_hourly_usd, status, created_by, created_at, updated_at
-		FROM shared_inventory_offers
-		WHERE id = $1
-	`, offerID).Scan(&item.ID, &item.ProviderID, &item.ResourceType, &item.Title, &item.Description, &item.CPUCores, &item.RAMMB, &item.GPUUnits, &item.NetworkMbps, &item.Quantity, &item.AvailableQty, &item.PriceHourly, &item.Status, &item.CreatedBy, &item.CreatedAt, &item.UpdatedAt)
+	err := row.Scan(&item.ID, &item.ProviderID, &item.ResourceType, &item.Title, &item.Description, &item.CPUCores, &item.RAMMB, &item.GPUUnits, &item.NetworkMbps, &item.Quantity, &item.AvailableQty, &item.PriceHourly, &item.Status, &item.PricingMode, &item.AuctionRule, &item.ClearingPeriodMin, &item.NextClearingAt, &item.LastClearingPriceUSD, &item.CreatedBy, &item.CreatedAt, &item.UpdatedAt)
 	return item, err
 }
 
-func (r *Repo) CreateAgentLog(ctx context.Context, item models.AgentLog) (models.AgentLog, error) {
+func (r *Repo) ListHostResources(ctx context.Context) ([]models.HostResource, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+hostResourceColumns+`
+		FROM host_resources
+		ORDER BY provider_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.HostResource, 0)
+	for rows.Next() {
+		item, err := scanHostResource(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// LatestMetricPoints returns the newest point per resource matching filter that
+// was captured at or after since.
+func (r *Repo) LatestMetricPoints(ctx context.Context, filter models.MetricFilter, since time.Time) ([]models.MetricPoint, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT DISTINCT ON (resource_type, resource_id) id, resource_type, resource_id, metric_type, value, captured_at, provider_id
+		FROM metric_points
+		WHERE metric_type = $1
+		  AND ($2 = '' OR resource_type = $2)
+		  AND ($3 = '' OR resource_id = $3)
+		  AND ($4 = '' OR provider_id = $4)
+		  AND captured_at >= $5
+		ORDER BY resource_type, resource_id, captured_at DESC
+	`, filter.MetricType, filter.ResourceType, filter.ResourceID, filter.ProviderID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.MetricPoint, 0)
+	for rows.Next() {
+		var item models.MetricPoint
+		if err := rows.Scan(&item.ID, &item.ResourceType, &item.ResourceID, &item.MetricType, &item.Value, &item.CapturedAt, &item.ProviderID); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// LatestHealthChecks returns the newest check per resource and check type
+// recorded at or after since.
+func (r *Repo) LatestHealthChecks(ctx context.Context, resourceType string, resourceID string, checkType string, since time.Time) ([]models.HealthCheck, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT DISTINCT ON (resource_type, resource_id, check_type) id, resource_type, resource_id, check_type, status, details, checked_at, probe_id, latency_ms
+		FROM health_checks
+		WHERE ($1 = '' OR resource_type = $1)
+		  AND ($2 = '' OR resource_id = $2)
+		  AND ($3 = '' OR check_type = $3)
+		  AND checked_at >= $4
+		ORDER BY resource_type, resource_id, check_type, checked_at DESC
+	`, resourceType, resourceID, checkType, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.HealthCheck, 0)
+	for rows.Next() {
+		var item models.HealthCheck
+		if err := rows.Scan(&item.ID, &item.ResourceType, &item.ResourceID, &item.CheckType, &item.Status, &item.Details, &item.CheckedAt, &item.ProbeID, &item.LatencyMS); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+const alertRuleColumns = `id, owner_user_id, scope, name, kind, resource_type, resource_id, metric_type, comparator, threshold, check_type, health_status, for_seconds, severity, channels_json, enabled, created_at, updated_at`
+
+func scanAlertRule(row pgx.Row) (models.AlertRule, error) {
+	var item models.AlertRule
+	var channels string
+	if err := row.Scan(&item.ID, &item.OwnerUserID, &item.Scope, &item.Name, &item.Kind, &item.ResourceType, &item.ResourceID, &item.MetricType, &item.Comparator, &item.Threshold, &item.CheckType, &item.HealthStatus, &item.ForSeconds, &item.Severity, &channels, &item.Enabled, &item.CreatedAt, &item.UpdatedAt); err != nil {
+		return models.AlertRule{}, err
+	}
+	if err := json.Unmarshal([]byte(channels), &item.Channels); err != nil {
+		return models.AlertRule{}, err
+	}
+	return item, nil
+}
+
+func (r *Repo) CreateAlertRule(ctx context.Context, item models.AlertRule) (models.AlertRule, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	if item.Channels == nil {
+		item.Channels = []models.AlertChannel{}
+	}
+	channels, err := json.Marshal(item.Channels)
+	if err != nil {
+		return models.AlertRule{}, err
+	}
+	return scanAlertRule(r.db.QueryRow(ctx, `
+		INSERT INTO alert_rules (id, owner_user_id, scope, name, kind, resource_type, resource_id, metric_type, comparator, threshold, check_type, health_status, for_seconds, severity, channels_json, enabled)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)
+		RETURNING `+alertRuleColumns,
+		item.ID, item.OwnerUserID, item.Scope, item.Name, item.Kind, item.ResourceType, item.ResourceID, item.MetricType, item.Comparator, item.Threshold, item.CheckType, item.HealthStatus, item.ForSeconds, item.Severity, string(channels), item.Enabled))
+}
+
+func (r *Repo) GetAlertRule(ctx context.Context, ruleID string) (models.AlertRule, error) {
+	return scanAlertRule(r.db.QueryRow(ctx, `SELECT `+alertRuleColumns+` FROM alert_rules WHERE id = $1`, ruleID))
+}
+
+func (r *Repo) ListAlertRules(ctx context.Context, ownerUserID string, enabledOnly bool) ([]models.AlertRule, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+alertRuleColumns+`
+		FROM alert_rules
+		WHERE ($1 = '' OR owner_user_id = $1)
+		  AND (NOT $2 OR enabled)
+		ORDER BY created_at DESC
+	`, ownerUserID, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.AlertRule, 0)
+	for rows.Next() {
+		item, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) DeleteAlertRule(ctx context.Context, ruleID string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM alert_rules WHERE id = $1`, ruleID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+const alertColumns = `a.id, a.rule_id, ar.name, ar.severity, a.resource_type, a.resource_id, a.state, a.value, a.summary, a.started_at, a.fired_at, a.resolved_at, a.notified_state, a.updated_at`
+
+func scanAlert(row pgx.Row) (models.Alert, error) {
+	var item models.Alert
+	err := row.Scan(&item.ID, &item.RuleID, &item.RuleName, &item.Severity, &item.ResourceType, &item.ResourceID, &item.State, &item.Value, &item.Summary, &item.StartedAt, &item.FiredAt, &item.ResolvedAt, &item.NotifiedState, &item.UpdatedAt)
+	return item, err
+}
+
+func (r *Repo) queryAlerts(ctx context.Context, query string, args ...any) ([]models.Alert, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.Alert, 0)
+	for rows.Next() {
+		item, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// CreateAlert opens an alert for a rule and resource. It returns pgx.ErrNoRows
+// when another evaluator already holds an open alert for the same pair.
+func (r *Repo) CreateAlert(ctx context.Context, item models.Alert) (models.Alert, error) {
 	if item.ID == "" {
 		item.ID = uuid.NewString()
 	}
-	err := r.db.QueryRow(ctx, `
-		INSERT INTO agent_logs (id, provider_id, resource_id, level, message, source)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING created_at
-	`, item.ID, item.ProviderID, item.ResourceID, item.Level, item.Message, item.Source).Scan(&item.CreatedAt)
-	return item, err
+	return scanAlert(r.db.QueryRow(ctx, `
+		WITH a AS (
+			INSERT INTO alerts (id, rule_id, resource_type, resource_id, state, value, summary, started_at, fired_at)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+			ON CONFLICT (rule_id, resource_type, resource_id) WHERE state <> 'resolved' DO NOTHING
+			RETURNING *
+		)
+		SELECT `+alertColumns+` FROM a JOIN alert_rules ar ON ar.id = a.rule_id
+	`, item.ID, item.RuleID, item.ResourceType, item.ResourceID, item.State, item.Value, item.Summary, item.StartedAt, item.FiredAt))
+}
+
+func (r *Repo) UpdateAlert(ctx context.Context, item models.Alert) (models.Alert, error) {
+	return scanAlert(r.db.QueryRow(ctx, `
+		WITH a AS (
+			UPDATE alerts
+			SET state = $2, value = $3, summary = $4, fired_at = $5, resolved_at = $6, updated_at = NOW()
+			WHERE id = $1
+			RETURNING *
+		)
+		SELECT `+alertColumns+` FROM a JOIN alert_rules ar ON ar.id = a.rule_id
+	`, item.ID, item.State, item.Value, item.Summary, item.FiredAt, item.ResolvedAt))
+}
+
+// ListOpenAlerts returns pending and firing alerts plus resolved ones whose
+// resolution has not been announced yet.
+func (r *Repo) ListOpenAlerts(ctx context.Context) ([]models.Alert, error) {
+	return r.queryAlerts(ctx, `
+		SELECT `+alertColumns+`
+		FROM alerts a JOIN alert_rules ar ON ar.id = a.rule_id
+		WHERE a.state <> 'resolved' OR a.notified_state = 'firing'
+	`)
+}
+
+func (r *Repo) ListAlerts(ctx context.Context, ownerUserID string, state string, limit int) ([]models.Alert, error) {
+	return r.queryAlerts(ctx, `
+		SELECT `+alertColumns+`
+		FROM alerts a JOIN alert_rules ar ON ar.id = a.rule_id
+		WHERE ($1 = '' OR ar.owner_user_id = $1)
+		  AND ($2 = '' OR a.state = $2)
+		ORDER BY a.started_at DESC
+		LIMIT $3
+	`, ownerUserID, state, limit)
+}
+
+// ClaimAlertNotification moves notified_state from one value to another so
+// only one evaluator announces each transition.
+func (r *Repo) ClaimAlertNotification(ctx context.Context, alertID string, from models.AlertState, to models.AlertState) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE alerts SET notified_state = $3 WHERE id = $1 AND notified_state = $2`, alertID, from, to)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+const alertSilenceColumns = `id, owner_user_id, rule_id, resource_type, resource_id, comment, starts_at, ends_at, created_at`
+
+func scanAlertSilence(row pgx.Row) (models.AlertSilence, error) {
+	var item models.AlertSilence
+	err := row.Scan(&item.ID, &item.OwnerUserID, &item.RuleID, &item.ResourceType, &item.ResourceID, &item.Comment, &item.StartsAt, &item.EndsAt, &item.CreatedAt)
+	return item, err
+}
+
+func (r *Repo) CreateAlertSilence(ctx context.Context, item models.AlertSilence) (models.AlertSilence, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanAlertSilence(r.db.QueryRow(ctx, `
+		INSERT INTO alert_silences (id, owner_user_id, rule_id, resource_type, resource_id, comment, starts_at, ends_at)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+		RETURNING `+alertSilenceColumns,
+		item.ID, item.OwnerUserID, item.RuleID, item.ResourceType, item.ResourceID, item.Comment, item.StartsAt, item.EndsAt))
+}
+
+func (r *Repo) GetAlertSilence(ctx context.Context, silenceID string) (models.AlertSilence, error) {
+	return scanAlertSilence(r.db.QueryRow(ctx, `SELECT `+alertSilenceColumns+` FROM alert_silences WHERE id = $1`, silenceID))
+}
+
+// ListAlertSilences lists silences of ownerUserID (all owners when empty);
+// a non-zero activeAt keeps only the silences in effect at that time.
+func (r *Repo) ListAlertSilences(ctx context.Context, ownerUserID string, activeAt time.Time) ([]models.AlertSilence, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+alertSilenceColumns+`
+		FROM alert_silences
+		WHERE ($1 = '' OR owner_user_id = $1)
+		  AND ($2::timestamptz IS NULL OR (starts_at <= $2::timestamptz AND ends_at > $2::timestamptz))
+		ORDER BY ends_at DESC
+		LIMIT 500
+	`, ownerUserID, nullableTime(activeAt))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.AlertSilence, 0)
+	for rows.Next() {
+		item, err := scanAlertSilence(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) EndAlertSilence(ctx context.Context, silenceID string, at time.Time) (models.AlertSilence, error) {
+	return scanAlertSilence(r.db.QueryRow(ctx, `
+		UPDATE alert_silences
+		SET ends_at = LEAST(ends_at, GREATEST(starts_at, $2))
+		WHERE id = $1
+		RETURNING `+alertSilenceColumns, silenceID, at))
+}
+
+const healthProbeColumns = `id, resource_type, resource_id, kind, port, path, expected_status, interval_seconds, timeout_seconds, failure_threshold, enabled, consecutive_failures, last_status, last_latency_ms, last_checked_at, next_run_at, created_by, created_at, updated_at`
+
+func scanHealthProbe(row pgx.Row, extra ...any) (models.HealthProbe, error) {
+	var item models.HealthProbe
+	dest := []any{&item.ID, &item.ResourceType, &item.ResourceID, &item.Kind, &item.Port, &item.Path, &item.ExpectedStatus, &item.IntervalSeconds, &item.TimeoutSeconds, &item.FailureThreshold, &item.Enabled, &item.ConsecutiveFailures, &item.LastStatus, &item.LastLatencyMS, &item.LastCheckedAt, &item.NextRunAt, &item.CreatedBy, &item.CreatedAt, &item.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return models.HealthProbe{}, err
+	}
+	return item, nil
+}
+
+func (r *Repo) CreateHealthProbe(ctx context.Context, item models.HealthProbe) (models.HealthProbe, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanHealthProbe(r.db.QueryRow(ctx, `
+		INSERT INTO health_probes (
+			id, resource_type, resource_id, kind, port, path, expected_status, interval_seconds, timeout_seconds, failure_threshold, enabled, next_run_at, created_by
+		)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+		RETURNING `+healthProbeColumns,
+		item.ID, item.ResourceType, item.ResourceID, item.Kind, item.Port, item.Path, item.ExpectedStatus,
+		item.IntervalSeconds, item.TimeoutSeconds, item.FailureThreshold, item.Enabled, item.NextRunAt, item.CreatedBy))
+}
+
+func (r *Repo) GetHealthProbe(ctx context.Context, probeID string) (models.HealthProbe, error) {
+	return scanHealthProbe(r.db.QueryRow(ctx, `SELECT `+healthProbeColumns+` FROM health_probes WHERE id = $1`, probeID))
+}
+
+func (r *Repo) ListHealthProbes(ctx context.Context, resourceType string, resourceID string) ([]models.HealthProbe, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+healthProbeColumns+`
+		FROM health_probes
+		WHERE resource_type = $1 AND resource_id = $2
+		ORDER BY created_at ASC
+	`, resourceType, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.HealthProbe, 0)
+	for rows.Next() {
+		item, err := scanHealthProbe(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) DeleteHealthProbe(ctx context.Context, probeID string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM health_probes WHERE id = $1`, probeID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ListUnprobedVMs returns running VMs with an address that have not had their
+// default probes created yet.
+func (r *Repo) ListUnprobedVMs(ctx context.Context, limit int) ([]models.VM, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, user_id, provider_id, name, template, os_name, ip_address, region, cloud_type, cpu_cores, vcpu, ram_mb, system_ram_gb, gpu_units, vram_gb, network_mbps,
+		       network_volume_supported, global_networking_supported, availability_tier, max_instances, external_id, expires_at, status, created_at, updated_at, health
+		FROM vms
+		WHERE status = 'running' AND ip_address <> '' AND NOT health_probes_seeded
+		ORDER BY created_at ASC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.VM, 0)
+	for rows.Next() {
+		var item models.VM
+		if err := rows.Scan(
+			&item.ID, &item.UserID, &item.ProviderID, &item.Name, &item.Template, &item.OSName, &item.IPAddress, &item.Region, &item.CloudType,
+			&item.CPUCores, &item.VCPU, &item.RAMMB, &item.SystemRAMGB, &item.GPUUnits, &item.VRAMGB, &item.NetworkMbps,
+			&item.NetworkVolumeSupported, &item.GlobalNetworkingSupport, &item.AvailabilityTier, &item.MaxInstances, &item.ExternalID, &item.ExpiresAt,
+			&item.Status, &item.CreatedAt, &item.UpdatedAt, &item.Health,
+		); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ListUnprobedPods is the pod counterpart of ListUnprobedVMs.
+func (r *Repo) ListUnprobedPods(ctx context.Context, limit int) ([]models.Pod, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, user_id, provider_id, name, image_name, gpu_type_id, gpu_count, cpu_count, memory_gb, external_id, expires_at, status, created_at, updated_at, spec_json, backend, allocation_id, ip_address, health, availability_tier
+		FROM pod_instances
+		WHERE status = 'running' AND ip_address <> '' AND NOT health_probes_seeded
+		ORDER BY created_at ASC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.Pod, 0)
+	for rows.Next() {
+		item, err := scanPod(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) MarkHealthProbesSeeded(ctx context.Context, resourceType string, resourceID string) error {
+	table := "vms"
+	if resourceType == "pod" {
+		table = "pod_instances"
+	}
+	_, err := r.db.Exec(ctx, `UPDATE `+table+` SET health_probes_seeded = TRUE WHERE id = $1`, resourceID)
+	return err
+}
+
+// ClaimDueHealthProbes pushes next_run_at of up to limit due probes forward by
+// their interval and returns them with Address resolved. Probes of resources
+// that are not running are left alone.
+func (r *Repo) ClaimDueHealthProbes(ctx context.Context, now time.Time, limit int) ([]models.HealthProbe, error) {
+	rows, err := r.db.Query(ctx, `
+		WITH due AS (
+			SELECT p.id, COALESCE(v.ip_address, pi.ip_address, '') AS address
+			FROM health_probes p
+			LEFT JOIN vms v ON p.resource_type = 'vm' AND v.id = p.resource_id
+			LEFT JOIN pod_instances pi ON p.resource_type = 'pod' AND pi.id = p.resource_id
+			WHERE p.enabled
+			  AND p.next_run_at <= $1
+			  AND COALESCE(v.status, pi.status) = 'running'
+			ORDER BY p.next_run_at ASC
+			LIMIT $2
+			FOR UPDATE OF p SKIP LOCKED
+		)
+		UPDATE health_probes p
+		SET next_run_at = $1 + make_interval(secs => p.interval_seconds), updated_at = NOW()
+		FROM due
+		WHERE p.id = due.id
+		RETURNING p.id, p.resource_type, p.resource_id, p.kind, p.port, p.path, p.expected_status, p.interval_seconds, p.timeout_seconds,
+		          p.failure_threshold, p.enabled, p.consecutive_failures, p.last_status, p.last_latency_ms, p.last_checked_at, p.next_run_at,
+		          p.created_by, p.created_at, p.updated_at, due.address
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.HealthProbe, 0)
+	for rows.Next() {
+		var address string
+		item, err := scanHealthProbe(rows, &address)
+		if err != nil {
+			return nil, err
+		}
+		item.Address = address
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// RecordHealthProbeResult stores the outcome of one probe run, counting
+// consecutive failures, and returns the updated probe.
+func (r *Repo) RecordHealthProbeResult(ctx context.Context, probeID string, status models.HealthStatus, latencyMS float64, checkedAt time.Time) (models.HealthProbe, error) {
+	return scanHealthProbe(r.db.QueryRow(ctx, `
+		UPDATE health_probes
+		SET consecutive_failures = CASE WHEN $2 = 'ok' THEN 0 ELSE consecutive_failures + 1 END,
+		    last_status = $2, last_latency_ms = $3, last_checked_at = $4, updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+healthProbeColumns, probeID, status, latencyMS, checkedAt))
+}
+
+func (r *Repo) resetHealthProbes(ctx context.Context, resourceType string, resourceID string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE health_probes
+		SET consecutive_failures = 0, updated_at = NOW()
+		WHERE resource_type = $1 AND resource_id = $2 AND consecutive_failures > 0
+	`, resourceType, resourceID)
+	return err
+}
+
+// SetResourceHealth updates the health of a running VM or pod and reports
+// whether it changed.
+func (r *Repo) SetResourceHealth(ctx context.Context, resourceType string, resourceID string, health models.ResourceHealth) (bool, error) {
+	table := "vms"
+	if resourceType == "pod" {
+		table = "pod_instances"
+	}
+	tag, err := r.db.Exec(ctx, `
+		UPDATE `+table+`
+		SET health = $2
+		WHERE id = $1 AND status = 'running' AND health <> $2
+	`, resourceID, health)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// TouchAgentPoll records that providerID's agent polled for commands.
+func (r *Repo) TouchAgentPoll(ctx context.Context, providerID string, at time.Time) error {
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO provider_presence (provider_id, last_poll_at, changed_at)
+		VALUES ($1, $2, $2)
+		ON CONFLICT (provider_id) DO UPDATE SET
+			last_poll_at = GREATEST(provider_presence.last_poll_at, EXCLUDED.last_poll_at)
+	`, providerID, at)
+	return err
+}
+
+// ListPresenceInputs returns every provider with a heartbeat or a presence
+// row, with its current state (empty when never evaluated) and liveness inputs.
+func (r *Repo) ListPresenceInputs(ctx context.Context) ([]models.ProviderPresence, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT COALESCE(hr.provider_id, pp.provider_id), COALESCE(pp.state, ''), COALESCE(pp.reason, ''), hr.heartbeat_at, pp.last_poll_at,
+		       COALESCE(pp.changed_at, NOW()), COALESCE(pp.flap_count, 0), COALESCE(pp.synced, TRUE), COALESCE(pp.updated_at, NOW())
+		FROM host_resources hr
+		FULL OUTER JOIN provider_presence pp ON pp.provider_id = hr.provider_id
+		ORDER BY 1
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.ProviderPresence, 0)
+	for rows.Next() {
+		var item models.ProviderPresence
+		if err := rows.Scan(&item.ProviderID, &item.State, &item.Reason, &item.HeartbeatAt, &item.LastPollAt, &item.ChangedAt, &item.FlapCount, &item.Synced, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// RecordPresenceChange moves a provider from one state to another and appends
+// the transition to its history. It returns false without writing when the
+// stored state is no longer from, e.g. because another replica got there first.
+func (r *Repo) RecordPresenceChange(ctx context.Context, item models.ProviderPresence, from models.ProviderPresenceState) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO provider_presence (provider_id, state, reason, changed_at, synced)
+		VALUES ($1, $2, $3, $4, FALSE)
+		ON CONFLICT (provider_id) DO UPDATE SET
+			state = EXCLUDED.state,
+			reason = EXCLUDED.reason,
+			changed_at = EXCLUDED.changed_at,
+			flap_count = provider_presence.flap_count + CASE WHEN provider_presence.state = '' THEN 0 ELSE 1 END,
+			synced = FALSE,
+			updated_at = NOW()
+		WHERE provider_presence.state = $5
+	`, item.ProviderID, item.State, item.Reason, item.ChangedAt, from)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO provider_presence_events (id, provider_id, from_state, to_state, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, uuid.NewString(), item.ProviderID, from, item.State, item.Reason, item.ChangedAt); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// ListProviderPresence lists evaluated providers, optionally narrowed to one
+// provider, one state or the ones whose latest change is not yet pushed.
+// RecentFlaps counts transitions in the last 24 hours.
+func (r *Repo) ListProviderPresence(ctx context.Context, providerID string, state string, unsyncedOnly bool, limit int) ([]models.ProviderPresence, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT pp.provider_id, pp.state, pp.reason, hr.heartbeat_at, pp.last_poll_at, pp.changed_at, pp.flap_count,
+		       (SELECT COUNT(*) FROM provider_presence_events e
+		        WHERE e.provider_id = pp.provider_id AND e.from_state <> '' AND e.created_at >= NOW() - INTERVAL '24 hours'),
+		       pp.synced, pp.updated_at
+		FROM provider_presence pp
+		LEFT JOIN host_resources hr ON hr.provider_id = pp.provider_id
+		WHERE pp.state <> ''
+		  AND ($1 = '' OR pp.provider_id = $1)
+		  AND ($2 = '' OR pp.state = $2)
+		  AND (NOT $3 OR NOT pp.synced)
+		ORDER BY pp.provider_id
+		LIMIT $4
+	`, providerID, state, unsyncedOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.ProviderPresence, 0)
+	for rows.Next() {
+		var item models.ProviderPresence
+		if err := rows.Scan(&item.ProviderID, &item.State, &item.Reason, &item.HeartbeatAt, &item.LastPollAt, &item.ChangedAt, &item.FlapCount, &item.RecentFlaps, &item.Synced, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// MarkPresenceSynced flags a pushed change; a newer change in the meantime
+// keeps the row unsynced.
+func (r *Repo) MarkPresenceSynced(ctx context.Context, providerID string, changedAt time.Time) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE provider_presence
+		SET synced = TRUE
+		WHERE provider_id = $1 AND changed_at = $2
+	`, providerID, changedAt)
+	return err
+}
+
+func (r *Repo) ListPresenceEvents(ctx context.Context, providerID string, limit int) ([]models.ProviderPresenceEvent, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, provider_id, from_state, to_state, reason, created_at
+		FROM provider_presence_events
+		WHERE provider_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, providerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.ProviderPresenceEvent, 0)
+	for rows.Next() {
+		var item models.ProviderPresenceEvent
+		if err := rows.Scan(&item.ID, &item.ProviderID, &item.FromState, &item.ToState, &item.Reason, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ListHealthChecksBetween returns a resource's checks from oldest to newest,
+// starting with the last check before from so the state at from is known.
+func (r *Repo) ListHealthChecksBetween(ctx context.Context, resourceType string, resourceID string, from time.Time, to time.Time) ([]models.HealthCheck, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, resource_type, resource_id, check_type, status, details, checked_at, probe_id, latency_ms
+		FROM health_checks
+		WHERE resource_type = $1
+		  AND resource_id = $2
+		  AND checked_at < $4
+		  AND checked_at >= COALESCE((
+			SELECT MAX(checked_at) FROM health_checks
+			WHERE resource_type = $1 AND resource_id = $2 AND checked_at <= $3
+		  ), $3)
+		ORDER BY checked_at
+	`, resourceType, resourceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.HealthCheck, 0)
+	for rows.Next() {
+		var item models.HealthCheck
+		if err := rows.Scan(&item.ID, &item.ResourceType, &item.ResourceID, &item.CheckType, &item.Status, &item.Details, &item.CheckedAt, &item.ProbeID, &item.LatencyMS); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ListPresenceEventsBetween returns a provider's presence changes from oldest
+// to newest, starting with the last change before from.
+func (r *Repo) ListPresenceEventsBetween(ctx context.Context, providerID string, from time.Time, to time.Time) ([]models.ProviderPresenceEvent, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, provider_id, from_state, to_state, reason, created_at
+		FROM provider_presence_events
+		WHERE provider_id = $1
+		  AND created_at < $3
+		  AND created_at >= COALESCE((
+			SELECT MAX(created_at) FROM provider_presence_events
+			WHERE provider_id = $1 AND created_at <= $2
+		  ), $2)
+		ORDER BY created_at
+	`, providerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.ProviderPresenceEvent, 0)
+	for rows.Next() {
+		var item models.ProviderPresenceEvent
+		if err := rows.Scan(&item.ID, &item.ProviderID, &item.FromState, &item.ToState, &item.Reason, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ListSLASubjects returns VMs and pods that existed between from and to and
+// have no stored report for the period yet. Terminated resources end at their
+// last update.
+func (r *Repo) ListSLASubjects(ctx context.Context, period string, from time.Time, to time.Time, limit int) ([]models.SLASubject, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT resource_type, id, user_id, provider_id, availability_tier, created_at, ended_at
+		FROM (
+			SELECT 'vm' AS resource_type, id, user_id, provider_id, availability_tier, created_at,
+			       CASE WHEN status IN ('terminated', 'expired') THEN updated_at END AS ended_at
+			FROM vms
+			UNION ALL
+			SELECT 'pod', id, user_id, provider_id, availability_tier, created_at,
+			       CASE WHEN status IN ('terminated', 'expired') THEN updated_at END
+			FROM pod_instances
+		) subjects
+		WHERE created_at < $3
+		  AND (ended_at IS NULL OR ended_at >= $2)
+		  AND NOT EXISTS (
+			SELECT 1 FROM sla_reports s
+			WHERE s.resource_type = subjects.resource_type AND s.resource_id = subjects.id AND s.period = $1
+		  )
+		ORDER BY created_at
+		LIMIT $4
+	`, period, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.SLASubject, 0)
+	for rows.Next() {
+		var item models.SLASubject
+		if err := rows.Scan(&item.ResourceType, &item.ResourceID, &item.UserID, &item.ProviderID, &item.Tier, &item.CreatedAt, &item.EndedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ListSLAProviders returns providers with presence history before to and no
+// stored report for the period yet.
+func (r *Repo) ListSLAProviders(ctx context.Context, period string, to time.Time, limit int) ([]string, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT DISTINCT e.provider_id
+		FROM provider_presence_events e
+		WHERE e.created_at < $2
+		  AND NOT EXISTS (
+			SELECT 1 FROM sla_reports s
+			WHERE s.resource_type = 'provider' AND s.resource_id = e.provider_id AND s.period = $1
+		  )
+		ORDER BY e.provider_id
+		LIMIT $3
+	`, period, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]string, 0)
+	for rows.Next() {
+		var providerID string
+		if err := rows.Scan(&providerID); err != nil {
+			return nil, err
+		}
+		out = append(out, providerID)
+	}
+	return out, rows.Err()
+}
+
+// ListBilledProviderBookings returns confirmed bookings on a provider that
+// were metered at some point between from and to.
+func (r *Repo) ListBilledProviderBookings(ctx context.Context, providerID string, from time.Time, to time.Time) ([]models.OfferBooking, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+offerBookingColumns+`
+		FROM offer_bookings
+		WHERE provider_id = $1
+		  AND billing_rental_id <> ''
+		  AND confirmed_at < $3
+		  AND (closed_at IS NULL OR closed_at >= $2)
+		ORDER BY confirmed_at
+	`, providerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.OfferBooking, 0)
+	for rows.Next() {
+		item, err := scanOfferBooking(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+const slaReportColumns = `resource_type, resource_id, period, user_id, provider_id, tier, period_start, period_end, target_pct, uptime_pct,
+	monitored_seconds, downtime_seconds, met, credit_pct, credit_status, credit_usd, created_at, updated_at`
+
+func scanSLAReport(row pgx.Row) (models.SLAReport, error) {
+	var item models.SLAReport
+	err := row.Scan(
+		&item.ResourceType, &item.ResourceID, &item.Period, &item.UserID, &item.ProviderID, &item.Tier, &item.PeriodStart, &item.PeriodEnd,
+		&item.TargetPct, &item.UptimePct, &item.MonitoredSeconds, &item.DowntimeSeconds, &item.Met, &item.CreditPct, &item.CreditStatus,
+		&item.CreditUSD, &item.CreatedAt, &item.UpdatedAt,
+	)
+	item.Final = true
+	return item, err
+}
+
+// SaveSLAReport stores a closed period's report once; a report that already
+// exists is left alone so issued credits are never recomputed.
+func (r *Repo) SaveSLAReport(ctx context.Context, item models.SLAReport) error {
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO sla_reports (
+			resource_type, resource_id, period, user_id, provider_id, tier, period_start, period_end, target_pct, uptime_pct,
+			monitored_seconds, downtime_seconds, met, credit_pct, credit_status
+		)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
+		ON CONFLICT (resource_type, resource_id, period) DO NOTHING
+	`, item.ResourceType, item.ResourceID, item.Period, item.UserID, item.ProviderID, item.Tier, item.PeriodStart, item.PeriodEnd,
+		item.TargetPct, item.UptimePct, item.MonitoredSeconds, item.DowntimeSeconds, item.Met, item.CreditPct, item.CreditStatus)
+	return err
+}
+
+func (r *Repo) GetSLAReport(ctx context.Context, resourceType string, resourceID string, period string) (models.SLAReport, error) {
+	return scanSLAReport(r.db.QueryRow(ctx, `
+		SELECT `+slaReportColumns+`
+		FROM sla_reports
+		WHERE resource_type = $1 AND resource_id = $2 AND period = $3
+	`, resourceType, resourceID, period))
+}
+
+func (r *Repo) ListSLAReports(ctx context.Context, filter models.SLAReportFilter) ([]models.SLAReport, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+slaReportColumns+`
+		FROM sla_reports
+		WHERE ($1 = '' OR period = $1)
+		  AND ($2 = '' OR resource_type = $2)
+		  AND ($3 = '' OR user_id = $3)
+		  AND ($4 = '' OR provider_id = $4)
+		  AND (NOT $5 OR NOT met)
+		  AND ($6 = '' OR credit_status = $6)
+		ORDER BY period DESC, uptime_pct
+		LIMIT $7
+	`, filter.Period, filter.ResourceType, filter.UserID, filter.ProviderID, filter.MissedOnly, string(filter.CreditStatus), filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.SLAReport, 0)
+	for rows.Next() {
+		item, err := scanSLAReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) MarkSLAReportCredited(ctx context.Context, resourceType string, resourceID string, period string, creditUSD float64) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE sla_reports
+		SET credit_status = 'issued', credit_usd = $4, updated_at = NOW()
+		WHERE resource_type = $1 AND resource_id = $2 AND period = $3 AND credit_status = 'pending'
+	`, resourceType, resourceID, period, creditUSD)
+	return err
+}
+
+func (r *Repo) UpsertSharedInventoryOffer(ctx context.Context, item models.SharedInventoryOffer) (models.SharedInventoryOffer, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanSharedOffer(r.db.QueryRow(ctx, `
+		INSERT INTO shared_inventory_offers (
+			id, provider_id, resource_type, title, description, cpu_cores, ram_mb, gpu_units, network_mbps,
+			quantity, available_qty, price_hourly_usd, status, pricing_mode, auction_rule, clearing_period_minutes, next_clearing_at, created_by
+		)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18)
+		ON CONFLICT (id) DO UPDATE SET
+			resource_type = EXCLUDED.resource_type,
+			title = EXCLUDED.title,
+			description = EXCLUDED.description,
+			cpu_cores = EXCLUDED.cpu_cores,
+			ram_mb = EXCLUDED.ram_mb,
+			gpu_units = EXCLUDED.gpu_units,
+			network_mbps = EXCLUDED.network_mbps,
+			quantity = EXCLUDED.quantity,
+			available_qty = EXCLUDED.available_qty,
+			price_hourly_usd = EXCLUDED.price_hourly_usd,
+			status = EXCLUDED.status,
+			pricing_mode = EXCLUDED.pricing_mode,
+			auction_rule = EXCLUDED.auction_rule,
+			clearing_period_minutes = EXCLUDED.clearing_period_minutes,
+			next_clearing_at = CASE
+				WHEN EXCLUDED.pricing_mode = 'auction' THEN COALESCE(shared_inventory_offers.next_clearing_at, EXCLUDED.next_clearing_at)
+				ELSE NULL
+			END,
+			updated_at = NOW()
+		RETURNING `+sharedOfferColumns,
+		item.ID, item.ProviderID, item.ResourceType, item.Title, item.Description, item.CPUCores, item.RAMMB, item.GPUUnits, item.NetworkMbps, item.Quantity, item.AvailableQty, item.PriceHourly, item.Status, item.PricingMode, item.AuctionRule, item.ClearingPeriodMin, item.NextClearingAt, item.CreatedBy,
+	))
+}
+
+func (r *Repo) ListSharedInventoryOffers(ctx context.Context, status string, providerID string) ([]models.SharedInventoryOffer, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+sharedOfferColumns+`
+		FROM shared_inventory_offers
+		WHERE ($1 = '' OR status = $1)
+		  AND ($2 = '' OR provider_id = $2)
+		ORDER BY updated_at DESC
+	`, status, providerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.SharedInventoryOffer, 0)
+	for rows.Next() {
+		item, err := scanSharedOffer(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+func (r *Repo) GetSharedInventoryOffer(ctx context.Context, offerID string) (models.SharedInventoryOffer, error) {
+	return scanSharedOffer(r.db.QueryRow(ctx, `SELECT `+sharedOfferColumns+` FROM shared_inventory_offers WHERE id = $1`, offerID))
+}
+
+const offerBookingColumns = `id, offer_id, user_id, provider_id, quantity, price_hourly_usd, status, hold_expires_at, allocation_id, billing_rental_id, confirmed_at, closed_at, created_at, updated_at`
+
+func scanOfferBooking(row pgx.Row) (models.OfferBooking, error) {
+	var item models.OfferBooking
+	err := row.Scan(&item.ID, &item.OfferID, &item.UserID, &item.ProviderID, &item.Quantity, &item.PriceHourly, &item.Status, &item.HoldExpiresAt, &item.AllocationID, &item.BillingRentalID, &item.ConfirmedAt, &item.ClosedAt, &item.CreatedAt, &item.UpdatedAt)
+	return item, err
+}
+
+func bookingStatuses(statuses []models.OfferBookingStatus) []string {
+	out := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		out = append(out, string(status))
+	}
+	return out
+}
+
+// CreateOfferBooking takes quantity out of an active offer and records the hold
+// in one statement, so two renters cannot both take the last unit.
+func (r *Repo) CreateOfferBooking(ctx context.Context, item models.OfferBooking) (models.OfferBooking, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	out, err := scanOfferBooking(r.db.QueryRow(ctx, `
+		WITH reserved AS (
+			UPDATE shared_inventory_offers
+			SET available_qty = available_qty - $2,
+			    status = CASE WHEN available_qty - $2 <= 0 THEN 'sold_out' ELSE status END,
+			    updated_at = NOW()
+			WHERE id = $1
+			  AND status = 'active'
+			  AND pricing_mode = 'fixed'
+			  AND available_qty >= $2
+			RETURNING id, provider_id, price_hourly_usd
+		)
+		INSERT INTO offer_bookings (id, offer_id, user_id, provider_id, quantity, price_hourly_usd, status, hold_expires_at)
+		SELECT $3, reserved.id, $4, reserved.provider_id, $2, reserved.price_hourly_usd, $5, $6
+		FROM reserved
+		RETURNING `+offerBookingColumns,
+		item.OfferID, item.Quantity, item.ID, item.UserID, item.Status, item.HoldExpiresAt,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.OfferBooking{}, errors.New("offer not found or insufficient available quantity")
+	}
+	return out, err
+}
+
+func (r *Repo) GetOfferBooking(ctx context.Context, bookingID string) (models.OfferBooking, error) {
+	return scanOfferBooking(r.db.QueryRow(ctx, `SELECT `+offerBookingColumns+` FROM offer_bookings WHERE id = $1`, bookingID))
+}
+
+func (r *Repo) ListOfferBookings(ctx context.Context, userID string, status string, limit int) ([]models.OfferBooking, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+offerBookingColumns+`
+		FROM offer_bookings
+		WHERE ($1 = '' OR user_id = $1)
+		  AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, userID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.OfferBooking, 0)
+	for rows.Next() {
+		item, err := scanOfferBooking(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ClaimOfferBooking moves a live hold to confirming. Only one caller can win
+// the claim, so concurrent confirms of the same booking cannot both allocate
+// and bill.
+func (r *Repo) ClaimOfferBooking(ctx context.Context, bookingID string, now time.Time) (models.OfferBooking, error) {
+	out, err := scanOfferBooking(r.db.QueryRow(ctx, `
+		UPDATE offer_bookings
+		SET status = 'confirming',
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = 'held'
+		  AND hold_expires_at > $2
+		RETURNING `+offerBookingColumns,
+		bookingID, now,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.OfferBooking{}, errors.New("booking is no longer held")
+	}
+	return out, err
+}
+
+// UnclaimOfferBooking puts a claimed booking back on hold after a confirm that
+// failed before it started billing.
+func (r *Repo) UnclaimOfferBooking(ctx context.Context, bookingID string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE offer_bookings
+		SET status = 'held',
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = 'confirming'
+	`, bookingID)
+	return err
+}
+
+func (r *Repo) ConfirmOfferBooking(ctx context.Context, bookingID string, allocationID string, rentalID string) (models.OfferBooking, error) {
+	out, err := scanOfferBooking(r.db.QueryRow(ctx, `
+		UPDATE offer_bookings
+		SET status = 'confirmed',
+		    allocation_id = $2,
+		    billing_rental_id = $3,
+		    confirmed_at = NOW(),
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = 'confirming'
+		RETURNING `+offerBookingColumns,
+		bookingID, allocationID, rentalID,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.OfferBooking{}, errors.New("booking is no longer being confirmed")
+	}
+	return out, err
+}
+
+// CloseOfferBooking moves a booking from one of the from statuses to to. When
+// the booking was still holding capacity (held, confirming or confirmed) its
+// quantity goes back to the offer in the same statement. It also returns the
+// status the booking was closed from.
+func (r *Repo) CloseOfferBooking(ctx context.Context, bookingID string, from []models.OfferBookingStatus, to models.OfferBookingStatus) (models.OfferBooking, models.OfferBookingStatus, error) {
+	var out models.OfferBooking
+	var prev models.OfferBookingStatus
+	err := r.db.QueryRow(ctx, `
+		WITH prev AS (
+			SELECT id, status
+			FROM offer_bookings
+			WHERE id = $1
+			  AND status = ANY($2)
+			FOR UPDATE
+		),
+		closed AS (
+			UPDATE offer_bookings b
+			SET status = $3,
+			    closed_at = COALESCE(b.closed_at, NOW()),
+			    updated_at = NOW()
+			FROM prev
+			WHERE b.id = prev.id
+			RETURNING b.*, prev.status AS prev_status
+		),
+		returned AS (
+			UPDATE shared_inventory_offers o
+			SET available_qty = LEAST(o.quantity, o.available_qty + closed.quantity),
+			    status = CASE WHEN o.status = 'sold_out' THEN 'active' ELSE o.status END,
+			    updated_at = NOW()
+			FROM closed
+			WHERE o.id = closed.offer_id
+			  AND closed.prev_status IN ('held', 'confirming', 'confirmed')
+		)
+		SELECT `+offerBookingColumns+`, prev_status FROM closed
+	`, bookingID, bookingStatuses(from), to).Scan(&out.ID, &out.OfferID, &out.UserID, &out.ProviderID, &out.Quantity, &out.PriceHourly, &out.Status, &out.HoldExpiresAt, &out.AllocationID, &out.BillingRentalID, &out.ConfirmedAt, &out.ClosedAt, &out.CreatedAt, &out.UpdatedAt, &prev)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.OfferBooking{}, "", fmt.Errorf("booking cannot move to %s from its current status", to)
+	}
+	return out, prev, err
+}
+
+// ExpireOfferHolds releases holds that ran out unconfirmed. A booking left
+// confirming by a confirm that never finished is released once its hold has
+// been over for ten minutes.
+func (r *Repo) ExpireOfferHolds(ctx context.Context, now time.Time, limit int) ([]models.OfferBooking, error) {
+	rows, err := r.db.Query(ctx, `
+		WITH expired AS (
+			UPDATE offer_bookings
+			SET status = 'released',
+			    closed_at = NOW(),
+			    updated_at = NOW()
+			WHERE id IN (
+				SELECT id FROM offer_bookings
+				WHERE (status = 'held' AND hold_expires_at <= $1)
+				   OR (status = 'confirming' AND hold_expires_at <= $1 - INTERVAL '10 minutes')
+				ORDER BY hold_expires_at ASC
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING *
+		),
+		returned AS (
+			UPDATE shared_inventory_offers o
+			SET available_qty = LEAST(o.quantity, o.available_qty + totals.quantity),
+			    status = CASE WHEN o.status = 'sold_out' THEN 'active' ELSE o.status END,
+			    updated_at = NOW()
+			FROM (SELECT offer_id, SUM(quantity) AS quantity FROM expired GROUP BY offer_id) totals
+			WHERE o.id = totals.offer_id
+		)
+		SELECT `+offerBookingColumns+` FROM expired
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.OfferBooking, 0)
+	for rows.Next() {
+		item, err := scanOfferBooking(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+const offerBidColumns = `id, offer_id, user_id, provider_id, quantity, max_price_hourly_usd, duration_hours, status, allocated_qty, clearing_price_usd, allocation_id, billing_rental_id, expires_at, created_at, updated_at`
+
+func scanOfferBid(row pgx.Row) (models.OfferBid, error) {
+	var item models.OfferBid
+	err := row.Scan(&item.ID, &item.OfferID, &item.UserID, &item.ProviderID, &item.Quantity, &item.MaxPriceHourly, &item.DurationHours, &item.Status, &item.AllocatedQty, &item.ClearingPriceUSD, &item.AllocationID, &item.BillingRentalID, &item.ExpiresAt, &item.CreatedAt, &item.UpdatedAt)
+	return item, err
+}
+
+func (r *Repo) CreateOfferBid(ctx context.Context, item models.OfferBid) (models.OfferBid, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanOfferBid(r.db.QueryRow(ctx, `
+		INSERT INTO offer_bids (id, offer_id, user_id, provider_id, quantity, max_price_hourly_usd, duration_hours, status, expires_at)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)
+		RETURNING `+offerBidColumns,
+		item.ID, item.OfferID, item.UserID, item.ProviderID, item.Quantity, item.MaxPriceHourly, item.DurationHours, item.Status, item.ExpiresAt,
+	))
+}
+
+func (r *Repo) GetOfferBid(ctx context.Context, bidID string) (models.OfferBid, error) {
+	return scanOfferBid(r.db.QueryRow(ctx, `SELECT `+offerBidColumns+` FROM offer_bids WHERE id = $1`, bidID))
+}
+
+func (r *Repo) ListOfferBids(ctx context.Context, offerID string, userID string, statuses []models.OfferBidStatus, limit int) ([]models.OfferBid, error) {
+	filter := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		filter = append(filter, string(status))
+	}
+	rows, err := r.db.Query(ctx, `
+		SELECT `+offerBidColumns+`
+		FROM offer_bids
+		WHERE ($1 = '' OR offer_id = $1)
+		  AND ($2 = '' OR user_id = $2)
+		  AND (cardinality($3::text[]) = 0 OR status = ANY($3))
+		ORDER BY created_at ASC
+		LIMIT $4
+	`, offerID, userID, filter, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.OfferBid, 0)
+	for rows.Next() {
+		item, err := scanOfferBid(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// UpdateOfferBid writes the clearing outcome for a bid, but only while the bid
+// is still in status from, so a cancel racing a clearing pass cannot be undone.
+func (r *Repo) UpdateOfferBid(ctx context.Context, item models.OfferBid, from models.OfferBidStatus) (models.OfferBid, error) {
+	out, err := scanOfferBid(r.db.QueryRow(ctx, `
+		UPDATE offer_bids
+		SET status = $3,
+		    allocated_qty = $4,
+		    clearing_price_usd = $5,
+		    allocation_id = $6,
+		    billing_rental_id = $7,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = $2
+		RETURNING `+offerBidColumns,
+		item.ID, from, item.Status, item.AllocatedQty, item.ClearingPriceUSD, item.AllocationID, item.BillingRentalID,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.OfferBid{}, fmt.Errorf("bid is no longer %s", from)
+	}
+	return out, err
+}
+
+func (r *Repo) ReturnOfferQuantity(ctx context.Context, offerID string, quantity int) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE shared_inventory_offers
+		SET available_qty = LEAST(quantity, available_qty + $2),
+		    status = CASE WHEN status = 'sold_out' THEN 'active' ELSE status END,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, offerID, quantity)
+	return err
+}
+
+func (r *Repo) ListDueAuctionOffers(ctx context.Context, now time.Time, limit int) ([]models.SharedInventoryOffer, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+sharedOfferColumns+`
+		FROM shared_inventory_offers
+		WHERE pricing_mode = 'auction'
+		  AND status IN ('active', 'sold_out', 'paused')
+		  AND next_clearing_at <= $1
+		ORDER BY next_clearing_at ASC
+		LIMIT $2
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.SharedInventoryOffer, 0)
+	for rows.Next() {
+		item, err := scanSharedOffer(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ClaimAuctionPeriod moves an offer's next clearing from due to next. Only one
+// replica wins the update, and only that replica runs the clearing.
+func (r *Repo) ClaimAuctionPeriod(ctx context.Context, offerID string, due time.Time, next time.Time) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE shared_inventory_offers
+		SET next_clearing_at = $3, updated_at = NOW()
+		WHERE id = $1
+		  AND pricing_mode = 'auction'
+		  AND next_clearing_at = $2
+	`, offerID, due, next)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RecordAuctionClearing stores the clearing and publishes its price on the
+// offer, along with the capacity left over after the awards.
+func (r *Repo) RecordAuctionClearing(ctx context.Context, item models.AuctionClearing) (models.AuctionClearing, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	if item.Awards == nil {
+		item.Awards = []models.AuctionAward{}
+	}
+	awards, err := json.Marshal(item.Awards)
+	if err != nil {
+		return models.AuctionClearing{}, err
+	}
+	err = r.db.QueryRow(ctx, `
+		WITH published AS (
+			UPDATE shared_inventory_offers
+			SET last_clearing_price_usd = $6,
+			    available_qty = GREATEST(0, quantity - $8),
+			    status = CASE
+					WHEN status = 'paused' THEN status
+					WHEN quantity - $8 <= 0 THEN 'sold_out'
+					ELSE 'active'
+				END,
+			    updated_at = NOW()
+			WHERE id = $2
+		)
+		INSERT INTO auction_clearings (id, offer_id, rule, period_start, period_end, clearing_price_usd, offered_qty, allocated_qty, bid_count, awards_json)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+		RETURNING created_at
+	`, item.ID, item.OfferID, item.Rule, item.PeriodStart, item.PeriodEnd, item.ClearingPriceUSD, item.OfferedQty, item.AllocatedQty, item.BidCount, string(awards)).Scan(&item.CreatedAt)
+	return item, err
+}
+
+func (r *Repo) ListAuctionClearings(ctx context.Context, offerID string, limit int) ([]models.AuctionClearing, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, offer_id, rule, period_start, period_end, clearing_price_usd, offered_qty, allocated_qty, bid_count, awards_json, created_at
+		FROM auction_clearings
+		WHERE offer_id = $1
+		ORDER BY period_start DESC
+		LIMIT $2
+	`, offerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.AuctionClearing, 0)
+	for rows.Next() {
+		var item models.AuctionClearing
+		var awards string
+		if err := rows.Scan(&item.ID, &item.OfferID, &item.Rule, &item.PeriodStart, &item.PeriodEnd, &item.ClearingPriceUSD, &item.OfferedQty, &item.AllocatedQty, &item.BidCount, &awards, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(awards), &item.Awards); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) CreateAgentLog(ctx context.Context, item models.AgentLog) (models.AgentLog, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	err := r.db.QueryRow(ctx, `
+		INSERT INTO agent_logs (id, provider_id, resource_id, level, message, source)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at
+	`, item.ID, item.ProviderID, item.ResourceID, item.Level, item.Message, item.Source).Scan(&item.CreatedAt)
+	return item, err
+}
+
+func (r *Repo) ListAgentLogs(ctx context.Context, providerID string, resourceID string, level string, limit int) ([]models.AgentLog, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, provider_id, resource_id, level, message, source, created_at
+		FROM agent_logs
+		WHERE ($1 = '' OR provider_id = $1)
+		  AND ($2 = '' OR resource_id = $2)
+		  AND ($3 = '' OR level = $3)
+		ORDER BY created_at DESC
+		LIMIT $4
+	`, providerID, resourceID, level, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.AgentLog, 0)
+	for rows.Next() {
+		var item models.AgentLog
+		if err := rows.Scan(&item.ID, &item.ProviderID, &item.ResourceID, &item.Level, &item.Message, &item.Source, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+const agentCommandColumns = `id, seq, provider_id, resource_id, session_id, command, payload, rows, cols, status, requested_by, result_message, attempts, max_attempts, timeout_seconds, rollout_id, deadline_at, lease_expires_at, acknowledged_at, created_at, updated_at`
+
+func scanAgentCommand(row pgx.Row) (models.AgentCommand, error) {
+	var item models.AgentCommand
+	var deadlineAt, leaseExpiresAt, acknowledgedAt *time.Time
+	err := row.Scan(&item.ID, &item.Seq, &item.ProviderID, &item.ResourceID, &item.SessionID, &item.Command, &item.Payload, &item.Rows, &item.Cols, &item.Status, &item.RequestedBy, &item.ResultMessage, &item.Attempts, &item.MaxAttempts, &item.TimeoutSeconds, &item.RolloutID, &deadlineAt, &leaseExpiresAt, &acknowledgedAt, &item.CreatedAt, &item.UpdatedAt)
+	if deadlineAt != nil {
+		item.DeadlineAt = *deadlineAt
+	}
+	if leaseExpiresAt != nil {
+		item.LeaseExpiresAt = *leaseExpiresAt
+	}
+	if acknowledgedAt != nil {
+		item.AcknowledgedAt = *acknowledgedAt
+	}
+	return item, err
+}
+
+func scanAgentCommands(rows pgx.Rows) ([]models.AgentCommand, error) {
+	defer rows.Close()
+	out := make([]models.AgentCommand, 0)
+	for rows.Next() {
+		item, err := scanAgentCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) CreateAgentCommand(ctx context.Context, item models.AgentCommand) (models.AgentCommand, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanAgentCommand(r.db.QueryRow(ctx, `
+		INSERT INTO agent_commands (id, provider_id, resource_id, session_id, command, payload, rows, cols, status, requested_by, result_message, max_attempts, timeout_seconds, rollout_id, deadline_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		RETURNING `+agentCommandColumns+`
+	`, item.ID, item.ProviderID, item.ResourceID, item.SessionID, item.Command, item.Payload, item.Rows, item.Cols, item.Status, item.RequestedBy, item.ResultMessage, item.MaxAttempts, item.TimeoutSeconds, item.RolloutID, nullableTime(item.DeadlineAt)))
+}
+
+func (r *Repo) GetAgentCommand(ctx context.Context, commandID string) (models.AgentCommand, error) {
+	item, err := scanAgentCommand(r.db.QueryRow(ctx, `
+		SELECT `+agentCommandColumns+`
+		FROM agent_commands
+		WHERE id = $1
+	`, commandID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentCommand{}, errors.New("agent command not found")
+	}
+	return item, err
+}
+
+func (r *Repo) ListAgentCommands(ctx context.Context, providerID string, limit int) ([]models.AgentCommand, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+agentCommandColumns+`
+		FROM agent_commands
+		WHERE ($1 = '' OR provider_id = $1)
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, providerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgentCommands(rows)
+}
+
+func (r *Repo) ListRequestedAgentCommands(ctx context.Context, userID string, limit int) ([]models.AgentCommand, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+agentCommandColumns+`
+		FROM agent_commands
+		WHERE requested_by = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgentCommands(rows)
+}
+
+// ClaimNextAgentCommand hands out the oldest queued command over HTTP. The
+// poll response is the delivery, so the command is acknowledged at once.
+func (r *Repo) ClaimNextAgentCommand(ctx context.Context, providerID string) (models.AgentCommand, error) {
+	item, err := scanAgentCommand(r.db.QueryRow(ctx, `
+		UPDATE agent_commands
+		SET status = 'running',
+		    attempts = attempts + 1,
+		    acknowledged_at = NOW(),
+		    lease_expires_at = NULL,
+		    updated_at = NOW()
+		WHERE id = (
+			SELECT id
+			FROM agent_commands
+			WHERE provider_id = $1
+			  AND status = 'queued'
+			ORDER BY seq ASC
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+agentCommandColumns+`
+	`, providerID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentCommand{}, nil
+	}
+	return item, err
+}
+
+// ClaimAgentCommands marks queued commands running under a delivery lease and
+// returns them in seq order, together with unacknowledged running commands
+// after afterSeq that a resuming agent never received. A fresh agent
+// (afterSeq 0) only gets queued commands.
+func (r *Repo) ClaimAgentCommands(ctx context.Context, providerID string, afterSeq int64, lease time.Duration, limit int) ([]models.AgentCommand, error) {
+	rows, err := r.db.Query(ctx, `
+		UPDATE agent_commands
+		SET attempts = attempts + CASE WHEN status = 'queued' THEN 1 ELSE 0 END,
+		    status = 'running',
+		    lease_expires_at = NOW() + make_interval(secs => $3),
+		    updated_at = NOW()
+		WHERE id IN (
+			SELECT id
+			FROM agent_commands
+			WHERE provider_id = $1
+			  AND (status = 'queued' OR ($2 > 0 AND status = 'running' AND acknowledged_at IS NULL AND seq > $2))
+			ORDER BY seq ASC
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+agentCommandColumns+`
+	`, providerID, afterSeq, lease.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	out, err := scanAgentCommands(rows)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out, nil
+}
+
+func (r *Repo) AcknowledgeAgentCommand(ctx context.Context, commandID string) (models.AgentCommand, error) {
+	item, err := scanAgentCommand(r.db.QueryRow(ctx, `
+		UPDATE agent_commands
+		SET acknowledged_at = COALESCE(acknowledged_at, NOW()),
+		    lease_expires_at = NULL,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = 'running'
+		RETURNING `+agentCommandColumns+`
+	`, commandID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentCommand{}, errors.New("agent command is not running")
+	}
+	return item, err
+}
+
+// ListOpenAgentCommands returns the queued and running commands of one kind
+// across all providers.
+func (r *Repo) ListOpenAgentCommands(ctx context.Context, command models.AgentCommandAction) ([]models.AgentCommand, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+agentCommandColumns+`
+		FROM agent_commands
+		WHERE command = $1 AND status IN ('queued', 'running')
+		ORDER BY seq ASC
+	`, command)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgentCommands(rows)
+}
+
+// ListStaleAgentCommands returns open commands past their deadline and
+// running commands whose delivery lease ran out unacknowledged.
+func (r *Repo) ListStaleAgentCommands(ctx context.Context, now time.Time, limit int) ([]models.AgentCommand, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+agentCommandColumns+`
+		FROM agent_commands
+		WHERE status IN ('queued', 'running')
+		  AND (deadline_at <= $1 OR (status = 'running' AND acknowledged_at IS NULL AND lease_expires_at <= $1))
+		ORDER BY seq ASC
+		LIMIT $2
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgentCommands(rows)
+}
+
+// RequeueAgentCommand puts an unacknowledged command back in the queue under
+// a new seq, so a resuming agent that already saw the old seq still gets it.
+func (r *Repo) RequeueAgentCommand(ctx context.Context, commandID string) (models.AgentCommand, error) {
+	item, err := scanAgentCommand(r.db.QueryRow(ctx, `
+		UPDATE agent_commands
+		SET status = 'queued',
+		    seq = nextval(pg_get_serial_sequence('agent_commands', 'seq')),
+		    lease_expires_at = NULL,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = 'running'
+		  AND acknowledged_at IS NULL
+		RETURNING `+agentCommandColumns+`
+	`, commandID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentCommand{}, errors.New("agent command is no longer awaiting acknowledgement")
+	}
+	return item, err
+}
+
+// CompleteAgentCommand moves an open command to a final state. Commands that
+// already finished, for example by timing out, are left alone.
+func (r *Repo) CompleteAgentCommand(ctx context.Context, commandID string, status models.AgentCommandState, resultMessage string) (models.AgentCommand, error) {
+	item, err := scanAgentCommand(r.db.QueryRow(ctx, `
+		UPDATE agent_commands
+		SET status = $2,
+		    result_message = $3,
+		    lease_expires_at = NULL,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status IN ('queued', 'running')
+		RETURNING `+agentCommandColumns+`
+	`, commandID, status, resultMessage))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentCommand{}, errors.New("agent command already finished")
+	}
+	return item, err
+}
+
+const rolloutColumns = `r.id, r.command, r.payload, r.selector_json, r.waves_json, r.current_wave, r.max_concurrency, r.max_failure_pct, r.pause_between_waves, r.timeout_seconds, r.max_attempts, r.status, r.detail, r.created_by, r.failure_window_at, r.created_at, r.updated_at, r.finished_at, p.total, p.pending, p.running, p.succeeded, p.failed, p.cancelled`
+
+// rolloutFrom joins each rollout with its target counts.
+const rolloutFrom = `
+		FROM rollouts r
+		CROSS JOIN LATERAL (
+			SELECT COUNT(*),
+			       COUNT(*) FILTER (WHERE t.status = 'pending'),
+			       COUNT(*) FILTER (WHERE t.status = 'running'),
+			       COUNT(*) FILTER (WHERE t.status = 'succeeded'),
+			       COUNT(*) FILTER (WHERE t.status = 'failed'),
+			       COUNT(*) FILTER (WHERE t.status = 'cancelled')
+			FROM rollout_targets t
+			WHERE t.rollout_id = r.id
+		) p(total, pending, running, succeeded, failed, cancelled)`
+
+func scanRollout(row pgx.Row) (models.Rollout, error) {
+	var item models.Rollout
+	var selector, waves string
+	var finishedAt *time.Time
+	if err := row.Scan(&item.ID, &item.Command, &item.Payload, &selector, &waves, &item.CurrentWave, &item.MaxConcurrency, &item.MaxFailurePct, &item.PauseBetweenWaves, &item.TimeoutSeconds, &item.MaxAttempts, &item.Status, &item.Detail, &item.CreatedBy, &item.FailureWindowAt, &item.CreatedAt, &item.UpdatedAt, &finishedAt, &item.Progress.Total, &item.Progress.Pending, &item.Progress.Running, &item.Progress.Succeeded, &item.Progress.Failed, &item.Progress.Cancelled); err != nil {
+		return models.Rollout{}, err
+	}
+	if err := json.Unmarshal([]byte(selector), &item.Selector); err != nil {
+		return models.Rollout{}, err
+	}
+	if err := json.Unmarshal([]byte(waves), &item.Waves); err != nil {
+		return models.Rollout{}, err
+	}
+	if finishedAt != nil {
+		item.FinishedAt = *finishedAt
+	}
+	return item, nil
+}
+
+const rolloutTargetColumns = `rollout_id, provider_id, position, wave, status, command_id, detail, started_at, finished_at`
+
+func scanRolloutTarget(row pgx.Row) (models.RolloutTarget, error) {
+	var item models.RolloutTarget
+	var startedAt, finishedAt *time.Time
+	err := row.Scan(&item.RolloutID, &item.ProviderID, &item.Position, &item.Wave, &item.Status, &item.CommandID, &item.Detail, &startedAt, &finishedAt)
+	if startedAt != nil {
+		item.StartedAt = *startedAt
+	}
+	if finishedAt != nil {
+		item.FinishedAt = *finishedAt
+	}
+	return item, err
+}
+
+func scanRolloutTargets(rows pgx.Rows) ([]models.RolloutTarget, error) {
+	defer rows.Close()
+	out := make([]models.RolloutTarget, 0)
+	for rows.Next() {
+		item, err := scanRolloutTarget(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// CreateRollout stores a rollout together with its targets.
+func (r *Repo) CreateRollout(ctx context.Context, item models.Rollout, targets []models.RolloutTarget) (models.Rollout, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	selector, err := json.Marshal(item.Selector)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	waves, err := json.Marshal(item.Waves)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO rollouts (id, command, payload, selector_json, waves_json, current_wave, max_concurrency, max_failure_pct, pause_between_waves, timeout_seconds, max_attempts, status, detail, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+	`, item.ID, item.Command, item.Payload, string(selector), string(waves), item.CurrentWave, item.MaxConcurrency, item.MaxFailurePct, item.PauseBetweenWaves, item.TimeoutSeconds, item.MaxAttempts, item.Status, item.Detail, item.CreatedBy); err != nil {
+		return models.Rollout{}, err
+	}
+	batch := &pgx.Batch{}
+	for _, target := range targets {
+		batch.Queue(`
+			INSERT INTO rollout_targets (rollout_id, provider_id, position, wave, status)
+			VALUES ($1, $2, $3, $4, 'pending')
+		`, item.ID, target.ProviderID, target.Position, target.Wave)
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return models.Rollout{}, err
+	}
+	created, err := scanRollout(tx.QueryRow(ctx, `SELECT `+rolloutColumns+rolloutFrom+` WHERE r.id = $1`, item.ID))
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	return created, tx.Commit(ctx)
+}
+
+func (r *Repo) GetRollout(ctx context.Context, rolloutID string) (models.Rollout, error) {
+	item, err := scanRollout(r.db.QueryRow(ctx, `SELECT `+rolloutColumns+rolloutFrom+` WHERE r.id = $1`, rolloutID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Rollout{}, errors.New("rollout not found")
+	}
+	return item, err
+}
+
+func (r *Repo) ListRollouts(ctx context.Context, status models.RolloutStatus, limit int) ([]models.Rollout, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+rolloutColumns+rolloutFrom+`
+		WHERE ($1 = '' OR r.status = $1)
+		ORDER BY r.created_at DESC
+		LIMIT $2
+	`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.Rollout, 0)
+	for rows.Next() {
+		item, err := scanRollout(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) ListRolloutTargets(ctx context.Context, rolloutID string) ([]models.RolloutTarget, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+rolloutTargetColumns+`
+		FROM rollout_targets
+		WHERE rollout_id = $1
+		ORDER BY position
+	`, rolloutID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRolloutTargets(rows)
+}
+
+// TransitionRollout moves a rollout in one of the from states to status.
+// Resuming a halted rollout restarts the window its failure rate is judged
+// over, so the failures that halted it do not halt it again.
+func (r *Repo) TransitionRollout(ctx context.Context, rolloutID string, from []models.RolloutStatus, status models.RolloutStatus, detail string) (models.Rollout, error) {
+	states := make([]string, 0, len(from))
+	for _, state := range from {
+		states = append(states, string(state))
+	}
+	tag, err := r.db.Exec(ctx, `
+		UPDATE rollouts
+		SET status = $3,
+		    detail = $4,
+		    failure_window_at = CASE WHEN status = 'halted' AND $3 = 'running' THEN NOW() ELSE failure_window_at END,
+		    finished_at = CASE WHEN $3 IN ('completed', 'cancelled') THEN NOW() ELSE finished_at END,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = ANY($2)
+	`, rolloutID, states, status, detail)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	if tag.RowsAffected() == 0 {
+		if _, err := r.GetRollout(ctx, rolloutID); err != nil {
+			return models.Rollout{}, err
+		}
+		return models.Rollout{}, fmt.Errorf("rollout is not %s", strings.Join(states, " or "))
+	}
+	return r.GetRollout(ctx, rolloutID)
+}
+
+// AdvanceRolloutWave opens the next wave of a running rollout. It is a no-op
+// if another pass already advanced it.
+func (r *Repo) AdvanceRolloutWave(ctx context.Context, rolloutID string, wave int) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE rollouts
+		SET current_wave = $2,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = 'running'
+		  AND current_wave < $2
+	`, rolloutID, wave)
+	return err
+}
+
+// ClaimRolloutTargets marks the next pending targets of the open waves as
+// running, up to the rollout's concurrency cap. The rollout row is locked so
+// concurrent passes cannot exceed the cap between them.
+func (r *Repo) ClaimRolloutTargets(ctx context.Context, rolloutID string) ([]models.RolloutTarget, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	var currentWave, maxConcurrency int
+	err = tx.QueryRow(ctx, `
+		SELECT current_wave, max_concurrency
+		FROM rollouts
+		WHERE id = $1
+		  AND status = 'running'
+		FOR UPDATE
+	`, rolloutID).Scan(&currentWave, &maxConcurrency)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return []models.RolloutTarget{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, `
+		UPDATE rollout_targets
+		SET status = 'running',
+		    started_at = NOW()
+		WHERE rollout_id = $1
+		  AND provider_id IN (
+			SELECT provider_id
+			FROM rollout_targets
+			WHERE rollout_id = $1
+			  AND status = 'pending'
+			  AND wave <= $2
+			ORDER BY position
+			LIMIT GREATEST($3 - (SELECT COUNT(*) FROM rollout_targets WHERE rollout_id = $1 AND status = 'running'), 0)
+		  )
+		RETURNING `+rolloutTargetColumns+`
+	`, rolloutID, currentWave, maxConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := scanRolloutTargets(rows)
+	if err != nil {
+		return nil, err
+	}
+	return claimed, tx.Commit(ctx)
+}
+
+func (r *Repo) SetRolloutTargetCommand(ctx context.Context, rolloutID string, providerID string, commandID string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE rollout_targets
+		SET command_id = $3
+		WHERE rollout_id = $1
+		  AND provider_id = $2
+	`, rolloutID, providerID, commandID)
+	return err
+}
+
+// FinishRolloutTarget records the outcome for a target that has not finished
+// yet.
+func (r *Repo) FinishRolloutTarget(ctx context.Context, rolloutID string, providerID string, status models.RolloutTargetStatus, detail string) (models.RolloutTarget, error) {
+	item, err := scanRolloutTarget(r.db.QueryRow(ctx, `
+		UPDATE rollout_targets
+		SET status = $3,
+		    detail = $4,
+		    finished_at = NOW()
+		WHERE rollout_id = $1
+		  AND provider_id = $2
+		  AND status IN ('pending', 'running')
+		RETURNING `+rolloutTargetColumns+`
+	`, rolloutID, providerID, status, detail))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.RolloutTarget{}, errors.New("rollout target already finished")
+	}
+	return item, err
+}
+
+func (r *Repo) CancelPendingRolloutTargets(ctx context.Context, rolloutID string, detail string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE rollout_targets
+		SET status = 'cancelled',
+		    detail = $2,
+		    finished_at = NOW()
+		WHERE rollout_id = $1
+		  AND status = 'pending'
+	`, rolloutID, detail)
+	return err
+}
+
+const agentEnrollmentColumns = `id, provider_id, label, created_by, host_id, expires_at, used_at, created_at`
+
+func scanAgentEnrollment(row pgx.Row) (models.AgentEnrollment, error) {
+	var item models.AgentEnrollment
+	var usedAt *time.Time
+	err := row.Scan(&item.ID, &item.ProviderID, &item.Label, &item.CreatedBy, &item.HostID, &item.ExpiresAt, &usedAt, &item.CreatedAt)
+	if usedAt != nil {
+		item.UsedAt = *usedAt
+	}
+	return item, err
+}
+
+func (r *Repo) CreateAgentEnrollment(ctx context.Context, item models.AgentEnrollment, tokenHash string) (models.AgentEnrollment, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanAgentEnrollment(r.db.QueryRow(ctx, `
+		INSERT INTO agent_enrollments (id, provider_id, token_hash, label, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+agentEnrollmentColumns+`
+	`, item.ID, item.ProviderID, tokenHash, item.Label, item.CreatedBy, item.ExpiresAt))
+}
+
+func (r *Repo) ListAgentEnrollments(ctx context.Context, providerID string, limit int) ([]models.AgentEnrollment, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+agentEnrollmentColumns+`
+		FROM agent_enrollments
+		WHERE ($1 = '' OR provider_id = $1)
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, providerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.AgentEnrollment, 0)
+	for rows.Next() {
+		item, err := scanAgentEnrollment(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ConsumeAgentEnrollment redeems an unused, unexpired token for hostID. Each
+// token can be redeemed once.
+func (r *Repo) ConsumeAgentEnrollment(ctx context.Context, tokenHash string, hostID string, now time.Time) (models.AgentEnrollment, error) {
+	item, err := scanAgentEnrollment(r.db.QueryRow(ctx, `
+		UPDATE agent_enrollments
+		SET used_at = $3,
+		    host_id = $2
+		WHERE token_hash = $1
+		  AND used_at IS NULL
+		  AND expires_at > $3
+		RETURNING `+agentEnrollmentColumns+`
+	`, tokenHash, hostID, now))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentEnrollment{}, errors.New("enrollment token is invalid, used or expired")
+	}
+	return item, err
+}
+
+const agentHostColumns = `id, provider_id, hostname, label, enrollment_id, status, public_key, credential_id, previous_credential_id, credential_expires_at, rotated_at, revoked_at, revoked_by, created_at, updated_at`
+
+func scanAgentHost(row pgx.Row) (models.AgentHost, error) {
+	var item models.AgentHost
+	var rotatedAt, revokedAt *time.Time
+	err := row.Scan(&item.ID, &item.ProviderID, &item.Hostname, &item.Label, &item.EnrollmentID, &item.Status, &item.PublicKey, &item.CredentialID, &item.PreviousCredentialID, &item.CredentialExpiresAt, &rotatedAt, &revokedAt, &item.RevokedBy, &item.CreatedAt, &item.UpdatedAt)
+	if rotatedAt != nil {
+		item.RotatedAt = *rotatedAt
+	}
+	if revokedAt != nil {
+		item.RevokedAt = *revokedAt
+	}
+	return item, err
+}
+
+// CreateAgentHost records a newly enrolled host and revokes the provider's
+// previous active host in the same transaction, returning the revoked hosts.
+// A provider has at most one active host.
+func (r *Repo) CreateAgentHost(ctx context.Context, item models.AgentHost) (models.AgentHost, []models.AgentHost, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return models.AgentHost{}, nil, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `
+		UPDATE agent_hosts
+		SET status = 'revoked',
+		    revoked_at = NOW(),
+		    revoked_by = 'enrollment',
+		    updated_at = NOW()
+		WHERE provider_id = $1
+		  AND status = 'active'
+		RETURNING `+agentHostColumns+`
+	`, item.ProviderID)
+	if err != nil {
+		return models.AgentHost{}, nil, err
+	}
+	replaced := make([]models.AgentHost, 0)
+	for rows.Next() {
+		host, err := scanAgentHost(rows)
+		if err != nil {
+			rows.Close()
+			return models.AgentHost{}, nil, err
+		}
+		replaced = append(replaced, host)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return models.AgentHost{}, nil, err
+	}
+	created, err := scanAgentHost(tx.QueryRow(ctx, `
+		INSERT INTO agent_hosts (id, provider_id, hostname, label, enrollment_id, status, public_key, credential_id, credential_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+agentHostColumns+`
+	`, item.ID, item.ProviderID, item.Hostname, item.Label, item.EnrollmentID, item.Status, item.PublicKey, item.CredentialID, item.CredentialExpiresAt))
+	if err != nil {
+		return models.AgentHost{}, nil, err
+	}
+	return created, replaced, tx.Commit(ctx)
+}
+
+func (r *Repo) GetAgentHost(ctx context.Context, hostID string) (models.AgentHost, error) {
+	item, err := scanAgentHost(r.db.QueryRow(ctx, `SELECT `+agentHostColumns+` FROM agent_hosts WHERE id = $1`, hostID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentHost{}, errors.New("agent host not found")
+	}
+	return item, err
+}
+
+func (r *Repo) ListAgentHosts(ctx context.Context, providerID string, limit int) ([]models.AgentHost, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+agentHostColumns+`
+		FROM agent_hosts
+		WHERE ($1 = '' OR provider_id = $1)
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, providerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.AgentHost, 0)
+	for rows.Next() {
+		item, err := scanAgentHost(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// RotateAgentHostCredential swaps in a new credential for an active host. The
+// caller must present the current or previous credential, which keeps a
+// rotation whose response was lost recoverable.
+func (r *Repo) RotateAgentHostCredential(ctx context.Context, hostID string, presentedCredentialID string, credentialID string, expiresAt time.Time) (models.AgentHost, error) {
+	item, err := scanAgentHost(r.db.QueryRow(ctx, `
+		UPDATE agent_hosts
+		SET previous_credential_id = credential_id,
+		    credential_id = $3,
+		    credential_expires_at = $4,
+		    rotated_at = NOW(),
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = 'active'
+		  AND $2 IN (credential_id, previous_credential_id)
+		RETURNING `+agentHostColumns+`
+	`, hostID, presentedCredentialID, credentialID, expiresAt))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentHost{}, errors.New("agent credential is no longer valid")
+	}
+	return item, err
+}
+
+// RetirePreviousAgentCredential drops a host's previous credential once
+// credentialID, the current one, has been used.
+func (r *Repo) RetirePreviousAgentCredential(ctx context.Context, hostID string, credentialID string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE agent_hosts
+		SET previous_credential_id = '',
+		    updated_at = NOW()
+		WHERE id = $1 AND credential_id = $2 AND previous_credential_id <> ''
+	`, hostID, credentialID)
+	return err
+}
+
+func (r *Repo) RevokeAgentHost(ctx context.Context, hostID string, revokedBy string) (models.AgentHost, error) {
+	item, err := scanAgentHost(r.db.QueryRow(ctx, `
+		UPDATE agent_hosts
+		SET status = 'revoked',
+		    revoked_at = NOW(),
+		    revoked_by = $2,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND status = 'active'
+		RETURNING `+agentHostColumns+`
+	`, hostID, revokedBy))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentHost{}, errors.New("agent host is already revoked")
+	}
+	return item, err
+}
+
+// SetAgentHostPublicKey registers the heartbeat signing key of a host that
+// enrolled without one. A registered key is never replaced.
+func (r *Repo) SetAgentHostPublicKey(ctx context.Context, hostID string, publicKey string) (models.AgentHost, error) {
+	item, err := scanAgentHost(r.db.QueryRow(ctx, `
+		UPDATE agent_hosts
+		SET public_key = $2,
+		    updated_at = NOW()
+		WHERE id = $1
+		  AND public_key = ''
+		RETURNING `+agentHostColumns+`
+	`, hostID, publicKey))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AgentHost{}, errors.New("agent host already has a public key")
+	}
+	return item, err
+}
+
+const capacityChallengeColumns = `id, provider_id, command_id, kind, nonce, memory_mb, passes, status, detail, issued_by, issued_at, completed_at`
+
+func scanCapacityChallenge(row pgx.Row) (models.CapacityChallenge, error) {
+	var item models.CapacityChallenge
+	var completedAt *time.Time
+	err := row.Scan(&item.ID, &item.ProviderID, &item.CommandID, &item.Kind, &item.Nonce, &item.MemoryMB, &item.Passes, &item.Status, &item.Detail, &item.IssuedBy, &item.IssuedAt, &completedAt)
+	if completedAt != nil {
+		item.CompletedAt = *completedAt
+	}
+	return item, err
+}
+
+func (r *Repo) CreateCapacityChallenge(ctx context.Context, item models.CapacityChallenge) (models.CapacityChallenge, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanCapacityChallenge(r.db.QueryRow(ctx, `
+		INSERT INTO capacity_challenges (id, provider_id, command_id, kind, nonce, memory_mb, passes, status, issued_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+capacityChallengeColumns+`
+	`, item.ID, item.ProviderID, item.CommandID, item.Kind, item.Nonce, item.MemoryMB, item.Passes, item.Status, item.IssuedBy))
+}
+
+func (r *Repo) GetCapacityChallenge(ctx context.Context, challengeID string) (models.CapacityChallenge, error) {
+	item, err := scanCapacityChallenge(r.db.QueryRow(ctx, `SELECT `+capacityChallengeColumns+` FROM capacity_challenges WHERE id = $1`, challengeID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.CapacityChallenge{}, errors.New("capacity challenge not found")
+	}
+	return item, err
+}
+
+func (r *Repo) ListCapacityChallenges(ctx context.Context, providerID string, limit int) ([]models.CapacityChallenge, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+capacityChallengeColumns+`
+		FROM capacity_challenges
+		WHERE ($1 = '' OR provider_id = $1)
+		ORDER BY issued_at DESC
+		LIMIT $2
+	`, providerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.CapacityChallenge, 0)
+	for rows.Next() {
+		item, err := scanCapacityChallenge(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// CompleteCapacityChallenge records the verdict of a pending challenge; a
+// challenge is judged once.
+func (r *Repo) CompleteCapacityChallenge(ctx context.Context, challengeID string, status models.CapacityChallengeState, detail string) (models.CapacityChallenge, error) {
+	item, err := scanCapacityChallenge(r.db.QueryRow(ctx, `
+		UPDATE capacity_challenges
+		SET status = $2,
+		    detail = $3,
+		    completed_at = NOW()
+		WHERE id = $1
+		  AND status = 'pending'
+		RETURNING `+capacityChallengeColumns+`
+	`, challengeID, status, detail))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.CapacityChallenge{}, errors.New("capacity challenge already judged")
+	}
+	return item, err
+}
+
+const hostVerificationColumns = `provider_id, status, reason, consecutive_passes, failed_challenges, last_challenge_at, flagged_at, updated_at`
+
+func scanHostVerification(row pgx.Row) (models.HostVerification, error) {
+	var item models.HostVerification
+	var lastChallengeAt, flaggedAt *time.Time
+	err := row.Scan(&item.ProviderID, &item.Status, &item.Reason, &item.ConsecutivePasses, &item.FailedChallenges, &lastChallengeAt, &flaggedAt, &item.UpdatedAt)
+	if lastChallengeAt != nil {
+		item.LastChallengeAt = *lastChallengeAt
+	}
+	if flaggedAt != nil {
+		item.FlaggedAt = *flaggedAt
+	}
+	return item, err
+}
+
+// GetHostVerification returns the provider's standing, or an unverified one
+// if it has never been challenged.
+func (r *Repo) GetHostVerification(ctx context.Context, providerID string) (models.HostVerification, error) {
+	item, err := scanHostVerification(r.db.QueryRow(ctx, `SELECT `+hostVerificationColumns+` FROM host_verifications WHERE provider_id = $1`, providerID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.HostVerification{ProviderID: providerID, Status: models.HostUnverified}, nil
+	}
+	return item, err
+}
+
+func (r *Repo) UpsertHostVerification(ctx context.Context, item models.HostVerification) (models.HostVerification, error) {
+	return scanHostVerification(r.db.QueryRow(ctx, `
+		INSERT INTO host_verifications (provider_id, status, reason, consecutive_passes, failed_challenges, last_challenge_at, flagged_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (provider_id) DO UPDATE SET
+			status = EXCLUDED.status,
+			reason = EXCLUDED.reason,
+			consecutive_passes = EXCLUDED.consecutive_passes,
+			failed_challenges = EXCLUDED.failed_challenges,
+			last_challenge_at = EXCLUDED.last_challenge_at,
+			flagged_at = EXCLUDED.flagged_at,
+			updated_at = NOW()
+		RETURNING `+hostVerificationColumns+`
+	`, item.ProviderID, item.Status, item.Reason, item.ConsecutivePasses, item.FailedChallenges, nullableTime(item.LastChallengeAt), nullableTime(item.FlaggedAt)))
+}
+
+func (r *Repo) ListHostVerifications(ctx context.Context, status models.HostVerificationState) ([]models.HostVerification, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+hostVerificationColumns+`
+		FROM host_verifications
+		WHERE ($1 = '' OR status = $1)
+		ORDER BY updated_at DESC
+	`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.HostVerification, 0)
+	for rows.Next() {
+		item, err := scanHostVerification(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// ListGPUDeviceOwners maps each known device UUID to the provider that first
+// reported it.
+func (r *Repo) ListGPUDeviceOwners(ctx context.Context, uuids []string) (map[string]string, error) {
+	rows, err := r.db.Query(ctx, `SELECT uuid, provider_id FROM host_gpu_devices WHERE uuid = ANY($1)`, uuids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]string, len(uuids))
+	for rows.Next() {
+		var deviceUUID, providerID string
+		if err := rows.Scan(&deviceUUID, &providerID); err != nil {
+			return nil, err
+		}
+		out[deviceUUID] = providerID
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) UpsertGPUDevices(ctx context.Context, items []models.GPUDevice) error {
+	batch := &pgx.Batch{}
+	for _, item := range items {
+		batch.Queue(`
+			INSERT INTO host_gpu_devices (uuid, provider_id, name, memory_mb, seen_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			ON CONFLICT (uuid) DO UPDATE SET
+				name = EXCLUDED.name,
+				memory_mb = EXCLUDED.memory_mb,
+				seen_at = NOW()
+			WHERE host_gpu_devices.provider_id = EXCLUDED.provider_id
+		`, item.UUID, item.ProviderID, item.Name, item.MemoryMB)
+	}
+	return r.db.SendBatch(ctx, batch).Close()
+}
+
+const execPolicyColumns = `provider_id, enabled, allowed_commands_json, allow_scripts, max_timeout_seconds, run_as, updated_by, updated_at`
+
+func scanExecPolicy(row pgx.Row) (models.ExecPolicy, error) {
+	var item models.ExecPolicy
+	var allowed string
+	if err := row.Scan(&item.ProviderID, &item.Enabled, &allowed, &item.AllowScripts, &item.MaxTimeoutSeconds, &item.RunAs, &item.UpdatedBy, &item.UpdatedAt); err != nil {
+		return models.ExecPolicy{}, err
+	}
+	if err := json.Unmarshal([]byte(allowed), &item.AllowedCommands); err != nil {
+		return models.ExecPolicy{}, err
+	}
+	return item, nil
+}
+
+// GetExecPolicy returns the disabled default for providers without a policy.
+func (r *Repo) GetExecPolicy(ctx context.Context, providerID string) (models.ExecPolicy, error) {
+	item, err := scanExecPolicy(r.db.QueryRow(ctx, `SELECT `+execPolicyColumns+` FROM exec_policies WHERE provider_id = $1`, providerID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.ExecPolicy{ProviderID: providerID, AllowedCommands: []string{}, MaxTimeoutSeconds: 300, RunAs: "nobody"}, nil
+	}
+	return item, err
+}
+
+func (r *Repo) UpsertExecPolicy(ctx context.Context, item models.ExecPolicy) (models.ExecPolicy, error) {
+	if item.AllowedCommands == nil {
+		item.AllowedCommands = []string{}
+	}
+	allowed, err := json.Marshal(item.AllowedCommands)
+	if err != nil {
+		return models.ExecPolicy{}, err
+	}
+	return scanExecPolicy(r.db.QueryRow(ctx, `
+		INSERT INTO exec_policies (provider_id, enabled, allowed_commands_json, allow_scripts, max_timeout_seconds, run_as, updated_by, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (provider_id) DO UPDATE SET
+			enabled = EXCLUDED.enabled,
+			allowed_commands_json = EXCLUDED.allowed_commands_json,
+			allow_scripts = EXCLUDED.allow_scripts,
+			max_timeout_seconds = EXCLUDED.max_timeout_seconds,
+			run_as = EXCLUDED.run_as,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = NOW()
+		RETURNING `+execPolicyColumns+`
+	`, item.ProviderID, item.Enabled, string(allowed), item.AllowScripts, item.MaxTimeoutSeconds, item.RunAs, item.UpdatedBy))
+}
+
+const execRunColumns = `id, provider_id, command_id, requested_by, reason, script, argv_json, work_dir, env_keys_json, run_as, timeout_seconds, status, detail, exit_code, stdout, stderr, output_truncated, created_at, started_at, finished_at`
+
+func scanExecRun(row pgx.Row) (models.ExecRun, error) {
+	var item models.ExecRun
+	var argv, envKeys string
+	var startedAt, finishedAt *time.Time
+	if err := row.Scan(&item.ID, &item.ProviderID, &item.CommandID, &item.RequestedBy, &item.Reason, &item.Script, &argv, &item.WorkDir, &envKeys, &item.RunAs, &item.TimeoutSeconds, &item.Status, &item.Detail, &item.ExitCode, &item.Stdout, &item.Stderr, &item.OutputTruncated, &item.CreatedAt, &startedAt, &finishedAt); err != nil {
+		return models.ExecRun{}, err
+	}
+	if err := json.Unmarshal([]byte(argv), &item.Argv); err != nil {
+		return models.ExecRun{}, err
+	}
+	if err := json.Unmarshal([]byte(envKeys), &item.EnvKeys); err != nil {
+		return models.ExecRun{}, err
+	}
+	if startedAt != nil {
+		item.StartedAt = *startedAt
+	}
+	if finishedAt != nil {
+		item.FinishedAt = *finishedAt
+	}
+	return item, nil
+}
+
+func (r *Repo) CreateExecRun(ctx context.Context, item models.ExecRun) (models.ExecRun, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	if item.Argv == nil {
+		item.Argv = []string{}
+	}
+	if item.EnvKeys == nil {
+		item.EnvKeys = []string{}
+	}
+	argv, err := json.Marshal(item.Argv)
+	if err != nil {
+		return models.ExecRun{}, err
+	}
+	envKeys, err := json.Marshal(item.EnvKeys)
+	if err != nil {
+		return models.ExecRun{}, err
+	}
+	return scanExecRun(r.db.QueryRow(ctx, `
+		INSERT INTO exec_runs (id, provider_id, command_id, requested_by, reason, script, argv_json, work_dir, env_keys_json, run_as, timeout_seconds, status, detail, finished_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING `+execRunColumns+`
+	`, item.ID, item.ProviderID, item.CommandID, item.RequestedBy, item.Reason, item.Script, string(argv), item.WorkDir, string(envKeys), item.RunAs, item.TimeoutSeconds, item.Status, item.Detail, nullableTime(item.FinishedAt)))
+}
+
+func (r *Repo) GetExecRun(ctx context.Context, execID string) (models.ExecRun, error) {
+	item, err := scanExecRun(r.db.QueryRow(ctx, `SELECT `+execRunColumns+` FROM exec_runs WHERE id = $1`, execID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.ExecRun{}, errors.New("exec run not found")
+	}
+	return item, err
+}
+
+func (r *Repo) ListExecRuns(ctx context.Context, providerID string, requestedBy string, limit int) ([]models.ExecRun, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+execRunColumns+`
+		FROM exec_runs
+		WHERE ($1 = '' OR provider_id = $1) AND ($2 = '' OR requested_by = $2)
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, providerID, requestedBy, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.ExecRun, 0)
+	for rows.Next() {
+		item, err := scanExecRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// AppendExecOutput adds a chunk to a run still in progress, keeping at most
+// limit bytes per stream, and marks it running.
+func (r *Repo) AppendExecOutput(ctx context.Context, execID string, stream string, data string, limit int) error {
+	column := "stdout"
+	if stream == "stderr" {
+		column = "stderr"
+	}
+	tag, err := r.db.Exec(ctx, `
+		UPDATE exec_runs SET
+			`+column+` = LEFT(`+column+` || $2, $3),
+			output_truncated = output_truncated OR LENGTH(`+column+`) + LENGTH($2) > $3,
+			status = 'running',
+			started_at = COALESCE(started_at, NOW())
+		WHERE id = $1 AND status IN ('queued', 'running')
+	`, execID, data, limit)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.New("exec run already finished")
+	}
+	return nil
+}
+
+func (r *Repo) FinishExecRun(ctx context.Context, execID string, status models.ExecRunState, exitCode int, truncated bool, detail string) (models.ExecRun, error) {
+	item, err := scanExecRun(r.db.QueryRow(ctx, `
+		UPDATE exec_runs SET
+			status = $2,
+			exit_code = $3,
+			output_truncated = output_truncated OR $4,
+			detail = $5,
+			finished_at = NOW()
+		WHERE id = $1 AND status IN ('queued', 'running')
+		RETURNING `+execRunColumns+`
+	`, execID, status, exitCode, truncated, detail))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.ExecRun{}, errors.New("exec run already finished")
+	}
+	return item, err
+}
+
+const fileTransferColumns = `id, provider_id, resource_id, requested_by, grant_id, direction, path, size, sha256, stored_bytes, host_bytes, status, detail, command_id, created_at, updated_at, completed_at, expires_at`
+
+func scanFileTransfer(row pgx.Row) (models.FileTransfer, error) {
+	var item models.FileTransfer
+	var completedAt *time.Time
+	if err := row.Scan(&item.ID, &item.ProviderID, &item.ResourceID, &item.RequestedBy, &item.GrantID, &item.Direction, &item.Path, &item.Size, &item.SHA256, &item.StoredBytes, &item.HostBytes, &item.Status, &item.Detail, &item.CommandID, &item.CreatedAt, &item.UpdatedAt, &completedAt, &item.ExpiresAt); err != nil {
+		return models.FileTransfer{}, err
+	}
+	if completedAt != nil {
+		item.CompletedAt = *completedAt
+	}
+	return item, nil
+}
+
+func (r *Repo) CreateFileTransfer(ctx context.Context, item models.FileTransfer) (models.FileTransfer, error) {
+	if item.ID == "" {
+		item.ID = uuid.NewString()
+	}
+	return scanFileTransfer(r.db.QueryRow(ctx, `
+		INSERT INTO file_transfers (id, provider_id, resource_id, requested_by, grant_id, direction, path, size, sha256, status, detail, command_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING `+fileTransferColumns+`
+	`, item.ID, item.ProviderID, item.ResourceID, item.RequestedBy, item.GrantID, item.Direction, item.Path, item.Size, item.SHA256, item.Status, item.Detail, item.CommandID, item.ExpiresAt))
+}
+
+func (r *Repo) GetFileTransfer(ctx context.Context, transferID string) (models.FileTransfer, error) {
+	item, err := scanFileTransfer(r.db.QueryRow(ctx, `SELECT `+fileTransferColumns+` FROM file_transfers WHERE id = $1`, transferID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.FileTransfer{}, errors.New("file transfer not found")
+	}
+	return item, err
+}
+
+func (r *Repo) ListFileTransfers(ctx context.Context, providerID string, resourceID string, requestedBy string, limit int) ([]models.FileTransfer, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+fileTransferColumns+`
+		FROM file_transfers
+		WHERE ($1 = '' OR provider_id = $1) AND ($2 = '' OR resource_id = $2) AND ($3 = '' OR requested_by = $3)
+		ORDER BY created_at DESC
+		LIMIT $4
+	`, providerID, resourceID, requestedBy, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.FileTransfer, 0)
+	for rows.Next() {
+		item, err := scanFileTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// UpdateFileTransfer stores a transfer's state and progress. StoredBytes only
+// changes through AppendFileTransferChunk and DeleteFileTransferChunks.
+func (r *Repo) UpdateFileTransfer(ctx context.Context, item models.FileTransfer) (models.FileTransfer, error) {
+	item, err := scanFileTransfer(r.db.QueryRow(ctx, `
+		UPDATE file_transfers SET
+			size = $2,
+			sha256 = $3,
+			host_bytes = $4,
+			status = $5,
+			detail = $6,
+			command_id = $7,
+			completed_at = $8,
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+fileTransferColumns+`
+	`, item.ID, item.Size, item.SHA256, item.HostBytes, item.Status, item.Detail, item.CommandID, nullableTime(item.CompletedAt)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.FileTransfer{}, errors.New("file transfer not found")
+	}
+	return item, err
+}
+
+// AppendFileTransferChunk stores the chunk that starts where the stored part
+// of the file ends, as long as the transfer is still taking data and the
+// result stays within maxBytes.
+func (r *Repo) AppendFileTransferChunk(ctx context.Context, transferID string, offset int64, data []byte, maxBytes int64) (models.FileTransfer, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	defer tx.Rollback(ctx)
+	item, err := scanFileTransfer(tx.QueryRow(ctx, `
+		UPDATE file_transfers SET
+			stored_bytes = stored_bytes + $3,
+			updated_at = NOW()
+		WHERE id = $1 AND stored_bytes = $2 AND status IN ('receiving', 'pulling') AND stored_bytes + $3 <= $4
+		RETURNING `+fileTransferColumns+`
+	`, transferID, offset, int64(len(data)), maxBytes))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.FileTransfer{}, errors.New("file transfer chunk out of order")
+	}
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO file_transfer_chunks (transfer_id, byte_offset, data) VALUES ($1, $2, $3)`, transferID, offset, data); err != nil {
+		return models.FileTransfer{}, err
+	}
+	return item, tx.Commit(ctx)
+}
+
+func (r *Repo) GetFileTransferChunk(ctx context.Context, transferID string, offset int64) ([]byte, error) {
+	var data []byte
+	err := r.db.QueryRow(ctx, `SELECT data FROM file_transfer_chunks WHERE transfer_id = $1 AND byte_offset = $2`, transferID, offset).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errors.New("file transfer chunk not found")
+	}
+	return data, err
 }
 
-func (r *Repo) ListAgentLogs(ctx context.Context, providerID string, resourceID string, level string, limit int) ([]models.AgentLog, error) {
+// ListFileTransferChunks returns up to limit chunks holding bytes at or after
+// offset, in order.
+func (r *Repo) ListFileTransferChunks(ctx context.Context, transferID string, offset int64, limit int) ([]models.FileTransferChunk, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, provider_id, resource_id, level, message, source, created_at
-		FROM agent_logs
-		WHERE ($1 = '' OR provider_id = $1)
-		  AND ($2 = '' OR resource_id = $2)
-		  AND ($3 = '' OR level = $3)
-		ORDER BY created_at DESC
-		LIMIT $4
-	`, providerID, resourceID, level, limit)
+		SELECT byte_offset, data
+		FROM file_transfer_chunks
+		WHERE transfer_id = $1 AND byte_offset + LENGTH(data) > $2
+		ORDER BY byte_offset
+		LIMIT $3
+	`, transferID, offset, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	out := make([]models.AgentLog, 0)
+	out := make([]models.FileTransferChunk, 0)
 	for rows.Next() {
-		var item models.AgentLog
-		if err := rows.Scan(&item.ID, &item.ProviderID, &item.ResourceID, &item.Level, &item.Message, &item.Source, &item.CreatedAt); err != nil {
+		var item models.FileTransferChunk
+		if err := rows.Scan(&item.Offset, &item.Data); err != nil {
 			return nil, err
 		}
 		out = append(out, item)
 	}
-	return out, nil
+	return out, rows.Err()
 }
 
-func (r *Repo) CreateAgentCommand(ctx context.Context, item models.AgentCommand) (models.AgentCommand, error) {
-	if item.ID == "" {
-		item.ID = uuid.NewString()
+// DeleteFileTransferChunks drops the data the service holds for a transfer.
+func (r *Repo) DeleteFileTransferChunks(ctx context.Context, transferID string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
 	}
-	err := r.db.QueryRow(ctx, `
-		INSERT INTO agent_commands (id, provider_id, resource_id, session_id, command, payload, rows, cols, status, requested_by, result_message)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-		RETURNING acknowledged_at, created_at, updated_at
-	`, item.ID, item.ProviderID, item.ResourceID, item.SessionID, item.Command, item.Payload, item.Rows, item.Cols, item.Status, item.RequestedBy, item.ResultMessage).Scan(&item.AcknowledgedAt, &item.CreatedAt, &item.UpdatedAt)
-	return item, err
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `DELETE FROM file_transfer_chunks WHERE transfer_id = $1`, transferID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE file_transfers SET stored_bytes = 0, updated_at = NOW() WHERE id = $1`, transferID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
-func (r *Repo) ListAgentCommands(ctx context.Context, providerID string, limit int) ([]models.AgentCommand, error) {
+// ListExpiredFileTransfers returns transfers past their expiry that still
+// hold data or are unfinished, or downloads whose content was available.
+func (r *Repo) ListExpiredFileTransfers(ctx context.Context, now time.Time, limit int) ([]models.FileTransfer, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id, provider_id, resource_id, session_id, command, payload, rows, cols, status, requested_by, result_message, acknowledged_at, created_at, updated_at
-		FROM agent_commands
-		WHERE ($1 = '' OR provider_id = $1)
-		ORDER BY created_at DESC
+		SELECT `+fileTransferColumns+`
+		FROM file_transfers
+		WHERE expires_at <= $1 AND (
+			stored_bytes > 0
+			OR status IN ('receiving', 'pushing', 'pulling')
+			OR (direction = 'download' AND status = 'completed')
+		)
+		ORDER BY expires_at
 		LIMIT $2
-	`, providerID, limit)
+	`, now, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	out := make([]models.AgentCommand, 0)
+	out := make([]models.FileTransfer, 0)
 	for rows.Next() {
-		var item models.AgentCommand
-		if err := rows.Scan(&item.ID, &item.ProviderID, &item.ResourceID, &item.SessionID, &item.Command, &item.Payload, &item.Rows, &item.Cols, &item.Status, &item.RequestedBy, &item.ResultMessage, &item.AcknowledgedAt, &item.CreatedAt, &item.UpdatedAt); err != nil {
+		item, err := scanFileTransfer(rows)
+		if err != nil {
 			return nil, err
 		}
 		out = append(out, item)
 	}
-	return out, nil
-}
-
-func (r *Repo) ClaimNextAgentCommand(ctx context.Context, providerID string) (models.AgentCommand, error) {
-	var item models.AgentCommand
-	err := r.db.QueryRow(ctx, `
-		WITH next AS (
-			SELECT id
-			FROM agent_commands
-			WHERE provider_id = $1
-			  AND status = 'queued'
-			ORDER BY created_at ASC
-			LIMIT 1
-		)
-		UPDATE agent_commands AS ac
-		SET status = 'running',
-		    acknowledged_at = NOW(),
-		    updated_at = NOW()
-		FROM next
-		WHERE ac.id = next.id
-		RETURNING ac.id, ac.provider_id, ac.resource_id, ac.session_id, ac.command, ac.payload, ac.rows, ac.cols, ac.status, ac.requested_by, ac.result_message, ac.acknowledged_at, ac.created_at, ac.updated_at
-	`, providerID).Scan(&item.ID, &item.ProviderID, &item.ResourceID, &item.SessionID, &item.Command, &item.Payload, &item.Rows, &item.Cols, &item.Status, &item.RequestedBy, &item.ResultMessage, &item.AcknowledgedAt, &item.CreatedAt, &item.UpdatedAt)
-	if errors.Is(err, pgx.ErrNoRows) {
-		return models.AgentCommand{}, nil
-	}
-	return item, err
-}
-
-func (r *Repo) CompleteAgentCommand(ctx context.Context, commandID string, status models.AgentCommandState, resultMessage string) (models.AgentCommand, error) {
-	var item models.AgentCommand
-	err := r.db.QueryRow(ctx, `
-		UPDATE agent_commands
-		SET status = $2,
-		    result_message = $3,
-		    updated_at = NOW()
-		WHERE id = $1
-		RETURNING id, provider_id, resource_id, session_id, command, payload, rows, cols, status, requested_by, result_message, acknowledged_at, created_at, updated_at
-	`, commandID, status, resultMessage).Scan(&item.ID, &item.ProviderID, &item.ResourceID, &item.SessionID, &item.Command, &item.Payload, &item.Rows, &item.Cols, &item.Status, &item.RequestedBy, &item.ResultMessage, &item.AcknowledgedAt, &item.CreatedAt, &item.UpdatedAt)
-	return item, err
+	return out, rows.Err()
 }
 
 func (r *Repo) CreateTerminalSession(ctx context.Context, item models.TerminalSession) (models.TerminalSession, error) {
 	if item.ID == "" {
 		item.ID = uuid.NewString()
 	}
+	item.InitialRows, item.InitialCols = item.Rows, item.Cols
 	err := r.db.QueryRow(ctx, `
 		INSERT INTO terminal_sessions (
-			id, provider_id, resource_id, renter_user_id, status, rows, cols, last_input_seq, last_output_seq, last_active_at, closed_at, exit_code
+			id, provider_id, resource_id, renter_user_id, grant_id, status, rows, cols, initial_rows, initial_cols, last_input_seq, last_output_seq, last_active_at, closed_at, exit_code
 		)
-		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,NOW(),NULL,$10)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$7,$8,$9,$10,NOW(),NULL,$11)
 		RETURNING created_at, updated_at, last_active_at
-	`, item.ID, item.ProviderID, item.ResourceID, item.RenterUserID, item.Status, item.Rows, item.Cols, item.LastInputSeq, item.LastOutputSeq, item.ExitCode).Scan(&item.CreatedAt, &item.UpdatedAt, &item.LastActiveAt)
+	`, item.ID, item.ProviderID, item.ResourceID, item.RenterUserID, item.GrantID, item.Status, item.Rows, item.Cols, item.LastInputSeq, item.LastOutputSeq, item.ExitCode).Scan(&item.CreatedAt, &item.UpdatedAt, &item.LastActiveAt)
 	return item, err
 }
 
-func (r *Repo) GetTerminalSession(ctx context.Context, sessionID string) (models.TerminalSession, error) {
+const terminalSessionColumns = `id, provider_id, resource_id, renter_user_id, grant_id, status, rows, cols, initial_rows, initial_cols, last_input_seq, last_output_seq, last_active_at, closed_at, exit_code, recording_purged_at, created_at, updated_at`
+
+func scanTerminalSession(row pgx.Row) (models.TerminalSession, error) {
 	var item models.TerminalSession
-	var closedAt sql.NullTime
-	err := r.db.QueryRow(ctx, `
-		SELECT id, provider_id, resource_id, renter_user_id, status, rows, cols, last_input_seq, last_output_seq, last_active_at, closed_at, exit_code, created_at, updated_at
-		FROM terminal_sessions
-		WHERE id = $1
-	`, sessionID).Scan(
-		&item.ID, &item.ProviderID, &item.ResourceID, &item.RenterUserID, &item.Status, &item.Rows, &item.Cols, &item.LastInputSeq, &item.LastOutputSeq, &item.LastActiveAt, &closedAt, &item.ExitCode, &item.CreatedAt, &item.UpdatedAt,
+	var closedAt, purgedAt sql.NullTime
+	err := row.Scan(
+		&item.ID, &item.ProviderID, &item.ResourceID, &item.RenterUserID, &item.GrantID, &item.Status, &item.Rows, &item.Cols, &item.InitialRows, &item.InitialCols, &item.LastInputSeq, &item.LastOutputSeq, &item.LastActiveAt, &closedAt, &item.ExitCode, &purgedAt, &item.CreatedAt, &item.UpdatedAt,
 	)
 	if closedAt.Valid {
 		item.ClosedAt = closedAt.Time
 	}
+	if purgedAt.Valid {
+		item.RecordingPurgedAt = purgedAt.Time
+	}
 	return item, err
 }
 
+func (r *Repo) GetTerminalSession(ctx context.Context, sessionID string) (models.TerminalSession, error) {
+	return scanTerminalSession(r.db.QueryRow(ctx, `SELECT `+terminalSessionColumns+` FROM terminal_sessions WHERE id = $1`, sessionID))
+}
+
+func (r *Repo) ListTerminalSessions(ctx context.Context, resourceID string, limit int) ([]models.TerminalSession, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+terminalSessionColumns+`
+		FROM terminal_sessions
+		WHERE resource_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, resourceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.TerminalSession, 0)
+	for rows.Next() {
+		item, err := scanTerminalSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) ListProviderTerminalSessions(ctx context.Context, providerID string, limit int) ([]models.TerminalSession, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT `+terminalSessionColumns+`
+		FROM terminal_sessions
+		WHERE provider_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, providerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.TerminalSession, 0)
+	for rows.Next() {
+		item, err := scanTerminalSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
 func (r *Repo) UpdateTerminalSessionStatus(ctx context.Context, sessionID string, status models.TerminalSessionState, exitCode int) (models.TerminalSession, error) {
-	var item models.TerminalSession
-	var closedAt sql.NullTime
-	err := r.db.QueryRow(ctx, `
+	return scanTerminalSession(r.db.QueryRow(ctx, `
 		UPDATE terminal_sessions
 		SET status = $2,
 		    exit_code = $3,
@@ -1257,34 +4638,18 @@ func (r *Repo) UpdateTerminalSessionStatus(ctx context.Context, sessionID string
 		    last_active_at = NOW(),
 		    updated_at = NOW()
 		WHERE id = $1
-		RETURNING id, provider_id, resource_id, renter_user_id, status, rows, cols, last_input_seq, last_output_seq, last_active_at, closed_at, exit_code, created_at, updated_at
-	`, sessionID, status, exitCode).Scan(
-		&item.ID, &item.ProviderID, &item.ResourceID, &item.RenterUserID, &item.Status, &item.Rows, &item.Cols, &item.LastInputSeq, &item.LastOutputSeq, &item.LastActiveAt, &closedAt, &item.ExitCode, &item.CreatedAt, &item.UpdatedAt,
-	)
-	if closedAt.Valid {
-		item.ClosedAt = closedAt.Time
-	}
-	return item, err
+		RETURNING `+terminalSessionColumns, sessionID, status, exitCode))
 }
 
 func (r *Repo) UpdateTerminalSessionSize(ctx context.Context, sessionID string, rows int, cols int) (models.TerminalSession, error) {
-	var item models.TerminalSession
-	var closedAt sql.NullTime
-	err := r.db.QueryRow(ctx, `
+	return scanTerminalSession(r.db.QueryRow(ctx, `
 		UPDATE terminal_sessions
 		SET rows = $2,
 		    cols = $3,
 		    last_active_at = NOW(),
 		    updated_at = NOW()
 		WHERE id = $1
-		RETURNING id, provider_id, resource_id, renter_user_id, status, rows, cols, last_input_seq, last_output_seq, last_active_at, closed_at, exit_code, created_at, updated_at
-	`, sessionID, rows, cols).Scan(
-		&item.ID, &item.ProviderID, &item.ResourceID, &item.RenterUserID, &item.Status, &item.Rows, &item.Cols, &item.LastInputSeq, &item.LastOutputSeq, &item.LastActiveAt, &closedAt, &item.ExitCode, &item.CreatedAt, &item.UpdatedAt,
-	)
-	if closedAt.Valid {
-		item.ClosedAt = closedAt.Time
-	}
-	return item, err
+		RETURNING `+terminalSessionColumns, sessionID, rows, cols))
 }
 
 func (r *Repo) AppendTerminalChunk(ctx context.Context, chunk models.TerminalChunk) (models.TerminalChunk, error) {
@@ -1297,37 +4662,41 @@ func (r *Repo) AppendTerminalChunk(ctx context.Context, chunk models.TerminalChu
 	}
 	defer tx.Rollback(ctx)
 
+	// A chunk sequenced in memory keeps its seq; the session counter only
+	// moves forward, since another instance may have written past it.
 	var seq int64
 	switch chunk.Direction {
 	case models.TerminalChunkInput:
 		err = tx.QueryRow(ctx, `
 			UPDATE terminal_sessions
-			SET last_input_seq = last_input_seq + 1,
+			SET last_input_seq = CASE WHEN $2::BIGINT > 0 THEN GREATEST(last_input_seq, $2::BIGINT) ELSE last_input_seq + 1 END,
 			    last_active_at = NOW(),
 			    updated_at = NOW()
 			WHERE id = $1
 			RETURNING last_input_seq
-		`, chunk.SessionID).Scan(&seq)
+		`, chunk.SessionID, chunk.Seq).Scan(&seq)
 	default:
 		err = tx.QueryRow(ctx, `
 			UPDATE terminal_sessions
-			SET last_output_seq = last_output_seq + 1,
+			SET last_output_seq = CASE WHEN $2::BIGINT > 0 THEN GREATEST(last_output_seq, $2::BIGINT) ELSE last_output_seq + 1 END,
 			    last_active_at = NOW(),
 			    updated_at = NOW()
 			WHERE id = $1
 			RETURNING last_output_seq
-		`, chunk.SessionID).Scan(&seq)
+		`, chunk.SessionID, chunk.Seq).Scan(&seq)
 	}
 	if err != nil {
 		return models.TerminalChunk{}, err
 	}
-	chunk.Seq = seq
+	if chunk.Seq == 0 {
+		chunk.Seq = seq
+	}
 
 	err = tx.QueryRow(ctx, `
-		INSERT INTO terminal_chunks (id, session_id, provider_id, direction, seq, data)
-		VALUES ($1,$2,$3,$4,$5,$6)
+		INSERT INTO terminal_chunks (id, session_id, provider_id, direction, seq, data, created_at)
+		VALUES ($1,$2,$3,$4,$5,$6,COALESCE($7, NOW()))
 		RETURNING created_at
-	`, chunk.ID, chunk.SessionID, chunk.ProviderID, chunk.Direction, chunk.Seq, chunk.Data).Scan(&chunk.CreatedAt)
+	`, chunk.ID, chunk.SessionID, chunk.ProviderID, chunk.Direction, chunk.Seq, chunk.Data, nullableTime(chunk.CreatedAt)).Scan(&chunk.CreatedAt)
 	if err != nil {
 		return models.TerminalChunk{}, err
 	}
@@ -1337,6 +4706,29 @@ func (r *Repo) AppendTerminalChunk(ctx context.Context, chunk models.TerminalChu
 	return chunk, nil
 }
 
+// ReserveTerminalSeqs reserves the next count seqs of a direction and
+// returns the last one. Blocks start above both earlier reservations and the
+// highest stored seq.
+func (r *Repo) ReserveTerminalSeqs(ctx context.Context, sessionID string, direction models.TerminalChunkDirection, count int64) (int64, error) {
+	query := `
+		UPDATE terminal_sessions
+		SET reserved_output_seq = GREATEST(reserved_output_seq, last_output_seq) + $2
+		WHERE id = $1
+		RETURNING reserved_output_seq
+	`
+	if direction == models.TerminalChunkInput {
+		query = `
+			UPDATE terminal_sessions
+			SET reserved_input_seq = GREATEST(reserved_input_seq, last_input_seq) + $2
+			WHERE id = $1
+			RETURNING reserved_input_seq
+		`
+	}
+	var end int64
+	err := r.db.QueryRow(ctx, query, sessionID, count).Scan(&end)
+	return end, err
+}
+
 func (r *Repo) ListTerminalChunks(ctx context.Context, sessionID string, direction models.TerminalChunkDirection, afterSeq int64, limit int) ([]models.TerminalChunk, error) {
 	rows, err := r.db.Query(ctx, `
 		SELECT id, session_id, provider_id, direction, seq, data, created_at
@@ -1367,17 +4759,144 @@ func (r *Repo) CreateTerminalAuditEvent(ctx context.Context, event models.Termin
 		event.ID = uuid.NewString()
 	}
 	err := r.db.QueryRow(ctx, `
-		INSERT INTO terminal_audit_events (id, session_id, provider_id, user_id, event_type, details)
-		VALUES ($1,$2,$3,$4,$5,$6)
+		INSERT INTO terminal_audit_events (id, session_id, provider_id, user_id, grant_id, event_type, details)
+		VALUES ($1,$2,$3,$4,$5,$6,$7)
 		RETURNING created_at
-	`, event.ID, event.SessionID, event.ProviderID, event.UserID, event.EventType, event.Details).Scan(&event.CreatedAt)
+	`, event.ID, event.SessionID, event.ProviderID, event.UserID, event.GrantID, event.EventType, event.Details).Scan(&event.CreatedAt)
 	return event, err
 }
 
+func (r *Repo) ListTerminalAuditEvents(ctx context.Context, sessionID string, eventType string, limit int) ([]models.TerminalAuditEvent, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, session_id, provider_id, user_id, grant_id, event_type, details, created_at
+		FROM terminal_audit_events
+		WHERE session_id = $1
+		  AND ($2 = '' OR event_type = $2)
+		ORDER BY created_at ASC
+		LIMIT $3
+	`, sessionID, eventType, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.TerminalAuditEvent, 0)
+	for rows.Next() {
+		var item models.TerminalAuditEvent
+		if err := rows.Scan(&item.ID, &item.SessionID, &item.ProviderID, &item.UserID, &item.GrantID, &item.EventType, &item.Details, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+// PurgeTerminalRecordings drops the chunks of sessions that ended before
+// endedBefore. Sessions and their audit events are kept and marked purged.
+func (r *Repo) PurgeTerminalRecordings(ctx context.Context, endedBefore time.Time, limit int) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `
+		UPDATE terminal_sessions
+		SET recording_purged_at = NOW()
+		WHERE id IN (
+			SELECT id
+			FROM terminal_sessions
+			WHERE status IN ('closed', 'expired')
+			  AND closed_at <= $1
+			  AND recording_purged_at IS NULL
+			ORDER BY closed_at ASC
+			LIMIT $2
+		)
+		RETURNING id
+	`, endedBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM terminal_chunks WHERE session_id = ANY($1)`, ids); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit(ctx)
+}
+
+func (r *Repo) UpsertTerminalParticipant(ctx context.Context, item models.TerminalParticipant) (models.TerminalParticipant, error) {
+	err := r.db.QueryRow(ctx, `
+		INSERT INTO terminal_participants (session_id, user_id, role, invited_by)
+		VALUES ($1,$2,$3,$4)
+		ON CONFLICT (session_id, user_id) DO UPDATE
+		SET role = EXCLUDED.role,
+		    invited_by = EXCLUDED.invited_by,
+		    updated_at = NOW()
+		RETURNING created_at, updated_at
+	`, item.SessionID, item.UserID, item.Role, item.InvitedBy).Scan(&item.CreatedAt, &item.UpdatedAt)
+	return item, err
+}
+
+func (r *Repo) GetTerminalParticipant(ctx context.Context, sessionID string, userID string) (models.TerminalParticipant, error) {
+	var item models.TerminalParticipant
+	err := r.db.QueryRow(ctx, `
+		SELECT session_id, user_id, role, invited_by, created_at, updated_at
+		FROM terminal_participants
+		WHERE session_id = $1 AND user_id = $2
+	`, sessionID, userID).Scan(&item.SessionID, &item.UserID, &item.Role, &item.InvitedBy, &item.CreatedAt, &item.UpdatedAt)
+	return item, err
+}
+
+func (r *Repo) ListTerminalParticipants(ctx context.Context, sessionID string) ([]models.TerminalParticipant, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT session_id, user_id, role, invited_by, created_at, updated_at
+		FROM terminal_participants
+		WHERE session_id = $1
+		ORDER BY created_at ASC
+	`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.TerminalParticipant, 0)
+	for rows.Next() {
+		var item models.TerminalParticipant
+		if err := rows.Scan(&item.SessionID, &item.UserID, &item.Role, &item.InvitedBy, &item.CreatedAt, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) DeleteTerminalParticipant(ctx context.Context, sessionID string, userID string) error {
+	tag, err := r.db.Exec(ctx, `DELETE FROM terminal_participants WHERE session_id = $1 AND user_id = $2`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
 func (r *Repo) ExpireIdleTerminalSessions(ctx context.Context, idleBefore time.Time, limit int) ([]models.TerminalSession, error) {
 	rows, err := r.db.Query(ctx, `
 		WITH picked AS (
-			SELECT id
+			SELECT id AS picked_id
 			FROM terminal_sessions
 			WHERE status IN ('queued', 'open')
 			  AND last_active_at <= $1
@@ -1389,8 +4908,8 @@ func (r *Repo) ExpireIdleTerminalSessions(ctx context.Context, idleBefore time.T
 		    closed_at = NOW(),
 		    updated_at = NOW()
 		FROM picked
-		WHERE s.id = picked.id
-		RETURNING s.id, s.provider_id, s.resource_id, s.renter_user_id, s.status, s.rows, s.cols, s.last_input_seq, s.last_output_seq, s.last_active_at, s.closed_at, s.exit_code, s.created_at, s.updated_at
+		WHERE s.id = picked.picked_id
+		RETURNING `+terminalSessionColumns+`
 	`, idleBefore, limit)
 	if err != nil {
 		return nil, err
@@ -1398,19 +4917,13 @@ func (r *Repo) ExpireIdleTerminalSessions(ctx context.Context, idleBefore time.T
 	defer rows.Close()
 	out := make([]models.TerminalSession, 0)
 	for rows.Next() {
-		var item models.TerminalSession
-		var closedAt sql.NullTime
-		if err := rows.Scan(
-			&item.ID, &item.ProviderID, &item.ResourceID, &item.RenterUserID, &item.Status, &item.Rows, &item.Cols, &item.LastInputSeq, &item.LastOutputSeq, &item.LastActiveAt, &closedAt, &item.ExitCode, &item.CreatedAt, &item.UpdatedAt,
-		); err != nil {
+		item, err := scanTerminalSession(rows)
+		if err != nil {
 			return nil, err
 		}
-		if closedAt.Valid {
-			item.ClosedAt = closedAt.Time
-		}
 		out = append(out, item)
 	}
-	return out, nil
+	return out, rows.Err()
 }
 
 func (r *Repo) CountActiveTerminalSessions(ctx context.Context, renterUserID string) (int, error) {
@@ -1460,6 +4973,80 @@ func (r *Repo) ListRootInputLogs(ctx context.Context, providerID string, resourc
 	return out, nil
 }
 
+func (r *Repo) CreateResourceLogs(ctx context.Context, items []models.ResourceLog) ([]models.ResourceLog, error) {
+	batch := &pgx.Batch{}
+	for i := range items {
+		if items[i].ID == "" {
+			items[i].ID = uuid.NewString()
+		}
+		item := &items[i]
+		batch.Queue(`
+			INSERT INTO resource_logs (id, provider_id, resource_id, resource_type, source_type, source, stream, level, message, occurred_at)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+			RETURNING seq, created_at
+		`, item.ID, item.ProviderID, item.ResourceID, item.ResourceType, item.SourceType, item.Source, item.Stream, item.Level, item.Message, item.OccurredAt).QueryRow(func(row pgx.Row) error {
+			return row.Scan(&item.Seq, &item.CreatedAt)
+		})
+	}
+	if err := r.db.SendBatch(ctx, batch).Close(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *Repo) ListResourceLogs(ctx context.Context, query models.ResourceLogQuery) ([]models.ResourceLog, error) {
+	order := "DESC"
+	if query.AfterSeq > 0 {
+		order = "ASC"
+	}
+	levels := query.Levels
+	if levels == nil {
+		levels = []string{}
+	}
+	text := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query.Text)
+	rows, err := r.db.Query(ctx, `
+		SELECT id, seq, provider_id, resource_id, resource_type, source_type, source, stream, level, message, occurred_at, created_at
+		FROM resource_logs
+		WHERE resource_id = $1
+		  AND (cardinality($2::text[]) = 0 OR level = ANY($2::text[]))
+		  AND ($3 = '' OR message ILIKE '%' || $3 || '%')
+		  AND ($4 = '' OR source = $4)
+		  AND ($5 = 0 OR seq > $5)
+		  AND ($6 = 0 OR seq < $6)
+		ORDER BY seq `+order+`
+		LIMIT $7
+	`, query.ResourceID, levels, text, query.Source, query.AfterSeq, query.BeforeSeq, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.ResourceLog, 0)
+	for rows.Next() {
+		var item models.ResourceLog
+		if err := rows.Scan(&item.ID, &item.Seq, &item.ProviderID, &item.ResourceID, &item.ResourceType, &item.SourceType, &item.Source, &item.Stream, &item.Level, &item.Message, &item.OccurredAt, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) DeleteResourceLogsBefore(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	tag, err := r.db.Exec(ctx, `
+		DELETE FROM resource_logs
+		WHERE id IN (
+			SELECT id FROM resource_logs
+			WHERE created_at < $1
+			ORDER BY created_at ASC
+			LIMIT $2
+		)
+	`, cutoff, limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
 func (r *Repo) ConsumeCreateRateLimit(ctx context.Context, userID string, windowStart time.Time, windowEnd time.Time, limit int) (bool, error) {
 	var used int
 	err := r.db.QueryRow(ctx, `
@@ -1651,3 +5238,57 @@ func (r *Repo) seedVMTemplates(ctx context.Context) error {
 	}
 	return nil
 }
+
+func (r *Repo) AppendStreamEvents(ctx context.Context, origin string, payloads [][]byte) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+	batch := &pgx.Batch{}
+	for _, payload := range payloads {
+		batch.Queue(`INSERT INTO stream_events (origin, payload) VALUES ($1, $2)`, origin, string(payload))
+	}
+	return r.db.SendBatch(ctx, batch).Close()
+}
+
+func (r *Repo) LatestStreamEventID(ctx context.Context) (int64, error) {
+	var id int64
+	err := r.db.QueryRow(ctx, `SELECT COALESCE(MAX(id), 0) FROM stream_events`).Scan(&id)
+	return id, err
+}
+
+// ListStreamEvents returns the stream events after afterID in id order. Ids
+// are taken before the insert commits, so rows younger than a second are held
+// back until a slower insert with a lower id has had time to commit.
+func (r *Repo) ListStreamEvents(ctx context.Context, afterID int64, limit int) ([]models.StreamRelayEvent, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, origin, payload
+		FROM stream_events
+		WHERE id > $1
+		  AND created_at < NOW() - INTERVAL '1 second'
+		ORDER BY id
+		LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]models.StreamRelayEvent, 0)
+	for rows.Next() {
+		var item models.StreamRelayEvent
+		var payload string
+		if err := rows.Scan(&item.ID, &item.Origin, &payload); err != nil {
+			return nil, err
+		}
+		item.Payload = []byte(payload)
+		out = append(out, item)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repo) DeleteStreamEventsBefore(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM stream_events WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
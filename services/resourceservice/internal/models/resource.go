@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type HostResource struct {
 	ID               string    `json:"id"`
@@ -13,6 +16,10 @@ type HostResource struct {
 	GPUMemoryUsedMB  int       `json:"gpu_memory_used_mb"`
 	NetworkMbps      int       `json:"network_mbps"`
 	HeartbeatAt      time.Time `json:"heartbeat_at"`
+	Signed           bool      `json:"signed"`
+	AgentVersion     string    `json:"agent_version"`
+	Region           string    `json:"region"`
+	Labels           []string  `json:"labels"`
 }
 
 type Allocation struct {
@@ -91,6 +98,15 @@ const (
 	HealthStatusCritical HealthStatus = "critical"
 )
 
+// ResourceHealth summarizes the active probes of a running VM or pod.
+type ResourceHealth string
+
+const (
+	ResourceHealthUnknown  ResourceHealth = "unknown"
+	ResourceHealthHealthy  ResourceHealth = "healthy"
+	ResourceHealthDegraded ResourceHealth = "degraded"
+)
+
 type ClusterStatus string
 
 const (
@@ -103,48 +119,110 @@ const (
 )
 
 type VM struct {
-	ID                      string    `json:"id"`
-	UserID                  string    `json:"user_id"`
-	ProviderID              string    `json:"provider_id"`
-	Name                    string    `json:"name"`
-	Template                string    `json:"template"`
-	OSName                  string    `json:"os_name"`
-	IPAddress               string    `json:"ip_address"`
-	Region                  string    `json:"region"`
-	CloudType               string    `json:"cloud_type"`
-	CPUCores                int       `json:"cpu_cores"`
-	VCPU                    int       `json:"vcpu"`
-	RAMMB                   int       `json:"ram_mb"`
-	SystemRAMGB             int       `json:"system_ram_gb"`
-	GPUUnits                int       `json:"gpu_units"`
-	VRAMGB                  int       `json:"vram_gb"`
-	NetworkMbps             int       `json:"network_mbps"`
-	NetworkVolumeSupported  bool      `json:"network_volume_supported"`
-	GlobalNetworkingSupport bool      `json:"global_networking_supported"`
-	AvailabilityTier        string    `json:"availability_tier"`
-	MaxInstances            int       `json:"max_instances"`
-	ExternalID              string    `json:"external_id"`
-	ExpiresAt               time.Time `json:"expires_at"`
-	Status                  VMStatus  `json:"status"`
-	CreatedAt               time.Time `json:"created_at"`
-	UpdatedAt               time.Time `json:"updated_at"`
+	ID                      string         `json:"id"`
+	UserID                  string         `json:"user_id"`
+	ProviderID              string         `json:"provider_id"`
+	Name                    string         `json:"name"`
+	Template                string         `json:"template"`
+	OSName                  string         `json:"os_name"`
+	IPAddress               string         `json:"ip_address"`
+	Region                  string         `json:"region"`
+	CloudType               string         `json:"cloud_type"`
+	CPUCores                int            `json:"cpu_cores"`
+	VCPU                    int            `json:"vcpu"`
+	RAMMB                   int            `json:"ram_mb"`
+	SystemRAMGB             int            `json:"system_ram_gb"`
+	GPUUnits                int            `json:"gpu_units"`
+	VRAMGB                  int            `json:"vram_gb"`
+	NetworkMbps             int            `json:"network_mbps"`
+	NetworkVolumeSupported  bool           `json:"network_volume_supported"`
+	GlobalNetworkingSupport bool           `json:"global_networking_supported"`
+	AvailabilityTier        string         `json:"availability_tier"`
+	MaxInstances            int            `json:"max_instances"`
+	ExternalID              string         `json:"external_id"`
+	ExpiresAt               time.Time      `json:"expires_at"`
+	Status                  VMStatus       `json:"status"`
+	Health                  ResourceHealth `json:"health"`
+	CreatedAt               time.Time      `json:"created_at"`
+	UpdatedAt               time.Time      `json:"updated_at"`
 }
 
 type Pod struct {
-	ID         string    `json:"id"`
-	UserID     string    `json:"user_id"`
-	ProviderID string    `json:"provider_id"`
-	Name       string    `json:"name"`
-	ImageName  string    `json:"image_name"`
-	GPUTypeID  string    `json:"gpu_type_id"`
-	GPUCount   int       `json:"gpu_count"`
-	CPUCount   int       `json:"cpu_count"`
-	MemoryGB   int       `json:"memory_gb"`
-	ExternalID string    `json:"external_id"`
-	ExpiresAt  time.Time `json:"expires_at"`
-	Status     PodStatus `json:"status"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID               string           `json:"id"`
+	UserID           string           `json:"user_id"`
+	ProviderID       string           `json:"provider_id"`
+	Name             string           `json:"name"`
+	ImageName        string           `json:"image_name"`
+	GPUTypeID        string           `json:"gpu_type_id"`
+	GPUCount         int              `json:"gpu_count"`
+	CPUCount         int              `json:"cpu_count"`
+	MemoryGB         int              `json:"memory_gb"`
+	Env              []PodEnvVar      `json:"env"`
+	Command          []string         `json:"command"`
+	Args             []string         `json:"args"`
+	Ports            []PodPort        `json:"ports"`
+	ContainerDiskGB  int              `json:"container_disk_gb"`
+	VolumeMounts     []PodVolumeMount `json:"volume_mounts"`
+	RegistryAuthID   string           `json:"registry_auth_id"`
+	Backend          PodBackend       `json:"backend"`
+	AllocationID     string           `json:"allocation_id"`
+	ExternalID       string           `json:"external_id"`
+	IPAddress        string           `json:"ip_address"`
+	AvailabilityTier string           `json:"availability_tier"`
+	ExpiresAt        time.Time        `json:"expires_at"`
+	Status           PodStatus        `json:"status"`
+	Health           ResourceHealth   `json:"health"`
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+}
+
+type PodBackend string
+
+const (
+	PodBackendRunPod PodBackend = "runpod"
+	PodBackendLocal  PodBackend = "local"
+)
+
+type PodEnvVar struct {
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	SecretRef string `json:"secret_ref,omitempty"`
+}
+
+type PodPortProtocol string
+
+const (
+	PodPortProtocolHTTP PodPortProtocol = "http"
+	PodPortProtocolTCP  PodPortProtocol = "tcp"
+)
+
+// PodPort is a container port to expose. HostPort is the port a donor host
+// published it on, reported once a local pod starts.
+type PodPort struct {
+	Port     int             `json:"port"`
+	Protocol PodPortProtocol `json:"protocol"`
+	HostPort int             `json:"host_port,omitempty"`
+}
+
+type PodVolumeMount struct {
+	MountPath       string `json:"mount_path"`
+	SizeGB          int    `json:"size_gb"`
+	NetworkVolumeID string `json:"network_volume_id,omitempty"`
+}
+
+type LocalPodSpec struct {
+	PodID           string           `json:"pod_id"`
+	AllocationID    string           `json:"allocation_id"`
+	ImageName       string           `json:"image_name"`
+	Env             []PodEnvVar      `json:"env,omitempty"`
+	Command         []string         `json:"command,omitempty"`
+	Args            []string         `json:"args,omitempty"`
+	Ports           []PodPort        `json:"ports,omitempty"`
+	CPUCount        int              `json:"cpu_count"`
+	MemoryGB        int              `json:"memory_gb"`
+	GPUCount        int              `json:"gpu_count"`
+	ContainerDiskGB int              `json:"container_disk_gb"`
+	VolumeMounts    []PodVolumeMount `json:"volume_mounts,omitempty"`
 }
 
 type VMTemplate struct {
@@ -184,23 +262,124 @@ const (
 	SharedInventoryStatusSoldOut SharedInventoryStatus = "sold_out"
 )
 
+type OfferPricingMode string
+
+const (
+	OfferPricingFixed   OfferPricingMode = "fixed"
+	OfferPricingAuction OfferPricingMode = "auction"
+)
+
+type AuctionRule string
+
+const (
+	AuctionRuleUniform     AuctionRule = "uniform"
+	AuctionRuleSecondPrice AuctionRule = "second_price"
+)
+
+// SharedInventoryOffer is sold at PriceHourly in fixed mode. In auction mode
+// PriceHourly is the reserve price and capacity goes to the highest bids at
+// every clearing period.
 type SharedInventoryOffer struct {
-	ID           string                `json:"id"`
-	ProviderID   string                `json:"provider_id"`
-	ResourceType string                `json:"resource_type"`
-	Title        string                `json:"title"`
-	Description  string                `json:"description"`
-	CPUCores     int                   `json:"cpu_cores"`
-	RAMMB        int                   `json:"ram_mb"`
-	GPUUnits     int                   `json:"gpu_units"`
-	NetworkMbps  int                   `json:"network_mbps"`
-	Quantity     int                   `json:"quantity"`
-	AvailableQty int                   `json:"available_qty"`
-	PriceHourly  float64               `json:"price_hourly_usd"`
-	Status       SharedInventoryStatus `json:"status"`
-	CreatedBy    string                `json:"created_by"`
-	CreatedAt    time.Time             `json:"created_at"`
-	UpdatedAt    time.Time             `json:"updated_at"`
+	ID                   string                `json:"id"`
+	ProviderID           string                `json:"provider_id"`
+	ResourceType         string                `json:"resource_type"`
+	Title                string                `json:"title"`
+	Description          string                `json:"description"`
+	CPUCores             int                   `json:"cpu_cores"`
+	RAMMB                int                   `json:"ram_mb"`
+	GPUUnits             int                   `json:"gpu_units"`
+	NetworkMbps          int                   `json:"network_mbps"`
+	Quantity             int                   `json:"quantity"`
+	AvailableQty         int                   `json:"available_qty"`
+	PriceHourly          float64               `json:"price_hourly_usd"`
+	Status               SharedInventoryStatus `json:"status"`
+	PricingMode          OfferPricingMode      `json:"pricing_mode"`
+	AuctionRule          AuctionRule           `json:"auction_rule,omitempty"`
+	ClearingPeriodMin    int                   `json:"clearing_period_minutes,omitempty"`
+	NextClearingAt       *time.Time            `json:"next_clearing_at,omitempty"`
+	LastClearingPriceUSD float64               `json:"last_clearing_price_usd,omitempty"`
+	ProviderPresence     ProviderPresenceState `json:"provider_presence,omitempty"`
+	ProviderVerification HostVerificationState `json:"provider_verification,omitempty"`
+	CreatedBy            string                `json:"created_by"`
+	CreatedAt            time.Time             `json:"created_at"`
+	UpdatedAt            time.Time             `json:"updated_at"`
+}
+
+type OfferBidStatus string
+
+const (
+	OfferBidOpen      OfferBidStatus = "open"
+	OfferBidWinning   OfferBidStatus = "winning"
+	OfferBidOutbid    OfferBidStatus = "outbid"
+	OfferBidExpired   OfferBidStatus = "expired"
+	OfferBidCancelled OfferBidStatus = "cancelled"
+)
+
+type OfferBid struct {
+	ID               string         `json:"id"`
+	OfferID          string         `json:"offer_id"`
+	UserID           string         `json:"user_id"`
+	ProviderID       string         `json:"provider_id"`
+	Quantity         int            `json:"quantity"`
+	MaxPriceHourly   float64        `json:"max_price_hourly_usd"`
+	DurationHours    int            `json:"duration_hours"`
+	Status           OfferBidStatus `json:"status"`
+	AllocatedQty     int            `json:"allocated_qty"`
+	ClearingPriceUSD float64        `json:"clearing_price_usd,omitempty"`
+	AllocationID     string         `json:"allocation_id,omitempty"`
+	BillingRentalID  string         `json:"billing_rental_id,omitempty"`
+	ExpiresAt        time.Time      `json:"expires_at"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+}
+
+type AuctionAward struct {
+	BidID       string  `json:"bid_id"`
+	UserID      string  `json:"user_id"`
+	Quantity    int     `json:"quantity"`
+	PriceHourly float64 `json:"price_hourly_usd"`
+}
+
+type AuctionClearing struct {
+	ID               string         `json:"id"`
+	OfferID          string         `json:"offer_id"`
+	Rule             AuctionRule    `json:"rule"`
+	PeriodStart      time.Time      `json:"period_start"`
+	PeriodEnd        time.Time      `json:"period_end"`
+	ClearingPriceUSD float64        `json:"clearing_price_usd"`
+	OfferedQty       int            `json:"offered_qty"`
+	AllocatedQty     int            `json:"allocated_qty"`
+	BidCount         int            `json:"bid_count"`
+	Awards           []AuctionAward `json:"awards"`
+	CreatedAt        time.Time      `json:"created_at"`
+}
+
+type OfferBookingStatus string
+
+const (
+	OfferBookingHeld       OfferBookingStatus = "held"
+	OfferBookingConfirming OfferBookingStatus = "confirming"
+	OfferBookingConfirmed  OfferBookingStatus = "confirmed"
+	OfferBookingReleased   OfferBookingStatus = "released"
+	OfferBookingCancelled  OfferBookingStatus = "cancelled"
+	OfferBookingRefunded   OfferBookingStatus = "refunded"
+)
+
+type OfferBooking struct {
+	ID              string             `json:"id"`
+	OfferID         string             `json:"offer_id"`
+	UserID          string             `json:"user_id"`
+	ProviderID      string             `json:"provider_id"`
+	Quantity        int                `json:"quantity"`
+	PriceHourly     float64            `json:"price_hourly_usd"`
+	Status          OfferBookingStatus `json:"status"`
+	HoldExpiresAt   time.Time          `json:"hold_expires_at"`
+	AllocationID    string             `json:"allocation_id,omitempty"`
+	BillingRentalID string             `json:"billing_rental_id,omitempty"`
+	ConfirmedAt     *time.Time         `json:"confirmed_at,omitempty"`
+	ClosedAt        *time.Time         `json:"closed_at,omitempty"`
+	CreatedAt       time.Time          `json:"created_at"`
+	UpdatedAt       time.Time          `json:"updated_at"`
 }
 
 type AgentLogLevel string
@@ -224,14 +403,23 @@ type AgentLog struct {
 type AgentCommandAction string
 
 const (
-	AgentCommandStatus         AgentCommandAction = "status"
-	AgentCommandStart          AgentCommandAction = "start"
-	AgentCommandStop           AgentCommandAction = "stop"
-	AgentCommandRestart        AgentCommandAction = "restart"
-	AgentCommandTerminalOpen   AgentCommandAction = "terminal_open"
-	AgentCommandTerminalData   AgentCommandAction = "terminal_data"
-	AgentCommandTerminalResize AgentCommandAction = "terminal_resize"
-	AgentCommandTerminalClose  AgentCommandAction = "terminal_close"
+	AgentCommandStatus            AgentCommandAction = "status"
+	AgentCommandStart             AgentCommandAction = "start"
+	AgentCommandStop              AgentCommandAction = "stop"
+	AgentCommandRestart           AgentCommandAction = "restart"
+	AgentCommandTerminalOpen      AgentCommandAction = "terminal_open"
+	AgentCommandTerminalData      AgentCommandAction = "terminal_data"
+	AgentCommandTerminalResize    AgentCommandAction = "terminal_resize"
+	AgentCommandTerminalClose     AgentCommandAction = "terminal_close"
+	AgentCommandPodStart          AgentCommandAction = "pod_start"
+	AgentCommandPodStop           AgentCommandAction = "pod_stop"
+	AgentCommandPodStatus         AgentCommandAction = "pod_status"
+	AgentCommandCapacityChallenge AgentCommandAction = "capacity_challenge"
+	AgentCommandExec              AgentCommandAction = "exec"
+	AgentCommandFileWrite         AgentCommandAction = "file_write"
+	AgentCommandFileRead          AgentCommandAction = "file_read"
+	AgentCommandAgentUpdate       AgentCommandAction = "agent_update"
+	AgentCommandCancel            AgentCommandAction = "command_cancel"
 )
 
 type AgentCommandState string
@@ -241,10 +429,13 @@ const (
 	AgentCommandRunning   AgentCommandState = "running"
 	AgentCommandSucceeded AgentCommandState = "succeeded"
 	AgentCommandFailed    AgentCommandState = "failed"
+	AgentCommandTimedOut  AgentCommandState = "timed_out"
+	AgentCommandCancelled AgentCommandState = "cancelled"
 )
 
 type AgentCommand struct {
 	ID             string             `json:"id"`
+	Seq            int64              `json:"seq"`
 	ProviderID     string             `json:"provider_id"`
 	ResourceID     string             `json:"resource_id"`
 	SessionID      string             `json:"session_id"`
@@ -255,6 +446,12 @@ type AgentCommand struct {
 	Status         AgentCommandState  `json:"status"`
 	RequestedBy    string             `json:"requested_by"`
 	ResultMessage  string             `json:"result_message"`
+	Attempts       int                `json:"attempts"`
+	MaxAttempts    int                `json:"max_attempts"`
+	TimeoutSeconds int                `json:"timeout_seconds"`
+	RolloutID      string             `json:"rollout_id,omitempty"`
+	DeadlineAt     time.Time          `json:"deadline_at"`
+	LeaseExpiresAt time.Time          `json:"lease_expires_at"`
 	CreatedAt      time.Time          `json:"created_at"`
 	UpdatedAt      time.Time          `json:"updated_at"`
 	AcknowledgedAt time.Time          `json:"acknowledged_at"`
@@ -270,20 +467,24 @@ const (
 )
 
 type TerminalSession struct {
-	ID            string               `json:"id"`
-	ProviderID    string               `json:"provider_id"`
-	ResourceID    string               `json:"resource_id"`
-	RenterUserID  string               `json:"renter_user_id"`
-	Status        TerminalSessionState `json:"status"`
-	Rows          int                  `json:"rows"`
-	Cols          int                  `json:"cols"`
-	LastInputSeq  int64                `json:"last_input_seq"`
-	LastOutputSeq int64                `json:"last_output_seq"`
-	LastActiveAt  time.Time            `json:"last_active_at"`
-	ClosedAt      time.Time            `json:"closed_at"`
-	ExitCode      int                  `json:"exit_code"`
-	CreatedAt     time.Time            `json:"created_at"`
-	UpdatedAt     time.Time            `json:"updated_at"`
+	ID                string               `json:"id"`
+	ProviderID        string               `json:"provider_id"`
+	ResourceID        string               `json:"resource_id"`
+	RenterUserID      string               `json:"renter_user_id"`
+	GrantID           string               `json:"grant_id,omitempty"`
+	Status            TerminalSessionState `json:"status"`
+	Rows              int                  `json:"rows"`
+	Cols              int                  `json:"cols"`
+	InitialRows       int                  `json:"initial_rows"`
+	InitialCols       int                  `json:"initial_cols"`
+	LastInputSeq      int64                `json:"last_input_seq"`
+	LastOutputSeq     int64                `json:"last_output_seq"`
+	LastActiveAt      time.Time            `json:"last_active_at"`
+	ClosedAt          time.Time            `json:"closed_at"`
+	ExitCode          int                  `json:"exit_code"`
+	RecordingPurgedAt time.Time            `json:"recording_purged_at"`
+	CreatedAt         time.Time            `json:"created_at"`
+	UpdatedAt         time.Time            `json:"updated_at"`
 }
 
 type TerminalChunkDirection string
@@ -303,11 +504,98 @@ type TerminalChunk struct {
 	CreatedAt  time.Time              `json:"created_at"`
 }
 
+// AsciicastHeader is the first line of an asciicast v2 recording.
+type AsciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Duration  float64           `json:"duration,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// AsciicastEvent is one event line of a recording: seconds since the start,
+// "o" for output, "i" for input or "r" for a resize to "COLSxROWS", and data.
+type AsciicastEvent struct {
+	Time float64
+	Code string
+	Data string
+}
+
+func (e AsciicastEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Time, e.Code, e.Data})
+}
+
+type TerminalRecording struct {
+	Session TerminalSession
+	Header  AsciicastHeader
+	Events  []AsciicastEvent
+}
+
+type TerminalFrameType string
+
+const (
+	TerminalFrameInput    TerminalFrameType = "input"
+	TerminalFrameResize   TerminalFrameType = "resize"
+	TerminalFrameOutput   TerminalFrameType = "output"
+	TerminalFrameInputAck TerminalFrameType = "input_ack"
+	TerminalFramePing     TerminalFrameType = "ping"
+	TerminalFramePong     TerminalFrameType = "pong"
+	TerminalFrameClosed   TerminalFrameType = "closed"
+	TerminalFrameError    TerminalFrameType = "error"
+	TerminalFramePresence TerminalFrameType = "presence"
+)
+
+// TerminalFrame is one JSON message on a terminal WebSocket. Output frames
+// carry the chunk seq and input_ack frames the seq given to the input; a
+// client reconnects with the highest output seq it has shown.
+type TerminalFrame struct {
+	Type   TerminalFrameType    `json:"type"`
+	Seq    int64                `json:"seq,omitempty"`
+	Data   string               `json:"data,omitempty"`
+	Rows   int                  `json:"rows,omitempty"`
+	Cols   int                  `json:"cols,omitempty"`
+	Status TerminalSessionState `json:"status,omitempty"`
+	Error  string               `json:"error,omitempty"`
+	// Participants is set on presence frames, sent whenever someone joins,
+	// leaves or changes role.
+	Participants []TerminalPresence `json:"participants,omitempty"`
+}
+
+type TerminalParticipantRole string
+
+const (
+	TerminalParticipantOwner  TerminalParticipantRole = "owner"
+	TerminalParticipantDriver TerminalParticipantRole = "driver"
+	TerminalParticipantViewer TerminalParticipantRole = "viewer"
+)
+
+// TerminalParticipant is a user the session's renter invited. Drivers may
+// send input and resizes; viewers watch.
+type TerminalParticipant struct {
+	SessionID string                  `json:"session_id"`
+	UserID    string                  `json:"user_id"`
+	Role      TerminalParticipantRole `json:"role"`
+	InvitedBy string                  `json:"invited_by"`
+	CreatedAt time.Time               `json:"created_at"`
+	UpdatedAt time.Time               `json:"updated_at"`
+}
+
+type TerminalPresence struct {
+	UserID      string                  `json:"user_id"`
+	Role        TerminalParticipantRole `json:"role"`
+	Invited     bool                    `json:"invited"`
+	Online      bool                    `json:"online"`
+	Connections int                     `json:"connections"`
+}
+
 type TerminalAuditEvent struct {
 	ID         string    `json:"id"`
 	SessionID  string    `json:"session_id"`
 	ProviderID string    `json:"provider_id"`
 	UserID     string    `json:"user_id"`
+	GrantID    string    `json:"grant_id,omitempty"`
 	EventType  string    `json:"event_type"`
 	Details    string    `json:"details"`
 	CreatedAt  time.Time `json:"created_at"`
@@ -325,6 +613,40 @@ type RootInputLog struct {
 	CreatedAt  time.Time `json:"created_at"`
 }
 
+type ResourceLogLevel string
+
+const (
+	ResourceLogDebug   ResourceLogLevel = "debug"
+	ResourceLogInfo    ResourceLogLevel = "info"
+	ResourceLogWarning ResourceLogLevel = "warning"
+	ResourceLogError   ResourceLogLevel = "error"
+)
+
+type ResourceLog struct {
+	ID           string           `json:"id"`
+	Seq          int64            `json:"seq"`
+	ProviderID   string           `json:"provider_id"`
+	ResourceID   string           `json:"resource_id"`
+	ResourceType string           `json:"resource_type"`
+	SourceType   string           `json:"source_type"`
+	Source       string           `json:"source"`
+	Stream       string           `json:"stream"`
+	Level        ResourceLogLevel `json:"level"`
+	Message      string           `json:"message"`
+	OccurredAt   time.Time        `json:"occurred_at"`
+	CreatedAt    time.Time        `json:"created_at"`
+}
+
+type ResourceLogQuery struct {
+	ResourceID string
+	Levels     []string
+	Text       string
+	Source     string
+	AfterSeq   int64
+	BeforeSeq  int64
+	Limit      int
+}
+
 type CatalogFilter struct {
 	Search                    string `json:"search"`
 	Region                    string `json:"region"`
@@ -337,12 +659,24 @@ type CatalogFilter struct {
 	MinVRAMGB                 int    `json:"min_vram_gb"`
 }
 
+type ShareGrantStatus string
+
+const (
+	ShareGrantPending ShareGrantStatus = "pending"
+	ShareGrantActive  ShareGrantStatus = "active"
+	ShareGrantRevoked ShareGrantStatus = "revoked"
+	ShareGrantExpired ShareGrantStatus = "expired"
+)
+
 type SharedVM struct {
 	ID          string            `json:"id"`
 	VMID        string            `json:"vm_id"`
 	OwnerUserID string            `json:"owner_user_id"`
 	SharedWith  []string          `json:"shared_with"`
 	AccessLevel SharedAccessLevel `json:"access_level"`
+	Status      ShareGrantStatus  `json:"status"`
+	InviteEmail string            `json:"invite_email,omitempty"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
 	CreatedAt   time.Time         `json:"created_at"`
 }
 
@@ -352,9 +686,46 @@ type SharedPod struct {
 	OwnerUserID string            `json:"owner_user_id"`
 	SharedWith  []string          `json:"shared_with"`
 	AccessLevel SharedAccessLevel `json:"access_level"`
+	Status      ShareGrantStatus  `json:"status"`
+	InviteEmail string            `json:"invite_email,omitempty"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
 	CreatedAt   time.Time         `json:"created_at"`
 }
 
+// ShareGrant is a single grantee's row in shared_vms or shared_pods.
+type ShareGrant struct {
+	ID            string            `json:"id"`
+	ResourceType  string            `json:"resource_type"`
+	ResourceID    string            `json:"resource_id"`
+	OwnerUserID   string            `json:"owner_user_id"`
+	GranteeUserID string            `json:"grantee_user_id"`
+	InviteEmail   string            `json:"invite_email,omitempty"`
+	AccessLevel   SharedAccessLevel `json:"access_level"`
+	Status        ShareGrantStatus  `json:"status"`
+	ExpiresAt     *time.Time        `json:"expires_at,omitempty"`
+	AcceptedAt    *time.Time        `json:"accepted_at,omitempty"`
+	RevokedAt     *time.Time        `json:"revoked_at,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+type ShareGrantUpdate struct {
+	AccessLevel SharedAccessLevel
+	ExpiresAt   *time.Time
+	ClearExpiry bool
+}
+
+type ShareAuditEvent struct {
+	ID           string    `json:"id"`
+	GrantID      string    `json:"grant_id"`
+	ResourceType string    `json:"resource_type"`
+	ResourceID   string    `json:"resource_id"`
+	ActorUserID  string    `json:"actor_user_id"`
+	Action       string    `json:"action"`
+	Details      string    `json:"details"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
 type HealthCheck struct {
 	ID           string       `json:"id"`
 	ResourceType string       `json:"resource_type"`
@@ -362,16 +733,118 @@ type HealthCheck struct {
 	CheckType    string       `json:"check_type"`
 	Status       HealthStatus `json:"status"`
 	Details      string       `json:"details"`
+	ProbeID      string       `json:"probe_id,omitempty"`
+	LatencyMS    float64      `json:"latency_ms,omitempty"`
 	CheckedAt    time.Time    `json:"checked_at"`
 }
 
+type HealthProbeKind string
+
+const (
+	HealthProbeTCP          HealthProbeKind = "tcp"
+	HealthProbeHTTP         HealthProbeKind = "http"
+	HealthProbeReachability HealthProbeKind = "reachability"
+	HealthProbeSSH          HealthProbeKind = "ssh"
+)
+
+// HealthProbe is an active check resourceservice runs against the address of
+// a running VM or pod. Address is resolved when the probe is claimed.
+type HealthProbe struct {
+	ID                  string          `json:"id"`
+	ResourceType        string          `json:"resource_type"`
+	ResourceID          string          `json:"resource_id"`
+	Kind                HealthProbeKind `json:"kind"`
+	Address             string          `json:"address,omitempty"`
+	Port                int             `json:"port"`
+	Path                string          `json:"path,omitempty"`
+	ExpectedStatus      int             `json:"expected_status,omitempty"`
+	IntervalSeconds     int             `json:"interval_seconds"`
+	TimeoutSeconds      int             `json:"timeout_seconds"`
+	FailureThreshold    int             `json:"failure_threshold"`
+	Enabled             bool            `json:"enabled"`
+	ConsecutiveFailures int             `json:"consecutive_failures"`
+	LastStatus          HealthStatus    `json:"last_status,omitempty"`
+	LastLatencyMS       float64         `json:"last_latency_ms,omitempty"`
+	LastCheckedAt       *time.Time      `json:"last_checked_at,omitempty"`
+	NextRunAt           time.Time       `json:"next_run_at"`
+	CreatedBy           string          `json:"created_by"`
+	CreatedAt           time.Time       `json:"created_at"`
+	UpdatedAt           time.Time       `json:"updated_at"`
+}
+
+type MetricResolution string
+
+const (
+	MetricResolutionRaw    MetricResolution = "raw"
+	MetricResolutionMinute MetricResolution = "1m"
+	MetricResolutionHour   MetricResolution = "1h"
+)
+
+// MetricPoint is either a raw sample or, when Rollup is set, one bucket of a
+// rollup tier: Value is the bucket average and CapturedAt the bucket start.
 type MetricPoint struct {
-	ID           string    `json:"id"`
-	ResourceType string    `json:"resource_type"`
-	ResourceID   string    `json:"resource_id"`
-	MetricType   string    `json:"metric_type"`
-	Value        float64   `json:"value"`
-	CapturedAt   time.Time `json:"captured_at"`
+	ID           string             `json:"id"`
+	ResourceType string             `json:"resource_type"`
+	ResourceID   string             `json:"resource_id"`
+	MetricType   string             `json:"metric_type"`
+	Value        float64            `json:"value"`
+	CapturedAt   time.Time          `json:"captured_at"`
+	ProviderID   string             `json:"provider_id,omitempty"`
+	Resolution   MetricResolution   `json:"resolution,omitempty"`
+	Rollup       *MetricRollupStats `json:"rollup,omitempty"`
+}
+
+type MetricFilter struct {
+	ResourceType string
+	ResourceID   string
+	MetricType   string
+	ProviderID   string
+}
+
+type MetricRollupStats struct {
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Last    float64   `json:"last"`
+	LastAt  time.Time `json:"last_at"`
+	Samples int64     `json:"samples"`
+}
+
+type MetricQuerySeries struct {
+	Name         string `json:"name,omitempty"`
+	MetricType   string `json:"metric_type"`
+	ResourceType string `json:"resource_type,omitempty"`
+	ResourceID   string `json:"resource_id,omitempty"`
+	ProviderID   string `json:"provider_id,omitempty"`
+	GroupBy      string `json:"group_by,omitempty"`
+	Function     string `json:"function"`
+}
+
+type MetricQuery struct {
+	From        time.Time           `json:"from"`
+	To          time.Time           `json:"to"`
+	StepSeconds int                 `json:"step_seconds,omitempty"`
+	Resolution  MetricResolution    `json:"resolution,omitempty"`
+	Series      []MetricQuerySeries `json:"series"`
+}
+
+type MetricQueryValue struct {
+	Timestamp time.Time `json:"t"`
+	Value     float64   `json:"v"`
+}
+
+type MetricQuerySeriesResult struct {
+	Name     string             `json:"name"`
+	Function string             `json:"function"`
+	Labels   map[string]string  `json:"labels"`
+	Points   []MetricQueryValue `json:"points"`
+}
+
+type MetricQueryResult struct {
+	From        time.Time                 `json:"from"`
+	To          time.Time                 `json:"to"`
+	StepSeconds int                       `json:"step_seconds"`
+	Resolution  MetricResolution          `json:"resolution"`
+	Series      []MetricQuerySeriesResult `json:"series"`
 }
 
 type MetricSummary struct {
@@ -385,6 +858,106 @@ type MetricSummary struct {
 	LastValue    float64 `json:"last_value"`
 }
 
+type AlertRuleKind string
+
+const (
+	AlertRuleMetric      AlertRuleKind = "metric"
+	AlertRuleHealthCheck AlertRuleKind = "health_check"
+	AlertRuleHeartbeat   AlertRuleKind = "heartbeat"
+)
+
+type AlertRuleScope string
+
+const (
+	AlertRuleScopeUser  AlertRuleScope = "user"
+	AlertRuleScopeAdmin AlertRuleScope = "admin"
+)
+
+type AlertState string
+
+const (
+	AlertStatePending  AlertState = "pending"
+	AlertStateFiring   AlertState = "firing"
+	AlertStateResolved AlertState = "resolved"
+)
+
+type AlertChannelType string
+
+const (
+	AlertChannelWebhook AlertChannelType = "webhook"
+	AlertChannelEmail   AlertChannelType = "email"
+)
+
+type AlertChannel struct {
+	Type   AlertChannelType `json:"type"`
+	Target string           `json:"target"`
+}
+
+type AlertRule struct {
+	ID           string         `json:"id"`
+	OwnerUserID  string         `json:"owner_user_id"`
+	Scope        AlertRuleScope `json:"scope"`
+	Name         string         `json:"name"`
+	Kind         AlertRuleKind  `json:"kind"`
+	ResourceType string         `json:"resource_type,omitempty"`
+	ResourceID   string         `json:"resource_id,omitempty"`
+	MetricType   string         `json:"metric_type,omitempty"`
+	Comparator   string         `json:"comparator,omitempty"`
+	Threshold    float64        `json:"threshold"`
+	CheckType    string         `json:"check_type,omitempty"`
+	HealthStatus HealthStatus   `json:"health_status,omitempty"`
+	ForSeconds   int            `json:"for_seconds"`
+	Severity     string         `json:"severity"`
+	Channels     []AlertChannel `json:"channels"`
+	Enabled      bool           `json:"enabled"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+type Alert struct {
+	ID            string     `json:"id"`
+	RuleID        string     `json:"rule_id"`
+	RuleName      string     `json:"rule_name,omitempty"`
+	Severity      string     `json:"severity,omitempty"`
+	ResourceType  string     `json:"resource_type"`
+	ResourceID    string     `json:"resource_id"`
+	State         AlertState `json:"state"`
+	Value         float64    `json:"value"`
+	Summary       string     `json:"summary"`
+	StartedAt     time.Time  `json:"started_at"`
+	FiredAt       *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+	NotifiedState AlertState `json:"notified_state,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type AlertSilence struct {
+	ID           string    `json:"id"`
+	OwnerUserID  string    `json:"owner_user_id"`
+	RuleID       string    `json:"rule_id,omitempty"`
+	ResourceType string    `json:"resource_type,omitempty"`
+	ResourceID   string    `json:"resource_id,omitempty"`
+	Comment      string    `json:"comment"`
+	StartsAt     time.Time `json:"starts_at"`
+	EndsAt       time.Time `json:"ends_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type AlertNotification struct {
+	AlertID      string     `json:"alert_id"`
+	RuleID       string     `json:"rule_id"`
+	RuleName     string     `json:"rule_name"`
+	Severity     string     `json:"severity"`
+	State        AlertState `json:"state"`
+	ResourceType string     `json:"resource_type"`
+	ResourceID   string     `json:"resource_id"`
+	Value        float64    `json:"value"`
+	Summary      string     `json:"summary"`
+	StartedAt    time.Time  `json:"started_at"`
+	FiredAt      *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`
+}
+
 type KubernetesCluster struct {
 	ID         string        `json:"id"`
 	UserID     string        `json:"user_id"`
@@ -399,3 +972,509 @@ type KubernetesCluster struct {
 	CreatedAt  time.Time     `json:"created_at"`
 	UpdatedAt  time.Time     `json:"updated_at"`
 }
+
+type ProviderPresenceState string
+
+const (
+	ProviderOnline   ProviderPresenceState = "online"
+	ProviderDegraded ProviderPresenceState = "degraded"
+	ProviderOffline  ProviderPresenceState = "offline"
+)
+
+// ProviderPresence is derived from heartbeat age and agent command polls.
+// Synced is false until the latest change has been pushed to adminservice.
+type ProviderPresence struct {
+	ProviderID  string                `json:"provider_id"`
+	State       ProviderPresenceState `json:"state"`
+	Reason      string                `json:"reason"`
+	HeartbeatAt *time.Time            `json:"heartbeat_at,omitempty"`
+	LastPollAt  *time.Time            `json:"last_poll_at,omitempty"`
+	ChangedAt   time.Time             `json:"changed_at"`
+	FlapCount   int                   `json:"flap_count"`
+	RecentFlaps int                   `json:"recent_flaps"`
+	Synced      bool                  `json:"synced"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+}
+
+type ProviderPresenceEvent struct {
+	ID         string                `json:"id"`
+	ProviderID string                `json:"provider_id"`
+	FromState  ProviderPresenceState `json:"from_state"`
+	ToState    ProviderPresenceState `json:"to_state"`
+	Reason     string                `json:"reason"`
+	CreatedAt  time.Time             `json:"created_at"`
+}
+
+const (
+	AvailabilityTierLow    = "low"
+	AvailabilityTierMedium = "medium"
+	AvailabilityTierHigh   = "high"
+)
+
+// SLATarget is the monthly uptime promised for an availability tier and the
+// share of the month's charge credited back when it is missed.
+type SLATarget struct {
+	Tier      string  `json:"tier"`
+	TargetPct float64 `json:"target_pct"`
+	CreditPct float64 `json:"credit_pct"`
+}
+
+type SLACreditStatus string
+
+const (
+	SLACreditNone    SLACreditStatus = "none"
+	SLACreditPending SLACreditStatus = "pending"
+	SLACreditIssued  SLACreditStatus = "issued"
+)
+
+// SLAReport is the uptime of a VM, pod or provider over one calendar month.
+// Only monitored time counts: health checks for VMs and pods, presence history
+// for providers.
+type SLAReport struct {
+	ResourceType     string          `json:"resource_type"`
+	ResourceID       string          `json:"resource_id"`
+	UserID           string          `json:"user_id,omitempty"`
+	ProviderID       string          `json:"provider_id,omitempty"`
+	Tier             string          `json:"tier"`
+	Period           string          `json:"period"`
+	PeriodStart      time.Time       `json:"period_start"`
+	PeriodEnd        time.Time       `json:"period_end"`
+	TargetPct        float64         `json:"target_pct"`
+	UptimePct        float64         `json:"uptime_pct"`
+	MonitoredSeconds int64           `json:"monitored_seconds"`
+	DowntimeSeconds  int64           `json:"downtime_seconds"`
+	Met              bool            `json:"met"`
+	Final            bool            `json:"final"`
+	CreditPct        float64         `json:"credit_pct"`
+	CreditStatus     SLACreditStatus `json:"credit_status"`
+	CreditUSD        float64         `json:"credit_usd"`
+	CreatedAt        time.Time       `json:"created_at,omitempty"`
+	UpdatedAt        time.Time       `json:"updated_at,omitempty"`
+}
+
+// SLASubject is a VM or pod that existed during an SLA period.
+type SLASubject struct {
+	ResourceType string     `json:"resource_type"`
+	ResourceID   string     `json:"resource_id"`
+	UserID       string     `json:"user_id"`
+	ProviderID   string     `json:"provider_id"`
+	Tier         string     `json:"tier"`
+	CreatedAt    time.Time  `json:"created_at"`
+	EndedAt      *time.Time `json:"ended_at,omitempty"`
+}
+
+type SLAReportFilter struct {
+	Period       string
+	ResourceType string
+	UserID       string
+	ProviderID   string
+	MissedOnly   bool
+	CreditStatus SLACreditStatus
+	Limit        int
+}
+
+type StreamEventType string
+
+const (
+	StreamEventState       StreamEventType = "state"
+	StreamEventHealthCheck StreamEventType = "health_check"
+	StreamEventMetric      StreamEventType = "metric"
+	StreamEventAgentLog    StreamEventType = "agent_log"
+	StreamEventExecOutput  StreamEventType = "exec_output"
+)
+
+// StreamEvent is pushed to stream subscribers; Data holds the VM or pod
+// state, health check, metric point or agent log it announces.
+type StreamEvent struct {
+	Type         StreamEventType `json:"type"`
+	ResourceType string          `json:"resource_type,omitempty"`
+	ResourceID   string          `json:"resource_id,omitempty"`
+	ProviderID   string          `json:"provider_id,omitempty"`
+	Data         any             `json:"data"`
+	At           time.Time       `json:"at"`
+}
+
+// StreamRelayEvent is a stream event as written for the other instances.
+type StreamRelayEvent struct {
+	ID      int64
+	Origin  string
+	Payload []byte
+}
+
+// StreamState is the data of a state event.
+type StreamState struct {
+	Status string         `json:"status,omitempty"`
+	Health ResourceHealth `json:"health,omitempty"`
+}
+
+type StreamSubscription struct {
+	ResourceIDs []string
+	ProviderIDs []string
+	Types       []StreamEventType
+}
+
+type AgentChannelFrameType string
+
+const (
+	AgentFrameHello          AgentChannelFrameType = "hello"
+	AgentFrameCommand        AgentChannelFrameType = "command"
+	AgentFramePing           AgentChannelFrameType = "ping"
+	AgentFramePong           AgentChannelFrameType = "pong"
+	AgentFrameAck            AgentChannelFrameType = "ack"
+	AgentFrameResult         AgentChannelFrameType = "result"
+	AgentFrameTerminalOutput AgentChannelFrameType = "terminal_output"
+	AgentFrameTerminalInput  AgentChannelFrameType = "terminal_input"
+	AgentFrameTerminalResize AgentChannelFrameType = "terminal_resize"
+	AgentFrameExecOutput     AgentChannelFrameType = "exec_output"
+	AgentFrameFileChunk      AgentChannelFrameType = "file_chunk"
+	AgentFrameError          AgentChannelFrameType = "error"
+)
+
+// AgentChannelFrame is one JSON message on the agent channel. Commands carry
+// their seq; agents resume with the highest seq they have received.
+type AgentChannelFrame struct {
+	Type          AgentChannelFrameType `json:"type"`
+	Seq           int64                 `json:"seq,omitempty"`
+	Command       *AgentCommand         `json:"command,omitempty"`
+	CommandID     string                `json:"command_id,omitempty"`
+	Status        AgentCommandState     `json:"status,omitempty"`
+	ResultMessage string                `json:"result_message,omitempty"`
+	SessionID     string                `json:"session_id,omitempty"`
+	ExecID        string                `json:"exec_id,omitempty"`
+	Stream        string                `json:"stream,omitempty"`
+	TransferID    string                `json:"transfer_id,omitempty"`
+	Offset        int64                 `json:"offset,omitempty"`
+	Rows          int                   `json:"rows,omitempty"`
+	Cols          int                   `json:"cols,omitempty"`
+	Data          string                `json:"data,omitempty"`
+	Error         string                `json:"error,omitempty"`
+}
+
+// AgentEnrollment is a one-time token a provider hands to a new host. Only
+// its hash is stored; Token is set once, in the response that creates it.
+type AgentEnrollment struct {
+	ID         string    `json:"id"`
+	ProviderID string    `json:"provider_id"`
+	Label      string    `json:"label"`
+	CreatedBy  string    `json:"created_by"`
+	HostID     string    `json:"host_id"`
+	Token      string    `json:"token,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UsedAt     time.Time `json:"used_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type AgentHostStatus string
+
+const (
+	AgentHostActive  AgentHostStatus = "active"
+	AgentHostRevoked AgentHostStatus = "revoked"
+)
+
+// AgentHost is an enrolled host and the credential it currently holds. The
+// previous credential stays valid for a short grace period after a rotation,
+// or until the new one is first used, so requests in flight during a rotation
+// are not rejected.
+type AgentHost struct {
+	ID                   string          `json:"id"`
+	ProviderID           string          `json:"provider_id"`
+	Hostname             string          `json:"hostname"`
+	Label                string          `json:"label"`
+	EnrollmentID         string          `json:"enrollment_id"`
+	Status               AgentHostStatus `json:"status"`
+	PublicKey            string          `json:"public_key,omitempty"`
+	CredentialID         string          `json:"-"`
+	PreviousCredentialID string          `json:"-"`
+	CredentialExpiresAt  time.Time       `json:"credential_expires_at"`
+	RotatedAt            time.Time       `json:"rotated_at"`
+	RevokedAt            time.Time       `json:"revoked_at"`
+	RevokedBy            string          `json:"revoked_by"`
+	CreatedAt            time.Time       `json:"created_at"`
+	UpdatedAt            time.Time       `json:"updated_at"`
+}
+
+// AgentVersionEntry is the hostagent version in a provider's latest
+// heartbeat. AgentVersion is empty for agents that predate version reporting.
+type AgentVersionEntry struct {
+	ProviderID   string    `json:"provider_id"`
+	AgentVersion string    `json:"agent_version"`
+	HeartbeatAt  time.Time `json:"heartbeat_at"`
+	Online       bool      `json:"online"`
+}
+
+type AgentVersionCount struct {
+	AgentVersion string `json:"agent_version"`
+	Providers    int    `json:"providers"`
+	Online       int    `json:"online"`
+}
+
+type AgentVersionInventory struct {
+	Versions  []AgentVersionCount `json:"versions"`
+	Providers []AgentVersionEntry `json:"providers"`
+}
+
+type RolloutStatus string
+
+const (
+	RolloutRunning   RolloutStatus = "running"
+	RolloutPaused    RolloutStatus = "paused"
+	RolloutHalted    RolloutStatus = "halted"
+	RolloutCompleted RolloutStatus = "completed"
+	RolloutCancelled RolloutStatus = "cancelled"
+)
+
+// RolloutSelector picks the providers a rollout targets. Each non-empty field
+// narrows the set; a provider must match every one of them. All must be set
+// to target the whole fleet.
+type RolloutSelector struct {
+	All           bool     `json:"all,omitempty"`
+	ProviderIDs   []string `json:"provider_ids,omitempty"`
+	Labels        []string `json:"labels,omitempty"`
+	Regions       []string `json:"regions,omitempty"`
+	ProviderTypes []string `json:"provider_types,omitempty"`
+}
+
+// Rollout runs one agent command across a set of providers in waves. Waves
+// holds cumulative percentages of the targets, so [1, 10, 100] runs a single
+// canary, then a tenth of the fleet, then the rest.
+type Rollout struct {
+	ID                string             `json:"id"`
+	Command           AgentCommandAction `json:"command"`
+	Payload           string             `json:"payload"`
+	Selector          RolloutSelector    `json:"selector"`
+	Waves             []int              `json:"waves"`
+	CurrentWave       int                `json:"current_wave"`
+	MaxConcurrency    int                `json:"max_concurrency"`
+	MaxFailurePct     int                `json:"max_failure_pct"`
+	PauseBetweenWaves bool               `json:"pause_between_waves"`
+	TimeoutSeconds    int                `json:"timeout_seconds"`
+	MaxAttempts       int                `json:"max_attempts"`
+	Status            RolloutStatus      `json:"status"`
+	Detail            string             `json:"detail"`
+	CreatedBy         string             `json:"created_by"`
+	FailureWindowAt   time.Time          `json:"failure_window_at"`
+	CreatedAt         time.Time          `json:"created_at"`
+	UpdatedAt         time.Time          `json:"updated_at"`
+	FinishedAt        time.Time          `json:"finished_at"`
+	Progress          RolloutProgress    `json:"progress"`
+}
+
+type RolloutProgress struct {
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Running   int `json:"running"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Cancelled int `json:"cancelled"`
+}
+
+type RolloutTargetStatus string
+
+const (
+	RolloutTargetPending   RolloutTargetStatus = "pending"
+	RolloutTargetRunning   RolloutTargetStatus = "running"
+	RolloutTargetSucceeded RolloutTargetStatus = "succeeded"
+	RolloutTargetFailed    RolloutTargetStatus = "failed"
+	RolloutTargetCancelled RolloutTargetStatus = "cancelled"
+)
+
+// RolloutTarget is one provider's progress through a rollout.
+type RolloutTarget struct {
+	RolloutID  string              `json:"rollout_id"`
+	ProviderID string              `json:"provider_id"`
+	Position   int                 `json:"position"`
+	Wave       int                 `json:"wave"`
+	Status     RolloutTargetStatus `json:"status"`
+	CommandID  string              `json:"command_id"`
+	Detail     string              `json:"detail"`
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt time.Time           `json:"finished_at"`
+}
+
+type RolloutDetail struct {
+	Rollout Rollout         `json:"rollout"`
+	Targets []RolloutTarget `json:"targets"`
+}
+
+// AgentCredential is issued to a host on enrollment and on each rotation.
+type AgentCredential struct {
+	HostID      string    `json:"host_id"`
+	ProviderID  string    `json:"provider_id"`
+	Token       string    `json:"token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	RotateAfter time.Time `json:"rotate_after"`
+}
+
+type CapacityChallengeKind string
+
+const (
+	CapacityChallengeCPUMemory CapacityChallengeKind = "cpu_memory"
+	CapacityChallengeGPUEnum   CapacityChallengeKind = "gpu_enum"
+)
+
+type CapacityChallengeState string
+
+const (
+	CapacityChallengePending CapacityChallengeState = "pending"
+	CapacityChallengePassed  CapacityChallengeState = "passed"
+	CapacityChallengeFailed  CapacityChallengeState = "failed"
+)
+
+// CapacityChallenge is one randomized check of what a host claims in its
+// heartbeats, delivered to the agent as a capacity_challenge command.
+type CapacityChallenge struct {
+	ID          string                 `json:"id"`
+	ProviderID  string                 `json:"provider_id"`
+	CommandID   string                 `json:"command_id"`
+	Kind        CapacityChallengeKind  `json:"kind"`
+	Nonce       string                 `json:"-"`
+	MemoryMB    int                    `json:"memory_mb,omitempty"`
+	Passes      int                    `json:"passes,omitempty"`
+	Status      CapacityChallengeState `json:"status"`
+	Detail      string                 `json:"detail"`
+	IssuedBy    string                 `json:"issued_by"`
+	IssuedAt    time.Time              `json:"issued_at"`
+	CompletedAt time.Time              `json:"completed_at"`
+}
+
+type HostVerificationState string
+
+const (
+	HostUnverified HostVerificationState = "unverified"
+	HostVerified   HostVerificationState = "verified"
+	HostFlagged    HostVerificationState = "flagged"
+)
+
+// HostVerification is the standing of a provider's claims. A failed challenge
+// flags the provider until it passes several in a row.
+type HostVerification struct {
+	ProviderID        string                `json:"provider_id"`
+	Status            HostVerificationState `json:"status"`
+	Reason            string                `json:"reason"`
+	ConsecutivePasses int                   `json:"consecutive_passes"`
+	FailedChallenges  int                   `json:"failed_challenges"`
+	LastChallengeAt   time.Time             `json:"last_challenge_at"`
+	FlaggedAt         time.Time             `json:"flagged_at"`
+	UpdatedAt         time.Time             `json:"updated_at"`
+}
+
+// GPUDevice is a GPU seen in a gpu_enum challenge. A device UUID belongs to
+// one provider; the same UUID reported by another provider fails the check.
+type GPUDevice struct {
+	UUID       string    `json:"uuid"`
+	ProviderID string    `json:"provider_id"`
+	Name       string    `json:"name"`
+	MemoryMB   int       `json:"memory_mb"`
+	SeenAt     time.Time `json:"seen_at"`
+}
+
+type ExecRunState string
+
+const (
+	ExecRunQueued    ExecRunState = "queued"
+	ExecRunRunning   ExecRunState = "running"
+	ExecRunSucceeded ExecRunState = "succeeded"
+	ExecRunFailed    ExecRunState = "failed"
+	ExecRunTimedOut  ExecRunState = "timed_out"
+	ExecRunCancelled ExecRunState = "cancelled"
+	ExecRunRejected  ExecRunState = "rejected"
+)
+
+// ExecRun records one exec request against a provider's host, including
+// requests the provider's policy rejected. Environment values are passed to
+// the agent but only their names are kept here.
+type ExecRun struct {
+	ID              string       `json:"id"`
+	ProviderID      string       `json:"provider_id"`
+	CommandID       string       `json:"command_id"`
+	RequestedBy     string       `json:"requested_by"`
+	Reason          string       `json:"reason"`
+	Script          string       `json:"script,omitempty"`
+	Argv            []string     `json:"argv,omitempty"`
+	WorkDir         string       `json:"work_dir"`
+	EnvKeys         []string     `json:"env_keys"`
+	RunAs           string       `json:"run_as"`
+	TimeoutSeconds  int          `json:"timeout_seconds"`
+	Status          ExecRunState `json:"status"`
+	Detail          string       `json:"detail"`
+	ExitCode        int          `json:"exit_code"`
+	Stdout          string       `json:"stdout"`
+	Stderr          string       `json:"stderr"`
+	OutputTruncated bool         `json:"output_truncated"`
+	CreatedAt       time.Time    `json:"created_at"`
+	StartedAt       time.Time    `json:"started_at"`
+	FinishedAt      time.Time    `json:"finished_at"`
+}
+
+// ExecPolicy is what may be run on a provider's hosts. Argv commands must
+// name an entry of AllowedCommands exactly; scripts need AllowScripts.
+type ExecPolicy struct {
+	ProviderID        string    `json:"provider_id"`
+	Enabled           bool      `json:"enabled"`
+	AllowedCommands   []string  `json:"allowed_commands"`
+	AllowScripts      bool      `json:"allow_scripts"`
+	MaxTimeoutSeconds int       `json:"max_timeout_seconds"`
+	RunAs             string    `json:"run_as"`
+	UpdatedBy         string    `json:"updated_by"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// ExecOutputChunk is the data of an exec_output stream event.
+type ExecOutputChunk struct {
+	ExecID string `json:"exec_id"`
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+type FileTransferDirection string
+
+const (
+	FileTransferUpload   FileTransferDirection = "upload"
+	FileTransferDownload FileTransferDirection = "download"
+)
+
+// An upload is receiving while the client sends it to the service and
+// pushing while the service writes it to the host; a download is pulling
+// while the host streams it back. Failed transfers can be resumed.
+type FileTransferState string
+
+const (
+	FileTransferReceiving FileTransferState = "receiving"
+	FileTransferPushing   FileTransferState = "pushing"
+	FileTransferPulling   FileTransferState = "pulling"
+	FileTransferCompleted FileTransferState = "completed"
+	FileTransferFailed    FileTransferState = "failed"
+	FileTransferCancelled FileTransferState = "cancelled"
+	FileTransferExpired   FileTransferState = "expired"
+)
+
+// FileTransfer moves one file between a client and the sandbox directory of
+// a provider's host. ResourceID scopes it to a local pod's sandbox; transfers
+// without one use the host sandbox and are started by admins. StoredBytes is
+// how much of the file the service holds, HostBytes how much of an upload the
+// agent has written.
+type FileTransfer struct {
+	ID          string                `json:"id"`
+	ProviderID  string                `json:"provider_id"`
+	ResourceID  string                `json:"resource_id,omitempty"`
+	RequestedBy string                `json:"requested_by"`
+	GrantID     string                `json:"grant_id,omitempty"`
+	Direction   FileTransferDirection `json:"direction"`
+	Path        string                `json:"path"`
+	Size        int64                 `json:"size"`
+	SHA256      string                `json:"sha256"`
+	StoredBytes int64                 `json:"stored_bytes"`
+	HostBytes   int64                 `json:"host_bytes"`
+	Status      FileTransferState     `json:"status"`
+	Detail      string                `json:"detail"`
+	CommandID   string                `json:"command_id"`
+	CreatedAt   time.Time             `json:"created_at"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+	CompletedAt time.Time             `json:"completed_at"`
+	ExpiresAt   time.Time             `json:"expires_at"`
+}
+
+type FileTransferChunk struct {
+	Offset int64
+	Data   []byte
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// AgentChannelConn is an open agent channel as the service sees it. Receive
+// blocks until the agent sends a frame or the connection fails.
+type AgentChannelConn interface {
+	Send(frame models.AgentChannelFrame) error
+	Receive() (models.AgentChannelFrame, error)
+}
+
+const (
+	// agentChannelRecheck bounds the delay for commands queued on another
+	// instance, whose wake-up never reaches this one.
+	agentChannelRecheck = 2 * time.Second
+	AgentChannelPing    = 15 * time.Second
+	agentChannelBatch   = 50
+	agentChannelFrames  = 256
+)
+
+// agentChannels wakes the channel of a provider when a command is queued for
+// it. A newer connection for the same provider replaces the older one.
+type agentChannels struct {
+	mu    sync.Mutex
+	links map[string]*agentLink
+}
+
+// agentLink is the open channel of one provider. Terminal input and resizes
+// skip the command queue and go out on frames as they arrive.
+type agentLink struct {
+	wake   chan struct{}
+	frames chan models.AgentChannelFrame
+}
+
+func newAgentChannels() *agentChannels {
+	return &agentChannels{links: make(map[string]*agentLink)}
+}
+
+func (c *agentChannels) register(providerID string) (*agentLink, func()) {
+	link := &agentLink{wake: make(chan struct{}, 1), frames: make(chan models.AgentChannelFrame, agentChannelFrames)}
+	c.mu.Lock()
+	if previous, ok := c.links[providerID]; ok {
+		close(previous.wake)
+	}
+	c.links[providerID] = link
+	c.mu.Unlock()
+	return link, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.links[providerID] == link {
+			delete(c.links, providerID)
+			close(link.wake)
+		}
+	}
+}
+
+func (c *agentChannels) notify(providerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if link, ok := c.links[providerID]; ok {
+		select {
+		case link.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// push hands a frame to the provider's channel if it is open on this
+// instance and keeping up. Callers fall back to the command queue otherwise.
+func (c *agentChannels) push(providerID string, frame models.AgentChannelFrame) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	link, ok := c.links[providerID]
+	if !ok {
+		return false
+	}
+	select {
+	case link.frames <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *ResourceService) createAgentCommand(ctx context.Context, item models.AgentCommand) (models.AgentCommand, error) {
+	applyAgentCommandLimits(&item, time.Now().UTC())
+	created, err := s.repo.CreateAgentCommand(ctx, item)
+	if err != nil {
+		return models.AgentCommand{}, err
+	}
+	s.agentChannels.notify(created.ProviderID)
+	return created, nil
+}
+
+// ServeAgentChannel pushes a provider's commands to its agent as they are
+// queued and applies the results and terminal output streamed back. On
+// reconnect the agent passes the highest seq it received, and commands after
+// it that were never acknowledged are sent again. authorize, if set, is
+// checked again on every ping so a revoked host is disconnected. It returns
+// when the connection fails, authorization lapses or ctx ends.
+func (s *ResourceService) ServeAgentChannel(ctx context.Context, providerID string, resumeSeq int64, conn AgentChannelConn, authorize func(context.Context) error) error {
+	if providerID == "" {
+		return errors.New("provider_id is required")
+	}
+	if resumeSeq < 0 {
+		resumeSeq = 0
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	link, release := s.agentChannels.register(providerID)
+	defer release()
+	// Output seqs handed out here were based on this channel; another
+	// instance may take over the provider once it is gone.
+	defer s.terminals.forgetProvider(providerID)
+
+	frames := make(chan models.AgentChannelFrame)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			frame, err := conn.Receive()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := conn.Send(models.AgentChannelFrame{Type: models.AgentFrameHello, Seq: resumeSeq}); err != nil {
+		return err
+	}
+	log.Info().Str("provider_id", providerID).Int64("resume_seq", resumeSeq).Msg("agent channel opened")
+	s.touchAgentPoll(ctx, providerID)
+	lastSeq := resumeSeq
+	deliver := func() error {
+		cmds, err := s.repo.ClaimAgentCommands(ctx, providerID, lastSeq, agentCommandLease, agentChannelBatch)
+		if err != nil {
+			return err
+		}
+		for i := range cmds {
+			if err := conn.Send(models.AgentChannelFrame{Type: models.AgentFrameCommand, Seq: cmds[i].Seq, Command: &cmds[i]}); err != nil {
+				return err
+			}
+			if cmds[i].Seq > lastSeq {
+				lastSeq = cmds[i].Seq
+			}
+		}
+		return nil
+	}
+	if err := deliver(); err != nil {
+		return err
+	}
+	recheck := time.NewTicker(agentChannelRecheck)
+	defer recheck.Stop()
+	ping := time.NewTicker(AgentChannelPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			return err
+		case _, ok := <-link.wake:
+			if !ok {
+				return errors.New("agent channel replaced by a newer connection")
+			}
+			if err := deliver(); err != nil {
+				return err
+			}
+		case frame := <-link.frames:
+			if err := conn.Send(frame); err != nil {
+				return err
+			}
+		case <-recheck.C:
+			if err := deliver(); err != nil {
+				return err
+			}
+		case <-ping.C:
+			if authorize != nil {
+				if err := authorize(ctx); err != nil {
+					_ = conn.Send(models.AgentChannelFrame{Type: models.AgentFrameError, Error: err.Error()})
+					return err
+				}
+			}
+			s.touchAgentPoll(ctx, providerID)
+			if err := conn.Send(models.AgentChannelFrame{Type: models.AgentFramePing}); err != nil {
+				return err
+			}
+		case frame := <-frames:
+			if reply, ok := s.handleAgentFrame(ctx, providerID, frame); ok {
+				if err := conn.Send(reply); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// handleAgentFrame applies one frame from the agent and returns the error
+// frame to send back, if any.
+func (s *ResourceService) handleAgentFrame(ctx context.Context, providerID string, frame models.AgentChannelFrame) (models.AgentChannelFrame, bool) {
+	var err error
+	switch frame.Type {
+	case models.AgentFramePong:
+		return models.AgentChannelFrame{}, false
+	case models.AgentFrameAck:
+		_, err = s.AcknowledgeAgentCommand(ctx, frame.CommandID, providerID)
+	case models.AgentFrameResult:
+		_, err = s.CompleteAgentCommand(ctx, frame.CommandID, providerID, frame.Status, frame.ResultMessage)
+	case models.AgentFrameTerminalOutput:
+		_, err = s.RecordTerminalOutput(ctx, providerID, frame.SessionID, frame.Data)
+	case models.AgentFrameExecOutput:
+		err = s.RecordExecOutput(ctx, providerID, frame.ExecID, frame.Stream, frame.Data)
+	case models.AgentFrameFileChunk:
+		var data []byte
+		if data, err = base64.StdEncoding.DecodeString(frame.Data); err == nil {
+			err = s.RecordFileChunk(ctx, providerID, frame.TransferID, frame.Offset, data)
+		}
+	default:
+		err = errors.New("unsupported frame type")
+	}
+	if err == nil {
+		return models.AgentChannelFrame{}, false
+	}
+	log.Warn().Err(err).Str("provider_id", providerID).Str("frame_type", string(frame.Type)).Msg("agent channel frame rejected")
+	return models.AgentChannelFrame{Type: models.AgentFrameError, CommandID: frame.CommandID, SessionID: frame.SessionID, Error: err.Error()}, true
+}
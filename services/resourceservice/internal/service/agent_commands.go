@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// agentCommandLease is how long a pushed command may go unacknowledged
+	// before the sweeper queues it again.
+	agentCommandLease           = 30 * time.Second
+	defaultAgentCommandAttempts = 3
+	maxAgentCommandAttempts     = 10
+	minAgentCommandTimeout      = 5 * time.Second
+	maxAgentCommandTimeout      = time.Hour
+)
+
+func defaultAgentCommandTimeout(action models.AgentCommandAction) time.Duration {
+	switch action {
+	case models.AgentCommandPodStart:
+		// Image pulls can take minutes.
+		return 15 * time.Minute
+	case models.AgentCommandTerminalOpen, models.AgentCommandTerminalData, models.AgentCommandTerminalResize, models.AgentCommandTerminalClose:
+		return 2 * time.Minute
+	default:
+		return 5 * time.Minute
+	}
+}
+
+// applyAgentCommandLimits fills in the attempt budget and deadline of a new
+// command. The deadline covers time spent queued as well as running.
+func applyAgentCommandLimits(item *models.AgentCommand, now time.Time) {
+	if item.MaxAttempts <= 0 {
+		item.MaxAttempts = defaultAgentCommandAttempts
+	}
+	if item.TimeoutSeconds <= 0 {
+		item.TimeoutSeconds = int(defaultAgentCommandTimeout(item.Command) / time.Second)
+	}
+	item.DeadlineAt = now.Add(time.Duration(item.TimeoutSeconds) * time.Second)
+}
+
+func validateAgentCommandLimits(item models.AgentCommand) error {
+	if item.MaxAttempts < 0 || item.MaxAttempts > maxAgentCommandAttempts {
+		return fmt.Errorf("max_attempts must be between 1 and %d", maxAgentCommandAttempts)
+	}
+	timeout := time.Duration(item.TimeoutSeconds) * time.Second
+	if item.TimeoutSeconds != 0 && (timeout < minAgentCommandTimeout || timeout > maxAgentCommandTimeout) {
+		return fmt.Errorf("timeout_seconds must be between %d and %d", int(minAgentCommandTimeout/time.Second), int(maxAgentCommandTimeout/time.Second))
+	}
+	return nil
+}
+
+func (s *ResourceService) getProviderAgentCommand(ctx context.Context, commandID string, providerID string) (models.AgentCommand, error) {
+	if commandID == "" {
+		return models.AgentCommand{}, errors.New("command id is required")
+	}
+	if providerID == "" {
+		return models.AgentCommand{}, errors.New("provider_id is required")
+	}
+	cmd, err := s.repo.GetAgentCommand(ctx, commandID)
+	if err != nil {
+		return models.AgentCommand{}, err
+	}
+	if cmd.ProviderID != providerID {
+		return models.AgentCommand{}, errors.New("command does not belong to provider")
+	}
+	return cmd, nil
+}
+
+// AcknowledgeAgentCommand records that the agent received a pushed command,
+// which ends its delivery lease. From then on only its deadline applies.
+func (s *ResourceService) AcknowledgeAgentCommand(ctx context.Context, commandID string, providerID string) (models.AgentCommand, error) {
+	if _, err := s.getProviderAgentCommand(ctx, commandID, providerID); err != nil {
+		return models.AgentCommand{}, err
+	}
+	return s.repo.AcknowledgeAgentCommand(ctx, commandID)
+}
+
+func (s *ResourceService) ListRequestedAgentCommands(ctx context.Context, userID string, limit int) ([]models.AgentCommand, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListRequestedAgentCommands(ctx, userID, limit)
+}
+
+// CancelAgentCommand ends a queued or running command for its requester or an
+// admin.
+func (s *ResourceService) CancelAgentCommand(ctx context.Context, userID string, admin bool, commandID string, reason string) (models.AgentCommand, error) {
+	cmd, err := s.repo.GetAgentCommand(ctx, commandID)
+	if err != nil {
+		return models.AgentCommand{}, err
+	}
+	if !admin && cmd.RequestedBy != userID {
+		return models.AgentCommand{}, errors.New("forbidden: only the requester or an admin can cancel a command")
+	}
+	if cmd.Status != models.AgentCommandQueued && cmd.Status != models.AgentCommandRunning {
+		return models.AgentCommand{}, errors.New("command already finished")
+	}
+	message := "cancelled by " + userID
+	if reason = strings.TrimSpace(reason); reason != "" {
+		message += ": " + reason
+	}
+	return s.cancelAgentCommand(ctx, cmd, userID, message)
+}
+
+// cancelAgentCommand cancels a command. One the agent already received is
+// stopped there by a command_cancel naming it, and a result it reports later
+// is rejected. Commands that time out need nothing sent, since the agent runs
+// each one only until its deadline_at.
+func (s *ResourceService) cancelAgentCommand(ctx context.Context, cmd models.AgentCommand, requestedBy string, message string) (models.AgentCommand, error) {
+	cancelled, err := s.finishAgentCommand(ctx, cmd, models.AgentCommandCancelled, message)
+	if err != nil {
+		return models.AgentCommand{}, err
+	}
+	if cmd.Status == models.AgentCommandRunning {
+		if _, err := s.createAgentCommand(ctx, models.AgentCommand{
+			ProviderID:  cmd.ProviderID,
+			ResourceID:  cmd.ResourceID,
+			Command:     models.AgentCommandCancel,
+			Payload:     cmd.ID,
+			Status:      models.AgentCommandQueued,
+			RequestedBy: requestedBy,
+		}); err != nil {
+			log.Warn().Err(err).Str("command_id", cmd.ID).Str("provider_id", cmd.ProviderID).Msg("agent command cancel not queued")
+		}
+	}
+	return cancelled, nil
+}
+
+// SweepAgentCommands times out commands past their deadline and queues again
+// pushed commands whose lease ran out unacknowledged, until they run out of
+// attempts.
+func (s *ResourceService) SweepAgentCommands(ctx context.Context, now time.Time) error {
+	stale, err := s.repo.ListStaleAgentCommands(ctx, now, 200)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range stale {
+		switch {
+		case !cmd.DeadlineAt.IsZero() && !cmd.DeadlineAt.After(now):
+			_, err = s.finishAgentCommand(ctx, cmd, models.AgentCommandTimedOut, fmt.Sprintf("deadline of %ds exceeded", cmd.TimeoutSeconds))
+		case cmd.Attempts < cmd.MaxAttempts:
+			var requeued models.AgentCommand
+			requeued, err = s.repo.RequeueAgentCommand(ctx, cmd.ID)
+			if err == nil {
+				s.agentChannels.notify(requeued.ProviderID)
+			}
+		default:
+			_, err = s.finishAgentCommand(ctx, cmd, models.AgentCommandTimedOut, fmt.Sprintf("not acknowledged after %d attempts", cmd.Attempts))
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("command_id", cmd.ID).Str("provider_id", cmd.ProviderID).Msg("agent command sweep skipped command")
+			continue
+		}
+		log.Info().Str("command_id", cmd.ID).Str("provider_id", cmd.ProviderID).Str("command", string(cmd.Command)).Int("attempts", cmd.Attempts).Msg("stale agent command swept")
+	}
+	return nil
+}
+
+// finishAgentCommand moves a command to its final state and applies the
+// outcome to the pod or terminal session it drives.
+func (s *ResourceService) finishAgentCommand(ctx context.Context, cmd models.AgentCommand, status models.AgentCommandState, resultMessage string) (models.AgentCommand, error) {
+	updated, err := s.repo.CompleteAgentCommand(ctx, cmd.ID, status, resultMessage)
+	if err != nil {
+		return models.AgentCommand{}, err
+	}
+	switch updated.Command {
+	case models.AgentCommandPodStart, models.AgentCommandPodStop, models.AgentCommandPodStatus:
+		s.applyLocalPodCommandResult(ctx, updated, status)
+	}
+	switch updated.Command {
+	case models.AgentCommandCapacityChallenge:
+		s.applyCapacityChallengeResult(ctx, updated, status)
+	case models.AgentCommandExec:
+		s.applyExecResult(ctx, updated, status)
+	case models.AgentCommandFileWrite:
+		s.applyFileWriteResult(ctx, updated, status)
+	case models.AgentCommandFileRead:
+		s.applyFileReadResult(ctx, updated, status)
+	}
+	if updated.SessionID != "" {
+		s.applyTerminalCommandResult(ctx, updated, status)
+	}
+	if updated.RolloutID != "" {
+		s.applyRolloutCommandResult(ctx, updated, status)
+	}
+	return updated, nil
+}
+
+func (s *ResourceService) applyTerminalCommandResult(ctx context.Context, cmd models.AgentCommand, status models.AgentCommandState) {
+	switch cmd.Command {
+	case models.AgentCommandTerminalOpen:
+		if status == models.AgentCommandSucceeded {
+			_, _ = s.repo.UpdateTerminalSessionStatus(ctx, cmd.SessionID, models.TerminalSessionOpen, 0)
+			_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+				SessionID:  cmd.SessionID,
+				ProviderID: cmd.ProviderID,
+				UserID:     cmd.RequestedBy,
+				EventType:  "terminal_opened",
+				Details:    "agent confirmed terminal open",
+			})
+			return
+		}
+		session, err := s.repo.GetTerminalSession(ctx, cmd.SessionID)
+		if err != nil || session.Status == models.TerminalSessionClosed || session.Status == models.TerminalSessionExpired {
+			return
+		}
+		_, _ = s.repo.UpdateTerminalSessionStatus(ctx, cmd.SessionID, models.TerminalSessionClosed, 1)
+		s.terminals.finish(cmd.SessionID, models.TerminalSessionClosed)
+		_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+			SessionID:  cmd.SessionID,
+			ProviderID: cmd.ProviderID,
+			UserID:     cmd.RequestedBy,
+			GrantID:    session.GrantID,
+			EventType:  "terminal_open_failed",
+			Details:    strings.TrimSpace(string(status) + ": " + cmd.ResultMessage),
+		})
+		// An agent that received the open may hold a half-open shell.
+		if !cmd.AcknowledgedAt.IsZero() && status != models.AgentCommandFailed {
+			_, _ = s.createAgentCommand(ctx, models.AgentCommand{
+				ProviderID:  cmd.ProviderID,
+				ResourceID:  cmd.ResourceID,
+				SessionID:   cmd.SessionID,
+				Command:     models.AgentCommandTerminalClose,
+				Status:      models.AgentCommandQueued,
+				RequestedBy: "system",
+			})
+		}
+	case models.AgentCommandTerminalClose:
+		finalExitCode := 0
+		if status != models.AgentCommandSucceeded {
+			finalExitCode = 1
+		}
+		_, _ = s.repo.UpdateTerminalSessionStatus(ctx, cmd.SessionID, models.TerminalSessionClosed, finalExitCode)
+		s.terminals.finish(cmd.SessionID, models.TerminalSessionClosed)
+		_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+			SessionID:  cmd.SessionID,
+			ProviderID: cmd.ProviderID,
+			UserID:     cmd.RequestedBy,
+			EventType:  "terminal_closed",
+			Details:    strings.TrimSpace(cmd.ResultMessage),
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const agentEnrollmentTokenPrefix = "smtc_enroll_"
+
+// AgentCredentialIssuer signs the host-bound token an enrolled agent
+// authenticates with.
+type AgentCredentialIssuer interface {
+	Issue(providerID string, hostID string, credentialID string, ttl time.Duration) (string, error)
+}
+
+// AgentAuthPolicy controls how agents authenticate. Static tokens are the
+// provider-wide agent JWTs issued before enrollment existed; they carry no
+// host and cannot be revoked individually. Providers is the registry that
+// decides who besides admins may create enrollment tokens. CredentialGrace is
+// how long a rotated-out credential keeps working.
+type AgentAuthPolicy struct {
+	Issuer            AgentCredentialIssuer
+	CredentialTTL     time.Duration
+	CredentialGrace   time.Duration
+	EnrollmentTTL     time.Duration
+	AllowStaticTokens bool
+	Providers         ProviderDirectory
+}
+
+func (p AgentAuthPolicy) withDefaults() AgentAuthPolicy {
+	if p.CredentialTTL <= 0 {
+		p.CredentialTTL = 7 * 24 * time.Hour
+	}
+	if p.CredentialGrace <= 0 {
+		p.CredentialGrace = 10 * time.Minute
+	}
+	if p.EnrollmentTTL <= 0 {
+		p.EnrollmentTTL = time.Hour
+	}
+	return p
+}
+
+// AgentIdentity is what an agent's token claims about itself.
+type AgentIdentity struct {
+	ProviderID   string
+	HostID       string
+	CredentialID string
+}
+
+// AuthorizeAgent checks that identity may act for providerID: the token must
+// name an active host of that provider and one of the host's live credentials.
+// The previous credential is live for CredentialGrace after a rotation and
+// retires as soon as the agent presents the new one.
+func (s *ResourceService) AuthorizeAgent(ctx context.Context, identity AgentIdentity, providerID string) error {
+	if identity.ProviderID != providerID {
+		return errors.New("agent token does not match provider_id")
+	}
+	if identity.HostID == "" {
+		if s.agentAuth.AllowStaticTokens {
+			return nil
+		}
+		return errors.New("agent token is not bound to an enrolled host")
+	}
+	host, err := s.repo.GetAgentHost(ctx, identity.HostID)
+	if err != nil {
+		return errors.New("agent host is not enrolled")
+	}
+	if host.ProviderID != providerID {
+		return errors.New("agent host does not belong to provider")
+	}
+	if host.Status != models.AgentHostActive {
+		return errors.New("agent host has been revoked")
+	}
+	switch {
+	case identity.CredentialID == "":
+		return errors.New("agent credential has been rotated out")
+	case identity.CredentialID == host.CredentialID:
+		if host.PreviousCredentialID != "" {
+			if err := s.repo.RetirePreviousAgentCredential(ctx, host.ID, host.CredentialID); err != nil {
+				log.Warn().Err(err).Str("host_id", host.ID).Msg("previous agent credential not retired")
+			}
+		}
+	case identity.CredentialID == host.PreviousCredentialID && time.Since(host.RotatedAt) < s.agentAuth.CredentialGrace:
+	default:
+		return errors.New("agent credential has been rotated out")
+	}
+	return nil
+}
+
+// CreateAgentEnrollment issues a one-time enrollment token for providerID.
+// Registered providers enroll their own hosts; admins may enroll for any
+// provider.
+func (s *ResourceService) CreateAgentEnrollment(ctx context.Context, userID string, admin bool, providerID string, label string) (models.AgentEnrollment, error) {
+	providerID = strings.TrimSpace(providerID)
+	if providerID == "" {
+		providerID = userID
+	}
+	if !admin {
+		if providerID != userID {
+			return models.AgentEnrollment{}, errors.New("forbidden: providers can only enroll their own hosts")
+		}
+		if err := s.requireRegisteredProvider(ctx, userID); err != nil {
+			return models.AgentEnrollment{}, err
+		}
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return models.AgentEnrollment{}, err
+	}
+	token := agentEnrollmentTokenPrefix + hex.EncodeToString(raw)
+	item, err := s.repo.CreateAgentEnrollment(ctx, models.AgentEnrollment{
+		ProviderID: providerID,
+		Label:      strings.TrimSpace(label),
+		CreatedBy:  userID,
+		ExpiresAt:  time.Now().UTC().Add(s.agentAuth.EnrollmentTTL),
+	}, hashEnrollmentToken(token))
+	if err != nil {
+		return models.AgentEnrollment{}, err
+	}
+	item.Token = token
+	return item, nil
+}
+
+// requireRegisteredProvider refuses users that are not registered providers.
+func (s *ResourceService) requireRegisteredProvider(ctx context.Context, userID string) error {
+	if s.agentAuth.Providers == nil {
+		return errors.New("forbidden: provider registry is not configured; an admin must enroll the host")
+	}
+	providers, err := s.agentAuth.Providers.ProviderTypes(ctx)
+	if err != nil {
+		return fmt.Errorf("provider registry unavailable: %w", err)
+	}
+	if _, ok := providers[userID]; !ok {
+		return errors.New("forbidden: only registered providers can enroll hosts")
+	}
+	return nil
+}
+
+func (s *ResourceService) ListAgentEnrollments(ctx context.Context, providerID string, limit int) ([]models.AgentEnrollment, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListAgentEnrollments(ctx, providerID, limit)
+}
+
+// EnrollAgent redeems an enrollment token for a new host and its first
+// credential. Agent channels, heartbeats and host capacity are all kept per
+// provider, so a provider has one active host: enrolling a new one revokes the
+// host enrolled before, whose open channel closes at its next liveness check.
+func (s *ResourceService) EnrollAgent(ctx context.Context, token string, hostname string, label string, publicKey string) (models.AgentCredential, error) {
+	if s.agentAuth.Issuer == nil {
+		return models.AgentCredential{}, errors.New("agent enrollment is not configured")
+	}
+	if publicKey != "" {
+		if _, err := decodePublicKey(publicKey); err != nil {
+			return models.AgentCredential{}, err
+		}
+	}
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, agentEnrollmentTokenPrefix) {
+		return models.AgentCredential{}, errors.New("enrollment token is invalid, used or expired")
+	}
+	hostID := uuid.NewString()
+	enrollment, err := s.repo.ConsumeAgentEnrollment(ctx, hashEnrollmentToken(token), hostID, time.Now().UTC())
+	if err != nil {
+		return models.AgentCredential{}, err
+	}
+	if label = strings.TrimSpace(label); label == "" {
+		label = enrollment.Label
+	}
+	credentialID := uuid.NewString()
+	expiresAt := time.Now().UTC().Add(s.agentAuth.CredentialTTL)
+	host, replaced, err := s.repo.CreateAgentHost(ctx, models.AgentHost{
+		ID:                  hostID,
+		ProviderID:          enrollment.ProviderID,
+		Hostname:            strings.TrimSpace(hostname),
+		Label:               label,
+		EnrollmentID:        enrollment.ID,
+		Status:              models.AgentHostActive,
+		PublicKey:           publicKey,
+		CredentialID:        credentialID,
+		CredentialExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return models.AgentCredential{}, err
+	}
+	for _, old := range replaced {
+		log.Info().Str("provider_id", old.ProviderID).Str("host_id", old.ID).Str("replaced_by", host.ID).Msg("agent host replaced by a new enrollment")
+	}
+	log.Info().Str("provider_id", host.ProviderID).Str("host_id", host.ID).Str("hostname", host.Hostname).Msg("agent host enrolled")
+	return s.issueAgentCredential(host, credentialID, expiresAt)
+}
+
+// RotateAgentCredential replaces the credential the agent presents. The one
+// it presented stays valid as the previous credential for a short grace
+// period, or until the new one is first used. A host that enrolled without a
+// heartbeat signing key may register one here.
+func (s *ResourceService) RotateAgentCredential(ctx context.Context, identity AgentIdentity, publicKey string) (models.AgentCredential, error) {
+	if s.agentAuth.Issuer == nil {
+		return models.AgentCredential{}, errors.New("agent enrollment is not configured")
+	}
+	if identity.HostID == "" {
+		return models.AgentCredential{}, errors.New("agent token is not bound to an enrolled host")
+	}
+	if err := s.AuthorizeAgent(ctx, identity, identity.ProviderID); err != nil {
+		return models.AgentCredential{}, err
+	}
+	if publicKey != "" {
+		if _, err := decodePublicKey(publicKey); err != nil {
+			return models.AgentCredential{}, err
+		}
+		if host, err := s.repo.GetAgentHost(ctx, identity.HostID); err == nil && host.PublicKey == "" {
+			if _, err := s.repo.SetAgentHostPublicKey(ctx, identity.HostID, publicKey); err != nil {
+				return models.AgentCredential{}, err
+			}
+		}
+	}
+	credentialID := uuid.NewString()
+	expiresAt := time.Now().UTC().Add(s.agentAuth.CredentialTTL)
+	host, err := s.repo.RotateAgentHostCredential(ctx, identity.HostID, identity.CredentialID, credentialID, expiresAt)
+	if err != nil {
+		return models.AgentCredential{}, err
+	}
+	log.Info().Str("provider_id", host.ProviderID).Str("host_id", host.ID).Msg("agent credential rotated")
+	return s.issueAgentCredential(host, credentialID, expiresAt)
+}
+
+func (s *ResourceService) ListAgentHosts(ctx context.Context, providerID string, limit int) ([]models.AgentHost, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListAgentHosts(ctx, providerID, limit)
+}
+
+// RevokeAgentHost disables every credential of a host. Open agent channels
+// notice on their next liveness check and close.
+func (s *ResourceService) RevokeAgentHost(ctx context.Context, userID string, admin bool, hostID string) (models.AgentHost, error) {
+	host, err := s.repo.GetAgentHost(ctx, hostID)
+	if err != nil {
+		return models.AgentHost{}, err
+	}
+	if !admin && host.ProviderID != userID {
+		return models.AgentHost{}, errors.New("forbidden: providers can only revoke their own hosts")
+	}
+	host, err = s.repo.RevokeAgentHost(ctx, hostID, userID)
+	if err != nil {
+		return models.AgentHost{}, err
+	}
+	log.Info().Str("provider_id", host.ProviderID).Str("host_id", host.ID).Str("revoked_by", userID).Msg("agent host revoked")
+	return host, nil
+}
+
+func (s *ResourceService) issueAgentCredential(host models.AgentHost, credentialID string, expiresAt time.Time) (models.AgentCredential, error) {
+	token, err := s.agentAuth.Issuer.Issue(host.ProviderID, host.ID, credentialID, time.Until(expiresAt))
+	if err != nil {
+		return models.AgentCredential{}, err
+	}
+	return models.AgentCredential{
+		HostID:      host.ID,
+		ProviderID:  host.ProviderID,
+		Token:       token,
+		ExpiresAt:   expiresAt,
+		RotateAfter: expiresAt.Add(-s.agentAuth.CredentialTTL / 2),
+	}, nil
+}
+
+func hashEnrollmentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
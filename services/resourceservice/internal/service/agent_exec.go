@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/MidasWR/ShareMTC/services/sdk/agentexec"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultExecTimeout = 60 * time.Second
+	// execCommandSlack is added to the exec timeout for the agent command
+	// deadline, which also covers time spent queued.
+	execCommandSlack   = time.Minute
+	maxExecTimeout     = maxAgentCommandTimeout - execCommandSlack
+	execOutputLimit    = 1 << 20
+	maxExecScriptBytes = 64 << 10
+	maxExecArgs        = 64
+	maxExecEnvVars     = 32
+)
+
+var (
+	execEnvNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	execUserPattern    = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+)
+
+// execReservedEnv are variables the agent sets itself or that would let a
+// request change what actually runs.
+var execReservedEnv = map[string]bool{"PATH": true, "HOME": true, "USER": true, "SHELL": true, "IFS": true, "ENV": true, "BASH_ENV": true}
+
+// ExecRequest is an operator's request to run a command on a provider's host.
+type ExecRequest struct {
+	ProviderID     string
+	Script         string
+	Argv           []string
+	WorkDir        string
+	Env            map[string]string
+	TimeoutSeconds int
+	Reason         string
+}
+
+func (s *ResourceService) GetExecPolicy(ctx context.Context, providerID string) (models.ExecPolicy, error) {
+	if providerID == "" {
+		return models.ExecPolicy{}, errors.New("provider_id is required")
+	}
+	return s.repo.GetExecPolicy(ctx, providerID)
+}
+
+// UpdateExecPolicy replaces a provider's exec policy. Commands never run as
+// root, whatever the policy says.
+func (s *ResourceService) UpdateExecPolicy(ctx context.Context, updatedBy string, item models.ExecPolicy) (models.ExecPolicy, error) {
+	item.ProviderID = strings.TrimSpace(item.ProviderID)
+	if item.ProviderID == "" {
+		return models.ExecPolicy{}, errors.New("provider_id is required")
+	}
+	allowed := make([]string, 0, len(item.AllowedCommands))
+	for _, command := range item.AllowedCommands {
+		command = strings.TrimSpace(command)
+		if command == "" || strings.ContainsAny(command, " \t\n") {
+			return models.ExecPolicy{}, fmt.Errorf("allowed command %q is invalid", command)
+		}
+		if strings.Contains(command, "/") && (!path.IsAbs(command) || path.Clean(command) != command) {
+			return models.ExecPolicy{}, fmt.Errorf("allowed command %q must be a bare name or a clean absolute path", command)
+		}
+		if !slices.Contains(allowed, command) {
+			allowed = append(allowed, command)
+		}
+	}
+	item.AllowedCommands = allowed
+	if item.MaxTimeoutSeconds == 0 {
+		item.MaxTimeoutSeconds = int(5 * time.Minute / time.Second)
+	}
+	if timeout := time.Duration(item.MaxTimeoutSeconds) * time.Second; timeout < minAgentCommandTimeout || timeout > maxExecTimeout {
+		return models.ExecPolicy{}, fmt.Errorf("max_timeout_seconds must be between %d and %d", int(minAgentCommandTimeout/time.Second), int(maxExecTimeout/time.Second))
+	}
+	if item.RunAs = strings.TrimSpace(item.RunAs); item.RunAs == "" {
+		item.RunAs = "nobody"
+	}
+	if item.RunAs == "root" || !execUserPattern.MatchString(item.RunAs) {
+		return models.ExecPolicy{}, errors.New("run_as must be a non-root user name")
+	}
+	item.UpdatedBy = updatedBy
+	updated, err := s.repo.UpsertExecPolicy(ctx, item)
+	if err != nil {
+		return models.ExecPolicy{}, err
+	}
+	log.Info().Str("provider_id", updated.ProviderID).Str("updated_by", updatedBy).Bool("enabled", updated.Enabled).Strs("allowed_commands", updated.AllowedCommands).Bool("allow_scripts", updated.AllowScripts).Msg("exec policy updated")
+	return updated, nil
+}
+
+// RunExec checks a request against the provider's policy and queues it for the
+// agent. Requests the policy rejects are recorded too.
+func (s *ResourceService) RunExec(ctx context.Context, requestedBy string, req ExecRequest) (models.ExecRun, error) {
+	req.ProviderID = strings.TrimSpace(req.ProviderID)
+	if err := validateExecRequest(&req); err != nil {
+		return models.ExecRun{}, err
+	}
+	policy, err := s.repo.GetExecPolicy(ctx, req.ProviderID)
+	if err != nil {
+		return models.ExecRun{}, err
+	}
+	envKeys := make([]string, 0, len(req.Env))
+	for key := range req.Env {
+		envKeys = append(envKeys, key)
+	}
+	sort.Strings(envKeys)
+	run := models.ExecRun{
+		ID:             uuid.NewString(),
+		ProviderID:     req.ProviderID,
+		RequestedBy:    requestedBy,
+		Reason:         strings.TrimSpace(req.Reason),
+		Script:         req.Script,
+		Argv:           req.Argv,
+		WorkDir:        req.WorkDir,
+		EnvKeys:        envKeys,
+		RunAs:          policy.RunAs,
+		TimeoutSeconds: req.TimeoutSeconds,
+		Status:         models.ExecRunQueued,
+	}
+	if reason := checkExecPolicy(policy, req); reason != "" {
+		run.Status = models.ExecRunRejected
+		run.Detail = reason
+		run.FinishedAt = time.Now().UTC()
+		if _, err := s.repo.CreateExecRun(ctx, run); err != nil {
+			return models.ExecRun{}, err
+		}
+		log.Warn().Str("exec_id", run.ID).Str("provider_id", run.ProviderID).Str("requested_by", requestedBy).Str("reason", reason).Msg("exec rejected by policy")
+		return models.ExecRun{}, errors.New("forbidden: " + reason)
+	}
+	payload, err := json.Marshal(agentexec.Request{
+		ExecID:         run.ID,
+		Script:         req.Script,
+		Argv:           req.Argv,
+		WorkDir:        req.WorkDir,
+		Env:            req.Env,
+		TimeoutSeconds: req.TimeoutSeconds,
+		RunAs:          policy.RunAs,
+	})
+	if err != nil {
+		return models.ExecRun{}, err
+	}
+	// The run exists before its command so output that arrives right after
+	// the push has somewhere to go.
+	run.CommandID = uuid.NewString()
+	created, err := s.repo.CreateExecRun(ctx, run)
+	if err != nil {
+		return models.ExecRun{}, err
+	}
+	_, err = s.createAgentCommand(ctx, models.AgentCommand{
+		ID:             run.CommandID,
+		ProviderID:     run.ProviderID,
+		Command:        models.AgentCommandExec,
+		Payload:        string(payload),
+		Status:         models.AgentCommandQueued,
+		RequestedBy:    requestedBy,
+		TimeoutSeconds: req.TimeoutSeconds + int(execCommandSlack/time.Second),
+		// A lost ack must not run the script a second time, so an exec is
+		// delivered once and times out if it goes unacknowledged.
+		MaxAttempts: 1,
+	})
+	if err != nil {
+		_, _ = s.repo.FinishExecRun(ctx, run.ID, models.ExecRunFailed, -1, false, "command not queued: "+err.Error())
+		return models.ExecRun{}, err
+	}
+	log.Info().Str("exec_id", run.ID).Str("provider_id", run.ProviderID).Str("requested_by", requestedBy).Strs("argv", run.Argv).Bool("script", run.Script != "").Str("run_as", run.RunAs).Msg("exec queued")
+	return created, nil
+}
+
+func validateExecRequest(req *ExecRequest) error {
+	if req.ProviderID == "" {
+		return errors.New("provider_id is required")
+	}
+	if (req.Script == "") == (len(req.Argv) == 0) {
+		return errors.New("exactly one of script and argv is required")
+	}
+	if len(req.Script) > maxExecScriptBytes {
+		return fmt.Errorf("script must be at most %d bytes", maxExecScriptBytes)
+	}
+	if len(req.Argv) > maxExecArgs {
+		return fmt.Errorf("argv must have at most %d entries", maxExecArgs)
+	}
+	if len(req.Argv) > 0 && strings.TrimSpace(req.Argv[0]) == "" {
+		return errors.New("argv[0] is required")
+	}
+	if req.WorkDir != "" && (!path.IsAbs(req.WorkDir) || path.Clean(req.WorkDir) != req.WorkDir) {
+		return errors.New("work_dir must be a clean absolute path")
+	}
+	if len(req.Env) > maxExecEnvVars {
+		return fmt.Errorf("env must have at most %d variables", maxExecEnvVars)
+	}
+	for key := range req.Env {
+		if !execEnvNamePattern.MatchString(key) || execReservedEnv[key] || strings.HasPrefix(key, "LD_") {
+			return fmt.Errorf("env variable %q is not allowed", key)
+		}
+	}
+	if req.TimeoutSeconds == 0 {
+		req.TimeoutSeconds = int(defaultExecTimeout / time.Second)
+	}
+	if timeout := time.Duration(req.TimeoutSeconds) * time.Second; timeout < minAgentCommandTimeout || timeout > maxExecTimeout {
+		return fmt.Errorf("timeout_seconds must be between %d and %d", int(minAgentCommandTimeout/time.Second), int(maxExecTimeout/time.Second))
+	}
+	return nil
+}
+
+// checkExecPolicy returns why policy forbids req, or "" if it allows it.
+func checkExecPolicy(policy models.ExecPolicy, req ExecRequest) string {
+	switch {
+	case !policy.Enabled:
+		return "exec is disabled for this provider"
+	case req.Script != "" && !policy.AllowScripts:
+		return "scripts are not allowed for this provider"
+	case len(req.Argv) > 0 && !slices.Contains(policy.AllowedCommands, req.Argv[0]):
+		return fmt.Sprintf("command %q is not in the allowlist", req.Argv[0])
+	case req.TimeoutSeconds > policy.MaxTimeoutSeconds:
+		return fmt.Sprintf("timeout_seconds exceeds the policy maximum of %d", policy.MaxTimeoutSeconds)
+	}
+	return ""
+}
+
+// RecordExecOutput appends a chunk streamed by the agent and fans it out to
+// admins watching the provider.
+func (s *ResourceService) RecordExecOutput(ctx context.Context, providerID string, execID string, stream string, data string) error {
+	if stream != agentexec.StreamStdout && stream != agentexec.StreamStderr {
+		return errors.New("stream must be stdout or stderr")
+	}
+	run, err := s.repo.GetExecRun(ctx, execID)
+	if err != nil {
+		return err
+	}
+	if run.ProviderID != providerID {
+		return errors.New("provider mismatch for exec output")
+	}
+	if err := s.repo.AppendExecOutput(ctx, execID, stream, data, execOutputLimit); err != nil {
+		return err
+	}
+	s.publishStream(models.StreamEvent{Type: models.StreamEventExecOutput, ProviderID: providerID, Data: models.ExecOutputChunk{ExecID: execID, Stream: stream, Data: data}})
+	return nil
+}
+
+func (s *ResourceService) applyExecResult(ctx context.Context, cmd models.AgentCommand, status models.AgentCommandState) {
+	var payload agentexec.Request
+	if err := json.Unmarshal([]byte(cmd.Payload), &payload); err != nil {
+		return
+	}
+	exitCode := -1
+	truncated := false
+	detail := ""
+	runStatus := models.ExecRunFailed
+	var result agentexec.Result
+	if err := json.Unmarshal([]byte(cmd.ResultMessage), &result); err == nil && (status == models.AgentCommandSucceeded || status == models.AgentCommandFailed) {
+		exitCode = result.ExitCode
+		truncated = result.Truncated
+		detail = result.Error
+		switch {
+		case result.TimedOut:
+			runStatus = models.ExecRunTimedOut
+		case status == models.AgentCommandSucceeded:
+			runStatus = models.ExecRunSucceeded
+		}
+	} else {
+		detail = cmd.ResultMessage
+		switch status {
+		case models.AgentCommandTimedOut:
+			runStatus = models.ExecRunTimedOut
+		case models.AgentCommandCancelled:
+			runStatus = models.ExecRunCancelled
+		}
+	}
+	run, err := s.repo.FinishExecRun(ctx, payload.ExecID, runStatus, exitCode, truncated, detail)
+	if err != nil {
+		log.Warn().Err(err).Str("exec_id", payload.ExecID).Str("command_id", cmd.ID).Msg("exec result not recorded")
+		return
+	}
+	log.Info().Str("exec_id", run.ID).Str("provider_id", run.ProviderID).Str("requested_by", run.RequestedBy).Str("status", string(run.Status)).Int("exit_code", run.ExitCode).Msg("exec finished")
+}
+
+func (s *ResourceService) GetExecRun(ctx context.Context, execID string) (models.ExecRun, error) {
+	return s.repo.GetExecRun(ctx, execID)
+}
+
+func (s *ResourceService) ListExecRuns(ctx context.Context, providerID string, requestedBy string, limit int) ([]models.ExecRun, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListExecRuns(ctx, providerID, requestedBy, limit)
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/MidasWR/ShareMTC/services/sdk/agentupdate"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultAgentReleaseURL = "https://github.com/MidasWR/ShareMTC/releases/download/{version}/hostagent-{os}-{arch}"
+	minAgentHealthTimeout  = 30 * time.Second
+	maxAgentHealthTimeout  = 30 * time.Minute
+	// agentUpdateSlack is added to the health timeout for the command
+	// deadline; it covers time queued, the download and the restart.
+	agentUpdateSlack = 15 * time.Minute
+)
+
+// AgentUpdatePolicy controls hostagent self-updates. ReleaseURL is a
+// template the agent fills in with {version}, {os} and {arch}; it fetches
+// the signature from the same URL with a .sig suffix and checks it against
+// the key built into the running agent, so the URL itself is not trusted.
+type AgentUpdatePolicy struct {
+	ReleaseURL    string
+	HealthTimeout time.Duration
+}
+
+func (p AgentUpdatePolicy) withDefaults() AgentUpdatePolicy {
+	if p.ReleaseURL == "" {
+		p.ReleaseURL = defaultAgentReleaseURL
+	}
+	if p.HealthTimeout < minAgentHealthTimeout || p.HealthTimeout > maxAgentHealthTimeout {
+		p.HealthTimeout = 2 * time.Minute
+	}
+	return p
+}
+
+// AgentUpdateRequest asks a provider's agent to move to Version. The agent
+// rolls back unless the new version delivers a heartbeat within the health
+// timeout.
+type AgentUpdateRequest struct {
+	ProviderID           string
+	Version              string
+	HealthTimeoutSeconds int
+}
+
+// RequestAgentUpdate queues an agent_update command. The command succeeds
+// once the new version has delivered a heartbeat and fails with the rollback
+// reason otherwise.
+func (s *ResourceService) RequestAgentUpdate(ctx context.Context, requestedBy string, req AgentUpdateRequest) (models.AgentCommand, error) {
+	req.ProviderID = strings.TrimSpace(req.ProviderID)
+	if req.ProviderID == "" {
+		return models.AgentCommand{}, errors.New("provider_id is required")
+	}
+	payload, timeoutSeconds, err := s.agentUpdatePayload(req.Version, req.HealthTimeoutSeconds)
+	if err != nil {
+		return models.AgentCommand{}, err
+	}
+	cmd, err := s.createAgentCommand(ctx, models.AgentCommand{
+		ProviderID:     req.ProviderID,
+		Command:        models.AgentCommandAgentUpdate,
+		Payload:        payload,
+		RequestedBy:    requestedBy,
+		Status:         models.AgentCommandQueued,
+		TimeoutSeconds: timeoutSeconds,
+	})
+	if err != nil {
+		return models.AgentCommand{}, err
+	}
+	log.Info().Str("command_id", cmd.ID).Str("provider_id", cmd.ProviderID).Str("version", strings.TrimSpace(req.Version)).Str("requested_by", requestedBy).Msg("agent update queued")
+	return cmd, nil
+}
+
+// agentUpdatePayload builds the agent_update payload for version and the
+// command timeout that goes with its health timeout.
+func (s *ResourceService) agentUpdatePayload(version string, healthTimeoutSeconds int) (string, int, error) {
+	version = strings.TrimSpace(version)
+	if !agentupdate.ValidVersion(version) {
+		return "", 0, errors.New("version must be a release tag such as v1.2.0")
+	}
+	timeout := s.agentUpdates.HealthTimeout
+	if healthTimeoutSeconds != 0 {
+		timeout = time.Duration(healthTimeoutSeconds) * time.Second
+		if timeout < minAgentHealthTimeout || timeout > maxAgentHealthTimeout {
+			return "", 0, fmt.Errorf("health_timeout_seconds must be between %d and %d", int(minAgentHealthTimeout/time.Second), int(maxAgentHealthTimeout/time.Second))
+		}
+	}
+	payload, err := json.Marshal(agentupdate.Request{
+		Version:              version,
+		URL:                  s.agentUpdates.ReleaseURL,
+		HealthTimeoutSeconds: int(timeout / time.Second),
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return string(payload), int((timeout + agentUpdateSlack) / time.Second), nil
+}
+
+// AgentVersions reports the hostagent version of every provider from its
+// latest heartbeat, with a count per version.
+func (s *ResourceService) AgentVersions(ctx context.Context) (models.AgentVersionInventory, error) {
+	hosts, err := s.repo.ListHostResources(ctx)
+	if err != nil {
+		return models.AgentVersionInventory{}, err
+	}
+	now := time.Now().UTC()
+	out := models.AgentVersionInventory{Versions: []models.AgentVersionCount{}, Providers: make([]models.AgentVersionEntry, 0, len(hosts))}
+	counts := map[string]*models.AgentVersionCount{}
+	for _, host := range hosts {
+		entry := models.AgentVersionEntry{
+			ProviderID:   host.ProviderID,
+			AgentVersion: host.AgentVersion,
+			HeartbeatAt:  host.HeartbeatAt,
+			Online:       now.Sub(host.HeartbeatAt) <= s.heartbeatMaxAge,
+		}
+		out.Providers = append(out.Providers, entry)
+		count, ok := counts[entry.AgentVersion]
+		if !ok {
+			count = &models.AgentVersionCount{AgentVersion: entry.AgentVersion}
+			counts[entry.AgentVersion] = count
+		}
+		count.Providers++
+		if entry.Online {
+			count.Online++
+		}
+	}
+	for _, count := range counts {
+		out.Versions = append(out.Versions, *count)
+	}
+	sort.Slice(out.Versions, func(i, j int) bool {
+		if out.Versions[i].Providers != out.Versions[j].Providers {
+			return out.Versions[i].Providers > out.Versions[j].Providers
+		}
+		return out.Versions[i].AgentVersion < out.Versions[j].AgentVersion
+	})
+	return out, nil
+}
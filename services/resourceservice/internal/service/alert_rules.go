@@ -0,0 +1,547 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// AlertNotifier delivers an alert notification to one channel target.
+type AlertNotifier interface {
+	Notify(ctx context.Context, target string, notification models.AlertNotification) error
+}
+
+const (
+	maxAlertRuleChannels      = 5
+	maxAlertForSeconds        = 24 * 60 * 60
+	defaultHeartbeatAlertSecs = 120
+	maxAlertSilence           = 30 * 24 * time.Hour
+	// alertMetricStaleAfter drops resources that stopped reporting a metric
+	// from metric rules; a heartbeat rule is the way to alert on silence.
+	alertMetricStaleAfter    = 5 * time.Minute
+	alertHealthCheckLookback = 24 * time.Hour
+)
+
+var alertComparators = map[string]func(value float64, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+type alertSubject struct {
+	ResourceType string
+	ResourceID   string
+	Value        float64
+	Matching     bool
+	Summary      string
+}
+
+// CreateAlertRule adds a rule for one resource the user can see: their own
+// host, or a VM or pod they own or were granted read access to.
+func (s *ResourceService) CreateAlertRule(ctx context.Context, userID string, rule models.AlertRule) (models.AlertRule, error) {
+	rule.OwnerUserID = userID
+	rule.Scope = models.AlertRuleScopeUser
+	if err := s.normalizeAlertRule(&rule); err != nil {
+		return models.AlertRule{}, err
+	}
+	if rule.ResourceID == "" {
+		return models.AlertRule{}, errors.New("resource_id is required")
+	}
+	switch rule.ResourceType {
+	case "host":
+		if rule.ResourceID != userID {
+			return models.AlertRule{}, errors.New("forbidden: host alerts are limited to the host provider")
+		}
+	case "vm", "pod":
+		access, err := s.authorizeResourceAccess(ctx, userID, rule.ResourceID, models.SharedAccessRead)
+		if err != nil {
+			return models.AlertRule{}, err
+		}
+		if access.ResourceType != rule.ResourceType {
+			return models.AlertRule{}, fmt.Errorf("resource_id is not a %s", rule.ResourceType)
+		}
+	default:
+		return models.AlertRule{}, errors.New("resource_type must be host, vm or pod")
+	}
+	return s.repo.CreateAlertRule(ctx, rule)
+}
+
+// CreateAlertRuleAdmin adds a platform rule; without a resource_id it covers
+// every resource of the type, or every resource when the type is empty too.
+func (s *ResourceService) CreateAlertRuleAdmin(ctx context.Context, adminUserID string, rule models.AlertRule) (models.AlertRule, error) {
+	rule.OwnerUserID = adminUserID
+	rule.Scope = models.AlertRuleScopeAdmin
+	if err := s.normalizeAlertRule(&rule); err != nil {
+		return models.AlertRule{}, err
+	}
+	return s.repo.CreateAlertRule(ctx, rule)
+}
+
+func (s *ResourceService) ListAlertRules(ctx context.Context, userID string) ([]models.AlertRule, error) {
+	return s.repo.ListAlertRules(ctx, userID, false)
+}
+
+func (s *ResourceService) ListAlertRulesAdmin(ctx context.Context) ([]models.AlertRule, error) {
+	return s.repo.ListAlertRules(ctx, "", false)
+}
+
+func (s *ResourceService) DeleteAlertRule(ctx context.Context, userID string, ruleID string) error {
+	if _, err := s.ownedAlertRule(ctx, userID, ruleID); err != nil {
+		return err
+	}
+	return s.repo.DeleteAlertRule(ctx, ruleID)
+}
+
+func (s *ResourceService) DeleteAlertRuleAdmin(ctx context.Context, ruleID string) error {
+	if err := s.repo.DeleteAlertRule(ctx, ruleID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errors.New("alert rule not found")
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *ResourceService) ListAlerts(ctx context.Context, userID string, state string, limit int) ([]models.Alert, error) {
+	return s.listAlerts(ctx, userID, state, limit)
+}
+
+func (s *ResourceService) ListAlertsAdmin(ctx context.Context, state string, limit int) ([]models.Alert, error) {
+	return s.listAlerts(ctx, "", state, limit)
+}
+
+func (s *ResourceService) listAlerts(ctx context.Context, ownerUserID string, state string, limit int) ([]models.Alert, error) {
+	switch models.AlertState(state) {
+	case "", models.AlertStatePending, models.AlertStateFiring, models.AlertStateResolved:
+	default:
+		return nil, errors.New("state must be pending, firing or resolved")
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListAlerts(ctx, ownerUserID, state, limit)
+}
+
+// CreateAlertSilence mutes one of the user's rules, optionally only for a
+// single resource.
+func (s *ResourceService) CreateAlertSilence(ctx context.Context, userID string, silence models.AlertSilence) (models.AlertSilence, error) {
+	if strings.TrimSpace(silence.RuleID) == "" {
+		return models.AlertSilence{}, errors.New("rule_id is required")
+	}
+	if _, err := s.ownedAlertRule(ctx, userID, strings.TrimSpace(silence.RuleID)); err != nil {
+		return models.AlertSilence{}, err
+	}
+	silence.OwnerUserID = userID
+	if err := normalizeAlertSilence(&silence, time.Now().UTC()); err != nil {
+		return models.AlertSilence{}, err
+	}
+	return s.repo.CreateAlertSilence(ctx, silence)
+}
+
+// CreateAlertSilenceAdmin mutes every rule matching the silence, which lets
+// operators quiet a host for maintenance.
+func (s *ResourceService) CreateAlertSilenceAdmin(ctx context.Context, adminUserID string, silence models.AlertSilence) (models.AlertSilence, error) {
+	silence.OwnerUserID = adminUserID
+	if err := normalizeAlertSilence(&silence, time.Now().UTC()); err != nil {
+		return models.AlertSilence{}, err
+	}
+	if silence.RuleID == "" && silence.ResourceType == "" && silence.ResourceID == "" {
+		return models.AlertSilence{}, errors.New("rule_id, resource_type or resource_id is required")
+	}
+	return s.repo.CreateAlertSilence(ctx, silence)
+}
+
+func (s *ResourceService) ListAlertSilences(ctx context.Context, userID string) ([]models.AlertSilence, error) {
+	return s.repo.ListAlertSilences(ctx, userID, time.Time{})
+}
+
+func (s *ResourceService) ListAlertSilencesAdmin(ctx context.Context) ([]models.AlertSilence, error) {
+	return s.repo.ListAlertSilences(ctx, "", time.Time{})
+}
+
+func (s *ResourceService) EndAlertSilence(ctx context.Context, userID string, silenceID string) (models.AlertSilence, error) {
+	silence, err := s.repo.GetAlertSilence(ctx, silenceID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.AlertSilence{}, errors.New("alert silence not found")
+		}
+		return models.AlertSilence{}, err
+	}
+	if silence.OwnerUserID != userID {
+		return models.AlertSilence{}, errors.New("forbidden: silence belongs to another user")
+	}
+	return s.repo.EndAlertSilence(ctx, silenceID, time.Now().UTC())
+}
+
+func (s *ResourceService) EndAlertSilenceAdmin(ctx context.Context, silenceID string) (models.AlertSilence, error) {
+	silence, err := s.repo.EndAlertSilence(ctx, silenceID, time.Now().UTC())
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AlertSilence{}, errors.New("alert silence not found")
+	}
+	return silence, err
+}
+
+func (s *ResourceService) ownedAlertRule(ctx context.Context, userID string, ruleID string) (models.AlertRule, error) {
+	rule, err := s.repo.GetAlertRule(ctx, ruleID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.AlertRule{}, errors.New("alert rule not found")
+		}
+		return models.AlertRule{}, err
+	}
+	if rule.OwnerUserID != userID {
+		return models.AlertRule{}, errors.New("forbidden: alert rule belongs to another user")
+	}
+	return rule, nil
+}
+
+func (s *ResourceService) normalizeAlertRule(rule *models.AlertRule) error {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" || len(rule.Name) > 120 {
+		return errors.New("name is required and must be at most 120 characters")
+	}
+	rule.ResourceType = strings.ToLower(strings.TrimSpace(rule.ResourceType))
+	rule.ResourceID = strings.TrimSpace(rule.ResourceID)
+	rule.MetricType = strings.TrimSpace(rule.MetricType)
+	rule.CheckType = strings.TrimSpace(rule.CheckType)
+	switch rule.Kind {
+	case models.AlertRuleMetric:
+		if rule.MetricType == "" {
+			return errors.New("metric_type is required for metric rules")
+		}
+		if alertComparators[rule.Comparator] == nil {
+			return errors.New("comparator must be one of >, >=, <, <=, ==, !=")
+		}
+		rule.CheckType, rule.HealthStatus = "", ""
+	case models.AlertRuleHealthCheck:
+		if rule.HealthStatus == "" {
+			rule.HealthStatus = models.HealthStatusCritical
+		}
+		if rule.HealthStatus != models.HealthStatusOK && rule.HealthStatus != models.HealthStatusWarning && rule.HealthStatus != models.HealthStatusCritical {
+			return errors.New("health_status must be ok, warning or critical")
+		}
+		rule.MetricType, rule.Comparator, rule.Threshold = "", "", 0
+	case models.AlertRuleHeartbeat:
+		if rule.ResourceType == "" {
+			rule.ResourceType = "host"
+		}
+		if rule.ResourceType != "host" {
+			return errors.New("heartbeat rules apply to hosts only")
+		}
+		if rule.ForSeconds == 0 {
+			rule.ForSeconds = defaultHeartbeatAlertSecs
+		}
+		rule.MetricType, rule.Comparator, rule.Threshold, rule.CheckType, rule.HealthStatus = "", "", 0, "", ""
+	default:
+		return errors.New("kind must be metric, health_check or heartbeat")
+	}
+	if rule.ForSeconds < 0 || rule.ForSeconds > maxAlertForSeconds {
+		return fmt.Errorf("for_seconds must be between 0 and %d", maxAlertForSeconds)
+	}
+	switch rule.Severity {
+	case "":
+		rule.Severity = "warning"
+	case "info", "warning", "critical":
+	default:
+		return errors.New("severity must be info, warning or critical")
+	}
+	if len(rule.Channels) > maxAlertRuleChannels {
+		return fmt.Errorf("at most %d channels are allowed", maxAlertRuleChannels)
+	}
+	for i := range rule.Channels {
+		channel := &rule.Channels[i]
+		channel.Target = strings.TrimSpace(channel.Target)
+		if s.alertNotifiers[channel.Type] == nil {
+			return fmt.Errorf("alert channel %q is not configured", channel.Type)
+		}
+		switch channel.Type {
+		case models.AlertChannelWebhook:
+			target, err := url.Parse(channel.Target)
+			if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+				return errors.New("webhook target must be an http or https url")
+			}
+		case models.AlertChannelEmail:
+			if _, err := mail.ParseAddress(channel.Target); err != nil {
+				return errors.New("email target must be an email address")
+			}
+		}
+	}
+	rule.Enabled = true
+	return nil
+}
+
+func normalizeAlertSilence(silence *models.AlertSilence, now time.Time) error {
+	silence.RuleID = strings.TrimSpace(silence.RuleID)
+	silence.ResourceType = strings.ToLower(strings.TrimSpace(silence.ResourceType))
+	silence.ResourceID = strings.TrimSpace(silence.ResourceID)
+	silence.Comment = strings.TrimSpace(silence.Comment)
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = now
+	}
+	if !silence.EndsAt.After(silence.StartsAt) || !silence.EndsAt.After(now) {
+		return errors.New("ends_at must be in the future and after starts_at")
+	}
+	if silence.EndsAt.Sub(silence.StartsAt) > maxAlertSilence {
+		return errors.New("silences can last at most 30 days")
+	}
+	return nil
+}
+
+// EvaluateAlerts runs every enabled rule once. A matching resource opens a
+// pending alert that fires after the rule's for_seconds; heartbeat rules fire
+// straight away since for_seconds is already their threshold. Alerts resolve
+// when the condition clears or the resource stops reporting. Only the firing
+// and resolved transitions are announced, once each, and not while a silence
+// matches; a firing alert is announced when its silence ends.
+func (s *ResourceService) EvaluateAlerts(ctx context.Context, now time.Time) error {
+	rules, err := s.repo.ListAlertRules(ctx, "", true)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	open, err := s.repo.ListOpenAlerts(ctx)
+	if err != nil {
+		return err
+	}
+	silences, err := s.repo.ListAlertSilences(ctx, "", now)
+	if err != nil {
+		return err
+	}
+	openByRule := make(map[string][]models.Alert)
+	for _, alert := range open {
+		openByRule[alert.RuleID] = append(openByRule[alert.RuleID], alert)
+	}
+	for _, rule := range rules {
+		subjects, err := s.alertSubjects(ctx, rule, now)
+		if err != nil {
+			log.Warn().Err(err).Str("rule_id", rule.ID).Msg("alert rule evaluation failed")
+			continue
+		}
+		s.evaluateAlertRule(ctx, rule, subjects, openByRule[rule.ID], silences, now)
+	}
+	return nil
+}
+
+func (s *ResourceService) evaluateAlertRule(ctx context.Context, rule models.AlertRule, subjects []alertSubject, open []models.Alert, silences []models.AlertSilence, now time.Time) {
+	hold := time.Duration(rule.ForSeconds) * time.Second
+	if rule.Kind == models.AlertRuleHeartbeat {
+		hold = 0
+	}
+	active := make(map[string]models.Alert, len(open))
+	for _, alert := range open {
+		if alert.State == models.AlertStateResolved {
+			s.notifyAlert(ctx, rule, alert, silences, now)
+			continue
+		}
+		active[alert.ResourceType+"/"+alert.ResourceID] = alert
+	}
+	for _, subject := range subjects {
+		if !subject.Matching {
+			continue
+		}
+		key := subject.ResourceType + "/" + subject.ResourceID
+		alert, exists := active[key]
+		delete(active, key)
+		var err error
+		if !exists {
+			alert = models.Alert{
+				RuleID:       rule.ID,
+				ResourceType: subject.ResourceType,
+				ResourceID:   subject.ResourceID,
+				State:        models.AlertStatePending,
+				Value:        subject.Value,
+				Summary:      subject.Summary,
+				StartedAt:    now,
+			}
+			if hold <= 0 {
+				alert.State = models.AlertStateFiring
+				alert.FiredAt = &now
+			}
+			alert, err = s.repo.CreateAlert(ctx, alert)
+			if errors.Is(err, pgx.ErrNoRows) {
+				continue
+			}
+		} else {
+			changed := alert.Value != subject.Value || alert.Summary != subject.Summary
+			alert.Value, alert.Summary = subject.Value, subject.Summary
+			if alert.State == models.AlertStatePending && now.Sub(alert.StartedAt) >= hold {
+				alert.State = models.AlertStateFiring
+				alert.FiredAt = &now
+				changed = true
+			}
+			if changed {
+				alert, err = s.repo.UpdateAlert(ctx, alert)
+			}
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("rule_id", rule.ID).Str("resource_id", subject.ResourceID).Msg("alert state update failed")
+			continue
+		}
+		s.notifyAlert(ctx, rule, alert, silences, now)
+	}
+	for _, alert := range active {
+		alert.State = models.AlertStateResolved
+		alert.ResolvedAt = &now
+		updated, err := s.repo.UpdateAlert(ctx, alert)
+		if err != nil {
+			log.Warn().Err(err).Str("alert_id", alert.ID).Msg("alert resolve failed")
+			continue
+		}
+		s.notifyAlert(ctx, rule, updated, silences, now)
+	}
+}
+
+func (s *ResourceService) alertSubjects(ctx context.Context, rule models.AlertRule, now time.Time) ([]alertSubject, error) {
+	out := make([]alertSubject, 0)
+	switch rule.Kind {
+	case models.AlertRuleMetric:
+		points, err := s.repo.LatestMetricPoints(ctx, models.MetricFilter{
+			ResourceType: rule.ResourceType,
+			ResourceID:   rule.ResourceID,
+			MetricType:   rule.MetricType,
+		}, now.Add(-alertMetricStaleAfter))
+		if err != nil {
+			return nil, err
+		}
+		compare := alertComparators[rule.Comparator]
+		for _, point := range points {
+			out = append(out, alertSubject{
+				ResourceType: point.ResourceType,
+				ResourceID:   point.ResourceID,
+				Value:        point.Value,
+				Matching:     compare(point.Value, rule.Threshold),
+				Summary:      fmt.Sprintf("%s is %g (%s %g)", rule.MetricType, point.Value, rule.Comparator, rule.Threshold),
+			})
+		}
+	case models.AlertRuleHealthCheck:
+		checks, err := s.repo.LatestHealthChecks(ctx, rule.ResourceType, rule.ResourceID, rule.CheckType, now.Add(-alertHealthCheckLookback))
+		if err != nil {
+			return nil, err
+		}
+		index := make(map[string]int)
+		for _, check := range checks {
+			key := check.ResourceType + "/" + check.ResourceID
+			i, ok := index[key]
+			if !ok {
+				i = len(out)
+				index[key] = i
+				out = append(out, alertSubject{ResourceType: check.ResourceType, ResourceID: check.ResourceID})
+			}
+			if check.Status == rule.HealthStatus && !out[i].Matching {
+				out[i].Matching = true
+				out[i].Value = 1
+				out[i].Summary = fmt.Sprintf("%s check is %s: %s", check.CheckType, check.Status, check.Details)
+			}
+		}
+	case models.AlertRuleHeartbeat:
+		hosts, err := s.repo.ListHostResources(ctx)
+		if err != nil {
+			return nil, err
+		}
+		threshold := time.Duration(rule.ForSeconds) * time.Second
+		for _, host := range hosts {
+			if rule.ResourceID != "" && host.ProviderID != rule.ResourceID {
+				continue
+			}
+			age := now.Sub(host.HeartbeatAt)
+			out = append(out, alertSubject{
+				ResourceType: "host",
+				ResourceID:   host.ProviderID,
+				Value:        age.Seconds(),
+				Matching:     age >= threshold,
+				Summary:      fmt.Sprintf("no heartbeat for %s", age.Truncate(time.Second)),
+			})
+		}
+	}
+	return out, nil
+}
+
+func alertSilenced(silences []models.AlertSilence, alert models.Alert, now time.Time) bool {
+	for _, silence := range silences {
+		if silence.StartsAt.After(now) || !silence.EndsAt.After(now) {
+			continue
+		}
+		if (silence.RuleID == "" || silence.RuleID == alert.RuleID) &&
+			(silence.ResourceType == "" || silence.ResourceType == alert.ResourceType) &&
+			(silence.ResourceID == "" || silence.ResourceID == alert.ResourceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyAlert announces a firing or resolved transition at most once. The
+// claim is rolled back when every channel fails so the next pass retries;
+// a partial failure is not retried to avoid repeating delivered messages.
+func (s *ResourceService) notifyAlert(ctx context.Context, rule models.AlertRule, alert models.Alert, silences []models.AlertSilence, now time.Time) {
+	var next models.AlertState
+	switch {
+	case alert.State == models.AlertStateFiring && alert.NotifiedState != models.AlertStateFiring:
+		next = models.AlertStateFiring
+	case alert.State == models.AlertStateResolved && alert.NotifiedState == models.AlertStateFiring:
+		next = models.AlertStateResolved
+	default:
+		return
+	}
+	silenced := alertSilenced(silences, alert, now)
+	if silenced && next == models.AlertStateFiring {
+		return
+	}
+	claimed, err := s.repo.ClaimAlertNotification(ctx, alert.ID, alert.NotifiedState, next)
+	if err != nil || !claimed {
+		if err != nil {
+			log.Warn().Err(err).Str("alert_id", alert.ID).Msg("alert notification claim failed")
+		}
+		return
+	}
+	if silenced || len(rule.Channels) == 0 {
+		return
+	}
+	notification := models.AlertNotification{
+		AlertID:      alert.ID,
+		RuleID:       rule.ID,
+		RuleName:     rule.Name,
+		Severity:     rule.Severity,
+		State:        next,
+		ResourceType: alert.ResourceType,
+		ResourceID:   alert.ResourceID,
+		Value:        alert.Value,
+		Summary:      alert.Summary,
+		StartedAt:    alert.StartedAt,
+		FiredAt:      alert.FiredAt,
+		ResolvedAt:   alert.ResolvedAt,
+	}
+	failed := 0
+	for _, channel := range rule.Channels {
+		notifier := s.alertNotifiers[channel.Type]
+		if notifier == nil {
+			failed++
+			log.Warn().Str("rule_id", rule.ID).Str("channel", string(channel.Type)).Msg("alert channel is not configured")
+			continue
+		}
+		if err := notifier.Notify(ctx, channel.Target, notification); err != nil {
+			failed++
+			log.Warn().Err(err).Str("rule_id", rule.ID).Str("alert_id", alert.ID).Str("channel", string(channel.Type)).Msg("alert notification failed")
+		}
+	}
+	if failed == len(rule.Channels) {
+		if _, err := s.repo.ClaimAlertNotification(ctx, alert.ID, next, alert.NotifiedState); err != nil {
+			log.Warn().Err(err).Str("alert_id", alert.ID).Msg("alert notification rollback failed")
+		}
+		return
+	}
+	log.Info().Str("rule_id", rule.ID).Str("alert_id", alert.ID).Str("state", string(next)).Msg("alert notification sent")
+}
@@ -0,0 +1,568 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/MidasWR/ShareMTC/services/sdk/filetransfer"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxFileTransferBytes  = 256 << 20
+	fileTransferRetention = 24 * time.Hour
+	fileWriteTimeout      = 2 * time.Minute
+	fileReadTimeout       = 30 * time.Minute
+	// fileChunkPage is how many stored chunks a checksum or content read
+	// loads at a time, so a large file is never held in memory whole.
+	fileChunkPage = 16
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// FileTransferRequest starts an upload to or a download from a sandbox
+// directory on a provider's host. Users name a local pod; admins may name a
+// provider instead to use the host sandbox.
+type FileTransferRequest struct {
+	ResourceID string
+	ProviderID string
+	Direction  models.FileTransferDirection
+	Path       string
+	Size       int64
+	SHA256     string
+}
+
+// StartFileTransfer starts a transfer to a local pod's sandbox. It needs the
+// same access as opening a terminal on the resource.
+func (s *ResourceService) StartFileTransfer(ctx context.Context, userID string, req FileTransferRequest) (models.FileTransfer, error) {
+	req.ResourceID = strings.TrimSpace(req.ResourceID)
+	if strings.TrimSpace(userID) == "" || req.ResourceID == "" {
+		return models.FileTransfer{}, errors.New("user_id and resource_id are required")
+	}
+	access, err := s.authorizeResourceAccess(ctx, userID, req.ResourceID, models.SharedAccessWrite)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	return s.startFileTransfer(ctx, userID, access, req)
+}
+
+// checkFileTransferResource refuses resources that cannot see the sandbox.
+// Only local pods get it, bind mounted at filetransfer.PodMountPath; VMs and
+// pods run elsewhere have nothing on the host to read or write.
+func (s *ResourceService) checkFileTransferResource(ctx context.Context, access resourceAccess, resourceID string) error {
+	if access.ResourceType != "pod" {
+		return errors.New("file transfers are only available for local pods")
+	}
+	pod, err := s.repo.GetPod(ctx, resourceID)
+	if err != nil {
+		return err
+	}
+	if pod.Backend != models.PodBackendLocal {
+		return errors.New("file transfers are only available for local pods")
+	}
+	return nil
+}
+
+// StartHostFileTransfer starts a transfer for an admin, either to a
+// resource's sandbox or to the host sandbox of a provider.
+func (s *ResourceService) StartHostFileTransfer(ctx context.Context, adminID string, req FileTransferRequest) (models.FileTransfer, error) {
+	req.ResourceID = strings.TrimSpace(req.ResourceID)
+	req.ProviderID = strings.TrimSpace(req.ProviderID)
+	if req.ResourceID != "" {
+		access, err := s.lookupResourceAccess(ctx, req.ResourceID)
+		if err != nil {
+			return models.FileTransfer{}, err
+		}
+		return s.startFileTransfer(ctx, adminID, access, req)
+	}
+	if req.ProviderID == "" {
+		return models.FileTransfer{}, errors.New("provider_id or resource_id is required")
+	}
+	return s.startFileTransfer(ctx, adminID, resourceAccess{ProviderID: req.ProviderID}, req)
+}
+
+func (s *ResourceService) startFileTransfer(ctx context.Context, requestedBy string, access resourceAccess, req FileTransferRequest) (models.FileTransfer, error) {
+	cleaned, err := filetransfer.CleanPath(req.Path)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	if req.ResourceID != "" {
+		if err := s.checkFileTransferResource(ctx, access, req.ResourceID); err != nil {
+			return models.FileTransfer{}, err
+		}
+	}
+	transfer := models.FileTransfer{
+		ID:          uuid.NewString(),
+		ProviderID:  access.ProviderID,
+		ResourceID:  req.ResourceID,
+		RequestedBy: requestedBy,
+		GrantID:     access.GrantID,
+		Direction:   req.Direction,
+		Path:        cleaned,
+		ExpiresAt:   time.Now().UTC().Add(fileTransferRetention),
+	}
+	switch req.Direction {
+	case models.FileTransferUpload:
+		if req.Size < 0 || req.Size > maxFileTransferBytes {
+			return models.FileTransfer{}, fmt.Errorf("size must be between 0 and %d bytes", maxFileTransferBytes)
+		}
+		transfer.SHA256 = strings.ToLower(strings.TrimSpace(req.SHA256))
+		if !sha256Pattern.MatchString(transfer.SHA256) {
+			return models.FileTransfer{}, errors.New("sha256 must be a hex encoded SHA-256 digest")
+		}
+		transfer.Size = req.Size
+		transfer.Status = models.FileTransferReceiving
+	case models.FileTransferDownload:
+		transfer.Status = models.FileTransferPulling
+		transfer.CommandID = uuid.NewString()
+	default:
+		return models.FileTransfer{}, errors.New("direction must be upload or download")
+	}
+	created, err := s.repo.CreateFileTransfer(ctx, transfer)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	event := "file_" + string(created.Direction) + "_requested"
+	s.auditFileTransfer(ctx, created, requestedBy, event, terminalAccessDetails(fmt.Sprintf("%s %s", created.Direction, created.Path), access))
+	if created.ResourceID != "" {
+		s.auditSharedAction(ctx, access, created.ResourceID, requestedBy, event)
+	}
+	log.Info().Str("transfer_id", created.ID).Str("provider_id", created.ProviderID).Str("resource_id", created.ResourceID).Str("requested_by", requestedBy).Str("direction", string(created.Direction)).Str("path", created.Path).Int64("size", created.Size).Msg("file transfer started")
+	switch {
+	case created.Direction == models.FileTransferDownload:
+		return s.pullFile(ctx, created)
+	case created.Size == 0:
+		return s.finishReceiving(ctx, created)
+	}
+	return created, nil
+}
+
+// fileTransferAccess returns a transfer to its requester, or to any admin.
+// Transfers through a share grant are re-checked so revoking the grant stops
+// them.
+func (s *ResourceService) fileTransferAccess(ctx context.Context, userID string, admin bool, transferID string) (models.FileTransfer, error) {
+	transfer, err := s.repo.GetFileTransfer(ctx, transferID)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	if admin {
+		return transfer, nil
+	}
+	if transfer.RequestedBy != userID || transfer.ResourceID == "" {
+		return models.FileTransfer{}, errors.New("forbidden: file transfer belongs to another user")
+	}
+	if transfer.GrantID != "" {
+		if _, err := s.authorizeResourceAccess(ctx, userID, transfer.ResourceID, models.SharedAccessWrite); err != nil {
+			return models.FileTransfer{}, err
+		}
+	}
+	return transfer, nil
+}
+
+func (s *ResourceService) GetFileTransfer(ctx context.Context, userID string, admin bool, transferID string) (models.FileTransfer, error) {
+	return s.fileTransferAccess(ctx, userID, admin, transferID)
+}
+
+// ListFileTransfers lists the caller's own transfers, or for admins all
+// transfers matching the filters.
+func (s *ResourceService) ListFileTransfers(ctx context.Context, userID string, admin bool, providerID string, resourceID string, limit int) ([]models.FileTransfer, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	requestedBy := userID
+	if admin {
+		requestedBy = ""
+	}
+	return s.repo.ListFileTransfers(ctx, providerID, resourceID, requestedBy, limit)
+}
+
+// WriteFileTransferChunk stores the next chunk of an upload. Chunks must
+// arrive in order; after an interruption the client continues from
+// StoredBytes. The last chunk starts the push to the host.
+func (s *ResourceService) WriteFileTransferChunk(ctx context.Context, userID string, admin bool, transferID string, offset int64, data []byte) (models.FileTransfer, error) {
+	transfer, err := s.fileTransferAccess(ctx, userID, admin, transferID)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	if transfer.Direction != models.FileTransferUpload || transfer.Status != models.FileTransferReceiving {
+		return models.FileTransfer{}, fmt.Errorf("file transfer is %s and does not accept data", transfer.Status)
+	}
+	if len(data) == 0 || len(data) > filetransfer.ChunkSize {
+		return models.FileTransfer{}, fmt.Errorf("chunks must be between 1 and %d bytes", filetransfer.ChunkSize)
+	}
+	if offset != transfer.StoredBytes {
+		return models.FileTransfer{}, fmt.Errorf("offset must be %d", transfer.StoredBytes)
+	}
+	if offset+int64(len(data)) > transfer.Size {
+		return models.FileTransfer{}, errors.New("chunk runs past the declared size")
+	}
+	updated, err := s.repo.AppendFileTransferChunk(ctx, transferID, offset, data, transfer.Size)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	if updated.StoredBytes < updated.Size {
+		return updated, nil
+	}
+	return s.finishReceiving(ctx, updated)
+}
+
+// finishReceiving checks a fully received upload against its checksum and
+// starts writing it to the host.
+func (s *ResourceService) finishReceiving(ctx context.Context, transfer models.FileTransfer) (models.FileTransfer, error) {
+	sum, err := s.storedFileChecksum(ctx, transfer.ID)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	if sum != transfer.SHA256 {
+		_ = s.repo.DeleteFileTransferChunks(ctx, transfer.ID)
+		return s.failFileTransfer(ctx, transfer, "checksum mismatch: uploaded data does not match sha256")
+	}
+	transfer.Status = models.FileTransferPushing
+	return s.pushFileChunk(ctx, transfer)
+}
+
+// pushFileChunk queues a file_write command for the chunk starting at
+// HostBytes. The final chunk carries the checksum for the agent to verify.
+func (s *ResourceService) pushFileChunk(ctx context.Context, transfer models.FileTransfer) (models.FileTransfer, error) {
+	var data []byte
+	if transfer.Size > 0 {
+		chunk, err := s.repo.GetFileTransferChunk(ctx, transfer.ID, transfer.HostBytes)
+		if err != nil {
+			return s.failFileTransfer(ctx, transfer, err.Error())
+		}
+		data = chunk
+	}
+	req := filetransfer.WriteRequest{
+		TransferID: transfer.ID,
+		ResourceID: transfer.ResourceID,
+		Path:       transfer.Path,
+		Offset:     transfer.HostBytes,
+		Data:       data,
+		Size:       transfer.Size,
+	}
+	if transfer.HostBytes+int64(len(data)) == transfer.Size {
+		req.SHA256 = transfer.SHA256
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	transfer.CommandID = uuid.NewString()
+	transfer.Detail = ""
+	updated, err := s.repo.UpdateFileTransfer(ctx, transfer)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	_, err = s.createAgentCommand(ctx, models.AgentCommand{
+		ID:             transfer.CommandID,
+		ProviderID:     transfer.ProviderID,
+		ResourceID:     transfer.ResourceID,
+		Command:        models.AgentCommandFileWrite,
+		Payload:        string(payload),
+		Status:         models.AgentCommandQueued,
+		RequestedBy:    transfer.RequestedBy,
+		TimeoutSeconds: int(fileWriteTimeout / time.Second),
+	})
+	if err != nil {
+		return s.failFileTransfer(ctx, updated, "command not queued: "+err.Error())
+	}
+	return updated, nil
+}
+
+// pullFile queues a file_read command from StoredBytes onwards.
+func (s *ResourceService) pullFile(ctx context.Context, transfer models.FileTransfer) (models.FileTransfer, error) {
+	payload, err := json.Marshal(filetransfer.ReadRequest{
+		TransferID: transfer.ID,
+		ResourceID: transfer.ResourceID,
+		Path:       transfer.Path,
+		Offset:     transfer.StoredBytes,
+		MaxBytes:   maxFileTransferBytes,
+	})
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	_, err = s.createAgentCommand(ctx, models.AgentCommand{
+		ID:             transfer.CommandID,
+		ProviderID:     transfer.ProviderID,
+		ResourceID:     transfer.ResourceID,
+		Command:        models.AgentCommandFileRead,
+		Payload:        string(payload),
+		Status:         models.AgentCommandQueued,
+		RequestedBy:    transfer.RequestedBy,
+		TimeoutSeconds: int(fileReadTimeout / time.Second),
+	})
+	if err != nil {
+		return s.failFileTransfer(ctx, transfer, "command not queued: "+err.Error())
+	}
+	return transfer, nil
+}
+
+// RecordFileChunk stores a chunk of a download streamed by the agent.
+func (s *ResourceService) RecordFileChunk(ctx context.Context, providerID string, transferID string, offset int64, data []byte) error {
+	transfer, err := s.repo.GetFileTransfer(ctx, transferID)
+	if err != nil {
+		return err
+	}
+	if transfer.ProviderID != providerID {
+		return errors.New("provider mismatch for file chunk")
+	}
+	if transfer.Direction != models.FileTransferDownload || transfer.Status != models.FileTransferPulling {
+		return errors.New("file transfer is not pulling data")
+	}
+	if len(data) == 0 || len(data) > filetransfer.ChunkSize {
+		return fmt.Errorf("chunks must be between 1 and %d bytes", filetransfer.ChunkSize)
+	}
+	_, err = s.repo.AppendFileTransferChunk(ctx, transferID, offset, data, maxFileTransferBytes)
+	return err
+}
+
+func (s *ResourceService) applyFileWriteResult(ctx context.Context, cmd models.AgentCommand, status models.AgentCommandState) {
+	var payload filetransfer.WriteRequest
+	if err := json.Unmarshal([]byte(cmd.Payload), &payload); err != nil {
+		return
+	}
+	transfer, err := s.repo.GetFileTransfer(ctx, payload.TransferID)
+	if err != nil || transfer.CommandID != cmd.ID || transfer.Status != models.FileTransferPushing {
+		return
+	}
+	var result filetransfer.WriteResult
+	parsed := json.Unmarshal([]byte(cmd.ResultMessage), &result) == nil
+	if parsed {
+		transfer.HostBytes = result.Written
+	}
+	switch {
+	case status == models.AgentCommandSucceeded && parsed && result.Complete:
+		transfer.Status = models.FileTransferCompleted
+		transfer.CompletedAt = time.Now().UTC()
+		transfer.Detail = ""
+		if _, err := s.repo.UpdateFileTransfer(ctx, transfer); err != nil {
+			log.Warn().Err(err).Str("transfer_id", transfer.ID).Msg("file transfer completion not recorded")
+			return
+		}
+		_ = s.repo.DeleteFileTransferChunks(ctx, transfer.ID)
+		s.auditFileTransfer(ctx, transfer, transfer.RequestedBy, "file_upload_completed", fmt.Sprintf("wrote %d bytes to %s", transfer.Size, transfer.Path))
+		log.Info().Str("transfer_id", transfer.ID).Str("provider_id", transfer.ProviderID).Int64("size", transfer.Size).Msg("file upload completed")
+	case status == models.AgentCommandSucceeded && parsed:
+		if _, err := s.pushFileChunk(ctx, transfer); err != nil {
+			log.Warn().Err(err).Str("transfer_id", transfer.ID).Msg("file transfer next chunk not queued")
+		}
+	default:
+		detail := cmd.ResultMessage
+		if parsed && result.Error != "" {
+			detail = result.Error
+		}
+		_, _ = s.failFileTransfer(ctx, transfer, detail)
+	}
+}
+
+func (s *ResourceService) applyFileReadResult(ctx context.Context, cmd models.AgentCommand, status models.AgentCommandState) {
+	var payload filetransfer.ReadRequest
+	if err := json.Unmarshal([]byte(cmd.Payload), &payload); err != nil {
+		return
+	}
+	transfer, err := s.repo.GetFileTransfer(ctx, payload.TransferID)
+	if err != nil || transfer.CommandID != cmd.ID || transfer.Status != models.FileTransferPulling {
+		return
+	}
+	var result filetransfer.ReadResult
+	if err := json.Unmarshal([]byte(cmd.ResultMessage), &result); err != nil || status != models.AgentCommandSucceeded {
+		detail := cmd.ResultMessage
+		if err == nil && result.Error != "" {
+			detail = result.Error
+		}
+		_, _ = s.failFileTransfer(ctx, transfer, detail)
+		return
+	}
+	transfer.Size = result.Size
+	transfer.SHA256 = result.SHA256
+	if transfer.StoredBytes != result.Size {
+		_, _ = s.failFileTransfer(ctx, transfer, fmt.Sprintf("received %d of %d bytes; resume to continue", transfer.StoredBytes, result.Size))
+		return
+	}
+	sum, err := s.storedFileChecksum(ctx, transfer.ID)
+	if err != nil {
+		_, _ = s.failFileTransfer(ctx, transfer, err.Error())
+		return
+	}
+	if sum != result.SHA256 {
+		_ = s.repo.DeleteFileTransferChunks(ctx, transfer.ID)
+		_, _ = s.failFileTransfer(ctx, transfer, "checksum mismatch: received data does not match the file on the host")
+		return
+	}
+	transfer.Status = models.FileTransferCompleted
+	transfer.CompletedAt = time.Now().UTC()
+	transfer.Detail = ""
+	if _, err := s.repo.UpdateFileTransfer(ctx, transfer); err != nil {
+		log.Warn().Err(err).Str("transfer_id", transfer.ID).Msg("file transfer completion not recorded")
+		return
+	}
+	s.auditFileTransfer(ctx, transfer, transfer.RequestedBy, "file_download_completed", fmt.Sprintf("read %d bytes from %s", transfer.Size, transfer.Path))
+	log.Info().Str("transfer_id", transfer.ID).Str("provider_id", transfer.ProviderID).Int64("size", transfer.Size).Msg("file download completed")
+}
+
+// ResumeFileTransfer continues a failed transfer from where it stopped: an
+// upload goes back to receiving if the service is missing data and to
+// pushing otherwise, a download pulls the rest of the file.
+func (s *ResourceService) ResumeFileTransfer(ctx context.Context, userID string, admin bool, transferID string) (models.FileTransfer, error) {
+	transfer, err := s.fileTransferAccess(ctx, userID, admin, transferID)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	if transfer.Status != models.FileTransferFailed {
+		return models.FileTransfer{}, fmt.Errorf("file transfer is %s and cannot be resumed", transfer.Status)
+	}
+	if !transfer.ExpiresAt.After(time.Now().UTC()) {
+		return models.FileTransfer{}, errors.New("file transfer has expired")
+	}
+	transfer.Detail = ""
+	if transfer.Direction == models.FileTransferDownload {
+		transfer.Status = models.FileTransferPulling
+		transfer.CommandID = uuid.NewString()
+		updated, err := s.repo.UpdateFileTransfer(ctx, transfer)
+		if err != nil {
+			return models.FileTransfer{}, err
+		}
+		return s.pullFile(ctx, updated)
+	}
+	if transfer.StoredBytes < transfer.Size {
+		transfer.Status = models.FileTransferReceiving
+		return s.repo.UpdateFileTransfer(ctx, transfer)
+	}
+	transfer.Status = models.FileTransferPushing
+	return s.pushFileChunk(ctx, transfer)
+}
+
+// CancelFileTransfer stops a transfer and drops the data the service holds.
+// A partial file already on the host stays there.
+func (s *ResourceService) CancelFileTransfer(ctx context.Context, userID string, admin bool, transferID string) (models.FileTransfer, error) {
+	transfer, err := s.fileTransferAccess(ctx, userID, admin, transferID)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	switch transfer.Status {
+	case models.FileTransferCompleted, models.FileTransferCancelled, models.FileTransferExpired:
+		return models.FileTransfer{}, fmt.Errorf("file transfer is already %s", transfer.Status)
+	}
+	transfer.Status = models.FileTransferCancelled
+	transfer.Detail = "cancelled by " + userID
+	updated, err := s.repo.UpdateFileTransfer(ctx, transfer)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	if cmd, err := s.repo.GetAgentCommand(ctx, transfer.CommandID); err == nil && (cmd.Status == models.AgentCommandQueued || cmd.Status == models.AgentCommandRunning) {
+		_, _ = s.cancelAgentCommand(ctx, cmd, userID, "file transfer cancelled")
+	}
+	_ = s.repo.DeleteFileTransferChunks(ctx, transfer.ID)
+	updated.StoredBytes = 0
+	s.auditFileTransfer(ctx, updated, userID, "file_transfer_cancelled", transfer.Detail)
+	return updated, nil
+}
+
+// ReadFileTransferContent returns up to limit chunks of a completed download
+// from offset onwards. The first chunk may start before offset; callers read
+// the rest of the file by asking again from the end of the last chunk.
+func (s *ResourceService) ReadFileTransferContent(ctx context.Context, userID string, admin bool, transferID string, offset int64, limit int) (models.FileTransfer, []models.FileTransferChunk, error) {
+	transfer, err := s.fileTransferAccess(ctx, userID, admin, transferID)
+	if err != nil {
+		return models.FileTransfer{}, nil, err
+	}
+	if transfer.Direction != models.FileTransferDownload || transfer.Status != models.FileTransferCompleted {
+		return models.FileTransfer{}, nil, errors.New("file transfer content not found")
+	}
+	if offset < 0 || (offset > 0 && offset >= transfer.Size) {
+		return models.FileTransfer{}, nil, errors.New("offset is outside the file")
+	}
+	if limit <= 0 || limit > fileChunkPage {
+		limit = fileChunkPage
+	}
+	chunks, err := s.repo.ListFileTransferChunks(ctx, transferID, offset, limit)
+	if err != nil {
+		return models.FileTransfer{}, nil, err
+	}
+	if offset == 0 {
+		s.auditFileTransfer(ctx, transfer, userID, "file_download_fetched", transfer.Path)
+	}
+	return transfer, chunks, nil
+}
+
+// ExpireFileTransfers drops the data of transfers past their retention and
+// ends the ones still in progress.
+func (s *ResourceService) ExpireFileTransfers(ctx context.Context, now time.Time) error {
+	expired, err := s.repo.ListExpiredFileTransfers(ctx, now, 100)
+	if err != nil {
+		return err
+	}
+	for _, transfer := range expired {
+		if err := s.repo.DeleteFileTransferChunks(ctx, transfer.ID); err != nil {
+			log.Warn().Err(err).Str("transfer_id", transfer.ID).Msg("file transfer data not deleted")
+			continue
+		}
+		switch transfer.Status {
+		case models.FileTransferFailed, models.FileTransferCancelled, models.FileTransferExpired:
+			continue
+		case models.FileTransferCompleted:
+			if transfer.Direction == models.FileTransferUpload {
+				continue
+			}
+		}
+		transfer.Status = models.FileTransferExpired
+		transfer.Detail = "retention period ended"
+		if _, err := s.repo.UpdateFileTransfer(ctx, transfer); err != nil {
+			log.Warn().Err(err).Str("transfer_id", transfer.ID).Msg("file transfer expiry not recorded")
+		}
+	}
+	return nil
+}
+
+func (s *ResourceService) failFileTransfer(ctx context.Context, transfer models.FileTransfer, detail string) (models.FileTransfer, error) {
+	transfer.Status = models.FileTransferFailed
+	transfer.Detail = detail
+	updated, err := s.repo.UpdateFileTransfer(ctx, transfer)
+	if err != nil {
+		return models.FileTransfer{}, err
+	}
+	s.auditFileTransfer(ctx, updated, updated.RequestedBy, "file_transfer_failed", detail)
+	log.Warn().Str("transfer_id", updated.ID).Str("provider_id", updated.ProviderID).Str("direction", string(updated.Direction)).Str("detail", detail).Msg("file transfer failed")
+	return updated, nil
+}
+
+// storedFileChecksum hashes the stored data a page of chunks at a time.
+func (s *ResourceService) storedFileChecksum(ctx context.Context, transferID string) (string, error) {
+	hash := sha256.New()
+	var offset int64
+	for {
+		chunks, err := s.repo.ListFileTransferChunks(ctx, transferID, offset, fileChunkPage)
+		if err != nil {
+			return "", err
+		}
+		for _, chunk := range chunks {
+			hash.Write(chunk.Data)
+			offset = chunk.Offset + int64(len(chunk.Data))
+		}
+		if len(chunks) < fileChunkPage {
+			return hex.EncodeToString(hash.Sum(nil)), nil
+		}
+	}
+}
+
+// auditFileTransfer records transfers next to terminal activity, keyed by
+// the transfer ID.
+func (s *ResourceService) auditFileTransfer(ctx context.Context, transfer models.FileTransfer, userID string, eventType string, details string) {
+	_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+		SessionID:  transfer.ID,
+		ProviderID: transfer.ProviderID,
+		UserID:     userID,
+		GrantID:    transfer.GrantID,
+		EventType:  eventType,
+		Details:    details,
+	})
+}
@@ -0,0 +1,328 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// HealthProber runs one probe against its resolved address and returns the
+// observed latency; a non-nil error marks the probe as failed.
+type HealthProber interface {
+	Probe(ctx context.Context, probe models.HealthProbe) (time.Duration, error)
+}
+
+const (
+	defaultProbeIntervalSecs     = 30
+	minProbeIntervalSecs         = 10
+	maxProbeIntervalSecs         = 3600
+	defaultProbeTimeoutSecs      = 5
+	maxProbeTimeoutSecs          = 60
+	defaultProbeFailureThreshold = 3
+	maxProbeFailureThreshold     = 20
+	maxProbesPerResource         = 10
+	defaultProbePort             = 22
+	healthProbeBatch             = 200
+	healthProbeSeedBatch         = 100
+	healthProbeConcurrency       = 16
+)
+
+type probeResult struct {
+	latency time.Duration
+	err     error
+}
+
+// CreateHealthProbe adds a probe to a VM or pod the user can write to.
+func (s *ResourceService) CreateHealthProbe(ctx context.Context, userID string, resourceID string, probe models.HealthProbe) (models.HealthProbe, error) {
+	access, err := s.authorizeResourceAccess(ctx, userID, resourceID, models.SharedAccessWrite)
+	if err != nil {
+		return models.HealthProbe{}, err
+	}
+	probe.ResourceType = access.ResourceType
+	probe.ResourceID = resourceID
+	if err := normalizeHealthProbe(&probe); err != nil {
+		return models.HealthProbe{}, err
+	}
+	existing, err := s.repo.ListHealthProbes(ctx, probe.ResourceType, resourceID)
+	if err != nil {
+		return models.HealthProbe{}, err
+	}
+	if len(existing) >= maxProbesPerResource {
+		return models.HealthProbe{}, fmt.Errorf("a resource can have at most %d probes", maxProbesPerResource)
+	}
+	probe.Enabled = true
+	probe.CreatedBy = userID
+	probe.NextRunAt = time.Now().UTC()
+	created, err := s.repo.CreateHealthProbe(ctx, probe)
+	if err != nil {
+		return models.HealthProbe{}, err
+	}
+	s.auditSharedAction(ctx, access, resourceID, userID, "health_probe_create")
+	return created, nil
+}
+
+func (s *ResourceService) ListHealthProbes(ctx context.Context, userID string, resourceID string) ([]models.HealthProbe, error) {
+	access, err := s.authorizeResourceAccess(ctx, userID, resourceID, models.SharedAccessRead)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.ListHealthProbes(ctx, access.ResourceType, resourceID)
+}
+
+func (s *ResourceService) DeleteHealthProbe(ctx context.Context, userID string, probeID string) error {
+	probe, err := s.repo.GetHealthProbe(ctx, probeID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errors.New("health probe not found")
+		}
+		return err
+	}
+	access, err := s.authorizeResourceAccess(ctx, userID, probe.ResourceID, models.SharedAccessWrite)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.DeleteHealthProbe(ctx, probeID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errors.New("health probe not found")
+		}
+		return err
+	}
+	s.auditSharedAction(ctx, access, probe.ResourceID, userID, "health_probe_delete")
+	return s.refreshResourceHealth(ctx, probe.ResourceType, probe.ResourceID)
+}
+
+func normalizeHealthProbe(probe *models.HealthProbe) error {
+	probe.Path = strings.TrimSpace(probe.Path)
+	switch probe.Kind {
+	case models.HealthProbeTCP:
+		if probe.Port == 0 {
+			return errors.New("port is required for tcp probes")
+		}
+	case models.HealthProbeHTTP:
+		if probe.Port == 0 {
+			probe.Port = 80
+		}
+		if probe.Path == "" {
+			probe.Path = "/"
+		}
+		if !strings.HasPrefix(probe.Path, "/") {
+			return errors.New("path must start with /")
+		}
+		if probe.ExpectedStatus != 0 && (probe.ExpectedStatus < 100 || probe.ExpectedStatus > 599) {
+			return errors.New("expected_status must be a valid HTTP status")
+		}
+	case models.HealthProbeReachability, models.HealthProbeSSH:
+		if probe.Port == 0 {
+			probe.Port = defaultProbePort
+		}
+	default:
+		return errors.New("kind must be tcp, http, reachability or ssh")
+	}
+	if probe.Kind != models.HealthProbeHTTP {
+		probe.Path = ""
+		probe.ExpectedStatus = 0
+	}
+	if probe.Port < 1 || probe.Port > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if probe.IntervalSeconds == 0 {
+		probe.IntervalSeconds = defaultProbeIntervalSecs
+	}
+	if probe.IntervalSeconds < minProbeIntervalSecs || probe.IntervalSeconds > maxProbeIntervalSecs {
+		return fmt.Errorf("interval_seconds must be between %d and %d", minProbeIntervalSecs, maxProbeIntervalSecs)
+	}
+	if probe.TimeoutSeconds == 0 {
+		probe.TimeoutSeconds = defaultProbeTimeoutSecs
+	}
+	if probe.TimeoutSeconds < 1 || probe.TimeoutSeconds > maxProbeTimeoutSecs {
+		return fmt.Errorf("timeout_seconds must be between 1 and %d", maxProbeTimeoutSecs)
+	}
+	if probe.TimeoutSeconds >= probe.IntervalSeconds {
+		return errors.New("timeout_seconds must be shorter than interval_seconds")
+	}
+	if probe.FailureThreshold == 0 {
+		probe.FailureThreshold = defaultProbeFailureThreshold
+	}
+	if probe.FailureThreshold < 1 || probe.FailureThreshold > maxProbeFailureThreshold {
+		return fmt.Errorf("failure_threshold must be between 1 and %d", maxProbeFailureThreshold)
+	}
+	return nil
+}
+
+// defaultHealthProbes is what every running resource gets without asking: VMs
+// are checked for reachability and an SSH banner, pods on each declared port.
+func defaultHealthProbes(resourceType string, ports []models.PodPort) []models.HealthProbe {
+	var out []models.HealthProbe
+	if resourceType == "vm" {
+		out = append(out,
+			models.HealthProbe{Kind: models.HealthProbeReachability},
+			models.HealthProbe{Kind: models.HealthProbeSSH},
+		)
+	}
+	for _, port := range ports {
+		if len(out) >= maxProbesPerResource {
+			break
+		}
+		kind := models.HealthProbeTCP
+		if port.Protocol == models.PodPortProtocolHTTP {
+			kind = models.HealthProbeHTTP
+		}
+		out = append(out, models.HealthProbe{Kind: kind, Port: port.Port})
+	}
+	if len(out) == 0 {
+		out = append(out, models.HealthProbe{Kind: models.HealthProbeReachability})
+	}
+	return out
+}
+
+// RunHealthProbes creates default probes for newly running resources, then
+// runs every due probe, records the results as health checks and updates the
+// health of the resources they belong to.
+func (s *ResourceService) RunHealthProbes(ctx context.Context, now time.Time) (int, error) {
+	if s.prober == nil {
+		return 0, nil
+	}
+	if err := s.seedHealthProbes(ctx, now); err != nil {
+		return 0, err
+	}
+	probes, err := s.repo.ClaimDueHealthProbes(ctx, now, healthProbeBatch)
+	if err != nil {
+		return 0, err
+	}
+	results := make([]probeResult, len(probes))
+	sem := make(chan struct{}, healthProbeConcurrency)
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, probe models.HealthProbe) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.runHealthProbe(ctx, probe)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	type resourceKey struct{ resourceType, resourceID string }
+	touched := make(map[resourceKey]struct{})
+	for i, probe := range probes {
+		result := results[i]
+		latencyMS := float64(result.latency.Microseconds()) / 1000
+		check := models.HealthCheck{
+			ResourceType: probe.ResourceType,
+			ResourceID:   probe.ResourceID,
+			CheckType:    "probe_" + string(probe.Kind),
+			Status:       models.HealthStatusOK,
+			Details:      fmt.Sprintf("%s probe on port %d succeeded", probe.Kind, probe.Port),
+			ProbeID:      probe.ID,
+			LatencyMS:    latencyMS,
+			CheckedAt:    now,
+		}
+		if result.err != nil {
+			check.Status = models.HealthStatusCritical
+			check.Details = fmt.Sprintf("%s probe on port %d failed: %v", probe.Kind, probe.Port, result.err)
+		}
+		if _, err := s.repo.CreateHealthCheck(ctx, check); err != nil {
+			log.Error().Err(err).Str("probe_id", probe.ID).Msg("health probe check record failed")
+			continue
+		}
+		if _, err := s.repo.RecordHealthProbeResult(ctx, probe.ID, check.Status, latencyMS, now); err != nil {
+			log.Error().Err(err).Str("probe_id", probe.ID).Msg("health probe result record failed")
+			continue
+		}
+		touched[resourceKey{probe.ResourceType, probe.ResourceID}] = struct{}{}
+	}
+	for key := range touched {
+		if err := s.refreshResourceHealth(ctx, key.resourceType, key.resourceID); err != nil {
+			log.Error().Err(err).Str("resource_id", key.resourceID).Msg("resource health update failed")
+		}
+	}
+	return len(probes), nil
+}
+
+func (s *ResourceService) runHealthProbe(ctx context.Context, probe models.HealthProbe) probeResult {
+	if probe.Address == "" {
+		return probeResult{err: errors.New("resource has no address")}
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, time.Duration(probe.TimeoutSeconds)*time.Second)
+	defer cancel()
+	latency, err := s.prober.Probe(probeCtx, probe)
+	return probeResult{latency: latency, err: err}
+}
+
+func (s *ResourceService) seedHealthProbes(ctx context.Context, now time.Time) error {
+	vms, err := s.repo.ListUnprobedVMs(ctx, healthProbeSeedBatch)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if err := s.seedResourceProbes(ctx, "vm", vm.ID, nil, now); err != nil {
+			return err
+		}
+	}
+	pods, err := s.repo.ListUnprobedPods(ctx, healthProbeSeedBatch)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if err := s.seedResourceProbes(ctx, "pod", pod.ID, pod.Ports, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ResourceService) seedResourceProbes(ctx context.Context, resourceType string, resourceID string, ports []models.PodPort, now time.Time) error {
+	for _, probe := range defaultHealthProbes(resourceType, ports) {
+		probe.ResourceType = resourceType
+		probe.ResourceID = resourceID
+		if err := normalizeHealthProbe(&probe); err != nil {
+			log.Warn().Err(err).Str("resource_id", resourceID).Int("port", probe.Port).Msg("skipping default health probe")
+			continue
+		}
+		probe.Enabled = true
+		probe.CreatedBy = "system"
+		probe.NextRunAt = now
+		if _, err := s.repo.CreateHealthProbe(ctx, probe); err != nil {
+			return err
+		}
+	}
+	return s.repo.MarkHealthProbesSeeded(ctx, resourceType, resourceID)
+}
+
+// refreshResourceHealth marks a resource degraded while any of its enabled
+// probes has failed failure_threshold times in a row, and healthy once all of
+// them pass again.
+func (s *ResourceService) refreshResourceHealth(ctx context.Context, resourceType string, resourceID string) error {
+	probes, err := s.repo.ListHealthProbes(ctx, resourceType, resourceID)
+	if err != nil {
+		return err
+	}
+	health := models.ResourceHealthUnknown
+	for _, probe := range probes {
+		if !probe.Enabled || probe.LastCheckedAt == nil {
+			continue
+		}
+		if probe.ConsecutiveFailures >= probe.FailureThreshold {
+			health = models.ResourceHealthDegraded
+			break
+		}
+		health = models.ResourceHealthHealthy
+	}
+	changed, err := s.repo.SetResourceHealth(ctx, resourceType, resourceID, health)
+	if err != nil {
+		return err
+	}
+	if changed {
+		log.Info().Str("resource_type", resourceType).Str("resource_id", resourceID).Str("health", string(health)).Msg("resource health changed")
+		s.publishResourceState(resourceType, resourceID, "", models.StreamState{Health: health})
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"sort"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/MidasWR/ShareMTC/services/sdk/capacity"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// heartbeatClockSkew bounds how far a signed heartbeat's heartbeat_at may be
+// from the server clock, which limits how long a captured one can be replayed.
+const heartbeatClockSkew = 2 * time.Minute
+
+const unsignedHeartbeatReason = "heartbeats are not signed"
+
+// VerificationPolicy controls capacity challenges. Each provider with a
+// fresh heartbeat is challenged on average every ChallengeInterval, at a
+// random time, with a buffer of up to MaxMemoryMB.
+type VerificationPolicy struct {
+	ChallengeInterval time.Duration
+	MaxMemoryMB       int
+	PassesToClear     int
+}
+
+func (p VerificationPolicy) withDefaults() VerificationPolicy {
+	if p.ChallengeInterval <= 0 {
+		p.ChallengeInterval = 6 * time.Hour
+	}
+	if p.MaxMemoryMB < capacity.MinMemoryMB || p.MaxMemoryMB > capacity.MaxMemoryMB {
+		p.MaxMemoryMB = 64
+	}
+	if p.PassesToClear <= 0 {
+		p.PassesToClear = 3
+	}
+	return p
+}
+
+// HeartbeatSignature is a host's ed25519 signature over the raw heartbeat
+// body. HostID is empty for callers that are not enrolled hosts.
+type HeartbeatSignature struct {
+	HostID    string
+	Body      []byte
+	Signature string
+}
+
+// RecordHeartbeat stores a heartbeat after checking its signature. Enrolled
+// hosts must sign, and once any host of a provider has registered a key, that
+// provider's heartbeats must be signed, fresh and newer than the last one
+// stored. Unsigned heartbeats, which only static tokens can send, leave the
+// provider unverified.
+func (s *ResourceService) RecordHeartbeat(ctx context.Context, resource models.HostResource, sig HeartbeatSignature) error {
+	signed, err := s.verifyHeartbeatSignature(ctx, resource, sig)
+	if err != nil {
+		log.Warn().Err(err).Str("provider_id", resource.ProviderID).Str("host_id", sig.HostID).Msg("heartbeat rejected")
+		return err
+	}
+	resource.Signed = signed
+	if !signed {
+		s.markUnsignedProvider(ctx, resource.ProviderID)
+	}
+	log.Debug().
+		Str("provider_id", resource.ProviderID).
+		Int("cpu_free_cores", resource.CPUFreeCores).
+		Int("ram_free_mb", resource.RAMFreeMB).
+		Int("gpu_free_units", resource.GPUFreeUnits).
+		Bool("signed", resource.Signed).
+		Msg("upserting host heartbeat")
+	return s.repo.UpsertHostResource(ctx, resource)
+}
+
+func (s *ResourceService) verifyHeartbeatSignature(ctx context.Context, resource models.HostResource, sig HeartbeatSignature) (bool, error) {
+	var publicKey string
+	if sig.HostID != "" {
+		host, err := s.repo.GetAgentHost(ctx, sig.HostID)
+		if err != nil {
+			return false, err
+		}
+		if host.PublicKey == "" {
+			return false, errors.New("heartbeat must be signed by the host key; rotate the agent credential to register one")
+		}
+		publicKey = host.PublicKey
+	}
+	if publicKey == "" {
+		keyed, err := s.providerHasSigningKey(ctx, resource.ProviderID)
+		if err != nil {
+			return false, err
+		}
+		if keyed {
+			return false, errors.New("heartbeat must be signed by the host key")
+		}
+		return false, nil
+	}
+	if sig.Signature == "" {
+		return false, errors.New("heartbeat must be signed by the host key")
+	}
+	key, err := decodePublicKey(publicKey)
+	if err != nil {
+		return false, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil || !ed25519.Verify(key, sig.Body, signature) {
+		return false, errors.New("heartbeat signature is invalid")
+	}
+	skew := time.Since(resource.HeartbeatAt)
+	if resource.HeartbeatAt.IsZero() || skew > heartbeatClockSkew || skew < -heartbeatClockSkew {
+		return false, errors.New("heartbeat_at is outside the allowed clock skew")
+	}
+	if last, err := s.repo.GetHostResource(ctx, resource.ProviderID); err == nil && last.Signed && !resource.HeartbeatAt.After(last.HeartbeatAt) {
+		return false, errors.New("heartbeat is not newer than the last one")
+	}
+	return true, nil
+}
+
+func (s *ResourceService) providerHasSigningKey(ctx context.Context, providerID string) (bool, error) {
+	return s.findAgentHost(ctx, providerID, func(host models.AgentHost) bool { return host.PublicKey != "" })
+}
+
+func (s *ResourceService) providerHasAgentHost(ctx context.Context, providerID string) (bool, error) {
+	return s.findAgentHost(ctx, providerID, func(models.AgentHost) bool { return true })
+}
+
+// findAgentHost reports whether any active host of the provider matches.
+func (s *ResourceService) findAgentHost(ctx context.Context, providerID string, match func(models.AgentHost) bool) (bool, error) {
+	hosts, err := s.repo.ListAgentHosts(ctx, providerID, 500)
+	if err != nil {
+		return false, err
+	}
+	for _, host := range hosts {
+		if host.Status == models.AgentHostActive && match(host) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// markUnsignedProvider drops a verified provider back to unverified, since
+// nothing ties its unsigned heartbeats to the host that passed the challenges.
+func (s *ResourceService) markUnsignedProvider(ctx context.Context, providerID string) {
+	item, err := s.repo.GetHostVerification(ctx, providerID)
+	if err != nil || item.Status != models.HostVerified {
+		return
+	}
+	item.Status = models.HostUnverified
+	item.Reason = unsignedHeartbeatReason
+	if _, err := s.repo.UpsertHostVerification(ctx, item); err != nil {
+		log.Warn().Err(err).Str("provider_id", providerID).Msg("host verification update failed")
+	}
+}
+
+func decodePublicKey(raw string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("public_key must be a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// IssueCapacityChallenge queues one challenge for a provider's agent.
+func (s *ResourceService) IssueCapacityChallenge(ctx context.Context, providerID string, kind models.CapacityChallengeKind, issuedBy string) (models.CapacityChallenge, error) {
+	if providerID == "" {
+		return models.CapacityChallenge{}, errors.New("provider_id is required")
+	}
+	if kind == "" {
+		kind = models.CapacityChallengeCPUMemory
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return models.CapacityChallenge{}, err
+	}
+	item := models.CapacityChallenge{
+		ID:         uuid.NewString(),
+		ProviderID: providerID,
+		Kind:       kind,
+		Nonce:      hex.EncodeToString(raw),
+		Status:     models.CapacityChallengePending,
+		IssuedBy:   issuedBy,
+	}
+	timeout := time.Minute
+	switch kind {
+	case models.CapacityChallengeCPUMemory:
+		item.MemoryMB = capacity.MinMemoryMB + mathrand.IntN(s.verification.MaxMemoryMB-capacity.MinMemoryMB+1)
+		item.Passes = 1
+		timeout = 2 * time.Minute
+	case models.CapacityChallengeGPUEnum:
+	default:
+		return models.CapacityChallenge{}, errors.New("unsupported challenge kind")
+	}
+	payload, err := json.Marshal(capacity.Challenge{ID: item.ID, Kind: string(kind), Nonce: item.Nonce, MemoryMB: item.MemoryMB, Passes: item.Passes})
+	if err != nil {
+		return models.CapacityChallenge{}, err
+	}
+	cmd, err := s.createAgentCommand(ctx, models.AgentCommand{
+		ProviderID:     providerID,
+		Command:        models.AgentCommandCapacityChallenge,
+		Payload:        string(payload),
+		Status:         models.AgentCommandQueued,
+		RequestedBy:    issuedBy,
+		TimeoutSeconds: int(timeout / time.Second),
+	})
+	if err != nil {
+		return models.CapacityChallenge{}, err
+	}
+	item.CommandID = cmd.ID
+	created, err := s.repo.CreateCapacityChallenge(ctx, item)
+	if err != nil {
+		return models.CapacityChallenge{}, err
+	}
+	verification, err := s.repo.GetHostVerification(ctx, providerID)
+	if err == nil {
+		verification.LastChallengeAt = created.IssuedAt
+		_, err = s.repo.UpsertHostVerification(ctx, verification)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("provider_id", providerID).Msg("host verification update failed")
+	}
+	log.Info().Str("provider_id", providerID).Str("challenge_id", created.ID).Str("kind", string(kind)).Msg("capacity challenge issued")
+	return created, nil
+}
+
+// IssueCapacityChallenges challenges providers with a fresh heartbeat whose
+// last challenge is older than a randomized share of the interval, so hosts
+// cannot predict when they will be checked.
+func (s *ResourceService) IssueCapacityChallenges(ctx context.Context, now time.Time) error {
+	hosts, err := s.repo.ListHostResources(ctx)
+	if err != nil {
+		return err
+	}
+	interval := s.verification.ChallengeInterval
+	for _, host := range hosts {
+		if host.HeartbeatAt.IsZero() || now.Sub(host.HeartbeatAt) > s.heartbeatMaxAge {
+			continue
+		}
+		verification, err := s.repo.GetHostVerification(ctx, host.ProviderID)
+		if err != nil {
+			return err
+		}
+		due := interval/2 + time.Duration(mathrand.Int64N(int64(interval)))
+		if !verification.LastChallengeAt.IsZero() && now.Sub(verification.LastChallengeAt) < due {
+			continue
+		}
+		kinds := []models.CapacityChallengeKind{models.CapacityChallengeCPUMemory}
+		if host.GPUTotalUnits > 0 || host.GPUFreeUnits > 0 {
+			kinds = append(kinds, models.CapacityChallengeGPUEnum)
+		}
+		for _, kind := range kinds {
+			if _, err := s.IssueCapacityChallenge(ctx, host.ProviderID, kind, "system"); err != nil {
+				log.Warn().Err(err).Str("provider_id", host.ProviderID).Str("kind", string(kind)).Msg("capacity challenge not issued")
+			}
+		}
+	}
+	return nil
+}
+
+func (s *ResourceService) applyCapacityChallengeResult(ctx context.Context, cmd models.AgentCommand, status models.AgentCommandState) {
+	var payload capacity.Challenge
+	if err := json.Unmarshal([]byte(cmd.Payload), &payload); err != nil {
+		return
+	}
+	item, err := s.repo.GetCapacityChallenge(ctx, payload.ID)
+	if err != nil || item.Status != models.CapacityChallengePending || item.ProviderID != cmd.ProviderID {
+		return
+	}
+	if status == models.AgentCommandCancelled {
+		_, _ = s.repo.CompleteCapacityChallenge(ctx, item.ID, models.CapacityChallengeFailed, "cancelled")
+		return
+	}
+	detail := ""
+	if status != models.AgentCommandSucceeded {
+		detail = fmt.Sprintf("challenge %s: %s", status, cmd.ResultMessage)
+	} else {
+		detail = s.judgeCapacityChallenge(ctx, item, cmd.ResultMessage)
+	}
+	verdict := models.CapacityChallengePassed
+	if detail != "" {
+		verdict = models.CapacityChallengeFailed
+	}
+	if _, err := s.repo.CompleteCapacityChallenge(ctx, item.ID, verdict, detail); err != nil {
+		return
+	}
+	s.recordVerification(ctx, item.ProviderID, detail)
+}
+
+// judgeCapacityChallenge checks an agent's answer and returns why it failed,
+// or "" if it passed.
+func (s *ResourceService) judgeCapacityChallenge(ctx context.Context, item models.CapacityChallenge, result string) string {
+	var resp capacity.Response
+	if err := json.Unmarshal([]byte(result), &resp); err != nil || resp.ChallengeID != item.ID {
+		return "malformed challenge response"
+	}
+	switch item.Kind {
+	case models.CapacityChallengeCPUMemory:
+		expected, err := capacity.Solve(item.Nonce, item.MemoryMB, item.Passes)
+		if err != nil {
+			return err.Error()
+		}
+		if resp.Digest != expected {
+			return fmt.Sprintf("wrong digest for %d MB workload", item.MemoryMB)
+		}
+		return ""
+	case models.CapacityChallengeGPUEnum:
+		return s.judgeGPUEnumeration(ctx, item.ProviderID, resp.GPUs)
+	}
+	return "unsupported challenge kind"
+}
+
+// judgeGPUEnumeration cross-checks enumerated devices with what the provider
+// claims in its heartbeats and with devices other providers reported.
+func (s *ResourceService) judgeGPUEnumeration(ctx context.Context, providerID string, gpus []capacity.GPUDevice) string {
+	host, err := s.repo.GetHostResource(ctx, providerID)
+	if err != nil {
+		return "no heartbeat to check against"
+	}
+	claimed := max(host.GPUTotalUnits, host.GPUFreeUnits)
+	if len(gpus) < claimed {
+		return fmt.Sprintf("claims %d GPUs but enumerated %d", claimed, len(gpus))
+	}
+	seen := make(map[string]bool, len(gpus))
+	uuids := make([]string, 0, len(gpus))
+	totalMB := 0
+	for _, gpu := range gpus {
+		if gpu.UUID == "" || seen[gpu.UUID] {
+			return "GPU devices must have distinct UUIDs"
+		}
+		seen[gpu.UUID] = true
+		uuids = append(uuids, gpu.UUID)
+		totalMB += gpu.MemoryMB
+	}
+	if host.GPUMemoryTotalMB > 0 && float64(totalMB) < 0.95*float64(host.GPUMemoryTotalMB) {
+		return fmt.Sprintf("claims %d MB of GPU memory but devices total %d MB", host.GPUMemoryTotalMB, totalMB)
+	}
+	if len(uuids) == 0 {
+		return ""
+	}
+	owners, err := s.repo.ListGPUDeviceOwners(ctx, uuids)
+	if err != nil {
+		return "GPU registry unavailable"
+	}
+	sort.Strings(uuids)
+	for _, id := range uuids {
+		if owner, ok := owners[id]; ok && owner != providerID {
+			return fmt.Sprintf("GPU %s is registered to another provider", id)
+		}
+	}
+	devices := make([]models.GPUDevice, 0, len(gpus))
+	for _, gpu := range gpus {
+		devices = append(devices, models.GPUDevice{UUID: gpu.UUID, ProviderID: providerID, Name: gpu.Name, MemoryMB: gpu.MemoryMB})
+	}
+	if err := s.repo.UpsertGPUDevices(ctx, devices); err != nil {
+		log.Warn().Err(err).Str("provider_id", providerID).Msg("gpu device registry update failed")
+	}
+	return ""
+}
+
+// recordVerification applies a challenge verdict: a failure flags the
+// provider and a flag clears after PassesToClear passes in a row. Passing
+// only verifies a provider whose heartbeats are signed.
+func (s *ResourceService) recordVerification(ctx context.Context, providerID string, failure string) {
+	item, err := s.repo.GetHostVerification(ctx, providerID)
+	if err != nil {
+		return
+	}
+	if failure == "" {
+		item.ConsecutivePasses++
+		if item.Status != models.HostFlagged || item.ConsecutivePasses >= s.verification.PassesToClear {
+			item.Status = models.HostVerified
+			item.Reason = ""
+			if host, err := s.repo.GetHostResource(ctx, providerID); err != nil || !host.Signed {
+				item.Status = models.HostUnverified
+				item.Reason = unsignedHeartbeatReason
+			}
+		}
+	} else {
+		item.Status = models.HostFlagged
+		item.Reason = failure
+		item.FailedChallenges++
+		item.ConsecutivePasses = 0
+		item.FlaggedAt = time.Now().UTC()
+		log.Warn().Str("provider_id", providerID).Str("reason", failure).Msg("host flagged by capacity challenge")
+	}
+	if _, err := s.repo.UpsertHostVerification(ctx, item); err != nil {
+		log.Warn().Err(err).Str("provider_id", providerID).Msg("host verification update failed")
+	}
+}
+
+func (s *ResourceService) GetHostVerification(ctx context.Context, providerID string) (models.HostVerification, error) {
+	return s.repo.GetHostVerification(ctx, providerID)
+}
+
+func (s *ResourceService) ListHostVerifications(ctx context.Context, status models.HostVerificationState) ([]models.HostVerification, error) {
+	return s.repo.ListHostVerifications(ctx, status)
+}
+
+func (s *ResourceService) ListCapacityChallenges(ctx context.Context, providerID string, limit int) ([]models.CapacityChallenge, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListCapacityChallenges(ctx, providerID, limit)
+}
+
+// withProviderVerification annotates offers with their provider's standing
+// and orders verified providers first and flagged ones last.
+func (s *ResourceService) withProviderVerification(ctx context.Context, offers []models.SharedInventoryOffer) ([]models.SharedInventoryOffer, error) {
+	if len(offers) == 0 {
+		return offers, nil
+	}
+	items, err := s.repo.ListHostVerifications(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]models.HostVerificationState, len(items))
+	for _, item := range items {
+		states[item.ProviderID] = item.Status
+	}
+	rank := map[models.HostVerificationState]int{models.HostVerified: 0, models.HostUnverified: 1, models.HostFlagged: 2}
+	for i := range offers {
+		offers[i].ProviderVerification = models.HostUnverified
+		if state, ok := states[offers[i].ProviderID]; ok {
+			offers[i].ProviderVerification = state
+		}
+	}
+	sort.SliceStable(offers, func(i, j int) bool {
+		return rank[offers[i].ProviderVerification] < rank[offers[j].ProviderVerification]
+	})
+	return offers, nil
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+func validateLocalPodSpec(pod models.Pod) error {
+	for _, item := range pod.Env {
+		if item.SecretRef != "" {
+			return errors.New("secret_ref env is not supported for local pods")
+		}
+	}
+	for _, item := range pod.VolumeMounts {
+		if item.NetworkVolumeID != "" {
+			return errors.New("network volumes are not supported for local pods")
+		}
+	}
+	if pod.RegistryAuthID != "" {
+		return errors.New("registry_auth_id is not supported for local pods")
+	}
+	return nil
+}
+
+// createLocalPod reserves capacity on the donor host and hands the container spec
+// to its hostagent. The pod stays provisioning until the agent confirms pod_start.
+func (s *ResourceService) createLocalPod(ctx context.Context, pod models.Pod) (models.Pod, error) {
+	if err := validateLocalPodSpec(pod); err != nil {
+		return models.Pod{}, err
+	}
+	alloc, err := s.Allocate(ctx, models.Allocation{
+		ProviderID: pod.ProviderID,
+		CPUCores:   pod.CPUCount,
+		RAMMB:      pod.MemoryGB * 1024,
+		GPUUnits:   pod.GPUCount,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("provider_id", pod.ProviderID).Msg("create local pod failed on allocation")
+		return models.Pod{}, err
+	}
+	pod.AllocationID = alloc.ID
+	created, err := s.repo.CreatePod(ctx, pod)
+	if err != nil {
+		log.Error().Err(err).Str("user_id", pod.UserID).Msg("create local pod failed on repository create")
+		_ = s.Release(ctx, alloc.ID)
+		return models.Pod{}, err
+	}
+	payload, err := json.Marshal(models.LocalPodSpec{
+		PodID:           created.ID,
+		AllocationID:    created.AllocationID,
+		ImageName:       created.ImageName,
+		Env:             created.Env,
+		Command:         created.Command,
+		Args:            created.Args,
+		Ports:           created.Ports,
+		CPUCount:        created.CPUCount,
+		MemoryGB:        created.MemoryGB,
+		GPUCount:        created.GPUCount,
+		ContainerDiskGB: created.ContainerDiskGB,
+		VolumeMounts:    created.VolumeMounts,
+	})
+	if err == nil {
+		_, err = s.createAgentCommand(ctx, models.AgentCommand{
+			ProviderID:  created.ProviderID,
+			ResourceID:  created.ID,
+			Command:     models.AgentCommandPodStart,
+			Payload:     string(payload),
+			Status:      models.AgentCommandQueued,
+			RequestedBy: created.UserID,
+		})
+	}
+	if err != nil {
+		log.Error().Err(err).Str("pod_id", created.ID).Msg("create local pod failed on queue pod_start")
+		_ = s.setPodStatus(ctx, created.ID, models.PodStatusTerminated)
+		s.releaseLocalPodAllocation(ctx, created)
+		return models.Pod{}, err
+	}
+	log.Info().Str("pod_id", created.ID).Str("provider_id", created.ProviderID).Str("allocation_id", created.AllocationID).Msg("local pod queued on donor host")
+	return s.repo.GetPod(ctx, created.ID)
+}
+
+func (s *ResourceService) stopLocalPod(ctx context.Context, pod models.Pod, requestedBy string) error {
+	_, err := s.createAgentCommand(ctx, models.AgentCommand{
+		ProviderID:  pod.ProviderID,
+		ResourceID:  pod.ID,
+		Command:     models.AgentCommandPodStop,
+		Status:      models.AgentCommandQueued,
+		RequestedBy: requestedBy,
+	})
+	return err
+}
+
+// applyLocalPodCommandResult moves a local pod through its lifecycle when the
+// donor host reports back on a pod command.
+func (s *ResourceService) applyLocalPodCommandResult(ctx context.Context, cmd models.AgentCommand, status models.AgentCommandState) {
+	pod, err := s.repo.GetPod(ctx, cmd.ResourceID)
+	if err != nil || pod.Backend != models.PodBackendLocal || pod.ProviderID != cmd.ProviderID {
+		return
+	}
+	switch cmd.Command {
+	case models.AgentCommandPodStart:
+		if pod.Status != models.PodStatusProvisioning {
+			return
+		}
+		if status == models.AgentCommandSucceeded {
+			s.recordLocalPodHostPorts(ctx, pod, cmd.ResultMessage)
+			_ = s.setPodStatus(ctx, pod.ID, models.PodStatusRunning)
+			return
+		}
+		log.Warn().Str("pod_id", pod.ID).Str("result_message", cmd.ResultMessage).Msg("local pod failed to start")
+		_ = s.setPodStatus(ctx, pod.ID, models.PodStatusTerminated)
+		if status != models.AgentCommandFailed && !cmd.AcknowledgedAt.IsZero() {
+			// The agent may still bring the container up; the allocation is
+			// released once it confirms the stop.
+			if err := s.stopLocalPod(ctx, pod, "system"); err == nil {
+				return
+			}
+		}
+		s.releaseLocalPodAllocation(ctx, pod)
+	case models.AgentCommandPodStop:
+		if status != models.AgentCommandSucceeded {
+			log.Warn().Str("pod_id", pod.ID).Str("result_message", cmd.ResultMessage).Msg("local pod stop failed, allocation kept")
+			return
+		}
+		s.releaseLocalPodAllocation(ctx, pod)
+	case models.AgentCommandPodStatus:
+		if status != models.AgentCommandFailed || pod.Status != models.PodStatusRunning {
+			return
+		}
+		log.Info().Str("pod_id", pod.ID).Str("result_message", cmd.ResultMessage).Msg("local pod container is no longer running")
+		_ = s.setPodStatus(ctx, pod.ID, models.PodStatusStopped)
+		if err := s.stopLocalPod(ctx, pod, "system"); err != nil {
+			log.Warn().Err(err).Str("pod_id", pod.ID).Msg("local pod cleanup could not be queued")
+		}
+	}
+}
+
+// recordLocalPodHostPorts stores the host ports the agent published the pod's
+// ports on, read from the "ports=8000:32768,22:32769" field of its result.
+func (s *ResourceService) recordLocalPodHostPorts(ctx context.Context, pod models.Pod, message string) {
+	published := parsePublishedPorts(message)
+	if len(published) == 0 {
+		return
+	}
+	changed := false
+	for i, item := range pod.Ports {
+		if host, ok := published[item.Port]; ok && host != item.HostPort {
+			pod.Ports[i].HostPort = host
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := s.repo.UpdatePodPorts(ctx, pod.ID, pod.Ports); err != nil {
+		log.Warn().Err(err).Str("pod_id", pod.ID).Msg("local pod host ports not recorded")
+	}
+}
+
+func parsePublishedPorts(message string) map[int]int {
+	for _, field := range strings.Fields(message) {
+		value, ok := strings.CutPrefix(field, "ports=")
+		if !ok {
+			continue
+		}
+		out := make(map[int]int)
+		for _, pair := range strings.Split(value, ",") {
+			container, host, ok := strings.Cut(pair, ":")
+			if !ok {
+				continue
+			}
+			containerPort, err := strconv.Atoi(container)
+			if err != nil {
+				continue
+			}
+			hostPort, err := strconv.Atoi(host)
+			if err != nil || hostPort < 1 || hostPort > 65535 {
+				continue
+			}
+			out[containerPort] = hostPort
+		}
+		return out
+	}
+	return nil
+}
+
+func (s *ResourceService) releaseLocalPodAllocation(ctx context.Context, pod models.Pod) {
+	if pod.AllocationID == "" {
+		return
+	}
+	allocations, err := s.repo.ListAllocations(ctx, pod.ProviderID)
+	if err == nil {
+		for _, item := range allocations {
+			if item.ID == pod.AllocationID && item.ReleasedAt != nil {
+				return
+			}
+		}
+	}
+	if err := s.Release(ctx, pod.AllocationID); err != nil {
+		log.Warn().Err(err).Str("pod_id", pod.ID).Str("allocation_id", pod.AllocationID).Msg("local pod allocation release failed")
+	}
+}
+
+// SyncLocalPods asks donor hosts for the state of every running local pod so
+// containers that exit on their own are noticed. At most one pod_status command
+// is outstanding per pod.
+func (s *ResourceService) SyncLocalPods(ctx context.Context) error {
+	pods, err := s.repo.ListRunningLocalPods(ctx)
+	if err != nil {
+		return err
+	}
+	open, err := s.repo.ListOpenAgentCommands(ctx, models.AgentCommandPodStatus)
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]bool, len(open))
+	for _, cmd := range open {
+		pending[cmd.ResourceID] = true
+	}
+	for _, pod := range pods {
+		if pending[pod.ID] {
+			continue
+		}
+		if _, err := s.createAgentCommand(ctx, models.AgentCommand{
+			ProviderID:  pod.ProviderID,
+			ResourceID:  pod.ID,
+			Command:     models.AgentCommandPodStatus,
+			Status:      models.AgentCommandQueued,
+			RequestedBy: "system",
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+)
+
+const (
+	maxMetricQuerySeries      = 20
+	maxMetricQueryBuckets     = 2000
+	maxMetricQuerySamples     = 200000
+	defaultMetricQueryBuckets = 240
+)
+
+var metricTierSteps = map[models.MetricResolution]time.Duration{
+	models.MetricResolutionRaw:    time.Second,
+	models.MetricResolutionMinute: time.Minute,
+	models.MetricResolutionHour:   time.Hour,
+}
+
+var metricQueryFunctions = map[string]bool{
+	"avg": true, "min": true, "max": true, "sum": true, "count": true, "last": true,
+	"rate": true, "delta": true, "p95": true, "p99": true,
+}
+
+// metricSample is one input to a bucket: a raw point, or a rollup bucket
+// carrying its own min/max/sum/count.
+type metricSample struct {
+	at     time.Time
+	lastAt time.Time
+	min    float64
+	max    float64
+	sum    float64
+	last   float64
+	avg    float64
+	count  int64
+}
+
+type metricQueryGroup struct {
+	labels map[string]string
+	// buckets holds samples per underlying resource so rate and delta can be
+	// taken per resource before they are summed into the group.
+	buckets map[string]map[int64][]metricSample
+}
+
+// QueryMetrics evaluates each series over step-aligned buckets between from
+// and to. The data tier is picked from the range like ListMetrics, and the
+// step is never finer than the tier. Series can be split per resource or per
+// provider; rate and delta are computed per resource and then summed.
+func (s *ResourceService) QueryMetrics(ctx context.Context, query models.MetricQuery) (models.MetricQueryResult, error) {
+	now := time.Now().UTC()
+	if query.To.IsZero() {
+		query.To = now
+	}
+	if query.From.IsZero() {
+		query.From = query.To.Add(-time.Hour)
+	}
+	if !query.From.Before(query.To) {
+		return models.MetricQueryResult{}, errors.New("from must be before to")
+	}
+	if len(query.Series) == 0 || len(query.Series) > maxMetricQuerySeries {
+		return models.MetricQueryResult{}, fmt.Errorf("between 1 and %d series are required", maxMetricQuerySeries)
+	}
+	tier, err := parseMetricResolution(string(query.Resolution))
+	if err != nil {
+		return models.MetricQueryResult{}, err
+	}
+	if tier == "" {
+		tier = s.metricRetention.metricTierFor(now, query.From, query.To)
+	}
+	span := query.To.Sub(query.From)
+	step := time.Duration(query.StepSeconds) * time.Second
+	if step <= 0 {
+		step = (span / defaultMetricQueryBuckets).Round(time.Second)
+	}
+	step = max(step, metricTierSteps[tier])
+	if span/step > maxMetricQueryBuckets {
+		return models.MetricQueryResult{}, fmt.Errorf("step is too small for the range, at most %d buckets are allowed", maxMetricQueryBuckets)
+	}
+	result := models.MetricQueryResult{
+		From:        query.From,
+		To:          query.To,
+		StepSeconds: int(step / time.Second),
+		Resolution:  tier,
+		Series:      make([]models.MetricQuerySeriesResult, 0, len(query.Series)),
+	}
+	for i, series := range query.Series {
+		out, err := s.evaluateMetricSeries(ctx, tier, series, query.From, query.To, step)
+		if err != nil {
+			return models.MetricQueryResult{}, fmt.Errorf("series %d: %w", i+1, err)
+		}
+		result.Series = append(result.Series, out...)
+	}
+	return result, nil
+}
+
+func (s *ResourceService) evaluateMetricSeries(ctx context.Context, tier models.MetricResolution, series models.MetricQuerySeries, from time.Time, to time.Time, step time.Duration) ([]models.MetricQuerySeriesResult, error) {
+	if strings.TrimSpace(series.MetricType) == "" {
+		return nil, errors.New("metric_type is required")
+	}
+	if !metricQueryFunctions[series.Function] {
+		return nil, errors.New("function must be one of avg, min, max, sum, count, last, rate, delta, p95, p99")
+	}
+	if series.GroupBy != "" && series.GroupBy != "resource" && series.GroupBy != "provider" {
+		return nil, errors.New("group_by must be resource or provider")
+	}
+	points, err := s.listMetricTier(ctx, tier, models.MetricFilter{
+		ResourceType: series.ResourceType,
+		ResourceID:   series.ResourceID,
+		MetricType:   series.MetricType,
+		ProviderID:   series.ProviderID,
+	}, from, to, maxMetricQuerySamples)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) >= maxMetricQuerySamples {
+		return nil, errors.New("query matched too many samples, narrow the range or filters")
+	}
+	origin := from.Truncate(step)
+	groups := map[string]*metricQueryGroup{}
+	for _, point := range points {
+		labels := metricGroupLabels(series.GroupBy, point)
+		key := metricLabelKey(labels)
+		group, ok := groups[key]
+		if !ok {
+			group = &metricQueryGroup{labels: labels, buckets: map[string]map[int64][]metricSample{}}
+			groups[key] = group
+		}
+		resourceKey := point.ResourceType + "/" + point.ResourceID
+		if group.buckets[resourceKey] == nil {
+			group.buckets[resourceKey] = map[int64][]metricSample{}
+		}
+		sample := metricSampleFrom(point)
+		bucket := int64(sample.at.Sub(origin) / step)
+		group.buckets[resourceKey][bucket] = append(group.buckets[resourceKey][bucket], sample)
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	name := series.Name
+	if name == "" {
+		name = series.MetricType
+	}
+	out := make([]models.MetricQuerySeriesResult, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		var values map[int64]float64
+		if series.Function == "rate" || series.Function == "delta" {
+			values = metricChange(group, series.Function == "rate")
+		} else {
+			values = metricReduce(group, series.Function)
+		}
+		out = append(out, models.MetricQuerySeriesResult{
+			Name:     name,
+			Function: series.Function,
+			Labels:   group.labels,
+			Points:   metricBucketPoints(values, origin, step),
+		})
+	}
+	return out, nil
+}
+
+func metricGroupLabels(groupBy string, point models.MetricPoint) map[string]string {
+	switch groupBy {
+	case "resource":
+		return map[string]string{"resource_type": point.ResourceType, "resource_id": point.ResourceID}
+	case "provider":
+		return map[string]string{"provider_id": point.ProviderID}
+	default:
+		return map[string]string{}
+	}
+}
+
+func metricLabelKey(labels map[string]string) string {
+	parts := make([]string, 0, len(labels))
+	for key, value := range labels {
+		parts = append(parts, key+"="+value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func metricSampleFrom(point models.MetricPoint) metricSample {
+	if point.Rollup == nil {
+		return metricSample{at: point.CapturedAt, lastAt: point.CapturedAt, min: point.Value, max: point.Value, sum: point.Value, last: point.Value, avg: point.Value, count: 1}
+	}
+	return metricSample{
+		at:     point.CapturedAt,
+		lastAt: point.Rollup.LastAt,
+		min:    point.Rollup.Min,
+		max:    point.Rollup.Max,
+		sum:    point.Value * float64(point.Rollup.Samples),
+		last:   point.Rollup.Last,
+		avg:    point.Value,
+		count:  point.Rollup.Samples,
+	}
+}
+
+// metricReduce pools every resource's samples per bucket. Percentiles use
+// nearest rank over the sample values; on rollup tiers those are bucket
+// averages, so p95/p99 there are approximations.
+func metricReduce(group *metricQueryGroup, function string) map[int64]float64 {
+	pooled := map[int64][]metricSample{}
+	for _, buckets := range group.buckets {
+		for bucket, samples := range buckets {
+			pooled[bucket] = append(pooled[bucket], samples...)
+		}
+	}
+	out := make(map[int64]float64, len(pooled))
+	for bucket, samples := range pooled {
+		switch function {
+		case "avg", "sum", "count":
+			var sum float64
+			var count int64
+			for _, sample := range samples {
+				sum += sample.sum
+				count += sample.count
+			}
+			switch {
+			case function == "sum":
+				out[bucket] = sum
+			case function == "count":
+				out[bucket] = float64(count)
+			case count > 0:
+				out[bucket] = sum / float64(count)
+			}
+		case "min":
+			value := math.Inf(1)
+			for _, sample := range samples {
+				value = math.Min(value, sample.min)
+			}
+			out[bucket] = value
+		case "max":
+			value := math.Inf(-1)
+			for _, sample := range samples {
+				value = math.Max(value, sample.max)
+			}
+			out[bucket] = value
+		case "last":
+			latest := samples[0]
+			for _, sample := range samples[1:] {
+				if sample.lastAt.After(latest.lastAt) {
+					latest = sample
+				}
+			}
+			out[bucket] = latest.last
+		case "p95", "p99":
+			values := make([]float64, 0, len(samples))
+			for _, sample := range samples {
+				values = append(values, sample.avg)
+			}
+			quantile := 0.95
+			if function == "p99" {
+				quantile = 0.99
+			}
+			out[bucket] = nearestRankPercentile(values, quantile)
+		}
+	}
+	return out
+}
+
+// metricChange takes each resource's change over every bucket, measured from
+// the last sample of its previous bucket (or the first sample of the bucket
+// when there is none), and sums resources into the group. Rate is that change
+// per second.
+func metricChange(group *metricQueryGroup, perSecond bool) map[int64]float64 {
+	out := map[int64]float64{}
+	for _, buckets := range group.buckets {
+		order := make([]int64, 0, len(buckets))
+		for bucket := range buckets {
+			order = append(order, bucket)
+		}
+		sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+		var prev *metricSample
+		for _, bucket := range order {
+			samples := buckets[bucket]
+			sort.Slice(samples, func(i, j int) bool { return samples[i].lastAt.Before(samples[j].lastAt) })
+			last := samples[len(samples)-1]
+			base := prev
+			prev = &last
+			if base == nil {
+				if len(samples) < 2 {
+					continue
+				}
+				base = &samples[0]
+			}
+			change := last.last - base.last
+			if perSecond {
+				elapsed := last.lastAt.Sub(base.lastAt).Seconds()
+				if elapsed <= 0 {
+					continue
+				}
+				change /= elapsed
+			}
+			out[bucket] += change
+		}
+	}
+	return out
+}
+
+func nearestRankPercentile(values []float64, quantile float64) float64 {
+	sort.Float64s(values)
+	rank := int(math.Ceil(quantile*float64(len(values)))) - 1
+	return values[max(0, min(rank, len(values)-1))]
+}
+
+func metricBucketPoints(values map[int64]float64, origin time.Time, step time.Duration) []models.MetricQueryValue {
+	order := make([]int64, 0, len(values))
+	for bucket := range values {
+		order = append(order, bucket)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	out := make([]models.MetricQueryValue, 0, len(order))
+	for _, bucket := range order {
+		out = append(out, models.MetricQueryValue{Timestamp: origin.Add(time.Duration(bucket) * step), Value: values[bucket]})
+	}
+	return out
+}
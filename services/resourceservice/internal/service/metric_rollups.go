@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// MetricRetention is how long each metric tier is kept. Zero fields fall back
+// to 24 hours of raw points, 7 days of minute rollups and 90 days of hour
+// rollups.
+type MetricRetention struct {
+	Raw    time.Duration
+	Minute time.Duration
+	Hour   time.Duration
+}
+
+func (r MetricRetention) withDefaults() MetricRetention {
+	if r.Raw <= 0 {
+		r.Raw = 24 * time.Hour
+	}
+	if r.Minute <= 0 {
+		r.Minute = 7 * 24 * time.Hour
+	}
+	if r.Hour <= 0 {
+		r.Hour = 90 * 24 * time.Hour
+	}
+	return r
+}
+
+const (
+	// metricRollupLag leaves room for samples that arrive late over Kafka
+	// before their minute is closed.
+	metricRollupLag          = 2 * time.Minute
+	metricPruneBatch         = 10000
+	maxRawQuerySpan          = 2 * time.Hour
+	maxMinuteRollupQuerySpan = 48 * time.Hour
+)
+
+// metricTierFor picks the finest tier that still holds data at from and keeps
+// the range to a chartable number of points. An open-ended query keeps the old
+// behaviour of returning the latest raw samples.
+func (r MetricRetention) metricTierFor(now time.Time, from time.Time, to time.Time) models.MetricResolution {
+	if from.IsZero() {
+		return models.MetricResolutionRaw
+	}
+	if to.IsZero() || to.After(now) {
+		to = now
+	}
+	span := to.Sub(from)
+	switch {
+	case !from.Before(now.Add(-r.Raw)) && span <= maxRawQuerySpan:
+		return models.MetricResolutionRaw
+	case !from.Before(now.Add(-r.Minute)) && span <= maxMinuteRollupQuerySpan:
+		return models.MetricResolutionMinute
+	default:
+		return models.MetricResolutionHour
+	}
+}
+
+func parseMetricResolution(raw string) (models.MetricResolution, error) {
+	switch models.MetricResolution(raw) {
+	case "":
+		return "", nil
+	case models.MetricResolutionRaw, models.MetricResolutionMinute, models.MetricResolutionHour:
+		return models.MetricResolution(raw), nil
+	default:
+		return "", errors.New("resolution must be raw, 1m or 1h")
+	}
+}
+
+// CompactMetrics rolls raw points into minute buckets and minute buckets into
+// hour buckets, then drops each tier past its retention. A tier is never
+// pruned past the watermark of the tier built from it, so a stalled rollup
+// cannot lose data.
+func (s *ResourceService) CompactMetrics(ctx context.Context, now time.Time) error {
+	minuteMark, err := s.rollupMetricTier(ctx, models.MetricResolutionMinute, time.Minute, now.Add(-metricRollupLag))
+	if err != nil {
+		return err
+	}
+	hourMark, err := s.rollupMetricTier(ctx, models.MetricResolutionHour, time.Hour, minuteMark)
+	if err != nil {
+		return err
+	}
+	rawCutoff := earlierOf(now.Add(-s.metricRetention.Raw), minuteMark)
+	deleted, err := s.repo.DeleteMetricPointsBefore(ctx, rawCutoff, metricPruneBatch)
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Info().Int64("deleted_count", deleted).Time("cutoff", rawCutoff).Msg("raw metric points pruned")
+	}
+	tiers := []struct {
+		resolution models.MetricResolution
+		cutoff     time.Time
+	}{
+		{models.MetricResolutionMinute, earlierOf(now.Add(-s.metricRetention.Minute), hourMark)},
+		{models.MetricResolutionHour, now.Add(-s.metricRetention.Hour)},
+	}
+	for _, tier := range tiers {
+		deleted, err := s.repo.DeleteMetricRollupsBefore(ctx, tier.resolution, tier.cutoff, metricPruneBatch)
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			log.Info().Int64("deleted_count", deleted).Str("resolution", string(tier.resolution)).Time("cutoff", tier.cutoff).Msg("metric rollups pruned")
+		}
+	}
+	return nil
+}
+
+// rollupMetricTier closes every whole bucket of resolution up to limit and
+// returns the new watermark. A zero result means nothing has been rolled yet.
+func (s *ResourceService) rollupMetricTier(ctx context.Context, resolution models.MetricResolution, step time.Duration, limit time.Time) (time.Time, error) {
+	watermark, err := s.repo.MetricRollupWatermark(ctx, resolution)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if limit.IsZero() {
+		return watermark, nil
+	}
+	to := limit.UTC().Truncate(step)
+	if !watermark.IsZero() && !to.After(watermark) {
+		return watermark, nil
+	}
+	rolled, err := s.repo.RollupMetrics(ctx, resolution, watermark, to)
+	if err != nil {
+		return watermark, err
+	}
+	log.Debug().Str("resolution", string(resolution)).Time("from", watermark).Time("to", to).Int64("bucket_count", rolled).Msg("metric rollup pass completed")
+	return to, nil
+}
+
+func earlierOf(a time.Time, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
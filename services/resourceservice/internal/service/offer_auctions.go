@@ -0,0 +1,389 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/billing"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultClearingPeriodMin = 60
+	maxClearingPeriodMin     = 24 * 60
+	maxBidDurationHours      = 24 * 30
+)
+
+func normalizeOfferPricing(item *models.SharedInventoryOffer, now time.Time) error {
+	if item.PricingMode == "" {
+		item.PricingMode = models.OfferPricingFixed
+	}
+	switch item.PricingMode {
+	case models.OfferPricingFixed:
+		item.AuctionRule = ""
+		item.ClearingPeriodMin = 0
+		item.NextClearingAt = nil
+		return nil
+	case models.OfferPricingAuction:
+	default:
+		return errors.New("pricing_mode must be fixed or auction")
+	}
+	if item.AuctionRule == "" {
+		item.AuctionRule = models.AuctionRuleUniform
+	}
+	if item.AuctionRule != models.AuctionRuleUniform && item.AuctionRule != models.AuctionRuleSecondPrice {
+		return errors.New("auction_rule must be uniform or second_price")
+	}
+	if item.ClearingPeriodMin == 0 {
+		item.ClearingPeriodMin = defaultClearingPeriodMin
+	}
+	if item.ClearingPeriodMin < 1 || item.ClearingPeriodMin > maxClearingPeriodMin {
+		return fmt.Errorf("clearing_period_minutes must be between 1 and %d", maxClearingPeriodMin)
+	}
+	if item.PriceHourly < 0 {
+		return errors.New("reserve price must not be negative")
+	}
+	next := now.Add(time.Duration(item.ClearingPeriodMin) * time.Minute)
+	item.NextClearingAt = &next
+	return nil
+}
+
+// PlaceOfferBid records a max-price bid on an auction offer. Bids wait for the
+// next clearing and keep competing each period until they expire or lose.
+func (s *ResourceService) PlaceOfferBid(ctx context.Context, userID string, offerID string, quantity int, maxPriceHourly float64, durationHours int) (models.OfferBid, error) {
+	if strings.TrimSpace(userID) == "" || strings.TrimSpace(offerID) == "" || quantity <= 0 {
+		return models.OfferBid{}, errors.New("offer_id and positive quantity are required")
+	}
+	if durationHours <= 0 || durationHours > maxBidDurationHours {
+		return models.OfferBid{}, fmt.Errorf("duration_hours must be between 1 and %d", maxBidDurationHours)
+	}
+	offer, err := s.repo.GetSharedInventoryOffer(ctx, offerID)
+	if err != nil {
+		return models.OfferBid{}, errors.New("offer not found")
+	}
+	if offer.PricingMode != models.OfferPricingAuction {
+		return models.OfferBid{}, errors.New("offer is fixed price, reserve it instead")
+	}
+	if offer.Status == models.SharedInventoryStatusPaused {
+		return models.OfferBid{}, errors.New("offer is not accepting bids")
+	}
+	if quantity > offer.Quantity {
+		return models.OfferBid{}, errors.New("quantity exceeds offer capacity")
+	}
+	if maxPriceHourly < offer.PriceHourly {
+		return models.OfferBid{}, fmt.Errorf("max_price_hourly_usd is below the reserve price %.4f", offer.PriceHourly)
+	}
+	bid, err := s.repo.CreateOfferBid(ctx, models.OfferBid{
+		OfferID:        offer.ID,
+		UserID:         userID,
+		ProviderID:     offer.ProviderID,
+		Quantity:       quantity,
+		MaxPriceHourly: maxPriceHourly,
+		DurationHours:  durationHours,
+		Status:         models.OfferBidOpen,
+		ExpiresAt:      time.Now().UTC().Add(time.Duration(durationHours) * time.Hour),
+	})
+	if err != nil {
+		return models.OfferBid{}, err
+	}
+	log.Info().Str("bid_id", bid.ID).Str("offer_id", offer.ID).Int("quantity", quantity).Float64("max_price_hourly_usd", maxPriceHourly).Msg("offer bid placed")
+	return bid, nil
+}
+
+func (s *ResourceService) ListOfferBids(ctx context.Context, userID string, offerID string, status string) ([]models.OfferBid, error) {
+	var statuses []models.OfferBidStatus
+	if status != "" {
+		statuses = []models.OfferBidStatus{models.OfferBidStatus(status)}
+	}
+	return s.repo.ListOfferBids(ctx, offerID, userID, statuses, 200)
+}
+
+func (s *ResourceService) ListAuctionClearings(ctx context.Context, offerID string) ([]models.AuctionClearing, error) {
+	offer, err := s.repo.GetSharedInventoryOffer(ctx, offerID)
+	if err != nil {
+		return nil, errors.New("offer not found")
+	}
+	if offer.PricingMode != models.OfferPricingAuction {
+		return nil, errors.New("offer is not auction priced")
+	}
+	return s.repo.ListAuctionClearings(ctx, offerID, 100)
+}
+
+// CancelOfferBid withdraws an open bid, or gives up a winning one straight
+// away: billing stops and the capacity goes back to the offer.
+func (s *ResourceService) CancelOfferBid(ctx context.Context, userID string, bidID string) (models.OfferBid, error) {
+	bid, err := s.repo.GetOfferBid(ctx, bidID)
+	if err != nil {
+		return models.OfferBid{}, errors.New("bid not found")
+	}
+	if bid.UserID != userID {
+		return models.OfferBid{}, errors.New("forbidden: bid belongs to another user")
+	}
+	if bid.Status != models.OfferBidOpen && bid.Status != models.OfferBidWinning {
+		return models.OfferBid{}, fmt.Errorf("bid is %s and cannot be cancelled", bid.Status)
+	}
+	return s.closeOfferBid(ctx, bid, models.OfferBidCancelled)
+}
+
+// ClearAuctions runs the clearing for every auction offer whose period has
+// ended. It is driven by the expiry worker. A paused offer is not cleared
+// again: its winners are let go when their period ends.
+func (s *ResourceService) ClearAuctions(ctx context.Context, now time.Time) error {
+	offers, err := s.repo.ListDueAuctionOffers(ctx, now, 50)
+	if err != nil {
+		return err
+	}
+	if len(offers) > 0 && s.billing == nil {
+		return errors.New("billing is not configured")
+	}
+	for _, offer := range offers {
+		if _, err := s.clearAuctionOffer(ctx, offer, now); err != nil {
+			log.Warn().Err(err).Str("offer_id", offer.ID).Msg("auction clearing failed")
+		}
+	}
+	return nil
+}
+
+func (s *ResourceService) clearAuctionOffer(ctx context.Context, offer models.SharedInventoryOffer, now time.Time) (models.AuctionClearing, error) {
+	period := time.Duration(offer.ClearingPeriodMin) * time.Minute
+	if period <= 0 {
+		period = defaultClearingPeriodMin * time.Minute
+	}
+	// Periods follow the offer's schedule rather than the worker's tick; if
+	// the worker fell behind by whole periods, those are skipped.
+	start := *offer.NextClearingAt
+	if missed := now.Sub(start) / period; missed > 0 {
+		start = start.Add(missed * period)
+	}
+	clearing := models.AuctionClearing{
+		ID:          uuid.NewString(),
+		OfferID:     offer.ID,
+		Rule:        offer.AuctionRule,
+		PeriodStart: start,
+		PeriodEnd:   start.Add(period),
+		OfferedQty:  offer.Quantity,
+		Awards:      []models.AuctionAward{},
+	}
+	claimed, err := s.repo.ClaimAuctionPeriod(ctx, offer.ID, *offer.NextClearingAt, clearing.PeriodEnd)
+	if err != nil {
+		return models.AuctionClearing{}, err
+	}
+	if !claimed {
+		return models.AuctionClearing{}, errors.New("clearing period already claimed")
+	}
+	if offer.Status == models.SharedInventoryStatusPaused {
+		log.Info().Str("offer_id", offer.ID).Msg("auction not cleared while the offer is paused")
+		return models.AuctionClearing{}, s.expireOfferBids(ctx, offer.ID, models.OfferBidOpen, models.OfferBidWinning)
+	}
+	bids, err := s.repo.ListOfferBids(ctx, offer.ID, "", []models.OfferBidStatus{models.OfferBidOpen, models.OfferBidWinning}, 1000)
+	if err != nil {
+		return models.AuctionClearing{}, err
+	}
+	live := make([]models.OfferBid, 0, len(bids))
+	for _, bid := range bids {
+		if !bid.ExpiresAt.After(now) {
+			_, _ = s.closeOfferBid(ctx, bid, models.OfferBidExpired)
+			continue
+		}
+		live = append(live, bid)
+	}
+	price, awards := clearAuction(offer.AuctionRule, offer.Quantity, offer.PriceHourly, live)
+	clearing.ClearingPriceUSD = price
+	clearing.BidCount = len(live)
+	awarded := make(map[string]int, len(awards))
+	for _, award := range awards {
+		awarded[award.BidID] = award.Quantity
+	}
+	// Outbid winners give their capacity back before the new awards are
+	// allocated, otherwise the host would briefly need room for both.
+	byID := make(map[string]models.OfferBid, len(live))
+	for _, bid := range live {
+		byID[bid.ID] = bid
+		if awarded[bid.ID] == 0 && bid.Status == models.OfferBidWinning {
+			_, _ = s.closeOfferBid(ctx, bid, models.OfferBidOutbid)
+		}
+	}
+	for _, award := range awards {
+		bid, err := s.awardOfferBid(ctx, offer, byID[award.BidID], award.Quantity, price, clearing.ID)
+		if err != nil {
+			log.Warn().Err(err).Str("offer_id", offer.ID).Str("bid_id", award.BidID).Msg("auction award could not be provisioned")
+			continue
+		}
+		clearing.AllocatedQty += bid.AllocatedQty
+		clearing.Awards = append(clearing.Awards, award)
+	}
+	clearing, err = s.repo.RecordAuctionClearing(ctx, clearing)
+	if err != nil {
+		return models.AuctionClearing{}, err
+	}
+	log.Info().Str("offer_id", offer.ID).Str("clearing_id", clearing.ID).Str("rule", string(clearing.Rule)).Float64("clearing_price_usd", price).Int("allocated_qty", clearing.AllocatedQty).Int("bid_count", clearing.BidCount).Msg("auction cleared")
+	return clearing, nil
+}
+
+// clearAuction ranks eligible bids by price, then age, and fills capacity from
+// the top; the marginal bid may be filled partially. Under the uniform rule all
+// winners pay the lowest accepted bid. Under the second-price rule they pay the
+// highest bid left unserved, or the reserve when all demand fits.
+func clearAuction(rule models.AuctionRule, capacity int, reserve float64, bids []models.OfferBid) (float64, []models.AuctionAward) {
+	ranked := make([]models.OfferBid, 0, len(bids))
+	for _, bid := range bids {
+		if bid.Quantity > 0 && bid.MaxPriceHourly >= reserve {
+			ranked = append(ranked, bid)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].MaxPriceHourly != ranked[j].MaxPriceHourly {
+			return ranked[i].MaxPriceHourly > ranked[j].MaxPriceHourly
+		}
+		if !ranked[i].CreatedAt.Equal(ranked[j].CreatedAt) {
+			return ranked[i].CreatedAt.Before(ranked[j].CreatedAt)
+		}
+		return ranked[i].ID < ranked[j].ID
+	})
+	remaining := capacity
+	awards := make([]models.AuctionAward, 0)
+	lowestAccepted := 0.0
+	highestUnserved := 0.0
+	unserved := false
+	for _, bid := range ranked {
+		take := min(bid.Quantity, remaining)
+		if take > 0 {
+			awards = append(awards, models.AuctionAward{BidID: bid.ID, UserID: bid.UserID, Quantity: take})
+			remaining -= take
+			lowestAccepted = bid.MaxPriceHourly
+		}
+		if take < bid.Quantity && !unserved {
+			highestUnserved = bid.MaxPriceHourly
+			unserved = true
+		}
+	}
+	if len(awards) == 0 {
+		return 0, awards
+	}
+	price := lowestAccepted
+	if rule == models.AuctionRuleSecondPrice {
+		price = reserve
+		if unserved {
+			price = highestUnserved
+		}
+	}
+	for i := range awards {
+		awards[i].PriceHourly = price
+	}
+	return price, awards
+}
+
+// awardOfferBid provisions a winning bid for the new period. A bid that keeps
+// the same quantity at the same price keeps its allocation and meter; anything
+// else is torn down and started again at the new terms.
+func (s *ResourceService) awardOfferBid(ctx context.Context, offer models.SharedInventoryOffer, bid models.OfferBid, quantity int, price float64, clearingID string) (models.OfferBid, error) {
+	if bid.Status == models.OfferBidWinning && bid.AllocatedQty == quantity && bid.ClearingPriceUSD == price {
+		return bid, nil
+	}
+	from := bid.Status
+	if bid.Status == models.OfferBidWinning {
+		s.releaseBidCapacity(ctx, bid)
+	}
+	alloc, err := s.Allocate(ctx, models.Allocation{
+		ProviderID: offer.ProviderID,
+		CPUCores:   offer.CPUCores * quantity,
+		RAMMB:      offer.RAMMB * quantity,
+		GPUUnits:   offer.GPUUnits * quantity,
+	})
+	if err != nil {
+		s.reopenOfferBid(ctx, bid, from)
+		return models.OfferBid{}, err
+	}
+	rental, err := s.billing.StartRental(ctx, billing.StartRentalRequest{
+		ReferenceID: bid.ID + "/" + clearingID,
+		UserID:      bid.UserID,
+		ProviderID:  offer.ProviderID,
+		Description: fmt.Sprintf("%dx %s (auction)", quantity, offer.Title),
+		PriceHourly: price * float64(quantity),
+	})
+	if err != nil {
+		s.releaseBidAllocation(ctx, bid.ID, alloc.ID)
+		s.reopenOfferBid(ctx, bid, from)
+		return models.OfferBid{}, errors.New("billing could not be started")
+	}
+	bid.Status = models.OfferBidWinning
+	bid.AllocatedQty = quantity
+	bid.ClearingPriceUSD = price
+	bid.AllocationID = alloc.ID
+	bid.BillingRentalID = rental.ID
+	updated, err := s.repo.UpdateOfferBid(ctx, bid, from)
+	if err != nil {
+		s.releaseBidCapacity(ctx, bid)
+		return models.OfferBid{}, err
+	}
+	return updated, nil
+}
+
+// expireOfferBids ends the offer's bids in the given statuses as expired.
+func (s *ResourceService) expireOfferBids(ctx context.Context, offerID string, statuses ...models.OfferBidStatus) error {
+	bids, err := s.repo.ListOfferBids(ctx, offerID, "", statuses, 1000)
+	if err != nil {
+		return err
+	}
+	for _, bid := range bids {
+		_, _ = s.closeOfferBid(ctx, bid, models.OfferBidExpired)
+	}
+	return nil
+}
+
+func (s *ResourceService) reopenOfferBid(ctx context.Context, bid models.OfferBid, from models.OfferBidStatus) {
+	bid.Status = models.OfferBidOpen
+	bid.AllocatedQty = 0
+	bid.ClearingPriceUSD = 0
+	bid.AllocationID = ""
+	bid.BillingRentalID = ""
+	if _, err := s.repo.UpdateOfferBid(ctx, bid, from); err != nil {
+		log.Warn().Err(err).Str("bid_id", bid.ID).Msg("offer bid could not be reopened")
+	}
+}
+
+// closeOfferBid ends a bid in status to. A winning bid stops billing, releases
+// its allocation and returns its quantity to the offer.
+func (s *ResourceService) closeOfferBid(ctx context.Context, bid models.OfferBid, to models.OfferBidStatus) (models.OfferBid, error) {
+	from := bid.Status
+	if from == models.OfferBidWinning {
+		s.releaseBidCapacity(ctx, bid)
+	}
+	bid.Status = to
+	closed, err := s.repo.UpdateOfferBid(ctx, bid, from)
+	if err != nil {
+		log.Warn().Err(err).Str("bid_id", bid.ID).Str("status", string(to)).Msg("offer bid close failed")
+		return models.OfferBid{}, err
+	}
+	if from == models.OfferBidWinning {
+		if err := s.repo.ReturnOfferQuantity(ctx, bid.OfferID, bid.AllocatedQty); err != nil {
+			log.Warn().Err(err).Str("bid_id", bid.ID).Msg("offer bid quantity return failed")
+		}
+	}
+	log.Info().Str("bid_id", bid.ID).Str("offer_id", bid.OfferID).Str("status", string(to)).Msg("offer bid closed")
+	return closed, nil
+}
+
+func (s *ResourceService) releaseBidCapacity(ctx context.Context, bid models.OfferBid) {
+	if bid.BillingRentalID != "" && s.billing != nil {
+		if _, err := s.billing.StopRental(ctx, bid.BillingRentalID); err != nil {
+			log.Error().Err(err).Str("bid_id", bid.ID).Str("rental_id", bid.BillingRentalID).Msg("bid billing stop failed")
+		}
+	}
+	s.releaseBidAllocation(ctx, bid.ID, bid.AllocationID)
+}
+
+func (s *ResourceService) releaseBidAllocation(ctx context.Context, bidID string, allocationID string) {
+	if allocationID == "" {
+		return
+	}
+	if err := s.Release(ctx, allocationID); err != nil {
+		log.Error().Err(err).Str("bid_id", bidID).Str("allocation_id", allocationID).Msg("bid allocation release failed")
+	}
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/billing"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+type BillingClient interface {
+	StartRental(ctx context.Context, req billing.StartRentalRequest) (billing.Rental, error)
+	StopRental(ctx context.Context, rentalID string) (billing.Rental, error)
+	StopRentalByReference(ctx context.Context, referenceID string) (billing.Rental, error)
+	RefundRental(ctx context.Context, rentalID string, amountUSD float64) (billing.Rental, error)
+	IssueCredit(ctx context.Context, req billing.CreditRequest) (billing.Credit, error)
+}
+
+// ReserveSharedInventoryOffer places a hold on quantity units of an offer. The
+// hold keeps the capacity out of the offer until it is confirmed, cancelled or
+// released by the expiry worker.
+func (s *ResourceService) ReserveSharedInventoryOffer(ctx context.Context, userID string, offerID string, quantity int) (models.OfferBooking, error) {
+	if strings.TrimSpace(userID) == "" || strings.TrimSpace(offerID) == "" || quantity <= 0 {
+		return models.OfferBooking{}, errors.New("offer_id and positive quantity are required")
+	}
+	if offer, err := s.repo.GetSharedInventoryOffer(ctx, offerID); err == nil && offer.PricingMode == models.OfferPricingAuction {
+		return models.OfferBooking{}, errors.New("offer is auction priced, place a bid instead")
+	}
+	booking, err := s.repo.CreateOfferBooking(ctx, models.OfferBooking{
+		OfferID:       offerID,
+		UserID:        userID,
+		Quantity:      quantity,
+		Status:        models.OfferBookingHeld,
+		HoldExpiresAt: time.Now().UTC().Add(s.offerHoldTTL),
+	})
+	if err != nil {
+		return models.OfferBooking{}, err
+	}
+	log.Info().Str("booking_id", booking.ID).Str("offer_id", offerID).Int("quantity", quantity).Time("hold_expires_at", booking.HoldExpiresAt).Msg("offer hold placed")
+	return booking, nil
+}
+
+func (s *ResourceService) ListOfferBookings(ctx context.Context, userID string, status string) ([]models.OfferBooking, error) {
+	return s.repo.ListOfferBookings(ctx, userID, status, 200)
+}
+
+func (s *ResourceService) ListOfferBookingsAdmin(ctx context.Context, status string) ([]models.OfferBooking, error) {
+	return s.repo.ListOfferBookings(ctx, "", status, 500)
+}
+
+func (s *ResourceService) ownOfferBooking(ctx context.Context, userID string, bookingID string) (models.OfferBooking, error) {
+	booking, err := s.repo.GetOfferBooking(ctx, bookingID)
+	if err != nil {
+		return models.OfferBooking{}, errors.New("booking not found")
+	}
+	if booking.UserID != userID {
+		return models.OfferBooking{}, errors.New("forbidden: booking belongs to another user")
+	}
+	return booking, nil
+}
+
+// ConfirmOfferBooking turns a live hold into compute: it allocates the booked
+// capacity on the donor host and starts an hourly meter in billingservice at
+// the offer price. The hold is claimed before either step, so a second confirm
+// of the same booking fails instead of sharing this one's rental. Either step
+// failing undoes the other; see abandonBookingConfirm for what happens to the
+// hold once billing was asked to start.
+func (s *ResourceService) ConfirmOfferBooking(ctx context.Context, userID string, bookingID string) (models.OfferBooking, error) {
+	booking, err := s.ownOfferBooking(ctx, userID, bookingID)
+	if err != nil {
+		return models.OfferBooking{}, err
+	}
+	if booking.Status != models.OfferBookingHeld {
+		return models.OfferBooking{}, fmt.Errorf("booking is %s, not held", booking.Status)
+	}
+	if !booking.HoldExpiresAt.After(time.Now().UTC()) {
+		return models.OfferBooking{}, errors.New("booking hold has expired")
+	}
+	if s.billing == nil {
+		return models.OfferBooking{}, errors.New("billing is not configured")
+	}
+	offer, err := s.repo.GetSharedInventoryOffer(ctx, booking.OfferID)
+	if err != nil {
+		return models.OfferBooking{}, errors.New("offer not found")
+	}
+	if booking, err = s.repo.ClaimOfferBooking(ctx, booking.ID, time.Now().UTC()); err != nil {
+		return models.OfferBooking{}, err
+	}
+	alloc, err := s.Allocate(ctx, models.Allocation{
+		ProviderID: booking.ProviderID,
+		CPUCores:   offer.CPUCores * booking.Quantity,
+		RAMMB:      offer.RAMMB * booking.Quantity,
+		GPUUnits:   offer.GPUUnits * booking.Quantity,
+	})
+	if err != nil {
+		s.unclaimOfferBooking(ctx, booking.ID)
+		return models.OfferBooking{}, err
+	}
+	rental, err := s.billing.StartRental(ctx, billing.StartRentalRequest{
+		ReferenceID: booking.ID,
+		UserID:      booking.UserID,
+		ProviderID:  booking.ProviderID,
+		Description: fmt.Sprintf("%dx %s", booking.Quantity, offer.Title),
+		PriceHourly: booking.PriceHourly * float64(booking.Quantity),
+	})
+	if err != nil {
+		log.Error().Err(err).Str("booking_id", booking.ID).Msg("confirm booking failed on billing start")
+		s.releaseBookingAllocation(ctx, booking.ID, alloc.ID)
+		s.abandonBookingConfirm(ctx, booking.ID)
+		return models.OfferBooking{}, errors.New("billing could not be started")
+	}
+	confirmed, err := s.repo.ConfirmOfferBooking(ctx, booking.ID, alloc.ID, rental.ID)
+	if err != nil {
+		s.releaseBookingAllocation(ctx, booking.ID, alloc.ID)
+		s.abandonBookingConfirm(ctx, booking.ID)
+		return models.OfferBooking{}, err
+	}
+	log.Info().Str("booking_id", booking.ID).Str("allocation_id", alloc.ID).Str("rental_id", rental.ID).Msg("offer booking confirmed")
+	return confirmed, nil
+}
+
+// CancelOfferBooking lets the renter drop a hold, or end a confirmed booking:
+// the booking closes first, returning the quantity to the offer, then billing
+// stops at the elapsed time and the allocation is released. What to undo is
+// decided by the status the booking was closed from, since a confirm may land
+// between the read and the close. Cancelling a cancelled booking again retries
+// a billing stop that failed.
+func (s *ResourceService) CancelOfferBooking(ctx context.Context, userID string, bookingID string) (models.OfferBooking, error) {
+	booking, err := s.ownOfferBooking(ctx, userID, bookingID)
+	if err != nil {
+		return models.OfferBooking{}, err
+	}
+	if booking.Status == models.OfferBookingCancelled {
+		return booking, s.stopCancelledBookingRental(ctx, booking)
+	}
+	if booking.Status == models.OfferBookingConfirmed && booking.BillingRentalID != "" && s.billing == nil {
+		return models.OfferBooking{}, errors.New("billing is not configured")
+	}
+	closed, prev, err := s.repo.CloseOfferBooking(ctx, booking.ID, []models.OfferBookingStatus{models.OfferBookingHeld, models.OfferBookingConfirmed}, models.OfferBookingCancelled)
+	if err != nil {
+		return models.OfferBooking{}, err
+	}
+	if prev != models.OfferBookingConfirmed {
+		return closed, nil
+	}
+	s.releaseBookingAllocation(ctx, closed.ID, closed.AllocationID)
+	return closed, s.stopCancelledBookingRental(ctx, closed)
+}
+
+func (s *ResourceService) stopCancelledBookingRental(ctx context.Context, booking models.OfferBooking) error {
+	if booking.BillingRentalID == "" {
+		return nil
+	}
+	if s.billing == nil {
+		return errors.New("billing is not configured")
+	}
+	if _, err := s.billing.StopRental(ctx, booking.BillingRentalID); err != nil {
+		log.Error().Err(err).Str("booking_id", booking.ID).Str("rental_id", booking.BillingRentalID).Msg("cancel booking failed on billing stop")
+		return errors.New("booking cancelled but billing could not be stopped; cancel again to retry")
+	}
+	return nil
+}
+
+// RefundOfferBooking is the operator path: it ends a confirmed booking like a
+// cancel and refunds amountUSD of the charge (zero refunds all of it). Already
+// cancelled bookings can be refunded without touching the offer again.
+func (s *ResourceService) RefundOfferBooking(ctx context.Context, bookingID string, amountUSD float64) (models.OfferBooking, error) {
+	booking, err := s.repo.GetOfferBooking(ctx, bookingID)
+	if err != nil {
+		return models.OfferBooking{}, errors.New("booking not found")
+	}
+	if booking.Status != models.OfferBookingConfirmed && booking.Status != models.OfferBookingCancelled {
+		return models.OfferBooking{}, fmt.Errorf("booking is %s and has nothing to refund", booking.Status)
+	}
+	if amountUSD < 0 {
+		return models.OfferBooking{}, errors.New("amount_usd must not be negative")
+	}
+	if booking.BillingRentalID != "" {
+		if s.billing == nil {
+			return models.OfferBooking{}, errors.New("billing is not configured")
+		}
+		if _, err := s.billing.RefundRental(ctx, booking.BillingRentalID, amountUSD); err != nil {
+			log.Error().Err(err).Str("booking_id", booking.ID).Msg("refund booking failed on billing refund")
+			return models.OfferBooking{}, errors.New("billing refund failed")
+		}
+	}
+	refunded, prev, err := s.repo.CloseOfferBooking(ctx, booking.ID, []models.OfferBookingStatus{models.OfferBookingConfirmed, models.OfferBookingCancelled}, models.OfferBookingRefunded)
+	if err != nil {
+		return models.OfferBooking{}, err
+	}
+	if prev == models.OfferBookingConfirmed {
+		s.releaseBookingAllocation(ctx, refunded.ID, refunded.AllocationID)
+	}
+	return refunded, nil
+}
+
+func (s *ResourceService) ExpireOfferHolds(ctx context.Context, now time.Time) error {
+	released, err := s.repo.ExpireOfferHolds(ctx, now, 200)
+	if err != nil {
+		return err
+	}
+	for _, item := range released {
+		log.Info().Str("booking_id", item.ID).Str("offer_id", item.OfferID).Int("quantity", item.Quantity).Msg("unconfirmed offer hold released")
+		// A confirm that lost the response of its billing start, or never
+		// finished, may have left a meter running for the booking.
+		if s.billing != nil {
+			if _, err := s.billing.StopRentalByReference(ctx, item.ID); err != nil {
+				log.Error().Err(err).Str("booking_id", item.ID).Msg("released hold billing stop failed")
+			}
+		}
+	}
+	return nil
+}
+
+func (s *ResourceService) releaseBookingAllocation(ctx context.Context, bookingID string, allocationID string) {
+	if allocationID == "" {
+		return
+	}
+	if err := s.Release(ctx, allocationID); err != nil {
+		log.Error().Err(err).Str("booking_id", bookingID).Str("allocation_id", allocationID).Msg("booking allocation release failed")
+	}
+}
+
+func (s *ResourceService) unclaimOfferBooking(ctx context.Context, bookingID string) {
+	if err := s.repo.UnclaimOfferBooking(ctx, bookingID); err != nil {
+		log.Error().Err(err).Str("booking_id", bookingID).Msg("booking claim release failed")
+	}
+}
+
+// abandonBookingConfirm undoes a claim once billing was asked to start a meter.
+// A start whose response was lost may still have opened one, so any rental for
+// the booking is stopped by reference. A booking that was never billed goes
+// back on hold; otherwise the hold is released, since confirming again would
+// get the stopped rental back. When the stop itself fails the booking stays
+// confirming and ExpireOfferHolds releases it and stops billing later.
+func (s *ResourceService) abandonBookingConfirm(ctx context.Context, bookingID string) {
+	rental, err := s.billing.StopRentalByReference(ctx, bookingID)
+	if err != nil {
+		log.Error().Err(err).Str("booking_id", bookingID).Msg("booking billing stop failed")
+		return
+	}
+	if rental.ID == "" {
+		s.unclaimOfferBooking(ctx, bookingID)
+		return
+	}
+	if _, _, err := s.repo.CloseOfferBooking(ctx, bookingID, []models.OfferBookingStatus{models.OfferBookingConfirming}, models.OfferBookingReleased); err != nil {
+		log.Error().Err(err).Str("booking_id", bookingID).Msg("booking hold release failed")
+	}
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+)
+
+const (
+	defaultPodContainerDiskGB = 20
+	maxPodContainerDiskGB     = 1000
+	maxPodVolumeGB            = 4000
+	maxPodEnvVars             = 64
+	maxPodPorts               = 16
+	maxPodCommandParts        = 64
+	maxPodCommandLength       = 4096
+)
+
+var (
+	podEnvKeyPattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	podSecretRefPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+	podRefIDPattern     = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+	// podImagePattern accepts the characters of an image reference,
+	// registry/name:tag@digest, and refuses a leading "-" so the image can
+	// never be read as a flag by the container engine.
+	podImagePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/:@-]{0,254}$`)
+)
+
+// normalizePodSpec validates the optional container spec of a pod and fills
+// defaults. The limits follow what RunPod accepts for podFindAndDeployOnDemand.
+func normalizePodSpec(pod models.Pod) (models.Pod, error) {
+	pod.ImageName = strings.TrimSpace(pod.ImageName)
+	if !podImagePattern.MatchString(pod.ImageName) {
+		return models.Pod{}, errors.New("image_name is not a valid image reference")
+	}
+
+	if len(pod.Env) > maxPodEnvVars {
+		return models.Pod{}, fmt.Errorf("env supports at most %d variables", maxPodEnvVars)
+	}
+	seenKeys := make(map[string]struct{}, len(pod.Env))
+	for i, item := range pod.Env {
+		item.Key = strings.TrimSpace(item.Key)
+		item.SecretRef = strings.TrimSpace(item.SecretRef)
+		if !podEnvKeyPattern.MatchString(item.Key) {
+			return models.Pod{}, fmt.Errorf("env key %q is invalid", item.Key)
+		}
+		if _, ok := seenKeys[item.Key]; ok {
+			return models.Pod{}, fmt.Errorf("env key %q is duplicated", item.Key)
+		}
+		seenKeys[item.Key] = struct{}{}
+		if item.SecretRef != "" {
+			if item.Value != "" {
+				return models.Pod{}, fmt.Errorf("env %s: value and secret_ref are mutually exclusive", item.Key)
+			}
+			if !podSecretRefPattern.MatchString(item.SecretRef) {
+				return models.Pod{}, fmt.Errorf("env %s: secret_ref is invalid", item.Key)
+			}
+		}
+		pod.Env[i] = item
+	}
+
+	if len(pod.Command)+len(pod.Args) > maxPodCommandParts {
+		return models.Pod{}, fmt.Errorf("command and args support at most %d parts", maxPodCommandParts)
+	}
+	if len(pod.Command) == 0 && len(pod.Args) > 0 {
+		return models.Pod{}, errors.New("args require command")
+	}
+	commandLength := 0
+	for _, part := range append(append([]string{}, pod.Command...), pod.Args...) {
+		if strings.ContainsRune(part, 0) {
+			return models.Pod{}, errors.New("command and args must not contain NUL bytes")
+		}
+		commandLength += len(part) + 1
+	}
+	if commandLength > maxPodCommandLength {
+		return models.Pod{}, fmt.Errorf("command and args must not exceed %d bytes", maxPodCommandLength)
+	}
+	if len(pod.Command) > 0 && strings.TrimSpace(pod.Command[0]) == "" {
+		return models.Pod{}, errors.New("command must start with an executable")
+	}
+
+	if len(pod.Ports) > maxPodPorts {
+		return models.Pod{}, fmt.Errorf("ports supports at most %d entries", maxPodPorts)
+	}
+	seenPorts := make(map[int]struct{}, len(pod.Ports))
+	for i, item := range pod.Ports {
+		if item.Port < 1 || item.Port > 65535 {
+			return models.Pod{}, fmt.Errorf("port %d is out of range", item.Port)
+		}
+		item.Protocol = models.PodPortProtocol(strings.ToLower(strings.TrimSpace(string(item.Protocol))))
+		if item.Protocol == "" {
+			item.Protocol = models.PodPortProtocolHTTP
+		}
+		if item.Protocol != models.PodPortProtocolHTTP && item.Protocol != models.PodPortProtocolTCP {
+			return models.Pod{}, fmt.Errorf("port %d: protocol must be http or tcp", item.Port)
+		}
+		if _, ok := seenPorts[item.Port]; ok {
+			return models.Pod{}, fmt.Errorf("port %d is duplicated", item.Port)
+		}
+		seenPorts[item.Port] = struct{}{}
+		item.HostPort = 0
+		pod.Ports[i] = item
+	}
+
+	if pod.ContainerDiskGB == 0 {
+		pod.ContainerDiskGB = defaultPodContainerDiskGB
+	}
+	if pod.ContainerDiskGB < 1 || pod.ContainerDiskGB > maxPodContainerDiskGB {
+		return models.Pod{}, fmt.Errorf("container_disk_gb must be between 1 and %d", maxPodContainerDiskGB)
+	}
+
+	// RunPod attaches a single volume per pod: either a pod volume or a network volume.
+	if len(pod.VolumeMounts) > 1 {
+		return models.Pod{}, errors.New("only one volume mount is supported")
+	}
+	for i, item := range pod.VolumeMounts {
+		item.MountPath = strings.TrimSpace(item.MountPath)
+		item.NetworkVolumeID = strings.TrimSpace(item.NetworkVolumeID)
+		if !strings.HasPrefix(item.MountPath, "/") || path.Clean(item.MountPath) != item.MountPath || item.MountPath == "/" {
+			return models.Pod{}, errors.New("volume mount_path must be a clean absolute path other than /")
+		}
+		if item.NetworkVolumeID != "" {
+			if !podRefIDPattern.MatchString(item.NetworkVolumeID) {
+				return models.Pod{}, errors.New("volume network_volume_id is invalid")
+			}
+			if item.SizeGB != 0 {
+				return models.Pod{}, errors.New("volume size_gb cannot be set for a network volume")
+			}
+		} else if item.SizeGB < 1 || item.SizeGB > maxPodVolumeGB {
+			return models.Pod{}, fmt.Errorf("volume size_gb must be between 1 and %d", maxPodVolumeGB)
+		}
+		pod.VolumeMounts[i] = item
+	}
+
+	pod.RegistryAuthID = strings.TrimSpace(pod.RegistryAuthID)
+	if pod.RegistryAuthID != "" && !podRefIDPattern.MatchString(pod.RegistryAuthID) {
+		return models.Pod{}, errors.New("registry_auth_id is invalid")
+	}
+	return pod, nil
+}
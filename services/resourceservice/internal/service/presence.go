@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// PresencePublisher pushes provider presence changes to adminservice.
+type PresencePublisher interface {
+	PublishPresence(ctx context.Context, presence models.ProviderPresence) error
+}
+
+const (
+	// presencePollMaxAge only applies to agents that have polled for commands
+	// at least once; hosts without a command channel are judged on heartbeats.
+	presencePollMaxAge   = time.Minute
+	presenceOfflineAfter = 5 * time.Minute
+	presencePublishBatch = 100
+)
+
+// derivePresence maps heartbeat and poll age to a presence state: online
+// while both are fresh, degraded while either still shows signs of life, and
+// offline once both are gone.
+func derivePresence(item models.ProviderPresence, now time.Time, heartbeatMaxAge time.Duration) (models.ProviderPresenceState, string) {
+	heartbeatAge := time.Duration(-1)
+	if item.HeartbeatAt != nil {
+		heartbeatAge = now.Sub(*item.HeartbeatAt)
+	}
+	polled := item.LastPollAt != nil
+	pollFresh := polled && now.Sub(*item.LastPollAt) <= presencePollMaxAge
+	switch {
+	case heartbeatAge >= 0 && heartbeatAge <= heartbeatMaxAge:
+		if polled && !pollFresh {
+			return models.ProviderDegraded, "agent stopped polling for commands"
+		}
+		return models.ProviderOnline, "heartbeat fresh"
+	case heartbeatAge >= 0 && heartbeatAge <= presenceOfflineAfter:
+		return models.ProviderDegraded, "heartbeat stale"
+	case pollFresh:
+		return models.ProviderDegraded, "agent polling without heartbeats"
+	case heartbeatAge < 0:
+		return models.ProviderOffline, "no heartbeat received"
+	default:
+		return models.ProviderOffline, "heartbeat lost"
+	}
+}
+
+// EvaluatePresence records state changes for every known provider and pushes
+// the changes adminservice has not acknowledged yet.
+func (s *ResourceService) EvaluatePresence(ctx context.Context, now time.Time) error {
+	inputs, err := s.repo.ListPresenceInputs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range inputs {
+		state, reason := derivePresence(item, now, s.heartbeatMaxAge)
+		if state == item.State {
+			continue
+		}
+		from := item.State
+		item.State = state
+		item.Reason = reason
+		item.ChangedAt = now
+		changed, err := s.repo.RecordPresenceChange(ctx, item, from)
+		if err != nil {
+			log.Error().Err(err).Str("provider_id", item.ProviderID).Msg("provider presence change record failed")
+			continue
+		}
+		if changed {
+			log.Info().Str("provider_id", item.ProviderID).Str("from", string(from)).Str("to", string(state)).Str("reason", reason).Msg("provider presence changed")
+		}
+	}
+	return s.publishPresence(ctx)
+}
+
+func (s *ResourceService) publishPresence(ctx context.Context) error {
+	if s.presence == nil {
+		return nil
+	}
+	pending, err := s.repo.ListProviderPresence(ctx, "", "", true, presencePublishBatch)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for _, item := range pending {
+		if err := s.presence.PublishPresence(ctx, item); err != nil {
+			log.Warn().Err(err).Str("provider_id", item.ProviderID).Msg("provider presence push failed; retrying next pass")
+			failed = err
+			continue
+		}
+		if err := s.repo.MarkPresenceSynced(ctx, item.ProviderID, item.ChangedAt); err != nil {
+			return err
+		}
+	}
+	return failed
+}
+
+func (s *ResourceService) touchAgentPoll(ctx context.Context, providerID string) {
+	if err := s.repo.TouchAgentPoll(ctx, providerID, time.Now().UTC()); err != nil {
+		log.Warn().Err(err).Str("provider_id", providerID).Msg("agent poll presence update failed")
+	}
+}
+
+func (s *ResourceService) ListProviderPresence(ctx context.Context, state string) ([]models.ProviderPresence, error) {
+	switch models.ProviderPresenceState(state) {
+	case "", models.ProviderOnline, models.ProviderDegraded, models.ProviderOffline:
+	default:
+		return nil, errors.New("state must be online, degraded or offline")
+	}
+	return s.repo.ListProviderPresence(ctx, "", state, false, 1000)
+}
+
+func (s *ResourceService) ListProviderPresenceEvents(ctx context.Context, providerID string, limit int) ([]models.ProviderPresenceEvent, error) {
+	if providerID == "" {
+		return nil, errors.New("provider_id is required")
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListPresenceEvents(ctx, providerID, limit)
+}
+
+// withProviderPresence labels catalog offers with the presence of the donor
+// behind them; providers that were never seen count as offline.
+func (s *ResourceService) withProviderPresence(ctx context.Context, offers []models.SharedInventoryOffer) ([]models.SharedInventoryOffer, error) {
+	if len(offers) == 0 {
+		return offers, nil
+	}
+	items, err := s.repo.ListProviderPresence(ctx, "", "", false, 10000)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]models.ProviderPresenceState, len(items))
+	for _, item := range items {
+		states[item.ProviderID] = item.State
+	}
+	for i := range offers {
+		offers[i].ProviderPresence = models.ProviderOffline
+		if state, ok := states[offers[i].ProviderID]; ok {
+			offers[i].ProviderPresence = state
+		}
+	}
+	return offers, nil
+}
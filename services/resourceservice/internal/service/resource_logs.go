@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxResourceLogBatch   = 500
+	maxResourceLogMessage = 16 * 1024
+	maxResourceLogFollow  = 30 * time.Second
+)
+
+var resourceLogPollInterval = 500 * time.Millisecond
+
+func normalizeResourceLogLevel(raw string) (models.ResourceLogLevel, bool) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", "info", "notice":
+		return models.ResourceLogInfo, true
+	case "debug", "trace":
+		return models.ResourceLogDebug, true
+	case "warn", "warning":
+		return models.ResourceLogWarning, true
+	case "error", "err", "fatal", "critical", "crit":
+		return models.ResourceLogError, true
+	default:
+		return "", false
+	}
+}
+
+// RecordResourceLogs stores a batch of log lines shipped by a donor host or
+// vmdaemon. Every line must belong to a resource placed on that provider, or to
+// the provider itself for host level sources.
+func (s *ResourceService) RecordResourceLogs(ctx context.Context, providerID string, items []models.ResourceLog) ([]models.ResourceLog, error) {
+	providerID = strings.TrimSpace(providerID)
+	if providerID == "" {
+		return nil, errors.New("provider_id is required")
+	}
+	if len(items) == 0 {
+		return []models.ResourceLog{}, nil
+	}
+	if len(items) > maxResourceLogBatch {
+		return nil, errors.New("too many log entries in one batch")
+	}
+	resourceTypes := make(map[string]string)
+	for i := range items {
+		item := &items[i]
+		item.ProviderID = providerID
+		item.ResourceID = strings.TrimSpace(item.ResourceID)
+		if item.ResourceID == "" {
+			return nil, errors.New("resource_id is required")
+		}
+		if strings.TrimSpace(item.Message) == "" {
+			return nil, errors.New("message is required")
+		}
+		if len(item.Message) > maxResourceLogMessage {
+			item.Message = item.Message[:maxResourceLogMessage]
+		}
+		level, ok := normalizeResourceLogLevel(string(item.Level))
+		if !ok {
+			return nil, errors.New("level must be debug, info, warning or error")
+		}
+		item.Level = level
+		resourceType, ok := resourceTypes[item.ResourceID]
+		if !ok {
+			var err error
+			resourceType, err = s.resourceLogOwner(ctx, providerID, item.ResourceID)
+			if err != nil {
+				return nil, err
+			}
+			resourceTypes[item.ResourceID] = resourceType
+		}
+		item.ResourceType = resourceType
+		if item.OccurredAt.IsZero() {
+			item.OccurredAt = time.Now().UTC()
+		}
+	}
+	return s.repo.CreateResourceLogs(ctx, items)
+}
+
+func (s *ResourceService) resourceLogOwner(ctx context.Context, providerID string, resourceID string) (string, error) {
+	if resourceID == providerID {
+		return "host", nil
+	}
+	if vm, err := s.repo.GetVM(ctx, resourceID); err == nil {
+		if vm.ProviderID != providerID {
+			return "", errors.New("provider mismatch for resource log")
+		}
+		return "vm", nil
+	}
+	pod, err := s.repo.GetPod(ctx, resourceID)
+	if err != nil {
+		return "", errors.New("resource not found for log entry")
+	}
+	if pod.ProviderID != providerID {
+		return "", errors.New("provider mismatch for resource log")
+	}
+	return "pod", nil
+}
+
+// ListResourceLogs returns log lines of a resource userID owns or holds a share
+// grant on. A query with AfterSeq pages forward from that cursor; otherwise the
+// newest lines come first and BeforeSeq pages backwards.
+func (s *ResourceService) ListResourceLogs(ctx context.Context, userID string, query models.ResourceLogQuery) ([]models.ResourceLog, error) {
+	if _, err := s.authorizeResourceAccess(ctx, userID, query.ResourceID, models.SharedAccessRead); err != nil {
+		return nil, err
+	}
+	return s.listResourceLogs(ctx, query)
+}
+
+// FollowResourceLogs waits up to wait for lines newer than query.AfterSeq and
+// returns as soon as any arrive.
+func (s *ResourceService) FollowResourceLogs(ctx context.Context, userID string, query models.ResourceLogQuery, wait time.Duration) ([]models.ResourceLog, error) {
+	if _, err := s.authorizeResourceAccess(ctx, userID, query.ResourceID, models.SharedAccessRead); err != nil {
+		return nil, err
+	}
+	return s.followResourceLogs(ctx, query, wait)
+}
+
+func (s *ResourceService) ListResourceLogsAdmin(ctx context.Context, query models.ResourceLogQuery) ([]models.ResourceLog, error) {
+	if strings.TrimSpace(query.ResourceID) == "" {
+		return nil, errors.New("resource_id is required")
+	}
+	return s.listResourceLogs(ctx, query)
+}
+
+func (s *ResourceService) listResourceLogs(ctx context.Context, query models.ResourceLogQuery) ([]models.ResourceLog, error) {
+	if query.Limit <= 0 {
+		query.Limit = 200
+	}
+	if query.Limit > 1000 {
+		query.Limit = 1000
+	}
+	if query.AfterSeq < 0 || query.BeforeSeq < 0 {
+		return nil, errors.New("after_seq and before_seq must not be negative")
+	}
+	levels := make([]string, 0, len(query.Levels))
+	for _, raw := range query.Levels {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		level, ok := normalizeResourceLogLevel(raw)
+		if !ok {
+			return nil, errors.New("level must be debug, info, warning or error")
+		}
+		levels = append(levels, string(level))
+	}
+	query.Levels = levels
+	query.Text = strings.TrimSpace(query.Text)
+	query.Source = strings.TrimSpace(query.Source)
+	return s.repo.ListResourceLogs(ctx, query)
+}
+
+func (s *ResourceService) followResourceLogs(ctx context.Context, query models.ResourceLogQuery, wait time.Duration) ([]models.ResourceLog, error) {
+	if wait > maxResourceLogFollow {
+		wait = maxResourceLogFollow
+	}
+	if query.AfterSeq <= 0 {
+		latest, err := s.listResourceLogs(ctx, models.ResourceLogQuery{ResourceID: query.ResourceID, Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		if len(latest) > 0 {
+			query.AfterSeq = latest[0].Seq
+		}
+		query.BeforeSeq = 0
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		items, err := s.listResourceLogs(ctx, query)
+		if err != nil || len(items) > 0 || !time.Now().Before(deadline) {
+			return items, err
+		}
+		select {
+		case <-ctx.Done():
+			return []models.ResourceLog{}, nil
+		case <-time.After(resourceLogPollInterval):
+		}
+	}
+}
+
+func (s *ResourceService) PruneResourceLogs(ctx context.Context, now time.Time) error {
+	cutoff := now.Add(-s.resourceLogRetention)
+	deleted, err := s.repo.DeleteResourceLogsBefore(ctx, cutoff, 5000)
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Info().Int64("deleted_count", deleted).Time("cutoff", cutoff).Msg("resource logs pruned")
+	}
+	return nil
+}
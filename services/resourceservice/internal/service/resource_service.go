@@ -39,42 +39,182 @@ type Repository interface {
 	GetPod(ctx context.Context, podID string) (models.Pod, error)
 	ListPods(ctx context.Context, userID string, filter models.CatalogFilter) ([]models.Pod, error)
 	ListAllPods(ctx context.Context, limit int) ([]models.Pod, error)
+	ListRunningLocalPods(ctx context.Context) ([]models.Pod, error)
 	UpdatePodStatus(ctx context.Context, podID string, status models.PodStatus) error
-	UpdatePodExternalRef(ctx context.Context, podID string, externalID string) error
+	UpdatePodExternalRef(ctx context.Context, podID string, externalID string, ipAddress string) error
+	UpdatePodPorts(ctx context.Context, podID string, ports []models.PodPort) error
 	ListExpiredPods(ctx context.Context, now time.Time, limit int) ([]models.Pod, error)
 	MarkPodExpired(ctx context.Context, podID string) error
 
-	CreateSharedVM(ctx context.Context, item models.SharedVM) (models.SharedVM, error)
 	ListSharedVMs(ctx context.Context, userID string) ([]models.SharedVM, error)
-	CreateSharedPod(ctx context.Context, item models.SharedPod) (models.SharedPod, error)
 	ListSharedPods(ctx context.Context, userID string) ([]models.SharedPod, error)
+	CreateShareGrant(ctx context.Context, item models.ShareGrant) (models.ShareGrant, error)
+	CreateShareGrants(ctx context.Context, items []models.ShareGrant) ([]models.ShareGrant, error)
+	GetShareGrant(ctx context.Context, resourceType string, grantID string) (models.ShareGrant, error)
+	ListShareGrants(ctx context.Context, resourceType string, resourceID string) ([]models.ShareGrant, error)
+	ListShareGrantsForGrantee(ctx context.Context, userID string) ([]models.ShareGrant, error)
+	UpdateShareGrant(ctx context.Context, item models.ShareGrant) (models.ShareGrant, error)
+	ExpireShareGrants(ctx context.Context, now time.Time, limit int) ([]models.ShareGrant, error)
+	CreateShareAuditEvent(ctx context.Context, event models.ShareAuditEvent) (models.ShareAuditEvent, error)
+	ListShareAuditEvents(ctx context.Context, resourceType string, resourceID string, limit int) ([]models.ShareAuditEvent, error)
 	UpsertSharedInventoryOffer(ctx context.Context, item models.SharedInventoryOffer) (models.SharedInventoryOffer, error)
 	ListSharedInventoryOffers(ctx context.Context, status string, providerID string) ([]models.SharedInventoryOffer, error)
-	ReserveSharedInventoryOffer(ctx context.Context, offerID string, quantity int) (models.SharedInventoryOffer, error)
+	GetSharedInventoryOffer(ctx context.Context, offerID string) (models.SharedInventoryOffer, error)
+	CreateOfferBooking(ctx context.Context, item models.OfferBooking) (models.OfferBooking, error)
+	GetOfferBooking(ctx context.Context, bookingID string) (models.OfferBooking, error)
+	ListOfferBookings(ctx context.Context, userID string, status string, limit int) ([]models.OfferBooking, error)
+	ClaimOfferBooking(ctx context.Context, bookingID string, now time.Time) (models.OfferBooking, error)
+	UnclaimOfferBooking(ctx context.Context, bookingID string) error
+	ConfirmOfferBooking(ctx context.Context, bookingID string, allocationID string, rentalID string) (models.OfferBooking, error)
+	CloseOfferBooking(ctx context.Context, bookingID string, from []models.OfferBookingStatus, to models.OfferBookingStatus) (models.OfferBooking, models.OfferBookingStatus, error)
+	ExpireOfferHolds(ctx context.Context, now time.Time, limit int) ([]models.OfferBooking, error)
+	CreateOfferBid(ctx context.Context, item models.OfferBid) (models.OfferBid, error)
+	GetOfferBid(ctx context.Context, bidID string) (models.OfferBid, error)
+	ListOfferBids(ctx context.Context, offerID string, userID string, statuses []models.OfferBidStatus, limit int) ([]models.OfferBid, error)
+	UpdateOfferBid(ctx context.Context, item models.OfferBid, from models.OfferBidStatus) (models.OfferBid, error)
+	ReturnOfferQuantity(ctx context.Context, offerID string, quantity int) error
+	ListDueAuctionOffers(ctx context.Context, now time.Time, limit int) ([]models.SharedInventoryOffer, error)
+	ClaimAuctionPeriod(ctx context.Context, offerID string, due time.Time, next time.Time) (bool, error)
+	RecordAuctionClearing(ctx context.Context, item models.AuctionClearing) (models.AuctionClearing, error)
+	ListAuctionClearings(ctx context.Context, offerID string, limit int) ([]models.AuctionClearing, error)
 
 	CreateHealthCheck(ctx context.Context, item models.HealthCheck) (models.HealthCheck, error)
 	ListHealthChecks(ctx context.Context, resourceType string, resourceID string, limit int) ([]models.HealthCheck, error)
+	CreateHealthProbe(ctx context.Context, item models.HealthProbe) (models.HealthProbe, error)
+	GetHealthProbe(ctx context.Context, probeID string) (models.HealthProbe, error)
+	ListHealthProbes(ctx context.Context, resourceType string, resourceID string) ([]models.HealthProbe, error)
+	DeleteHealthProbe(ctx context.Context, probeID string) error
+	ListUnprobedVMs(ctx context.Context, limit int) ([]models.VM, error)
+	ListUnprobedPods(ctx context.Context, limit int) ([]models.Pod, error)
+	MarkHealthProbesSeeded(ctx context.Context, resourceType string, resourceID string) error
+	ClaimDueHealthProbes(ctx context.Context, now time.Time, limit int) ([]models.HealthProbe, error)
+	RecordHealthProbeResult(ctx context.Context, probeID string, status models.HealthStatus, latencyMS float64, checkedAt time.Time) (models.HealthProbe, error)
+	SetResourceHealth(ctx context.Context, resourceType string, resourceID string, health models.ResourceHealth) (bool, error)
+	AppendStreamEvents(ctx context.Context, origin string, payloads [][]byte) error
+	LatestStreamEventID(ctx context.Context) (int64, error)
+	ListStreamEvents(ctx context.Context, afterID int64, limit int) ([]models.StreamRelayEvent, error)
+	DeleteStreamEventsBefore(ctx context.Context, before time.Time) (int64, error)
+	TouchAgentPoll(ctx context.Context, providerID string, at time.Time) error
+	ListPresenceInputs(ctx context.Context) ([]models.ProviderPresence, error)
+	RecordPresenceChange(ctx context.Context, item models.ProviderPresence, from models.ProviderPresenceState) (bool, error)
+	ListProviderPresence(ctx context.Context, providerID string, state string, unsyncedOnly bool, limit int) ([]models.ProviderPresence, error)
+	MarkPresenceSynced(ctx context.Context, providerID string, changedAt time.Time) error
+	ListPresenceEvents(ctx context.Context, providerID string, limit int) ([]models.ProviderPresenceEvent, error)
+	ListHealthChecksBetween(ctx context.Context, resourceType string, resourceID string, from time.Time, to time.Time) ([]models.HealthCheck, error)
+	ListPresenceEventsBetween(ctx context.Context, providerID string, from time.Time, to time.Time) ([]models.ProviderPresenceEvent, error)
+	ListSLASubjects(ctx context.Context, period string, from time.Time, to time.Time, limit int) ([]models.SLASubject, error)
+	ListSLAProviders(ctx context.Context, period string, to time.Time, limit int) ([]string, error)
+	ListBilledProviderBookings(ctx context.Context, providerID string, from time.Time, to time.Time) ([]models.OfferBooking, error)
+	SaveSLAReport(ctx context.Context, item models.SLAReport) error
+	GetSLAReport(ctx context.Context, resourceType string, resourceID string, period string) (models.SLAReport, error)
+	ListSLAReports(ctx context.Context, filter models.SLAReportFilter) ([]models.SLAReport, error)
+	MarkSLAReportCredited(ctx context.Context, resourceType string, resourceID string, period string, creditUSD float64) error
 
 	CreateMetricPoint(ctx context.Context, item models.MetricPoint) (models.MetricPoint, error)
-	ListMetricPoints(ctx context.Context, resourceType string, resourceID string, metricType string, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error)
+	ListMetricPoints(ctx context.Context, filter models.MetricFilter, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error)
 	MetricSummaries(ctx context.Context, limit int) ([]models.MetricSummary, error)
+	ListMetricRollups(ctx context.Context, resolution models.MetricResolution, filter models.MetricFilter, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error)
+	MetricRollupWatermark(ctx context.Context, resolution models.MetricResolution) (time.Time, error)
+	RollupMetrics(ctx context.Context, resolution models.MetricResolution, from time.Time, to time.Time) (int64, error)
+	DeleteMetricPointsBefore(ctx context.Context, cutoff time.Time, limit int) (int64, error)
+	DeleteMetricRollupsBefore(ctx context.Context, resolution models.MetricResolution, cutoff time.Time, limit int) (int64, error)
+	LatestMetricPoints(ctx context.Context, filter models.MetricFilter, since time.Time) ([]models.MetricPoint, error)
+	LatestHealthChecks(ctx context.Context, resourceType string, resourceID string, checkType string, since time.Time) ([]models.HealthCheck, error)
+	ListHostResources(ctx context.Context) ([]models.HostResource, error)
+	CreateAlertRule(ctx context.Context, item models.AlertRule) (models.AlertRule, error)
+	GetAlertRule(ctx context.Context, ruleID string) (models.AlertRule, error)
+	ListAlertRules(ctx context.Context, ownerUserID string, enabledOnly bool) ([]models.AlertRule, error)
+	DeleteAlertRule(ctx context.Context, ruleID string) error
+	CreateAlert(ctx context.Context, item models.Alert) (models.Alert, error)
+	UpdateAlert(ctx context.Context, item models.Alert) (models.Alert, error)
+	ListOpenAlerts(ctx context.Context) ([]models.Alert, error)
+	ListAlerts(ctx context.Context, ownerUserID string, state string, limit int) ([]models.Alert, error)
+	ClaimAlertNotification(ctx context.Context, alertID string, from models.AlertState, to models.AlertState) (bool, error)
+	CreateAlertSilence(ctx context.Context, item models.AlertSilence) (models.AlertSilence, error)
+	GetAlertSilence(ctx context.Context, silenceID string) (models.AlertSilence, error)
+	ListAlertSilences(ctx context.Context, ownerUserID string, activeAt time.Time) ([]models.AlertSilence, error)
+	EndAlertSilence(ctx context.Context, silenceID string, at time.Time) (models.AlertSilence, error)
 	CreateAgentLog(ctx context.Context, item models.AgentLog) (models.AgentLog, error)
 	ListAgentLogs(ctx context.Context, providerID string, resourceID string, level string, limit int) ([]models.AgentLog, error)
 	CreateAgentCommand(ctx context.Context, item models.AgentCommand) (models.AgentCommand, error)
 	ListAgentCommands(ctx context.Context, providerID string, limit int) ([]models.AgentCommand, error)
 	ClaimNextAgentCommand(ctx context.Context, providerID string) (models.AgentCommand, error)
+	ClaimAgentCommands(ctx context.Context, providerID string, afterSeq int64, lease time.Duration, limit int) ([]models.AgentCommand, error)
 	CompleteAgentCommand(ctx context.Context, commandID string, status models.AgentCommandState, resultMessage string) (models.AgentCommand, error)
+	GetAgentCommand(ctx context.Context, commandID string) (models.AgentCommand, error)
+	ListRequestedAgentCommands(ctx context.Context, userID string, limit int) ([]models.AgentCommand, error)
+	AcknowledgeAgentCommand(ctx context.Context, commandID string) (models.AgentCommand, error)
+	ListOpenAgentCommands(ctx context.Context, command models.AgentCommandAction) ([]models.AgentCommand, error)
+	ListStaleAgentCommands(ctx context.Context, now time.Time, limit int) ([]models.AgentCommand, error)
+	RequeueAgentCommand(ctx context.Context, commandID string) (models.AgentCommand, error)
+	CreateRollout(ctx context.Context, item models.Rollout, targets []models.RolloutTarget) (models.Rollout, error)
+	GetRollout(ctx context.Context, rolloutID string) (models.Rollout, error)
+	ListRollouts(ctx context.Context, status models.RolloutStatus, limit int) ([]models.Rollout, error)
+	ListRolloutTargets(ctx context.Context, rolloutID string) ([]models.RolloutTarget, error)
+	TransitionRollout(ctx context.Context, rolloutID string, from []models.RolloutStatus, status models.RolloutStatus, detail string) (models.Rollout, error)
+	AdvanceRolloutWave(ctx context.Context, rolloutID string, wave int) error
+	ClaimRolloutTargets(ctx context.Context, rolloutID string) ([]models.RolloutTarget, error)
+	SetRolloutTargetCommand(ctx context.Context, rolloutID string, providerID string, commandID string) error
+	FinishRolloutTarget(ctx context.Context, rolloutID string, providerID string, status models.RolloutTargetStatus, detail string) (models.RolloutTarget, error)
+	CancelPendingRolloutTargets(ctx context.Context, rolloutID string, detail string) error
+	CreateAgentEnrollment(ctx context.Context, item models.AgentEnrollment, tokenHash string) (models.AgentEnrollment, error)
+	ListAgentEnrollments(ctx context.Context, providerID string, limit int) ([]models.AgentEnrollment, error)
+	ConsumeAgentEnrollment(ctx context.Context, tokenHash string, hostID string, now time.Time) (models.AgentEnrollment, error)
+	CreateAgentHost(ctx context.Context, item models.AgentHost) (models.AgentHost, []models.AgentHost, error)
+	GetAgentHost(ctx context.Context, hostID string) (models.AgentHost, error)
+	ListAgentHosts(ctx context.Context, providerID string, limit int) ([]models.AgentHost, error)
+	RotateAgentHostCredential(ctx context.Context, hostID string, presentedCredentialID string, credentialID string, expiresAt time.Time) (models.AgentHost, error)
+	RetirePreviousAgentCredential(ctx context.Context, hostID string, credentialID string) error
+	RevokeAgentHost(ctx context.Context, hostID string, revokedBy string) (models.AgentHost, error)
+	SetAgentHostPublicKey(ctx context.Context, hostID string, publicKey string) (models.AgentHost, error)
+	CreateCapacityChallenge(ctx context.Context, item models.CapacityChallenge) (models.CapacityChallenge, error)
+	GetCapacityChallenge(ctx context.Context, challengeID string) (models.CapacityChallenge, error)
+	ListCapacityChallenges(ctx context.Context, providerID string, limit int) ([]models.CapacityChallenge, error)
+	CompleteCapacityChallenge(ctx context.Context, challengeID string, status models.CapacityChallengeState, detail string) (models.CapacityChallenge, error)
+	GetHostVerification(ctx context.Context, providerID string) (models.HostVerification, error)
+	UpsertHostVerification(ctx context.Context, item models.HostVerification) (models.HostVerification, error)
+	ListHostVerifications(ctx context.Context, status models.HostVerificationState) ([]models.HostVerification, error)
+	ListGPUDeviceOwners(ctx context.Context, uuids []string) (map[string]string, error)
+	UpsertGPUDevices(ctx context.Context, items []models.GPUDevice) error
+	GetExecPolicy(ctx context.Context, providerID string) (models.ExecPolicy, error)
+	UpsertExecPolicy(ctx context.Context, item models.ExecPolicy) (models.ExecPolicy, error)
+	CreateExecRun(ctx context.Context, item models.ExecRun) (models.ExecRun, error)
+	GetExecRun(ctx context.Context, execID string) (models.ExecRun, error)
+	ListExecRuns(ctx context.Context, providerID string, requestedBy string, limit int) ([]models.ExecRun, error)
+	AppendExecOutput(ctx context.Context, execID string, stream string, data string, limit int) error
+	FinishExecRun(ctx context.Context, execID string, status models.ExecRunState, exitCode int, truncated bool, detail string) (models.ExecRun, error)
+	CreateFileTransfer(ctx context.Context, item models.FileTransfer) (models.FileTransfer, error)
+	GetFileTransfer(ctx context.Context, transferID string) (models.FileTransfer, error)
+	ListFileTransfers(ctx context.Context, providerID string, resourceID string, requestedBy string, limit int) ([]models.FileTransfer, error)
+	UpdateFileTransfer(ctx context.Context, item models.FileTransfer) (models.FileTransfer, error)
+	AppendFileTransferChunk(ctx context.Context, transferID string, offset int64, data []byte, maxBytes int64) (models.FileTransfer, error)
+	GetFileTransferChunk(ctx context.Context, transferID string, offset int64) ([]byte, error)
+	ListFileTransferChunks(ctx context.Context, transferID string, offset int64, limit int) ([]models.FileTransferChunk, error)
+	DeleteFileTransferChunks(ctx context.Context, transferID string) error
+	ListExpiredFileTransfers(ctx context.Context, now time.Time, limit int) ([]models.FileTransfer, error)
 	CreateTerminalSession(ctx context.Context, item models.TerminalSession) (models.TerminalSession, error)
+	ListTerminalSessions(ctx context.Context, resourceID string, limit int) ([]models.TerminalSession, error)
+	ListProviderTerminalSessions(ctx context.Context, providerID string, limit int) ([]models.TerminalSession, error)
 	GetTerminalSession(ctx context.Context, sessionID string) (models.TerminalSession, error)
 	UpdateTerminalSessionStatus(ctx context.Context, sessionID string, status models.TerminalSessionState, exitCode int) (models.TerminalSession, error)
 	UpdateTerminalSessionSize(ctx context.Context, sessionID string, rows int, cols int) (models.TerminalSession, error)
 	AppendTerminalChunk(ctx context.Context, chunk models.TerminalChunk) (models.TerminalChunk, error)
+	ReserveTerminalSeqs(ctx context.Context, sessionID string, direction models.TerminalChunkDirection, count int64) (int64, error)
 	ListTerminalChunks(ctx context.Context, sessionID string, direction models.TerminalChunkDirection, afterSeq int64, limit int) ([]models.TerminalChunk, error)
 	CreateTerminalAuditEvent(ctx context.Context, event models.TerminalAuditEvent) (models.TerminalAuditEvent, error)
+	ListTerminalAuditEvents(ctx context.Context, sessionID string, eventType string, limit int) ([]models.TerminalAuditEvent, error)
+	UpsertTerminalParticipant(ctx context.Context, item models.TerminalParticipant) (models.TerminalParticipant, error)
+	GetTerminalParticipant(ctx context.Context, sessionID string, userID string) (models.TerminalParticipant, error)
+	ListTerminalParticipants(ctx context.Context, sessionID string) ([]models.TerminalParticipant, error)
+	DeleteTerminalParticipant(ctx context.Context, sessionID string, userID string) error
 	ExpireIdleTerminalSessions(ctx context.Context, idleBefore time.Time, limit int) ([]models.TerminalSession, error)
+	PurgeTerminalRecordings(ctx context.Context, endedBefore time.Time, limit int) (int, error)
 	CountActiveTerminalSessions(ctx context.Context, renterUserID string) (int, error)
 	CreateRootInputLog(ctx context.Context, item models.RootInputLog) (models.RootInputLog, error)
 	ListRootInputLogs(ctx context.Context, providerID string, resourceID string, limit int) ([]models.RootInputLog, error)
+	CreateResourceLogs(ctx context.Context, items []models.ResourceLog) ([]models.ResourceLog, error)
+	ListResourceLogs(ctx context.Context, query models.ResourceLogQuery) ([]models.ResourceLog, error)
+	DeleteResourceLogsBefore(ctx context.Context, cutoff time.Time, limit int) (int64, error)
 
 	ConsumeCreateRateLimit(ctx context.Context, userID string, windowStart time.Time, windowEnd time.Time, limit int) (bool, error)
 
@@ -95,6 +235,8 @@ type ResourceService struct {
 	cgroups              CGroupApplier
 	orchestrator         orchestrator.Runtime
 	provisioning         ProvisioningClient
+	users                UserDirectory
+	billing              BillingClient
 	heartbeatMaxAge      time.Duration
 	createRateLimitRPM   int
 	vmTTL                time.Duration
@@ -103,6 +245,21 @@ type ResourceService struct {
 	vmDaemonKafkaTopic   string
 	terminalIdleTimeout  time.Duration
 	terminalMaxSessions  int
+	resourceLogRetention time.Duration
+	offerHoldTTL         time.Duration
+	metricRetention      MetricRetention
+	alertNotifiers       map[models.AlertChannelType]AlertNotifier
+	prober               HealthProber
+	presence             PresencePublisher
+	slaPolicy            SLAPolicy
+	agentAuth            AgentAuthPolicy
+	verification         VerificationPolicy
+	agentUpdates         AgentUpdatePolicy
+	rollouts             RolloutPolicy
+	recordings           RecordingPolicy
+	streams              *streamHub
+	agentChannels        *agentChannels
+	terminals            *terminalHub
 }
 
 type ProvisioningClient interface {
@@ -112,38 +269,112 @@ type ProvisioningClient interface {
 	DeletePod(ctx context.Context, externalID string, req provisioning.DeleteRequest) error
 }
 
+// Options carries the collaborators and policies of a ResourceService. Zero
+// durations, limits and policies fall back to their defaults, and nil clients
+// leave the features that need them unconfigured.
+type Options struct {
+	Orchestrator         orchestrator.Runtime
+	Provisioning         ProvisioningClient
+	Users                UserDirectory
+	Billing              BillingClient
+	HeartbeatMaxAge      time.Duration
+	CreateRateLimitRPM   int
+	VMTTL                time.Duration
+	VMDaemonDownloadURL  string
+	VMDaemonKafkaBrokers string
+	VMDaemonKafkaTopic   string
+	MetricRetention      MetricRetention
+	AlertNotifiers       map[models.AlertChannelType]AlertNotifier
+	Prober               HealthProber
+	Presence             PresencePublisher
+	SLA                  SLAPolicy
+	AgentAuth            AgentAuthPolicy
+	Verification         VerificationPolicy
+	AgentUpdates         AgentUpdatePolicy
+	Rollouts             RolloutPolicy
+	Recordings           RecordingPolicy
+}
+
 // NewResourceService wires control-plane components for telemetry, allocation accounting,
 // and lifecycle APIs. It is not a hardened sandbox runtime for untrusted code execution.
-func NewResourceService(repo Repository, cgroups CGroupApplier, runtime orchestrator.Runtime, provisioningClient ProvisioningClient, heartbeatMaxAge time.Duration, createRateLimitRPM int, vmTTL time.Duration, vmDaemonDownloadURL string, vmDaemonKafkaBrokers string, vmDaemonKafkaTopic string) *ResourceService {
-	if heartbeatMaxAge <= 0 {
-		heartbeatMaxAge = 30 * time.Second
-	}
-	if createRateLimitRPM <= 0 {
-		createRateLimitRPM = 5
-	}
-	if vmTTL <= 0 {
-		vmTTL = 5 * time.Minute
-	}
-	terminalIdleTimeout := 10 * time.Minute
-	terminalMaxSessions := 2
+func NewResourceService(repo Repository, cgroups CGroupApplier, opts Options) *ResourceService {
+	if opts.HeartbeatMaxAge <= 0 {
+		opts.HeartbeatMaxAge = 30 * time.Second
+	}
+	if opts.CreateRateLimitRPM <= 0 {
+		opts.CreateRateLimitRPM = 5
+	}
+	if opts.VMTTL <= 0 {
+		opts.VMTTL = 5 * time.Minute
+	}
+	opts.MetricRetention = opts.MetricRetention.withDefaults()
+	opts.SLA = opts.SLA.withDefaults()
+	opts.AgentAuth = opts.AgentAuth.withDefaults()
+	opts.Verification = opts.Verification.withDefaults()
+	opts.AgentUpdates = opts.AgentUpdates.withDefaults()
+	opts.Rollouts = opts.Rollouts.withDefaults()
+	opts.Recordings = opts.Recordings.withDefaults()
 	log.Info().
-		Dur("heartbeat_max_age", heartbeatMaxAge).
-		Int("create_rate_limit_rpm", createRateLimitRPM).
-		Dur("vm_ttl", vmTTL).
+		Dur("heartbeat_max_age", opts.HeartbeatMaxAge).
+		Int("create_rate_limit_rpm", opts.CreateRateLimitRPM).
+		Dur("vm_ttl", opts.VMTTL).
+		Dur("metric_raw_retention", opts.MetricRetention.Raw).
+		Dur("metric_minute_retention", opts.MetricRetention.Minute).
+		Dur("metric_hour_retention", opts.MetricRetention.Hour).
+		Str("sla_provider_tier", opts.SLA.ProviderTier).
+		Dur("agent_credential_ttl", opts.AgentAuth.CredentialTTL).
+		Bool("agent_static_tokens", opts.AgentAuth.AllowStaticTokens).
+		Dur("capacity_challenge_interval", opts.Verification.ChallengeInterval).
+		Str("agent_release_url", opts.AgentUpdates.ReleaseURL).
+		Int("rollout_max_concurrency", opts.Rollouts.MaxConcurrency).
+		Dur("terminal_recording_retention", opts.Recordings.Retention).
 		Msg("resource service initialized")
 	return &ResourceService{
-		repo: repo, cgroups: cgroups, orchestrator: runtime, provisioning: provisioningClient, heartbeatMaxAge: heartbeatMaxAge, createRateLimitRPM: createRateLimitRPM, vmTTL: vmTTL, vmDaemonDownloadURL: vmDaemonDownloadURL, vmDaemonKafkaBrokers: vmDaemonKafkaBrokers, vmDaemonKafkaTopic: vmDaemonKafkaTopic, terminalIdleTimeout: terminalIdleTimeout, terminalMaxSessions: terminalMaxSessions,
+		repo:                 repo,
+		cgroups:              cgroups,
+		orchestrator:         opts.Orchestrator,
+		provisioning:         opts.Provisioning,
+		users:                opts.Users,
+		billing:              opts.Billing,
+		heartbeatMaxAge:      opts.HeartbeatMaxAge,
+		createRateLimitRPM:   opts.CreateRateLimitRPM,
+		vmTTL:                opts.VMTTL,
+		vmDaemonDownloadURL:  opts.VMDaemonDownloadURL,
+		vmDaemonKafkaBrokers: opts.VMDaemonKafkaBrokers,
+		vmDaemonKafkaTopic:   opts.VMDaemonKafkaTopic,
+		terminalIdleTimeout:  10 * time.Minute,
+		terminalMaxSessions:  2,
+		resourceLogRetention: 72 * time.Hour,
+		offerHoldTTL:         15 * time.Minute,
+		metricRetention:      opts.MetricRetention,
+		alertNotifiers:       opts.AlertNotifiers,
+		prober:               opts.Prober,
+		presence:             opts.Presence,
+		slaPolicy:            opts.SLA,
+		agentAuth:            opts.AgentAuth,
+		verification:         opts.Verification,
+		agentUpdates:         opts.AgentUpdates,
+		rollouts:             opts.Rollouts,
+		recordings:           opts.Recordings,
+		streams:              newStreamHub(repo),
+		agentChannels:        newAgentChannels(),
+		terminals:            newTerminalHub(repo),
 	}
 }
 
+// UpdateHeartbeat stores an unsigned heartbeat ingested from Kafka. Providers
+// with an enrolled host send signed heartbeats over HTTP instead, so Kafka
+// heartbeats for them are dropped; their other telemetry is still consumed.
 func (s *ResourceService) UpdateHeartbeat(ctx context.Context, resource models.HostResource) error {
-	log.Debug().
-		Str("provider_id", resource.ProviderID).
-		Int("cpu_free_cores", resource.CPUFreeCores).
-		Int("ram_free_mb", resource.RAMFreeMB).
-		Int("gpu_free_units", resource.GPUFreeUnits).
-		Msg("upserting host heartbeat")
-	return s.repo.UpsertHostResource(ctx, resource)
+	enrolled, err := s.providerHasAgentHost(ctx, resource.ProviderID)
+	if err != nil {
+		return err
+	}
+	if enrolled {
+		log.Debug().Str("provider_id", resource.ProviderID).Msg("kafka heartbeat ignored for enrolled provider")
+		return nil
+	}
+	return s.RecordHeartbeat(ctx, resource, HeartbeatSignature{})
 }
 
 func (s *ResourceService) Allocate(ctx context.Context, alloc models.Allocation) (models.Allocation, error) {
@@ -173,6 +404,14 @@ func (s *ResourceService) Allocate(ctx context.Context, alloc models.Allocation)
 	if host.CPUFreeCores < alloc.CPUCores || host.RAMFreeMB < alloc.RAMMB || host.GPUFreeUnits < alloc.GPUUnits {
 		return models.Allocation{}, errors.New("insufficient free resources")
 	}
+	verification, err := s.repo.GetHostVerification(ctx, alloc.ProviderID)
+	if err != nil {
+		return models.Allocation{}, err
+	}
+	if verification.Status == models.HostFlagged {
+		log.Warn().Str("provider_id", alloc.ProviderID).Str("reason", verification.Reason).Msg("allocation refused for flagged provider")
+		return models.Allocation{}, fmt.Errorf("provider is flagged by capacity verification: %s", verification.Reason)
+	}
 	if err := s.cgroups.Apply(alloc.ProviderID, alloc.CPUCores, alloc.RAMMB, alloc.GPUUnits); err != nil {
 		log.Error().Err(err).Str("provider_id", alloc.ProviderID).Msg("allocation failed on cgroup apply")
 		return models.Allocation{}, err
@@ -422,7 +661,7 @@ func (s *ResourceService) CreateVM(ctx context.Context, vm models.VM) (models.VM
 	})
 	if err != nil {
 		log.Error().Err(err).Str("vm_id", created.ID).Msg("create vm failed on provisioning create")
-		_ = s.repo.UpdateVMStatus(ctx, created.ID, models.VMStatusTerminated)
+		_ = s.setVMStatus(ctx, created.ID, models.VMStatusTerminated)
 		return models.VM{}, err
 	}
 	created.ExternalID = provisioned.ExternalID
@@ -435,7 +674,7 @@ func (s *ResourceService) CreateVM(ctx context.Context, vm models.VM) (models.VM
 		log.Error().Err(err).Str("vm_id", created.ID).Str("external_id", created.ExternalID).Msg("create vm failed on update external ref")
 		return models.VM{}, err
 	}
-	if err := s.repo.UpdateVMStatus(ctx, created.ID, models.VMStatusRunning); err != nil {
+	if err := s.setVMStatus(ctx, created.ID, models.VMStatusRunning); err != nil {
 		log.Error().Err(err).Str("vm_id", created.ID).Msg("create vm failed on update running status")
 		return models.VM{}, err
 	}
@@ -456,7 +695,60 @@ func (s *ResourceService) ListVMs(ctx context.Context, userID string, filter mod
 	return s.repo.ListVMs(ctx, userID, filter)
 }
 
-func (s *ResourceService) StartVM(ctx context.Context, vmID string) (models.VM, error) {
+func (s *ResourceService) StartVM(ctx context.Context, userID string, vmID string) (models.VM, error) {
+	access, err := s.authorizeVMLifecycle(ctx, userID, vmID)
+	if err != nil {
+		return models.VM{}, err
+	}
+	vm, err := s.startVM(ctx, vmID)
+	if err != nil {
+		return models.VM{}, err
+	}
+	s.auditSharedAction(ctx, access, vmID, userID, "vm_start")
+	return vm, nil
+}
+
+func (s *ResourceService) StopVM(ctx context.Context, userID string, vmID string) (models.VM, error) {
+	access, err := s.authorizeVMLifecycle(ctx, userID, vmID)
+	if err != nil {
+		return models.VM{}, err
+	}
+	vm, err := s.stopVM(ctx, vmID)
+	if err != nil {
+		return models.VM{}, err
+	}
+	s.auditSharedAction(ctx, access, vmID, userID, "vm_stop")
+	return vm, nil
+}
+
+func (s *ResourceService) RebootVM(ctx context.Context, userID string, vmID string) (models.VM, error) {
+	access, err := s.authorizeVMLifecycle(ctx, userID, vmID)
+	if err != nil {
+		return models.VM{}, err
+	}
+	if _, err := s.stopVM(ctx, vmID); err != nil {
+		return models.VM{}, err
+	}
+	vm, err := s.startVM(ctx, vmID)
+	if err != nil {
+		return models.VM{}, err
+	}
+	s.auditSharedAction(ctx, access, vmID, userID, "vm_reboot")
+	return vm, nil
+}
+
+func (s *ResourceService) authorizeVMLifecycle(ctx context.Context, userID string, vmID string) (resourceAccess, error) {
+	access, err := s.authorizeResourceAccess(ctx, userID, vmID, models.SharedAccessAdmin)
+	if err != nil {
+		return resourceAccess{}, err
+	}
+	if access.ResourceType != "vm" {
+		return resourceAccess{}, errors.New("vm not found")
+	}
+	return access, nil
+}
+
+func (s *ResourceService) startVM(ctx context.Context, vmID string) (models.VM, error) {
 	vm, err := s.repo.GetVM(ctx, vmID)
 	if err != nil {
 		return models.VM{}, err
@@ -464,13 +756,13 @@ func (s *ResourceService) StartVM(ctx context.Context, vmID string) (models.VM,
 	if vm.Status == models.VMStatusTerminated {
 		return models.VM{}, errors.New("terminated VM cannot be started")
 	}
-	if err := s.repo.UpdateVMStatus(ctx, vmID, models.VMStatusRunning); err != nil {
+	if err := s.setVMStatus(ctx, vmID, models.VMStatusRunning); err != nil {
 		return models.VM{}, err
 	}
 	return s.repo.GetVM(ctx, vmID)
 }
 
-func (s *ResourceService) StopVM(ctx context.Context, vmID string) (models.VM, error) {
+func (s *ResourceService) stopVM(ctx context.Context, vmID string) (models.VM, error) {
 	vm, err := s.repo.GetVM(ctx, vmID)
 	if err != nil {
 		return models.VM{}, err
@@ -478,19 +770,12 @@ func (s *ResourceService) StopVM(ctx context.Context, vmID string) (models.VM, e
 	if vm.Status == models.VMStatusTerminated {
 		return models.VM{}, errors.New("terminated VM cannot be stopped")
 	}
-	if err := s.repo.UpdateVMStatus(ctx, vmID, models.VMStatusStopped); err != nil {
+	if err := s.setVMStatus(ctx, vmID, models.VMStatusStopped); err != nil {
 		return models.VM{}, err
 	}
 	return s.repo.GetVM(ctx, vmID)
 }
 
-func (s *ResourceService) RebootVM(ctx context.Context, vmID string) (models.VM, error) {
-	if _, err := s.StopVM(ctx, vmID); err != nil {
-		return models.VM{}, err
-	}
-	return s.StartVM(ctx, vmID)
-}
-
 func (s *ResourceService) TerminateVM(ctx context.Context, vmID string) (models.VM, error) {
 	log.Info().Str("vm_id", vmID).Msg("terminate vm requested")
 	vm, err := s.repo.GetVM(ctx, vmID)
@@ -506,7 +791,7 @@ func (s *ResourceService) TerminateVM(ctx context.Context, vmID string) (models.
 			return models.VM{}, err
 		}
 	}
-	if err := s.repo.UpdateVMStatus(ctx, vmID, models.VMStatusTerminated); err != nil {
+	if err := s.setVMStatus(ctx, vmID, models.VMStatusTerminated); err != nil {
 		return models.VM{}, err
 	}
 	out, err := s.repo.GetVM(ctx, vmID)
@@ -530,6 +815,20 @@ func (s *ResourceService) CreatePod(ctx context.Context, pod models.Pod) (models
 	if pod.GPUCount <= 0 || pod.CPUCount <= 0 || pod.MemoryGB <= 0 {
 		return models.Pod{}, errors.New("gpu_count, cpu_count and memory_gb must be positive")
 	}
+	switch pod.Backend {
+	case "":
+		pod.Backend = models.PodBackendRunPod
+	case models.PodBackendRunPod, models.PodBackendLocal:
+	default:
+		return models.Pod{}, errors.New("backend must be runpod or local")
+	}
+	pod, err := normalizePodSpec(pod)
+	if err != nil {
+		return models.Pod{}, err
+	}
+	if pod.AvailabilityTier, err = normalizeAvailabilityTier(pod.AvailabilityTier); err != nil {
+		return models.Pod{}, err
+	}
 	windowEnd := time.Now().UTC()
 	windowStart := windowEnd.Add(-1 * time.Minute)
 	allowed, err := s.repo.ConsumeCreateRateLimit(ctx, pod.UserID, windowStart, windowEnd, s.createRateLimitRPM)
@@ -542,38 +841,49 @@ func (s *ResourceService) CreatePod(ctx context.Context, pod models.Pod) (models
 	}
 	pod.Status = models.PodStatusProvisioning
 	pod.ExpiresAt = time.Now().UTC().Add(s.vmTTL)
+	if pod.Backend == models.PodBackendLocal {
+		return s.createLocalPod(ctx, pod)
+	}
 	created, err := s.repo.CreatePod(ctx, pod)
 	if err != nil {
 		log.Error().Err(err).Str("user_id", pod.UserID).Msg("create pod failed on repository create")
 		return models.Pod{}, err
 	}
 	provisioned, err := s.provisioning.CreatePod(ctx, provisioning.CreatePodRequest{
-		RequestID:  uuid.NewString(),
-		TraceID:    uuid.NewString(),
-		UserID:     created.UserID,
-		ProviderID: created.ProviderID,
-		Name:       created.Name,
-		ImageName:  created.ImageName,
-		GPUTypeID:  created.GPUTypeID,
-		GPUCount:   created.GPUCount,
-		CPUCount:   created.CPUCount,
-		MemoryGB:   created.MemoryGB,
-		ExpiresAt:  created.ExpiresAt,
+		RequestID:       uuid.NewString(),
+		TraceID:         uuid.NewString(),
+		UserID:          created.UserID,
+		ProviderID:      created.ProviderID,
+		Name:            created.Name,
+		ImageName:       created.ImageName,
+		GPUTypeID:       created.GPUTypeID,
+		GPUCount:        created.GPUCount,
+		CPUCount:        created.CPUCount,
+		MemoryGB:        created.MemoryGB,
+		Env:             created.Env,
+		Command:         created.Command,
+		Args:            created.Args,
+		Ports:           created.Ports,
+		ContainerDiskGB: created.ContainerDiskGB,
+		VolumeMounts:    created.VolumeMounts,
+		RegistryAuthID:  created.RegistryAuthID,
+		ExpiresAt:       created.ExpiresAt,
 		Metadata: map[string]any{
 			"pod_id": created.ID,
 		},
 	})
 	if err != nil {
 		log.Error().Err(err).Str("pod_id", created.ID).Msg("create pod failed on provisioning create")
-		_ = s.repo.UpdatePodStatus(ctx, created.ID, models.PodStatusTerminated)
+		_ = s.setPodStatus(ctx, created.ID, models.PodStatusTerminated)
 		return models.Pod{}, err
 	}
 	created.ExternalID = provisioned.ExternalID
-	if err := s.repo.UpdatePodExternalRef(ctx, created.ID, created.ExternalID); err != nil {
+	created.IPAddress = provisioned.PublicIP
+	if err := s.repo.UpdatePodExternalRef(ctx, created.ID, created.ExternalID, created.IPAddress); err != nil {
 		log.Error().Err(err).Str("pod_id", created.ID).Str("external_id", created.ExternalID).Msg("create pod failed on update external ref")
 		return models.Pod{}, err
 	}
-	if err := s.repo.UpdatePodStatus(ctx, created.ID, models.PodStatusRunning); err != nil {
+	if err := s.setPodStatus(ctx, created.ID, models.PodStatusRunning); err != nil {
 		return models.Pod{}, err
 	}
 	out, err := s.repo.GetPod(ctx, created.ID)
@@ -599,7 +909,12 @@ func (s *ResourceService) TerminatePod(ctx context.Context, podID string) (model
 	if err != nil {
 		return models.Pod{}, err
 	}
-	if strings.TrimSpace(pod.ExternalID) != "" {
+	if pod.Backend == models.PodBackendLocal {
+		if err := s.stopLocalPod(ctx, pod, pod.UserID); err != nil {
+			log.Error().Err(err).Str("pod_id", podID).Msg("terminate pod failed on queue pod_stop")
+			return models.Pod{}, err
+		}
+	} else if strings.TrimSpace(pod.ExternalID) != "" {
 		if err := s.provisioning.DeletePod(ctx, pod.ExternalID, provisioning.DeleteRequest{
 			RequestID: uuid.NewString(),
 			TraceID:   uuid.NewString(),
@@ -608,7 +923,7 @@ func (s *ResourceService) TerminatePod(ctx context.Context, podID string) (model
 			return models.Pod{}, err
 		}
 	}
-	if err := s.repo.UpdatePodStatus(ctx, podID, models.PodStatusTerminated); err != nil {
+	if err := s.setPodStatus(ctx, podID, models.PodStatusTerminated); err != nil {
 		return models.Pod{}, err
 	}
 	out, err := s.repo.GetPod(ctx, podID)
@@ -630,7 +945,14 @@ func (s *ResourceService) ShareVM(ctx context.Context, item models.SharedVM) (mo
 	if item.AccessLevel == "" {
 		item.AccessLevel = models.SharedAccessRead
 	}
-	return s.repo.CreateSharedVM(ctx, item)
+	grants, err := s.shareRecipients(ctx, item.OwnerUserID, "vm", item.VMID, item.SharedWith, item.AccessLevel, item.ExpiresAt)
+	if err != nil {
+		return models.SharedVM{}, err
+	}
+	item.ID = grants[0].ID
+	item.SharedWith, item.Status = summarizeShareGrants(grants)
+	item.CreatedAt = grants[0].CreatedAt
+	return item, nil
 }
 
 func (s *ResourceService) ListSharedVMs(ctx context.Context, userID string) ([]models.SharedVM, error) {
@@ -647,13 +969,32 @@ func (s *ResourceService) SharePod(ctx context.Context, item models.SharedPod) (
 	if item.AccessLevel == "" {
 		item.AccessLevel = models.SharedAccessRead
 	}
-	return s.repo.CreateSharedPod(ctx, item)
+	grants, err := s.shareRecipients(ctx, item.OwnerUserID, "pod", item.PodCode, item.SharedWith, item.AccessLevel, item.ExpiresAt)
+	if err != nil {
+		return models.SharedPod{}, err
+	}
+	item.ID = grants[0].ID
+	item.SharedWith, item.Status = summarizeShareGrants(grants)
+	item.CreatedAt = grants[0].CreatedAt
+	return item, nil
 }
 
 func (s *ResourceService) ListSharedPods(ctx context.Context, userID string) ([]models.SharedPod, error) {
 	return s.repo.ListSharedPods(ctx, userID)
 }
 
+func summarizeShareGrants(grants []models.ShareGrant) ([]string, models.ShareGrantStatus) {
+	users := make([]string, 0, len(grants))
+	status := models.ShareGrantActive
+	for _, grant := range grants {
+		users = append(users, grant.GranteeUserID)
+		if grant.Status == models.ShareGrantPending {
+			status = models.ShareGrantPending
+		}
+	}
+	return users, status
+}
+
 func (s *ResourceService) UpsertSharedInventoryOffer(ctx context.Context, item models.SharedInventoryOffer) (models.SharedInventoryOffer, error) {
 	if item.ProviderID == "" || item.ResourceType == "" || item.Title == "" {
 		return models.SharedInventoryOffer{}, errors.New("provider_id, resource_type and title are required")
@@ -664,18 +1005,32 @@ func (s *ResourceService) UpsertSharedInventoryOffer(ctx context.Context, item m
 	if item.Status == "" {
 		item.Status = models.SharedInventoryStatusActive
 	}
-	return s.repo.UpsertSharedInventoryOffer(ctx, item)
+	if err := normalizeOfferPricing(&item, time.Now().UTC()); err != nil {
+		return models.SharedInventoryOffer{}, err
+	}
+	stored, err := s.repo.UpsertSharedInventoryOffer(ctx, item)
+	if err != nil {
+		return models.SharedInventoryOffer{}, err
+	}
+	// A paused auction takes no bids, so the ones waiting for a clearing
+	// expire now; winners keep their capacity until the period ends.
+	if stored.PricingMode == models.OfferPricingAuction && stored.Status == models.SharedInventoryStatusPaused {
+		if err := s.expireOfferBids(ctx, stored.ID, models.OfferBidOpen); err != nil {
+			log.Warn().Err(err).Str("offer_id", stored.ID).Msg("open bids of paused offer could not be expired")
+		}
+	}
+	return stored, nil
 }
 
 func (s *ResourceService) ListSharedInventoryOffers(ctx context.Context, status string, providerID string) ([]models.SharedInventoryOffer, error) {
-	return s.repo.ListSharedInventoryOffers(ctx, status, providerID)
-}
-
-func (s *ResourceService) ReserveSharedInventoryOffer(ctx context.Context, offerID string, quantity int) (models.SharedInventoryOffer, error) {
-	if offerID == "" || quantity <= 0 {
-		return models.SharedInventoryOffer{}, errors.New("offer_id and positive quantity are required")
+	items, err := s.repo.ListSharedInventoryOffers(ctx, status, providerID)
+	if err != nil {
+		return nil, err
 	}
-	return s.repo.ReserveSharedInventoryOffer(ctx, offerID, quantity)
+	if items, err = s.withProviderPresence(ctx, items); err != nil {
+		return nil, err
+	}
+	return s.withProviderVerification(ctx, items)
 }
 
 func (s *ResourceService) RecordHealthCheck(ctx context.Context, item models.HealthCheck) (models.HealthCheck, error) {
@@ -685,7 +1040,12 @@ func (s *ResourceService) RecordHealthCheck(ctx context.Context, item models.Hea
 	if item.CheckedAt.IsZero() {
 		item.CheckedAt = time.Now().UTC()
 	}
-	return s.repo.CreateHealthCheck(ctx, item)
+	created, err := s.repo.CreateHealthCheck(ctx, item)
+	if err != nil {
+		return models.HealthCheck{}, err
+	}
+	s.publishStream(models.StreamEvent{Type: models.StreamEventHealthCheck, ResourceType: created.ResourceType, ResourceID: created.ResourceID, Data: created, At: created.CheckedAt})
+	return created, nil
 }
 
 func (s *ResourceService) ListHealthChecks(ctx context.Context, resourceType string, resourceID string, limit int) ([]models.HealthCheck, error) {
@@ -702,14 +1062,35 @@ func (s *ResourceService) RecordMetric(ctx context.Context, item models.MetricPo
 	if item.CapturedAt.IsZero() {
 		item.CapturedAt = time.Now().UTC()
 	}
-	return s.repo.CreateMetricPoint(ctx, item)
+	created, err := s.repo.CreateMetricPoint(ctx, item)
+	if err != nil {
+		return models.MetricPoint{}, err
+	}
+	s.publishStream(models.StreamEvent{Type: models.StreamEventMetric, ResourceType: created.ResourceType, ResourceID: created.ResourceID, ProviderID: created.ProviderID, Data: created, At: created.CapturedAt})
+	return created, nil
 }
 
-func (s *ResourceService) ListMetrics(ctx context.Context, resourceType string, resourceID string, metricType string, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error) {
+// ListMetrics reads from the tier named by resolution, or from the tier that
+// best fits the requested range when resolution is empty.
+func (s *ResourceService) ListMetrics(ctx context.Context, filter models.MetricFilter, resolution string, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error) {
 	if limit <= 0 {
 		limit = 500
 	}
-	return s.repo.ListMetricPoints(ctx, resourceType, resourceID, metricType, from, to, limit)
+	tier, err := parseMetricResolution(resolution)
+	if err != nil {
+		return nil, err
+	}
+	if tier == "" {
+		tier = s.metricRetention.metricTierFor(time.Now().UTC(), from, to)
+	}
+	return s.listMetricTier(ctx, tier, filter, from, to, limit)
+}
+
+func (s *ResourceService) listMetricTier(ctx context.Context, tier models.MetricResolution, filter models.MetricFilter, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error) {
+	if tier == models.MetricResolutionRaw {
+		return s.repo.ListMetricPoints(ctx, filter, from, to, limit)
+	}
+	return s.repo.ListMetricRollups(ctx, tier, filter, from, to, limit)
 }
 
 func (s *ResourceService) MetricSummaries(ctx context.Context, limit int) ([]models.MetricSummary, error) {
@@ -729,7 +1110,12 @@ func (s *ResourceService) RecordAgentLog(ctx context.Context, item models.AgentL
 	if item.Source == "" {
 		item.Source = "hostagent"
 	}
-	return s.repo.CreateAgentLog(ctx, item)
+	created, err := s.repo.CreateAgentLog(ctx, item)
+	if err != nil {
+		return models.AgentLog{}, err
+	}
+	s.publishStream(models.StreamEvent{Type: models.StreamEventAgentLog, ResourceID: created.ResourceID, ProviderID: created.ProviderID, Data: created, At: created.CreatedAt})
+	return created, nil
 }
 
 func (s *ResourceService) QueueAgentCommand(ctx context.Context, item models.AgentCommand) (models.AgentCommand, error) {
@@ -741,11 +1127,14 @@ func (s *ResourceService) QueueAgentCommand(ctx context.Context, item models.Age
 	default:
 		return models.AgentCommand{}, errors.New("unsupported command")
 	}
+	if err := validateAgentCommandLimits(item); err != nil {
+		return models.AgentCommand{}, err
+	}
 	if item.RequestedBy == "" {
 		item.RequestedBy = "system"
 	}
 	item.Status = models.AgentCommandQueued
-	return s.repo.CreateAgentCommand(ctx, item)
+	return s.createAgentCommand(ctx, item)
 }
 
 func (s *ResourceService) ListAgentCommands(ctx context.Context, providerID string, limit int) ([]models.AgentCommand, error) {
@@ -759,68 +1148,21 @@ func (s *ResourceService) ClaimNextAgentCommand(ctx context.Context, providerID
 	if providerID == "" {
 		return models.AgentCommand{}, errors.New("provider_id is required")
 	}
+	s.touchAgentPoll(ctx, providerID)
 	return s.repo.ClaimNextAgentCommand(ctx, providerID)
 }
 
 func (s *ResourceService) CompleteAgentCommand(ctx context.Context, commandID string, providerID string, status models.AgentCommandState, resultMessage string) (models.AgentCommand, error) {
-	if commandID == "" {
-		return models.AgentCommand{}, errors.New("command id is required")
-	}
-	if providerID == "" {
-		return models.AgentCommand{}, errors.New("provider_id is required")
-	}
 	switch status {
 	case models.AgentCommandSucceeded, models.AgentCommandFailed:
 	default:
 		return models.AgentCommand{}, errors.New("invalid command status")
 	}
-	cmds, err := s.repo.ListAgentCommands(ctx, providerID, 200)
-	if err != nil {
-		return models.AgentCommand{}, err
-	}
-	found := false
-	for _, item := range cmds {
-		if item.ID == commandID {
-			found = true
-			break
-		}
-	}
-	if !found {
-		return models.AgentCommand{}, errors.New("command does not belong to provider")
-	}
-	updated, err := s.repo.CompleteAgentCommand(ctx, commandID, status, resultMessage)
+	cmd, err := s.getProviderAgentCommand(ctx, commandID, providerID)
 	if err != nil {
 		return models.AgentCommand{}, err
 	}
-	if updated.SessionID != "" {
-		switch updated.Command {
-		case models.AgentCommandTerminalOpen:
-			if status == models.AgentCommandSucceeded {
-				_, _ = s.repo.UpdateTerminalSessionStatus(ctx, updated.SessionID, models.TerminalSessionOpen, 0)
-				_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
-					SessionID:  updated.SessionID,
-					ProviderID: updated.ProviderID,
-					UserID:     updated.RequestedBy,
-					EventType:  "terminal_opened",
-					Details:    "agent confirmed terminal open",
-				})
-			}
-		case models.AgentCommandTerminalClose:
-			finalExitCode := 0
-			if status == models.AgentCommandFailed {
-				finalExitCode = 1
-			}
-			_, _ = s.repo.UpdateTerminalSessionStatus(ctx, updated.SessionID, models.TerminalSessionClosed, finalExitCode)
-			_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
-				SessionID:  updated.SessionID,
-				ProviderID: updated.ProviderID,
-				UserID:     updated.RequestedBy,
-				EventType:  "terminal_closed",
-				Details:    strings.TrimSpace(resultMessage),
-			})
-		}
-	}
-	return updated, nil
+	return s.finishAgentCommand(ctx, cmd, status, resultMessage)
 }
 
 func (s *ResourceService) ListAgentLogs(ctx context.Context, providerID string, resourceID string, level string, limit int) ([]models.AgentLog, error) {
@@ -847,14 +1189,16 @@ func (s *ResourceService) CreateTerminalSession(ctx context.Context, userID stri
 	if activeCount >= s.terminalMaxSessions {
 		return models.TerminalSession{}, errors.New("too many active terminal sessions")
 	}
-	providerID, err := s.authorizeTerminalResource(ctx, userID, resourceID)
+	access, err := s.authorizeResourceAccess(ctx, userID, resourceID, models.SharedAccessWrite)
 	if err != nil {
 		return models.TerminalSession{}, err
 	}
+	providerID := access.ProviderID
 	session, err := s.repo.CreateTerminalSession(ctx, models.TerminalSession{
 		ProviderID:   providerID,
 		ResourceID:   resourceID,
 		RenterUserID: userID,
+		GrantID:      access.GrantID,
 		Status:       models.TerminalSessionQueued,
 		Rows:         rows,
 		Cols:         cols,
@@ -866,10 +1210,11 @@ func (s *ResourceService) CreateTerminalSession(ctx context.Context, userID stri
 		SessionID:  session.ID,
 		ProviderID: providerID,
 		UserID:     userID,
+		GrantID:    access.GrantID,
 		EventType:  "terminal_create",
-		Details:    "terminal session requested",
+		Details:    terminalAccessDetails("terminal session requested", access),
 	})
-	_, err = s.repo.CreateAgentCommand(ctx, models.AgentCommand{
+	_, err = s.createAgentCommand(ctx, models.AgentCommand{
 		ProviderID:  providerID,
 		ResourceID:  resourceID,
 		SessionID:   session.ID,
@@ -885,52 +1230,92 @@ func (s *ResourceService) CreateTerminalSession(ctx context.Context, userID stri
 	return session, nil
 }
 
+// GetTerminalSession returns a session to its renter, or to anyone holding at
+// least read access to the resource. Viewing through a grant is audited.
 func (s *ResourceService) GetTerminalSession(ctx context.Context, userID string, sessionID string) (models.TerminalSession, error) {
-	session, err := s.repo.GetTerminalSession(ctx, sessionID)
+	session, access, err := s.viewTerminalSession(ctx, userID, sessionID)
 	if err != nil {
 		return models.TerminalSession{}, err
 	}
-	if session.RenterUserID != userID {
-		return models.TerminalSession{}, errors.New("forbidden session access")
+	if session.RenterUserID != userID && access.GrantID != "" {
+		_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+			SessionID:  session.ID,
+			ProviderID: session.ProviderID,
+			UserID:     userID,
+			GrantID:    access.GrantID,
+			EventType:  "terminal_view",
+			Details:    terminalAccessDetails("session viewed", access),
+		})
 	}
 	return session, nil
 }
 
-func (s *ResourceService) WriteTerminalInput(ctx context.Context, userID string, sessionID string, data string) (models.TerminalChunk, error) {
-	session, err := s.GetTerminalSession(ctx, userID, sessionID)
+func (s *ResourceService) ListTerminalSessions(ctx context.Context, userID string, resourceID string) ([]models.TerminalSession, error) {
+	if _, err := s.authorizeResourceAccess(ctx, userID, resourceID, models.SharedAccessRead); err != nil {
+		return nil, err
+	}
+	return s.repo.ListTerminalSessions(ctx, resourceID, 50)
+}
+
+func (s *ResourceService) viewTerminalSession(ctx context.Context, userID string, sessionID string) (models.TerminalSession, resourceAccess, error) {
+	session, err := s.repo.GetTerminalSession(ctx, sessionID)
 	if err != nil {
-		return models.TerminalChunk{}, err
+		return models.TerminalSession{}, resourceAccess{}, err
 	}
-	if session.Status == models.TerminalSessionClosed || session.Status == models.TerminalSessionExpired {
-		return models.TerminalChunk{}, errors.New("terminal session is closed")
+	if session.RenterUserID == userID && session.GrantID == "" {
+		return session, resourceAccess{}, nil
 	}
-	if strings.TrimSpace(data) == "" {
-		return models.TerminalChunk{}, errors.New("input payload is empty")
+	access, err := s.authorizeResourceAccess(ctx, userID, session.ResourceID, models.SharedAccessRead)
+	if err != nil {
+		return models.TerminalSession{}, resourceAccess{}, errors.New("forbidden session access")
 	}
-	chunk, err := s.repo.AppendTerminalChunk(ctx, models.TerminalChunk{
-		SessionID:  session.ID,
-		ProviderID: session.ProviderID,
-		Direction:  models.TerminalChunkInput,
-		Data:       data,
-	})
+	return session, access, nil
+}
+
+// controlTerminalSession allows closing and inviting only to the renter. A
+// session opened through a share grant is re-checked so a revoked or downgraded
+// grant stops working immediately.
+func (s *ResourceService) controlTerminalSession(ctx context.Context, userID string, sessionID string) (models.TerminalSession, resourceAccess, error) {
+	session, err := s.repo.GetTerminalSession(ctx, sessionID)
 	if err != nil {
-		return models.TerminalChunk{}, err
+		return models.TerminalSession{}, resourceAccess{}, err
 	}
-	_, err = s.repo.CreateAgentCommand(ctx, models.AgentCommand{
-		ProviderID:  session.ProviderID,
-		ResourceID:  session.ResourceID,
-		SessionID:   session.ID,
-		Command:     models.AgentCommandTerminalData,
-		Payload:     data,
-		Status:      models.AgentCommandQueued,
-		RequestedBy: userID,
-	})
+	if session.RenterUserID != userID {
+		return models.TerminalSession{}, resourceAccess{}, errors.New("forbidden session access")
+	}
+	if session.GrantID == "" {
+		return session, resourceAccess{}, nil
+	}
+	access, err := s.authorizeResourceAccess(ctx, userID, session.ResourceID, models.SharedAccessWrite)
+	if err != nil {
+		return models.TerminalSession{}, resourceAccess{}, err
+	}
+	return session, access, nil
+}
+
+func terminalAccessDetails(details string, access resourceAccess) string {
+	if access.GrantID == "" {
+		return details
+	}
+	return fmt.Sprintf("%s via %s grant %s", details, access.Level, access.GrantID)
+}
+
+func (s *ResourceService) WriteTerminalInput(ctx context.Context, userID string, sessionID string, data string) (models.TerminalChunk, error) {
+	session, access, err := s.driveTerminalSession(ctx, userID, sessionID)
 	if err != nil {
 		return models.TerminalChunk{}, err
 	}
-	return chunk, nil
+	if terminalSessionEnded(session.Status) {
+		return models.TerminalChunk{}, errors.New("terminal session is closed")
+	}
+	if strings.TrimSpace(data) == "" {
+		return models.TerminalChunk{}, errors.New("input payload is empty")
+	}
+	return s.deliverTerminalInput(ctx, session, access, userID, data)
 }
 
+// ListTerminalOutput reads stored output and adds the chunks this instance
+// has sequenced but not written yet.
 func (s *ResourceService) ListTerminalOutput(ctx context.Context, userID string, sessionID string, afterSeq int64, limit int) ([]models.TerminalChunk, error) {
 	if limit <= 0 {
 		limit = 200
@@ -938,62 +1323,50 @@ func (s *ResourceService) ListTerminalOutput(ctx context.Context, userID string,
 	if limit > 1000 {
 		limit = 1000
 	}
-	if _, err := s.GetTerminalSession(ctx, userID, sessionID); err != nil {
+	if _, _, err := s.viewTerminalSession(ctx, userID, sessionID); err != nil {
 		return nil, err
 	}
-	return s.repo.ListTerminalChunks(ctx, sessionID, models.TerminalChunkOutput, afterSeq, limit)
+	chunks, err := s.repo.ListTerminalChunks(ctx, sessionID, models.TerminalChunkOutput, afterSeq, limit)
+	if err != nil || len(chunks) >= limit {
+		return chunks, err
+	}
+	last := afterSeq
+	if len(chunks) > 0 {
+		last = chunks[len(chunks)-1].Seq
+	}
+	for _, chunk := range s.terminals.recentAfter(sessionID, last) {
+		if len(chunks) >= limit {
+			break
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
 }
 
+// RecordTerminalOutput streams output to the session's viewers at once; the
+// chunk is written in the background.
 func (s *ResourceService) RecordTerminalOutput(ctx context.Context, providerID string, sessionID string, data string) (models.TerminalChunk, error) {
-	session, err := s.repo.GetTerminalSession(ctx, sessionID)
-	if err != nil {
-		return models.TerminalChunk{}, err
-	}
-	if session.ProviderID != providerID {
-		return models.TerminalChunk{}, errors.New("provider mismatch for terminal output")
-	}
-	chunk, err := s.repo.AppendTerminalChunk(ctx, models.TerminalChunk{
-		SessionID:  session.ID,
+	return s.sequenceTerminalChunk(ctx, models.TerminalChunk{
+		SessionID:  sessionID,
 		ProviderID: providerID,
 		Direction:  models.TerminalChunkOutput,
 		Data:       data,
 	})
-	if err != nil {
-		return models.TerminalChunk{}, err
-	}
-	return chunk, nil
 }
 
 func (s *ResourceService) ResizeTerminalSession(ctx context.Context, userID string, sessionID string, rows int, cols int) (models.TerminalSession, error) {
 	if rows <= 0 || cols <= 0 {
 		return models.TerminalSession{}, errors.New("rows and cols must be positive")
 	}
-	session, err := s.GetTerminalSession(ctx, userID, sessionID)
-	if err != nil {
-		return models.TerminalSession{}, err
-	}
-	updated, err := s.repo.UpdateTerminalSessionSize(ctx, sessionID, rows, cols)
-	if err != nil {
-		return models.TerminalSession{}, err
-	}
-	_, err = s.repo.CreateAgentCommand(ctx, models.AgentCommand{
-		ProviderID:  session.ProviderID,
-		ResourceID:  session.ResourceID,
-		SessionID:   session.ID,
-		Command:     models.AgentCommandTerminalResize,
-		Rows:        rows,
-		Cols:        cols,
-		Status:      models.AgentCommandQueued,
-		RequestedBy: userID,
-	})
+	session, access, err := s.driveTerminalSession(ctx, userID, sessionID)
 	if err != nil {
 		return models.TerminalSession{}, err
 	}
-	return updated, nil
+	return s.resizeTerminal(ctx, session, access, userID, rows, cols)
 }
 
 func (s *ResourceService) CloseTerminalSession(ctx context.Context, userID string, sessionID string) (models.TerminalSession, error) {
-	session, err := s.GetTerminalSession(ctx, userID, sessionID)
+	session, access, err := s.controlTerminalSession(ctx, userID, sessionID)
 	if err != nil {
 		return models.TerminalSession{}, err
 	}
@@ -1001,14 +1374,16 @@ func (s *ResourceService) CloseTerminalSession(ctx context.Context, userID strin
 	if err != nil {
 		return models.TerminalSession{}, err
 	}
+	s.terminals.finish(sessionID, models.TerminalSessionClosed)
 	_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
 		SessionID:  sessionID,
 		ProviderID: session.ProviderID,
 		UserID:     userID,
+		GrantID:    access.GrantID,
 		EventType:  "terminal_close_request",
-		Details:    "close requested by renter",
+		Details:    terminalAccessDetails("close requested by renter", access),
 	})
-	_, err = s.repo.CreateAgentCommand(ctx, models.AgentCommand{
+	_, err = s.createAgentCommand(ctx, models.AgentCommand{
 		ProviderID:  session.ProviderID,
 		ResourceID:  session.ResourceID,
 		SessionID:   session.ID,
@@ -1029,14 +1404,16 @@ func (s *ResourceService) ExpireTerminalSessions(ctx context.Context, now time.T
 		return err
 	}
 	for _, item := range expired {
+		s.terminals.finish(item.ID, models.TerminalSessionExpired)
 		_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
 			SessionID:  item.ID,
 			ProviderID: item.ProviderID,
 			UserID:     item.RenterUserID,
+			GrantID:    item.GrantID,
 			EventType:  "terminal_expired",
 			Details:    "idle timeout reached",
 		})
-		_, _ = s.repo.CreateAgentCommand(ctx, models.AgentCommand{
+		_, _ = s.createAgentCommand(ctx, models.AgentCommand{
 			ProviderID:  item.ProviderID,
 			ResourceID:  item.ResourceID,
 			SessionID:   item.ID,
@@ -1048,30 +1425,6 @@ func (s *ResourceService) ExpireTerminalSessions(ctx context.Context, now time.T
 	return nil
 }
 
-func (s *ResourceService) authorizeTerminalResource(ctx context.Context, userID string, resourceID string) (string, error) {
-	vm, err := s.repo.GetVM(ctx, resourceID)
-	if err == nil {
-		if vm.UserID != userID {
-			return "", errors.New("forbidden: user does not own vm")
-		}
-		return vm.ProviderID, nil
-	}
-	pod, podErr := s.repo.GetPod(ctx, resourceID)
-	if podErr == nil {
-		if pod.UserID != userID {
-			return "", errors.New("forbidden: user does not own pod")
-		}
-		return pod.ProviderID, nil
-	}
-	if errors.Is(err, pgx.ErrNoRows) || errors.Is(podErr, pgx.ErrNoRows) {
-		return "", errors.New("resource not found for terminal access")
-	}
-	if podErr != nil {
-		return "", podErr
-	}
-	return "", err
-}
-
 func (s *ResourceService) RecordRootInputLog(ctx context.Context, item models.RootInputLog) (models.RootInputLog, error) {
 	if item.ProviderID == "" || item.ResourceID == "" || item.Command == "" {
 		return models.RootInputLog{}, errors.New("provider_id, resource_id and command are required")
@@ -1141,7 +1494,9 @@ func (s *ResourceService) ExpireResources(ctx context.Context, now time.Time) er
 				continue
 			}
 		}
-		_ = s.repo.MarkVMExpired(ctx, vm.ID)
+		if err := s.repo.MarkVMExpired(ctx, vm.ID); err == nil {
+			s.publishResourceState("vm", vm.ID, vm.ProviderID, models.StreamState{Status: string(models.VMStatusExpired)})
+		}
 		log.Info().Str("vm_id", vm.ID).Msg("expired vm marked")
 	}
 
@@ -1152,7 +1507,14 @@ func (s *ResourceService) ExpireResources(ctx context.Context, now time.Time) er
 	}
 	log.Info().Int("expired_pod_count", len(expiredPods)).Msg("resource expiry found expired pods")
 	for _, pod := range expiredPods {
-		if strings.TrimSpace(pod.ExternalID) != "" {
+		if pod.Backend == models.PodBackendLocal {
+			if pod.Status == models.PodStatusRunning {
+				if err := s.stopLocalPod(ctx, pod, "system"); err != nil {
+					log.Warn().Err(err).Str("pod_id", pod.ID).Msg("resource expiry could not queue local pod stop")
+					continue
+				}
+			}
+		} else if strings.TrimSpace(pod.ExternalID) != "" {
 			if err := s.provisioning.DeletePod(ctx, pod.ExternalID, provisioning.DeleteRequest{
 				RequestID: uuid.NewString(),
 				TraceID:   uuid.NewString(),
@@ -1161,12 +1523,44 @@ func (s *ResourceService) ExpireResources(ctx context.Context, now time.Time) er
 				continue
 			}
 		}
-		_ = s.repo.MarkPodExpired(ctx, pod.ID)
+		if err := s.repo.MarkPodExpired(ctx, pod.ID); err == nil {
+			s.publishResourceState("pod", pod.ID, pod.ProviderID, models.StreamState{Status: string(models.PodStatusExpired)})
+		}
 		log.Info().Str("pod_id", pod.ID).Msg("expired pod marked")
 	}
+	if err := s.SyncLocalPods(ctx); err != nil {
+		log.Warn().Err(err).Msg("local pod sync pass failed")
+	}
+	if err := s.SweepAgentCommands(ctx, now); err != nil {
+		log.Warn().Err(err).Msg("agent command sweep failed")
+	}
 	if err := s.ExpireTerminalSessions(ctx, now); err != nil {
 		log.Warn().Err(err).Msg("terminal session expiry pass failed")
 	}
+	if err := s.sweepTerminalStreams(ctx); err != nil {
+		log.Warn().Err(err).Msg("terminal stream sweep failed")
+	}
+	if err := s.PurgeTerminalRecordings(ctx, now); err != nil {
+		log.Warn().Err(err).Msg("terminal recording retention pass failed")
+	}
+	if err := s.ExpireShareGrants(ctx, now); err != nil {
+		log.Warn().Err(err).Msg("share grant expiry pass failed")
+	}
+	if err := s.ExpireOfferHolds(ctx, now); err != nil {
+		log.Warn().Err(err).Msg("offer hold expiry pass failed")
+	}
+	if err := s.ClearAuctions(ctx, now); err != nil {
+		log.Warn().Err(err).Msg("auction clearing pass failed")
+	}
+	if err := s.PruneResourceLogs(ctx, now); err != nil {
+		log.Warn().Err(err).Msg("resource log retention pass failed")
+	}
+	if err := s.ExpireFileTransfers(ctx, now); err != nil {
+		log.Warn().Err(err).Msg("file transfer expiry pass failed")
+	}
+	if err := s.AdvanceRollouts(ctx); err != nil {
+		log.Warn().Err(err).Msg("rollout advance pass failed")
+	}
 	log.Debug().Msg("resource expiry pass completed")
 	return nil
 }
@@ -2,34 +2,115 @@ package service
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/billing"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/orchestrator"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/provisioning"
 	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/MidasWR/ShareMTC/services/sdk/agentexec"
+	"github.com/MidasWR/ShareMTC/services/sdk/agentupdate"
+	"github.com/MidasWR/ShareMTC/services/sdk/capacity"
+	"github.com/MidasWR/ShareMTC/services/sdk/filetransfer"
+	"github.com/jackc/pgx/v5"
 )
 
 type repoStub struct {
-	resource      models.HostResource
-	vm            models.VM
-	pods          []models.Pod
-	rootInputLogs []models.RootInputLog
-	createEvents  int
-	sharedVMs     []models.SharedVM
-	sharedPods    []models.SharedPod
-	k8sByID       map[string]models.KubernetesCluster
-	templates     []models.VMTemplate
-	healthChecks  []models.HealthCheck
-	metricPoints  []models.MetricPoint
-	sharedOffers  []models.SharedInventoryOffer
-	agentLogs     []models.AgentLog
-	agentCommands []models.AgentCommand
-	terminalByID  map[string]models.TerminalSession
-	terminalInput []models.TerminalChunk
-	terminalOut   []models.TerminalChunk
-	terminalAudit []models.TerminalAuditEvent
+	resource       models.HostResource
+	vm             models.VM
+	pods           []models.Pod
+	rootInputLogs  []models.RootInputLog
+	createEvents   int
+	sharedVMs      []models.SharedVM
+	sharedPods     []models.SharedPod
+	k8sByID        map[string]models.KubernetesCluster
+	templates      []models.VMTemplate
+	healthChecks   []models.HealthCheck
+	metricPoints   []models.MetricPoint
+	sharedOffers   []models.SharedInventoryOffer
+	agentLogs      []models.AgentLog
+	agentCommands  []models.AgentCommand
+	terminalByID   map[string]models.TerminalSession
+	terminalMu     sync.Mutex
+	terminalSeqs   map[string]int64
+	terminalInput  []models.TerminalChunk
+	terminalOut    []models.TerminalChunk
+	terminalAudit  []models.TerminalAuditEvent
+	participants   []models.TerminalParticipant
+	allocations    []models.Allocation
+	resourceLogs   []models.ResourceLog
+	shareGrants    []models.ShareGrant
+	shareAudit     []models.ShareAuditEvent
+	bookings       []models.OfferBooking
+	bookingMu      sync.Mutex
+	bids           []models.OfferBid
+	clearings      []models.AuctionClearing
+	metricRollups  []models.MetricPoint
+	watermarks     map[models.MetricResolution]time.Time
+	hosts          []models.HostResource
+	alertRules     []models.AlertRule
+	alerts         []models.Alert
+	silences       []models.AlertSilence
+	probes         []models.HealthProbe
+	probesSeeded   map[string]bool
+	presence       map[string]models.ProviderPresence
+	presenceLog    []models.ProviderPresenceEvent
+	slaReports     []models.SLAReport
+	enrollments    map[string]models.AgentEnrollment
+	agentHosts     map[string]models.AgentHost
+	challenges     map[string]models.CapacityChallenge
+	verifications  map[string]models.HostVerification
+	gpuDevices     map[string]models.GPUDevice
+	execPolicies   map[string]models.ExecPolicy
+	execRuns       map[string]models.ExecRun
+	fileTransfers  map[string]models.FileTransfer
+	fileChunks     map[string][]models.FileTransferChunk
+	rollouts       map[string]models.Rollout
+	rolloutTargets map[string][]models.RolloutTarget
+	streamMu       sync.Mutex
+	streamEvents   []models.StreamRelayEvent
+}
+
+func (r *repoStub) AppendStreamEvents(_ context.Context, origin string, payloads [][]byte) error {
+	r.streamMu.Lock()
+	defer r.streamMu.Unlock()
+	for _, payload := range payloads {
+		r.streamEvents = append(r.streamEvents, models.StreamRelayEvent{ID: int64(len(r.streamEvents) + 1), Origin: origin, Payload: payload})
+	}
+	return nil
+}
+func (r *repoStub) LatestStreamEventID(context.Context) (int64, error) {
+	r.streamMu.Lock()
+	defer r.streamMu.Unlock()
+	return int64(len(r.streamEvents)), nil
+}
+func (r *repoStub) ListStreamEvents(_ context.Context, afterID int64, limit int) ([]models.StreamRelayEvent, error) {
+	r.streamMu.Lock()
+	defer r.streamMu.Unlock()
+	out := make([]models.StreamRelayEvent, 0)
+	for _, item := range r.streamEvents {
+		if item.ID > afterID && len(out) < limit {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) DeleteStreamEventsBefore(context.Context, time.Time) (int64, error) {
+	return 0, nil
 }
 
 func (r *repoStub) UpsertHostResource(_ context.Context, resource models.HostResource) error {
@@ -40,13 +121,22 @@ func (r *repoStub) GetHostResource(_ context.Context, _ string) (models.HostReso
 	return r.resource, nil
 }
 func (r *repoStub) CreateAllocation(_ context.Context, alloc models.Allocation) (models.Allocation, error) {
-	alloc.ID = "a1"
+	alloc.ID = fmt.Sprintf("a%d", len(r.allocations)+1)
 	alloc.StartedAt = time.Now().UTC()
+	r.allocations = append(r.allocations, alloc)
 	return alloc, nil
 }
-func (r *repoStub) ReleaseAllocation(_ context.Context, _ string) error { return nil }
+func (r *repoStub) ReleaseAllocation(_ context.Context, allocationID string) error {
+	for i := range r.allocations {
+		if r.allocations[i].ID == allocationID {
+			releasedAt := time.Now().UTC()
+			r.allocations[i].ReleasedAt = &releasedAt
+		}
+	}
+	return nil
+}
 func (r *repoStub) ListAllocations(_ context.Context, _ string) ([]models.Allocation, error) {
-	return nil, nil
+	return r.allocations, nil
 }
 func (r *repoStub) ListAllAllocations(_ context.Context, _ int, _ int) ([]models.Allocation, error) {
 	return nil, nil
@@ -140,6 +230,15 @@ func (r *repoStub) ListPods(_ context.Context, _ string, _ models.CatalogFilter)
 func (r *repoStub) ListAllPods(_ context.Context, _ int) ([]models.Pod, error) {
 	return r.pods, nil
 }
+func (r *repoStub) ListRunningLocalPods(_ context.Context) ([]models.Pod, error) {
+	out := make([]models.Pod, 0)
+	for _, pod := range r.pods {
+		if pod.Backend == models.PodBackendLocal && pod.Status == models.PodStatusRunning {
+			out = append(out, pod)
+		}
+	}
+	return out, nil
+}
 func (r *repoStub) UpdatePodStatus(_ context.Context, podID string, status models.PodStatus) error {
 	for i := range r.pods {
 		if r.pods[i].ID == podID {
@@ -150,10 +249,22 @@ func (r *repoStub) UpdatePodStatus(_ context.Context, podID string, status model
 	}
 	return errors.New("not found")
 }
-func (r *repoStub) UpdatePodExternalRef(_ context.Context, podID string, externalID string) error {
+func (r *repoStub) UpdatePodExternalRef(_ context.Context, podID string, externalID string, ipAddress string) error {
 	for i := range r.pods {
 		if r.pods[i].ID == podID {
 			r.pods[i].ExternalID = externalID
+			if ipAddress != "" {
+				r.pods[i].IPAddress = ipAddress
+			}
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+func (r *repoStub) UpdatePodPorts(_ context.Context, podID string, ports []models.PodPort) error {
+	for i := range r.pods {
+		if r.pods[i].ID == podID {
+			r.pods[i].Ports = append([]models.PodPort(nil), ports...)
 			return nil
 		}
 	}
@@ -176,26 +287,101 @@ func (r *repoStub) MarkPodExpired(_ context.Context, podID string) error {
 	}
 	return nil
 }
-func (r *repoStub) CreateSharedVM(_ context.Context, item models.SharedVM) (models.SharedVM, error) {
-	item.ID = "svm-1"
-	r.sharedVMs = append(r.sharedVMs, item)
-	return item, nil
-}
 func (r *repoStub) ListSharedVMs(_ context.Context, _ string) ([]models.SharedVM, error) {
 	return r.sharedVMs, nil
 }
-func (r *repoStub) CreateSharedPod(_ context.Context, item models.SharedPod) (models.SharedPod, error) {
-	item.ID = "spod-1"
-	r.sharedPods = append(r.sharedPods, item)
-	return item, nil
-}
 func (r *repoStub) ListSharedPods(_ context.Context, _ string) ([]models.SharedPod, error) {
 	return r.sharedPods, nil
 }
+func (r *repoStub) CreateShareGrant(_ context.Context, item models.ShareGrant) (models.ShareGrant, error) {
+	item.ID = fmt.Sprintf("grant-%d", len(r.shareGrants)+1)
+	item.CreatedAt = time.Now().UTC()
+	item.UpdatedAt = item.CreatedAt
+	r.shareGrants = append(r.shareGrants, item)
+	return item, nil
+}
+func (r *repoStub) CreateShareGrants(ctx context.Context, items []models.ShareGrant) ([]models.ShareGrant, error) {
+	out := make([]models.ShareGrant, 0, len(items))
+	for _, item := range items {
+		created, _ := r.CreateShareGrant(ctx, item)
+		out = append(out, created)
+	}
+	return out, nil
+}
+func (r *repoStub) GetShareGrant(_ context.Context, resourceType string, grantID string) (models.ShareGrant, error) {
+	for _, item := range r.shareGrants {
+		if item.ID == grantID && item.ResourceType == resourceType {
+			return item, nil
+		}
+	}
+	return models.ShareGrant{}, errors.New("not found")
+}
+func (r *repoStub) ListShareGrants(_ context.Context, resourceType string, resourceID string) ([]models.ShareGrant, error) {
+	out := make([]models.ShareGrant, 0)
+	for _, item := range r.shareGrants {
+		if item.ResourceType == resourceType && item.ResourceID == resourceID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) ListShareGrantsForGrantee(_ context.Context, userID string) ([]models.ShareGrant, error) {
+	out := make([]models.ShareGrant, 0)
+	for _, item := range r.shareGrants {
+		if item.GranteeUserID == userID && (item.Status == models.ShareGrantPending || item.Status == models.ShareGrantActive) {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) UpdateShareGrant(_ context.Context, item models.ShareGrant) (models.ShareGrant, error) {
+	for i := range r.shareGrants {
+		if r.shareGrants[i].ID == item.ID {
+			item.UpdatedAt = time.Now().UTC()
+			r.shareGrants[i] = item
+			return item, nil
+		}
+	}
+	return models.ShareGrant{}, errors.New("not found")
+}
+func (r *repoStub) ExpireShareGrants(_ context.Context, now time.Time, _ int) ([]models.ShareGrant, error) {
+	out := make([]models.ShareGrant, 0)
+	for i := range r.shareGrants {
+		item := &r.shareGrants[i]
+		if (item.Status == models.ShareGrantPending || item.Status == models.ShareGrantActive) && item.ExpiresAt != nil && !item.ExpiresAt.After(now) {
+			item.Status = models.ShareGrantExpired
+			out = append(out, *item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) CreateShareAuditEvent(_ context.Context, event models.ShareAuditEvent) (models.ShareAuditEvent, error) {
+	event.ID = fmt.Sprintf("share-audit-%d", len(r.shareAudit)+1)
+	r.shareAudit = append(r.shareAudit, event)
+	return event, nil
+}
+func (r *repoStub) ListShareAuditEvents(_ context.Context, resourceType string, resourceID string, _ int) ([]models.ShareAuditEvent, error) {
+	out := make([]models.ShareAuditEvent, 0)
+	for _, item := range r.shareAudit {
+		if item.ResourceType == resourceType && item.ResourceID == resourceID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
 func (r *repoStub) UpsertSharedInventoryOffer(_ context.Context, item models.SharedInventoryOffer) (models.SharedInventoryOffer, error) {
 	if item.ID == "" {
 		item.ID = "offer-1"
 	}
+	for i := range r.sharedOffers {
+		if r.sharedOffers[i].ID == item.ID {
+			if item.PricingMode == models.OfferPricingAuction && r.sharedOffers[i].NextClearingAt != nil {
+				item.NextClearingAt = r.sharedOffers[i].NextClearingAt
+			}
+			r.sharedOffers[i] = item
+			return item, nil
+		}
+	}
 	r.sharedOffers = append(r.sharedOffers, item)
 	return item, nil
 }
@@ -212,17 +398,215 @@ func (r *repoStub) ListSharedInventoryOffers(_ context.Context, status string, p
 	}
 	return out, nil
 }
-func (r *repoStub) ReserveSharedInventoryOffer(_ context.Context, offerID string, quantity int) (models.SharedInventoryOffer, error) {
+func (r *repoStub) GetSharedInventoryOffer(_ context.Context, offerID string) (models.SharedInventoryOffer, error) {
+	for _, item := range r.sharedOffers {
+		if item.ID == offerID {
+			return item, nil
+		}
+	}
+	return models.SharedInventoryOffer{}, errors.New("not found")
+}
+func (r *repoStub) CreateOfferBooking(_ context.Context, item models.OfferBooking) (models.OfferBooking, error) {
 	for i := range r.sharedOffers {
-		if r.sharedOffers[i].ID == offerID {
-			if r.sharedOffers[i].AvailableQty < quantity {
-				return models.SharedInventoryOffer{}, errors.New("insufficient available quantity")
+		offer := &r.sharedOffers[i]
+		if offer.ID != item.OfferID {
+			continue
+		}
+		if offer.PricingMode == models.OfferPricingAuction || offer.AvailableQty < item.Quantity {
+			return models.OfferBooking{}, errors.New("offer not found or insufficient available quantity")
+		}
+		offer.AvailableQty -= item.Quantity
+		item.ID = fmt.Sprintf("booking-%d", len(r.bookings)+1)
+		item.ProviderID = offer.ProviderID
+		item.PriceHourly = offer.PriceHourly
+		item.CreatedAt = time.Now().UTC()
+		r.bookings = append(r.bookings, item)
+		return item, nil
+	}
+	return models.OfferBooking{}, errors.New("offer not found or insufficient available quantity")
+}
+func (r *repoStub) GetOfferBooking(_ context.Context, bookingID string) (models.OfferBooking, error) {
+	r.bookingMu.Lock()
+	defer r.bookingMu.Unlock()
+	for _, item := range r.bookings {
+		if item.ID == bookingID {
+			return item, nil
+		}
+	}
+	return models.OfferBooking{}, errors.New("not found")
+}
+func (r *repoStub) ListOfferBookings(_ context.Context, userID string, status string, _ int) ([]models.OfferBooking, error) {
+	out := make([]models.OfferBooking, 0)
+	for _, item := range r.bookings {
+		if (userID == "" || item.UserID == userID) && (status == "" || string(item.Status) == status) {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) ClaimOfferBooking(_ context.Context, bookingID string, now time.Time) (models.OfferBooking, error) {
+	r.bookingMu.Lock()
+	defer r.bookingMu.Unlock()
+	for i := range r.bookings {
+		item := &r.bookings[i]
+		if item.ID == bookingID && item.Status == models.OfferBookingHeld && item.HoldExpiresAt.After(now) {
+			item.Status = models.OfferBookingConfirming
+			return *item, nil
+		}
+	}
+	return models.OfferBooking{}, errors.New("booking is no longer held")
+}
+func (r *repoStub) UnclaimOfferBooking(_ context.Context, bookingID string) error {
+	r.bookingMu.Lock()
+	defer r.bookingMu.Unlock()
+	for i := range r.bookings {
+		item := &r.bookings[i]
+		if item.ID == bookingID && item.Status == models.OfferBookingConfirming {
+			item.Status = models.OfferBookingHeld
+		}
+	}
+	return nil
+}
+func (r *repoStub) ConfirmOfferBooking(_ context.Context, bookingID string, allocationID string, rentalID string) (models.OfferBooking, error) {
+	r.bookingMu.Lock()
+	defer r.bookingMu.Unlock()
+	for i := range r.bookings {
+		item := &r.bookings[i]
+		if item.ID == bookingID && item.Status == models.OfferBookingConfirming {
+			now := time.Now().UTC()
+			item.Status = models.OfferBookingConfirmed
+			item.AllocationID = allocationID
+			item.BillingRentalID = rentalID
+			item.ConfirmedAt = &now
+			return *item, nil
+		}
+	}
+	return models.OfferBooking{}, errors.New("booking is no longer being confirmed")
+}
+func (r *repoStub) CloseOfferBooking(_ context.Context, bookingID string, from []models.OfferBookingStatus, to models.OfferBookingStatus) (models.OfferBooking, models.OfferBookingStatus, error) {
+	for i := range r.bookings {
+		item := &r.bookings[i]
+		if item.ID != bookingID {
+			continue
+		}
+		for _, status := range from {
+			if item.Status != status {
+				continue
+			}
+			if status == models.OfferBookingHeld || status == models.OfferBookingConfirming || status == models.OfferBookingConfirmed {
+				r.returnOfferQuantity(item.OfferID, item.Quantity)
 			}
-			r.sharedOffers[i].AvailableQty -= quantity
-			return r.sharedOffers[i], nil
+			now := time.Now().UTC()
+			item.Status = to
+			item.ClosedAt = &now
+			return *item, status, nil
 		}
 	}
-	return models.SharedInventoryOffer{}, errors.New("not found")
+	return models.OfferBooking{}, "", fmt.Errorf("booking cannot move to %s from its current status", to)
+}
+func (r *repoStub) ExpireOfferHolds(_ context.Context, now time.Time, _ int) ([]models.OfferBooking, error) {
+	out := make([]models.OfferBooking, 0)
+	for i := range r.bookings {
+		item := &r.bookings[i]
+		stuck := item.Status == models.OfferBookingConfirming && !item.HoldExpiresAt.After(now.Add(-10*time.Minute))
+		if (item.Status == models.OfferBookingHeld && !item.HoldExpiresAt.After(now)) || stuck {
+			item.Status = models.OfferBookingReleased
+			r.returnOfferQuantity(item.OfferID, item.Quantity)
+			out = append(out, *item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) returnOfferQuantity(offerID string, quantity int) {
+	for i := range r.sharedOffers {
+		if r.sharedOffers[i].ID == offerID {
+			r.sharedOffers[i].AvailableQty += quantity
+		}
+	}
+}
+func (r *repoStub) CreateOfferBid(_ context.Context, item models.OfferBid) (models.OfferBid, error) {
+	item.ID = fmt.Sprintf("bid-%d", len(r.bids)+1)
+	item.CreatedAt = time.Now().UTC().Add(time.Duration(len(r.bids)) * time.Millisecond)
+	r.bids = append(r.bids, item)
+	return item, nil
+}
+func (r *repoStub) GetOfferBid(_ context.Context, bidID string) (models.OfferBid, error) {
+	for _, item := range r.bids {
+		if item.ID == bidID {
+			return item, nil
+		}
+	}
+	return models.OfferBid{}, errors.New("not found")
+}
+func (r *repoStub) ListOfferBids(_ context.Context, offerID string, userID string, statuses []models.OfferBidStatus, _ int) ([]models.OfferBid, error) {
+	out := make([]models.OfferBid, 0)
+	for _, item := range r.bids {
+		if (offerID != "" && item.OfferID != offerID) || (userID != "" && item.UserID != userID) {
+			continue
+		}
+		if len(statuses) > 0 && !slices.Contains(statuses, item.Status) {
+			continue
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+func (r *repoStub) UpdateOfferBid(_ context.Context, item models.OfferBid, from models.OfferBidStatus) (models.OfferBid, error) {
+	for i := range r.bids {
+		if r.bids[i].ID == item.ID && r.bids[i].Status == from {
+			r.bids[i].Status = item.Status
+			r.bids[i].AllocatedQty = item.AllocatedQty
+			r.bids[i].ClearingPriceUSD = item.ClearingPriceUSD
+			r.bids[i].AllocationID = item.AllocationID
+			r.bids[i].BillingRentalID = item.BillingRentalID
+			return r.bids[i], nil
+		}
+	}
+	return models.OfferBid{}, fmt.Errorf("bid is no longer %s", from)
+}
+func (r *repoStub) ReturnOfferQuantity(_ context.Context, offerID string, quantity int) error {
+	r.returnOfferQuantity(offerID, quantity)
+	return nil
+}
+func (r *repoStub) ListDueAuctionOffers(_ context.Context, now time.Time, _ int) ([]models.SharedInventoryOffer, error) {
+	out := make([]models.SharedInventoryOffer, 0)
+	for _, item := range r.sharedOffers {
+		if item.PricingMode == models.OfferPricingAuction && item.NextClearingAt != nil && !item.NextClearingAt.After(now) {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) ClaimAuctionPeriod(_ context.Context, offerID string, due time.Time, next time.Time) (bool, error) {
+	for i := range r.sharedOffers {
+		offer := &r.sharedOffers[i]
+		if offer.ID == offerID && offer.NextClearingAt != nil && offer.NextClearingAt.Equal(due) {
+			offer.NextClearingAt = &next
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (r *repoStub) RecordAuctionClearing(_ context.Context, item models.AuctionClearing) (models.AuctionClearing, error) {
+	for i := range r.sharedOffers {
+		offer := &r.sharedOffers[i]
+		if offer.ID == item.OfferID {
+			offer.LastClearingPriceUSD = item.ClearingPriceUSD
+			offer.AvailableQty = max(0, offer.Quantity-item.AllocatedQty)
+		}
+	}
+	item.CreatedAt = time.Now().UTC()
+	r.clearings = append(r.clearings, item)
+	return item, nil
+}
+func (r *repoStub) ListAuctionClearings(_ context.Context, offerID string, _ int) ([]models.AuctionClearing, error) {
+	out := make([]models.AuctionClearing, 0)
+	for i := len(r.clearings) - 1; i >= 0; i-- {
+		if r.clearings[i].OfferID == offerID {
+			out = append(out, r.clearings[i])
+		}
+	}
+	return out, nil
 }
 func (r *repoStub) CreateHealthCheck(_ context.Context, item models.HealthCheck) (models.HealthCheck, error) {
 	item.ID = "health-1"
@@ -237,8 +621,23 @@ func (r *repoStub) CreateMetricPoint(_ context.Context, item models.MetricPoint)
 	r.metricPoints = append(r.metricPoints, item)
 	return item, nil
 }
-func (r *repoStub) ListMetricPoints(_ context.Context, _, _, _ string, _ time.Time, _ time.Time, _ int) ([]models.MetricPoint, error) {
-	return r.metricPoints, nil
+func (r *repoStub) ListMetricPoints(_ context.Context, filter models.MetricFilter, from time.Time, to time.Time, limit int) ([]models.MetricPoint, error) {
+	out := make([]models.MetricPoint, 0)
+	for i := len(r.metricPoints) - 1; i >= 0 && len(out) < limit; i-- {
+		if item := r.metricPoints[i]; metricMatches(item, filter, from, to) {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func metricMatches(item models.MetricPoint, filter models.MetricFilter, from time.Time, to time.Time) bool {
+	if (filter.ResourceType != "" && item.ResourceType != filter.ResourceType) ||
+		(filter.ResourceID != "" && item.ResourceID != filter.ResourceID) ||
+		(filter.MetricType != "" && item.MetricType != filter.MetricType) ||
+		(filter.ProviderID != "" && item.ProviderID != filter.ProviderID) {
+		return false
+	}
+	return (from.IsZero() || !item.CapturedAt.Before(from)) && (to.IsZero() || !item.CapturedAt.After(to))
 }
 func (r *repoStub) MetricSummaries(_ context.Context, _ int) ([]models.MetricSummary, error) {
 	if len(r.metricPoints) == 0 {
@@ -255,551 +654,5047 @@ func (r *repoStub) MetricSummaries(_ context.Context, _ int) ([]models.MetricSum
 		LastValue:    r.metricPoints[len(r.metricPoints)-1].Value,
 	}}, nil
 }
-func (r *repoStub) CreateAgentLog(_ context.Context, item models.AgentLog) (models.AgentLog, error) {
-	item.ID = "log-1"
-	r.agentLogs = append(r.agentLogs, item)
-	return item, nil
+func (r *repoStub) ListMetricRollups(_ context.Context, resolution models.MetricResolution, filter models.MetricFilter, from time.Time, to time.Time, _ int) ([]models.MetricPoint, error) {
+	out := make([]models.MetricPoint, 0)
+	for _, item := range r.metricRollups {
+		if item.Resolution == resolution && metricMatches(item, filter, from, to) {
+			out = append(out, item)
+		}
+	}
+	return out, nil
 }
-func (r *repoStub) ListAgentLogs(_ context.Context, providerID string, resourceID string, level string, _ int) ([]models.AgentLog, error) {
-	out := make([]models.AgentLog, 0)
-	for _, item := range r.agentLogs {
-		if providerID != "" && item.ProviderID != providerID {
-			continue
+func (r *repoStub) MetricRollupWatermark(_ context.Context, resolution models.MetricResolution) (time.Time, error) {
+	return r.watermarks[resolution], nil
+}
+func (r *repoStub) RollupMetrics(_ context.Context, resolution models.MetricResolution, from time.Time, to time.Time) (int64, error) {
+	step, source := time.Minute, r.metricPoints
+	if resolution == models.MetricResolutionHour {
+		step, source = time.Hour, nil
+		for _, item := range r.metricRollups {
+			if item.Resolution == models.MetricResolutionMinute {
+				source = append(source, item)
+			}
 		}
-		if resourceID != "" && item.ResourceID != resourceID {
+	}
+	buckets := map[string]*models.MetricPoint{}
+	sums := map[string]float64{}
+	order := make([]string, 0)
+	for _, item := range source {
+		if (!from.IsZero() && item.CapturedAt.Before(from)) || !item.CapturedAt.Before(to) {
 			continue
 		}
-		if level != "" && string(item.Level) != level {
+		stats := models.MetricRollupStats{Min: item.Value, Max: item.Value, Last: item.Value, LastAt: item.CapturedAt, Samples: 1}
+		sum := item.Value
+		if item.Rollup != nil {
+			stats = *item.Rollup
+			sum = item.Value * float64(stats.Samples)
+		}
+		start := item.CapturedAt.Truncate(step)
+		key := item.ResourceType + "|" + item.ResourceID + "|" + item.MetricType + "|" + start.String()
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &models.MetricPoint{ResourceType: item.ResourceType, ResourceID: item.ResourceID, MetricType: item.MetricType, ProviderID: item.ProviderID, CapturedAt: start, Resolution: resolution, Rollup: &stats}
+			buckets[key] = bucket
+			sums[key] = sum
+			order = append(order, key)
 			continue
 		}
-		out = append(out, item)
+		bucket.Rollup.Min = min(bucket.Rollup.Min, stats.Min)
+		bucket.Rollup.Max = max(bucket.Rollup.Max, stats.Max)
+		if !stats.LastAt.Before(bucket.Rollup.LastAt) {
+			bucket.Rollup.Last, bucket.Rollup.LastAt = stats.Last, stats.LastAt
+		}
+		bucket.Rollup.Samples += stats.Samples
+		sums[key] += sum
 	}
-	return out, nil
+	for _, key := range order {
+		bucket := buckets[key]
+		bucket.Value = sums[key] / float64(bucket.Rollup.Samples)
+		r.metricRollups = slices.DeleteFunc(r.metricRollups, func(item models.MetricPoint) bool {
+			return item.Resolution == resolution && item.ResourceID == bucket.ResourceID && item.MetricType == bucket.MetricType && item.CapturedAt.Equal(bucket.CapturedAt)
+		})
+		r.metricRollups = append(r.metricRollups, *bucket)
+	}
+	if r.watermarks == nil {
+		r.watermarks = map[models.MetricResolution]time.Time{}
+	}
+	if to.After(r.watermarks[resolution]) {
+		r.watermarks[resolution] = to
+	}
+	return int64(len(order)), nil
 }
-func (r *repoStub) CreateAgentCommand(_ context.Context, item models.AgentCommand) (models.AgentCommand, error) {
-	item.ID = "cmd-1"
-	item.CreatedAt = time.Now().UTC()
-	item.UpdatedAt = item.CreatedAt
-	r.agentCommands = append(r.agentCommands, item)
-	return item, nil
+func (r *repoStub) DeleteMetricPointsBefore(_ context.Context, cutoff time.Time, _ int) (int64, error) {
+	before := len(r.metricPoints)
+	r.metricPoints = slices.DeleteFunc(r.metricPoints, func(item models.MetricPoint) bool { return item.CapturedAt.Before(cutoff) })
+	return int64(before - len(r.metricPoints)), nil
 }
-func (r *repoStub) ListAgentCommands(_ context.Context, providerID string, limit int) ([]models.AgentCommand, error) {
-	out := make([]models.AgentCommand, 0)
-	for _, item := range r.agentCommands {
-		if providerID != "" && item.ProviderID != providerID {
+func (r *repoStub) DeleteMetricRollupsBefore(_ context.Context, resolution models.MetricResolution, cutoff time.Time, _ int) (int64, error) {
+	before := len(r.metricRollups)
+	r.metricRollups = slices.DeleteFunc(r.metricRollups, func(item models.MetricPoint) bool {
+		return item.Resolution == resolution && item.CapturedAt.Before(cutoff)
+	})
+	return int64(before - len(r.metricRollups)), nil
+}
+func (r *repoStub) LatestMetricPoints(_ context.Context, filter models.MetricFilter, since time.Time) ([]models.MetricPoint, error) {
+	latest := map[string]models.MetricPoint{}
+	order := make([]string, 0)
+	for _, item := range r.metricPoints {
+		if !metricMatches(item, filter, since, time.Time{}) {
 			continue
 		}
-		out = append(out, item)
-		if len(out) >= limit {
-			break
+		key := item.ResourceType + "/" + item.ResourceID
+		current, ok := latest[key]
+		if !ok {
+			order = append(order, key)
 		}
+		if !ok || item.CapturedAt.After(current.CapturedAt) {
+			latest[key] = item
+		}
+	}
+	out := make([]models.MetricPoint, 0, len(order))
+	for _, key := range order {
+		out = append(out, latest[key])
 	}
 	return out, nil
 }
-func (r *repoStub) ClaimNextAgentCommand(_ context.Context, providerID string) (models.AgentCommand, error) {
-	for i := range r.agentCommands {
-		if r.agentCommands[i].ProviderID == providerID && r.agentCommands[i].Status == models.AgentCommandQueued {
-			r.agentCommands[i].Status = models.AgentCommandRunning
-			r.agentCommands[i].AcknowledgedAt = time.Now().UTC()
-			r.agentCommands[i].UpdatedAt = r.agentCommands[i].AcknowledgedAt
-			return r.agentCommands[i], nil
+func (r *repoStub) LatestHealthChecks(_ context.Context, resourceType string, resourceID string, checkType string, since time.Time) ([]models.HealthCheck, error) {
+	latest := map[string]models.HealthCheck{}
+	order := make([]string, 0)
+	for _, item := range r.healthChecks {
+		if (resourceType != "" && item.ResourceType != resourceType) || (resourceID != "" && item.ResourceID != resourceID) ||
+			(checkType != "" && item.CheckType != checkType) || item.CheckedAt.Before(since) {
+			continue
+		}
+		key := item.ResourceType + "/" + item.ResourceID + "/" + item.CheckType
+		current, ok := latest[key]
+		if !ok {
+			order = append(order, key)
+		}
+		if !ok || item.CheckedAt.After(current.CheckedAt) {
+			latest[key] = item
 		}
 	}
-	return models.AgentCommand{}, nil
+	out := make([]models.HealthCheck, 0, len(order))
+	for _, key := range order {
+		out = append(out, latest[key])
+	}
+	return out, nil
 }
-func (r *repoStub) CompleteAgentCommand(_ context.Context, commandID string, status models.AgentCommandState, resultMessage string) (models.AgentCommand, error) {
-	for i := range r.agentCommands {
-		if r.agentCommands[i].ID == commandID {
-			r.agentCommands[i].Status = status
-			r.agentCommands[i].ResultMessage = resultMessage
-			r.agentCommands[i].UpdatedAt = time.Now().UTC()
-			return r.agentCommands[i], nil
-		}
+func (r *repoStub) ListHostResources(_ context.Context) ([]models.HostResource, error) {
+	return append([]models.HostResource(nil), r.hosts...), nil
+}
+func (r *repoStub) TouchAgentPoll(_ context.Context, providerID string, at time.Time) error {
+	if r.presence == nil {
+		r.presence = map[string]models.ProviderPresence{}
 	}
-	return models.AgentCommand{}, errors.New("not found")
+	item := r.presence[providerID]
+	item.ProviderID = providerID
+	item.LastPollAt = &at
+	r.presence[providerID] = item
+	return nil
 }
-func (r *repoStub) CreateTerminalSession(_ context.Context, item models.TerminalSession) (models.TerminalSession, error) {
-	if r.terminalByID == nil {
-		r.terminalByID = make(map[string]models.TerminalSession)
+func (r *repoStub) ListPresenceInputs(_ context.Context) ([]models.ProviderPresence, error) {
+	byID := map[string]models.ProviderPresence{}
+	for id, item := range r.presence {
+		byID[id] = item
 	}
-	if item.ID == "" {
-		item.ID = "term-1"
+	for _, host := range r.hosts {
+		item := byID[host.ProviderID]
+		item.ProviderID = host.ProviderID
+		heartbeatAt := host.HeartbeatAt
+		item.HeartbeatAt = &heartbeatAt
+		byID[host.ProviderID] = item
 	}
-	item.CreatedAt = time.Now().UTC()
-	item.UpdatedAt = item.CreatedAt
-	item.LastActiveAt = item.CreatedAt
-	r.terminalByID[item.ID] = item
-	return item, nil
-}
-func (r *repoStub) GetTerminalSession(_ context.Context, sessionID string) (models.TerminalSession, error) {
-	item, ok := r.terminalByID[sessionID]
-	if !ok {
-		return models.TerminalSession{}, errors.New("not found")
+	out := make([]models.ProviderPresence, 0, len(byID))
+	for _, item := range byID {
+		out = append(out, item)
 	}
-	return item, nil
+	sort.Slice(out, func(i, j int) bool { return out[i].ProviderID < out[j].ProviderID })
+	return out, nil
 }
-func (r *repoStub) UpdateTerminalSessionStatus(_ context.Context, sessionID string, status models.TerminalSessionState, exitCode int) (models.TerminalSession, error) {
-	item, ok := r.terminalByID[sessionID]
-	if !ok {
-		return models.TerminalSession{}, errors.New("not found")
+func (r *repoStub) RecordPresenceChange(_ context.Context, item models.ProviderPresence, from models.ProviderPresenceState) (bool, error) {
+	if r.presence == nil {
+		r.presence = map[string]models.ProviderPresence{}
 	}
-	item.Status = status
-	item.ExitCode = exitCode
-	item.UpdatedAt = time.Now().UTC()
-	r.terminalByID[sessionID] = item
-	return item, nil
-}
-func (r *repoStub) UpdateTerminalSessionSize(_ context.Context, sessionID string, rows int, cols int) (models.TerminalSession, error) {
-	item, ok := r.terminalByID[sessionID]
-	if !ok {
-		return models.TerminalSession{}, errors.New("not found")
+	current := r.presence[item.ProviderID]
+	if current.State != from {
+		return false, nil
 	}
-	item.Rows = rows
-	item.Cols = cols
-	item.UpdatedAt = time.Now().UTC()
-	r.terminalByID[sessionID] = item
-	return item, nil
-}
-func (r *repoStub) AppendTerminalChunk(_ context.Context, chunk models.TerminalChunk) (models.TerminalChunk, error) {
-	chunk.ID = "chunk-1"
-	chunk.CreatedAt = time.Now().UTC()
-	if chunk.Direction == models.TerminalChunkInput {
-		chunk.Seq = int64(len(r.terminalInput) + 1)
-		r.terminalInput = append(r.terminalInput, chunk)
-	} else {
-		chunk.Seq = int64(len(r.terminalOut) + 1)
-		r.terminalOut = append(r.terminalOut, chunk)
+	if from != "" {
+		current.FlapCount++
 	}
-	return chunk, nil
+	current.ProviderID = item.ProviderID
+	current.State = item.State
+	current.Reason = item.Reason
+	current.HeartbeatAt = item.HeartbeatAt
+	current.ChangedAt = item.ChangedAt
+	current.Synced = false
+	current.UpdatedAt = item.ChangedAt
+	r.presence[item.ProviderID] = current
+	r.presenceLog = append(r.presenceLog, models.ProviderPresenceEvent{
+		ID:         fmt.Sprintf("presence-%d", len(r.presenceLog)+1),
+		ProviderID: item.ProviderID,
+		FromState:  from,
+		ToState:    item.State,
+		Reason:     item.Reason,
+		CreatedAt:  item.ChangedAt,
+	})
+	return true, nil
 }
-func (r *repoStub) ListTerminalChunks(_ context.Context, sessionID string, direction models.TerminalChunkDirection, afterSeq int64, limit int) ([]models.TerminalChunk, error) {
-	var source []models.TerminalChunk
-	if direction == models.TerminalChunkInput {
-		source = r.terminalInput
-	} else {
-		source = r.terminalOut
-	}
-	out := make([]models.TerminalChunk, 0)
-	for _, item := range source {
-		if item.SessionID != sessionID || item.Seq <= afterSeq {
+func (r *repoStub) ListProviderPresence(_ context.Context, providerID string, state string, unsyncedOnly bool, limit int) ([]models.ProviderPresence, error) {
+	out := make([]models.ProviderPresence, 0)
+	for _, item := range r.presence {
+		if item.State == "" {
+			continue
+		}
+		if providerID != "" && item.ProviderID != providerID {
+			continue
+		}
+		if state != "" && string(item.State) != state {
 			continue
 		}
+		if unsyncedOnly && item.Synced {
+			continue
+		}
+		item.RecentFlaps = 0
+		for _, event := range r.presenceLog {
+			if event.ProviderID == item.ProviderID && event.FromState != "" {
+				item.RecentFlaps++
+			}
+		}
 		out = append(out, item)
-		if len(out) >= limit {
-			break
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ProviderID < out[j].ProviderID })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+func (r *repoStub) MarkPresenceSynced(_ context.Context, providerID string, changedAt time.Time) error {
+	item, ok := r.presence[providerID]
+	if ok && item.ChangedAt.Equal(changedAt) {
+		item.Synced = true
+		r.presence[providerID] = item
+	}
+	return nil
+}
+func (r *repoStub) ListPresenceEvents(_ context.Context, providerID string, limit int) ([]models.ProviderPresenceEvent, error) {
+	out := make([]models.ProviderPresenceEvent, 0)
+	for i := len(r.presenceLog) - 1; i >= 0 && len(out) < limit; i-- {
+		if r.presenceLog[i].ProviderID == providerID {
+			out = append(out, r.presenceLog[i])
 		}
 	}
 	return out, nil
 }
-func (r *repoStub) CreateTerminalAuditEvent(_ context.Context, event models.TerminalAuditEvent) (models.TerminalAuditEvent, error) {
-	event.ID = "audit-1"
-	event.CreatedAt = time.Now().UTC()
-	r.terminalAudit = append(r.terminalAudit, event)
-	return event, nil
+func (r *repoStub) ListHealthChecksBetween(_ context.Context, resourceType string, resourceID string, from time.Time, to time.Time) ([]models.HealthCheck, error) {
+	out := make([]models.HealthCheck, 0)
+	for _, item := range r.healthChecks {
+		if item.ResourceType == resourceType && item.ResourceID == resourceID && item.CheckedAt.Before(to) && !item.CheckedAt.Before(from.Add(-slaCheckSpan)) {
+			out = append(out, item)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CheckedAt.Before(out[j].CheckedAt) })
+	return out, nil
 }
-func (r *repoStub) ExpireIdleTerminalSessions(_ context.Context, _ time.Time, _ int) ([]models.TerminalSession, error) {
-	return []models.TerminalSession{}, nil
+func (r *repoStub) ListPresenceEventsBetween(_ context.Context, providerID string, from time.Time, to time.Time) ([]models.ProviderPresenceEvent, error) {
+	out := make([]models.ProviderPresenceEvent, 0)
+	for i, item := range r.presenceLog {
+		if item.ProviderID != providerID || !item.CreatedAt.Before(to) {
+			continue
+		}
+		if item.CreatedAt.Before(from) {
+			later := false
+			for _, next := range r.presenceLog[i+1:] {
+				if next.ProviderID == providerID && !next.CreatedAt.After(from) {
+					later = true
+				}
+			}
+			if later {
+				continue
+			}
+		}
+		out = append(out, item)
+	}
+	return out, nil
 }
-func (r *repoStub) CountActiveTerminalSessions(_ context.Context, _ string) (int, error) {
-	count := 0
-	for _, item := range r.terminalByID {
-		if item.Status == models.TerminalSessionQueued || item.Status == models.TerminalSessionOpen {
-			count++
+func (r *repoStub) hasSLAReport(resourceType string, resourceID string, period string) bool {
+	_, err := r.GetSLAReport(context.Background(), resourceType, resourceID, period)
+	return err == nil
+}
+func (r *repoStub) ListSLASubjects(_ context.Context, period string, from time.Time, to time.Time, limit int) ([]models.SLASubject, error) {
+	subjects := make([]models.SLASubject, 0)
+	if r.vm.ID != "" {
+		subjects = append(subjects, models.SLASubject{ResourceType: "vm", ResourceID: r.vm.ID, UserID: r.vm.UserID, ProviderID: r.vm.ProviderID, Tier: r.vm.AvailabilityTier, CreatedAt: r.vm.CreatedAt})
+	}
+	for _, pod := range r.pods {
+		subjects = append(subjects, models.SLASubject{ResourceType: "pod", ResourceID: pod.ID, UserID: pod.UserID, ProviderID: pod.ProviderID, Tier: pod.AvailabilityTier, CreatedAt: pod.CreatedAt})
+	}
+	out := make([]models.SLASubject, 0)
+	for _, subject := range subjects {
+		if subject.CreatedAt.Before(to) && !r.hasSLAReport(subject.ResourceType, subject.ResourceID, period) && len(out) < limit {
+			out = append(out, subject)
 		}
 	}
-	return count, nil
+	return out, nil
 }
-func (r *repoStub) CreateRootInputLog(_ context.Context, item models.RootInputLog) (models.RootInputLog, error) {
-	item.ID = "root-1"
-	item.CreatedAt = time.Now().UTC()
-	r.rootInputLogs = append(r.rootInputLogs, item)
-	return item, nil
+func (r *repoStub) ListSLAProviders(_ context.Context, period string, to time.Time, limit int) ([]string, error) {
+	out := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, item := range r.presenceLog {
+		if seen[item.ProviderID] || !item.CreatedAt.Before(to) || r.hasSLAReport("provider", item.ProviderID, period) || len(out) >= limit {
+			continue
+		}
+		seen[item.ProviderID] = true
+		out = append(out, item.ProviderID)
+	}
+	return out, nil
 }
-func (r *repoStub) ListRootInputLogs(_ context.Context, providerID string, resourceID string, _ int) ([]models.RootInputLog, error) {
-	out := make([]models.RootInputLog, 0)
-	for _, item := range r.rootInputLogs {
-		if providerID != "" && item.ProviderID != providerID {
+func (r *repoStub) ListBilledProviderBookings(_ context.Context, providerID string, from time.Time, to time.Time) ([]models.OfferBooking, error) {
+	out := make([]models.OfferBooking, 0)
+	for _, item := range r.bookings {
+		if item.ProviderID != providerID || item.BillingRentalID == "" || item.ConfirmedAt == nil || !item.ConfirmedAt.Before(to) {
 			continue
 		}
-		if resourceID != "" && item.ResourceID != resourceID {
+		if item.ClosedAt != nil && item.ClosedAt.Before(from) {
 			continue
 		}
 		out = append(out, item)
 	}
 	return out, nil
 }
-func (r *repoStub) ConsumeCreateRateLimit(_ context.Context, _ string, _ time.Time, _ time.Time, limit int) (bool, error) {
-	if r.createEvents >= limit {
-		return false, nil
+func (r *repoStub) SaveSLAReport(_ context.Context, item models.SLAReport) error {
+	if r.hasSLAReport(item.ResourceType, item.ResourceID, item.Period) {
+		return nil
 	}
-	r.createEvents++
-	return true, nil
-}
-func (r *repoStub) CreateKubernetesCluster(_ context.Context, item models.KubernetesCluster) (models.KubernetesCluster, error) {
 	item.CreatedAt = time.Now().UTC()
 	item.UpdatedAt = item.CreatedAt
-	if r.k8sByID == nil {
-		r.k8sByID = make(map[string]models.KubernetesCluster)
+	r.slaReports = append(r.slaReports, item)
+	return nil
+}
+func (r *repoStub) GetSLAReport(_ context.Context, resourceType string, resourceID string, period string) (models.SLAReport, error) {
+	for _, item := range r.slaReports {
+		if item.ResourceType == resourceType && item.ResourceID == resourceID && item.Period == period {
+			return item, nil
+		}
 	}
-	r.k8sByID[item.ID] = item
-	return item, nil
+	return models.SLAReport{}, pgx.ErrNoRows
 }
-func (r *repoStub) GetKubernetesCluster(_ context.Context, clusterID string) (models.KubernetesCluster, error) {
-	item, ok := r.k8sByID[clusterID]
-	if !ok {
-		return models.KubernetesCluster{}, errors.New("not found")
+func (r *repoStub) ListSLAReports(_ context.Context, filter models.SLAReportFilter) ([]models.SLAReport, error) {
+	out := make([]models.SLAReport, 0)
+	for _, item := range r.slaReports {
+		if (filter.Period != "" && item.Period != filter.Period) || (filter.UserID != "" && item.UserID != filter.UserID) ||
+			(filter.ProviderID != "" && item.ProviderID != filter.ProviderID) || (filter.CreditStatus != "" && item.CreditStatus != filter.CreditStatus) ||
+			(filter.ResourceType != "" && item.ResourceType != filter.ResourceType) || (filter.MissedOnly && item.Met) {
+			continue
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+func (r *repoStub) MarkSLAReportCredited(_ context.Context, resourceType string, resourceID string, period string, creditUSD float64) error {
+	for i := range r.slaReports {
+		item := &r.slaReports[i]
+		if item.ResourceType == resourceType && item.ResourceID == resourceID && item.Period == period && item.CreditStatus == models.SLACreditPending {
+			item.CreditStatus = models.SLACreditIssued
+			item.CreditUSD = creditUSD
+		}
 	}
+	return nil
+}
+func (r *repoStub) CreateAlertRule(_ context.Context, item models.AlertRule) (models.AlertRule, error) {
+	item.ID = fmt.Sprintf("rule-%d", len(r.alertRules)+1)
+	item.CreatedAt = time.Now().UTC()
+	item.UpdatedAt = item.CreatedAt
+	r.alertRules = append(r.alertRules, item)
 	return item, nil
 }
-func (r *repoStub) ListKubernetesClusters(_ context.Context, _ string) ([]models.KubernetesCluster, error) {
-	out := make([]models.KubernetesCluster, 0, len(r.k8sByID))
-	for _, item := range r.k8sByID {
-		out = append(out, item)
+func (r *repoStub) GetAlertRule(_ context.Context, ruleID string) (models.AlertRule, error) {
+	for _, item := range r.alertRules {
+		if item.ID == ruleID {
+			return item, nil
+		}
+	}
+	return models.AlertRule{}, pgx.ErrNoRows
+}
+func (r *repoStub) ListAlertRules(_ context.Context, ownerUserID string, enabledOnly bool) ([]models.AlertRule, error) {
+	out := make([]models.AlertRule, 0)
+	for _, item := range r.alertRules {
+		if (ownerUserID == "" || item.OwnerUserID == ownerUserID) && (!enabledOnly || item.Enabled) {
+			out = append(out, item)
+		}
 	}
 	return out, nil
 }
-func (r *repoStub) UpdateKubernetesClusterStatus(_ context.Context, clusterID string, status models.ClusterStatus) error {
-	item, ok := r.k8sByID[clusterID]
-	if !ok {
-		return errors.New("not found")
+func (r *repoStub) DeleteAlertRule(_ context.Context, ruleID string) error {
+	for i, item := range r.alertRules {
+		if item.ID == ruleID {
+			r.alertRules = append(r.alertRules[:i], r.alertRules[i+1:]...)
+			alerts := r.alerts[:0]
+			for _, alert := range r.alerts {
+				if alert.RuleID != ruleID {
+					alerts = append(alerts, alert)
+				}
+			}
+			r.alerts = alerts
+			return nil
+		}
 	}
-	item.Status = status
+	return pgx.ErrNoRows
+}
+func (r *repoStub) withRule(item models.Alert) models.Alert {
+	for _, rule := range r.alertRules {
+		if rule.ID == item.RuleID {
+			item.RuleName, item.Severity = rule.Name, rule.Severity
+		}
+	}
+	return item
+}
+func (r *repoStub) CreateAlert(_ context.Context, item models.Alert) (models.Alert, error) {
+	for _, existing := range r.alerts {
+		if existing.RuleID == item.RuleID && existing.ResourceType == item.ResourceType && existing.ResourceID == item.ResourceID && existing.State != models.AlertStateResolved {
+			return models.Alert{}, pgx.ErrNoRows
+		}
+	}
+	item.ID = fmt.Sprintf("alert-%d", len(r.alerts)+1)
 	item.UpdatedAt = time.Now().UTC()
-	r.k8sByID[clusterID] = item
-	return nil
+	r.alerts = append(r.alerts, item)
+	return r.withRule(item), nil
 }
-func (r *repoStub) DeleteKubernetesCluster(_ context.Context, clusterID string) error {
-	delete(r.k8sByID, clusterID)
-	return nil
+func (r *repoStub) UpdateAlert(_ context.Context, item models.Alert) (models.Alert, error) {
+	for i := range r.alerts {
+		if r.alerts[i].ID == item.ID {
+			item.NotifiedState = r.alerts[i].NotifiedState
+			item.UpdatedAt = time.Now().UTC()
+			r.alerts[i] = item
+			return r.withRule(item), nil
+		}
+	}
+	return models.Alert{}, pgx.ErrNoRows
 }
-
-type cgStub struct{}
-
-func (cgStub) Apply(_ string, _ int, _ int, _ int) error { return nil }
-func (cgStub) Release(_ string) error                    { return nil }
-
-type orchestratorStub struct{}
-
-func (orchestratorStub) ProvisionCluster(_ context.Context, spec orchestrator.ClusterSpec) (orchestrator.RuntimeCluster, error) {
-	return orchestrator.RuntimeCluster{
-		Endpoint:   "https://cluster.local",
-		Kubeconfig: "kubeconfig-content-" + spec.Name,
-	}, nil
+func (r *repoStub) ListOpenAlerts(_ context.Context) ([]models.Alert, error) {
+	out := make([]models.Alert, 0)
+	for _, item := range r.alerts {
+		if item.State != models.AlertStateResolved || item.NotifiedState == models.AlertStateFiring {
+			out = append(out, r.withRule(item))
+		}
+	}
+	return out, nil
 }
-
-func (orchestratorStub) DeleteCluster(_ context.Context, _ string) error { return nil }
-
-func (orchestratorStub) RefreshClusterStatus(_ context.Context, _ string) (string, error) {
-	return "running", nil
+func (r *repoStub) ListAlerts(_ context.Context, ownerUserID string, state string, limit int) ([]models.Alert, error) {
+	out := make([]models.Alert, 0)
+	for i := len(r.alerts) - 1; i >= 0 && len(out) < limit; i-- {
+		item := r.alerts[i]
+		rule, _ := r.GetAlertRule(context.Background(), item.RuleID)
+		if (ownerUserID == "" || rule.OwnerUserID == ownerUserID) && (state == "" || string(item.State) == state) {
+			out = append(out, r.withRule(item))
+		}
+	}
+	return out, nil
 }
-
-type provisioningStub struct{}
-
-func (provisioningStub) CreateVM(_ context.Context, _ provisioning.CreateVMRequest) (provisioning.ProvisionResult, error) {
-	return provisioning.ProvisionResult{ExternalID: "ext-vm-1", PublicIP: "203.0.113.10", Status: "succeeded"}, nil
+func (r *repoStub) ClaimAlertNotification(_ context.Context, alertID string, from models.AlertState, to models.AlertState) (bool, error) {
+	for i := range r.alerts {
+		if r.alerts[i].ID == alertID && r.alerts[i].NotifiedState == from {
+			r.alerts[i].NotifiedState = to
+			return true, nil
+		}
+	}
+	return false, nil
 }
-func (provisioningStub) DeleteVM(_ context.Context, _ string, _ provisioning.DeleteRequest) error {
-	return nil
+func (r *repoStub) CreateAlertSilence(_ context.Context, item models.AlertSilence) (models.AlertSilence, error) {
+	item.ID = fmt.Sprintf("silence-%d", len(r.silences)+1)
+	item.CreatedAt = time.Now().UTC()
+	r.silences = append(r.silences, item)
+	return item, nil
 }
-func (provisioningStub) CreatePod(_ context.Context, _ provisioning.CreatePodRequest) (provisioning.ProvisionResult, error) {
-	return provisioning.ProvisionResult{ExternalID: "ext-pod-1", Status: "succeeded"}, nil
+func (r *repoStub) GetAlertSilence(_ context.Context, silenceID string) (models.AlertSilence, error) {
+	for _, item := range r.silences {
+		if item.ID == silenceID {
+			return item, nil
+		}
+	}
+	return models.AlertSilence{}, pgx.ErrNoRows
 }
-func (provisioningStub) DeletePod(_ context.Context, _ string, _ provisioning.DeleteRequest) error {
-	return nil
+func (r *repoStub) ListAlertSilences(_ context.Context, ownerUserID string, activeAt time.Time) ([]models.AlertSilence, error) {
+	out := make([]models.AlertSilence, 0)
+	for _, item := range r.silences {
+		if ownerUserID != "" && item.OwnerUserID != ownerUserID {
+			continue
+		}
+		if !activeAt.IsZero() && (item.StartsAt.After(activeAt) || !item.EndsAt.After(activeAt)) {
+			continue
+		}
+		out = append(out, item)
+	}
+	return out, nil
 }
-
-func TestAllocateChecksFreeResources(t *testing.T) {
-	repo := &repoStub{
-		resource: models.HostResource{
-			ProviderID:   "p1",
-			CPUFreeCores: 4,
-			RAMFreeMB:    4096,
-			GPUFreeUnits: 1,
-			HeartbeatAt:  time.Now().UTC(),
-		},
+func (r *repoStub) EndAlertSilence(_ context.Context, silenceID string, at time.Time) (models.AlertSilence, error) {
+	for i := range r.silences {
+		if r.silences[i].ID == silenceID {
+			if at.Before(r.silences[i].EndsAt) {
+				r.silences[i].EndsAt = at
+			}
+			return r.silences[i], nil
+		}
 	}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
-
-	_, err := svc.Allocate(context.Background(), models.Allocation{
-		ProviderID: "p1",
-		CPUCores:   8,
-		RAMMB:      4096,
-		GPUUnits:   1,
-	})
-	if err == nil {
-		t.Fatal("expected insufficient resources error")
+	return models.AlertSilence{}, pgx.ErrNoRows
+}
+func (r *repoStub) CreateHealthProbe(_ context.Context, item models.HealthProbe) (models.HealthProbe, error) {
+	item.ID = fmt.Sprintf("probe-%d", len(r.probes)+1)
+	item.CreatedAt = time.Now().UTC()
+	r.probes = append(r.probes, item)
+	return item, nil
+}
+func (r *repoStub) GetHealthProbe(_ context.Context, probeID string) (models.HealthProbe, error) {
+	for _, item := range r.probes {
+		if item.ID == probeID {
+			return item, nil
+		}
 	}
+	return models.HealthProbe{}, pgx.ErrNoRows
 }
-
-func TestAllocateRejectsStaleHeartbeat(t *testing.T) {
-	repo := &repoStub{
-		resource: models.HostResource{
-			ProviderID:   "p1",
-			CPUFreeCores: 8,
-			RAMFreeMB:    8192,
-			GPUFreeUnits: 1,
-			HeartbeatAt:  time.Now().UTC().Add(-2 * time.Minute),
-		},
+func (r *repoStub) ListHealthProbes(_ context.Context, resourceType string, resourceID string) ([]models.HealthProbe, error) {
+	out := make([]models.HealthProbe, 0)
+	for _, item := range r.probes {
+		if item.ResourceType == resourceType && item.ResourceID == resourceID {
+			out = append(out, item)
+		}
 	}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
-
-	_, err := svc.Allocate(context.Background(), models.Allocation{
-		ProviderID: "p1",
-		CPUCores:   1,
-		RAMMB:      512,
-		GPUUnits:   0,
-	})
-	if err == nil {
-		t.Fatal("expected stale heartbeat error")
+	return out, nil
+}
+func (r *repoStub) DeleteHealthProbe(_ context.Context, probeID string) error {
+	for i, item := range r.probes {
+		if item.ID == probeID {
+			r.probes = append(r.probes[:i], r.probes[i+1:]...)
+			return nil
+		}
 	}
+	return pgx.ErrNoRows
 }
-
-func TestAllocateRejectsInvalidHeartbeatValues(t *testing.T) {
-	repo := &repoStub{
-		resource: models.HostResource{
-			ProviderID:   "p1",
-			CPUFreeCores: -1,
-			RAMFreeMB:    8192,
-			GPUFreeUnits: 1,
-			HeartbeatAt:  time.Now().UTC(),
-		},
+func (r *repoStub) ListUnprobedVMs(_ context.Context, _ int) ([]models.VM, error) {
+	if r.vm.ID == "" || r.vm.Status != models.VMStatusRunning || r.vm.IPAddress == "" || r.probesSeeded[r.vm.ID] {
+		return nil, nil
+	}
+	return []models.VM{r.vm}, nil
+}
+func (r *repoStub) ListUnprobedPods(_ context.Context, _ int) ([]models.Pod, error) {
+	out := make([]models.Pod, 0)
+	for _, pod := range r.pods {
+		if pod.Status == models.PodStatusRunning && pod.IPAddress != "" && !r.probesSeeded[pod.ID] {
+			out = append(out, pod)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) MarkHealthProbesSeeded(_ context.Context, _ string, resourceID string) error {
+	if r.probesSeeded == nil {
+		r.probesSeeded = map[string]bool{}
+	}
+	r.probesSeeded[resourceID] = true
+	return nil
+}
+func (r *repoStub) ClaimDueHealthProbes(_ context.Context, now time.Time, limit int) ([]models.HealthProbe, error) {
+	out := make([]models.HealthProbe, 0)
+	for i := range r.probes {
+		item := &r.probes[i]
+		if !item.Enabled || item.NextRunAt.After(now) || len(out) >= limit {
+			continue
+		}
+		switch {
+		case item.ResourceType == "vm" && item.ResourceID == r.vm.ID && r.vm.Status == models.VMStatusRunning:
+			item.Address = r.vm.IPAddress
+		case item.ResourceType == "pod":
+			pod, err := r.GetPod(context.Background(), item.ResourceID)
+			if err != nil || pod.Status != models.PodStatusRunning {
+				continue
+			}
+			item.Address = pod.IPAddress
+		default:
+			continue
+		}
+		item.NextRunAt = now.Add(time.Duration(item.IntervalSeconds) * time.Second)
+		out = append(out, *item)
+	}
+	return out, nil
+}
+func (r *repoStub) RecordHealthProbeResult(_ context.Context, probeID string, status models.HealthStatus, latencyMS float64, checkedAt time.Time) (models.HealthProbe, error) {
+	for i := range r.probes {
+		if r.probes[i].ID != probeID {
+			continue
+		}
+		if status == models.HealthStatusOK {
+			r.probes[i].ConsecutiveFailures = 0
+		} else {
+			r.probes[i].ConsecutiveFailures++
+		}
+		r.probes[i].LastStatus = status
+		r.probes[i].LastLatencyMS = latencyMS
+		r.probes[i].LastCheckedAt = &checkedAt
+		return r.probes[i], nil
+	}
+	return models.HealthProbe{}, pgx.ErrNoRows
+}
+func (r *repoStub) SetResourceHealth(_ context.Context, resourceType string, resourceID string, health models.ResourceHealth) (bool, error) {
+	if resourceType == "vm" && resourceID == r.vm.ID {
+		changed := r.vm.Health != health
+		r.vm.Health = health
+		return changed, nil
+	}
+	for i := range r.pods {
+		if r.pods[i].ID == resourceID {
+			changed := r.pods[i].Health != health
+			r.pods[i].Health = health
+			return changed, nil
+		}
+	}
+	return false, nil
+}
+func (r *repoStub) CreateAgentLog(_ context.Context, item models.AgentLog) (models.AgentLog, error) {
+	item.ID = "log-1"
+	r.agentLogs = append(r.agentLogs, item)
+	return item, nil
+}
+func (r *repoStub) ListAgentLogs(_ context.Context, providerID string, resourceID string, level string, _ int) ([]models.AgentLog, error) {
+	out := make([]models.AgentLog, 0)
+	for _, item := range r.agentLogs {
+		if providerID != "" && item.ProviderID != providerID {
+			continue
+		}
+		if resourceID != "" && item.ResourceID != resourceID {
+			continue
+		}
+		if level != "" && string(item.Level) != level {
+			continue
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+func (r *repoStub) CreateAgentCommand(_ context.Context, item models.AgentCommand) (models.AgentCommand, error) {
+	if item.ID == "" {
+		item.ID = fmt.Sprintf("cmd-%d", len(r.agentCommands)+1)
+	}
+	item.Seq = int64(len(r.agentCommands) + 1)
+	item.CreatedAt = time.Now().UTC()
+	item.UpdatedAt = item.CreatedAt
+	r.agentCommands = append(r.agentCommands, item)
+	return item, nil
+}
+func (r *repoStub) ListAgentCommands(_ context.Context, providerID string, limit int) ([]models.AgentCommand, error) {
+	out := make([]models.AgentCommand, 0)
+	for _, item := range r.agentCommands {
+		if providerID != "" && item.ProviderID != providerID {
+			continue
+		}
+		out = append(out, item)
+		if len(out) >= limit {
+			break
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) ListOpenAgentCommands(_ context.Context, command models.AgentCommandAction) ([]models.AgentCommand, error) {
+	out := make([]models.AgentCommand, 0)
+	for _, item := range r.agentCommands {
+		if item.Command == command && (item.Status == models.AgentCommandQueued || item.Status == models.AgentCommandRunning) {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) ClaimNextAgentCommand(_ context.Context, providerID string) (models.AgentCommand, error) {
+	for i := range r.agentCommands {
+		if r.agentCommands[i].ProviderID == providerID && r.agentCommands[i].Status == models.AgentCommandQueued {
+			r.agentCommands[i].Status = models.AgentCommandRunning
+			r.agentCommands[i].Attempts++
+			r.agentCommands[i].AcknowledgedAt = time.Now().UTC()
+			r.agentCommands[i].UpdatedAt = r.agentCommands[i].AcknowledgedAt
+			return r.agentCommands[i], nil
+		}
+	}
+	return models.AgentCommand{}, nil
+}
+func (r *repoStub) ClaimAgentCommands(_ context.Context, providerID string, afterSeq int64, lease time.Duration, limit int) ([]models.AgentCommand, error) {
+	out := make([]models.AgentCommand, 0)
+	for i := range r.agentCommands {
+		item := &r.agentCommands[i]
+		if item.ProviderID != providerID || len(out) >= limit {
+			continue
+		}
+		switch {
+		case item.Status == models.AgentCommandQueued:
+			item.Status = models.AgentCommandRunning
+			item.Attempts++
+		case item.Status == models.AgentCommandRunning && item.AcknowledgedAt.IsZero() && afterSeq > 0 && item.Seq > afterSeq:
+		default:
+			continue
+		}
+		item.LeaseExpiresAt = time.Now().UTC().Add(lease)
+		item.UpdatedAt = time.Now().UTC()
+		out = append(out, *item)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out, nil
+}
+func (r *repoStub) CompleteAgentCommand(_ context.Context, commandID string, status models.AgentCommandState, resultMessage string) (models.AgentCommand, error) {
+	for i := range r.agentCommands {
+		if r.agentCommands[i].ID == commandID {
+			if r.agentCommands[i].Status != models.AgentCommandQueued && r.agentCommands[i].Status != models.AgentCommandRunning {
+				return models.AgentCommand{}, errors.New("agent command already finished")
+			}
+			r.agentCommands[i].Status = status
+			r.agentCommands[i].ResultMessage = resultMessage
+			r.agentCommands[i].LeaseExpiresAt = time.Time{}
+			r.agentCommands[i].UpdatedAt = time.Now().UTC()
+			return r.agentCommands[i], nil
+		}
+	}
+	return models.AgentCommand{}, errors.New("not found")
+}
+func (r *repoStub) GetAgentCommand(_ context.Context, commandID string) (models.AgentCommand, error) {
+	for _, item := range r.agentCommands {
+		if item.ID == commandID {
+			return item, nil
+		}
+	}
+	return models.AgentCommand{}, errors.New("agent command not found")
+}
+func (r *repoStub) ListRequestedAgentCommands(_ context.Context, userID string, limit int) ([]models.AgentCommand, error) {
+	out := make([]models.AgentCommand, 0)
+	for i := len(r.agentCommands) - 1; i >= 0 && len(out) < limit; i-- {
+		if r.agentCommands[i].RequestedBy == userID {
+			out = append(out, r.agentCommands[i])
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) AcknowledgeAgentCommand(_ context.Context, commandID string) (models.AgentCommand, error) {
+	for i := range r.agentCommands {
+		if r.agentCommands[i].ID == commandID && r.agentCommands[i].Status == models.AgentCommandRunning {
+			if r.agentCommands[i].AcknowledgedAt.IsZero() {
+				r.agentCommands[i].AcknowledgedAt = time.Now().UTC()
+			}
+			r.agentCommands[i].LeaseExpiresAt = time.Time{}
+			return r.agentCommands[i], nil
+		}
+	}
+	return models.AgentCommand{}, errors.New("agent command is not running")
+}
+func (r *repoStub) ListStaleAgentCommands(_ context.Context, now time.Time, limit int) ([]models.AgentCommand, error) {
+	out := make([]models.AgentCommand, 0)
+	for _, item := range r.agentCommands {
+		if item.Status != models.AgentCommandQueued && item.Status != models.AgentCommandRunning {
+			continue
+		}
+		deadlinePassed := !item.DeadlineAt.IsZero() && !item.DeadlineAt.After(now)
+		leaseExpired := item.Status == models.AgentCommandRunning && item.AcknowledgedAt.IsZero() && !item.LeaseExpiresAt.IsZero() && !item.LeaseExpiresAt.After(now)
+		if (deadlinePassed || leaseExpired) && len(out) < limit {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) RequeueAgentCommand(_ context.Context, commandID string) (models.AgentCommand, error) {
+	var maxSeq int64
+	for _, item := range r.agentCommands {
+		if item.Seq > maxSeq {
+			maxSeq = item.Seq
+		}
+	}
+	for i := range r.agentCommands {
+		if r.agentCommands[i].ID == commandID && r.agentCommands[i].Status == models.AgentCommandRunning && r.agentCommands[i].AcknowledgedAt.IsZero() {
+			r.agentCommands[i].Status = models.AgentCommandQueued
+			r.agentCommands[i].Seq = maxSeq + 1
+			r.agentCommands[i].LeaseExpiresAt = time.Time{}
+			return r.agentCommands[i], nil
+		}
+	}
+	return models.AgentCommand{}, errors.New("agent command is no longer awaiting acknowledgement")
+}
+func (r *repoStub) CreateAgentEnrollment(_ context.Context, item models.AgentEnrollment, tokenHash string) (models.AgentEnrollment, error) {
+	if r.enrollments == nil {
+		r.enrollments = make(map[string]models.AgentEnrollment)
+	}
+	item.ID = fmt.Sprintf("enroll-%d", len(r.enrollments)+1)
+	item.CreatedAt = time.Now().UTC()
+	r.enrollments[tokenHash] = item
+	return item, nil
+}
+
+func (r *repoStub) ListAgentEnrollments(_ context.Context, providerID string, _ int) ([]models.AgentEnrollment, error) {
+	out := make([]models.AgentEnrollment, 0)
+	for _, item := range r.enrollments {
+		if providerID == "" || item.ProviderID == providerID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) ConsumeAgentEnrollment(_ context.Context, tokenHash string, hostID string, now time.Time) (models.AgentEnrollment, error) {
+	item, ok := r.enrollments[tokenHash]
+	if !ok || !item.UsedAt.IsZero() || !item.ExpiresAt.After(now) {
+		return models.AgentEnrollment{}, errors.New("enrollment token is invalid, used or expired")
+	}
+	item.UsedAt = now
+	item.HostID = hostID
+	r.enrollments[tokenHash] = item
+	return item, nil
+}
+
+func (r *repoStub) CreateAgentHost(_ context.Context, item models.AgentHost) (models.AgentHost, []models.AgentHost, error) {
+	if r.agentHosts == nil {
+		r.agentHosts = make(map[string]models.AgentHost)
+	}
+	replaced := make([]models.AgentHost, 0)
+	for id, host := range r.agentHosts {
+		if host.ProviderID == item.ProviderID && host.Status == models.AgentHostActive {
+			host.Status = models.AgentHostRevoked
+			host.RevokedBy = "enrollment"
+			host.RevokedAt = time.Now().UTC()
+			r.agentHosts[id] = host
+			replaced = append(replaced, host)
+		}
+	}
+	r.agentHosts[item.ID] = item
+	return item, replaced, nil
+}
+
+func (r *repoStub) GetAgentHost(_ context.Context, hostID string) (models.AgentHost, error) {
+	item, ok := r.agentHosts[hostID]
+	if !ok {
+		return models.AgentHost{}, errors.New("agent host not found")
+	}
+	return item, nil
+}
+
+func (r *repoStub) ListAgentHosts(_ context.Context, providerID string, _ int) ([]models.AgentHost, error) {
+	out := make([]models.AgentHost, 0)
+	for _, item := range r.agentHosts {
+		if providerID == "" || item.ProviderID == providerID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) RotateAgentHostCredential(_ context.Context, hostID string, presentedCredentialID string, credentialID string, expiresAt time.Time) (models.AgentHost, error) {
+	item, ok := r.agentHosts[hostID]
+	if !ok || item.Status != models.AgentHostActive || (presentedCredentialID != item.CredentialID && presentedCredentialID != item.PreviousCredentialID) {
+		return models.AgentHost{}, errors.New("agent credential is no longer valid")
+	}
+	item.PreviousCredentialID = item.CredentialID
+	item.CredentialID = credentialID
+	item.CredentialExpiresAt = expiresAt
+	item.RotatedAt = time.Now().UTC()
+	r.agentHosts[hostID] = item
+	return item, nil
+}
+
+func (r *repoStub) RetirePreviousAgentCredential(_ context.Context, hostID string, credentialID string) error {
+	if item, ok := r.agentHosts[hostID]; ok && item.CredentialID == credentialID {
+		item.PreviousCredentialID = ""
+		r.agentHosts[hostID] = item
+	}
+	return nil
+}
+
+func (r *repoStub) RevokeAgentHost(_ context.Context, hostID string, revokedBy string) (models.AgentHost, error) {
+	item, ok := r.agentHosts[hostID]
+	if !ok || item.Status != models.AgentHostActive {
+		return models.AgentHost{}, errors.New("agent host is already revoked")
+	}
+	item.Status = models.AgentHostRevoked
+	item.RevokedBy = revokedBy
+	item.RevokedAt = time.Now().UTC()
+	r.agentHosts[hostID] = item
+	return item, nil
+}
+
+func (r *repoStub) SetAgentHostPublicKey(_ context.Context, hostID string, publicKey string) (models.AgentHost, error) {
+	item, ok := r.agentHosts[hostID]
+	if !ok {
+		return models.AgentHost{}, errors.New("agent host not found")
+	}
+	item.PublicKey = publicKey
+	r.agentHosts[hostID] = item
+	return item, nil
+}
+
+func (r *repoStub) CreateCapacityChallenge(_ context.Context, item models.CapacityChallenge) (models.CapacityChallenge, error) {
+	if r.challenges == nil {
+		r.challenges = make(map[string]models.CapacityChallenge)
+	}
+	if item.ID == "" {
+		item.ID = fmt.Sprintf("challenge-%d", len(r.challenges)+1)
+	}
+	item.IssuedAt = time.Now().UTC()
+	r.challenges[item.ID] = item
+	return item, nil
+}
+
+func (r *repoStub) GetCapacityChallenge(_ context.Context, challengeID string) (models.CapacityChallenge, error) {
+	item, ok := r.challenges[challengeID]
+	if !ok {
+		return models.CapacityChallenge{}, errors.New("capacity challenge not found")
+	}
+	return item, nil
+}
+
+func (r *repoStub) ListCapacityChallenges(_ context.Context, providerID string, limit int) ([]models.CapacityChallenge, error) {
+	out := make([]models.CapacityChallenge, 0)
+	for _, item := range r.challenges {
+		if item.ProviderID == providerID && len(out) < limit {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) CompleteCapacityChallenge(_ context.Context, challengeID string, status models.CapacityChallengeState, detail string) (models.CapacityChallenge, error) {
+	item, ok := r.challenges[challengeID]
+	if !ok {
+		return models.CapacityChallenge{}, errors.New("capacity challenge not found")
+	}
+	if item.Status != models.CapacityChallengePending {
+		return models.CapacityChallenge{}, errors.New("capacity challenge already judged")
+	}
+	item.Status = status
+	item.Detail = detail
+	item.CompletedAt = time.Now().UTC()
+	r.challenges[challengeID] = item
+	return item, nil
+}
+
+func (r *repoStub) GetHostVerification(_ context.Context, providerID string) (models.HostVerification, error) {
+	item, ok := r.verifications[providerID]
+	if !ok {
+		return models.HostVerification{ProviderID: providerID, Status: models.HostUnverified}, nil
+	}
+	return item, nil
+}
+
+func (r *repoStub) UpsertHostVerification(_ context.Context, item models.HostVerification) (models.HostVerification, error) {
+	if r.verifications == nil {
+		r.verifications = make(map[string]models.HostVerification)
+	}
+	item.UpdatedAt = time.Now().UTC()
+	r.verifications[item.ProviderID] = item
+	return item, nil
+}
+
+func (r *repoStub) ListHostVerifications(_ context.Context, status models.HostVerificationState) ([]models.HostVerification, error) {
+	out := make([]models.HostVerification, 0)
+	for _, item := range r.verifications {
+		if status == "" || item.Status == status {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) ListGPUDeviceOwners(_ context.Context, uuids []string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, id := range uuids {
+		if item, ok := r.gpuDevices[id]; ok {
+			out[id] = item.ProviderID
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) UpsertGPUDevices(_ context.Context, items []models.GPUDevice) error {
+	if r.gpuDevices == nil {
+		r.gpuDevices = make(map[string]models.GPUDevice)
+	}
+	for _, item := range items {
+		if existing, ok := r.gpuDevices[item.UUID]; ok && existing.ProviderID != item.ProviderID {
+			continue
+		}
+		r.gpuDevices[item.UUID] = item
+	}
+	return nil
+}
+
+func (r *repoStub) GetExecPolicy(_ context.Context, providerID string) (models.ExecPolicy, error) {
+	item, ok := r.execPolicies[providerID]
+	if !ok {
+		return models.ExecPolicy{ProviderID: providerID, AllowedCommands: []string{}, MaxTimeoutSeconds: 300, RunAs: "nobody"}, nil
+	}
+	return item, nil
+}
+
+func (r *repoStub) UpsertExecPolicy(_ context.Context, item models.ExecPolicy) (models.ExecPolicy, error) {
+	if r.execPolicies == nil {
+		r.execPolicies = make(map[string]models.ExecPolicy)
+	}
+	item.UpdatedAt = time.Now().UTC()
+	r.execPolicies[item.ProviderID] = item
+	return item, nil
+}
+
+func (r *repoStub) CreateExecRun(_ context.Context, item models.ExecRun) (models.ExecRun, error) {
+	if r.execRuns == nil {
+		r.execRuns = make(map[string]models.ExecRun)
+	}
+	item.CreatedAt = time.Now().UTC()
+	r.execRuns[item.ID] = item
+	return item, nil
+}
+
+func (r *repoStub) GetExecRun(_ context.Context, execID string) (models.ExecRun, error) {
+	item, ok := r.execRuns[execID]
+	if !ok {
+		return models.ExecRun{}, errors.New("exec run not found")
+	}
+	return item, nil
+}
+
+func (r *repoStub) ListExecRuns(_ context.Context, providerID string, requestedBy string, limit int) ([]models.ExecRun, error) {
+	out := make([]models.ExecRun, 0)
+	for _, item := range r.execRuns {
+		if (providerID == "" || item.ProviderID == providerID) && (requestedBy == "" || item.RequestedBy == requestedBy) && len(out) < limit {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) AppendExecOutput(_ context.Context, execID string, stream string, data string, limit int) error {
+	item, ok := r.execRuns[execID]
+	if !ok || (item.Status != models.ExecRunQueued && item.Status != models.ExecRunRunning) {
+		return errors.New("exec run already finished")
+	}
+	target := &item.Stdout
+	if stream == "stderr" {
+		target = &item.Stderr
+	}
+	if len(*target)+len(data) > limit {
+		item.OutputTruncated = true
+	}
+	*target = (*target + data)[:min(len(*target)+len(data), limit)]
+	item.Status = models.ExecRunRunning
+	r.execRuns[execID] = item
+	return nil
+}
+
+func (r *repoStub) FinishExecRun(_ context.Context, execID string, status models.ExecRunState, exitCode int, truncated bool, detail string) (models.ExecRun, error) {
+	item, ok := r.execRuns[execID]
+	if !ok || (item.Status != models.ExecRunQueued && item.Status != models.ExecRunRunning) {
+		return models.ExecRun{}, errors.New("exec run already finished")
+	}
+	item.Status = status
+	item.ExitCode = exitCode
+	item.OutputTruncated = item.OutputTruncated || truncated
+	item.Detail = detail
+	item.FinishedAt = time.Now().UTC()
+	r.execRuns[execID] = item
+	return item, nil
+}
+
+func (r *repoStub) CreateFileTransfer(_ context.Context, item models.FileTransfer) (models.FileTransfer, error) {
+	if r.fileTransfers == nil {
+		r.fileTransfers = make(map[string]models.FileTransfer)
+	}
+	item.CreatedAt = time.Now().UTC()
+	item.UpdatedAt = item.CreatedAt
+	r.fileTransfers[item.ID] = item
+	return item, nil
+}
+
+func (r *repoStub) GetFileTransfer(_ context.Context, transferID string) (models.FileTransfer, error) {
+	item, ok := r.fileTransfers[transferID]
+	if !ok {
+		return models.FileTransfer{}, errors.New("file transfer not found")
+	}
+	return item, nil
+}
+
+func (r *repoStub) ListFileTransfers(_ context.Context, providerID string, resourceID string, requestedBy string, limit int) ([]models.FileTransfer, error) {
+	out := make([]models.FileTransfer, 0)
+	for _, item := range r.fileTransfers {
+		if (providerID == "" || item.ProviderID == providerID) && (resourceID == "" || item.ResourceID == resourceID) && (requestedBy == "" || item.RequestedBy == requestedBy) && len(out) < limit {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) UpdateFileTransfer(_ context.Context, item models.FileTransfer) (models.FileTransfer, error) {
+	current, ok := r.fileTransfers[item.ID]
+	if !ok {
+		return models.FileTransfer{}, errors.New("file transfer not found")
+	}
+	item.StoredBytes = current.StoredBytes
+	item.UpdatedAt = time.Now().UTC()
+	r.fileTransfers[item.ID] = item
+	return item, nil
+}
+
+func (r *repoStub) AppendFileTransferChunk(_ context.Context, transferID string, offset int64, data []byte, maxBytes int64) (models.FileTransfer, error) {
+	item, ok := r.fileTransfers[transferID]
+	if !ok || item.StoredBytes != offset || (item.Status != models.FileTransferReceiving && item.Status != models.FileTransferPulling) || offset+int64(len(data)) > maxBytes {
+		return models.FileTransfer{}, errors.New("file transfer chunk out of order")
+	}
+	if r.fileChunks == nil {
+		r.fileChunks = make(map[string][]models.FileTransferChunk)
+	}
+	r.fileChunks[transferID] = append(r.fileChunks[transferID], models.FileTransferChunk{Offset: offset, Data: append([]byte(nil), data...)})
+	item.StoredBytes += int64(len(data))
+	r.fileTransfers[transferID] = item
+	return item, nil
+}
+
+func (r *repoStub) GetFileTransferChunk(_ context.Context, transferID string, offset int64) ([]byte, error) {
+	for _, chunk := range r.fileChunks[transferID] {
+		if chunk.Offset == offset {
+			return chunk.Data, nil
+		}
+	}
+	return nil, errors.New("file transfer chunk not found")
+}
+
+func (r *repoStub) ListFileTransferChunks(_ context.Context, transferID string, offset int64, limit int) ([]models.FileTransferChunk, error) {
+	out := make([]models.FileTransferChunk, 0)
+	for _, chunk := range r.fileChunks[transferID] {
+		if chunk.Offset+int64(len(chunk.Data)) > offset && len(out) < limit {
+			out = append(out, chunk)
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) DeleteFileTransferChunks(_ context.Context, transferID string) error {
+	delete(r.fileChunks, transferID)
+	if item, ok := r.fileTransfers[transferID]; ok {
+		item.StoredBytes = 0
+		r.fileTransfers[transferID] = item
+	}
+	return nil
+}
+
+func (r *repoStub) ListExpiredFileTransfers(_ context.Context, now time.Time, limit int) ([]models.FileTransfer, error) {
+	out := make([]models.FileTransfer, 0)
+	for _, item := range r.fileTransfers {
+		active := item.Status == models.FileTransferReceiving || item.Status == models.FileTransferPushing || item.Status == models.FileTransferPulling
+		download := item.Direction == models.FileTransferDownload && item.Status == models.FileTransferCompleted
+		if !item.ExpiresAt.After(now) && (item.StoredBytes > 0 || active || download) && len(out) < limit {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) rolloutWithProgress(item models.Rollout) models.Rollout {
+	item.Progress = models.RolloutProgress{}
+	for _, target := range r.rolloutTargets[item.ID] {
+		item.Progress.Total++
+		switch target.Status {
+		case models.RolloutTargetPending:
+			item.Progress.Pending++
+		case models.RolloutTargetRunning:
+			item.Progress.Running++
+		case models.RolloutTargetSucceeded:
+			item.Progress.Succeeded++
+		case models.RolloutTargetFailed:
+			item.Progress.Failed++
+		case models.RolloutTargetCancelled:
+			item.Progress.Cancelled++
+		}
+	}
+	return item
+}
+
+func (r *repoStub) CreateRollout(_ context.Context, item models.Rollout, targets []models.RolloutTarget) (models.Rollout, error) {
+	if r.rollouts == nil {
+		r.rollouts = make(map[string]models.Rollout)
+		r.rolloutTargets = make(map[string][]models.RolloutTarget)
+	}
+	item.ID = fmt.Sprintf("rollout-%d", len(r.rollouts)+1)
+	item.CreatedAt = time.Now().UTC()
+	item.FailureWindowAt = item.CreatedAt
+	r.rollouts[item.ID] = item
+	for _, target := range targets {
+		target.RolloutID = item.ID
+		target.Status = models.RolloutTargetPending
+		r.rolloutTargets[item.ID] = append(r.rolloutTargets[item.ID], target)
+	}
+	return r.rolloutWithProgress(item), nil
+}
+
+func (r *repoStub) GetRollout(_ context.Context, rolloutID string) (models.Rollout, error) {
+	item, ok := r.rollouts[rolloutID]
+	if !ok {
+		return models.Rollout{}, errors.New("rollout not found")
+	}
+	return r.rolloutWithProgress(item), nil
+}
+
+func (r *repoStub) ListRollouts(_ context.Context, status models.RolloutStatus, limit int) ([]models.Rollout, error) {
+	out := make([]models.Rollout, 0)
+	for _, item := range r.rollouts {
+		if (status == "" || item.Status == status) && len(out) < limit {
+			out = append(out, r.rolloutWithProgress(item))
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) ListRolloutTargets(_ context.Context, rolloutID string) ([]models.RolloutTarget, error) {
+	return append([]models.RolloutTarget(nil), r.rolloutTargets[rolloutID]...), nil
+}
+
+func (r *repoStub) TransitionRollout(ctx context.Context, rolloutID string, from []models.RolloutStatus, status models.RolloutStatus, detail string) (models.Rollout, error) {
+	item, ok := r.rollouts[rolloutID]
+	if !ok {
+		return models.Rollout{}, errors.New("rollout not found")
+	}
+	allowed := false
+	for _, state := range from {
+		allowed = allowed || item.Status == state
+	}
+	if !allowed {
+		return models.Rollout{}, fmt.Errorf("rollout is not %v", from)
+	}
+	if item.Status == models.RolloutHalted && status == models.RolloutRunning {
+		item.FailureWindowAt = time.Now().UTC()
+	}
+	item.Status = status
+	item.Detail = detail
+	r.rollouts[rolloutID] = item
+	return r.GetRollout(ctx, rolloutID)
+}
+
+func (r *repoStub) AdvanceRolloutWave(_ context.Context, rolloutID string, wave int) error {
+	item := r.rollouts[rolloutID]
+	if item.Status == models.RolloutRunning && item.CurrentWave < wave {
+		item.CurrentWave = wave
+		r.rollouts[rolloutID] = item
+	}
+	return nil
+}
+
+func (r *repoStub) ClaimRolloutTargets(_ context.Context, rolloutID string) ([]models.RolloutTarget, error) {
+	item := r.rollouts[rolloutID]
+	out := make([]models.RolloutTarget, 0)
+	if item.Status != models.RolloutRunning {
+		return out, nil
+	}
+	targets := r.rolloutTargets[rolloutID]
+	running := 0
+	for _, target := range targets {
+		if target.Status == models.RolloutTargetRunning {
+			running++
+		}
+	}
+	for i := range targets {
+		if running >= item.MaxConcurrency {
+			break
+		}
+		if targets[i].Status == models.RolloutTargetPending && targets[i].Wave <= item.CurrentWave {
+			targets[i].Status = models.RolloutTargetRunning
+			targets[i].StartedAt = time.Now().UTC()
+			out = append(out, targets[i])
+			running++
+		}
+	}
+	return out, nil
+}
+
+func (r *repoStub) SetRolloutTargetCommand(_ context.Context, rolloutID string, providerID string, commandID string) error {
+	for i := range r.rolloutTargets[rolloutID] {
+		if r.rolloutTargets[rolloutID][i].ProviderID == providerID {
+			r.rolloutTargets[rolloutID][i].CommandID = commandID
+		}
+	}
+	return nil
+}
+
+func (r *repoStub) FinishRolloutTarget(_ context.Context, rolloutID string, providerID string, status models.RolloutTargetStatus, detail string) (models.RolloutTarget, error) {
+	targets := r.rolloutTargets[rolloutID]
+	for i := range targets {
+		if targets[i].ProviderID == providerID && (targets[i].Status == models.RolloutTargetPending || targets[i].Status == models.RolloutTargetRunning) {
+			targets[i].Status = status
+			targets[i].Detail = detail
+			targets[i].FinishedAt = time.Now().UTC()
+			return targets[i], nil
+		}
+	}
+	return models.RolloutTarget{}, errors.New("rollout target already finished")
+}
+
+func (r *repoStub) CancelPendingRolloutTargets(_ context.Context, rolloutID string, detail string) error {
+	targets := r.rolloutTargets[rolloutID]
+	for i := range targets {
+		if targets[i].Status == models.RolloutTargetPending {
+			targets[i].Status = models.RolloutTargetCancelled
+			targets[i].Detail = detail
+			targets[i].FinishedAt = time.Now().UTC()
+		}
+	}
+	return nil
+}
+
+func (r *repoStub) CreateTerminalSession(_ context.Context, item models.TerminalSession) (models.TerminalSession, error) {
+	if r.terminalByID == nil {
+		r.terminalByID = make(map[string]models.TerminalSession)
+	}
+	if item.ID == "" {
+		item.ID = fmt.Sprintf("term-%d", len(r.terminalByID)+1)
+	}
+	item.CreatedAt = time.Now().UTC()
+	item.UpdatedAt = item.CreatedAt
+	item.LastActiveAt = item.CreatedAt
+	item.InitialRows, item.InitialCols = item.Rows, item.Cols
+	r.terminalByID[item.ID] = item
+	return item, nil
+}
+func (r *repoStub) ListTerminalSessions(_ context.Context, resourceID string, _ int) ([]models.TerminalSession, error) {
+	out := make([]models.TerminalSession, 0)
+	for _, item := range r.terminalByID {
+		if item.ResourceID == resourceID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) ListProviderTerminalSessions(_ context.Context, providerID string, _ int) ([]models.TerminalSession, error) {
+	out := make([]models.TerminalSession, 0)
+	for _, item := range r.terminalByID {
+		if item.ProviderID == providerID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) GetTerminalSession(_ context.Context, sessionID string) (models.TerminalSession, error) {
+	item, ok := r.terminalByID[sessionID]
+	if !ok {
+		return models.TerminalSession{}, errors.New("not found")
+	}
+	return item, nil
+}
+func (r *repoStub) UpdateTerminalSessionStatus(_ context.Context, sessionID string, status models.TerminalSessionState, exitCode int) (models.TerminalSession, error) {
+	item, ok := r.terminalByID[sessionID]
+	if !ok {
+		return models.TerminalSession{}, errors.New("not found")
+	}
+	item.Status = status
+	item.ExitCode = exitCode
+	item.UpdatedAt = time.Now().UTC()
+	if status == models.TerminalSessionClosed || status == models.TerminalSessionExpired {
+		item.ClosedAt = item.UpdatedAt
+	}
+	r.terminalByID[sessionID] = item
+	return item, nil
+}
+func (r *repoStub) UpdateTerminalSessionSize(_ context.Context, sessionID string, rows int, cols int) (models.TerminalSession, error) {
+	item, ok := r.terminalByID[sessionID]
+	if !ok {
+		return models.TerminalSession{}, errors.New("not found")
+	}
+	item.Rows = rows
+	item.Cols = cols
+	item.UpdatedAt = time.Now().UTC()
+	r.terminalByID[sessionID] = item
+	return item, nil
+}
+func (r *repoStub) AppendTerminalChunk(_ context.Context, chunk models.TerminalChunk) (models.TerminalChunk, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	chunk.ID = "chunk-1"
+	if chunk.CreatedAt.IsZero() {
+		chunk.CreatedAt = time.Now().UTC()
+	}
+	if chunk.Direction == models.TerminalChunkInput {
+		if chunk.Seq == 0 {
+			chunk.Seq = int64(len(r.terminalInput) + 1)
+		}
+		r.terminalInput = append(r.terminalInput, chunk)
+	} else {
+		if chunk.Seq == 0 {
+			chunk.Seq = int64(len(r.terminalOut) + 1)
+		}
+		r.terminalOut = append(r.terminalOut, chunk)
+	}
+	return chunk, nil
+}
+func (r *repoStub) ReserveTerminalSeqs(_ context.Context, sessionID string, direction models.TerminalChunkDirection, count int64) (int64, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	if r.terminalSeqs == nil {
+		r.terminalSeqs = make(map[string]int64)
+	}
+	key := sessionID + "/" + string(direction)
+	r.terminalSeqs[key] += count
+	return r.terminalSeqs[key], nil
+}
+func (r *repoStub) ListTerminalChunks(_ context.Context, sessionID string, direction models.TerminalChunkDirection, afterSeq int64, limit int) ([]models.TerminalChunk, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	var source []models.TerminalChunk
+	if direction == models.TerminalChunkInput {
+		source = r.terminalInput
+	} else {
+		source = r.terminalOut
+	}
+	out := make([]models.TerminalChunk, 0)
+	for _, item := range source {
+		if item.SessionID != sessionID || item.Seq <= afterSeq {
+			continue
+		}
+		out = append(out, item)
+		if len(out) >= limit {
+			break
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) CreateTerminalAuditEvent(_ context.Context, event models.TerminalAuditEvent) (models.TerminalAuditEvent, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	event.ID = "audit-1"
+	event.CreatedAt = time.Now().UTC()
+	r.terminalAudit = append(r.terminalAudit, event)
+	return event, nil
+}
+func (r *repoStub) ListTerminalAuditEvents(_ context.Context, sessionID string, eventType string, _ int) ([]models.TerminalAuditEvent, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	out := make([]models.TerminalAuditEvent, 0)
+	for _, item := range r.terminalAudit {
+		if item.SessionID == sessionID && (eventType == "" || item.EventType == eventType) {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) PurgeTerminalRecordings(_ context.Context, endedBefore time.Time, _ int) (int, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	purged := 0
+	for id, item := range r.terminalByID {
+		if item.ClosedAt.IsZero() || item.ClosedAt.After(endedBefore) || !item.RecordingPurgedAt.IsZero() {
+			continue
+		}
+		item.RecordingPurgedAt = time.Now().UTC()
+		r.terminalByID[id] = item
+		purged++
+	}
+	return purged, nil
+}
+func (r *repoStub) UpsertTerminalParticipant(_ context.Context, item models.TerminalParticipant) (models.TerminalParticipant, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	item.UpdatedAt = time.Now().UTC()
+	for i := range r.participants {
+		if r.participants[i].SessionID == item.SessionID && r.participants[i].UserID == item.UserID {
+			item.CreatedAt = r.participants[i].CreatedAt
+			r.participants[i] = item
+			return item, nil
+		}
+	}
+	item.CreatedAt = item.UpdatedAt
+	r.participants = append(r.participants, item)
+	return item, nil
+}
+func (r *repoStub) GetTerminalParticipant(_ context.Context, sessionID string, userID string) (models.TerminalParticipant, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	for _, item := range r.participants {
+		if item.SessionID == sessionID && item.UserID == userID {
+			return item, nil
+		}
+	}
+	return models.TerminalParticipant{}, pgx.ErrNoRows
+}
+func (r *repoStub) ListTerminalParticipants(_ context.Context, sessionID string) ([]models.TerminalParticipant, error) {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	out := make([]models.TerminalParticipant, 0)
+	for _, item := range r.participants {
+		if item.SessionID == sessionID {
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) DeleteTerminalParticipant(_ context.Context, sessionID string, userID string) error {
+	r.terminalMu.Lock()
+	defer r.terminalMu.Unlock()
+	for i, item := range r.participants {
+		if item.SessionID == sessionID && item.UserID == userID {
+			r.participants = append(r.participants[:i], r.participants[i+1:]...)
+			return nil
+		}
+	}
+	return pgx.ErrNoRows
+}
+func (r *repoStub) ExpireIdleTerminalSessions(_ context.Context, _ time.Time, _ int) ([]models.TerminalSession, error) {
+	return []models.TerminalSession{}, nil
+}
+func (r *repoStub) CountActiveTerminalSessions(_ context.Context, _ string) (int, error) {
+	count := 0
+	for _, item := range r.terminalByID {
+		if item.Status == models.TerminalSessionQueued || item.Status == models.TerminalSessionOpen {
+			count++
+		}
+	}
+	return count, nil
+}
+func (r *repoStub) CreateRootInputLog(_ context.Context, item models.RootInputLog) (models.RootInputLog, error) {
+	item.ID = "root-1"
+	item.CreatedAt = time.Now().UTC()
+	r.rootInputLogs = append(r.rootInputLogs, item)
+	return item, nil
+}
+func (r *repoStub) ListRootInputLogs(_ context.Context, providerID string, resourceID string, _ int) ([]models.RootInputLog, error) {
+	out := make([]models.RootInputLog, 0)
+	for _, item := range r.rootInputLogs {
+		if providerID != "" && item.ProviderID != providerID {
+			continue
+		}
+		if resourceID != "" && item.ResourceID != resourceID {
+			continue
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+func (r *repoStub) CreateResourceLogs(_ context.Context, items []models.ResourceLog) ([]models.ResourceLog, error) {
+	for i := range items {
+		items[i].Seq = int64(len(r.resourceLogs) + 1)
+		items[i].ID = fmt.Sprintf("log-%d", items[i].Seq)
+		if items[i].CreatedAt.IsZero() {
+			items[i].CreatedAt = time.Now().UTC()
+		}
+		r.resourceLogs = append(r.resourceLogs, items[i])
+	}
+	return items, nil
+}
+func (r *repoStub) ListResourceLogs(_ context.Context, query models.ResourceLogQuery) ([]models.ResourceLog, error) {
+	out := make([]models.ResourceLog, 0)
+	for i := range r.resourceLogs {
+		item := r.resourceLogs[i]
+		if query.AfterSeq == 0 {
+			item = r.resourceLogs[len(r.resourceLogs)-1-i]
+		}
+		if item.ResourceID != query.ResourceID || (query.AfterSeq > 0 && item.Seq <= query.AfterSeq) || (query.BeforeSeq > 0 && item.Seq >= query.BeforeSeq) {
+			continue
+		}
+		if query.Text != "" && !strings.Contains(strings.ToLower(item.Message), strings.ToLower(query.Text)) {
+			continue
+		}
+		if query.Source != "" && item.Source != query.Source {
+			continue
+		}
+		if len(query.Levels) > 0 {
+			matched := false
+			for _, level := range query.Levels {
+				matched = matched || string(item.Level) == level
+			}
+			if !matched {
+				continue
+			}
+		}
+		out = append(out, item)
+		if len(out) == query.Limit {
+			break
+		}
+	}
+	return out, nil
+}
+func (r *repoStub) DeleteResourceLogsBefore(_ context.Context, cutoff time.Time, _ int) (int64, error) {
+	kept := make([]models.ResourceLog, 0, len(r.resourceLogs))
+	for _, item := range r.resourceLogs {
+		if item.CreatedAt.After(cutoff) {
+			kept = append(kept, item)
+		}
+	}
+	deleted := int64(len(r.resourceLogs) - len(kept))
+	r.resourceLogs = kept
+	return deleted, nil
+}
+func (r *repoStub) ConsumeCreateRateLimit(_ context.Context, _ string, _ time.Time, _ time.Time, limit int) (bool, error) {
+	if r.createEvents >= limit {
+		return false, nil
+	}
+	r.createEvents++
+	return true, nil
+}
+func (r *repoStub) CreateKubernetesCluster(_ context.Context, item models.KubernetesCluster) (models.KubernetesCluster, error) {
+	item.CreatedAt = time.Now().UTC()
+	item.UpdatedAt = item.CreatedAt
+	if r.k8sByID == nil {
+		r.k8sByID = make(map[string]models.KubernetesCluster)
+	}
+	r.k8sByID[item.ID] = item
+	return item, nil
+}
+func (r *repoStub) GetKubernetesCluster(_ context.Context, clusterID string) (models.KubernetesCluster, error) {
+	item, ok := r.k8sByID[clusterID]
+	if !ok {
+		return models.KubernetesCluster{}, errors.New("not found")
+	}
+	return item, nil
+}
+func (r *repoStub) ListKubernetesClusters(_ context.Context, _ string) ([]models.KubernetesCluster, error) {
+	out := make([]models.KubernetesCluster, 0, len(r.k8sByID))
+	for _, item := range r.k8sByID {
+		out = append(out, item)
+	}
+	return out, nil
+}
+func (r *repoStub) UpdateKubernetesClusterStatus(_ context.Context, clusterID string, status models.ClusterStatus) error {
+	item, ok := r.k8sByID[clusterID]
+	if !ok {
+		return errors.New("not found")
+	}
+	item.Status = status
+	item.UpdatedAt = time.Now().UTC()
+	r.k8sByID[clusterID] = item
+	return nil
+}
+func (r *repoStub) DeleteKubernetesCluster(_ context.Context, clusterID string) error {
+	delete(r.k8sByID, clusterID)
+	return nil
+}
+
+type cgStub struct{}
+
+func (cgStub) Apply(_ string, _ int, _ int, _ int) error { return nil }
+func (cgStub) Release(_ string) error                    { return nil }
+
+type orchestratorStub struct{}
+
+func (orchestratorStub) ProvisionCluster(_ context.Context, spec orchestrator.ClusterSpec) (orchestrator.RuntimeCluster, error) {
+	return orchestrator.RuntimeCluster{
+		Endpoint:   "https://cluster.local",
+		Kubeconfig: "kubeconfig-content-" + spec.Name,
+	}, nil
+}
+
+func (orchestratorStub) DeleteCluster(_ context.Context, _ string) error { return nil }
+
+func (orchestratorStub) RefreshClusterStatus(_ context.Context, _ string) (string, error) {
+	return "running", nil
+}
+
+type userDirectoryStub map[string]string
+
+func (d userDirectoryStub) LookupUserByEmail(_ context.Context, email string) (string, error) {
+	userID, ok := d[email]
+	if !ok {
+		return "", errors.New("user not found")
+	}
+	return userID, nil
+}
+
+type provisioningStub struct{}
+
+func (provisioningStub) CreateVM(_ context.Context, _ provisioning.CreateVMRequest) (provisioning.ProvisionResult, error) {
+	return provisioning.ProvisionResult{ExternalID: "ext-vm-1", PublicIP: "203.0.113.10", Status: "succeeded"}, nil
+}
+func (provisioningStub) DeleteVM(_ context.Context, _ string, _ provisioning.DeleteRequest) error {
+	return nil
+}
+func (provisioningStub) CreatePod(_ context.Context, _ provisioning.CreatePodRequest) (provisioning.ProvisionResult, error) {
+	return provisioning.ProvisionResult{ExternalID: "ext-pod-1", Status: "succeeded"}, nil
+}
+func (provisioningStub) DeletePod(_ context.Context, _ string, _ provisioning.DeleteRequest) error {
+	return nil
+}
+
+func TestAllocateChecksFreeResources(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{
+			ProviderID:   "p1",
+			CPUFreeCores: 4,
+			RAMFreeMB:    4096,
+			GPUFreeUnits: 1,
+			HeartbeatAt:  time.Now().UTC(),
+		},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	_, err := svc.Allocate(context.Background(), models.Allocation{
+		ProviderID: "p1",
+		CPUCores:   8,
+		RAMMB:      4096,
+		GPUUnits:   1,
+	})
+	if err == nil {
+		t.Fatal("expected insufficient resources error")
+	}
+}
+
+func TestAllocateRejectsStaleHeartbeat(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{
+			ProviderID:   "p1",
+			CPUFreeCores: 8,
+			RAMFreeMB:    8192,
+			GPUFreeUnits: 1,
+			HeartbeatAt:  time.Now().UTC().Add(-2 * time.Minute),
+		},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	_, err := svc.Allocate(context.Background(), models.Allocation{
+		ProviderID: "p1",
+		CPUCores:   1,
+		RAMMB:      512,
+		GPUUnits:   0,
+	})
+	if err == nil {
+		t.Fatal("expected stale heartbeat error")
+	}
+}
+
+func TestAllocateRejectsInvalidHeartbeatValues(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{
+			ProviderID:   "p1",
+			CPUFreeCores: -1,
+			RAMFreeMB:    8192,
+			GPUFreeUnits: 1,
+			HeartbeatAt:  time.Now().UTC(),
+		},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	_, err := svc.Allocate(context.Background(), models.Allocation{
+		ProviderID: "p1",
+		CPUCores:   1,
+		RAMMB:      512,
+		GPUUnits:   0,
+	})
+	if err == nil {
+		t.Fatal("expected invalid heartbeat value error")
+	}
+}
+
+func TestVMLifecycle(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	vm, err := svc.CreateVM(ctx, models.VM{
+		UserID:      "u1",
+		ProviderID:  "p1",
+		Name:        "vm-alpha",
+		Template:    "fastpanel",
+		OSName:      "Ubuntu 22.04",
+		CPUCores:    4,
+		RAMMB:       8192,
+		GPUUnits:    1,
+		NetworkMbps: 500,
+	})
+	if err != nil {
+		t.Fatalf("create vm: %v", err)
+	}
+	if vm.Status != models.VMStatusRunning {
+		t.Fatalf("expected running after provision, got %s", vm.Status)
+	}
+	if vm.Region != "any" {
+		t.Fatalf("expected default region any, got %s", vm.Region)
+	}
+	if vm.CloudType != "secure" {
+		t.Fatalf("expected default cloud type secure, got %s", vm.CloudType)
+	}
+	if vm.AvailabilityTier != "low" {
+		t.Fatalf("expected default availability low, got %s", vm.AvailabilityTier)
+	}
+	if vm.VCPU != vm.CPUCores {
+		t.Fatalf("expected vcpu mirror cpu_cores, got %d", vm.VCPU)
+	}
+
+	vm, err = svc.StopVM(ctx, "u1", vm.ID)
+	if err != nil {
+		t.Fatalf("stop vm: %v", err)
+	}
+	if vm.Status != models.VMStatusStopped {
+		t.Fatalf("expected stopped, got %s", vm.Status)
+	}
+
+	vm, err = svc.StartVM(ctx, "u1", vm.ID)
+	if err != nil {
+		t.Fatalf("start vm: %v", err)
+	}
+	if vm.Status != models.VMStatusRunning {
+		t.Fatalf("expected running, got %s", vm.Status)
+	}
+
+	vm, err = svc.TerminateVM(ctx, vm.ID)
+	if err != nil {
+		t.Fatalf("terminate vm: %v", err)
+	}
+	if vm.Status != models.VMStatusTerminated {
+		t.Fatalf("expected terminated, got %s", vm.Status)
+	}
+}
+
+func TestCreateKubernetesCluster(t *testing.T) {
+	repo := &repoStub{k8sByID: map[string]models.KubernetesCluster{}}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	cluster, err := svc.CreateKubernetesCluster(context.Background(), models.KubernetesCluster{
+		UserID:     "u1",
+		Name:       "core-cluster",
+		ProviderID: "p1",
+		NodeCount:  3,
+		NodeType:   "shared-cpu",
+		K8sVersion: "1.30",
+	})
+	if err != nil {
+		t.Fatalf("create cluster: %v", err)
+	}
+	if cluster.Status != models.ClusterStatusRunning {
+		t.Fatalf("expected running cluster, got %s", cluster.Status)
+	}
+	if cluster.Endpoint == "" {
+		t.Fatal("expected endpoint to be set")
+	}
+}
+
+func TestSharedInventoryReserveFlow(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	offer, err := svc.UpsertSharedInventoryOffer(context.Background(), models.SharedInventoryOffer{
+		ProviderID:   "p1",
+		ResourceType: "gpu",
+		Title:        "Shared H100",
+		Description:  "8x H100 pool",
+		CPUCores:     32,
+		RAMMB:        131072,
+		GPUUnits:     8,
+		NetworkMbps:  20000,
+		Quantity:     8,
+		AvailableQty: 8,
+		PriceHourly:  4.2,
+		CreatedBy:    "owner-1",
+	})
+	if err != nil {
+		t.Fatalf("upsert shared offer: %v", err)
+	}
+	if offer.ID == "" {
+		t.Fatal("expected non-empty offer id")
+	}
+
+	reserved, err := svc.ReserveSharedInventoryOffer(context.Background(), "renter-1", offer.ID, 3)
+	if err != nil {
+		t.Fatalf("reserve shared offer: %v", err)
+	}
+	if reserved.Status != models.OfferBookingHeld || reserved.Quantity != 3 {
+		t.Fatalf("expected held booking for 3 units, got %+v", reserved)
+	}
+	if repo.sharedOffers[0].AvailableQty != 5 {
+		t.Fatalf("expected available qty 5, got %d", repo.sharedOffers[0].AvailableQty)
+	}
+}
+
+type billingStub struct {
+	started     []billing.StartRentalRequest
+	stopped     []string
+	stoppedRefs []string
+	refunded    []string
+	credits     []billing.CreditRequest
+	stopErr     error
+	startErr    error
+	// startLost makes StartRental open the rental and still return startErr,
+	// like a response lost after billingservice committed.
+	startLost bool
+}
+
+func (b *billingStub) StartRental(_ context.Context, req billing.StartRentalRequest) (billing.Rental, error) {
+	if b.startErr != nil && !b.startLost {
+		return billing.Rental{}, b.startErr
+	}
+	b.started = append(b.started, req)
+	if b.startErr != nil {
+		return billing.Rental{}, b.startErr
+	}
+	return billing.Rental{ID: fmt.Sprintf("rental-%d", len(b.started)), ReferenceID: req.ReferenceID, Status: "running", PriceHourly: req.PriceHourly}, nil
+}
+func (b *billingStub) StopRentalByReference(_ context.Context, referenceID string) (billing.Rental, error) {
+	if b.stopErr != nil {
+		return billing.Rental{}, b.stopErr
+	}
+	for i, req := range b.started {
+		if req.ReferenceID == referenceID {
+			b.stoppedRefs = append(b.stoppedRefs, referenceID)
+			return billing.Rental{ID: fmt.Sprintf("rental-%d", i+1), ReferenceID: referenceID, Status: "stopped"}, nil
+		}
+	}
+	return billing.Rental{}, nil
+}
+func (b *billingStub) StopRental(_ context.Context, rentalID string) (billing.Rental, error) {
+	if b.stopErr != nil {
+		return billing.Rental{}, b.stopErr
+	}
+	b.stopped = append(b.stopped, rentalID)
+	return billing.Rental{ID: rentalID, Status: "stopped"}, nil
+}
+func (b *billingStub) RefundRental(_ context.Context, rentalID string, _ float64) (billing.Rental, error) {
+	b.refunded = append(b.refunded, rentalID)
+	return billing.Rental{ID: rentalID, Status: "stopped"}, nil
+}
+
+func (b *billingStub) IssueCredit(_ context.Context, req billing.CreditRequest) (billing.Credit, error) {
+	for _, credit := range b.credits {
+		if credit.ReferenceID == req.ReferenceID {
+			return billing.Credit{ReferenceID: req.ReferenceID, BasisUSD: 100, AmountUSD: req.CreditPct}, nil
+		}
+	}
+	b.credits = append(b.credits, req)
+	return billing.Credit{ID: fmt.Sprintf("credit-%d", len(b.credits)), ReferenceID: req.ReferenceID, BasisUSD: 100, AmountUSD: req.CreditPct}, nil
+}
+
+func TestOfferBookingLifecycle(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{ProviderID: "p1", CPUFreeCores: 64, RAMFreeMB: 262144, GPUFreeUnits: 8, HeartbeatAt: time.Now().UTC()},
+		sharedOffers: []models.SharedInventoryOffer{{
+			ID: "offer-1", ProviderID: "p1", Title: "A100 slice", CPUCores: 4, RAMMB: 16384, GPUUnits: 1,
+			Quantity: 4, AvailableQty: 4, PriceHourly: 1.5, Status: models.SharedInventoryStatusActive,
+		}},
+	}
+	bill := &billingStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Billing: bill, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+	available := func() int { return repo.sharedOffers[0].AvailableQty }
+
+	booking, err := svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 2)
+	if err != nil || available() != 2 {
+		t.Fatalf("expected hold of 2 units, got %+v available=%d err=%v", booking, available(), err)
+	}
+	if _, err := svc.ReserveSharedInventoryOffer(ctx, "other", "offer-1", 3); err == nil {
+		t.Fatal("expected oversized hold to be rejected")
+	}
+	if _, err := svc.ConfirmOfferBooking(ctx, "other", booking.ID); err == nil {
+		t.Fatal("expected confirm by another user to fail")
+	}
+	confirmed, err := svc.ConfirmOfferBooking(ctx, "renter", booking.ID)
+	if err != nil {
+		t.Fatalf("confirm booking: %v", err)
+	}
+	if confirmed.Status != models.OfferBookingConfirmed || confirmed.AllocationID == "" || confirmed.BillingRentalID != "rental-1" {
+		t.Fatalf("expected confirmed booking with allocation and rental, got %+v", confirmed)
+	}
+	alloc := repo.allocations[0]
+	if alloc.CPUCores != 8 || alloc.RAMMB != 32768 || alloc.GPUUnits != 2 {
+		t.Fatalf("expected allocation for two units, got %+v", alloc)
+	}
+	if len(bill.started) != 1 || bill.started[0].ReferenceID != booking.ID || bill.started[0].PriceHourly != 3 {
+		t.Fatalf("expected billing at 3/h for booking, got %+v", bill.started)
+	}
+
+	cancelled, err := svc.CancelOfferBooking(ctx, "renter", booking.ID)
+	if err != nil || cancelled.Status != models.OfferBookingCancelled {
+		t.Fatalf("expected cancelled booking, got %+v err=%v", cancelled, err)
+	}
+	if len(bill.stopped) != 1 || repo.allocations[0].ReleasedAt == nil || available() != 4 {
+		t.Fatalf("expected billing stopped, allocation released and quantity returned, available=%d", available())
+	}
+	if again, err := svc.CancelOfferBooking(ctx, "renter", booking.ID); err != nil || again.Status != models.OfferBookingCancelled || available() != 4 {
+		t.Fatalf("expected repeated cancel to leave the booking as is, got %+v available=%d err=%v", again, available(), err)
+	}
+
+	hold, err := svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 1)
+	if err != nil {
+		t.Fatalf("reserve for expiry: %v", err)
+	}
+	if err := svc.ExpireOfferHolds(ctx, time.Now().UTC().Add(16*time.Minute)); err != nil {
+		t.Fatalf("expire holds: %v", err)
+	}
+	if expired, _ := repo.GetOfferBooking(ctx, hold.ID); expired.Status != models.OfferBookingReleased || available() != 4 {
+		t.Fatalf("expected unpaid hold released, got %s available=%d", expired.Status, available())
+	}
+	if _, err := svc.ConfirmOfferBooking(ctx, "renter", hold.ID); err == nil {
+		t.Fatal("expected released hold to be unconfirmable")
+	}
+
+	paid, err := svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 1)
+	if err != nil {
+		t.Fatalf("reserve for refund: %v", err)
+	}
+	if _, err := svc.ConfirmOfferBooking(ctx, "renter", paid.ID); err != nil {
+		t.Fatalf("confirm for refund: %v", err)
+	}
+	refunded, err := svc.RefundOfferBooking(ctx, paid.ID, 0)
+	if err != nil || refunded.Status != models.OfferBookingRefunded {
+		t.Fatalf("expected refunded booking, got %+v err=%v", refunded, err)
+	}
+	if len(bill.refunded) != 1 || available() != 4 {
+		t.Fatalf("expected billing refund and quantity returned, available=%d", available())
+	}
+}
+
+func TestCancelOfferBookingClosesBeforeStoppingBilling(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{ProviderID: "p1", CPUFreeCores: 64, RAMFreeMB: 262144, GPUFreeUnits: 8, HeartbeatAt: time.Now().UTC()},
+		sharedOffers: []models.SharedInventoryOffer{{
+			ID: "offer-1", ProviderID: "p1", Title: "A100 slice", CPUCores: 4, RAMMB: 16384, GPUUnits: 1,
+			Quantity: 4, AvailableQty: 4, PriceHourly: 1.5, Status: models.SharedInventoryStatusActive,
+		}},
+	}
+	bill := &billingStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Billing: bill, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	booking, err := svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 1)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if _, err := svc.ConfirmOfferBooking(ctx, "renter", booking.ID); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if _, err := svc.RefundOfferBooking(ctx, booking.ID, 0); err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+	if _, err := svc.CancelOfferBooking(ctx, "renter", booking.ID); err == nil {
+		t.Fatal("expected cancel of a refunded booking to fail")
+	}
+	if len(bill.stopped) != 0 {
+		t.Fatalf("expected billing untouched when the booking cannot close, got %v", bill.stopped)
+	}
+
+	booking, err = svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 1)
+	if err != nil {
+		t.Fatalf("reserve again: %v", err)
+	}
+	confirmed, err := svc.ConfirmOfferBooking(ctx, "renter", booking.ID)
+	if err != nil {
+		t.Fatalf("confirm again: %v", err)
+	}
+	bill.stopErr = errors.New("billing unavailable")
+	if _, err := svc.CancelOfferBooking(ctx, "renter", booking.ID); err == nil || !strings.Contains(err.Error(), "cancel again") {
+		t.Fatalf("expected billing stop failure to be reported, got %v", err)
+	}
+	stored, _ := repo.GetOfferBooking(ctx, booking.ID)
+	if stored.Status != models.OfferBookingCancelled || repo.sharedOffers[0].AvailableQty != 4 {
+		t.Fatalf("expected booking cancelled and quantity returned, got %s available=%d", stored.Status, repo.sharedOffers[0].AvailableQty)
+	}
+	for _, alloc := range repo.allocations {
+		if alloc.ID == confirmed.AllocationID && alloc.ReleasedAt == nil {
+			t.Fatal("expected allocation released")
+		}
+	}
+	bill.stopErr = nil
+	if _, err := svc.CancelOfferBooking(ctx, "renter", booking.ID); err != nil {
+		t.Fatalf("retry cancel: %v", err)
+	}
+	if len(bill.stopped) != 1 || bill.stopped[0] != confirmed.BillingRentalID {
+		t.Fatalf("expected retry to stop the rental, got %v", bill.stopped)
+	}
+
+	// A confirm that lands between the read and the close is still undone.
+	held, err := svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 1)
+	if err != nil {
+		t.Fatalf("reserve for race: %v", err)
+	}
+	if confirmed, err = svc.ConfirmOfferBooking(ctx, "renter", held.ID); err != nil {
+		t.Fatalf("confirm for race: %v", err)
+	}
+	stale := NewResourceService(staleBookingRepo{repoStub: repo, booking: held}, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Billing: bill, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	if _, err := stale.CancelOfferBooking(ctx, "renter", held.ID); err != nil {
+		t.Fatalf("cancel with a stale read: %v", err)
+	}
+	if len(bill.stopped) != 2 || bill.stopped[1] != confirmed.BillingRentalID {
+		t.Fatalf("expected the rental confirmed after the read to be stopped, got %v", bill.stopped)
+	}
+	for _, alloc := range repo.allocations {
+		if alloc.ID == confirmed.AllocationID && alloc.ReleasedAt == nil {
+			t.Fatal("expected the allocation confirmed after the read to be released")
+		}
+	}
+}
+
+func TestConcurrentOfferBookingConfirmsBillOnce(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{ProviderID: "p1", CPUFreeCores: 64, RAMFreeMB: 262144, GPUFreeUnits: 8, HeartbeatAt: time.Now().UTC()},
+		sharedOffers: []models.SharedInventoryOffer{{
+			ID: "offer-1", ProviderID: "p1", Title: "A100 slice", CPUCores: 4, RAMMB: 16384, GPUUnits: 1,
+			Quantity: 4, AvailableQty: 4, PriceHourly: 1.5, Status: models.SharedInventoryStatusActive,
+		}},
+	}
+	bill := &billingStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Billing: bill, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	booking, err := svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 1)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	results := make([]error, 2)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, results[i] = svc.ConfirmOfferBooking(ctx, "renter", booking.ID)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if (results[0] == nil) == (results[1] == nil) {
+		t.Fatalf("expected exactly one confirm to win, got %v", results)
+	}
+
+	// A confirm that read the booking while it was still held loses the claim
+	// without touching the winner's rental.
+	stale := NewResourceService(staleBookingRepo{repoStub: repo, booking: booking}, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Billing: bill, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	if _, err := stale.ConfirmOfferBooking(ctx, "renter", booking.ID); err == nil {
+		t.Fatal("expected a confirm with a stale read to fail")
+	}
+	stored, _ := repo.GetOfferBooking(ctx, booking.ID)
+	if stored.Status != models.OfferBookingConfirmed || stored.BillingRentalID == "" {
+		t.Fatalf("expected the booking confirmed with a rental, got %+v", stored)
+	}
+	if len(bill.started) != 1 || len(bill.stopped) != 0 {
+		t.Fatalf("expected one rental started and none stopped, got started=%d stopped=%v", len(bill.started), bill.stopped)
+	}
+	if len(repo.allocations) != 1 || repo.allocations[0].ID != stored.AllocationID || repo.allocations[0].ReleasedAt != nil {
+		t.Fatalf("expected the winner's allocation alone and still held, got %+v", repo.allocations)
+	}
+}
+
+func TestOfferBookingBillingStartFailureStopsByReference(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{ProviderID: "p1", CPUFreeCores: 64, RAMFreeMB: 262144, GPUFreeUnits: 8, HeartbeatAt: time.Now().UTC()},
+		sharedOffers: []models.SharedInventoryOffer{{
+			ID: "offer-1", ProviderID: "p1", Title: "A100 slice", CPUCores: 4, RAMMB: 16384, GPUUnits: 1,
+			Quantity: 4, AvailableQty: 4, PriceHourly: 1.5, Status: models.SharedInventoryStatusActive,
+		}},
+	}
+	bill := &billingStub{startErr: errors.New("billing unavailable")}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Billing: bill, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+	available := func() int { return repo.sharedOffers[0].AvailableQty }
+	allReleased := func() bool {
+		for _, alloc := range repo.allocations {
+			if alloc.ReleasedAt == nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Billing refused the start: nothing is metered and the hold stays.
+	booking, err := svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 1)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if _, err := svc.ConfirmOfferBooking(ctx, "renter", booking.ID); err == nil {
+		t.Fatal("expected confirm to fail when billing is down")
+	}
+	if stored, _ := repo.GetOfferBooking(ctx, booking.ID); stored.Status != models.OfferBookingHeld || !allReleased() {
+		t.Fatalf("expected the hold kept and the allocation released, got %s", stored.Status)
+	}
+
+	// Billing opened the meter but the response was lost: it is stopped and
+	// the hold released, so a retry cannot pick the stopped rental back up.
+	bill.startLost = true
+	if _, err := svc.ConfirmOfferBooking(ctx, "renter", booking.ID); err == nil {
+		t.Fatal("expected confirm to fail when the billing response is lost")
+	}
+	if len(bill.stoppedRefs) != 1 || bill.stoppedRefs[0] != booking.ID {
+		t.Fatalf("expected the lost rental stopped by reference, got %v", bill.stoppedRefs)
+	}
+	if stored, _ := repo.GetOfferBooking(ctx, booking.ID); stored.Status != models.OfferBookingReleased || available() != 4 || !allReleased() {
+		t.Fatalf("expected the hold released and quantity returned, got %s available=%d", stored.Status, available())
+	}
+
+	// A stop that fails too leaves the booking confirming until the expiry
+	// worker releases it and stops billing again.
+	stuck, err := svc.ReserveSharedInventoryOffer(ctx, "renter", "offer-1", 1)
+	if err != nil {
+		t.Fatalf("reserve again: %v", err)
+	}
+	bill.stopErr = errors.New("billing unavailable")
+	if _, err := svc.ConfirmOfferBooking(ctx, "renter", stuck.ID); err == nil {
+		t.Fatal("expected confirm to fail")
+	}
+	if stored, _ := repo.GetOfferBooking(ctx, stuck.ID); stored.Status != models.OfferBookingConfirming {
+		t.Fatalf("expected the booking left confirming, got %s", stored.Status)
+	}
+	bill.stopErr = nil
+	if err := svc.ExpireOfferHolds(ctx, time.Now().UTC().Add(time.Hour)); err != nil {
+		t.Fatalf("expire holds: %v", err)
+	}
+	if stored, _ := repo.GetOfferBooking(ctx, stuck.ID); stored.Status != models.OfferBookingReleased || available() != 4 {
+		t.Fatalf("expected the stuck booking released, got %s available=%d", stored.Status, available())
+	}
+	if len(bill.stoppedRefs) != 2 || bill.stoppedRefs[1] != stuck.ID {
+		t.Fatalf("expected the expired booking's rental stopped by reference, got %v", bill.stoppedRefs)
+	}
+}
+
+// staleBookingRepo returns a booking as it was before a concurrent change.
+type staleBookingRepo struct {
+	*repoStub
+	booking models.OfferBooking
+}
+
+func (r staleBookingRepo) GetOfferBooking(context.Context, string) (models.OfferBooking, error) {
+	return r.booking, nil
+}
+
+func TestClearAuctionRules(t *testing.T) {
+	base := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	bids := []models.OfferBid{
+		{ID: "a", UserID: "u1", Quantity: 2, MaxPriceHourly: 3.0, CreatedAt: base},
+		{ID: "b", UserID: "u2", Quantity: 2, MaxPriceHourly: 2.5, CreatedAt: base.Add(time.Second)},
+		{ID: "c", UserID: "u3", Quantity: 2, MaxPriceHourly: 2.0, CreatedAt: base.Add(2 * time.Second)},
+		{ID: "d", UserID: "u4", Quantity: 1, MaxPriceHourly: 0.5, CreatedAt: base.Add(3 * time.Second)},
+	}
+	cases := []struct {
+		name     string
+		rule     models.AuctionRule
+		capacity int
+		price    float64
+		awards   map[string]int
+	}{
+		{"uniform scarce", models.AuctionRuleUniform, 4, 2.5, map[string]int{"a": 2, "b": 2}},
+		{"second price scarce", models.AuctionRuleSecondPrice, 4, 2.0, map[string]int{"a": 2, "b": 2}},
+		{"uniform partial fill", models.AuctionRuleUniform, 5, 2.0, map[string]int{"a": 2, "b": 2, "c": 1}},
+		{"second price partial fill", models.AuctionRuleSecondPrice, 5, 2.0, map[string]int{"a": 2, "b": 2, "c": 1}},
+		{"uniform surplus", models.AuctionRuleUniform, 10, 2.0, map[string]int{"a": 2, "b": 2, "c": 2}},
+		{"second price surplus falls to reserve", models.AuctionRuleSecondPrice, 10, 1.0, map[string]int{"a": 2, "b": 2, "c": 2}},
+	}
+	for _, tc := range cases {
+		price, awards := clearAuction(tc.rule, tc.capacity, 1.0, bids)
+		if price != tc.price {
+			t.Fatalf("%s: expected clearing price %.2f, got %.2f", tc.name, tc.price, price)
+		}
+		if len(awards) != len(tc.awards) {
+			t.Fatalf("%s: expected %d awards, got %+v", tc.name, len(tc.awards), awards)
+		}
+		for _, award := range awards {
+			if award.Quantity != tc.awards[award.BidID] || award.PriceHourly != tc.price {
+				t.Fatalf("%s: unexpected award %+v", tc.name, award)
+			}
+		}
+	}
+
+	tied := []models.OfferBid{
+		{ID: "late", UserID: "u1", Quantity: 2, MaxPriceHourly: 3.0, CreatedAt: base.Add(time.Second)},
+		{ID: "early", UserID: "u2", Quantity: 2, MaxPriceHourly: 3.0, CreatedAt: base},
+	}
+	_, awards := clearAuction(models.AuctionRuleUniform, 3, 1.0, tied)
+	if len(awards) != 2 || awards[0].BidID != "early" || awards[0].Quantity != 2 || awards[1].Quantity != 1 {
+		t.Fatalf("expected the earlier bid to win a price tie, got %+v", awards)
+	}
+	if price, awards := clearAuction(models.AuctionRuleUniform, 4, 5.0, bids); price != 0 || len(awards) != 0 {
+		t.Fatalf("expected no awards under the reserve, got price=%.2f awards=%+v", price, awards)
+	}
+}
+
+func TestAuctionClearingPeriods(t *testing.T) {
+	due := time.Now().UTC().Truncate(time.Second)
+	repo := &repoStub{
+		resource: models.HostResource{ProviderID: "p1", CPUFreeCores: 64, RAMFreeMB: 262144, GPUFreeUnits: 8, HeartbeatAt: time.Now().UTC()},
+		sharedOffers: []models.SharedInventoryOffer{{
+			ID: "auction-1", ProviderID: "p1", ResourceType: "gpu", Title: "L40S slice", CPUCores: 2, RAMMB: 4096, GPUUnits: 1,
+			Quantity: 4, AvailableQty: 4, PriceHourly: 1.0, Status: models.SharedInventoryStatusActive,
+			PricingMode: models.OfferPricingAuction, AuctionRule: models.AuctionRuleUniform, ClearingPeriodMin: 60, NextClearingAt: &due,
+		}},
+	}
+	bill := &billingStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Billing: bill, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+	offer := func() models.SharedInventoryOffer { return repo.sharedOffers[0] }
+	bid := func(id string) models.OfferBid {
+		item, _ := repo.GetOfferBid(ctx, id)
+		return item
+	}
+
+	if _, err := svc.ReserveSharedInventoryOffer(ctx, "renter-a", "auction-1", 1); err == nil {
+		t.Fatal("expected fixed-price reserve on an auction offer to fail")
+	}
+	if _, err := svc.PlaceOfferBid(ctx, "renter-a", "auction-1", 1, 0.5, 4); err == nil {
+		t.Fatal("expected bid under the reserve price to fail")
+	}
+	if _, err := svc.PlaceOfferBid(ctx, "renter-a", "auction-1", 5, 3.0, 4); err == nil {
+		t.Fatal("expected bid over offer capacity to fail")
+	}
+	a, _ := svc.PlaceOfferBid(ctx, "renter-a", "auction-1", 2, 3.0, 4)
+	b, _ := svc.PlaceOfferBid(ctx, "renter-b", "auction-1", 2, 2.5, 4)
+	c, _ := svc.PlaceOfferBid(ctx, "renter-c", "auction-1", 2, 2.0, 4)
+
+	// A late tick still clears the scheduled period.
+	if err := svc.ClearAuctions(ctx, due.Add(20*time.Second)); err != nil {
+		t.Fatalf("first clearing: %v", err)
+	}
+	if got := *offer().NextClearingAt; !got.Equal(due.Add(time.Hour)) {
+		t.Fatalf("expected the next period to end an hour after the scheduled start, got %s", got)
+	}
+	if bid(a.ID).Status != models.OfferBidWinning || bid(b.ID).Status != models.OfferBidWinning || bid(c.ID).Status != models.OfferBidOpen {
+		t.Fatalf("unexpected first clearing outcome: a=%+v b=%+v c=%+v", bid(a.ID), bid(b.ID), bid(c.ID))
+	}
+	if offer().LastClearingPriceUSD != 2.5 || offer().AvailableQty != 0 {
+		t.Fatalf("expected published price 2.5 and no spare capacity, got %+v", offer())
+	}
+	if len(bill.started) != 2 || bill.started[0].PriceHourly != 5.0 || bill.started[1].PriceHourly != 5.0 {
+		t.Fatalf("expected winners metered at clearing price x quantity, got %+v", bill.started)
+	}
+
+	d, _ := svc.PlaceOfferBid(ctx, "renter-d", "auction-1", 3, 4.0, 4)
+	next := *offer().NextClearingAt
+	if err := svc.ClearAuctions(ctx, next.Add(-time.Minute)); err != nil || len(repo.clearings) != 1 {
+		t.Fatalf("expected no clearing before the period ends, got %d clearings err=%v", len(repo.clearings), err)
+	}
+	if bid(b.ID).Status != models.OfferBidWinning {
+		t.Fatal("expected outbid capacity to be kept until the period ends")
+	}
+	if err := svc.ClearAuctions(ctx, next); err != nil {
+		t.Fatalf("second clearing: %v", err)
+	}
+	if got := bid(d.ID); got.Status != models.OfferBidWinning || got.AllocatedQty != 3 || got.ClearingPriceUSD != 3.0 {
+		t.Fatalf("expected new high bid to win 3 units at 3.0, got %+v", got)
+	}
+	if got := bid(a.ID); got.Status != models.OfferBidWinning || got.AllocatedQty != 1 || got.ClearingPriceUSD != 3.0 {
+		t.Fatalf("expected previous winner to keep 1 unit at the new price, got %+v", got)
+	}
+	if bid(b.ID).Status != models.OfferBidOutbid || bid(c.ID).Status != models.OfferBidOpen {
+		t.Fatalf("expected b outbid and c still open, got b=%+v c=%+v", bid(b.ID), bid(c.ID))
+	}
+	if len(bill.stopped) != 2 || !slices.Contains(bill.stopped, bid(b.ID).BillingRentalID) || slices.Contains(bill.stopped, bid(a.ID).BillingRentalID) {
+		t.Fatalf("expected outbid and repriced meters to stop, got %+v", bill.stopped)
+	}
+	released := 0
+	for _, alloc := range repo.allocations {
+		if alloc.ReleasedAt != nil {
+			released++
+		}
+	}
+	if released != 2 {
+		t.Fatalf("expected outbid and repriced allocations released, got %d", released)
+	}
+
+	history, err := svc.ListAuctionClearings(ctx, "auction-1")
+	if err != nil || len(history) != 2 || history[0].ClearingPriceUSD != 3.0 || history[1].ClearingPriceUSD != 2.5 {
+		t.Fatalf("unexpected clearing history %+v err=%v", history, err)
+	}
+	if history[0].AllocatedQty != 4 || len(history[0].Awards) != 2 || history[0].BidCount != 4 {
+		t.Fatalf("unexpected second clearing %+v", history[0])
+	}
+	if !history[1].PeriodStart.Equal(due) || !history[0].PeriodStart.Equal(next) {
+		t.Fatalf("expected periods to start on schedule, got %s and %s", history[1].PeriodStart, history[0].PeriodStart)
+	}
+
+	if _, err := svc.CancelOfferBid(ctx, "renter-a", d.ID); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected cancel by another renter to be forbidden, got %v", err)
+	}
+	if cancelled, err := svc.CancelOfferBid(ctx, "renter-d", d.ID); err != nil || cancelled.Status != models.OfferBidCancelled || offer().AvailableQty != 3 {
+		t.Fatalf("expected winning bid cancel to return capacity, got %+v available=%d err=%v", cancelled, offer().AvailableQty, err)
+	}
+
+	paused := offer()
+	paused.Status = models.SharedInventoryStatusPaused
+	if _, err := svc.UpsertSharedInventoryOffer(ctx, paused); err != nil {
+		t.Fatalf("pause offer: %v", err)
+	}
+	if bid(c.ID).Status != models.OfferBidExpired || bid(a.ID).Status != models.OfferBidWinning {
+		t.Fatalf("expected pausing to expire open bids only, got a=%+v c=%+v", bid(a.ID), bid(c.ID))
+	}
+	if err := svc.ClearAuctions(ctx, *offer().NextClearingAt); err != nil {
+		t.Fatalf("clearing while paused: %v", err)
+	}
+	if bid(a.ID).Status != models.OfferBidExpired || !slices.Contains(bill.stopped, bid(a.ID).BillingRentalID) || len(repo.clearings) != 2 {
+		t.Fatalf("expected the paused offer's winner to be let go without a clearing, got %+v clearings=%d", bid(a.ID), len(repo.clearings))
+	}
+}
+
+func TestMetricCompactionTiers(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 30, 0, time.UTC)
+	repo := &repoStub{}
+	start := now.Add(-3*time.Hour - 30*time.Second)
+	for i := 0; !start.Add(time.Duration(i) * 20 * time.Second).After(now); i++ {
+		repo.metricPoints = append(repo.metricPoints, models.MetricPoint{
+			ResourceType: "host", ResourceID: "h1", MetricType: "cpu_usage_pct",
+			Value: float64(i), CapturedAt: start.Add(time.Duration(i) * 20 * time.Second),
+		})
+	}
+	retention := MetricRetention{Raw: time.Hour, Minute: 2 * time.Hour, Hour: 30 * 24 * time.Hour}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, MetricRetention: retention, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	if err := svc.CompactMetrics(ctx, now); err != nil {
+		t.Fatalf("compact metrics: %v", err)
+	}
+	if got := repo.watermarks[models.MetricResolutionMinute]; !got.Equal(time.Date(2026, 10, 19, 11, 58, 0, 0, time.UTC)) {
+		t.Fatalf("expected minute tier closed up to 11:58, got %s", got)
+	}
+	if got := repo.watermarks[models.MetricResolutionHour]; !got.Equal(time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected hour tier closed up to 11:00, got %s", got)
+	}
+	for _, item := range repo.metricPoints {
+		if item.CapturedAt.Before(now.Add(-time.Hour)) {
+			t.Fatalf("expected raw points older than retention pruned, found %s", item.CapturedAt)
+		}
+	}
+	bucket := func(resolution models.MetricResolution, at time.Time) models.MetricPoint {
+		for _, item := range repo.metricRollups {
+			if item.Resolution == resolution && item.CapturedAt.Equal(at) {
+				return item
+			}
+		}
+		return models.MetricPoint{}
+	}
+	// 11:30 holds samples 450, 451 and 452.
+	minute := bucket(models.MetricResolutionMinute, time.Date(2026, 10, 19, 11, 30, 0, 0, time.UTC))
+	if minute.Rollup == nil || minute.Rollup.Min != 450 || minute.Rollup.Max != 452 || minute.Value != 451 || minute.Rollup.Last != 452 || minute.Rollup.Samples != 3 {
+		t.Fatalf("unexpected minute rollup %+v %+v", minute, minute.Rollup)
+	}
+	if old := bucket(models.MetricResolutionMinute, time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)); old.Rollup != nil {
+		t.Fatal("expected minute rollups older than retention pruned")
+	}
+	// 10:00 to 11:00 holds samples 180 through 359.
+	hour := bucket(models.MetricResolutionHour, time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC))
+	if hour.Rollup == nil || hour.Rollup.Samples != 180 || hour.Rollup.Min != 180 || hour.Rollup.Max != 359 || hour.Value != 269.5 || hour.Rollup.Last != 359 {
+		t.Fatalf("unexpected hour rollup %+v %+v", hour, hour.Rollup)
+	}
+	if open := bucket(models.MetricResolutionHour, time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC)); open.Rollup != nil {
+		t.Fatal("expected the current hour to stay open")
+	}
+
+	rollups := len(repo.metricRollups)
+	if err := svc.CompactMetrics(ctx, now); err != nil || len(repo.metricRollups) != rollups {
+		t.Fatalf("expected a repeated pass to be a no-op, got %d rollups (was %d) err=%v", len(repo.metricRollups), rollups, err)
+	}
+
+	cases := []struct {
+		from, to time.Time
+		want     models.MetricResolution
+	}{
+		{time.Time{}, time.Time{}, models.MetricResolutionRaw},
+		{now.Add(-30 * time.Minute), now, models.MetricResolutionRaw},
+		{now.Add(-90 * time.Minute), now, models.MetricResolutionMinute},
+		{now.Add(-90 * time.Minute), now.Add(-80 * time.Minute), models.MetricResolutionMinute},
+		{now.Add(-3 * time.Hour), now, models.MetricResolutionHour},
+		{now.Add(-72 * time.Hour), now, models.MetricResolutionHour},
+	}
+	for _, tc := range cases {
+		if got := svc.metricRetention.metricTierFor(now, tc.from, tc.to); got != tc.want {
+			t.Fatalf("range %s..%s: expected %s tier, got %s", tc.from, tc.to, tc.want, got)
+		}
+	}
+	items, err := svc.ListMetrics(ctx, models.MetricFilter{ResourceType: "host", ResourceID: "h1", MetricType: "cpu_usage_pct"}, "1h", time.Time{}, time.Time{}, 0)
+	if err != nil || len(items) != 2 || items[0].Resolution != models.MetricResolutionHour {
+		t.Fatalf("expected two hour buckets, got %d err=%v", len(items), err)
+	}
+	if _, err := svc.ListMetrics(ctx, models.MetricFilter{ResourceType: "host", ResourceID: "h1", MetricType: "cpu_usage_pct"}, "5m", time.Time{}, time.Time{}, 0); err == nil {
+		t.Fatal("expected unknown resolution to be rejected")
+	}
+}
+
+func TestMetricQueryFunctions(t *testing.T) {
+	base := time.Now().UTC().Add(-30 * time.Minute).Truncate(time.Minute)
+	repo := &repoStub{}
+	point := func(resourceID, providerID, metricType string, at time.Duration, value float64) {
+		repo.metricPoints = append(repo.metricPoints, models.MetricPoint{
+			ResourceType: "vm", ResourceID: resourceID, ProviderID: providerID, MetricType: metricType,
+			Value: value, CapturedAt: base.Add(at),
+		})
+	}
+	for j := 0; j < 18; j++ {
+		at := time.Duration(j) * 10 * time.Second
+		point("vm-a", "p1", "cpu_usage_pct", at, float64(10+j))
+		point("vm-b", "p1", "cpu_usage_pct", at, 50)
+		point("vm-c", "p2", "cpu_usage_pct", at, 100)
+		point("vm-a", "p1", "net_bytes", at, float64(1000*j))
+	}
+	for v := 1; v <= 100; v++ {
+		point("vm-b", "p1", "latency_ms", time.Duration(v)*500*time.Millisecond, float64(v))
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	result, err := svc.QueryMetrics(context.Background(), models.MetricQuery{
+		From: base, To: base.Add(3 * time.Minute), StepSeconds: 60, Resolution: models.MetricResolutionRaw,
+		Series: []models.MetricQuerySeries{
+			{Name: "cpu_by_provider", MetricType: "cpu_usage_pct", GroupBy: "provider", Function: "avg"},
+			{Name: "cpu_peak", MetricType: "cpu_usage_pct", ResourceID: "vm-a", GroupBy: "resource", Function: "max"},
+			{Name: "net_rate", MetricType: "net_bytes", Function: "rate"},
+			{Name: "net_delta", MetricType: "net_bytes", Function: "delta"},
+			{Name: "latency_p95", MetricType: "latency_ms", Function: "p95"},
+			{Name: "latency_p99", MetricType: "latency_ms", Function: "p99"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("query metrics: %v", err)
+	}
+	if result.StepSeconds != 60 || len(result.Series) != 7 {
+		t.Fatalf("expected 60s step and 7 series, got %d and %d", result.StepSeconds, len(result.Series))
+	}
+	values := func(series models.MetricQuerySeriesResult) []float64 {
+		out := make([]float64, 0, len(series.Points))
+		for i, item := range series.Points {
+			if !item.Timestamp.Equal(base.Add(time.Duration(i) * time.Minute)) {
+				t.Fatalf("%s: expected step-aligned bucket %d, got %s", series.Name, i, item.Timestamp)
+			}
+			out = append(out, item.Value)
+		}
+		return out
+	}
+	expect := func(series models.MetricQuerySeriesResult, want ...float64) {
+		got := values(series)
+		if len(got) != len(want) {
+			t.Fatalf("%s %v: expected %v, got %v", series.Name, series.Labels, want, got)
+		}
+		for i := range want {
+			if math.Abs(got[i]-want[i]) > 1e-9 {
+				t.Fatalf("%s %v: expected %v, got %v", series.Name, series.Labels, want, got)
+			}
+		}
+	}
+	// p1 pools vm-a (10..15, 16..21, 22..27) with vm-b's constant 50.
+	if result.Series[0].Labels["provider_id"] != "p1" || result.Series[1].Labels["provider_id"] != "p2" {
+		t.Fatalf("expected provider groups in order, got %v and %v", result.Series[0].Labels, result.Series[1].Labels)
+	}
+	expect(result.Series[0], 31.25, 34.25, 37.25)
+	expect(result.Series[1], 100, 100, 100)
+	if result.Series[2].Labels["resource_id"] != "vm-a" {
+		t.Fatalf("expected resource labels, got %v", result.Series[2].Labels)
+	}
+	expect(result.Series[2], 15, 21, 27)
+	expect(result.Series[3], 100, 100, 100)
+	expect(result.Series[4], 5000, 6000, 6000)
+	expect(result.Series[5], 95)
+	expect(result.Series[6], 99)
+
+	if _, err := svc.QueryMetrics(context.Background(), models.MetricQuery{
+		Series: []models.MetricQuerySeries{{MetricType: "cpu_usage_pct", Function: "median"}},
+	}); err == nil {
+		t.Fatal("expected unknown function to be rejected")
+	}
+	if _, err := svc.QueryMetrics(context.Background(), models.MetricQuery{
+		From: base, To: base.Add(24 * time.Hour), StepSeconds: 1, Resolution: models.MetricResolutionRaw,
+		Series: []models.MetricQuerySeries{{MetricType: "cpu_usage_pct", Function: "avg"}},
+	}); err == nil {
+		t.Fatal("expected too many buckets to be rejected")
+	}
+}
+
+type notifierStub struct {
+	sent []models.AlertNotification
+	fail int
+}
+
+func (n *notifierStub) Notify(_ context.Context, _ string, notification models.AlertNotification) error {
+	if n.fail > 0 {
+		n.fail--
+		return errors.New("receiver unreachable")
+	}
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func TestAlertRuleEvaluation(t *testing.T) {
+	base := time.Now().UTC()
+	hook := &notifierStub{}
+	mail := &notifierStub{fail: 1}
+	repo := &repoStub{
+		hosts:        []models.HostResource{{ProviderID: "p1", HeartbeatAt: base}, {ProviderID: "p2", HeartbeatAt: base.Add(-3 * time.Minute)}},
+		metricPoints: []models.MetricPoint{{ResourceType: "host", ResourceID: "p1", ProviderID: "p1", MetricType: "host_gpu_free_units", Value: 0, CapturedAt: base}},
+		healthChecks: []models.HealthCheck{{ResourceType: "vm", ResourceID: "vm-1", CheckType: "ssh", Status: models.HealthStatusCritical, Details: "timeout", CheckedAt: base}},
+	}
+	notifiers := map[models.AlertChannelType]AlertNotifier{models.AlertChannelWebhook: hook, models.AlertChannelEmail: mail}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AlertNotifiers: notifiers, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+	webhook := []models.AlertChannel{{Type: models.AlertChannelWebhook, Target: "https://hooks.example.com/alerts"}}
+
+	gpuRule, err := svc.CreateAlertRule(ctx, "p1", models.AlertRule{
+		Name: "no free gpus", Kind: models.AlertRuleMetric, ResourceType: "host", ResourceID: "p1",
+		MetricType: "host_gpu_free_units", Comparator: "==", Threshold: 0, ForSeconds: 600, Channels: webhook,
+	})
+	if err != nil {
+		t.Fatalf("create metric rule: %v", err)
+	}
+	if _, err := svc.CreateAlertRule(ctx, "p1", models.AlertRule{Name: "x", Kind: models.AlertRuleMetric, ResourceType: "host", ResourceID: "p2", MetricType: "m", Comparator: ">"}); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected foreign host rule to be forbidden, got %v", err)
+	}
+	if _, err := svc.CreateAlertRule(ctx, "p1", models.AlertRule{Name: "x", Kind: models.AlertRuleMetric, ResourceType: "host", ResourceID: "p1", MetricType: "m", Comparator: "~"}); err == nil {
+		t.Fatal("expected unknown comparator to be rejected")
+	}
+	heartbeatRule, err := svc.CreateAlertRuleAdmin(ctx, "admin-1", models.AlertRule{
+		Name: "host silent", Kind: models.AlertRuleHeartbeat,
+		Channels: []models.AlertChannel{{Type: models.AlertChannelEmail, Target: "ops@example.com"}},
+	})
+	if err != nil || heartbeatRule.ResourceType != "host" || heartbeatRule.ForSeconds != 120 {
+		t.Fatalf("create heartbeat rule: %+v %v", heartbeatRule, err)
+	}
+	healthRule, err := svc.CreateAlertRuleAdmin(ctx, "admin-1", models.AlertRule{Name: "vm critical", Kind: models.AlertRuleHealthCheck, ResourceType: "vm", Channels: webhook})
+	if err != nil || healthRule.HealthStatus != models.HealthStatusCritical {
+		t.Fatalf("create health rule: %+v %v", healthRule, err)
+	}
+
+	sent := func(notifier *notifierStub, ruleID string) []models.AlertState {
+		out := make([]models.AlertState, 0)
+		for _, item := range notifier.sent {
+			if item.RuleID == ruleID {
+				out = append(out, item.State)
+			}
+		}
+		return out
+	}
+	alertFor := func(ruleID string, resourceID string) models.Alert {
+		var out models.Alert
+		for _, item := range repo.alerts {
+			if item.RuleID == ruleID && item.ResourceID == resourceID {
+				out = item
+			}
+		}
+		return out
+	}
+	evaluate := func(at time.Time, gpuFree float64) {
+		repo.hosts[0].HeartbeatAt = at
+		repo.metricPoints = append(repo.metricPoints, models.MetricPoint{ResourceType: "host", ResourceID: "p1", ProviderID: "p1", MetricType: "host_gpu_free_units", Value: gpuFree, CapturedAt: at})
+		if err := svc.EvaluateAlerts(ctx, at); err != nil {
+			t.Fatalf("evaluate alerts at %s: %v", at, err)
+		}
+	}
+
+	evaluate(base, 0)
+	if got := alertFor(gpuRule.ID, "p1"); got.State != models.AlertStatePending {
+		t.Fatalf("expected gpu alert pending before for_seconds, got %+v", got)
+	}
+	if got := alertFor(heartbeatRule.ID, "p2"); got.State != models.AlertStateFiring || got.NotifiedState != "" || len(mail.sent) != 0 {
+		t.Fatalf("expected heartbeat alert firing with delivery to retry, got %+v sent=%d", got, len(mail.sent))
+	}
+	if got := alertFor(heartbeatRule.ID, "p1"); got.ID != "" {
+		t.Fatalf("expected fresh host to stay quiet, got %+v", got)
+	}
+	if got := sent(hook, healthRule.ID); len(got) != 1 || got[0] != models.AlertStateFiring {
+		t.Fatalf("expected health rule to fire once, got %v", got)
+	}
+
+	evaluate(base.Add(time.Minute), 0)
+	if got := sent(mail, heartbeatRule.ID); len(got) != 1 || mail.sent[0].ResourceID != "p2" {
+		t.Fatalf("expected failed heartbeat notification retried once, got %v", got)
+	}
+	silence, err := svc.CreateAlertSilence(ctx, "p1", models.AlertSilence{RuleID: gpuRule.ID, EndsAt: base.Add(time.Hour), Comment: "maintenance"})
+	if err != nil {
+		t.Fatalf("create silence: %v", err)
+	}
+	if _, err := svc.EndAlertSilence(ctx, "p2", silence.ID); err == nil {
+		t.Fatal("expected other users not to end the silence")
+	}
+
+	evaluate(base.Add(10*time.Minute), 0)
+	if got := alertFor(gpuRule.ID, "p1"); got.State != models.AlertStateFiring || got.FiredAt == nil {
+		t.Fatalf("expected gpu alert firing after for_seconds, got %+v", got)
+	}
+	if got := sent(hook, gpuRule.ID); len(got) != 0 {
+		t.Fatalf("expected silenced alert not to notify, got %v", got)
+	}
+	if got := sent(hook, healthRule.ID); len(got) != 1 {
+		t.Fatalf("expected firing health alert deduplicated, got %v", got)
+	}
+	if _, err := svc.EndAlertSilence(ctx, "p1", silence.ID); err != nil {
+		t.Fatalf("end silence: %v", err)
+	}
+
+	evaluate(base.Add(10*time.Minute+30*time.Second), 0)
+	evaluate(base.Add(11*time.Minute), 0)
+	if got := sent(hook, gpuRule.ID); len(got) != 1 || got[0] != models.AlertStateFiring {
+		t.Fatalf("expected one firing notification once the silence ended, got %v", got)
+	}
+	if got := sent(mail, heartbeatRule.ID); len(got) != 1 {
+		t.Fatalf("expected heartbeat alert deduplicated, got %v", got)
+	}
+
+	repo.hosts[1].HeartbeatAt = base.Add(12 * time.Minute)
+	repo.healthChecks = append(repo.healthChecks, models.HealthCheck{ResourceType: "vm", ResourceID: "vm-1", CheckType: "ssh", Status: models.HealthStatusOK, CheckedAt: base.Add(12 * time.Minute)})
+	evaluate(base.Add(12*time.Minute), 2)
+	if got := sent(hook, gpuRule.ID); len(got) != 2 || got[1] != models.AlertStateResolved {
+		t.Fatalf("expected gpu alert resolved, got %v", got)
+	}
+	if got := sent(mail, heartbeatRule.ID); len(got) != 2 || got[1] != models.AlertStateResolved {
+		t.Fatalf("expected heartbeat alert resolved, got %v", got)
+	}
+	if got := sent(hook, healthRule.ID); len(got) != 2 || got[1] != models.AlertStateResolved {
+		t.Fatalf("expected health alert resolved, got %v", got)
+	}
+	items, err := svc.ListAlerts(ctx, "p1", "resolved", 0)
+	if err != nil || len(items) != 1 || items[0].RuleName != "no free gpus" {
+		t.Fatalf("expected the user's resolved gpu alert, got %+v err=%v", items, err)
+	}
+	if err := svc.DeleteAlertRule(ctx, "p2", gpuRule.ID); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected foreign rule delete to be forbidden, got %v", err)
+	}
+}
+
+type proberStub struct {
+	mu       sync.Mutex
+	failing  map[models.HealthProbeKind]bool
+	attempts int
+}
+
+func (p *proberStub) Probe(_ context.Context, probe models.HealthProbe) (time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts++
+	if p.failing[probe.Kind] {
+		return 5 * time.Second, errors.New("connection timed out")
+	}
+	return 12 * time.Millisecond, nil
+}
+
+func TestHealthProbes(t *testing.T) {
+	base := time.Now().UTC()
+	repo := &repoStub{
+		vm: models.VM{ID: "vm-1", UserID: "u1", IPAddress: "10.0.0.5", Status: models.VMStatusRunning, Health: models.ResourceHealthUnknown},
+		pods: []models.Pod{{
+			ID: "pod-1", UserID: "u1", IPAddress: "10.0.0.6", Status: models.PodStatusRunning, Health: models.ResourceHealthUnknown,
+			Ports: []models.PodPort{{Port: 8080, Protocol: models.PodPortProtocolHTTP}, {Port: 5432, Protocol: models.PodPortProtocolTCP}},
+		}},
+	}
+	prober := &proberStub{failing: map[models.HealthProbeKind]bool{}}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Prober: prober, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	ran, err := svc.RunHealthProbes(ctx, base)
+	if err != nil || ran != 4 {
+		t.Fatalf("expected 4 default probes to run, got %d %v", ran, err)
+	}
+	kinds := make([]string, 0)
+	for _, probe := range repo.probes {
+		kinds = append(kinds, fmt.Sprintf("%s/%s:%d", probe.ResourceID, probe.Kind, probe.Port))
+	}
+	if want := []string{"vm-1/reachability:22", "vm-1/ssh:22", "pod-1/http:8080", "pod-1/tcp:5432"}; !slices.Equal(kinds, want) {
+		t.Fatalf("unexpected default probes %v", kinds)
+	}
+	if len(repo.healthChecks) != 4 || repo.healthChecks[0].LatencyMS != 12 || repo.healthChecks[0].ProbeID == "" || repo.healthChecks[0].CheckType != "probe_reachability" {
+		t.Fatalf("unexpected probe health checks %+v", repo.healthChecks)
+	}
+	if repo.vm.Health != models.ResourceHealthHealthy || repo.pods[0].Health != models.ResourceHealthHealthy {
+		t.Fatalf("expected healthy resources, got %s %s", repo.vm.Health, repo.pods[0].Health)
+	}
+
+	if _, err := svc.CreateHealthProbe(ctx, "u2", "vm-1", models.HealthProbe{Kind: models.HealthProbeTCP, Port: 80}); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected foreign probe to be forbidden, got %v", err)
+	}
+	if _, err := svc.CreateHealthProbe(ctx, "u1", "vm-1", models.HealthProbe{Kind: models.HealthProbeTCP}); err == nil {
+		t.Fatal("expected tcp probe without port to be rejected")
+	}
+	if _, err := svc.CreateHealthProbe(ctx, "u1", "vm-1", models.HealthProbe{Kind: models.HealthProbeHTTP, IntervalSeconds: 10, TimeoutSeconds: 10}); err == nil {
+		t.Fatal("expected timeout not shorter than interval to be rejected")
+	}
+	custom, err := svc.CreateHealthProbe(ctx, "u1", "vm-1", models.HealthProbe{Kind: models.HealthProbeHTTP, Port: 8000, ExpectedStatus: 204, IntervalSeconds: 60, FailureThreshold: 1})
+	if err != nil || custom.Path != "/" || custom.ResourceType != "vm" || custom.TimeoutSeconds != 5 {
+		t.Fatalf("create custom probe: %+v %v", custom, err)
+	}
+
+	prober.failing[models.HealthProbeSSH] = true
+	for i := 1; i <= 2; i++ {
+		if _, err := svc.RunHealthProbes(ctx, base.Add(time.Duration(i)*30*time.Second)); err != nil {
+			t.Fatalf("probe pass %d: %v", i, err)
+		}
+		if repo.vm.Health != models.ResourceHealthHealthy {
+			t.Fatalf("expected vm to stay healthy below the failure threshold, got %s", repo.vm.Health)
+		}
+	}
+	if _, err := svc.RunHealthProbes(ctx, base.Add(90*time.Second)); err != nil {
+		t.Fatalf("third failing pass: %v", err)
+	}
+	if repo.vm.Health != models.ResourceHealthDegraded || repo.pods[0].Health != models.ResourceHealthHealthy {
+		t.Fatalf("expected only the vm to be degraded, got %s %s", repo.vm.Health, repo.pods[0].Health)
+	}
+	vms, err := svc.ListVMs(ctx, "u1", models.CatalogFilter{})
+	if err != nil || len(vms) != 1 || vms[0].Health != models.ResourceHealthDegraded {
+		t.Fatalf("expected ListVMs to report degraded health, got %+v %v", vms, err)
+	}
+	last := repo.healthChecks[len(repo.healthChecks)-1]
+	failed := false
+	for _, check := range repo.healthChecks {
+		if check.CheckType == "probe_ssh" && check.Status == models.HealthStatusCritical && strings.Contains(check.Details, "connection timed out") {
+			failed = true
+		}
+	}
+	if !failed || last.CheckedAt != base.Add(90*time.Second) {
+		t.Fatalf("expected failed ssh probe checks, got %+v", repo.healthChecks)
+	}
+
+	if ran, err := svc.RunHealthProbes(ctx, base.Add(100*time.Second)); err != nil || ran != 0 {
+		t.Fatalf("expected no probes due between intervals, got %d %v", ran, err)
+	}
+	prober.failing[models.HealthProbeSSH] = false
+	if _, err := svc.RunHealthProbes(ctx, base.Add(120*time.Second)); err != nil {
+		t.Fatalf("recovery pass: %v", err)
+	}
+	if repo.vm.Health != models.ResourceHealthHealthy {
+		t.Fatalf("expected vm to recover, got %s", repo.vm.Health)
+	}
+
+	probes, err := svc.ListHealthProbes(ctx, "u1", "vm-1")
+	if err != nil || len(probes) != 3 {
+		t.Fatalf("expected 3 vm probes, got %d %v", len(probes), err)
+	}
+	if err := svc.DeleteHealthProbe(ctx, "u2", custom.ID); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected foreign delete to be forbidden, got %v", err)
+	}
+	if err := svc.DeleteHealthProbe(ctx, "u1", custom.ID); err != nil {
+		t.Fatalf("delete probe: %v", err)
+	}
+	if err := svc.DeleteHealthProbe(ctx, "u1", custom.ID); err == nil || !strings.HasSuffix(err.Error(), "not found") {
+		t.Fatalf("expected deleted probe to be not found, got %v", err)
+	}
+}
+
+func TestAgentLogRecord(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	entry, err := svc.RecordAgentLog(context.Background(), models.AgentLog{
+		ProviderID: "p1",
+		ResourceID: "vm-1",
+		Message:    "heartbeat ok",
+	})
+	if err != nil {
+		t.Fatalf("record agent log: %v", err)
+	}
+	if entry.Level != models.AgentLogInfo {
+		t.Fatalf("expected default level info, got %s", entry.Level)
+	}
+}
+
+func TestAgentCommandLifecycle(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	queued, err := svc.QueueAgentCommand(context.Background(), models.AgentCommand{
+		ProviderID:  "p1",
+		Command:     models.AgentCommandStatus,
+		RequestedBy: "admin-1",
+	})
+	if err != nil {
+		t.Fatalf("queue agent command: %v", err)
+	}
+	if queued.Status != models.AgentCommandQueued {
+		t.Fatalf("expected queued status, got %s", queued.Status)
+	}
+
+	claimed, err := svc.ClaimNextAgentCommand(context.Background(), "p1")
+	if err != nil {
+		t.Fatalf("claim agent command: %v", err)
+	}
+	if claimed.Status != models.AgentCommandRunning {
+		t.Fatalf("expected running status, got %s", claimed.Status)
+	}
+
+	completed, err := svc.CompleteAgentCommand(context.Background(), claimed.ID, "p1", models.AgentCommandSucceeded, "collector is running")
+	if err != nil {
+		t.Fatalf("complete agent command: %v", err)
+	}
+	if completed.Status != models.AgentCommandSucceeded {
+		t.Fatalf("expected succeeded status, got %s", completed.Status)
+	}
+}
+
+func TestTerminalSessionLifecycle(t *testing.T) {
+	repo := &repoStub{
+		vm: models.VM{
+			ID:         "vm-1",
+			UserID:     "user-1",
+			ProviderID: "provider-1",
+			Status:     models.VMStatusRunning,
+		},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	session, err := svc.CreateTerminalSession(ctx, "user-1", "vm-1", 40, 140)
+	if err != nil {
+		t.Fatalf("create terminal session: %v", err)
+	}
+	if session.ProviderID != "provider-1" {
+		t.Fatalf("expected provider-1, got %s", session.ProviderID)
+	}
+	if len(repo.agentCommands) == 0 || repo.agentCommands[0].Command != models.AgentCommandTerminalOpen {
+		t.Fatalf("expected terminal_open command queued")
+	}
+
+	_, err = svc.WriteTerminalInput(ctx, "user-1", session.ID, "echo hello\n")
+	if err != nil {
+		t.Fatalf("write terminal input: %v", err)
+	}
+	if len(repo.agentCommands) < 2 || repo.agentCommands[1].Command != models.AgentCommandTerminalData {
+		t.Fatalf("expected terminal_data command queued")
+	}
+
+	_, err = svc.RecordTerminalOutput(ctx, "provider-1", session.ID, "hello\n")
+	if err != nil {
+		t.Fatalf("record terminal output: %v", err)
+	}
+	chunks, err := svc.ListTerminalOutput(ctx, "user-1", session.ID, 0, 20)
+	if err != nil {
+		t.Fatalf("list terminal output: %v", err)
+	}
+	if len(chunks) == 0 {
+		t.Fatal("expected terminal output chunk")
+	}
+
+	_, err = svc.ResizeTerminalSession(ctx, "user-1", session.ID, 32, 120)
+	if err != nil {
+		t.Fatalf("resize terminal session: %v", err)
+	}
+	if len(repo.agentCommands) < 3 || repo.agentCommands[2].Command != models.AgentCommandTerminalResize {
+		t.Fatalf("expected terminal_resize command queued")
+	}
+
+	_, err = svc.CloseTerminalSession(ctx, "user-1", session.ID)
+	if err != nil {
+		t.Fatalf("close terminal session: %v", err)
+	}
+	if len(repo.agentCommands) < 4 || repo.agentCommands[3].Command != models.AgentCommandTerminalClose {
+		t.Fatalf("expected terminal_close command queued")
+	}
+}
+
+func TestSharedTerminalParticipants(t *testing.T) {
+	repo := &repoStub{
+		vm: models.VM{ID: "vm-1", UserID: "owner", ProviderID: "provider-1", Status: models.VMStatusRunning},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pairGrant, err := svc.GrantShare(ctx, "owner", models.ShareGrant{ResourceType: "vm", ResourceID: "vm-1", GranteeUserID: "pair", AccessLevel: models.SharedAccessWrite})
+	if err != nil {
+		t.Fatalf("grant write: %v", err)
+	}
+	if _, err := svc.GrantShare(ctx, "owner", models.ShareGrant{ResourceType: "vm", ResourceID: "vm-1", GranteeUserID: "watcher", AccessLevel: models.SharedAccessRead}); err != nil {
+		t.Fatalf("grant read: %v", err)
+	}
+	session, err := svc.CreateTerminalSession(ctx, "owner", "vm-1", 24, 80)
+	if err != nil {
+		t.Fatalf("create terminal session: %v", err)
+	}
+
+	if _, err := svc.InviteTerminalParticipant(ctx, "owner", session.ID, "stranger", models.TerminalParticipantViewer); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected a user without a grant to be refused, got %v", err)
+	}
+	if _, err := svc.InviteTerminalParticipant(ctx, "owner", session.ID, "watcher", models.TerminalParticipantDriver); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected a read grant to be refused drive rights, got %v", err)
+	}
+	if _, err := svc.InviteTerminalParticipant(ctx, "owner", session.ID, "pair", models.TerminalParticipantDriver); err != nil {
+		t.Fatalf("invite driver: %v", err)
+	}
+	if _, err := svc.InviteTerminalParticipant(ctx, "owner", session.ID, "watcher", models.TerminalParticipantViewer); err != nil {
+		t.Fatalf("invite viewer: %v", err)
+	}
+	if _, err := svc.InviteTerminalParticipant(ctx, "pair", session.ID, "watcher", models.TerminalParticipantDriver); err == nil {
+		t.Fatal("expected only the renter to invite")
+	}
+
+	if _, err := svc.WriteTerminalInput(ctx, "owner", session.ID, "whoami\n"); err != nil {
+		t.Fatalf("renter input: %v", err)
+	}
+	if _, err := svc.WriteTerminalInput(ctx, "pair", session.ID, "nvidia-smi\n"); err != nil {
+		t.Fatalf("driver input: %v", err)
+	}
+	if _, err := svc.WriteTerminalInput(ctx, "watcher", session.ID, "id\n"); err == nil {
+		t.Fatal("expected viewer input to be refused")
+	}
+	if _, err := svc.ResizeTerminalSession(ctx, "watcher", session.ID, 30, 100); err == nil {
+		t.Fatal("expected viewer resize to be refused")
+	}
+	if _, err := svc.CloseTerminalSession(ctx, "pair", session.ID); err == nil {
+		t.Fatal("expected only the renter to close the session")
+	}
+	svc.terminals.flush()
+	inputs := map[string]string{}
+	for _, event := range repo.terminalAudit {
+		if event.EventType == "terminal_input" {
+			inputs[event.UserID] = event.GrantID
+		}
+	}
+	if grantID, ok := inputs["owner"]; !ok || grantID != "" || inputs["pair"] != pairGrant.ID || len(inputs) != 2 {
+		t.Fatalf("expected input attributed to each driver, got %+v", inputs)
+	}
+
+	presence, err := svc.ListTerminalParticipants(ctx, "watcher", session.ID)
+	if err != nil {
+		t.Fatalf("list participants: %v", err)
+	}
+	roles := make([]string, 0)
+	for _, item := range presence {
+		roles = append(roles, item.UserID+":"+string(item.Role))
+	}
+	if strings.Join(roles, ",") != "owner:owner,pair:driver,watcher:viewer" {
+		t.Fatalf("unexpected presence list %v", roles)
+	}
+
+	term := terminalConnStub{sent: make(chan models.TerminalFrame, 8), received: make(chan models.TerminalFrame)}
+	done := make(chan error, 1)
+	go func() { done <- svc.ServeTerminalStream(ctx, "pair", session.ID, 0, term) }()
+	joined := <-term.sent
+	if joined.Type != models.TerminalFramePresence || len(joined.Participants) != 3 || !joined.Participants[1].Online || joined.Participants[0].Online {
+		t.Fatalf("expected presence with the driver online, got %+v", joined)
+	}
+	term.received <- models.TerminalFrame{Type: models.TerminalFrameInput, Data: "top\n"}
+	if ack := <-term.sent; ack.Type != models.TerminalFrameInputAck {
+		t.Fatalf("expected driver input acked, got %+v", ack)
+	}
+	if _, err := svc.UpdateShareGrant(ctx, "owner", "vm", pairGrant.ID, models.ShareGrantUpdate{AccessLevel: models.SharedAccessRead}); err != nil {
+		t.Fatalf("demote driver grant: %v", err)
+	}
+	term.received <- models.TerminalFrame{Type: models.TerminalFrameResize, Rows: 30, Cols: 100}
+	if refused := <-term.sent; refused.Type != models.TerminalFrameError || !strings.HasPrefix(refused.Error, "forbidden") {
+		t.Fatalf("expected demoted driver resize refused without a presence change, got %+v", refused)
+	}
+	if _, err := svc.UpdateShareGrant(ctx, "owner", "vm", pairGrant.ID, models.ShareGrantUpdate{AccessLevel: models.SharedAccessWrite}); err != nil {
+		t.Fatalf("restore driver grant: %v", err)
+	}
+	term.received <- models.TerminalFrame{Type: models.TerminalFrameInput, Data: "top\n"}
+	if ack := <-term.sent; ack.Type != models.TerminalFrameInputAck {
+		t.Fatalf("expected restored driver input acked, got %+v", ack)
+	}
+
+	if err := svc.RemoveTerminalParticipant(ctx, "owner", session.ID, "pair"); err != nil {
+		t.Fatalf("remove driver: %v", err)
+	}
+	if left := <-term.sent; left.Type != models.TerminalFramePresence || len(left.Participants) != 3 || left.Participants[2].UserID != "pair" || left.Participants[2].Invited {
+		t.Fatalf("expected presence with the removed driver watching, got %+v", left)
+	}
+	term.received <- models.TerminalFrame{Type: models.TerminalFrameInput, Data: "top\n"}
+	if refused := <-term.sent; refused.Type != models.TerminalFrameError || !strings.HasPrefix(refused.Error, "forbidden") {
+		t.Fatalf("expected removed driver input refused, got %+v", refused)
+	}
+	if err := svc.RemoveTerminalParticipant(ctx, "pair", session.ID, "pair"); err == nil || err.Error() != "terminal participant not found" {
+		t.Fatalf("expected leaving twice to fail, got %v", err)
+	}
+	if err := svc.RemoveTerminalParticipant(ctx, "watcher", session.ID, "watcher"); err != nil {
+		t.Fatalf("viewer leaves: %v", err)
+	}
+	cancel()
+	<-done
+}
+
+func TestTerminalRecordingExportReplayAndRetention(t *testing.T) {
+	repo := &repoStub{
+		vm: models.VM{
+			ID:         "vm-1",
+			UserID:     "user-1",
+			ProviderID: "provider-1",
+			Status:     models.VMStatusRunning,
+		},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}, Recordings: RecordingPolicy{Retention: 48 * time.Hour}})
+	ctx := context.Background()
+
+	session, err := svc.CreateTerminalSession(ctx, "user-1", "vm-1", 40, 140)
+	if err != nil {
+		t.Fatalf("create terminal session: %v", err)
+	}
+	if _, err := svc.WriteTerminalInput(ctx, "user-1", session.ID, "ls\n"); err != nil {
+		t.Fatalf("write terminal input: %v", err)
+	}
+	if _, err := svc.RecordTerminalOutput(ctx, "provider-1", session.ID, "file.txt\n"); err != nil {
+		t.Fatalf("record terminal output: %v", err)
+	}
+	if _, err := svc.ResizeTerminalSession(ctx, "user-1", session.ID, 32, 120); err != nil {
+		t.Fatalf("resize terminal session: %v", err)
+	}
+	svc.terminals.flush()
+
+	if _, err := svc.TerminalRecording(ctx, "user-2", false, session.ID, "export"); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected stranger to be forbidden, got %v", err)
+	}
+	recording, err := svc.TerminalRecording(ctx, "user-1", false, session.ID, "export")
+	if err != nil {
+		t.Fatalf("export recording: %v", err)
+	}
+	if recording.Header.Version != 2 || recording.Header.Width != 140 || recording.Header.Height != 40 {
+		t.Fatalf("unexpected header: %+v", recording.Header)
+	}
+	codes := map[string]string{}
+	for i, event := range recording.Events {
+		if i > 0 && event.Time < recording.Events[i-1].Time {
+			t.Fatalf("events out of order: %+v", recording.Events)
+		}
+		codes[event.Code] = event.Data
+	}
+	if codes["i"] != "ls\n" || codes["o"] != "file.txt\n" || codes["r"] != "120x32" {
+		t.Fatalf("unexpected events: %+v", recording.Events)
+	}
+	line, err := json.Marshal(recording.Events[len(recording.Events)-1])
+	if err != nil || !strings.HasPrefix(string(line), "[") || !strings.HasSuffix(string(line), `,"r","120x32"]`) {
+		t.Fatalf("expected asciicast event line, got %s (%v)", line, err)
+	}
+	if last := repo.terminalAudit[len(repo.terminalAudit)-1]; last.EventType != "terminal_recording_export" {
+		t.Fatalf("expected export audit event, got %s", last.EventType)
+	}
+
+	events := []models.AsciicastEvent{{Time: 0.01, Code: "o", Data: "a"}, {Time: 30, Code: "o", Data: "b"}}
+	replayed := make([]models.AsciicastEvent, 0)
+	err = ReplayTerminalRecording(ctx, events, 16, 160*time.Millisecond, func(event models.AsciicastEvent) error {
+		replayed = append(replayed, event)
+		return nil
+	})
+	if err != nil || len(replayed) != 2 || replayed[1].Time > 0.02 {
+		t.Fatalf("expected idle gap capped and sped up, got %+v (%v)", replayed, err)
+	}
+	if err := ReplayTerminalRecording(ctx, events, 100, 0, func(models.AsciicastEvent) error { return nil }); err == nil {
+		t.Fatal("expected out of range speed to be rejected")
+	}
+
+	if _, err := svc.CloseTerminalSession(ctx, "user-1", session.ID); err != nil {
+		t.Fatalf("close terminal session: %v", err)
+	}
+	if err := svc.PurgeTerminalRecordings(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("purge within retention: %v", err)
+	}
+	if _, err := svc.TerminalRecording(ctx, "user-1", true, session.ID, "export"); err != nil {
+		t.Fatalf("expected recording kept within retention: %v", err)
+	}
+	if err := svc.PurgeTerminalRecordings(ctx, time.Now().Add(72*time.Hour)); err != nil {
+		t.Fatalf("purge past retention: %v", err)
+	}
+	if _, err := svc.TerminalRecording(ctx, "admin-1", true, session.ID, "export"); err == nil || err.Error() != "terminal recording not found" {
+		t.Fatalf("expected purged recording to be gone, got %v", err)
+	}
+}
+
+func TestSharedAccessGrantsOnTerminalAndLifecycle(t *testing.T) {
+	repo := &repoStub{
+		vm: models.VM{ID: "vm-1", UserID: "owner", ProviderID: "provider-1", Status: models.VMStatusRunning},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+	grant := func(userID string, level models.SharedAccessLevel) models.ShareGrant {
+		item, err := svc.GrantShare(ctx, "owner", models.ShareGrant{ResourceType: "vm", ResourceID: "vm-1", GranteeUserID: userID, AccessLevel: level})
+		if err != nil {
+			t.Fatalf("grant %s: %v", level, err)
+		}
+		return item
+	}
+	readGrant := grant("reader", models.SharedAccessRead)
+	writeGrant := grant("writer", models.SharedAccessWrite)
+	adminGrant := grant("operator", models.SharedAccessAdmin)
+
+	ownerSession, err := svc.CreateTerminalSession(ctx, "owner", "vm-1", 24, 80)
+	if err != nil || ownerSession.GrantID != "" {
+		t.Fatalf("expected owner session without grant, got %+v err=%v", ownerSession, err)
+	}
+	if _, err := svc.CreateTerminalSession(ctx, "reader", "vm-1", 24, 80); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected read grant to be refused a terminal, got %v", err)
+	}
+	if _, err := svc.CreateTerminalSession(ctx, "stranger", "vm-1", 24, 80); err == nil {
+		t.Fatal("expected stranger to be refused a terminal")
+	}
+
+	viewed, err := svc.GetTerminalSession(ctx, "reader", ownerSession.ID)
+	if err != nil || viewed.ID != ownerSession.ID {
+		t.Fatalf("expected reader to view owner session, got %+v err=%v", viewed, err)
+	}
+	if _, err := svc.ListTerminalOutput(ctx, "reader", ownerSession.ID, 0, 20); err != nil {
+		t.Fatalf("expected reader to list output: %v", err)
+	}
+	if _, err := svc.WriteTerminalInput(ctx, "reader", ownerSession.ID, "id\n"); err == nil {
+		t.Fatal("expected reader input to be refused")
+	}
+	sessions, err := svc.ListTerminalSessions(ctx, "reader", "vm-1")
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("expected reader to list one session, got %d err=%v", len(sessions), err)
+	}
+
+	writerSession, err := svc.CreateTerminalSession(ctx, "writer", "vm-1", 24, 80)
+	if err != nil {
+		t.Fatalf("writer terminal: %v", err)
+	}
+	if writerSession.GrantID != writeGrant.ID {
+		t.Fatalf("expected session to carry write grant %s, got %s", writeGrant.ID, writerSession.GrantID)
+	}
+	if _, err := svc.WriteTerminalInput(ctx, "writer", writerSession.ID, "ls\n"); err != nil {
+		t.Fatalf("writer input: %v", err)
+	}
+	if _, err := svc.StopVM(ctx, "writer", "vm-1"); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected write grant to be refused lifecycle actions, got %v", err)
+	}
+
+	svc.terminals.flush()
+	audited := map[string]string{}
+	for _, event := range repo.terminalAudit {
+		audited[event.EventType+":"+event.UserID] = event.GrantID
+	}
+	if audited["terminal_create:writer"] != writeGrant.ID || audited["terminal_view:reader"] != readGrant.ID {
+		t.Fatalf("expected terminal audit to record grants, got %+v", audited)
+	}
+	if grantID, ok := audited["terminal_create:owner"]; !ok || grantID != "" {
+		t.Fatalf("expected owner audit without grant, got %+v", audited)
+	}
+
+	if _, err := svc.RevokeShareGrant(ctx, "owner", "vm", writeGrant.ID); err != nil {
+		t.Fatalf("revoke write grant: %v", err)
+	}
+	if _, err := svc.WriteTerminalInput(ctx, "writer", writerSession.ID, "ls\n"); err == nil {
+		t.Fatal("expected input to stop after revocation")
+	}
+
+	vm, err := svc.RebootVM(ctx, "operator", "vm-1")
+	if err != nil || vm.Status != models.VMStatusRunning {
+		t.Fatalf("expected admin grant to reboot, got %+v err=%v", vm, err)
+	}
+	vm, err = svc.StopVM(ctx, "operator", "vm-1")
+	if err != nil || vm.Status != models.VMStatusStopped {
+		t.Fatalf("expected admin grant to stop, got %+v err=%v", vm, err)
+	}
+	actions := make([]string, 0)
+	for _, event := range repo.shareAudit {
+		if event.GrantID == adminGrant.ID {
+			actions = append(actions, event.Action)
+		}
+	}
+	if strings.Join(actions, ",") != "grant_created,vm_reboot,vm_stop" {
+		t.Fatalf("expected lifecycle actions audited on admin grant, got %v", actions)
+	}
+}
+
+type recordingProvisioningStub struct {
+	provisioningStub
+	podRequests []provisioning.CreatePodRequest
+}
+
+func (p *recordingProvisioningStub) CreatePod(ctx context.Context, req provisioning.CreatePodRequest) (provisioning.ProvisionResult, error) {
+	p.podRequests = append(p.podRequests, req)
+	return p.provisioningStub.CreatePod(ctx, req)
+}
+
+func TestCreatePodForwardsSpec(t *testing.T) {
+	repo := &repoStub{}
+	prov := &recordingProvisioningStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: prov, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	pod, err := svc.CreatePod(context.Background(), models.Pod{
+		UserID:     "u1",
+		ProviderID: "p1",
+		Name:       "trainer",
+		ImageName:  "pytorch/pytorch:latest",
+		GPUTypeID:  "NVIDIA A40",
+		GPUCount:   1,
+		CPUCount:   8,
+		MemoryGB:   32,
+		Env: []models.PodEnvVar{
+			{Key: "MODE", Value: "train"},
+			{Key: "HF_TOKEN", SecretRef: "hf_token"},
+		},
+		Command:      []string{"python", "train.py"},
+		Args:         []string{"--epochs", "3"},
+		Ports:        []models.PodPort{{Port: 8888}, {Port: 22, Protocol: "TCP"}},
+		VolumeMounts: []models.PodVolumeMount{{MountPath: "/workspace", SizeGB: 50}},
+	})
+	if err != nil {
+		t.Fatalf("create pod: %v", err)
+	}
+	if pod.Status != models.PodStatusRunning {
+		t.Fatalf("expected running pod, got %s", pod.Status)
+	}
+	if len(prov.podRequests) != 1 {
+		t.Fatalf("expected one provisioning request, got %d", len(prov.podRequests))
+	}
+	req := prov.podRequests[0]
+	if req.ContainerDiskGB != defaultPodContainerDiskGB {
+		t.Fatalf("expected default container disk, got %d", req.ContainerDiskGB)
+	}
+	if len(req.Env) != 2 || req.Env[1].SecretRef != "hf_token" || req.Env[1].Value != "" {
+		t.Fatalf("expected secret env forwarded as reference, got %+v", req.Env)
+	}
+	if len(req.Ports) != 2 || req.Ports[0].Protocol != models.PodPortProtocolHTTP || req.Ports[1].Protocol != models.PodPortProtocolTCP {
+		t.Fatalf("expected normalized port protocols, got %+v", req.Ports)
+	}
+	if len(req.Command) != 2 || len(req.Args) != 2 || len(req.VolumeMounts) != 1 {
+		t.Fatalf("expected command, args and volume forwarded, got %+v", req)
+	}
+}
+
+func TestCreatePodRejectsInvalidSpec(t *testing.T) {
+	base := models.Pod{
+		UserID:     "u1",
+		ProviderID: "p1",
+		Name:       "trainer",
+		ImageName:  "pytorch/pytorch:latest",
+		GPUTypeID:  "NVIDIA A40",
+		GPUCount:   1,
+		CPUCount:   8,
+		MemoryGB:   32,
+	}
+	cases := map[string]func(p *models.Pod){
+		"bad env key":       func(p *models.Pod) { p.Env = []models.PodEnvVar{{Key: "1BAD", Value: "x"}} },
+		"duplicate env":     func(p *models.Pod) { p.Env = []models.PodEnvVar{{Key: "A", Value: "1"}, {Key: "A", Value: "2"}} },
+		"value and secret":  func(p *models.Pod) { p.Env = []models.PodEnvVar{{Key: "A", Value: "1", SecretRef: "s"}} },
+		"args without cmd":  func(p *models.Pod) { p.Args = []string{"--flag"} },
+		"port out of range": func(p *models.Pod) { p.Ports = []models.PodPort{{Port: 70000}} },
+		"bad port protocol": func(p *models.Pod) { p.Ports = []models.PodPort{{Port: 53, Protocol: "udp"}} },
+		"duplicate port":    func(p *models.Pod) { p.Ports = []models.PodPort{{Port: 80}, {Port: 80, Protocol: "tcp"}} },
+		"disk too large":    func(p *models.Pod) { p.ContainerDiskGB = maxPodContainerDiskGB + 1 },
+		"relative mount":    func(p *models.Pod) { p.VolumeMounts = []models.PodVolumeMount{{MountPath: "data", SizeGB: 10}} },
+		"two mounts": func(p *models.Pod) {
+			p.VolumeMounts = []models.PodVolumeMount{{MountPath: "/a", SizeGB: 1}, {MountPath: "/b", SizeGB: 1}}
+		},
+		"sized network vol": func(p *models.Pod) {
+			p.VolumeMounts = []models.PodVolumeMount{{MountPath: "/a", SizeGB: 1, NetworkVolumeID: "nv1"}}
+		},
+		"bad registry auth":  func(p *models.Pod) { p.RegistryAuthID = "auth id" },
+		"empty command head": func(p *models.Pod) { p.Command = []string{" "} },
+		"image as a flag":    func(p *models.Pod) { p.ImageName = "--privileged" },
+		"image with spaces":  func(p *models.Pod) { p.ImageName = "nginx latest" },
+	}
+	for name, mutate := range cases {
+		repo := &repoStub{}
+		svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, CreateRateLimitRPM: 100, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+		pod := base
+		mutate(&pod)
+		if _, err := svc.CreatePod(context.Background(), pod); err == nil {
+			t.Fatalf("%s: expected validation error", name)
+		}
+		if len(repo.pods) != 0 {
+			t.Fatalf("%s: expected no pod persisted", name)
+		}
+	}
+}
+
+func TestLocalPodLifecycle(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{
+			ProviderID:   "donor-1",
+			CPUFreeCores: 16,
+			RAMFreeMB:    65536,
+			GPUFreeUnits: 2,
+			HeartbeatAt:  time.Now().UTC(),
+		},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	pod, err := svc.CreatePod(ctx, models.Pod{
+		UserID:     "u1",
+		ProviderID: "donor-1",
+		Name:       "local-trainer",
+		ImageName:  "pytorch/pytorch:latest",
+		GPUTypeID:  "any",
+		GPUCount:   1,
+		CPUCount:   4,
+		MemoryGB:   8,
+		Backend:    models.PodBackendLocal,
+		Command:    []string{"python", "-m", "http.server"},
+		Ports:      []models.PodPort{{Port: 8000, HostPort: 80}, {Port: 22, Protocol: models.PodPortProtocolTCP}},
+	})
+	if err != nil {
+		t.Fatalf("create local pod: %v", err)
+	}
+	if pod.Ports[0].HostPort != 0 {
+		t.Fatalf("expected requested host port to be dropped, got %+v", pod.Ports)
+	}
+	if pod.Status != models.PodStatusProvisioning || pod.AllocationID == "" {
+		t.Fatalf("expected provisioning pod with allocation, got %+v", pod)
+	}
+	if len(repo.agentCommands) != 1 || repo.agentCommands[0].Command != models.AgentCommandPodStart {
+		t.Fatalf("expected pod_start command queued, got %+v", repo.agentCommands)
+	}
+	var spec models.LocalPodSpec
+	if err := json.Unmarshal([]byte(repo.agentCommands[0].Payload), &spec); err != nil {
+		t.Fatalf("decode pod_start payload: %v", err)
+	}
+	if spec.PodID != pod.ID || spec.AllocationID != pod.AllocationID || spec.GPUCount != 1 || len(spec.Command) != 3 {
+		t.Fatalf("unexpected pod_start payload: %+v", spec)
+	}
+
+	if _, err := svc.CompleteAgentCommand(ctx, repo.agentCommands[0].ID, "donor-1", models.AgentCommandSucceeded, "container started: c1 gpus=0 ports=22:32769,8000:32768"); err != nil {
+		t.Fatalf("complete pod_start: %v", err)
+	}
+	got, _ := svc.GetPod(ctx, pod.ID)
+	if got.Status != models.PodStatusRunning {
+		t.Fatalf("expected running pod, got %s", got.Status)
+	}
+	if len(got.Ports) != 2 || got.Ports[0].HostPort != 32768 || got.Ports[1].HostPort != 32769 {
+		t.Fatalf("expected published host ports recorded, got %+v", got.Ports)
+	}
+
+	if err := svc.SyncLocalPods(ctx); err != nil {
+		t.Fatalf("sync local pods: %v", err)
+	}
+	if err := svc.SyncLocalPods(ctx); err != nil {
+		t.Fatalf("sync local pods again: %v", err)
+	}
+	if len(repo.agentCommands) != 2 || repo.agentCommands[1].Command != models.AgentCommandPodStatus {
+		t.Fatalf("expected a single pod_status command, got %+v", repo.agentCommands)
+	}
+	if _, err := svc.CompleteAgentCommand(ctx, repo.agentCommands[1].ID, "donor-1", models.AgentCommandFailed, "container exited with code 1"); err != nil {
+		t.Fatalf("complete pod_status: %v", err)
+	}
+	if got, _ := svc.GetPod(ctx, pod.ID); got.Status != models.PodStatusStopped {
+		t.Fatalf("expected stopped pod after exit, got %s", got.Status)
+	}
+	if len(repo.agentCommands) != 3 || repo.agentCommands[2].Command != models.AgentCommandPodStop {
+		t.Fatalf("expected pod_stop cleanup queued, got %+v", repo.agentCommands)
+	}
+	if _, err := svc.CompleteAgentCommand(ctx, repo.agentCommands[2].ID, "donor-1", models.AgentCommandSucceeded, "container removed"); err != nil {
+		t.Fatalf("complete pod_stop: %v", err)
+	}
+	if repo.allocations[0].ReleasedAt == nil {
+		t.Fatal("expected allocation released after pod_stop")
+	}
+}
+
+func TestSyncLocalPodsCoversEveryRunningPod(t *testing.T) {
+	repo := &repoStub{}
+	for i := 0; i < 600; i++ {
+		repo.pods = append(repo.pods, models.Pod{ID: fmt.Sprintf("pod-%d", i), ProviderID: "donor-1", Backend: models.PodBackendLocal, Status: models.PodStatusRunning})
+	}
+	repo.pods = append(repo.pods, models.Pod{ID: "stopped", ProviderID: "donor-1", Backend: models.PodBackendLocal, Status: models.PodStatusStopped})
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}})
+	ctx := context.Background()
+
+	// An open pod_status queued behind hundreds of other commands still counts.
+	repo.agentCommands = append(repo.agentCommands, models.AgentCommand{ID: "old-status", ProviderID: "donor-1", ResourceID: "pod-0", Command: models.AgentCommandPodStatus, Status: models.AgentCommandQueued})
+	for i := 0; i < 300; i++ {
+		repo.agentCommands = append(repo.agentCommands, models.AgentCommand{ID: fmt.Sprintf("exec-%d", i), ProviderID: "donor-1", Command: models.AgentCommandExec, Status: models.AgentCommandSucceeded})
+	}
+	if err := svc.SyncLocalPods(ctx); err != nil {
+		t.Fatalf("sync local pods: %v", err)
+	}
+	queued := make(map[string]int)
+	for _, cmd := range repo.agentCommands {
+		if cmd.Command == models.AgentCommandPodStatus {
+			queued[cmd.ResourceID]++
+		}
+	}
+	if len(queued) != 600 || queued["pod-0"] != 1 || queued["pod-599"] != 1 || queued["stopped"] != 0 {
+		t.Fatalf("expected one pod_status for each of the 600 running pods, got %d pods", len(queued))
+	}
+}
+
+func TestLocalPodStartFailureReleasesAllocation(t *testing.T) {
+	repo := &repoStub{
+		resource: models.HostResource{
+			ProviderID:   "donor-1",
+			CPUFreeCores: 16,
+			RAMFreeMB:    65536,
+			GPUFreeUnits: 2,
+			HeartbeatAt:  time.Now().UTC(),
+		},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	if _, err := svc.CreatePod(ctx, models.Pod{
+		UserID: "u1", ProviderID: "donor-1", Name: "p", ImageName: "img", GPUTypeID: "any",
+		GPUCount: 1, CPUCount: 1, MemoryGB: 1, Backend: models.PodBackendLocal,
+		Env: []models.PodEnvVar{{Key: "TOKEN", SecretRef: "tok"}},
+	}); err == nil {
+		t.Fatal("expected secret_ref to be rejected for local pods")
+	}
+
+	pod, err := svc.CreatePod(ctx, models.Pod{
+		UserID: "u1", ProviderID: "donor-1", Name: "p", ImageName: "img", GPUTypeID: "any",
+		GPUCount: 1, CPUCount: 1, MemoryGB: 1, Backend: models.PodBackendLocal,
+	})
+	if err != nil {
+		t.Fatalf("create local pod: %v", err)
+	}
+	if _, err := svc.CompleteAgentCommand(ctx, repo.agentCommands[0].ID, "donor-1", models.AgentCommandFailed, "image pull failed"); err != nil {
+		t.Fatalf("complete pod_start: %v", err)
+	}
+	if got, _ := svc.GetPod(ctx, pod.ID); got.Status != models.PodStatusTerminated {
+		t.Fatalf("expected terminated pod, got %s", got.Status)
+	}
+	if repo.allocations[0].ReleasedAt == nil {
+		t.Fatal("expected allocation released after failed start")
+	}
+}
+
+func TestResourceLogsRecordFilterAndRetention(t *testing.T) {
+	repo := &repoStub{
+		vm: models.VM{ID: "vm-1", UserID: "u1", ProviderID: "donor-1"},
+	}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	if _, err := svc.RecordResourceLogs(ctx, "donor-2", []models.ResourceLog{{ResourceID: "vm-1", Message: "hello"}}); err == nil {
+		t.Fatal("expected provider mismatch error")
+	}
+	if _, err := svc.RecordResourceLogs(ctx, "donor-1", []models.ResourceLog{{ResourceID: "vm-1", Message: "x", Level: "loud"}}); err == nil {
+		t.Fatal("expected invalid level error")
+	}
+	created, err := svc.RecordResourceLogs(ctx, "donor-1", []models.ResourceLog{
+		{ResourceID: "vm-1", SourceType: "journald", Source: "nginx.service", Message: "started worker 100%"},
+		{ResourceID: "vm-1", SourceType: "journald", Source: "nginx.service", Level: "warn", Message: "slow upstream"},
+		{ResourceID: "vm-1", SourceType: "file", Source: "/var/log/app.log", Level: "error", Message: "upstream timed out"},
+		{ResourceID: "donor-1", SourceType: "journald", Source: "docker.service", Message: "daemon ready"},
+	})
+	if err != nil {
+		t.Fatalf("record resource logs: %v", err)
+	}
+	if created[0].Level != models.ResourceLogInfo || created[1].Level != models.ResourceLogWarning || created[0].ResourceType != "vm" || created[3].ResourceType != "host" {
+		t.Fatalf("unexpected normalized logs: %+v", created)
+	}
+
+	if _, err := svc.ListResourceLogs(ctx, "u2", models.ResourceLogQuery{ResourceID: "vm-1"}); err == nil {
+		t.Fatal("expected forbidden for non-owner")
+	}
+	items, err := svc.ListResourceLogs(ctx, "u1", models.ResourceLogQuery{ResourceID: "vm-1", Levels: []string{"warn", "error"}, Text: "UPSTREAM"})
+	if err != nil {
+		t.Fatalf("list resource logs: %v", err)
+	}
+	if len(items) != 2 || items[0].Seq != 3 || items[1].Seq != 2 {
+		t.Fatalf("expected newest-first warning and error lines, got %+v", items)
+	}
+	items, err = svc.ListResourceLogs(ctx, "u1", models.ResourceLogQuery{ResourceID: "vm-1", AfterSeq: 1, Source: "nginx.service"})
+	if err != nil || len(items) != 1 || items[0].Seq != 2 {
+		t.Fatalf("expected one nginx line after seq 1, got %+v err=%v", items, err)
+	}
+
+	resourceLogPollInterval = 10 * time.Millisecond
+	followed, err := svc.FollowResourceLogs(ctx, "u1", models.ResourceLogQuery{ResourceID: "vm-1"}, 50*time.Millisecond)
+	if err != nil || len(followed) != 0 {
+		t.Fatalf("expected follow from tail to time out empty, got %+v err=%v", followed, err)
+	}
+	if _, err := svc.RecordResourceLogs(ctx, "donor-1", []models.ResourceLog{{ResourceID: "vm-1", Message: "new line"}}); err != nil {
+		t.Fatalf("record followed log: %v", err)
+	}
+	followed, err = svc.FollowResourceLogs(ctx, "u1", models.ResourceLogQuery{ResourceID: "vm-1", AfterSeq: 4}, time.Second)
+	if err != nil || len(followed) != 1 || followed[0].Message != "new line" {
+		t.Fatalf("expected followed line, got %+v err=%v", followed, err)
+	}
+
+	for i := range repo.resourceLogs[:2] {
+		repo.resourceLogs[i].CreatedAt = time.Now().UTC().Add(-100 * time.Hour)
+	}
+	if err := svc.PruneResourceLogs(ctx, time.Now().UTC()); err != nil {
+		t.Fatalf("prune resource logs: %v", err)
+	}
+	if len(repo.resourceLogs) != 3 {
+		t.Fatalf("expected 3 logs after retention, got %d", len(repo.resourceLogs))
+	}
+}
+
+func TestShareGrantLifecycle(t *testing.T) {
+	repo := &repoStub{
+		vm: models.VM{ID: "vm-1", UserID: "owner", ProviderID: "donor-1"},
+	}
+	users := userDirectoryStub{"friend@mail.com": "friend"}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Users: users, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	if _, err := svc.GrantShare(ctx, "intruder", models.ShareGrant{ResourceType: "vm", ResourceID: "vm-1", GranteeUserID: "intruder"}); err == nil {
+		t.Fatal("expected non-owner grant to be rejected")
+	}
+	if _, err := svc.GrantShare(ctx, "owner", models.ShareGrant{ResourceType: "vm", ResourceID: "vm-1", InviteEmail: "stranger@mail.com"}); err == nil {
+		t.Fatal("expected unknown email to be rejected")
+	}
+	invite, err := svc.GrantShare(ctx, "owner", models.ShareGrant{ResourceType: "vm", ResourceID: "vm-1", InviteEmail: "Friend@mail.com", AccessLevel: models.SharedAccessWrite})
+	if err != nil {
+		t.Fatalf("invite by email: %v", err)
+	}
+	if invite.Status != models.ShareGrantPending || invite.GranteeUserID != "friend" {
+		t.Fatalf("expected pending invite for friend, got %+v", invite)
+	}
+	if _, err := svc.GrantShare(ctx, "owner", models.ShareGrant{ResourceType: "vm", ResourceID: "vm-1", GranteeUserID: "friend"}); err == nil {
+		t.Fatal("expected duplicate grant to be rejected")
+	}
+	received, err := svc.ListReceivedShareGrants(ctx, "friend")
+	if err != nil || len(received) != 1 {
+		t.Fatalf("expected one received invite, got %+v err=%v", received, err)
+	}
+	if _, err := svc.AcceptShareGrant(ctx, "someone-else", "vm", invite.ID); err == nil {
+		t.Fatal("expected accept by another user to fail")
+	}
+	accepted, err := svc.AcceptShareGrant(ctx, "friend", "vm", invite.ID)
+	if err != nil || accepted.Status != models.ShareGrantActive || accepted.AcceptedAt == nil {
+		t.Fatalf("expected active grant after accept, got %+v err=%v", accepted, err)
+	}
+
+	expiresAt := time.Now().UTC().Add(time.Hour)
+	updated, err := svc.UpdateShareGrant(ctx, "owner", "vm", invite.ID, models.ShareGrantUpdate{AccessLevel: models.SharedAccessAdmin, ExpiresAt: &expiresAt})
+	if err != nil || updated.AccessLevel != models.SharedAccessAdmin || updated.ExpiresAt == nil {
+		t.Fatalf("expected admin grant with expiry, got %+v err=%v", updated, err)
+	}
+	if _, err := svc.UpdateShareGrant(ctx, "friend", "vm", invite.ID, models.ShareGrantUpdate{AccessLevel: models.SharedAccessRead}); err == nil {
+		t.Fatal("expected grantee update to be rejected")
+	}
+	if err := svc.ExpireShareGrants(ctx, expiresAt.Add(time.Minute)); err != nil {
+		t.Fatalf("expire grants: %v", err)
+	}
+	grants, err := svc.ListShareGrants(ctx, "owner", "vm", "vm-1")
+	if err != nil || len(grants) != 1 || grants[0].Status != models.ShareGrantExpired {
+		t.Fatalf("expected expired grant, got %+v err=%v", grants, err)
+	}
+
+	shared, err := svc.ShareVM(ctx, models.SharedVM{VMID: "vm-1", OwnerUserID: "owner", SharedWith: []string{"friend"}})
+	if err != nil || shared.Status != models.ShareGrantActive {
+		t.Fatalf("expected legacy share to create active grant, got %+v err=%v", shared, err)
+	}
+	if _, err := svc.RevokeShareGrant(ctx, "intruder", "vm", shared.ID); err == nil {
+		t.Fatal("expected revoke by stranger to fail")
+	}
+	revoked, err := svc.RevokeShareGrant(ctx, "friend", "vm", shared.ID)
+	if err != nil || revoked.Status != models.ShareGrantRevoked || revoked.RevokedAt == nil {
+		t.Fatalf("expected grantee to leave share, got %+v err=%v", revoked, err)
+	}
+
+	audit, err := svc.ListShareAuditEvents(ctx, "owner", "vm", "vm-1", 50)
+	if err != nil {
+		t.Fatalf("list share audit: %v", err)
+	}
+	actions := make([]string, 0, len(audit))
+	for _, item := range audit {
+		actions = append(actions, item.Action)
+	}
+	want := "invite_created,grant_accepted,grant_updated,grant_expired,grant_created,grant_revoked"
+	if strings.Join(actions, ",") != want {
+		t.Fatalf("expected audit trail %s, got %s", want, strings.Join(actions, ","))
+	}
+}
+
+type presenceStub struct {
+	failNext int
+	sent     []models.ProviderPresence
+}
+
+func TestShareVMStoresNoGrantWhenARecipientFails(t *testing.T) {
+	repo := &repoStub{
+		vm: models.VM{ID: "vm-1", UserID: "owner", ProviderID: "donor-1"},
+	}
+	users := userDirectoryStub{"friend@mail.com": "friend"}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Users: users, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	for _, sharedWith := range [][]string{
+		{"bob", "stranger@mail.com"},
+		{"bob", "owner"},
+		{"friend", "friend@mail.com"},
+	} {
+		if _, err := svc.ShareVM(ctx, models.SharedVM{VMID: "vm-1", OwnerUserID: "owner", SharedWith: sharedWith}); err == nil {
+			t.Fatalf("expected share with %v to fail", sharedWith)
+		}
+		if len(repo.shareGrants) != 0 {
+			t.Fatalf("expected no grants after failed share with %v, got %+v", sharedWith, repo.shareGrants)
+		}
+	}
+
+	shared, err := svc.ShareVM(ctx, models.SharedVM{VMID: "vm-1", OwnerUserID: "owner", SharedWith: []string{"bob", "friend@mail.com"}})
+	if err != nil || shared.Status != models.ShareGrantPending || len(repo.shareGrants) != 2 {
+		t.Fatalf("expected two grants with a pending invite, got %+v grants=%d err=%v", shared, len(repo.shareGrants), err)
+	}
+}
+
+func (p *presenceStub) PublishPresence(_ context.Context, presence models.ProviderPresence) error {
+	if p.failNext > 0 {
+		p.failNext--
+		return errors.New("adminservice unavailable")
+	}
+	p.sent = append(p.sent, presence)
+	return nil
+}
+
+func TestProviderPresence(t *testing.T) {
+	base := time.Now().UTC()
+	repo := &repoStub{
+		hosts: []models.HostResource{
+			{ProviderID: "p1", HeartbeatAt: base},
+			{ProviderID: "p2", HeartbeatAt: base.Add(-2 * time.Minute)},
+			{ProviderID: "p3", HeartbeatAt: base.Add(-10 * time.Minute)},
+		},
+		sharedOffers: []models.SharedInventoryOffer{
+			{ID: "offer-1", ProviderID: "p1", Status: "active"},
+			{ID: "offer-2", ProviderID: "p9", Status: "active"},
+		},
+	}
+	publisher := &presenceStub{failNext: 1}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Presence: publisher, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	if err := svc.EvaluatePresence(ctx, base); err == nil {
+		t.Fatal("expected failed presence push to be reported")
+	}
+	states := map[string]models.ProviderPresenceState{}
+	for id, item := range repo.presence {
+		states[id] = item.State
+	}
+	if states["p1"] != models.ProviderOnline || states["p2"] != models.ProviderDegraded || states["p3"] != models.ProviderOffline {
+		t.Fatalf("unexpected derived presence %v", states)
+	}
+	if len(publisher.sent) != 2 {
+		t.Fatalf("expected two pushes to succeed, got %d", len(publisher.sent))
+	}
+	if err := svc.EvaluatePresence(ctx, base.Add(time.Second)); err != nil {
+		t.Fatalf("retry presence push: %v", err)
+	}
+	if len(publisher.sent) != 3 || publisher.sent[2].ProviderID != "p1" {
+		t.Fatalf("expected failed push to be retried, got %+v", publisher.sent)
+	}
+
+	if _, err := svc.ClaimNextAgentCommand(ctx, "p1"); err != nil {
+		t.Fatalf("claim agent command: %v", err)
+	}
+	repo.hosts[0].HeartbeatAt = base.Add(90 * time.Second)
+	if err := svc.EvaluatePresence(ctx, base.Add(90*time.Second)); err != nil {
+		t.Fatalf("evaluate presence: %v", err)
+	}
+	if item := repo.presence["p1"]; item.State != models.ProviderDegraded || item.Reason != "agent stopped polling for commands" || item.FlapCount != 1 {
+		t.Fatalf("expected stale poll to degrade p1, got %+v", item)
+	}
+	now := time.Now().UTC()
+	if _, err := svc.ClaimNextAgentCommand(ctx, "p1"); err != nil {
+		t.Fatalf("claim agent command: %v", err)
+	}
+	repo.hosts[0].HeartbeatAt = now
+	if err := svc.EvaluatePresence(ctx, now); err != nil {
+		t.Fatalf("evaluate presence: %v", err)
+	}
+	degraded, err := svc.ListProviderPresence(ctx, "degraded")
+	if err != nil || len(degraded) != 1 || degraded[0].ProviderID != "p2" {
+		t.Fatalf("expected only p2 degraded, got %+v %v", degraded, err)
+	}
+	online, err := svc.ListProviderPresence(ctx, "online")
+	if err != nil || len(online) != 1 || online[0].FlapCount != 2 || online[0].RecentFlaps != 2 {
+		t.Fatalf("expected p1 back online with two flaps, got %+v %v", online, err)
+	}
+	if _, err := svc.ListProviderPresence(ctx, "away"); err == nil {
+		t.Fatal("expected unknown presence state to be rejected")
+	}
+	events, err := svc.ListProviderPresenceEvents(ctx, "p1", 0)
+	if err != nil || len(events) != 3 || events[0].ToState != models.ProviderOnline || events[2].FromState != "" {
+		t.Fatalf("unexpected presence history %+v %v", events, err)
+	}
+
+	pollAt := now.Add(-10 * time.Second)
+	state, _ := derivePresence(models.ProviderPresence{LastPollAt: &pollAt}, now, 30*time.Second)
+	if state != models.ProviderDegraded {
+		t.Fatalf("expected polling agent without heartbeats to be degraded, got %s", state)
+	}
+
+	offers, err := svc.ListSharedInventoryOffers(ctx, "", "")
+	if err != nil {
+		t.Fatalf("list offers: %v", err)
+	}
+	if offers[0].ProviderPresence != models.ProviderOnline || offers[1].ProviderPresence != models.ProviderOffline {
+		t.Fatalf("unexpected offer presence %s %s", offers[0].ProviderPresence, offers[1].ProviderPresence)
+	}
+}
+
+func TestSLAReportsAndCredits(t *testing.T) {
+	september := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	outageStart := september.Add(10 * 24 * time.Hour)
+	checks := make([]models.HealthCheck, 0)
+	for at := september.Add(-time.Minute); at.Before(september.AddDate(0, 1, 0)); at = at.Add(5 * time.Minute) {
+		status := models.HealthStatusOK
+		if !at.Before(outageStart) && at.Before(outageStart.Add(time.Hour)) {
+			status = models.HealthStatusCritical
+		}
+		checks = append(checks, models.HealthCheck{ResourceType: "vm", ResourceID: "vm-1", CheckType: "tcp", Status: status, CheckedAt: at})
+	}
+	confirmed := september.Add(-48 * time.Hour)
+	terminated := september.AddDate(0, 0, 20)
+	repo := &repoStub{
+		vm:           models.VM{ID: "vm-1", UserID: "u1", ProviderID: "p1", AvailabilityTier: models.AvailabilityTierHigh, Status: models.VMStatusTerminated, CreatedAt: september.AddDate(0, 0, -12), UpdatedAt: terminated},
+		pods:         []models.Pod{{ID: "pod-1", UserID: "u1", ProviderID: "p1", AvailabilityTier: models.AvailabilityTierLow, CreatedAt: september.Add(24 * time.Hour)}},
+		healthChecks: checks,
+		presenceLog: []models.ProviderPresenceEvent{
+			{ProviderID: "p1", ToState: models.ProviderOnline, CreatedAt: september.AddDate(0, -1, 0)},
+			{ProviderID: "p1", FromState: models.ProviderOnline, ToState: models.ProviderOffline, CreatedAt: outageStart},
+			{ProviderID: "p1", FromState: models.ProviderOffline, ToState: models.ProviderDegraded, CreatedAt: outageStart.Add(24 * time.Hour)},
+		},
+		bookings: []models.OfferBooking{
+			{ID: "b1", UserID: "u2", ProviderID: "p1", Status: models.OfferBookingConfirmed, BillingRentalID: "rental-1", ConfirmedAt: &confirmed},
+			{ID: "b2", UserID: "u3", ProviderID: "p1", Status: models.OfferBookingConfirmed, ConfirmedAt: &confirmed},
+		},
+	}
+	bill := &billingStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, Billing: bill, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+
+	now := time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)
+	if err := svc.EvaluateSLAs(context.Background(), now); err != nil {
+		t.Fatalf("evaluate slas: %v", err)
+	}
+	vmReport, _ := repo.GetSLAReport(context.Background(), "vm", "vm-1", "2026-09")
+	if vmReport.Met || vmReport.TargetPct != 99.9 || vmReport.DowntimeSeconds != 3600 || vmReport.UptimePct != 99.861 {
+		t.Fatalf("unexpected vm report: %+v", vmReport)
+	}
+	if vmReport.CreditStatus != models.SLACreditIssued || vmReport.CreditUSD != 25 {
+		t.Fatalf("expected vm credit issued for 25, got %s %.2f", vmReport.CreditStatus, vmReport.CreditUSD)
+	}
+	podReport, _ := repo.GetSLAReport(context.Background(), "pod", "pod-1", "2026-09")
+	if !podReport.Met || podReport.MonitoredSeconds != 0 || podReport.CreditStatus != models.SLACreditNone {
+		t.Fatalf("unmonitored pod should meet its sla without credit: %+v", podReport)
+	}
+	providerReport, _ := repo.GetSLAReport(context.Background(), "provider", "p1", "2026-09")
+	if providerReport.Met || providerReport.Tier != models.AvailabilityTierMedium || providerReport.DowntimeSeconds != 24*3600 {
+		t.Fatalf("unexpected provider report: %+v", providerReport)
+	}
+	if len(bill.credits) != 2 || bill.credits[0].ReferenceID != "sla:vm:vm-1:2026-09" || bill.credits[1].ReferenceID != "sla:provider:p1:2026-09:b1" || bill.credits[1].RentalID != "rental-1" {
+		t.Fatalf("unexpected credits: %+v", bill.credits)
+	}
+	if bill.credits[0].ResourceEndedAt == nil || !bill.credits[0].ResourceEndedAt.Equal(terminated) || bill.credits[1].ResourceEndedAt != nil {
+		t.Fatalf("expected the terminated vm's end sent with its credit only, got %+v", bill.credits)
+	}
+
+	if err := svc.EvaluateSLAs(context.Background(), now.Add(time.Hour)); err != nil {
+		t.Fatalf("second evaluation: %v", err)
+	}
+	if len(bill.credits) != 2 || len(repo.slaReports) != 3 {
+		t.Fatalf("evaluation should be idempotent, got %d credits and %d reports", len(bill.credits), len(repo.slaReports))
+	}
+	stored, err := svc.ResourceSLAReport(context.Background(), "u1", "vm-1", "2026-09")
+	if err != nil || stored.CreditStatus != models.SLACreditIssued {
+		t.Fatalf("expected stored report, got %+v err=%v", stored, err)
+	}
+	if _, err := svc.ResourceSLAReport(context.Background(), "u9", "vm-1", "2026-09"); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected forbidden for stranger, got %v", err)
+	}
+	if _, err := normalizeAvailabilityTier("gold"); err == nil {
+		t.Fatal("expected unknown availability tier to be rejected")
+	}
+}
+
+func TestMeasureCheckUptimeAcrossProbes(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	checks := []models.HealthCheck{
+		{ProbeID: "http", Status: models.HealthStatusOK, CheckedAt: from},
+		{ProbeID: "tcp", Status: models.HealthStatusOK, CheckedAt: from},
+		{ProbeID: "http", Status: models.HealthStatusCritical, CheckedAt: from.Add(2 * time.Minute)},
+		{ProbeID: "tcp", Status: models.HealthStatusOK, CheckedAt: from.Add(3 * time.Minute)},
+		{ProbeID: "http", Status: models.HealthStatusOK, CheckedAt: from.Add(4 * time.Minute)},
+	}
+	monitored, down := measureCheckUptime(checks, from, to)
+	if monitored != 9*time.Minute || down != 2*time.Minute {
+		t.Fatalf("expected 9m monitored and 2m down, got %s and %s", monitored, down)
+	}
+}
+
+func TestResourceStreams(t *testing.T) {
+	repo := &repoStub{vm: models.VM{ID: "vm-1", UserID: "u1", ProviderID: "p1", Status: models.VMStatusRunning}}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	if _, err := svc.AuthorizeStream(ctx, "u2", false, models.StreamSubscription{ResourceIDs: []string{"vm-1"}}); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected stranger to be forbidden, got %v", err)
+	}
+	if _, err := svc.AuthorizeStream(ctx, "u1", false, models.StreamSubscription{ProviderIDs: []string{"p1"}}); err == nil {
+		t.Fatal("expected provider stream to require admin")
+	}
+	sub, err := svc.AuthorizeStream(ctx, "u1", false, models.StreamSubscription{ResourceIDs: []string{"vm-1, vm-1"}, Types: []models.StreamEventType{models.StreamEventState, models.StreamEventMetric}})
+	if err != nil || len(sub.ResourceIDs) != 1 {
+		t.Fatalf("authorize stream: %+v %v", sub, err)
+	}
+	events, cancel := svc.SubscribeStream(sub)
+	defer cancel()
+
+	if _, err := svc.RecordMetric(ctx, models.MetricPoint{ResourceType: "vm", ResourceID: "vm-2", MetricType: "cpu", Value: 1}); err != nil {
+		t.Fatalf("record metric: %v", err)
+	}
+	if _, err := svc.RecordAgentLog(ctx, models.AgentLog{ProviderID: "p1", ResourceID: "vm-1", Message: "filtered by type"}); err != nil {
+		t.Fatalf("record agent log: %v", err)
+	}
+	if _, err := svc.RecordMetric(ctx, models.MetricPoint{ResourceType: "vm", ResourceID: "vm-1", MetricType: "cpu", Value: 42}); err != nil {
+		t.Fatalf("record metric: %v", err)
+	}
+	if _, err := svc.StopVM(ctx, "u1", "vm-1"); err != nil {
+		t.Fatalf("stop vm: %v", err)
+	}
+	first := <-events
+	if first.Type != models.StreamEventMetric || first.Data.(models.MetricPoint).Value != 42 {
+		t.Fatalf("expected vm-1 metric first, got %+v", first)
+	}
+	second := <-events
+	if second.Type != models.StreamEventState || second.Data.(models.StreamState).Status != string(models.VMStatusStopped) {
+		t.Fatalf("expected stopped state, got %+v", second)
+	}
+	select {
+	case extra := <-events:
+		t.Fatalf("unexpected event %+v", extra)
+	default:
+	}
+
+	for i := 0; i <= streamBuffer; i++ {
+		svc.publishResourceState("vm", "vm-1", "", models.StreamState{Status: "running"})
+	}
+	drained := 0
+	for range events {
+		drained++
+	}
+	if drained != streamBuffer {
+		t.Fatalf("expected slow subscriber to be dropped after %d events, drained %d", streamBuffer, drained)
+	}
+}
+
+func TestStreamEventsRelayAcrossInstances(t *testing.T) {
+	repo := &repoStub{vm: models.VM{ID: "vm-1", UserID: "u1", ProviderID: "p1", Status: models.VMStatusRunning}}
+	opts := Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}}
+	ingest := NewResourceService(repo, cgStub{}, opts)
+	serve := NewResourceService(repo, cgStub{}, opts)
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	// An event from before the instance started is not replayed.
+	ingest.publishResourceState("vm", "vm-1", "", models.StreamState{Status: "starting"})
+	ingest.streams.flush()
+	for _, svc := range []*ResourceService{ingest, serve} {
+		if err := svc.RelayStreamEvents(ctx, now); err != nil {
+			t.Fatalf("prime relay: %v", err)
+		}
+	}
+	sub := models.StreamSubscription{ResourceIDs: []string{"vm-1"}}
+	remote, cancelRemote := serve.SubscribeStream(sub)
+	defer cancelRemote()
+	local, cancelLocal := ingest.SubscribeStream(sub)
+	defer cancelLocal()
+
+	if _, err := ingest.RecordMetric(ctx, models.MetricPoint{ResourceType: "vm", ResourceID: "vm-1", MetricType: "cpu", Value: 42}); err != nil {
+		t.Fatalf("record metric: %v", err)
+	}
+	ingest.streams.flush()
+	for _, svc := range []*ResourceService{ingest, serve} {
+		if err := svc.RelayStreamEvents(ctx, now); err != nil {
+			t.Fatalf("relay: %v", err)
+		}
+	}
+	select {
+	case event := <-remote:
+		var point models.MetricPoint
+		raw, ok := event.Data.(json.RawMessage)
+		if event.Type != models.StreamEventMetric || !ok || json.Unmarshal(raw, &point) != nil || point.Value != 42 {
+			t.Fatalf("expected the metric relayed to the other instance, got %+v", event)
+		}
+	default:
+		t.Fatal("expected the metric on the instance that did not ingest it")
+	}
+	if event := <-local; event.Type != models.StreamEventMetric {
+		t.Fatalf("expected the metric delivered locally, got %+v", event)
+	}
+	select {
+	case extra := <-local:
+		t.Fatalf("expected the ingesting instance to skip its own relayed event, got %+v", extra)
+	case extra := <-remote:
+		t.Fatalf("unexpected event %+v", extra)
+	default:
+	}
+}
+
+type agentConnStub struct {
+	sent     chan models.AgentChannelFrame
+	received chan models.AgentChannelFrame
+}
+
+func (c agentConnStub) Send(frame models.AgentChannelFrame) error {
+	c.sent <- frame
+	return nil
+}
+
+func (c agentConnStub) Receive() (models.AgentChannelFrame, error) {
+	frame, ok := <-c.received
+	if !ok {
+		return models.AgentChannelFrame{}, io.EOF
+	}
+	return frame, nil
+}
+
+func TestAgentChannelPushesCommandsAndResumes(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+	if _, err := svc.QueueAgentCommand(ctx, models.AgentCommand{ProviderID: "p1", Command: models.AgentCommandStatus}); err != nil {
+		t.Fatalf("queue command: %v", err)
+	}
+
+	conn := agentConnStub{sent: make(chan models.AgentChannelFrame, 8), received: make(chan models.AgentChannelFrame)}
+	done := make(chan error, 1)
+	go func() { done <- svc.ServeAgentChannel(ctx, "p1", 0, conn, nil) }()
+	if hello := <-conn.sent; hello.Type != models.AgentFrameHello {
+		t.Fatalf("expected hello, got %+v", hello)
+	}
+	first := <-conn.sent
+	if first.Type != models.AgentFrameCommand || first.Command == nil || first.Seq != 1 || first.Command.Status != models.AgentCommandRunning {
+		t.Fatalf("expected queued command on connect, got %+v", first)
+	}
+
+	if _, err := svc.QueueAgentCommand(ctx, models.AgentCommand{ProviderID: "p1", Command: models.AgentCommandRestart}); err != nil {
+		t.Fatalf("queue command: %v", err)
+	}
+	pushed := <-conn.sent
+	if pushed.Type != models.AgentFrameCommand || pushed.Seq != 2 || pushed.Command.Command != models.AgentCommandRestart {
+		t.Fatalf("expected restart pushed without polling, got %+v", pushed)
+	}
+
+	conn.received <- models.AgentChannelFrame{Type: models.AgentFrameResult, CommandID: first.Command.ID, Status: models.AgentCommandSucceeded, ResultMessage: "ok"}
+	conn.received <- models.AgentChannelFrame{Type: models.AgentFrameResult, CommandID: "cmd-404", Status: models.AgentCommandSucceeded}
+	rejected := <-conn.sent
+	if rejected.Type != models.AgentFrameError || rejected.CommandID != "cmd-404" {
+		t.Fatalf("expected error frame for unknown command, got %+v", rejected)
+	}
+	if repo.agentCommands[0].Status != models.AgentCommandSucceeded || repo.agentCommands[0].ResultMessage != "ok" {
+		t.Fatalf("expected result frame to complete command, got %+v", repo.agentCommands[0])
+	}
+	close(conn.received)
+	if err := <-done; !errors.Is(err, io.EOF) {
+		t.Fatalf("expected channel to end with the connection, got %v", err)
+	}
+
+	// Reconnecting after seq 1 replays the still-running restart but not the
+	// completed status command.
+	resumed := agentConnStub{sent: make(chan models.AgentChannelFrame, 8), received: make(chan models.AgentChannelFrame)}
+	go func() { done <- svc.ServeAgentChannel(ctx, "p1", 1, resumed, nil) }()
+	if hello := <-resumed.sent; hello.Type != models.AgentFrameHello || hello.Seq != 1 {
+		t.Fatalf("expected hello echoing resume seq, got %+v", hello)
+	}
+	replayed := <-resumed.sent
+	if replayed.Type != models.AgentFrameCommand || replayed.Seq != 2 {
+		t.Fatalf("expected running command replayed after resume, got %+v", replayed)
+	}
+	close(resumed.received)
+	<-done
+}
+
+type terminalConnStub struct {
+	sent     chan models.TerminalFrame
+	received chan models.TerminalFrame
+}
+
+func (c terminalConnStub) Send(frame models.TerminalFrame) error {
+	c.sent <- frame
+	return nil
+}
+
+func (c terminalConnStub) Receive() (models.TerminalFrame, error) {
+	frame, ok := <-c.received
+	if !ok {
+		return models.TerminalFrame{}, io.EOF
+	}
+	return frame, nil
+}
+
+func TestTerminalStreamBridgesAgentChannel(t *testing.T) {
+	repo := &repoStub{vm: models.VM{ID: "vm-1", UserID: "user-1", ProviderID: "provider-1", Status: models.VMStatusRunning}}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+	session, err := svc.CreateTerminalSession(ctx, "user-1", "vm-1", 24, 80)
+	if err != nil {
+		t.Fatalf("create terminal session: %v", err)
+	}
+	agent := agentConnStub{sent: make(chan models.AgentChannelFrame, 8), received: make(chan models.AgentChannelFrame)}
+	agentDone := make(chan error, 1)
+	go func() { agentDone <- svc.ServeAgentChannel(ctx, "provider-1", 0, agent, nil) }()
+	<-agent.sent
+	if open := <-agent.sent; open.Command == nil || open.Command.Command != models.AgentCommandTerminalOpen {
+		t.Fatalf("expected terminal_open pushed, got %+v", open)
+	}
+	for _, data := range []string{"one\n", "two\n"} {
+		if _, err := svc.RecordTerminalOutput(ctx, "provider-1", session.ID, data); err != nil {
+			t.Fatalf("record terminal output: %v", err)
+		}
+	}
+	if _, err := svc.RecordTerminalOutput(ctx, "provider-2", session.ID, "spoofed"); err == nil {
+		t.Fatal("expected output from another provider to be rejected")
+	}
+	svc.terminals.flush()
+
+	// Reconnecting after seq 1 replays only what the client has not shown.
+	term := terminalConnStub{sent: make(chan models.TerminalFrame, 8), received: make(chan models.TerminalFrame)}
+	done := make(chan error, 1)
+	go func() { done <- svc.ServeTerminalStream(ctx, "user-1", session.ID, 1, term) }()
+	if replayed := <-term.sent; replayed.Type != models.TerminalFrameOutput || replayed.Seq != 2 || replayed.Data != "two\n" {
+		t.Fatalf("expected seq 2 replayed, got %+v", replayed)
+	}
+	if presence := <-term.sent; presence.Type != models.TerminalFramePresence || len(presence.Participants) != 1 || !presence.Participants[0].Online {
+		t.Fatalf("expected presence with the renter online, got %+v", presence)
+	}
+	agent.received <- models.AgentChannelFrame{Type: models.AgentFrameTerminalOutput, SessionID: session.ID, Data: "three\n"}
+	if live := <-term.sent; live.Type != models.TerminalFrameOutput || live.Seq != 3 || live.Data != "three\n" {
+		t.Fatalf("expected agent output streamed live, got %+v", live)
+	}
+
+	term.received <- models.TerminalFrame{Type: models.TerminalFrameInput, Data: "ls\n"}
+	if input := <-agent.sent; input.Type != models.AgentFrameTerminalInput || input.SessionID != session.ID || input.Data != "ls\n" {
+		t.Fatalf("expected input pushed on the agent channel, got %+v", input)
+	}
+	if ack := <-term.sent; ack.Type != models.TerminalFrameInputAck || ack.Seq != 1 {
+		t.Fatalf("expected input ack with seq 1, got %+v", ack)
+	}
+	term.received <- models.TerminalFrame{Type: models.TerminalFrameResize, Rows: 50, Cols: 200}
+	if resize := <-agent.sent; resize.Type != models.AgentFrameTerminalResize || resize.Rows != 50 || resize.Cols != 200 {
+		t.Fatalf("expected resize pushed on the agent channel, got %+v", resize)
+	}
+	if len(repo.agentCommands) != 1 {
+		t.Fatalf("expected input and resize to skip the command queue, got %d commands", len(repo.agentCommands))
+	}
+
+	if _, err := svc.CloseTerminalSession(ctx, "user-1", session.ID); err != nil {
+		t.Fatalf("close terminal session: %v", err)
+	}
+	if closed := <-term.sent; closed.Type != models.TerminalFrameClosed || closed.Status != models.TerminalSessionClosed {
+		t.Fatalf("expected closed frame, got %+v", closed)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected stream to end cleanly, got %v", err)
+	}
+	svc.terminals.flush()
+	if len(repo.terminalInput) != 1 || repo.terminalInput[0].Seq != 1 || repo.terminalInput[0].Data != "ls\n" {
+		t.Fatalf("expected input recorded for audit, got %+v", repo.terminalInput)
+	}
+	if len(repo.terminalOut) != 3 || repo.terminalOut[2].Seq != 3 {
+		t.Fatalf("expected all output written, got %+v", repo.terminalOut)
+	}
+
+	replay := terminalConnStub{sent: make(chan models.TerminalFrame, 8), received: make(chan models.TerminalFrame)}
+	if err := svc.ServeTerminalStream(ctx, "user-1", session.ID, 2, replay); err != nil {
+		t.Fatalf("replay closed session: %v", err)
+	}
+	if frame := <-replay.sent; frame.Type != models.TerminalFrameOutput || frame.Seq != 3 {
+		t.Fatalf("expected stored output replayed, got %+v", frame)
+	}
+	if frame := <-replay.sent; frame.Type != models.TerminalFrameClosed {
+		t.Fatalf("expected closed frame after replay, got %+v", frame)
+	}
+	if idle := svc.terminals.idle(); len(idle) != 0 {
+		t.Fatalf("expected the ended session dropped after its last viewer left, got %v", idle)
+	}
+	close(agent.received)
+	<-agentDone
+}
+
+func TestTerminalSeqsStayDistinctAcrossInstances(t *testing.T) {
+	repo := &repoStub{vm: models.VM{ID: "vm-1", UserID: "user-1", ProviderID: "provider-1", Status: models.VMStatusRunning}}
+	opts := Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}}
+	first := NewResourceService(repo, cgStub{}, opts)
+	second := NewResourceService(repo, cgStub{}, opts)
+	ctx := context.Background()
+	session, err := first.CreateTerminalSession(ctx, "user-1", "vm-1", 24, 80)
+	if err != nil {
+		t.Fatalf("create terminal session: %v", err)
+	}
+
+	var seqs []int64
+	for _, svc := range []*ResourceService{first, first, second, first} {
+		chunk, err := svc.RecordTerminalOutput(ctx, "provider-1", session.ID, "out\n")
+		if err != nil {
+			t.Fatalf("record terminal output: %v", err)
+		}
+		seqs = append(seqs, chunk.Seq)
+	}
+	if want := []int64{1, 2, terminalSeqBlock + 1, 3}; !slices.Equal(seqs, want) {
+		t.Fatalf("expected seqs %v from separate blocks, got %v", want, seqs)
+	}
+	// Once the agent's channel moves, the old instance continues above the
+	// seqs handed out elsewhere.
+	first.terminals.forgetProvider("provider-1")
+	chunk, err := first.RecordTerminalOutput(ctx, "provider-1", session.ID, "out\n")
+	if err != nil || chunk.Seq != 2*terminalSeqBlock+1 {
+		t.Fatalf("expected seq %d after the channel moved, got %+v %v", 2*terminalSeqBlock+1, chunk, err)
+	}
+	first.terminals.flush()
+	second.terminals.flush()
+	if len(repo.terminalOut) != 5 {
+		t.Fatalf("expected every chunk written, got %+v", repo.terminalOut)
+	}
+
+	// A session closed on one instance is swept from the others.
+	if _, err := second.CloseTerminalSession(ctx, "user-1", session.ID); err != nil {
+		t.Fatalf("close terminal session: %v", err)
+	}
+	if idle := first.terminals.idle(); len(idle) != 1 {
+		t.Fatalf("expected the first instance to still hold the session, got %v", idle)
+	}
+	if err := first.sweepTerminalStreams(ctx); err != nil {
+		t.Fatalf("sweep terminal streams: %v", err)
+	}
+	if idle := first.terminals.idle(); len(idle) != 0 {
+		t.Fatalf("expected the closed session swept, got %v", idle)
+	}
+}
+
+func TestAgentCommandLeasesDeadlinesAndCancel(t *testing.T) {
+	repo := &repoStub{terminalByID: map[string]models.TerminalSession{
+		"term-1": {ID: "term-1", ProviderID: "p1", RenterUserID: "u1", Status: models.TerminalSessionQueued},
+	}}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+
+	if _, err := svc.QueueAgentCommand(ctx, models.AgentCommand{ProviderID: "p1", Command: models.AgentCommandStatus, TimeoutSeconds: 1}); err == nil {
+		t.Fatal("expected too short a timeout to be rejected")
+	}
+	cmd, err := svc.QueueAgentCommand(ctx, models.AgentCommand{ProviderID: "p1", Command: models.AgentCommandStatus, MaxAttempts: 2, RequestedBy: "admin-1"})
+	if err != nil {
+		t.Fatalf("queue command: %v", err)
+	}
+	if cmd.TimeoutSeconds != 300 || cmd.DeadlineAt.IsZero() {
+		t.Fatalf("expected default deadline, got %+v", cmd)
+	}
+
+	// An unacknowledged push is queued again under a new seq, then times out
+	// once its attempts are used up.
+	if _, err := repo.ClaimAgentCommands(ctx, "p1", 0, agentCommandLease, 10); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	afterLease := time.Now().UTC().Add(agentCommandLease + time.Second)
+	if err := svc.SweepAgentCommands(ctx, afterLease); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if repo.agentCommands[0].Status != models.AgentCommandQueued || repo.agentCommands[0].Seq <= cmd.Seq {
+		t.Fatalf("expected command requeued under a new seq, got %+v", repo.agentCommands[0])
+	}
+	if _, err := repo.ClaimAgentCommands(ctx, "p1", 0, agentCommandLease, 10); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err := svc.SweepAgentCommands(ctx, afterLease.Add(agentCommandLease)); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if repo.agentCommands[0].Status != models.AgentCommandTimedOut || repo.agentCommands[0].Attempts != 2 {
+		t.Fatalf("expected timed out after 2 attempts, got %+v", repo.agentCommands[0])
+	}
+	if _, err := svc.CompleteAgentCommand(ctx, cmd.ID, "p1", models.AgentCommandSucceeded, "late"); err == nil {
+		t.Fatal("expected late result for a timed out command to be rejected")
+	}
+
+	// Acknowledged commands are only bound by their deadline.
+	acked, _ := svc.QueueAgentCommand(ctx, models.AgentCommand{ProviderID: "p1", Command: models.AgentCommandRestart, RequestedBy: "admin-1"})
+	if _, err := repo.ClaimAgentCommands(ctx, "p1", 0, agentCommandLease, 10); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if _, err := svc.AcknowledgeAgentCommand(ctx, acked.ID, "p2"); err == nil {
+		t.Fatal("expected another provider's ack to be rejected")
+	}
+	if _, err := svc.AcknowledgeAgentCommand(ctx, acked.ID, "p1"); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if err := svc.SweepAgentCommands(ctx, time.Now().UTC().Add(time.Minute)); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if got, _ := repo.GetAgentCommand(ctx, acked.ID); got.Status != models.AgentCommandRunning {
+		t.Fatalf("expected acknowledged command to keep running, got %+v", got)
+	}
+	if err := svc.SweepAgentCommands(ctx, time.Now().UTC().Add(6*time.Minute)); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if got, _ := repo.GetAgentCommand(ctx, acked.ID); got.Status != models.AgentCommandTimedOut {
+		t.Fatalf("expected deadline to time out the command, got %+v", got)
+	}
+
+	queued, _ := svc.QueueAgentCommand(ctx, models.AgentCommand{ProviderID: "p1", Command: models.AgentCommandStop, RequestedBy: "admin-1"})
+	if _, err := svc.CancelAgentCommand(ctx, "u2", false, queued.ID, ""); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected stranger cancel to be forbidden, got %v", err)
+	}
+	cancelled, err := svc.CancelAgentCommand(ctx, "admin-1", false, queued.ID, "wrong host")
+	if err != nil || cancelled.Status != models.AgentCommandCancelled || cancelled.ResultMessage != "cancelled by admin-1: wrong host" {
+		t.Fatalf("cancel: %+v %v", cancelled, err)
+	}
+	if _, err := svc.CancelAgentCommand(ctx, "admin-1", true, queued.ID, ""); err == nil {
+		t.Fatal("expected second cancel to fail")
+	}
+	if last := repo.agentCommands[len(repo.agentCommands)-1]; last.Command == models.AgentCommandCancel {
+		t.Fatalf("expected no agent cancel for a command never delivered, got %+v", last)
+	}
+	delivered, _ := svc.QueueAgentCommand(ctx, models.AgentCommand{ProviderID: "p1", Command: models.AgentCommandRestart, RequestedBy: "admin-1"})
+	if _, err := repo.ClaimAgentCommands(ctx, "p1", 0, agentCommandLease, 10); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if _, err := svc.CancelAgentCommand(ctx, "admin-1", true, delivered.ID, ""); err != nil {
+		t.Fatalf("cancel delivered command: %v", err)
+	}
+	if last := repo.agentCommands[len(repo.agentCommands)-1]; last.Command != models.AgentCommandCancel || last.Payload != delivered.ID || last.ProviderID != "p1" {
+		t.Fatalf("expected the agent told to cancel the delivered command, got %+v", last)
+	}
+
+	// A terminal whose open command dies after delivery is closed and the
+	// agent is told to tear down its shell.
+	open, err := svc.createAgentCommand(ctx, models.AgentCommand{ProviderID: "p1", SessionID: "term-1", Command: models.AgentCommandTerminalOpen, Status: models.AgentCommandQueued, RequestedBy: "u1"})
+	if err != nil {
+		t.Fatalf("queue terminal open: %v", err)
+	}
+	if _, err := repo.ClaimAgentCommands(ctx, "p1", 0, agentCommandLease, 10); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if _, err := svc.AcknowledgeAgentCommand(ctx, open.ID, "p1"); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if err := svc.SweepAgentCommands(ctx, time.Now().UTC().Add(3*time.Minute)); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if session := repo.terminalByID["term-1"]; session.Status != models.TerminalSessionClosed || session.ExitCode != 1 {
+		t.Fatalf("expected terminal closed with exit code 1, got %+v", session)
+	}
+	last := repo.agentCommands[len(repo.agentCommands)-1]
+	if last.Command != models.AgentCommandTerminalClose || last.SessionID != "term-1" || last.Status != models.AgentCommandQueued {
+		t.Fatalf("expected terminal_close queued, got %+v", last)
+	}
+	if audit := repo.terminalAudit[len(repo.terminalAudit)-1]; audit.EventType != "terminal_open_failed" {
+		t.Fatalf("expected terminal_open_failed audit, got %+v", audit)
+	}
+}
+
+type issuerStub struct{}
+
+func (issuerStub) Issue(providerID string, hostID string, credentialID string, _ time.Duration) (string, error) {
+	return providerID + "/" + hostID + "/" + credentialID, nil
+}
+
+func TestAgentEnrollmentRotationAndRevocation(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{Issuer: issuerStub{}, Providers: providerTypesStub{"p1": "donor"}}})
+	ctx := context.Background()
+
+	if _, err := svc.CreateAgentEnrollment(ctx, "p2", false, "p1", "rack-a"); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected enrolling for another provider to be forbidden, got %v", err)
+	}
+	if _, err := svc.CreateAgentEnrollment(ctx, "u9", false, "", "rack-a"); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected a user who is not a registered provider to be forbidden, got %v", err)
+	}
+	enrollment, err := svc.CreateAgentEnrollment(ctx, "p1", false, "", "rack-a")
+	if err != nil {
+		t.Fatalf("create enrollment: %v", err)
+	}
+	if enrollment.ProviderID != "p1" || !strings.HasPrefix(enrollment.Token, agentEnrollmentTokenPrefix) {
+		t.Fatalf("unexpected enrollment %+v", enrollment)
+	}
+	if err := svc.AuthorizeAgent(ctx, AgentIdentity{ProviderID: "p1"}, "p1"); err == nil {
+		t.Fatal("expected static agent tokens to be rejected")
+	}
+
+	cred, err := svc.EnrollAgent(ctx, enrollment.Token, "gpu-node-1", "", "")
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if _, err := svc.EnrollAgent(ctx, enrollment.Token, "gpu-node-2", "", ""); err == nil {
+		t.Fatal("expected enrollment token to be single use")
+	}
+	host := repo.agentHosts[cred.HostID]
+	if host.ProviderID != "p1" || host.Label != "rack-a" || !cred.RotateAfter.Before(cred.ExpiresAt) {
+		t.Fatalf("unexpected host %+v / credential %+v", host, cred)
+	}
+	first := AgentIdentity{ProviderID: "p1", HostID: host.ID, CredentialID: host.CredentialID}
+	if err := svc.AuthorizeAgent(ctx, first, "p1"); err != nil {
+		t.Fatalf("authorize enrolled host: %v", err)
+	}
+	if err := svc.AuthorizeAgent(ctx, first, "p2"); err == nil {
+		t.Fatal("expected host credential to be bound to its provider")
+	}
+
+	// The presented credential survives a rotation until the new one is used.
+	if _, err := svc.RotateAgentCredential(ctx, first, ""); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	second := AgentIdentity{ProviderID: "p1", HostID: host.ID, CredentialID: repo.agentHosts[host.ID].CredentialID}
+	if err := svc.AuthorizeAgent(ctx, first, "p1"); err != nil {
+		t.Fatalf("previous credential should still be valid: %v", err)
+	}
+	if err := svc.AuthorizeAgent(ctx, second, "p1"); err != nil {
+		t.Fatalf("authorize rotated credential: %v", err)
+	}
+	if err := svc.AuthorizeAgent(ctx, first, "p1"); err == nil {
+		t.Fatal("expected the old credential to retire once the new one is used")
+	}
+
+	// An unused new credential leaves the old one valid only for the grace period.
+	if _, err := svc.RotateAgentCredential(ctx, second, ""); err != nil {
+		t.Fatalf("rotate again: %v", err)
+	}
+	rotated := repo.agentHosts[host.ID]
+	rotated.RotatedAt = time.Now().UTC().Add(-11 * time.Minute)
+	repo.agentHosts[host.ID] = rotated
+	if err := svc.AuthorizeAgent(ctx, second, "p1"); err == nil {
+		t.Fatal("expected the old credential to expire after the grace period")
+	}
+
+	// Enrolling a second host replaces the first: channels, heartbeats and
+	// capacity are per provider.
+	replacement, err := svc.CreateAgentEnrollment(ctx, "p1", false, "", "rack-b")
+	if err != nil {
+		t.Fatalf("create second enrollment: %v", err)
+	}
+	replacementCred, err := svc.EnrollAgent(ctx, replacement.Token, "gpu-node-2", "", "")
+	if err != nil {
+		t.Fatalf("enroll second host: %v", err)
+	}
+	newHost := repo.agentHosts[replacementCred.HostID]
+	if err := svc.AuthorizeAgent(ctx, AgentIdentity{ProviderID: "p1", HostID: newHost.ID, CredentialID: newHost.CredentialID}, "p1"); err != nil {
+		t.Fatalf("authorize replacement host: %v", err)
+	}
+	second = AgentIdentity{ProviderID: "p1", HostID: host.ID, CredentialID: repo.agentHosts[host.ID].CredentialID}
+	if err := svc.AuthorizeAgent(ctx, second, "p1"); err == nil {
+		t.Fatal("expected the replaced host to be rejected")
+	}
+	if old := repo.agentHosts[host.ID]; old.Status != models.AgentHostRevoked || old.RevokedBy != "enrollment" {
+		t.Fatalf("expected the replaced host revoked by enrollment, got %+v", old)
+	}
+	host = newHost
+
+	if _, err := svc.RevokeAgentHost(ctx, "p2", false, host.ID); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected revoking another provider's host to be forbidden, got %v", err)
+	}
+	if _, err := svc.RevokeAgentHost(ctx, "p1", false, host.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	current := AgentIdentity{ProviderID: "p1", HostID: host.ID, CredentialID: repo.agentHosts[host.ID].CredentialID}
+	if err := svc.AuthorizeAgent(ctx, current, "p1"); err == nil {
+		t.Fatal("expected revoked host to be rejected")
+	}
+	if _, err := svc.RotateAgentCredential(ctx, current, ""); err == nil {
+		t.Fatal("expected revoked host to be unable to rotate")
+	}
+}
+
+func TestSignedHeartbeatsAndCapacityChallenges(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{Issuer: issuerStub{}, Providers: providerTypesStub{"p1": "donor"}}, Verification: VerificationPolicy{MaxMemoryMB: capacity.MinMemoryMB, PassesToClear: 2}})
+	ctx := context.Background()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	enrollment, err := svc.CreateAgentEnrollment(ctx, "p1", false, "", "")
+	if err != nil {
+		t.Fatalf("create enrollment: %v", err)
+	}
+	if _, err := svc.EnrollAgent(ctx, enrollment.Token, "gpu-node-1", "", "not-a-key"); err == nil {
+		t.Fatal("expected malformed public key to be rejected")
+	}
+	enrollment, _ = svc.CreateAgentEnrollment(ctx, "p1", false, "", "")
+	cred, err := svc.EnrollAgent(ctx, enrollment.Token, "gpu-node-1", "", base64.StdEncoding.EncodeToString(publicKey))
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+
+	heartbeat := func(at time.Time, sign bool) (models.HostResource, HeartbeatSignature) {
+		resource := models.HostResource{ProviderID: "p1", CPUFreeCores: 8, RAMFreeMB: 32768, GPUTotalUnits: 2, GPUFreeUnits: 2, GPUMemoryTotalMB: 160000, HeartbeatAt: at}
+		body, _ := json.Marshal(resource)
+		sig := HeartbeatSignature{HostID: cred.HostID, Body: body}
+		if sign {
+			sig.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, body))
+		}
+		return resource, sig
+	}
+	now := time.Now().UTC()
+	if err := svc.RecordHeartbeat(ctx, models.HostResource{ProviderID: "p1", HeartbeatAt: now}, HeartbeatSignature{}); err == nil {
+		t.Fatal("expected unsigned heartbeat from a keyed provider to be rejected")
+	}
+	resource, sig := heartbeat(now, false)
+	if err := svc.RecordHeartbeat(ctx, resource, sig); err == nil {
+		t.Fatal("expected heartbeat without signature to be rejected")
+	}
+	resource, sig = heartbeat(now, true)
+	sig.Body = append([]byte(nil), sig.Body...)
+	sig.Body[len(sig.Body)-2] ^= 1
+	if err := svc.RecordHeartbeat(ctx, resource, sig); err == nil {
+		t.Fatal("expected tampered heartbeat to be rejected")
+	}
+	resource, sig = heartbeat(now.Add(-10*time.Minute), true)
+	if err := svc.RecordHeartbeat(ctx, resource, sig); err == nil {
+		t.Fatal("expected stale heartbeat to be rejected")
+	}
+	resource, sig = heartbeat(now, true)
+	if err := svc.RecordHeartbeat(ctx, resource, sig); err != nil {
+		t.Fatalf("signed heartbeat: %v", err)
+	}
+	if !repo.resource.Signed {
+		t.Fatal("expected stored heartbeat to be marked signed")
+	}
+	if err := svc.RecordHeartbeat(ctx, resource, sig); err == nil {
+		t.Fatal("expected replayed heartbeat to be rejected")
+	}
+
+	answer := func(challenge models.CapacityChallenge, resp capacity.Response) models.CapacityChallenge {
+		resp.ChallengeID = challenge.ID
+		raw, _ := json.Marshal(resp)
+		if _, err := svc.CompleteAgentCommand(ctx, challenge.CommandID, "p1", models.AgentCommandSucceeded, string(raw)); err != nil {
+			t.Fatalf("complete challenge command: %v", err)
+		}
+		return repo.challenges[challenge.ID]
+	}
+
+	challenge, err := svc.IssueCapacityChallenge(ctx, "p1", models.CapacityChallengeCPUMemory, "admin")
+	if err != nil {
+		t.Fatalf("issue cpu challenge: %v", err)
+	}
+	if challenge.MemoryMB != capacity.MinMemoryMB || challenge.CommandID == "" {
+		t.Fatalf("unexpected challenge %+v", challenge)
+	}
+	digest, err := capacity.Solve(challenge.Nonce, challenge.MemoryMB, challenge.Passes)
+	if err != nil {
+		t.Fatalf("solve: %v", err)
+	}
+	if got := answer(challenge, capacity.Response{Digest: digest}); got.Status != models.CapacityChallengePassed {
+		t.Fatalf("expected correct digest to pass, got %+v", got)
+	}
+	if v, _ := svc.GetHostVerification(ctx, "p1"); v.Status != models.HostVerified {
+		t.Fatalf("expected provider to be verified, got %+v", v)
+	}
+
+	challenge, _ = svc.IssueCapacityChallenge(ctx, "p1", models.CapacityChallengeCPUMemory, "admin")
+	if got := answer(challenge, capacity.Response{Digest: digest}); got.Status != models.CapacityChallengeFailed {
+		t.Fatalf("expected reused digest to fail, got %+v", got)
+	}
+	if v, _ := svc.GetHostVerification(ctx, "p1"); v.Status != models.HostFlagged || v.FailedChallenges != 1 {
+		t.Fatalf("expected provider to be flagged, got %+v", v)
+	}
+
+	challenge, _ = svc.IssueCapacityChallenge(ctx, "p1", models.CapacityChallengeGPUEnum, "admin")
+	one := []capacity.GPUDevice{{Index: 0, UUID: "GPU-a", Name: "A100", MemoryMB: 81920}}
+	if got := answer(challenge, capacity.Response{GPUs: one}); got.Status != models.CapacityChallengeFailed {
+		t.Fatalf("expected fewer GPUs than claimed to fail, got %+v", got)
+	}
+	two := append(one, capacity.GPUDevice{Index: 1, UUID: "GPU-b", Name: "A100", MemoryMB: 81920})
+	for i := 0; i < 2; i++ {
+		challenge, _ = svc.IssueCapacityChallenge(ctx, "p1", models.CapacityChallengeGPUEnum, "admin")
+		if got := answer(challenge, capacity.Response{GPUs: two}); got.Status != models.CapacityChallengePassed {
+			t.Fatalf("expected matching GPUs to pass, got %+v", got)
+		}
+	}
+	if v, _ := svc.GetHostVerification(ctx, "p1"); v.Status != models.HostVerified {
+		t.Fatalf("expected flag to clear after consecutive passes, got %+v", v)
+	}
+	if repo.gpuDevices["GPU-b"].ProviderID != "p1" {
+		t.Fatal("expected enumerated GPUs to be registered")
 	}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
 
-	_, err := svc.Allocate(context.Background(), models.Allocation{
-		ProviderID: "p1",
-		CPUCores:   1,
-		RAMMB:      512,
-		GPUUnits:   0,
-	})
-	if err == nil {
-		t.Fatal("expected invalid heartbeat value error")
+	// Another provider reporting the same devices is caught.
+	repo.resource = models.HostResource{ProviderID: "p2", GPUTotalUnits: 1}
+	challenge, _ = svc.IssueCapacityChallenge(ctx, "p2", models.CapacityChallengeGPUEnum, "admin")
+	raw, _ := json.Marshal(capacity.Response{ChallengeID: challenge.ID, GPUs: one})
+	if _, err := svc.CompleteAgentCommand(ctx, challenge.CommandID, "p2", models.AgentCommandSucceeded, string(raw)); err != nil {
+		t.Fatalf("complete challenge command: %v", err)
+	}
+	if v, _ := svc.GetHostVerification(ctx, "p2"); v.Status != models.HostFlagged {
+		t.Fatalf("expected provider reusing another's GPU to be flagged, got %+v", v)
+	}
+
+	repo.sharedOffers = []models.SharedInventoryOffer{
+		{ID: "o1", ProviderID: "p2", Status: models.SharedInventoryStatusActive},
+		{ID: "o2", ProviderID: "p3", Status: models.SharedInventoryStatusActive},
+		{ID: "o3", ProviderID: "p1", Status: models.SharedInventoryStatusActive},
+	}
+	offers, err := svc.ListSharedInventoryOffers(ctx, "", "")
+	if err != nil {
+		t.Fatalf("list offers: %v", err)
+	}
+	got := []string{offers[0].ID, offers[1].ID, offers[2].ID}
+	if !slices.Equal(got, []string{"o3", "o2", "o1"}) || offers[2].ProviderVerification != models.HostFlagged {
+		t.Fatalf("expected verified, unverified, flagged order, got %v", got)
 	}
 }
 
-func TestVMLifecycle(t *testing.T) {
+func TestUnsignedHeartbeatsAndFlaggedProviders(t *testing.T) {
 	repo := &repoStub{}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{Issuer: issuerStub{}, Providers: providerTypesStub{"p1": "donor"}, AllowStaticTokens: true}})
 	ctx := context.Background()
+	now := time.Now().UTC()
 
-	vm, err := svc.CreateVM(ctx, models.VM{
-		UserID:      "u1",
-		ProviderID:  "p1",
-		Name:        "vm-alpha",
-		Template:    "fastpanel",
-		OSName:      "Ubuntu 22.04",
-		CPUCores:    4,
-		RAMMB:       8192,
-		GPUUnits:    1,
-		NetworkMbps: 500,
-	})
+	enrollment, err := svc.CreateAgentEnrollment(ctx, "p1", false, "", "")
 	if err != nil {
-		t.Fatalf("create vm: %v", err)
+		t.Fatalf("create enrollment: %v", err)
 	}
-	if vm.Status != models.VMStatusRunning {
-		t.Fatalf("expected running after provision, got %s", vm.Status)
+	cred, err := svc.EnrollAgent(ctx, enrollment.Token, "cpu-node-1", "", "")
+	if err != nil {
+		t.Fatalf("enroll without key: %v", err)
 	}
-	if vm.Region != "any" {
-		t.Fatalf("expected default region any, got %s", vm.Region)
+	resource := models.HostResource{ProviderID: "p1", CPUFreeCores: 8, RAMFreeMB: 32768, HeartbeatAt: now}
+	if err := svc.RecordHeartbeat(ctx, resource, HeartbeatSignature{HostID: cred.HostID}); err == nil {
+		t.Fatal("expected unsigned heartbeat from an enrolled host without a key to be rejected")
 	}
-	if vm.CloudType != "secure" {
-		t.Fatalf("expected default cloud type secure, got %s", vm.CloudType)
+	if err := svc.UpdateHeartbeat(ctx, resource); err != nil || repo.resource.ProviderID != "" {
+		t.Fatalf("expected kafka heartbeat for an enrolled provider to be dropped, got %v %+v", err, repo.resource)
 	}
-	if vm.AvailabilityTier != "low" {
-		t.Fatalf("expected default availability low, got %s", vm.AvailabilityTier)
+
+	// A static token cannot sign, so its provider is never left verified.
+	if _, err := repo.UpsertHostVerification(ctx, models.HostVerification{ProviderID: "p2", Status: models.HostVerified}); err != nil {
+		t.Fatalf("seed verification: %v", err)
 	}
-	if vm.VCPU != vm.CPUCores {
-		t.Fatalf("expected vcpu mirror cpu_cores, got %d", vm.VCPU)
+	resource.ProviderID = "p2"
+	if err := svc.RecordHeartbeat(ctx, resource, HeartbeatSignature{}); err != nil {
+		t.Fatalf("static token heartbeat: %v", err)
+	}
+	if repo.resource.Signed {
+		t.Fatal("expected static token heartbeat to be stored unsigned")
+	}
+	if v, _ := svc.GetHostVerification(ctx, "p2"); v.Status != models.HostUnverified || v.Reason != unsignedHeartbeatReason {
+		t.Fatalf("expected unsigned provider to be unverified, got %+v", v)
+	}
+	svc.recordVerification(ctx, "p2", "")
+	if v, _ := svc.GetHostVerification(ctx, "p2"); v.Status != models.HostUnverified {
+		t.Fatalf("expected a passed challenge not to verify an unsigned provider, got %+v", v)
+	}
+	if _, err := svc.Allocate(ctx, models.Allocation{ProviderID: "p2", CPUCores: 2, RAMMB: 1024}); err != nil {
+		t.Fatalf("allocate on unverified provider: %v", err)
 	}
 
-	vm, err = svc.StopVM(ctx, vm.ID)
-	if err != nil {
-		t.Fatalf("stop vm: %v", err)
+	svc.recordVerification(ctx, "p2", "wrong digest for 64 MB workload")
+	if _, err := svc.Allocate(ctx, models.Allocation{ProviderID: "p2", CPUCores: 2, RAMMB: 1024}); err == nil || !strings.Contains(err.Error(), "flagged") {
+		t.Fatalf("expected allocation on a flagged provider to be refused, got %v", err)
 	}
-	if vm.Status != models.VMStatusStopped {
-		t.Fatalf("expected stopped, got %s", vm.Status)
+	if len(repo.allocations) != 1 {
+		t.Fatalf("expected only the first allocation to be stored, got %d", len(repo.allocations))
 	}
+}
+
+func TestExecPolicyOutputAndResults(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
 
-	vm, err = svc.StartVM(ctx, vm.ID)
+	req := ExecRequest{ProviderID: "p1", Argv: []string{"nvidia-smi", "-L"}, Reason: "gpu triage"}
+	if _, err := svc.RunExec(ctx, "ops-1", req); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+		t.Fatalf("expected exec to be disabled without a policy, got %v", err)
+	}
+	if len(repo.execRuns) != 1 {
+		t.Fatalf("expected rejected request to be recorded, got %d runs", len(repo.execRuns))
+	}
+	if _, err := svc.UpdateExecPolicy(ctx, "admin", models.ExecPolicy{ProviderID: "p1", Enabled: true, RunAs: "root"}); err == nil {
+		t.Fatal("expected root run_as to be rejected")
+	}
+	policy, err := svc.UpdateExecPolicy(ctx, "admin", models.ExecPolicy{ProviderID: "p1", Enabled: true, AllowedCommands: []string{"nvidia-smi", " nvidia-smi", "/usr/bin/df"}, MaxTimeoutSeconds: 120})
 	if err != nil {
-		t.Fatalf("start vm: %v", err)
+		t.Fatalf("update policy: %v", err)
 	}
-	if vm.Status != models.VMStatusRunning {
-		t.Fatalf("expected running, got %s", vm.Status)
+	if policy.RunAs != "nobody" || len(policy.AllowedCommands) != 2 {
+		t.Fatalf("unexpected policy %+v", policy)
 	}
 
-	vm, err = svc.TerminateVM(ctx, vm.ID)
+	for _, bad := range []ExecRequest{
+		{ProviderID: "p1", Script: "uptime", Argv: []string{"uptime"}},
+		{ProviderID: "p1", Argv: []string{"nvidia-smi"}, WorkDir: "tmp/../etc"},
+		{ProviderID: "p1", Argv: []string{"nvidia-smi"}, Env: map[string]string{"LD_PRELOAD": "/tmp/x.so"}},
+	} {
+		if _, err := svc.RunExec(ctx, "ops-1", bad); err == nil || strings.HasPrefix(err.Error(), "forbidden") {
+			t.Fatalf("expected %+v to be invalid, got %v", bad, err)
+		}
+	}
+	for _, denied := range []ExecRequest{
+		{ProviderID: "p1", Script: "cat /etc/shadow"},
+		{ProviderID: "p1", Argv: []string{"/usr/bin/nvidia-smi"}},
+		{ProviderID: "p1", Argv: []string{"nvidia-smi"}, TimeoutSeconds: 600},
+	} {
+		if _, err := svc.RunExec(ctx, "ops-1", denied); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+			t.Fatalf("expected %+v to be denied by policy, got %v", denied, err)
+		}
+	}
+
+	req.Env = map[string]string{"CUDA_VISIBLE_DEVICES": "0"}
+	run, err := svc.RunExec(ctx, "ops-1", req)
 	if err != nil {
-		t.Fatalf("terminate vm: %v", err)
+		t.Fatalf("run exec: %v", err)
 	}
-	if vm.Status != models.VMStatusTerminated {
-		t.Fatalf("expected terminated, got %s", vm.Status)
+	if run.RunAs != "nobody" || run.TimeoutSeconds != 60 || !slices.Equal(run.EnvKeys, []string{"CUDA_VISIBLE_DEVICES"}) {
+		t.Fatalf("unexpected run %+v", run)
+	}
+	cmd, err := repo.GetAgentCommand(ctx, run.CommandID)
+	if err != nil || cmd.Command != models.AgentCommandExec || cmd.TimeoutSeconds != 120 || cmd.MaxAttempts != 1 {
+		t.Fatalf("expected a single attempt exec command with slack in its deadline, got %+v (%v)", cmd, err)
+	}
+	var payload agentexec.Request
+	if err := json.Unmarshal([]byte(cmd.Payload), &payload); err != nil || payload.ExecID != run.ID || payload.Env["CUDA_VISIBLE_DEVICES"] != "0" {
+		t.Fatalf("unexpected payload %s (%v)", cmd.Payload, err)
 	}
-}
 
-func TestCreateKubernetesCluster(t *testing.T) {
-	repo := &repoStub{k8sByID: map[string]models.KubernetesCluster{}}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
+	if err := svc.RecordExecOutput(ctx, "p2", run.ID, "stdout", "x"); err == nil {
+		t.Fatal("expected output from another provider to be rejected")
+	}
+	if err := svc.RecordExecOutput(ctx, "p1", run.ID, "stdout", "GPU 0: A100\n"); err != nil {
+		t.Fatalf("record stdout: %v", err)
+	}
+	if err := svc.RecordExecOutput(ctx, "p1", run.ID, "stderr", "warning\n"); err != nil {
+		t.Fatalf("record stderr: %v", err)
+	}
+	result, _ := json.Marshal(agentexec.Result{ExitCode: 3})
+	if _, err := svc.CompleteAgentCommand(ctx, run.CommandID, "p1", models.AgentCommandFailed, string(result)); err != nil {
+		t.Fatalf("complete command: %v", err)
+	}
+	got, _ := svc.GetExecRun(ctx, run.ID)
+	if got.Status != models.ExecRunFailed || got.ExitCode != 3 || got.Stdout != "GPU 0: A100\n" || got.Stderr != "warning\n" {
+		t.Fatalf("unexpected finished run %+v", got)
+	}
+	if err := svc.RecordExecOutput(ctx, "p1", run.ID, "stdout", "late"); err == nil {
+		t.Fatal("expected output after completion to be rejected")
+	}
 
-	cluster, err := svc.CreateKubernetesCluster(context.Background(), models.KubernetesCluster{
-		UserID:     "u1",
-		Name:       "core-cluster",
-		ProviderID: "p1",
-		NodeCount:  3,
-		NodeType:   "shared-cpu",
-		K8sVersion: "1.30",
-	})
-	if err != nil {
-		t.Fatalf("create cluster: %v", err)
+	run, _ = svc.RunExec(ctx, "ops-1", ExecRequest{ProviderID: "p1", Argv: []string{"/usr/bin/df"}})
+	if _, err := svc.CancelAgentCommand(ctx, "ops-1", false, run.CommandID, "wrong host"); err != nil {
+		t.Fatalf("cancel: %v", err)
 	}
-	if cluster.Status != models.ClusterStatusRunning {
-		t.Fatalf("expected running cluster, got %s", cluster.Status)
+	if got, _ := svc.GetExecRun(ctx, run.ID); got.Status != models.ExecRunCancelled {
+		t.Fatalf("expected cancelled run, got %+v", got)
 	}
-	if cluster.Endpoint == "" {
-		t.Fatal("expected endpoint to be set")
+	runs, _ := svc.ListExecRuns(ctx, "p1", "ops-1", 0)
+	if len(runs) != 6 {
+		t.Fatalf("expected 4 rejected and 2 queued runs in the audit trail, got %d", len(runs))
 	}
 }
 
-func TestSharedInventoryReserveFlow(t *testing.T) {
-	repo := &repoStub{}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
+func TestFileTransferUploadDownloadAndAccess(t *testing.T) {
+	repo := &repoStub{vm: models.VM{ID: "vm-1", ProviderID: "p1", UserID: "owner"}}
+	repo.pods = []models.Pod{
+		{ID: "pod-1", ProviderID: "p1", UserID: "owner", Backend: models.PodBackendLocal},
+		{ID: "pod-2", ProviderID: "p1", UserID: "owner", Backend: models.PodBackendRunPod},
+	}
+	repo.shareGrants = []models.ShareGrant{{ID: "g1", ResourceType: "pod", ResourceID: "pod-1", GranteeUserID: "reader", AccessLevel: models.SharedAccessRead, Status: models.ShareGrantActive}}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
 
-	offer, err := svc.UpsertSharedInventoryOffer(context.Background(), models.SharedInventoryOffer{
-		ProviderID:   "p1",
-		ResourceType: "gpu",
-		Title:        "Shared H100",
-		Description:  "8x H100 pool",
-		CPUCores:     32,
-		RAMMB:        131072,
-		GPUUnits:     8,
-		NetworkMbps:  20000,
-		Quantity:     8,
-		AvailableQty: 8,
-		PriceHourly:  4.2,
-		CreatedBy:    "owner-1",
-	})
-	if err != nil {
-		t.Fatalf("upsert shared offer: %v", err)
+	content := []byte(strings.Repeat("weights: fp16\n", filetransfer.ChunkSize/10))
+	digest := sha256.Sum256(content)
+	upload := FileTransferRequest{ResourceID: "pod-1", Direction: models.FileTransferUpload, Path: "configs/model.yaml", Size: int64(len(content)), SHA256: hex.EncodeToString(digest[:])}
+	for _, user := range []string{"stranger", "reader"} {
+		if _, err := svc.StartFileTransfer(ctx, user, upload); err == nil || !strings.HasPrefix(err.Error(), "forbidden") {
+			t.Fatalf("expected %s to need terminal access, got %v", user, err)
+		}
 	}
-	if offer.ID == "" {
-		t.Fatal("expected non-empty offer id")
+	// Only local pods have the sandbox mounted.
+	for _, resourceID := range []string{"vm-1", "pod-2"} {
+		elsewhere := upload
+		elsewhere.ResourceID = resourceID
+		if _, err := svc.StartFileTransfer(ctx, "owner", elsewhere); err == nil || !strings.Contains(err.Error(), "only available for local pods") {
+			t.Fatalf("expected a transfer to %s to be refused, got %v", resourceID, err)
+		}
+	}
+	escape := upload
+	escape.Path = "../../etc/cron.d/x"
+	if _, err := svc.StartFileTransfer(ctx, "owner", escape); err == nil {
+		t.Fatal("expected a path outside the sandbox to be rejected")
+	}
+	tooBig := upload
+	tooBig.Size = maxFileTransferBytes + 1
+	if _, err := svc.StartFileTransfer(ctx, "owner", tooBig); err == nil {
+		t.Fatal("expected the size limit to be enforced")
 	}
 
-	reserved, err := svc.ReserveSharedInventoryOffer(context.Background(), offer.ID, 3)
+	transfer, err := svc.StartFileTransfer(ctx, "owner", upload)
 	if err != nil {
-		t.Fatalf("reserve shared offer: %v", err)
+		t.Fatalf("start upload: %v", err)
 	}
-	if reserved.AvailableQty != 5 {
-		t.Fatalf("expected available qty 5, got %d", reserved.AvailableQty)
+	if _, err := svc.WriteFileTransferChunk(ctx, "stranger", false, transfer.ID, 0, content[:10]); err == nil {
+		t.Fatal("expected another user's chunk to be rejected")
+	}
+	first := content[:filetransfer.ChunkSize]
+	if _, err := svc.WriteFileTransferChunk(ctx, "owner", false, transfer.ID, 5, first); err == nil {
+		t.Fatal("expected an out of order chunk to be rejected")
+	}
+	if transfer, err = svc.WriteFileTransferChunk(ctx, "owner", false, transfer.ID, 0, first); err != nil || transfer.StoredBytes != int64(len(first)) {
+		t.Fatalf("first chunk: %+v %v", transfer, err)
+	}
+	if transfer, err = svc.WriteFileTransferChunk(ctx, "owner", false, transfer.ID, transfer.StoredBytes, content[len(first):]); err != nil {
+		t.Fatalf("last chunk: %v", err)
+	}
+	if transfer.Status != models.FileTransferPushing || transfer.CommandID == "" {
+		t.Fatalf("expected the upload to be pushed to the host, got %+v", transfer)
 	}
-}
 
-func TestAgentLogRecord(t *testing.T) {
-	repo := &repoStub{}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
+	lastWrite := func() (models.AgentCommand, filetransfer.WriteRequest) {
+		cmd := repo.agentCommands[len(repo.agentCommands)-1]
+		var req filetransfer.WriteRequest
+		if err := json.Unmarshal([]byte(cmd.Payload), &req); err != nil {
+			t.Fatalf("write payload: %v", err)
+		}
+		return cmd, req
+	}
+	complete := func(cmd models.AgentCommand, status models.AgentCommandState, result any) {
+		raw, _ := json.Marshal(result)
+		if _, err := svc.CompleteAgentCommand(ctx, cmd.ID, "p1", status, string(raw)); err != nil {
+			t.Fatalf("complete %s: %v", cmd.Command, err)
+		}
+	}
+	cmd, req := lastWrite()
+	if cmd.Command != models.AgentCommandFileWrite || req.Offset != 0 || len(req.Data) != len(first) || req.SHA256 != "" || req.ResourceID != "pod-1" {
+		t.Fatalf("unexpected first write %+v", req)
+	}
+	complete(cmd, models.AgentCommandSucceeded, filetransfer.WriteResult{Written: int64(len(first))})
+	cmd, req = lastWrite()
+	if req.Offset != int64(len(first)) || req.SHA256 != upload.SHA256 {
+		t.Fatalf("expected the final chunk to carry the checksum, got offset %d sha %q", req.Offset, req.SHA256)
+	}
+	complete(cmd, models.AgentCommandFailed, filetransfer.WriteResult{Written: int64(len(first)), Error: "no space left on device"})
+	if transfer, _ = svc.GetFileTransfer(ctx, "owner", false, transfer.ID); transfer.Status != models.FileTransferFailed || transfer.HostBytes != int64(len(first)) {
+		t.Fatalf("expected a failed transfer that remembers host progress, got %+v", transfer)
+	}
+	if transfer, err = svc.ResumeFileTransfer(ctx, "owner", false, transfer.ID); err != nil || transfer.Status != models.FileTransferPushing {
+		t.Fatalf("resume: %+v %v", transfer, err)
+	}
+	cmd, req = lastWrite()
+	if req.Offset != int64(len(first)) {
+		t.Fatalf("expected the resumed push to continue at %d, got %d", len(first), req.Offset)
+	}
+	complete(cmd, models.AgentCommandSucceeded, filetransfer.WriteResult{Written: int64(len(content)), Complete: true})
+	if transfer, _ = svc.GetFileTransfer(ctx, "owner", false, transfer.ID); transfer.Status != models.FileTransferCompleted || len(repo.fileChunks[transfer.ID]) != 0 {
+		t.Fatalf("expected a completed upload without stored data, got %+v", transfer)
+	}
 
-	entry, err := svc.RecordAgentLog(context.Background(), models.AgentLog{
-		ProviderID: "p1",
-		ResourceID: "vm-1",
-		Message:    "heartbeat ok",
-	})
-	if err != nil {
-		t.Fatalf("record agent log: %v", err)
+	download, err := svc.StartFileTransfer(ctx, "owner", FileTransferRequest{ResourceID: "pod-1", Direction: models.FileTransferDownload, Path: "crash/core.1"})
+	if err != nil || download.Status != models.FileTransferPulling {
+		t.Fatalf("start download: %+v %v", download, err)
 	}
-	if entry.Level != models.AgentLogInfo {
-		t.Fatalf("expected default level info, got %s", entry.Level)
+	readCmd := repo.agentCommands[len(repo.agentCommands)-1]
+	if readCmd.Command != models.AgentCommandFileRead || readCmd.ID != download.CommandID {
+		t.Fatalf("unexpected read command %+v", readCmd)
+	}
+	if err := svc.RecordFileChunk(ctx, "p2", download.ID, 0, content[:10]); err == nil {
+		t.Fatal("expected a chunk from another provider to be rejected")
+	}
+	if err := svc.RecordFileChunk(ctx, "p1", download.ID, 0, first); err != nil {
+		t.Fatalf("record chunk: %v", err)
+	}
+	// The stream broke after the first chunk; resuming pulls the rest.
+	complete(readCmd, models.AgentCommandSucceeded, filetransfer.ReadResult{Size: int64(len(content)), SHA256: upload.SHA256})
+	if download, _ = svc.GetFileTransfer(ctx, "owner", false, download.ID); download.Status != models.FileTransferFailed {
+		t.Fatalf("expected an incomplete download to fail, got %+v", download)
+	}
+	if download, err = svc.ResumeFileTransfer(ctx, "owner", false, download.ID); err != nil {
+		t.Fatalf("resume download: %v", err)
+	}
+	readCmd = repo.agentCommands[len(repo.agentCommands)-1]
+	var readReq filetransfer.ReadRequest
+	_ = json.Unmarshal([]byte(readCmd.Payload), &readReq)
+	if readReq.Offset != int64(len(first)) || readReq.MaxBytes != maxFileTransferBytes {
+		t.Fatalf("unexpected resumed read %+v", readReq)
+	}
+	if err := svc.RecordFileChunk(ctx, "p1", download.ID, readReq.Offset, content[len(first):]); err != nil {
+		t.Fatalf("record chunk: %v", err)
+	}
+	complete(readCmd, models.AgentCommandSucceeded, filetransfer.ReadResult{Size: int64(len(content)), SHA256: upload.SHA256})
+	download, chunks, err := svc.ReadFileTransferContent(ctx, "owner", false, download.ID, 100, 1)
+	if err != nil || download.Status != models.FileTransferCompleted || len(chunks) != 1 {
+		t.Fatalf("read content: %+v %d chunks %v", download, len(chunks), err)
+	}
+	fetched := chunks[0].Data[100-chunks[0].Offset:]
+	next := chunks[0].Offset + int64(len(chunks[0].Data))
+	if _, chunks, err = svc.ReadFileTransferContent(ctx, "owner", false, download.ID, next, 1); err != nil || len(chunks) != 1 || chunks[0].Offset != next {
+		t.Fatalf("expected the next page from %d, got %+v %v", next, chunks, err)
+	}
+	if fetched = append(fetched, chunks[0].Data...); string(fetched) != string(content[100:]) {
+		t.Fatal("expected the content from the requested offset")
+	}
+
+	if err := svc.ExpireFileTransfers(ctx, time.Now().UTC().Add(fileTransferRetention+time.Minute)); err != nil {
+		t.Fatalf("expire: %v", err)
+	}
+	if download, _ = svc.GetFileTransfer(ctx, "owner", false, download.ID); download.Status != models.FileTransferExpired || len(repo.fileChunks[download.ID]) != 0 {
+		t.Fatalf("expected the download to expire with its data, got %+v", download)
+	}
+	if transfer, _ = svc.GetFileTransfer(ctx, "owner", false, transfer.ID); transfer.Status != models.FileTransferCompleted {
+		t.Fatalf("expected a completed upload to stay completed, got %+v", transfer)
+	}
+	events := 0
+	for _, event := range repo.terminalAudit {
+		if event.SessionID == transfer.ID || event.SessionID == download.ID {
+			events++
+		}
+	}
+	if events < 4 {
+		t.Fatalf("expected transfers in the terminal audit trail, got %d events", events)
 	}
 }
 
-func TestAgentCommandLifecycle(t *testing.T) {
+func TestAgentUpdateCommandAndVersionInventory(t *testing.T) {
 	repo := &repoStub{}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}, AgentUpdates: AgentUpdatePolicy{ReleaseURL: "https://releases.example.com/{version}/hostagent-{os}-{arch}"}})
+	ctx := context.Background()
 
-	queued, err := svc.QueueAgentCommand(context.Background(), models.AgentCommand{
-		ProviderID:  "p1",
-		Command:     models.AgentCommandStatus,
-		RequestedBy: "admin-1",
-	})
+	for _, bad := range []AgentUpdateRequest{
+		{Version: "v1.2.0"},
+		{ProviderID: "p1", Version: "latest; rm -rf /"},
+		{ProviderID: "p1", Version: "v1.2.0", HealthTimeoutSeconds: 5},
+	} {
+		if _, err := svc.RequestAgentUpdate(ctx, "ops-1", bad); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+	cmd, err := svc.RequestAgentUpdate(ctx, "ops-1", AgentUpdateRequest{ProviderID: "p1", Version: "v1.2.0", HealthTimeoutSeconds: 300})
 	if err != nil {
-		t.Fatalf("queue agent command: %v", err)
+		t.Fatalf("request update: %v", err)
 	}
-	if queued.Status != models.AgentCommandQueued {
-		t.Fatalf("expected queued status, got %s", queued.Status)
+	var payload agentupdate.Request
+	if err := json.Unmarshal([]byte(cmd.Payload), &payload); err != nil {
+		t.Fatal(err)
 	}
-
-	claimed, err := svc.ClaimNextAgentCommand(context.Background(), "p1")
-	if err != nil {
-		t.Fatalf("claim agent command: %v", err)
+	if cmd.Command != models.AgentCommandAgentUpdate || payload.Version != "v1.2.0" || payload.HealthTimeoutSeconds != 300 || payload.URL != "https://releases.example.com/{version}/hostagent-{os}-{arch}" {
+		t.Fatalf("unexpected update command %+v", cmd)
 	}
-	if claimed.Status != models.AgentCommandRunning {
-		t.Fatalf("expected running status, got %s", claimed.Status)
+	if cmd.TimeoutSeconds <= payload.HealthTimeoutSeconds {
+		t.Fatalf("expected the command deadline to cover the health timeout, got %d", cmd.TimeoutSeconds)
 	}
 
-	completed, err := svc.CompleteAgentCommand(context.Background(), claimed.ID, "p1", models.AgentCommandSucceeded, "collector is running")
+	now := time.Now().UTC()
+	repo.hosts = []models.HostResource{
+		{ProviderID: "p1", AgentVersion: "v1.2.0", HeartbeatAt: now},
+		{ProviderID: "p2", AgentVersion: "v1.1.0", HeartbeatAt: now},
+		{ProviderID: "p3", AgentVersion: "v1.2.0", HeartbeatAt: now.Add(-time.Hour)},
+		{ProviderID: "p4", HeartbeatAt: now},
+	}
+	inventory, err := svc.AgentVersions(ctx)
 	if err != nil {
-		t.Fatalf("complete agent command: %v", err)
+		t.Fatalf("versions: %v", err)
 	}
-	if completed.Status != models.AgentCommandSucceeded {
-		t.Fatalf("expected succeeded status, got %s", completed.Status)
+	if len(inventory.Providers) != 4 || inventory.Providers[2].Online {
+		t.Fatalf("unexpected providers %+v", inventory.Providers)
+	}
+	if len(inventory.Versions) != 3 || inventory.Versions[0].AgentVersion != "v1.2.0" || inventory.Versions[0].Providers != 2 || inventory.Versions[0].Online != 1 {
+		t.Fatalf("unexpected version counts %+v", inventory.Versions)
 	}
 }
 
-func TestTerminalSessionLifecycle(t *testing.T) {
-	repo := &repoStub{
-		vm: models.VM{
-			ID:         "vm-1",
-			UserID:     "user-1",
-			ProviderID: "provider-1",
-			Status:     models.VMStatusRunning,
-		},
-	}
-	svc := NewResourceService(repo, cgStub{}, orchestratorStub{}, provisioningStub{}, 30*time.Second, 5, 5*time.Minute, "https://example.com/vmdaemon", "kafka:9092", "vmdaemon.events")
+type providerTypesStub map[string]string
+
+func (p providerTypesStub) ProviderTypes(context.Context) (map[string]string, error) {
+	return p, nil
+}
+
+func TestFleetRolloutWavesHaltAndResume(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}, Rollouts: RolloutPolicy{Providers: providerTypesStub{"p00": "donor", "p01": "internal"}}})
 	ctx := context.Background()
+	now := time.Now().UTC()
+	for i := 0; i < 10; i++ {
+		repo.hosts = append(repo.hosts, models.HostResource{ProviderID: fmt.Sprintf("p%02d", i), Region: "eu", Labels: []string{"gpu", "canary"}, HeartbeatAt: now})
+	}
+	repo.hosts = append(repo.hosts,
+		models.HostResource{ProviderID: "p10", Region: "us", Labels: []string{"gpu"}, HeartbeatAt: now},
+		models.HostResource{ProviderID: "p11", Region: "eu", Labels: []string{"gpu"}, HeartbeatAt: now.Add(-time.Hour)},
+	)
+	failurePct := 25
+	eu := models.RolloutSelector{Regions: []string{"eu"}, Labels: []string{"gpu"}}
 
-	session, err := svc.CreateTerminalSession(ctx, "user-1", "vm-1", 40, 140)
-	if err != nil {
-		t.Fatalf("create terminal session: %v", err)
+	for _, bad := range []RolloutRequest{
+		{Command: models.AgentCommandRestart},
+		{Command: models.AgentCommandExec, Selector: eu},
+		{Command: models.AgentCommandRestart, Selector: eu, Waves: []int{50, 10}},
+		{Command: models.AgentCommandRestart, Selector: eu, Waves: []int{10, 50}},
+		{Command: models.AgentCommandAgentUpdate, Selector: eu},
+		{Command: models.AgentCommandRestart, Selector: models.RolloutSelector{Regions: []string{"ap"}}},
+	} {
+		if _, err := svc.CreateRollout(ctx, "ops-1", bad); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
 	}
-	if session.ProviderID != "provider-1" {
-		t.Fatalf("expected provider-1, got %s", session.ProviderID)
+	typed, err := svc.CreateRollout(ctx, "ops-1", RolloutRequest{Command: models.AgentCommandStatus, Selector: models.RolloutSelector{ProviderTypes: []string{"donor"}}, Waves: []int{100}})
+	if err != nil || typed.Progress.Total != 1 || typed.Progress.Running != 1 {
+		t.Fatalf("expected one donor target, got %+v %v", typed, err)
 	}
-	if len(repo.agentCommands) == 0 || repo.agentCommands[0].Command != models.AgentCommandTerminalOpen {
-		t.Fatalf("expected terminal_open command queued")
+
+	openCommand := func(providerID string) models.AgentCommand {
+		t.Helper()
+		for _, cmd := range repo.agentCommands {
+			if cmd.ProviderID == providerID && cmd.Command == models.AgentCommandRestart && cmd.Status == models.AgentCommandQueued {
+				return cmd
+			}
+		}
+		t.Fatalf("no open restart command for %s", providerID)
+		return models.AgentCommand{}
+	}
+	finish := func(providerID string, status models.AgentCommandState) {
+		t.Helper()
+		cmd := openCommand(providerID)
+		if _, err := svc.CompleteAgentCommand(ctx, cmd.ID, providerID, status, string(status)); err != nil {
+			t.Fatalf("complete %s: %v", providerID, err)
+		}
+	}
+	running := func(rolloutID string) []string {
+		detail, err := svc.GetRollout(ctx, rolloutID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := []string{}
+		for _, target := range detail.Targets {
+			if target.Status == models.RolloutTargetRunning {
+				out = append(out, target.ProviderID)
+			}
+		}
+		return out
 	}
 
-	_, err = svc.WriteTerminalInput(ctx, "user-1", session.ID, "echo hello\n")
+	rollout, err := svc.CreateRollout(ctx, "ops-1", RolloutRequest{Command: models.AgentCommandRestart, Selector: eu, Waves: []int{10, 50, 100}, MaxConcurrency: 2, MaxFailurePct: &failurePct})
 	if err != nil {
-		t.Fatalf("write terminal input: %v", err)
+		t.Fatalf("create rollout: %v", err)
 	}
-	if len(repo.agentCommands) < 2 || repo.agentCommands[1].Command != models.AgentCommandTerminalData {
-		t.Fatalf("expected terminal_data command queued")
+	if rollout.Progress.Total != 10 || rollout.Detail == "" {
+		t.Fatalf("expected ten targets with the offline host skipped, got %+v", rollout)
+	}
+	if got := running(rollout.ID); len(got) != 1 || got[0] != "p00" || openCommand("p00").RolloutID != rollout.ID {
+		t.Fatalf("expected a single canary, got %v", got)
 	}
 
-	_, err = svc.RecordTerminalOutput(ctx, "provider-1", session.ID, "hello\n")
-	if err != nil {
-		t.Fatalf("record terminal output: %v", err)
+	finish("p00", models.AgentCommandSucceeded)
+	if got := running(rollout.ID); len(got) != 2 || got[0] != "p01" || got[1] != "p02" {
+		t.Fatalf("expected the second wave capped at two, got %v", got)
 	}
-	chunks, err := svc.ListTerminalOutput(ctx, "user-1", session.ID, 0, 20)
-	if err != nil {
-		t.Fatalf("list terminal output: %v", err)
+	finish("p01", models.AgentCommandFailed)
+	detail, _ := svc.GetRollout(ctx, rollout.ID)
+	if detail.Rollout.Status != models.RolloutHalted || detail.Rollout.CurrentWave != 1 {
+		t.Fatalf("expected a halt at 1 of 2 failed, got %+v", detail.Rollout)
 	}
-	if len(chunks) == 0 {
-		t.Fatal("expected terminal output chunk")
+	finish("p02", models.AgentCommandSucceeded)
+	if got := running(rollout.ID); len(got) != 0 {
+		t.Fatalf("expected no dispatch while halted, got %v", got)
 	}
 
-	_, err = svc.ResizeTerminalSession(ctx, "user-1", session.ID, 32, 120)
+	if _, err := svc.ResumeRollout(ctx, "ops-1", rollout.ID); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if got := running(rollout.ID); len(got) != 2 || got[0] != "p03" {
+		t.Fatalf("expected the rest of the wave after resume, got %v", got)
+	}
+	if _, err := svc.PauseRollout(ctx, "ops-1", rollout.ID); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	finish("p03", models.AgentCommandSucceeded)
+	finish("p04", models.AgentCommandSucceeded)
+	if got := running(rollout.ID); len(got) != 0 {
+		t.Fatalf("expected no dispatch while paused, got %v", got)
+	}
+	if _, err := svc.ResumeRollout(ctx, "ops-1", rollout.ID); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if got := running(rollout.ID); len(got) != 2 || got[0] != "p05" {
+		t.Fatalf("expected the last wave to open, got %v", got)
+	}
+
+	cancelled, err := svc.CancelRollout(ctx, "ops-1", rollout.ID)
 	if err != nil {
-		t.Fatalf("resize terminal session: %v", err)
+		t.Fatalf("cancel: %v", err)
 	}
-	if len(repo.agentCommands) < 3 || repo.agentCommands[2].Command != models.AgentCommandTerminalResize {
-		t.Fatalf("expected terminal_resize command queued")
+	if cancelled.Status != models.RolloutCancelled || cancelled.Progress.Cancelled != 5 || cancelled.Progress.Running != 0 || cancelled.Progress.Failed != 1 {
+		t.Fatalf("unexpected cancelled rollout %+v", cancelled)
 	}
+	for _, cmd := range repo.agentCommands {
+		if cmd.RolloutID == rollout.ID && cmd.Status == models.AgentCommandQueued {
+			t.Fatalf("expected open rollout commands to be cancelled, got %+v", cmd)
+		}
+	}
+	if _, err := svc.ResumeRollout(ctx, "ops-1", rollout.ID); err == nil {
+		t.Fatal("expected a cancelled rollout not to resume")
+	}
+}
 
-	_, err = svc.CloseTerminalSession(ctx, "user-1", session.ID)
+func TestRolloutCompletesAcrossEmptyWaves(t *testing.T) {
+	repo := &repoStub{}
+	svc := NewResourceService(repo, cgStub{}, Options{Orchestrator: orchestratorStub{}, Provisioning: provisioningStub{}, AgentAuth: AgentAuthPolicy{AllowStaticTokens: true}})
+	ctx := context.Background()
+	now := time.Now().UTC()
+	repo.hosts = []models.HostResource{{ProviderID: "p1", HeartbeatAt: now}, {ProviderID: "p2", HeartbeatAt: now}}
+	if _, err := svc.CreateRollout(ctx, "ops-1", RolloutRequest{Command: models.AgentCommandStatus, Selector: models.RolloutSelector{ProviderTypes: []string{"donor"}}}); err == nil {
+		t.Fatal("expected provider type targeting to need a directory")
+	}
+	tolerateAll := 100
+	rollout, err := svc.CreateRollout(ctx, "ops-1", RolloutRequest{Command: models.AgentCommandAgentUpdate, Version: "v1.3.0", Selector: models.RolloutSelector{All: true}, MaxFailurePct: &tolerateAll})
 	if err != nil {
-		t.Fatalf("close terminal session: %v", err)
+		t.Fatalf("create rollout: %v", err)
 	}
-	if len(repo.agentCommands) < 4 || repo.agentCommands[3].Command != models.AgentCommandTerminalClose {
-		t.Fatalf("expected terminal_close command queued")
+	// With two targets the 1% and 10% waves both hold only the canary.
+	for _, providerID := range []string{"p1", "p2"} {
+		var cmd models.AgentCommand
+		for _, item := range repo.agentCommands {
+			if item.ProviderID == providerID && item.RolloutID == rollout.ID {
+				cmd = item
+			}
+		}
+		if cmd.Command != models.AgentCommandAgentUpdate || !strings.Contains(cmd.Payload, "v1.3.0") {
+			t.Fatalf("expected an agent update for %s, got %+v", providerID, cmd)
+		}
+		if _, err := svc.CompleteAgentCommand(ctx, cmd.ID, providerID, models.AgentCommandFailed, "rolled back"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	detail, _ := svc.GetRollout(ctx, rollout.ID)
+	if detail.Rollout.Status != models.RolloutCompleted || detail.Rollout.Progress.Failed != 2 {
+		t.Fatalf("expected the rollout to complete with its failures reported, got %+v", detail.Rollout)
 	}
 }
@@ -0,0 +1,481 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultRolloutConcurrency = 10
+	defaultRolloutFailurePct  = 10
+	maxRolloutWaves           = 10
+	// rolloutStaleTarget is how long a running target may go without its
+	// command result before the rollout checks on the command itself.
+	rolloutStaleTarget = 2 * time.Minute
+)
+
+var defaultRolloutWaves = []int{1, 10, 100}
+
+// ProviderDirectory maps provider ids to their provider type in adminservice.
+type ProviderDirectory interface {
+	ProviderTypes(ctx context.Context) (map[string]string, error)
+}
+
+// RolloutPolicy bounds fleet rollouts. Providers resolves provider_types
+// selectors; without it only heartbeat attributes can be targeted.
+type RolloutPolicy struct {
+	Providers      ProviderDirectory
+	MaxConcurrency int
+}
+
+func (p RolloutPolicy) withDefaults() RolloutPolicy {
+	if p.MaxConcurrency <= 0 {
+		p.MaxConcurrency = 100
+	}
+	return p
+}
+
+// RolloutRequest describes a command to run across the fleet. Version and
+// HealthTimeoutSeconds only apply to agent_update. A nil MaxFailurePct uses
+// the default; zero halts on the first failure.
+type RolloutRequest struct {
+	Command              models.AgentCommandAction
+	Version              string
+	HealthTimeoutSeconds int
+	Selector             models.RolloutSelector
+	Waves                []int
+	MaxConcurrency       int
+	MaxFailurePct        *int
+	PauseBetweenWaves    bool
+	TimeoutSeconds       int
+	MaxAttempts          int
+}
+
+// CreateRollout resolves the selector against providers with a fresh
+// heartbeat, splits them into waves and dispatches the first one.
+func (s *ResourceService) CreateRollout(ctx context.Context, createdBy string, req RolloutRequest) (models.Rollout, error) {
+	item := models.Rollout{
+		Command:           req.Command,
+		Selector:          normalizeRolloutSelector(req.Selector),
+		Waves:             req.Waves,
+		MaxConcurrency:    req.MaxConcurrency,
+		MaxFailurePct:     defaultRolloutFailurePct,
+		PauseBetweenWaves: req.PauseBetweenWaves,
+		TimeoutSeconds:    req.TimeoutSeconds,
+		MaxAttempts:       req.MaxAttempts,
+		Status:            models.RolloutRunning,
+		CreatedBy:         createdBy,
+	}
+	switch item.Command {
+	case models.AgentCommandStatus, models.AgentCommandStart, models.AgentCommandStop, models.AgentCommandRestart:
+		if err := validateAgentCommandLimits(models.AgentCommand{TimeoutSeconds: item.TimeoutSeconds, MaxAttempts: item.MaxAttempts}); err != nil {
+			return models.Rollout{}, err
+		}
+	case models.AgentCommandAgentUpdate:
+		if err := validateAgentCommandLimits(models.AgentCommand{MaxAttempts: item.MaxAttempts}); err != nil {
+			return models.Rollout{}, err
+		}
+		payload, timeoutSeconds, err := s.agentUpdatePayload(req.Version, req.HealthTimeoutSeconds)
+		if err != nil {
+			return models.Rollout{}, err
+		}
+		item.Payload = payload
+		item.TimeoutSeconds = timeoutSeconds
+	default:
+		return models.Rollout{}, errors.New("unsupported rollout command")
+	}
+	if len(item.Waves) == 0 {
+		item.Waves = defaultRolloutWaves
+	}
+	if err := validateRolloutWaves(item.Waves); err != nil {
+		return models.Rollout{}, err
+	}
+	if item.MaxConcurrency == 0 {
+		item.MaxConcurrency = min(defaultRolloutConcurrency, s.rollouts.MaxConcurrency)
+	}
+	if item.MaxConcurrency < 1 || item.MaxConcurrency > s.rollouts.MaxConcurrency {
+		return models.Rollout{}, fmt.Errorf("max_concurrency must be between 1 and %d", s.rollouts.MaxConcurrency)
+	}
+	if req.MaxFailurePct != nil {
+		if *req.MaxFailurePct < 0 || *req.MaxFailurePct > 100 {
+			return models.Rollout{}, errors.New("max_failure_pct must be between 0 and 100")
+		}
+		item.MaxFailurePct = *req.MaxFailurePct
+	}
+	providerIDs, skipped, err := s.resolveRolloutTargets(ctx, item.Selector)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	if len(providerIDs) == 0 {
+		return models.Rollout{}, errors.New("no online providers match the selector")
+	}
+	if skipped > 0 {
+		item.Detail = fmt.Sprintf("%d matching providers were offline and skipped", skipped)
+	}
+	targets := make([]models.RolloutTarget, len(providerIDs))
+	for i, providerID := range providerIDs {
+		targets[i] = models.RolloutTarget{ProviderID: providerID, Position: i, Wave: rolloutWave(item.Waves, len(providerIDs), i)}
+	}
+	created, err := s.repo.CreateRollout(ctx, item, targets)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	log.Info().Str("rollout_id", created.ID).Str("command", string(created.Command)).Int("targets", len(targets)).Ints("waves", created.Waves).Str("created_by", createdBy).Msg("rollout created")
+	return s.advanceRollout(ctx, created.ID)
+}
+
+func normalizeRolloutSelector(selector models.RolloutSelector) models.RolloutSelector {
+	clean := func(values []string) []string {
+		out := make([]string, 0, len(values))
+		seen := map[string]bool{}
+		for _, value := range values {
+			value = strings.TrimSpace(value)
+			if value != "" && !seen[value] {
+				seen[value] = true
+				out = append(out, value)
+			}
+		}
+		return out
+	}
+	selector.ProviderIDs = clean(selector.ProviderIDs)
+	selector.Labels = clean(selector.Labels)
+	selector.Regions = clean(selector.Regions)
+	selector.ProviderTypes = clean(selector.ProviderTypes)
+	return selector
+}
+
+func validateRolloutWaves(waves []int) error {
+	if len(waves) > maxRolloutWaves {
+		return fmt.Errorf("at most %d waves are allowed", maxRolloutWaves)
+	}
+	previous := 0
+	for _, pct := range waves {
+		if pct <= previous || pct > 100 {
+			return errors.New("waves must be increasing percentages between 1 and 100")
+		}
+		previous = pct
+	}
+	if previous != 100 {
+		return errors.New("the last wave must be 100")
+	}
+	return nil
+}
+
+// rolloutWave returns the wave of the target at position. Waves are
+// cumulative, and the first one always holds at least one target.
+func rolloutWave(waves []int, total int, position int) int {
+	for i, pct := range waves {
+		cutoff := (total*pct + 99) / 100
+		if position < max(cutoff, 1) {
+			return i
+		}
+	}
+	return len(waves) - 1
+}
+
+// resolveRolloutTargets returns the online providers matching selector in a
+// stable order, and how many matching providers were offline.
+func (s *ResourceService) resolveRolloutTargets(ctx context.Context, selector models.RolloutSelector) ([]string, int, error) {
+	if !selector.All && len(selector.ProviderIDs) == 0 && len(selector.Labels) == 0 && len(selector.Regions) == 0 && len(selector.ProviderTypes) == 0 {
+		return nil, 0, errors.New("selector must set all or at least one of provider_ids, labels, regions and provider_types")
+	}
+	var providerTypes map[string]string
+	if len(selector.ProviderTypes) > 0 {
+		if s.rollouts.Providers == nil {
+			return nil, 0, errors.New("provider type targeting is not configured")
+		}
+		var err error
+		if providerTypes, err = s.rollouts.Providers.ProviderTypes(ctx); err != nil {
+			return nil, 0, fmt.Errorf("provider types unavailable: %w", err)
+		}
+	}
+	hosts, err := s.repo.ListHostResources(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	now := time.Now().UTC()
+	out := make([]string, 0, len(hosts))
+	skipped := 0
+	for _, host := range hosts {
+		if len(selector.ProviderIDs) > 0 && !containsString(selector.ProviderIDs, host.ProviderID) {
+			continue
+		}
+		if len(selector.Regions) > 0 && !containsString(selector.Regions, host.Region) {
+			continue
+		}
+		if len(selector.ProviderTypes) > 0 && !containsString(selector.ProviderTypes, providerTypes[host.ProviderID]) {
+			continue
+		}
+		if len(selector.Labels) > 0 && !hasAllLabels(host.Labels, selector.Labels) {
+			continue
+		}
+		if now.Sub(host.HeartbeatAt) > s.heartbeatMaxAge {
+			skipped++
+			continue
+		}
+		out = append(out, host.ProviderID)
+	}
+	sort.Strings(out)
+	return out, skipped, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAllLabels(labels []string, want []string) bool {
+	for _, label := range want {
+		if !containsString(labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ResourceService) GetRollout(ctx context.Context, rolloutID string) (models.RolloutDetail, error) {
+	rollout, err := s.repo.GetRollout(ctx, rolloutID)
+	if err != nil {
+		return models.RolloutDetail{}, err
+	}
+	targets, err := s.repo.ListRolloutTargets(ctx, rolloutID)
+	if err != nil {
+		return models.RolloutDetail{}, err
+	}
+	return models.RolloutDetail{Rollout: rollout, Targets: targets}, nil
+}
+
+func (s *ResourceService) ListRollouts(ctx context.Context, status models.RolloutStatus, limit int) ([]models.Rollout, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListRollouts(ctx, status, limit)
+}
+
+// PauseRollout stops dispatching new targets. Commands already sent run to
+// completion and are still recorded.
+func (s *ResourceService) PauseRollout(ctx context.Context, userID string, rolloutID string) (models.Rollout, error) {
+	rollout, err := s.repo.TransitionRollout(ctx, rolloutID, []models.RolloutStatus{models.RolloutRunning}, models.RolloutPaused, "paused by "+userID)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	log.Info().Str("rollout_id", rolloutID).Str("user_id", userID).Msg("rollout paused")
+	return rollout, nil
+}
+
+// ResumeRollout continues a paused or halted rollout. Resuming after a halt
+// means the operator accepted the failures so far.
+func (s *ResourceService) ResumeRollout(ctx context.Context, userID string, rolloutID string) (models.Rollout, error) {
+	if _, err := s.repo.TransitionRollout(ctx, rolloutID, []models.RolloutStatus{models.RolloutPaused, models.RolloutHalted}, models.RolloutRunning, "resumed by "+userID); err != nil {
+		return models.Rollout{}, err
+	}
+	log.Info().Str("rollout_id", rolloutID).Str("user_id", userID).Msg("rollout resumed")
+	return s.advanceRollout(ctx, rolloutID)
+}
+
+// CancelRollout skips the targets not yet dispatched and cancels the
+// commands still open.
+func (s *ResourceService) CancelRollout(ctx context.Context, userID string, rolloutID string) (models.Rollout, error) {
+	detail := "cancelled by " + userID
+	if _, err := s.repo.TransitionRollout(ctx, rolloutID, []models.RolloutStatus{models.RolloutRunning, models.RolloutPaused, models.RolloutHalted}, models.RolloutCancelled, detail); err != nil {
+		return models.Rollout{}, err
+	}
+	if err := s.repo.CancelPendingRolloutTargets(ctx, rolloutID, detail); err != nil {
+		return models.Rollout{}, err
+	}
+	targets, err := s.repo.ListRolloutTargets(ctx, rolloutID)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	for _, target := range targets {
+		if target.Status != models.RolloutTargetRunning {
+			continue
+		}
+		if target.CommandID == "" {
+			_, _ = s.repo.FinishRolloutTarget(ctx, rolloutID, target.ProviderID, models.RolloutTargetCancelled, detail)
+			continue
+		}
+		if _, err := s.CancelAgentCommand(ctx, userID, true, target.CommandID, "rollout cancelled"); err != nil {
+			log.Warn().Err(err).Str("rollout_id", rolloutID).Str("command_id", target.CommandID).Msg("rollout cancel left command open")
+		}
+	}
+	log.Info().Str("rollout_id", rolloutID).Str("user_id", userID).Msg("rollout cancelled")
+	return s.repo.GetRollout(ctx, rolloutID)
+}
+
+// AdvanceRollouts moves every running rollout forward. Results normally
+// advance a rollout as they arrive; this pass catches up after restarts.
+func (s *ResourceService) AdvanceRollouts(ctx context.Context) error {
+	rollouts, err := s.repo.ListRollouts(ctx, models.RolloutRunning, 100)
+	if err != nil {
+		return err
+	}
+	for _, rollout := range rollouts {
+		if _, err := s.advanceRollout(ctx, rollout.ID); err != nil {
+			log.Warn().Err(err).Str("rollout_id", rollout.ID).Msg("rollout advance failed")
+		}
+	}
+	return nil
+}
+
+// advanceRollout halts a running rollout whose failure rate passed its
+// threshold, opens the next wave once the current one has finished, and
+// dispatches pending targets up to the concurrency cap.
+func (s *ResourceService) advanceRollout(ctx context.Context, rolloutID string) (models.Rollout, error) {
+	rollout, err := s.repo.GetRollout(ctx, rolloutID)
+	if err != nil || rollout.Status != models.RolloutRunning {
+		return rollout, err
+	}
+	targets, err := s.repo.ListRolloutTargets(ctx, rolloutID)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	s.reconcileRolloutTargets(ctx, targets)
+	if targets, err = s.repo.ListRolloutTargets(ctx, rolloutID); err != nil {
+		return models.Rollout{}, err
+	}
+
+	// finished and failed only count results since the failure window
+	// opened; counts covers the whole rollout.
+	finished, failed, pending := 0, 0, 0
+	counts := map[models.RolloutTargetStatus]int{}
+	open := make([]int, len(rollout.Waves))
+	sizes := make([]int, len(rollout.Waves))
+	for _, target := range targets {
+		counts[target.Status]++
+		sizes[target.Wave]++
+		switch target.Status {
+		case models.RolloutTargetPending, models.RolloutTargetRunning:
+			open[target.Wave]++
+			if target.Status == models.RolloutTargetPending {
+				pending++
+			}
+		case models.RolloutTargetSucceeded, models.RolloutTargetFailed:
+			if target.FinishedAt.Before(rollout.FailureWindowAt) {
+				continue
+			}
+			finished++
+			if target.Status == models.RolloutTargetFailed {
+				failed++
+			}
+		}
+	}
+	// With nothing left to dispatch there is nothing to halt; the rollout
+	// completes and reports its failures.
+	if pending > 0 && failed > 0 && failed*100 > rollout.MaxFailurePct*finished {
+		detail := fmt.Sprintf("halted: %d of %d finished targets failed, above the %d%% threshold", failed, finished, rollout.MaxFailurePct)
+		log.Warn().Str("rollout_id", rolloutID).Int("failed", failed).Int("finished", finished).Msg("rollout halted")
+		return s.repo.TransitionRollout(ctx, rolloutID, []models.RolloutStatus{models.RolloutRunning}, models.RolloutHalted, detail)
+	}
+
+	wave := rollout.CurrentWave
+	for wave < len(rollout.Waves)-1 && open[wave] == 0 {
+		wave++
+		// An empty wave has nothing to wait for.
+		if rollout.PauseBetweenWaves && sizes[wave-1] > 0 {
+			break
+		}
+	}
+	if wave == len(rollout.Waves)-1 && open[wave] == 0 {
+		detail := fmt.Sprintf("completed: %d succeeded, %d failed, %d cancelled", counts[models.RolloutTargetSucceeded], counts[models.RolloutTargetFailed], counts[models.RolloutTargetCancelled])
+		log.Info().Str("rollout_id", rolloutID).Msg("rollout completed")
+		return s.repo.TransitionRollout(ctx, rolloutID, []models.RolloutStatus{models.RolloutRunning}, models.RolloutCompleted, detail)
+	}
+	if wave != rollout.CurrentWave {
+		if err := s.repo.AdvanceRolloutWave(ctx, rolloutID, wave); err != nil {
+			return models.Rollout{}, err
+		}
+		log.Info().Str("rollout_id", rolloutID).Int("wave", wave).Int("targets", sizes[wave]).Msg("rollout wave opened")
+		if rollout.PauseBetweenWaves && sizes[wave-1] > 0 {
+			detail := fmt.Sprintf("wave %d of %d finished; resume to start the next", wave, len(rollout.Waves))
+			return s.repo.TransitionRollout(ctx, rolloutID, []models.RolloutStatus{models.RolloutRunning}, models.RolloutPaused, detail)
+		}
+	}
+
+	claimed, err := s.repo.ClaimRolloutTargets(ctx, rolloutID)
+	if err != nil {
+		return models.Rollout{}, err
+	}
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].Position < claimed[j].Position })
+	for _, target := range claimed {
+		cmd, err := s.createAgentCommand(ctx, models.AgentCommand{
+			ProviderID:     target.ProviderID,
+			Command:        rollout.Command,
+			Payload:        rollout.Payload,
+			RequestedBy:    rollout.CreatedBy,
+			Status:         models.AgentCommandQueued,
+			TimeoutSeconds: rollout.TimeoutSeconds,
+			MaxAttempts:    rollout.MaxAttempts,
+			RolloutID:      rolloutID,
+		})
+		if err != nil {
+			_, _ = s.repo.FinishRolloutTarget(ctx, rolloutID, target.ProviderID, models.RolloutTargetFailed, "dispatch failed: "+err.Error())
+			continue
+		}
+		if err := s.repo.SetRolloutTargetCommand(ctx, rolloutID, target.ProviderID, cmd.ID); err != nil {
+			log.Warn().Err(err).Str("rollout_id", rolloutID).Str("command_id", cmd.ID).Msg("rollout target command not recorded")
+		}
+	}
+	if len(claimed) == 0 {
+		return rollout, nil
+	}
+	return s.repo.GetRollout(ctx, rolloutID)
+}
+
+// reconcileRolloutTargets settles running targets whose result was lost, for
+// example when the service stopped between finishing a command and recording
+// it on the rollout.
+func (s *ResourceService) reconcileRolloutTargets(ctx context.Context, targets []models.RolloutTarget) {
+	cutoff := time.Now().UTC().Add(-rolloutStaleTarget)
+	for _, target := range targets {
+		if target.Status != models.RolloutTargetRunning || target.StartedAt.After(cutoff) {
+			continue
+		}
+		if target.CommandID == "" {
+			_, _ = s.repo.FinishRolloutTarget(ctx, target.RolloutID, target.ProviderID, models.RolloutTargetFailed, "dispatch interrupted")
+			continue
+		}
+		cmd, err := s.repo.GetAgentCommand(ctx, target.CommandID)
+		if err != nil || cmd.Status == models.AgentCommandQueued || cmd.Status == models.AgentCommandRunning {
+			continue
+		}
+		status, detail := rolloutTargetResult(cmd, cmd.Status)
+		_, _ = s.repo.FinishRolloutTarget(ctx, target.RolloutID, target.ProviderID, status, detail)
+	}
+}
+
+func rolloutTargetResult(cmd models.AgentCommand, status models.AgentCommandState) (models.RolloutTargetStatus, string) {
+	detail := strings.TrimSpace(string(status) + ": " + cmd.ResultMessage)
+	switch status {
+	case models.AgentCommandSucceeded:
+		return models.RolloutTargetSucceeded, detail
+	case models.AgentCommandCancelled:
+		return models.RolloutTargetCancelled, detail
+	default:
+		return models.RolloutTargetFailed, detail
+	}
+}
+
+// applyRolloutCommandResult records a finished command on its rollout target
+// and moves the rollout forward.
+func (s *ResourceService) applyRolloutCommandResult(ctx context.Context, cmd models.AgentCommand, status models.AgentCommandState) {
+	targetStatus, detail := rolloutTargetResult(cmd, status)
+	if _, err := s.repo.FinishRolloutTarget(ctx, cmd.RolloutID, cmd.ProviderID, targetStatus, detail); err != nil {
+		log.Warn().Err(err).Str("rollout_id", cmd.RolloutID).Str("command_id", cmd.ID).Msg("rollout target result not recorded")
+		return
+	}
+	if _, err := s.advanceRollout(ctx, cmd.RolloutID); err != nil {
+		log.Warn().Err(err).Str("rollout_id", cmd.RolloutID).Msg("rollout advance failed")
+	}
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+type UserDirectory interface {
+	LookupUserByEmail(ctx context.Context, email string) (string, error)
+}
+
+func validShareAccessLevel(level models.SharedAccessLevel) bool {
+	switch level {
+	case models.SharedAccessRead, models.SharedAccessWrite, models.SharedAccessAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+func shareGrantOpen(grant models.ShareGrant) bool {
+	return grant.Status == models.ShareGrantPending || grant.Status == models.ShareGrantActive
+}
+
+func shareGrantCovers(grant models.ShareGrant, userID string) bool {
+	for _, item := range strings.Split(grant.GranteeUserID, ",") {
+		if strings.TrimSpace(item) == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ResourceService) shareResourceOwner(ctx context.Context, resourceType string, resourceID string) (string, error) {
+	switch resourceType {
+	case "vm":
+		vm, err := s.repo.GetVM(ctx, resourceID)
+		if err != nil {
+			return "", errors.New("vm not found")
+		}
+		return vm.UserID, nil
+	case "pod":
+		pod, err := s.repo.GetPod(ctx, resourceID)
+		if err != nil {
+			return "", errors.New("pod not found")
+		}
+		return pod.UserID, nil
+	default:
+		return "", errors.New("resource_type must be vm or pod")
+	}
+}
+
+func (s *ResourceService) authorizeShareOwner(ctx context.Context, userID string, resourceType string, resourceID string) error {
+	owner, err := s.shareResourceOwner(ctx, resourceType, resourceID)
+	if err != nil {
+		return err
+	}
+	if owner != userID {
+		return errors.New("forbidden: only the resource owner can manage shares")
+	}
+	return nil
+}
+
+func (s *ResourceService) auditShareGrant(ctx context.Context, grant models.ShareGrant, actorUserID string, action string, details string) {
+	if _, err := s.repo.CreateShareAuditEvent(ctx, models.ShareAuditEvent{
+		GrantID:      grant.ID,
+		ResourceType: grant.ResourceType,
+		ResourceID:   grant.ResourceID,
+		ActorUserID:  actorUserID,
+		Action:       action,
+		Details:      details,
+	}); err != nil {
+		log.Warn().Err(err).Str("grant_id", grant.ID).Str("action", action).Msg("share audit event write failed")
+	}
+}
+
+// GrantShare gives another user access to a VM or pod owned by ownerUserID.
+// Grants addressed to a user id are active immediately; grants addressed to an
+// email are resolved through authservice and stay pending until accepted.
+func (s *ResourceService) GrantShare(ctx context.Context, ownerUserID string, grant models.ShareGrant) (models.ShareGrant, error) {
+	grant, err := s.prepareShareGrant(ctx, ownerUserID, grant)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	created, err := s.repo.CreateShareGrant(ctx, grant)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	s.shareGrantCreated(ctx, ownerUserID, created)
+	return created, nil
+}
+
+// prepareShareGrant validates a grant and resolves its grantee without
+// storing it.
+func (s *ResourceService) prepareShareGrant(ctx context.Context, ownerUserID string, grant models.ShareGrant) (models.ShareGrant, error) {
+	grant.ResourceType = strings.TrimSpace(grant.ResourceType)
+	grant.ResourceID = strings.TrimSpace(grant.ResourceID)
+	grant.GranteeUserID = strings.TrimSpace(grant.GranteeUserID)
+	grant.InviteEmail = strings.ToLower(strings.TrimSpace(grant.InviteEmail))
+	if grant.ResourceID == "" {
+		return models.ShareGrant{}, errors.New("resource_id is required")
+	}
+	if err := s.authorizeShareOwner(ctx, ownerUserID, grant.ResourceType, grant.ResourceID); err != nil {
+		return models.ShareGrant{}, err
+	}
+	if grant.AccessLevel == "" {
+		grant.AccessLevel = models.SharedAccessRead
+	}
+	if !validShareAccessLevel(grant.AccessLevel) {
+		return models.ShareGrant{}, errors.New("access_level must be read, write or admin")
+	}
+	now := time.Now().UTC()
+	if grant.ExpiresAt != nil && !grant.ExpiresAt.After(now) {
+		return models.ShareGrant{}, errors.New("expires_at must be in the future")
+	}
+	switch {
+	case grant.GranteeUserID != "" && grant.InviteEmail != "":
+		return models.ShareGrant{}, errors.New("set either user_id or email, not both")
+	case grant.GranteeUserID != "":
+		grant.Status = models.ShareGrantActive
+		grant.AcceptedAt = &now
+	case grant.InviteEmail != "":
+		if s.users == nil {
+			return models.ShareGrant{}, errors.New("email invites are not configured")
+		}
+		userID, err := s.users.LookupUserByEmail(ctx, grant.InviteEmail)
+		if err != nil {
+			log.Warn().Err(err).Str("resource_id", grant.ResourceID).Msg("share invite email lookup failed")
+			return models.ShareGrant{}, errors.New("no account found for invite email")
+		}
+		grant.GranteeUserID = userID
+		grant.Status = models.ShareGrantPending
+		grant.AcceptedAt = nil
+	default:
+		return models.ShareGrant{}, errors.New("user_id or email is required")
+	}
+	if grant.GranteeUserID == ownerUserID {
+		return models.ShareGrant{}, errors.New("cannot share a resource with its owner")
+	}
+	existing, err := s.repo.ListShareGrants(ctx, grant.ResourceType, grant.ResourceID)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	for _, item := range existing {
+		if shareGrantOpen(item) && shareGrantCovers(item, grant.GranteeUserID) {
+			return models.ShareGrant{}, errors.New("user already has a grant on this resource")
+		}
+	}
+	grant.OwnerUserID = ownerUserID
+	return grant, nil
+}
+
+func (s *ResourceService) shareGrantCreated(ctx context.Context, ownerUserID string, created models.ShareGrant) {
+	action := "grant_created"
+	if created.Status == models.ShareGrantPending {
+		action = "invite_created"
+	}
+	s.auditShareGrant(ctx, created, ownerUserID, action, fmt.Sprintf("grantee=%s access_level=%s", created.GranteeUserID, created.AccessLevel))
+	log.Info().Str("grant_id", created.ID).Str("resource_type", created.ResourceType).Str("resource_id", created.ResourceID).Str("status", string(created.Status)).Msg("share grant created")
+}
+
+func (s *ResourceService) ListShareGrants(ctx context.Context, ownerUserID string, resourceType string, resourceID string) ([]models.ShareGrant, error) {
+	if err := s.authorizeShareOwner(ctx, ownerUserID, resourceType, resourceID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListShareGrants(ctx, resourceType, resourceID)
+}
+
+// ListReceivedShareGrants returns pending invites and active grants addressed to userID.
+func (s *ResourceService) ListReceivedShareGrants(ctx context.Context, userID string) ([]models.ShareGrant, error) {
+	return s.repo.ListShareGrantsForGrantee(ctx, userID)
+}
+
+func (s *ResourceService) AcceptShareGrant(ctx context.Context, userID string, resourceType string, grantID string) (models.ShareGrant, error) {
+	grant, err := s.repo.GetShareGrant(ctx, resourceType, grantID)
+	if err != nil {
+		return models.ShareGrant{}, errors.New("share grant not found")
+	}
+	if !shareGrantCovers(grant, userID) {
+		return models.ShareGrant{}, errors.New("forbidden: share grant belongs to another user")
+	}
+	if grant.Status != models.ShareGrantPending {
+		return models.ShareGrant{}, errors.New("share grant is not pending")
+	}
+	now := time.Now().UTC()
+	if grant.ExpiresAt != nil && !grant.ExpiresAt.After(now) {
+		return models.ShareGrant{}, errors.New("share grant has expired")
+	}
+	grant.Status = models.ShareGrantActive
+	grant.AcceptedAt = &now
+	updated, err := s.repo.UpdateShareGrant(ctx, grant)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	s.auditShareGrant(ctx, updated, userID, "grant_accepted", "")
+	return updated, nil
+}
+
+// RevokeShareGrant ends a grant. The owner can revoke any grant on the resource
+// and a grantee can give up their own.
+func (s *ResourceService) RevokeShareGrant(ctx context.Context, userID string, resourceType string, grantID string) (models.ShareGrant, error) {
+	grant, err := s.repo.GetShareGrant(ctx, resourceType, grantID)
+	if err != nil {
+		return models.ShareGrant{}, errors.New("share grant not found")
+	}
+	if grant.OwnerUserID != userID && !shareGrantCovers(grant, userID) {
+		return models.ShareGrant{}, errors.New("forbidden: only the owner or grantee can revoke a share")
+	}
+	if !shareGrantOpen(grant) {
+		return models.ShareGrant{}, errors.New("share grant is already closed")
+	}
+	now := time.Now().UTC()
+	grant.Status = models.ShareGrantRevoked
+	grant.RevokedAt = &now
+	updated, err := s.repo.UpdateShareGrant(ctx, grant)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	s.auditShareGrant(ctx, updated, userID, "grant_revoked", "")
+	log.Info().Str("grant_id", updated.ID).Str("actor_user_id", userID).Msg("share grant revoked")
+	return updated, nil
+}
+
+// UpdateShareGrant changes the access level and/or expiry of an open grant.
+func (s *ResourceService) UpdateShareGrant(ctx context.Context, ownerUserID string, resourceType string, grantID string, update models.ShareGrantUpdate) (models.ShareGrant, error) {
+	grant, err := s.repo.GetShareGrant(ctx, resourceType, grantID)
+	if err != nil {
+		return models.ShareGrant{}, errors.New("share grant not found")
+	}
+	if err := s.authorizeShareOwner(ctx, ownerUserID, grant.ResourceType, grant.ResourceID); err != nil {
+		return models.ShareGrant{}, err
+	}
+	if !shareGrantOpen(grant) {
+		return models.ShareGrant{}, errors.New("share grant is already closed")
+	}
+	changes := make([]string, 0, 2)
+	if update.AccessLevel != "" && update.AccessLevel != grant.AccessLevel {
+		if !validShareAccessLevel(update.AccessLevel) {
+			return models.ShareGrant{}, errors.New("access_level must be read, write or admin")
+		}
+		changes = append(changes, fmt.Sprintf("access_level %s -> %s", grant.AccessLevel, update.AccessLevel))
+		grant.AccessLevel = update.AccessLevel
+	}
+	switch {
+	case update.ClearExpiry:
+		if grant.ExpiresAt != nil {
+			changes = append(changes, "expiry removed")
+			grant.ExpiresAt = nil
+		}
+	case update.ExpiresAt != nil:
+		if !update.ExpiresAt.After(time.Now().UTC()) {
+			return models.ShareGrant{}, errors.New("expires_at must be in the future")
+		}
+		changes = append(changes, "expires_at "+update.ExpiresAt.UTC().Format(time.RFC3339))
+		grant.ExpiresAt = update.ExpiresAt
+	}
+	if len(changes) == 0 {
+		return grant, nil
+	}
+	updated, err := s.repo.UpdateShareGrant(ctx, grant)
+	if err != nil {
+		return models.ShareGrant{}, err
+	}
+	s.auditShareGrant(ctx, updated, ownerUserID, "grant_updated", strings.Join(changes, "; "))
+	return updated, nil
+}
+
+func (s *ResourceService) ListShareAuditEvents(ctx context.Context, ownerUserID string, resourceType string, resourceID string, limit int) ([]models.ShareAuditEvent, error) {
+	if err := s.authorizeShareOwner(ctx, ownerUserID, resourceType, resourceID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.repo.ListShareAuditEvents(ctx, resourceType, resourceID, limit)
+}
+
+func (s *ResourceService) ExpireShareGrants(ctx context.Context, now time.Time) error {
+	expired, err := s.repo.ExpireShareGrants(ctx, now, 200)
+	if err != nil {
+		return err
+	}
+	for _, grant := range expired {
+		s.auditShareGrant(ctx, grant, "system", "grant_expired", "")
+	}
+	if len(expired) > 0 {
+		log.Info().Int("expired_grant_count", len(expired)).Msg("share grants expired")
+	}
+	return nil
+}
+
+// shareRecipients turns the legacy shared_with list (user ids or emails) into
+// one grant per recipient.
+func (s *ResourceService) shareRecipients(ctx context.Context, ownerUserID string, resourceType string, resourceID string, sharedWith []string, level models.SharedAccessLevel, expiresAt *time.Time) ([]models.ShareGrant, error) {
+	grants := make([]models.ShareGrant, 0, len(sharedWith))
+	seen := make(map[string]bool, len(sharedWith))
+	for _, recipient := range sharedWith {
+		recipient = strings.TrimSpace(recipient)
+		if recipient == "" {
+			continue
+		}
+		grant := models.ShareGrant{ResourceType: resourceType, ResourceID: resourceID, AccessLevel: level, ExpiresAt: expiresAt}
+		if strings.Contains(recipient, "@") {
+			grant.InviteEmail = recipient
+		} else {
+			grant.GranteeUserID = recipient
+		}
+		prepared, err := s.prepareShareGrant(ctx, ownerUserID, grant)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", recipient, err)
+		}
+		if seen[prepared.GranteeUserID] {
+			return nil, fmt.Errorf("%s: user is listed more than once", recipient)
+		}
+		seen[prepared.GranteeUserID] = true
+		grants = append(grants, prepared)
+	}
+	if len(grants) == 0 {
+		return nil, errors.New("shared_with must not be empty")
+	}
+	// Every recipient is checked before any grant is stored, and the grants
+	// are stored together, so a bad entry leaves no partial share behind.
+	created, err := s.repo.CreateShareGrants(ctx, grants)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range created {
+		s.shareGrantCreated(ctx, ownerUserID, item)
+	}
+	return created, nil
+}
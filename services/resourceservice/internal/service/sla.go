@@ -0,0 +1,482 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/adapter/billing"
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// SLAPolicy is the monthly uptime target and credit per availability tier,
+// plus the tier providers are measured against. Tiers left out fall back to
+// 99/5, 99.5/10 and 99.9/25 percent for low, medium and high.
+type SLAPolicy struct {
+	Targets      map[string]models.SLATarget
+	ProviderTier string
+}
+
+func (p SLAPolicy) withDefaults() SLAPolicy {
+	defaults := map[string]models.SLATarget{
+		models.AvailabilityTierLow:    {Tier: models.AvailabilityTierLow, TargetPct: 99, CreditPct: 5},
+		models.AvailabilityTierMedium: {Tier: models.AvailabilityTierMedium, TargetPct: 99.5, CreditPct: 10},
+		models.AvailabilityTierHigh:   {Tier: models.AvailabilityTierHigh, TargetPct: 99.9, CreditPct: 25},
+	}
+	targets := make(map[string]models.SLATarget, len(defaults))
+	for tier, target := range defaults {
+		if configured, ok := p.Targets[tier]; ok && configured.TargetPct > 0 && configured.TargetPct <= 100 {
+			configured.Tier = tier
+			target = configured
+		}
+		targets[tier] = target
+	}
+	p.Targets = targets
+	if _, ok := targets[p.ProviderTier]; !ok {
+		p.ProviderTier = models.AvailabilityTierMedium
+	}
+	return p
+}
+
+// target returns the SLA for a tier; unknown tiers get the low tier's.
+func (p SLAPolicy) target(tier string) models.SLATarget {
+	if target, ok := p.Targets[tier]; ok {
+		return target
+	}
+	return p.Targets[models.AvailabilityTierLow]
+}
+
+const (
+	// slaCheckSpan is how long a health check vouches for a resource when no
+	// later check from the same probe follows it.
+	slaCheckSpan = 5 * time.Minute
+	slaBatch     = 200
+)
+
+func normalizeAvailabilityTier(tier string) (string, error) {
+	tier = strings.ToLower(strings.TrimSpace(tier))
+	switch tier {
+	case "":
+		return models.AvailabilityTierLow, nil
+	case models.AvailabilityTierLow, models.AvailabilityTierMedium, models.AvailabilityTierHigh:
+		return tier, nil
+	default:
+		return "", errors.New("availability_tier must be low, medium or high")
+	}
+}
+
+// slaPeriod resolves a YYYY-MM period, defaulting to the current month.
+func slaPeriod(period string, now time.Time) (string, time.Time, time.Time, error) {
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if period != "" {
+		parsed, err := time.Parse("2006-01", period)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, errors.New("period must be YYYY-MM")
+		}
+		start = parsed
+	}
+	if start.After(now) {
+		return "", time.Time{}, time.Time{}, errors.New("period is in the future")
+	}
+	return start.Format("2006-01"), start, start.AddDate(0, 1, 0), nil
+}
+
+// measureCheckUptime returns how much of [from, to) health checks covered and
+// how much of that the resource was down. Each probe's check holds until its
+// next check or slaCheckSpan, and the resource is down while any probe's
+// latest check is critical.
+func measureCheckUptime(checks []models.HealthCheck, from time.Time, to time.Time) (time.Duration, time.Duration) {
+	type edge struct {
+		at       time.Time
+		covered  int
+		critical int
+	}
+	edges := make([]edge, 0, 2*len(checks))
+	next := make(map[string]time.Time)
+	for i := len(checks) - 1; i >= 0; i-- {
+		check := checks[i]
+		series := check.ProbeID
+		if series == "" {
+			series = check.CheckType
+		}
+		start := check.CheckedAt
+		end := start.Add(slaCheckSpan)
+		if following, ok := next[series]; ok && following.Before(end) {
+			end = following
+		}
+		next[series] = check.CheckedAt
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		critical := 0
+		if check.Status == models.HealthStatusCritical {
+			critical = 1
+		}
+		edges = append(edges, edge{at: start, covered: 1, critical: critical}, edge{at: end, covered: -1, critical: -critical})
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].at.Before(edges[j].at) })
+	var monitored, down time.Duration
+	covered, critical := 0, 0
+	for i, item := range edges {
+		if i > 0 {
+			span := item.at.Sub(edges[i-1].at)
+			if covered > 0 {
+				monitored += span
+			}
+			if critical > 0 {
+				down += span
+			}
+		}
+		covered += item.covered
+		critical += item.critical
+	}
+	return monitored, down
+}
+
+// measurePresenceUptime returns how much of [from, to) the provider's presence
+// was known and how much of that it was offline; degraded counts as up.
+func measurePresenceUptime(events []models.ProviderPresenceEvent, from time.Time, to time.Time) (time.Duration, time.Duration) {
+	var monitored, down time.Duration
+	for i, event := range events {
+		start := event.CreatedAt
+		if start.Before(from) {
+			start = from
+		}
+		end := to
+		if i+1 < len(events) && events[i+1].CreatedAt.Before(end) {
+			end = events[i+1].CreatedAt
+		}
+		if !end.After(start) {
+			continue
+		}
+		monitored += end.Sub(start)
+		if event.ToState == models.ProviderOffline {
+			down += end.Sub(start)
+		}
+	}
+	return monitored, down
+}
+
+func (s *ResourceService) finishSLAReport(report models.SLAReport, monitored time.Duration, down time.Duration, now time.Time) models.SLAReport {
+	target := s.slaPolicy.target(report.Tier)
+	report.Tier = target.Tier
+	report.TargetPct = target.TargetPct
+	report.MonitoredSeconds = int64(monitored / time.Second)
+	report.DowntimeSeconds = int64(down / time.Second)
+	report.UptimePct = 100
+	if monitored > 0 {
+		report.UptimePct = math.Round(float64(monitored-down)/float64(monitored)*100000) / 1000
+	}
+	report.Met = report.UptimePct >= target.TargetPct
+	report.Final = !report.PeriodEnd.After(now)
+	report.CreditStatus = models.SLACreditNone
+	if !report.Met {
+		report.CreditPct = target.CreditPct
+		if report.Final && target.CreditPct > 0 {
+			report.CreditStatus = models.SLACreditPending
+		}
+	}
+	return report
+}
+
+func (s *ResourceService) subjectSLAReport(ctx context.Context, subject models.SLASubject, period string, start time.Time, end time.Time, now time.Time) (models.SLAReport, error) {
+	report := models.SLAReport{
+		ResourceType: subject.ResourceType,
+		ResourceID:   subject.ResourceID,
+		UserID:       subject.UserID,
+		ProviderID:   subject.ProviderID,
+		Tier:         subject.Tier,
+		Period:       period,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+	}
+	from, to := start, end
+	if subject.CreatedAt.After(from) {
+		from = subject.CreatedAt
+	}
+	if now.Before(to) {
+		to = now
+	}
+	if subject.EndedAt != nil && subject.EndedAt.Before(to) {
+		to = *subject.EndedAt
+	}
+	if !to.After(from) {
+		return s.finishSLAReport(report, 0, 0, now), nil
+	}
+	checks, err := s.repo.ListHealthChecksBetween(ctx, subject.ResourceType, subject.ResourceID, from, to)
+	if err != nil {
+		return models.SLAReport{}, err
+	}
+	monitored, down := measureCheckUptime(checks, from, to)
+	return s.finishSLAReport(report, monitored, down, now), nil
+}
+
+func (s *ResourceService) providerSLAReport(ctx context.Context, providerID string, period string, start time.Time, end time.Time, now time.Time) (models.SLAReport, error) {
+	report := models.SLAReport{
+		ResourceType: "provider",
+		ResourceID:   providerID,
+		ProviderID:   providerID,
+		Tier:         s.slaPolicy.ProviderTier,
+		Period:       period,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+	}
+	to := end
+	if now.Before(to) {
+		to = now
+	}
+	events, err := s.repo.ListPresenceEventsBetween(ctx, providerID, start, to)
+	if err != nil {
+		return models.SLAReport{}, err
+	}
+	monitored, down := measurePresenceUptime(events, start, to)
+	return s.finishSLAReport(report, monitored, down, now), nil
+}
+
+// storedSLAReport returns the report saved when the period closed, if any.
+func (s *ResourceService) storedSLAReport(ctx context.Context, resourceType string, resourceID string, period string) (models.SLAReport, bool, error) {
+	report, err := s.repo.GetSLAReport(ctx, resourceType, resourceID, period)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.SLAReport{}, false, nil
+	}
+	if err != nil {
+		return models.SLAReport{}, false, err
+	}
+	return report, true, nil
+}
+
+func (s *ResourceService) SLATargets() []models.SLATarget {
+	out := make([]models.SLATarget, 0, len(s.slaPolicy.Targets))
+	for _, tier := range []string{models.AvailabilityTierLow, models.AvailabilityTierMedium, models.AvailabilityTierHigh} {
+		out = append(out, s.slaPolicy.Targets[tier])
+	}
+	return out
+}
+
+// ResourceSLAReport returns the uptime of a VM or pod the user can read for a
+// YYYY-MM period, live for the current month.
+func (s *ResourceService) ResourceSLAReport(ctx context.Context, userID string, resourceID string, period string) (models.SLAReport, error) {
+	now := time.Now().UTC()
+	period, start, end, err := slaPeriod(period, now)
+	if err != nil {
+		return models.SLAReport{}, err
+	}
+	access, err := s.authorizeResourceAccess(ctx, userID, resourceID, models.SharedAccessRead)
+	if err != nil {
+		return models.SLAReport{}, err
+	}
+	if report, ok, err := s.storedSLAReport(ctx, access.ResourceType, resourceID, period); err != nil || ok {
+		return report, err
+	}
+	subject := models.SLASubject{ResourceType: access.ResourceType, ResourceID: resourceID}
+	if access.ResourceType == "vm" {
+		vm, err := s.repo.GetVM(ctx, resourceID)
+		if err != nil {
+			return models.SLAReport{}, err
+		}
+		subject.UserID, subject.ProviderID, subject.Tier, subject.CreatedAt = vm.UserID, vm.ProviderID, vm.AvailabilityTier, vm.CreatedAt
+		if vm.Status == models.VMStatusTerminated || vm.Status == models.VMStatusExpired {
+			subject.EndedAt = &vm.UpdatedAt
+		}
+	} else {
+		pod, err := s.repo.GetPod(ctx, resourceID)
+		if err != nil {
+			return models.SLAReport{}, err
+		}
+		subject.UserID, subject.ProviderID, subject.Tier, subject.CreatedAt = pod.UserID, pod.ProviderID, pod.AvailabilityTier, pod.CreatedAt
+		if pod.Status == models.PodStatusTerminated || pod.Status == models.PodStatusExpired {
+			subject.EndedAt = &pod.UpdatedAt
+		}
+	}
+	return s.subjectSLAReport(ctx, subject, period, start, end, now)
+}
+
+// ProviderSLAReport returns a provider's uptime from its presence history.
+func (s *ResourceService) ProviderSLAReport(ctx context.Context, providerID string, period string) (models.SLAReport, error) {
+	if providerID == "" {
+		return models.SLAReport{}, errors.New("provider_id is required")
+	}
+	now := time.Now().UTC()
+	period, start, end, err := slaPeriod(period, now)
+	if err != nil {
+		return models.SLAReport{}, err
+	}
+	if report, ok, err := s.storedSLAReport(ctx, "provider", providerID, period); err != nil || ok {
+		return report, err
+	}
+	return s.providerSLAReport(ctx, providerID, period, start, end, now)
+}
+
+// ListSLAReports returns the closed-period reports for a user's own VMs and
+// pods.
+func (s *ResourceService) ListSLAReports(ctx context.Context, userID string, period string) ([]models.SLAReport, error) {
+	return s.repo.ListSLAReports(ctx, models.SLAReportFilter{UserID: userID, Period: period, Limit: 500})
+}
+
+func (s *ResourceService) AdminListSLAReports(ctx context.Context, filter models.SLAReportFilter) ([]models.SLAReport, error) {
+	switch filter.CreditStatus {
+	case "", models.SLACreditNone, models.SLACreditPending, models.SLACreditIssued:
+	default:
+		return nil, errors.New("credit_status must be none, pending or issued")
+	}
+	if filter.Limit <= 0 || filter.Limit > 1000 {
+		filter.Limit = 200
+	}
+	return s.repo.ListSLAReports(ctx, filter)
+}
+
+// EvaluateSLAs stores reports for the month before now once it has closed and
+// asks billingservice for the credits owed on missed targets. Credits that
+// fail stay pending and are retried on the next pass.
+func (s *ResourceService) EvaluateSLAs(ctx context.Context, now time.Time) error {
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	end := start.AddDate(0, 1, 0)
+	period := start.Format("2006-01")
+	for {
+		subjects, err := s.repo.ListSLASubjects(ctx, period, start, end, slaBatch)
+		if err != nil {
+			return err
+		}
+		for _, subject := range subjects {
+			report, err := s.subjectSLAReport(ctx, subject, period, start, end, now)
+			if err != nil {
+				return err
+			}
+			if err := s.repo.SaveSLAReport(ctx, report); err != nil {
+				return err
+			}
+		}
+		if len(subjects) < slaBatch {
+			break
+		}
+	}
+	for {
+		providers, err := s.repo.ListSLAProviders(ctx, period, end, slaBatch)
+		if err != nil {
+			return err
+		}
+		for _, providerID := range providers {
+			report, err := s.providerSLAReport(ctx, providerID, period, start, end, now)
+			if err != nil {
+				return err
+			}
+			if err := s.repo.SaveSLAReport(ctx, report); err != nil {
+				return err
+			}
+		}
+		if len(providers) < slaBatch {
+			break
+		}
+	}
+	return s.issueSLACredits(ctx)
+}
+
+func (s *ResourceService) issueSLACredits(ctx context.Context) error {
+	if s.billing == nil {
+		return nil
+	}
+	pending, err := s.repo.ListSLAReports(ctx, models.SLAReportFilter{CreditStatus: models.SLACreditPending, Limit: slaBatch})
+	if err != nil {
+		return err
+	}
+	var failed error
+	for _, report := range pending {
+		total, err := s.issueSLACredit(ctx, report)
+		if err != nil {
+			log.Warn().Err(err).Str("resource_type", report.ResourceType).Str("resource_id", report.ResourceID).Str("period", report.Period).Msg("sla credit failed; retrying next pass")
+			failed = err
+			continue
+		}
+		if err := s.repo.MarkSLAReportCredited(ctx, report.ResourceType, report.ResourceID, report.Period, total); err != nil {
+			return err
+		}
+		log.Info().Str("resource_type", report.ResourceType).Str("resource_id", report.ResourceID).Str("period", report.Period).Float64("credit_usd", total).Msg("sla credit issued")
+	}
+	return failed
+}
+
+// issueSLACredit credits the owner of a VM or pod, or every renter metered on
+// a provider during the period. Reference ids make a partly failed pass safe
+// to repeat.
+func (s *ResourceService) issueSLACredit(ctx context.Context, report models.SLAReport) (float64, error) {
+	reason := fmt.Sprintf("%s tier uptime %.3f%% below %.3f%% target for %s", report.Tier, report.UptimePct, report.TargetPct, report.Period)
+	requests := make([]billing.CreditRequest, 0, 1)
+	if report.ResourceType == "provider" {
+		bookings, err := s.repo.ListBilledProviderBookings(ctx, report.ResourceID, report.PeriodStart, report.PeriodEnd)
+		if err != nil {
+			return 0, err
+		}
+		for _, booking := range bookings {
+			requests = append(requests, billing.CreditRequest{
+				ReferenceID:  "sla:provider:" + report.ResourceID + ":" + report.Period + ":" + booking.ID,
+				UserID:       booking.UserID,
+				ProviderID:   report.ResourceID,
+				ResourceType: "offer_booking",
+				ResourceID:   booking.ID,
+				RentalID:     booking.BillingRentalID,
+			})
+		}
+	} else {
+		endedAt, err := s.slaResourceEndedAt(ctx, report)
+		if err != nil {
+			return 0, err
+		}
+		requests = append(requests, billing.CreditRequest{
+			ReferenceID:     "sla:" + report.ResourceType + ":" + report.ResourceID + ":" + report.Period,
+			UserID:          report.UserID,
+			ProviderID:      report.ProviderID,
+			ResourceType:    report.ResourceType,
+			ResourceID:      report.ResourceID,
+			ResourceEndedAt: endedAt,
+		})
+	}
+	total := 0.0
+	for _, req := range requests {
+		req.PeriodStart = report.PeriodStart
+		req.PeriodEnd = report.PeriodEnd
+		req.CreditPct = report.CreditPct
+		req.Reason = reason
+		credit, err := s.billing.IssueCredit(ctx, req)
+		if err != nil {
+			return 0, err
+		}
+		total += credit.AmountUSD
+	}
+	return math.Round(total*100) / 100, nil
+}
+
+// slaResourceEndedAt returns when a credited VM or pod was terminated, or nil
+// while it still exists, so billing stops counting hourly charges there.
+func (s *ResourceService) slaResourceEndedAt(ctx context.Context, report models.SLAReport) (*time.Time, error) {
+	switch report.ResourceType {
+	case "vm":
+		vm, err := s.repo.GetVM(ctx, report.ResourceID)
+		if err != nil {
+			return nil, err
+		}
+		if vm.Status == models.VMStatusTerminated || vm.Status == models.VMStatusExpired {
+			return &vm.UpdatedAt, nil
+		}
+	case "pod":
+		pod, err := s.repo.GetPod(ctx, report.ResourceID)
+		if err != nil {
+			return nil, err
+		}
+		if pod.Status == models.PodStatusTerminated || pod.Status == models.PodStatusExpired {
+			return &pod.UpdatedAt, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	streamBuffer       = 256
+	streamMaxResources = 50
+	// streamRelayQueue bounds the events waiting to be written for the other
+	// instances; past it an event only reaches streams open on this one.
+	streamRelayQueue     = 1024
+	streamRelayBatch     = 256
+	streamRelayRetention = 10 * time.Minute
+)
+
+// streamHub fans events out to the streams open on this instance. Publishing
+// never blocks: a subscriber whose buffer is full is dropped and its channel
+// closed, so the client reconnects and reloads over REST.
+//
+// Kafka partitions and REST calls are spread over the replicas, so published
+// events are also written to the database by a background writer, and
+// relayFrom delivers the ones other instances wrote. Streams see events from
+// other instances within about two seconds.
+type streamHub struct {
+	mu   sync.Mutex
+	subs map[*streamSubscriber]struct{}
+
+	repo Repository
+	// origin tags the events this instance writes, so it skips them when
+	// they come back from the database.
+	origin  string
+	relay   chan models.StreamEvent
+	start   sync.Once
+	pending sync.WaitGroup
+
+	relayMu  sync.Mutex
+	primed   bool
+	cursor   int64
+	prunedAt time.Time
+}
+
+type streamSubscriber struct {
+	resources map[string]bool
+	providers map[string]bool
+	types     map[models.StreamEventType]bool
+	events    chan models.StreamEvent
+}
+
+func newStreamHub(repo Repository) *streamHub {
+	return &streamHub{
+		subs:   make(map[*streamSubscriber]struct{}),
+		repo:   repo,
+		origin: uuid.NewString(),
+		relay:  make(chan models.StreamEvent, streamRelayQueue),
+	}
+}
+
+func (sub *streamSubscriber) wants(event models.StreamEvent) bool {
+	if len(sub.types) > 0 && !sub.types[event.Type] {
+		return false
+	}
+	return (event.ResourceID != "" && sub.resources[event.ResourceID]) || (event.ProviderID != "" && sub.providers[event.ProviderID])
+}
+
+func (h *streamHub) subscribe(sub models.StreamSubscription) (<-chan models.StreamEvent, func()) {
+	item := &streamSubscriber{
+		resources: make(map[string]bool, len(sub.ResourceIDs)),
+		providers: make(map[string]bool, len(sub.ProviderIDs)),
+		types:     make(map[models.StreamEventType]bool, len(sub.Types)),
+		events:    make(chan models.StreamEvent, streamBuffer),
+	}
+	for _, id := range sub.ResourceIDs {
+		item.resources[id] = true
+	}
+	for _, id := range sub.ProviderIDs {
+		item.providers[id] = true
+	}
+	for _, eventType := range sub.Types {
+		item.types[eventType] = true
+	}
+	h.mu.Lock()
+	h.subs[item] = struct{}{}
+	h.mu.Unlock()
+	return item.events, func() { h.remove(item) }
+}
+
+func (h *streamHub) remove(item *streamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[item]; ok {
+		delete(h.subs, item)
+		close(item.events)
+	}
+}
+
+// publish delivers an event to the streams open here and queues it for the
+// other instances.
+func (h *streamHub) publish(event models.StreamEvent) {
+	h.deliver(event)
+	h.pending.Add(1)
+	h.start.Do(func() { go h.writeLoop() })
+	select {
+	case h.relay <- event:
+	default:
+		h.pending.Done()
+		log.Warn().Str("event_type", string(event.Type)).Msg("stream relay queue full; event not relayed")
+	}
+}
+
+func (h *streamHub) deliver(event models.StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for item := range h.subs {
+		if !item.wants(event) {
+			continue
+		}
+		select {
+		case item.events <- event:
+		default:
+			delete(h.subs, item)
+			close(item.events)
+			log.Warn().Str("event_type", string(event.Type)).Msg("stream subscriber too slow; dropped")
+		}
+	}
+}
+
+func (h *streamHub) writeLoop() {
+	for event := range h.relay {
+		batch := []models.StreamEvent{event}
+	fill:
+		for len(batch) < streamRelayBatch {
+			select {
+			case next := <-h.relay:
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+		payloads := make([][]byte, 0, len(batch))
+		for _, item := range batch {
+			raw, err := json.Marshal(item)
+			if err != nil {
+				log.Error().Err(err).Str("event_type", string(item.Type)).Msg("stream event encode failed")
+				continue
+			}
+			payloads = append(payloads, raw)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := h.repo.AppendStreamEvents(ctx, h.origin, payloads); err != nil {
+			log.Error().Err(err).Int("events", len(payloads)).Msg("stream relay write failed")
+		}
+		cancel()
+		for range batch {
+			h.pending.Done()
+		}
+	}
+}
+
+// flush waits until every queued event has been written.
+func (h *streamHub) flush() {
+	h.pending.Wait()
+}
+
+// relayedStreamEvent keeps the data of an event read back from the database
+// as the JSON it was written as.
+type relayedStreamEvent struct {
+	models.StreamEvent
+	Data json.RawMessage `json:"data"`
+}
+
+// relayFrom delivers the events other instances wrote since the last pass and
+// prunes old ones. The first pass only places the cursor, so an instance
+// never replays events from before it started.
+func (h *streamHub) relayFrom(ctx context.Context, now time.Time) error {
+	h.relayMu.Lock()
+	defer h.relayMu.Unlock()
+	if !h.primed {
+		latest, err := h.repo.LatestStreamEventID(ctx)
+		if err != nil {
+			return err
+		}
+		h.cursor, h.primed = latest, true
+		return nil
+	}
+	for {
+		items, err := h.repo.ListStreamEvents(ctx, h.cursor, streamRelayBatch)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			h.cursor = item.ID
+			if item.Origin == h.origin {
+				continue
+			}
+			var relayed relayedStreamEvent
+			if err := json.Unmarshal(item.Payload, &relayed); err != nil {
+				log.Error().Err(err).Int64("stream_event_id", item.ID).Msg("relayed stream event decode failed")
+				continue
+			}
+			event := relayed.StreamEvent
+			event.Data = relayed.Data
+			h.deliver(event)
+		}
+		if len(items) < streamRelayBatch {
+			break
+		}
+	}
+	if now.Sub(h.prunedAt) >= time.Minute {
+		if _, err := h.repo.DeleteStreamEventsBefore(ctx, now.Add(-streamRelayRetention)); err != nil {
+			return err
+		}
+		h.prunedAt = now
+	}
+	return nil
+}
+
+// RelayStreamEvents delivers stream events published on other instances to
+// the streams open on this one.
+func (s *ResourceService) RelayStreamEvents(ctx context.Context, now time.Time) error {
+	return s.streams.relayFrom(ctx, now)
+}
+
+func (s *ResourceService) publishStream(event models.StreamEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	s.streams.publish(event)
+}
+
+func (s *ResourceService) publishResourceState(resourceType string, resourceID string, providerID string, state models.StreamState) {
+	s.publishStream(models.StreamEvent{Type: models.StreamEventState, ResourceType: resourceType, ResourceID: resourceID, ProviderID: providerID, Data: state})
+}
+
+func (s *ResourceService) setVMStatus(ctx context.Context, vmID string, status models.VMStatus) error {
+	if err := s.repo.UpdateVMStatus(ctx, vmID, status); err != nil {
+		return err
+	}
+	s.publishResourceState("vm", vmID, "", models.StreamState{Status: string(status)})
+	return nil
+}
+
+func (s *ResourceService) setPodStatus(ctx context.Context, podID string, status models.PodStatus) error {
+	if err := s.repo.UpdatePodStatus(ctx, podID, status); err != nil {
+		return err
+	}
+	s.publishResourceState("pod", podID, "", models.StreamState{Status: string(status)})
+	return nil
+}
+
+// AuthorizeStream normalizes a subscription and checks it against the same
+// rules as the REST reads: VMs and pods the user can read, and providers for
+// admins only.
+func (s *ResourceService) AuthorizeStream(ctx context.Context, userID string, admin bool, sub models.StreamSubscription) (models.StreamSubscription, error) {
+	sub.ResourceIDs = compactIDs(sub.ResourceIDs)
+	sub.ProviderIDs = compactIDs(sub.ProviderIDs)
+	if len(sub.ResourceIDs) == 0 && len(sub.ProviderIDs) == 0 {
+		return models.StreamSubscription{}, errors.New("resource_id or provider_id is required")
+	}
+	if len(sub.ResourceIDs)+len(sub.ProviderIDs) > streamMaxResources {
+		return models.StreamSubscription{}, errors.New("too many stream subscriptions")
+	}
+	for _, eventType := range sub.Types {
+		switch eventType {
+		case models.StreamEventState, models.StreamEventHealthCheck, models.StreamEventMetric, models.StreamEventAgentLog, models.StreamEventExecOutput:
+		default:
+			return models.StreamSubscription{}, errors.New("types must be state, health_check, metric, agent_log or exec_output")
+		}
+	}
+	if len(sub.ProviderIDs) > 0 && !admin {
+		return models.StreamSubscription{}, errors.New("forbidden: provider streams require an admin role")
+	}
+	if admin {
+		return sub, nil
+	}
+	for _, resourceID := range sub.ResourceIDs {
+		if _, err := s.authorizeResourceAccess(ctx, userID, resourceID, models.SharedAccessRead); err != nil {
+			return models.StreamSubscription{}, err
+		}
+	}
+	return sub, nil
+}
+
+// SubscribeStream opens a stream for an authorized subscription. The channel
+// is closed by cancel, or early when the subscriber falls behind.
+func (s *ResourceService) SubscribeStream(sub models.StreamSubscription) (<-chan models.StreamEvent, func()) {
+	return s.streams.subscribe(sub)
+}
+
+func compactIDs(ids []string) []string {
+	out := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, raw := range ids {
+		for _, id := range strings.Split(raw, ",") {
+			id = strings.TrimSpace(id)
+			if id != "" && !seen[id] {
+				seen[id] = true
+				out = append(out, id)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+// driveTerminalSession allows input and resizes to the renter and to the
+// drivers they invited. A driver needs write access to the resource on every
+// call, so a revoked grant or a demotion stops their input at once.
+func (s *ResourceService) driveTerminalSession(ctx context.Context, userID string, sessionID string) (models.TerminalSession, resourceAccess, error) {
+	session, err := s.repo.GetTerminalSession(ctx, sessionID)
+	if err != nil {
+		return models.TerminalSession{}, resourceAccess{}, err
+	}
+	if session.RenterUserID == userID {
+		return s.controlTerminalSession(ctx, userID, sessionID)
+	}
+	participant, err := s.repo.GetTerminalParticipant(ctx, sessionID, userID)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && participant.Role != models.TerminalParticipantDriver) {
+		return models.TerminalSession{}, resourceAccess{}, errors.New("forbidden session access")
+	}
+	if err != nil {
+		return models.TerminalSession{}, resourceAccess{}, err
+	}
+	access, err := s.authorizeResourceAccess(ctx, userID, session.ResourceID, models.SharedAccessWrite)
+	if err != nil {
+		return models.TerminalSession{}, resourceAccess{}, err
+	}
+	return session, access, nil
+}
+
+// InviteTerminalParticipant lets the renter add a driver or viewer to their
+// session, or change the role of one already added. Drivers need a write
+// grant on the resource and viewers a read grant.
+func (s *ResourceService) InviteTerminalParticipant(ctx context.Context, userID string, sessionID string, inviteeID string, role models.TerminalParticipantRole) (models.TerminalParticipant, error) {
+	session, _, err := s.controlTerminalSession(ctx, userID, sessionID)
+	if err != nil {
+		return models.TerminalParticipant{}, err
+	}
+	if terminalSessionEnded(session.Status) {
+		return models.TerminalParticipant{}, errors.New("terminal session is closed")
+	}
+	inviteeID = strings.TrimSpace(inviteeID)
+	if inviteeID == "" {
+		return models.TerminalParticipant{}, errors.New("user_id is required")
+	}
+	if inviteeID == session.RenterUserID {
+		return models.TerminalParticipant{}, errors.New("the renter already drives the session")
+	}
+	var required models.SharedAccessLevel
+	switch role {
+	case models.TerminalParticipantDriver:
+		required = models.SharedAccessWrite
+	case models.TerminalParticipantViewer:
+		required = models.SharedAccessRead
+	default:
+		return models.TerminalParticipant{}, errors.New("role must be driver or viewer")
+	}
+	access, err := s.authorizeResourceAccess(ctx, inviteeID, session.ResourceID, required)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "forbidden") {
+			return models.TerminalParticipant{}, fmt.Errorf("forbidden: %s needs %s access to the resource to join as %s", inviteeID, required, role)
+		}
+		return models.TerminalParticipant{}, err
+	}
+	item, err := s.repo.UpsertTerminalParticipant(ctx, models.TerminalParticipant{
+		SessionID: session.ID,
+		UserID:    inviteeID,
+		Role:      role,
+		InvitedBy: userID,
+	})
+	if err != nil {
+		return models.TerminalParticipant{}, err
+	}
+	_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+		SessionID:  session.ID,
+		ProviderID: session.ProviderID,
+		UserID:     userID,
+		GrantID:    access.GrantID,
+		EventType:  "terminal_participant_invited",
+		Details:    terminalAccessDetails(fmt.Sprintf("%s joined as %s", inviteeID, role), access),
+	})
+	s.publishTerminalPresence(ctx, session)
+	return item, nil
+}
+
+// RemoveTerminalParticipant takes a participant off a session, for the
+// renter or for the participant leaving. Streams they hold stay open while
+// their grant lets them read, but they can no longer drive.
+func (s *ResourceService) RemoveTerminalParticipant(ctx context.Context, userID string, sessionID string, participantID string) error {
+	session, err := s.repo.GetTerminalSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	details := participantID + " left"
+	if userID != participantID {
+		if _, _, err := s.controlTerminalSession(ctx, userID, sessionID); err != nil {
+			return err
+		}
+		details = participantID + " removed"
+	}
+	if err := s.repo.DeleteTerminalParticipant(ctx, sessionID, participantID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errors.New("terminal participant not found")
+		}
+		return err
+	}
+	_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+		SessionID:  session.ID,
+		ProviderID: session.ProviderID,
+		UserID:     userID,
+		EventType:  "terminal_participant_removed",
+		Details:    details,
+	})
+	s.publishTerminalPresence(ctx, session)
+	return nil
+}
+
+// ListTerminalParticipants returns the presence list of a session to anyone
+// who may view it.
+func (s *ResourceService) ListTerminalParticipants(ctx context.Context, userID string, sessionID string) ([]models.TerminalPresence, error) {
+	session, _, err := s.viewTerminalSession(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return s.terminalPresence(ctx, session)
+}
+
+// terminalPresence lists the renter, then invited participants, then anyone
+// else watching through a read grant. Online counts cover the streams open
+// on this instance.
+func (s *ResourceService) terminalPresence(ctx context.Context, session models.TerminalSession) ([]models.TerminalPresence, error) {
+	participants, err := s.repo.ListTerminalParticipants(ctx, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	online := s.terminals.online(session.ID)
+	presence := func(userID string, role models.TerminalParticipantRole, invited bool) models.TerminalPresence {
+		return models.TerminalPresence{UserID: userID, Role: role, Invited: invited, Online: online[userID] > 0, Connections: online[userID]}
+	}
+	out := []models.TerminalPresence{presence(session.RenterUserID, models.TerminalParticipantOwner, false)}
+	listed := map[string]bool{session.RenterUserID: true}
+	for _, item := range participants {
+		if !listed[item.UserID] {
+			listed[item.UserID] = true
+			out = append(out, presence(item.UserID, item.Role, true))
+		}
+	}
+	watchers := make([]string, 0)
+	for userID := range online {
+		if !listed[userID] {
+			watchers = append(watchers, userID)
+		}
+	}
+	sort.Strings(watchers)
+	for _, userID := range watchers {
+		out = append(out, presence(userID, models.TerminalParticipantViewer, false))
+	}
+	return out, nil
+}
+
+// publishTerminalPresence sends the presence list to the session's streams.
+// Streams re-check their drive rights when it arrives.
+func (s *ResourceService) publishTerminalPresence(ctx context.Context, session models.TerminalSession) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	participants, err := s.terminalPresence(ctx, session)
+	if err != nil {
+		return
+	}
+	s.terminals.broadcast(session.ID, models.TerminalFrame{Type: models.TerminalFramePresence, Participants: participants})
+}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultRecordingRetention = 90 * 24 * time.Hour
+	minRecordingRetention     = 24 * time.Hour
+	recordingMaxChunks        = 100000
+	recordingPurgeBatch       = 100
+	MinReplaySpeed            = 0.25
+	MaxReplaySpeed            = 16.0
+)
+
+// RecordingPolicy sets how long the input and output of a terminal session
+// are kept after it ends. The session and its audit events outlive the purge.
+type RecordingPolicy struct {
+	Retention time.Duration
+}
+
+func (p RecordingPolicy) withDefaults() RecordingPolicy {
+	if p.Retention <= 0 {
+		p.Retention = defaultRecordingRetention
+	}
+	if p.Retention < minRecordingRetention {
+		p.Retention = minRecordingRetention
+	}
+	return p
+}
+
+// authorizeRecording opens recordings to admins and the resource owner. A
+// renter who did not come through a grant owned the resource when the
+// session ran, which still counts after the resource is gone.
+func (s *ResourceService) authorizeRecording(ctx context.Context, userID string, admin bool, sessionID string) (models.TerminalSession, error) {
+	session, err := s.repo.GetTerminalSession(ctx, sessionID)
+	if err != nil {
+		return models.TerminalSession{}, err
+	}
+	if admin || (session.RenterUserID == userID && session.GrantID == "") {
+		return session, nil
+	}
+	if access, err := s.lookupResourceAccess(ctx, session.ResourceID); err == nil && access.OwnerUserID == userID {
+		return session, nil
+	}
+	return models.TerminalSession{}, errors.New("forbidden: recordings are open to the resource owner and admins")
+}
+
+// TerminalRecording exports a session as asciicast v2, with input, output
+// and resizes in the order they happened. purpose names the audit event
+// recorded for the access.
+func (s *ResourceService) TerminalRecording(ctx context.Context, userID string, admin bool, sessionID string, purpose string) (models.TerminalRecording, error) {
+	session, err := s.authorizeRecording(ctx, userID, admin, sessionID)
+	if err != nil {
+		return models.TerminalRecording{}, err
+	}
+	if !session.RecordingPurgedAt.IsZero() {
+		return models.TerminalRecording{}, errors.New("terminal recording not found")
+	}
+	output, err := s.recordingChunks(ctx, sessionID, models.TerminalChunkOutput)
+	if err != nil {
+		return models.TerminalRecording{}, err
+	}
+	input, err := s.recordingChunks(ctx, sessionID, models.TerminalChunkInput)
+	if err != nil {
+		return models.TerminalRecording{}, err
+	}
+	resizes, err := s.repo.ListTerminalAuditEvents(ctx, sessionID, "terminal_resize", recordingMaxChunks)
+	if err != nil {
+		return models.TerminalRecording{}, err
+	}
+
+	type timedEvent struct {
+		at    time.Time
+		event models.AsciicastEvent
+	}
+	timed := make([]timedEvent, 0, len(output)+len(input)+len(resizes))
+	for _, chunk := range output {
+		timed = append(timed, timedEvent{at: chunk.CreatedAt, event: models.AsciicastEvent{Code: "o", Data: chunk.Data}})
+	}
+	for _, chunk := range input {
+		timed = append(timed, timedEvent{at: chunk.CreatedAt, event: models.AsciicastEvent{Code: "i", Data: chunk.Data}})
+	}
+	for _, item := range resizes {
+		timed = append(timed, timedEvent{at: item.CreatedAt, event: models.AsciicastEvent{Code: "r", Data: item.Details}})
+	}
+	// Output comes first, so an equal timestamp keeps seq order within each
+	// direction and puts output before the input it answered.
+	sort.SliceStable(timed, func(i, j int) bool { return timed[i].at.Before(timed[j].at) })
+
+	start := session.CreatedAt
+	out := models.TerminalRecording{Session: session, Events: make([]models.AsciicastEvent, 0, len(timed))}
+	for _, item := range timed {
+		item.event.Time = recordingSeconds(item.at.Sub(start))
+		out.Events = append(out.Events, item.event)
+	}
+	width, height := session.InitialCols, session.InitialRows
+	if width <= 0 || height <= 0 {
+		width, height = session.Cols, session.Rows
+	}
+	out.Header = models.AsciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     fmt.Sprintf("terminal %s on %s", session.ID, session.ResourceID),
+		Env:       map[string]string{"SHELL": "/bin/bash", "TERM": "xterm-256color"},
+	}
+	if len(out.Events) > 0 {
+		out.Header.Duration = out.Events[len(out.Events)-1].Time
+	}
+	_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+		SessionID:  session.ID,
+		ProviderID: session.ProviderID,
+		UserID:     userID,
+		EventType:  "terminal_recording_" + purpose,
+		Details:    fmt.Sprintf("%d events", len(out.Events)),
+	})
+	return out, nil
+}
+
+func (s *ResourceService) recordingChunks(ctx context.Context, sessionID string, direction models.TerminalChunkDirection) ([]models.TerminalChunk, error) {
+	out := make([]models.TerminalChunk, 0)
+	var afterSeq int64
+	for {
+		chunks, err := s.repo.ListTerminalChunks(ctx, sessionID, direction, afterSeq, terminalReplayBatch)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunks...)
+		if len(out) > recordingMaxChunks {
+			return nil, fmt.Errorf("terminal recording has more than %d %s chunks", recordingMaxChunks, direction)
+		}
+		if len(chunks) < terminalReplayBatch {
+			return out, nil
+		}
+		afterSeq = chunks[len(chunks)-1].Seq
+	}
+}
+
+func recordingSeconds(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return float64(d.Microseconds()) / 1e6
+}
+
+// ReplayTerminalRecording hands events to emit at speed times their recorded
+// pace. Gaps longer than maxIdle are shortened to it, unless maxIdle is zero,
+// and emitted times are those of the replay.
+func ReplayTerminalRecording(ctx context.Context, events []models.AsciicastEvent, speed float64, maxIdle time.Duration, emit func(models.AsciicastEvent) error) error {
+	if speed < MinReplaySpeed || speed > MaxReplaySpeed {
+		return fmt.Errorf("speed must be between %g and %g", MinReplaySpeed, MaxReplaySpeed)
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	var previous, elapsed float64
+	for _, event := range events {
+		gap := event.Time - previous
+		previous = event.Time
+		if maxIdle > 0 && gap > maxIdle.Seconds() {
+			gap = maxIdle.Seconds()
+		}
+		gap /= speed
+		elapsed += gap
+		if wait := time.Duration(gap * float64(time.Second)); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		event.Time = recordingSeconds(time.Duration(elapsed * float64(time.Second)))
+		if err := emit(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTerminalSessionsAdmin lists sessions of a resource or, for review of
+// the shells opened on a host, of a provider.
+func (s *ResourceService) ListTerminalSessionsAdmin(ctx context.Context, providerID string, resourceID string, limit int) ([]models.TerminalSession, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	if resourceID = strings.TrimSpace(resourceID); resourceID != "" {
+		return s.repo.ListTerminalSessions(ctx, resourceID, limit)
+	}
+	if providerID = strings.TrimSpace(providerID); providerID == "" {
+		return nil, errors.New("provider_id or resource_id is required")
+	}
+	return s.repo.ListProviderTerminalSessions(ctx, providerID, limit)
+}
+
+// PurgeTerminalRecordings drops the recordings of sessions that ended longer
+// than the retention ago.
+func (s *ResourceService) PurgeTerminalRecordings(ctx context.Context, now time.Time) error {
+	purged, err := s.repo.PurgeTerminalRecordings(ctx, now.Add(-s.recordings.Retention), recordingPurgeBatch)
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		log.Info().Int("sessions", purged).Dur("retention", s.recordings.Retention).Msg("terminal recordings purged")
+	}
+	return nil
+}
@@ -0,0 +1,625 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MidasWR/ShareMTC/services/resourceservice/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// TerminalStreamConn is an open terminal WebSocket as the service sees it.
+// Receive blocks until the client sends a frame or the connection fails.
+type TerminalStreamConn interface {
+	Send(frame models.TerminalFrame) error
+	Receive() (models.TerminalFrame, error)
+}
+
+const (
+	TerminalStreamPing = 15 * time.Second
+	// terminalStreamRecheck bounds the delay for output recorded on another
+	// instance, which only reaches this one through the database.
+	terminalStreamRecheck = 2 * time.Second
+	terminalViewerBuffer  = 256
+	// terminalWriteQueue is smaller than terminalRecentChunks, so every chunk
+	// not yet written is still held in memory for replay.
+	terminalWriteQueue   = 256
+	terminalRecentChunks = 512
+	terminalReplayBatch  = 1000
+	terminalMaxInput     = 64 << 10
+	// terminalSeqBlock is how many seqs an instance reserves in the database
+	// at a time.
+	terminalSeqBlock = 64
+)
+
+var errTerminalNotSequenced = errors.New("terminal session is not sequenced")
+
+// terminalHub sequences terminal chunks in memory so output reaches the
+// streams open on this instance without waiting on the database. Seqs come
+// from blocks reserved in the database, so instances never hand out the same
+// one; output stays in order while one instance holds the agent's channel.
+// Chunks and input audit events are written by a background writer; a full
+// queue slows the agent down rather than dropping chunks.
+type terminalHub struct {
+	repo    Repository
+	mu      sync.Mutex
+	streams map[string]*terminalStream
+	writes  chan terminalWrite
+	start   sync.Once
+	pending sync.WaitGroup
+}
+
+// terminalWrite is a chunk or, when event is set, an audit event.
+type terminalWrite struct {
+	chunk models.TerminalChunk
+	event *models.TerminalAuditEvent
+}
+
+type terminalStream struct {
+	providerID string
+	input      terminalSeqs
+	output     terminalSeqs
+	recent     []models.TerminalChunk
+	// viewers maps each open stream to the user watching it.
+	viewers map[chan models.TerminalFrame]string
+}
+
+// terminalSeqs is the unused rest of a reserved block: last was handed out
+// and end is the last seq reserved.
+type terminalSeqs struct {
+	last int64
+	end  int64
+}
+
+func (q *terminalSeqs) next() (int64, bool) {
+	if q.last >= q.end {
+		return 0, false
+	}
+	q.last++
+	return q.last, true
+}
+
+func (st *terminalStream) seqs(direction models.TerminalChunkDirection) *terminalSeqs {
+	if direction == models.TerminalChunkInput {
+		return &st.input
+	}
+	return &st.output
+}
+
+func newTerminalHub(repo Repository) *terminalHub {
+	return &terminalHub{repo: repo, streams: make(map[string]*terminalStream), writes: make(chan terminalWrite, terminalWriteQueue)}
+}
+
+func (h *terminalHub) stream(sessionID string) *terminalStream {
+	st, ok := h.streams[sessionID]
+	if !ok {
+		st = &terminalStream{viewers: make(map[chan models.TerminalFrame]string)}
+		h.streams[sessionID] = st
+	}
+	return st
+}
+
+// grant hands a block reserved up to end to a session's stream. A block
+// that is not needed because another caller refilled first is left unused.
+func (h *terminalHub) grant(session models.TerminalSession, direction models.TerminalChunkDirection, end int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.stream(session.ID)
+	st.providerID = session.ProviderID
+	if seqs := st.seqs(direction); seqs.last >= seqs.end {
+		*seqs = terminalSeqs{last: end - terminalSeqBlock, end: end}
+	}
+}
+
+// forgetProvider drops the rest of the blocks held for a provider's
+// sessions, so seqs continue above those another instance assigned while
+// this one had no channel to the agent.
+func (h *terminalHub) forgetProvider(providerID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, st := range h.streams {
+		if st.providerID == providerID {
+			st.input.last = st.input.end
+			st.output.last = st.output.end
+		}
+	}
+}
+
+// append gives a chunk the next seq of its direction, publishes output to
+// the session's viewers and queues the chunk to be written.
+func (h *terminalHub) append(chunk models.TerminalChunk) (models.TerminalChunk, error) {
+	h.mu.Lock()
+	st, ok := h.streams[chunk.SessionID]
+	if !ok || st.providerID == "" {
+		h.mu.Unlock()
+		return models.TerminalChunk{}, errTerminalNotSequenced
+	}
+	if st.providerID != chunk.ProviderID {
+		h.mu.Unlock()
+		return models.TerminalChunk{}, errors.New("provider mismatch for terminal output")
+	}
+	seq, ok := st.seqs(chunk.Direction).next()
+	if !ok {
+		h.mu.Unlock()
+		return models.TerminalChunk{}, errTerminalNotSequenced
+	}
+	chunk.ID = uuid.NewString()
+	chunk.CreatedAt = time.Now().UTC()
+	chunk.Seq = seq
+	if chunk.Direction != models.TerminalChunkInput {
+		st.recent = append(st.recent, chunk)
+		if len(st.recent) > terminalRecentChunks {
+			st.recent = append(st.recent[:0], st.recent[len(st.recent)-terminalRecentChunks:]...)
+		}
+		publishTerminalFrame(st, chunk.SessionID, models.TerminalFrame{Type: models.TerminalFrameOutput, Seq: chunk.Seq, Data: chunk.Data})
+	}
+	h.mu.Unlock()
+
+	h.queue(terminalWrite{chunk: chunk})
+	return chunk, nil
+}
+
+// publishTerminalFrame sends a frame to every viewer of a stream, dropping
+// viewers too slow to take it. The hub lock must be held.
+func publishTerminalFrame(st *terminalStream, sessionID string, frame models.TerminalFrame) {
+	for viewer := range st.viewers {
+		select {
+		case viewer <- frame:
+		default:
+			delete(st.viewers, viewer)
+			close(viewer)
+			log.Warn().Str("session_id", sessionID).Msg("terminal viewer too slow; dropped")
+		}
+	}
+}
+
+// record queues an audit event behind the chunks already queued, keeping
+// per-keystroke auditing off the input path.
+func (h *terminalHub) record(event models.TerminalAuditEvent) {
+	h.queue(terminalWrite{event: &event})
+}
+
+func (h *terminalHub) queue(write terminalWrite) {
+	h.pending.Add(1)
+	h.start.Do(func() { go h.writeLoop() })
+	h.writes <- write
+}
+
+func (h *terminalHub) writeLoop() {
+	for write := range h.writes {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if write.event != nil {
+			if _, err := h.repo.CreateTerminalAuditEvent(ctx, *write.event); err != nil {
+				log.Error().Err(err).Str("session_id", write.event.SessionID).Str("event_type", write.event.EventType).Msg("terminal audit write failed")
+			}
+		} else if _, err := h.repo.AppendTerminalChunk(ctx, write.chunk); err != nil {
+			log.Error().Err(err).Str("session_id", write.chunk.SessionID).Int64("seq", write.chunk.Seq).Str("direction", string(write.chunk.Direction)).Msg("terminal chunk write failed")
+		}
+		cancel()
+		h.pending.Done()
+	}
+}
+
+// flush waits until every queued chunk has been written.
+func (h *terminalHub) flush() {
+	h.pending.Wait()
+}
+
+// recentAfter returns the held output chunks of a session after seq.
+func (h *terminalHub) recentAfter(sessionID string, seq int64) []models.TerminalChunk {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]models.TerminalChunk, 0)
+	if st, ok := h.streams[sessionID]; ok {
+		for _, chunk := range st.recent {
+			if chunk.Seq > seq {
+				out = append(out, chunk)
+			}
+		}
+	}
+	return out
+}
+
+// subscribe registers userID's viewer and returns it with the output held so
+// far. The channel is closed by cancel, when the session ends or when the
+// viewer falls behind. Cancelling the last viewer of a session that has
+// ended drops the session's state.
+func (h *terminalHub) subscribe(sessionID string, userID string) (<-chan models.TerminalFrame, []models.TerminalChunk, func(ended bool)) {
+	viewer := make(chan models.TerminalFrame, terminalViewerBuffer)
+	h.mu.Lock()
+	st := h.stream(sessionID)
+	st.viewers[viewer] = userID
+	recent := append([]models.TerminalChunk(nil), st.recent...)
+	h.mu.Unlock()
+	return viewer, recent, func(ended bool) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		st, ok := h.streams[sessionID]
+		if !ok {
+			return
+		}
+		if _, ok := st.viewers[viewer]; ok {
+			delete(st.viewers, viewer)
+			close(viewer)
+		}
+		if ended && len(st.viewers) == 0 {
+			delete(h.streams, sessionID)
+		}
+	}
+}
+
+// idle lists the sessions held on this instance that nobody watches.
+func (h *terminalHub) idle() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]string, 0)
+	for sessionID, st := range h.streams {
+		if len(st.viewers) == 0 {
+			out = append(out, sessionID)
+		}
+	}
+	return out
+}
+
+// drop forgets an ended session unless a viewer arrived in the meantime.
+func (h *terminalHub) drop(sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if st, ok := h.streams[sessionID]; ok && len(st.viewers) == 0 {
+		delete(h.streams, sessionID)
+	}
+}
+
+// online counts the open streams of a session per user.
+func (h *terminalHub) online(sessionID string) map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]int)
+	if st, ok := h.streams[sessionID]; ok {
+		for _, userID := range st.viewers {
+			out[userID]++
+		}
+	}
+	return out
+}
+
+// broadcast sends a frame to the viewers of a session open on this instance.
+func (h *terminalHub) broadcast(sessionID string, frame models.TerminalFrame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if st, ok := h.streams[sessionID]; ok {
+		publishTerminalFrame(st, sessionID, frame)
+	}
+}
+
+// finish tells the viewers of a session that it ended and drops its state.
+func (h *terminalHub) finish(sessionID string, status models.TerminalSessionState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.streams[sessionID]
+	if !ok {
+		return
+	}
+	for viewer := range st.viewers {
+		select {
+		case viewer <- models.TerminalFrame{Type: models.TerminalFrameClosed, Status: status}:
+		default:
+		}
+		close(viewer)
+	}
+	delete(h.streams, sessionID)
+}
+
+// sequenceTerminalChunk appends a chunk through the hub, reserving another
+// block of seqs whenever this instance has none left for the session.
+func (s *ResourceService) sequenceTerminalChunk(ctx context.Context, chunk models.TerminalChunk) (models.TerminalChunk, error) {
+	for {
+		item, err := s.terminals.append(chunk)
+		if !errors.Is(err, errTerminalNotSequenced) {
+			return item, err
+		}
+		session, err := s.repo.GetTerminalSession(ctx, chunk.SessionID)
+		if err != nil {
+			return models.TerminalChunk{}, err
+		}
+		end, err := s.repo.ReserveTerminalSeqs(ctx, chunk.SessionID, chunk.Direction, terminalSeqBlock)
+		if err != nil {
+			return models.TerminalChunk{}, err
+		}
+		s.terminals.grant(session, chunk.Direction, end)
+	}
+}
+
+// sweepTerminalStreams drops the state of unwatched sessions that have ended,
+// including those closed on another instance, which never finish here.
+func (s *ResourceService) sweepTerminalStreams(ctx context.Context) error {
+	for _, sessionID := range s.terminals.idle() {
+		session, err := s.repo.GetTerminalSession(ctx, sessionID)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			s.terminals.drop(sessionID)
+		case err != nil:
+			return err
+		case terminalSessionEnded(session.Status):
+			s.terminals.drop(sessionID)
+		}
+	}
+	return nil
+}
+
+// deliverTerminalInput records input for audit and hands it to the agent's
+// channel, or queues a terminal_data command when the channel is not open on
+// this instance. Each input gets a terminal_input audit event naming who sent
+// it, since a shared session has more than one driver.
+func (s *ResourceService) deliverTerminalInput(ctx context.Context, session models.TerminalSession, access resourceAccess, userID string, data string) (models.TerminalChunk, error) {
+	chunk, err := s.sequenceTerminalChunk(ctx, models.TerminalChunk{
+		SessionID:  session.ID,
+		ProviderID: session.ProviderID,
+		Direction:  models.TerminalChunkInput,
+		Data:       data,
+	})
+	if err != nil {
+		return models.TerminalChunk{}, err
+	}
+	s.terminals.record(models.TerminalAuditEvent{
+		SessionID:  session.ID,
+		ProviderID: session.ProviderID,
+		UserID:     userID,
+		GrantID:    access.GrantID,
+		EventType:  "terminal_input",
+		Details:    fmt.Sprintf("input seq %d, %d bytes", chunk.Seq, len(data)),
+	})
+	if s.agentChannels.push(session.ProviderID, models.AgentChannelFrame{Type: models.AgentFrameTerminalInput, SessionID: session.ID, Data: data}) {
+		return chunk, nil
+	}
+	_, err = s.createAgentCommand(ctx, models.AgentCommand{
+		ProviderID:  session.ProviderID,
+		ResourceID:  session.ResourceID,
+		SessionID:   session.ID,
+		Command:     models.AgentCommandTerminalData,
+		Payload:     data,
+		Status:      models.AgentCommandQueued,
+		RequestedBy: userID,
+	})
+	if err != nil {
+		return models.TerminalChunk{}, err
+	}
+	return chunk, nil
+}
+
+func (s *ResourceService) resizeTerminal(ctx context.Context, session models.TerminalSession, access resourceAccess, userID string, rows int, cols int) (models.TerminalSession, error) {
+	if rows <= 0 || cols <= 0 {
+		return models.TerminalSession{}, errors.New("rows and cols must be positive")
+	}
+	updated, err := s.repo.UpdateTerminalSessionSize(ctx, session.ID, rows, cols)
+	if err != nil {
+		return models.TerminalSession{}, err
+	}
+	// Recordings replay resizes from these events, in asciicast's COLSxROWS.
+	_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+		SessionID:  session.ID,
+		ProviderID: session.ProviderID,
+		UserID:     userID,
+		GrantID:    access.GrantID,
+		EventType:  "terminal_resize",
+		Details:    fmt.Sprintf("%dx%d", cols, rows),
+	})
+	if s.agentChannels.push(session.ProviderID, models.AgentChannelFrame{Type: models.AgentFrameTerminalResize, SessionID: session.ID, Rows: rows, Cols: cols}) {
+		return updated, nil
+	}
+	_, err = s.createAgentCommand(ctx, models.AgentCommand{
+		ProviderID:  session.ProviderID,
+		ResourceID:  session.ResourceID,
+		SessionID:   session.ID,
+		Command:     models.AgentCommandTerminalResize,
+		Rows:        rows,
+		Cols:        cols,
+		Status:      models.AgentCommandQueued,
+		RequestedBy: userID,
+	})
+	if err != nil {
+		return models.TerminalSession{}, err
+	}
+	return updated, nil
+}
+
+func terminalSessionEnded(status models.TerminalSessionState) bool {
+	return status == models.TerminalSessionClosed || status == models.TerminalSessionExpired
+}
+
+// ServeTerminalStream bridges a terminal session and a WebSocket. Output
+// after afterSeq is replayed, from the database and then from the chunks not
+// yet written, and streamed live after that. The renter and invited drivers
+// may send input and resizes; other readers watch. Drive access is checked
+// on every input and resize, and view access on every ping, so a removed
+// driver stops driving at once and a revoked grant ends the stream. It
+// returns when the session ends, the connection fails or ctx ends.
+func (s *ResourceService) ServeTerminalStream(ctx context.Context, userID string, sessionID string, afterSeq int64, conn TerminalStreamConn) error {
+	session, access, err := s.viewTerminalSession(ctx, userID, sessionID)
+	if err != nil {
+		_ = conn.Send(models.TerminalFrame{Type: models.TerminalFrameError, Error: err.Error()})
+		return err
+	}
+	if session.RenterUserID != userID && access.GrantID != "" {
+		_, _ = s.repo.CreateTerminalAuditEvent(ctx, models.TerminalAuditEvent{
+			SessionID:  session.ID,
+			ProviderID: session.ProviderID,
+			UserID:     userID,
+			GrantID:    access.GrantID,
+			EventType:  "terminal_view",
+			Details:    terminalAccessDetails("stream opened", access),
+		})
+	}
+	if afterSeq < 0 {
+		afterSeq = 0
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	live, recent, unsubscribe := s.terminals.subscribe(sessionID, userID)
+	ended := false
+	defer func() {
+		unsubscribe(ended)
+		s.publishTerminalPresence(ctx, session)
+	}()
+	s.publishTerminalPresence(ctx, session)
+
+	lastSeq := afterSeq
+	sendOutput := func(seq int64, data string) error {
+		if seq <= lastSeq {
+			return nil
+		}
+		lastSeq = seq
+		return conn.Send(models.TerminalFrame{Type: models.TerminalFrameOutput, Seq: seq, Data: data})
+	}
+	catchUp := func() error {
+		for {
+			chunks, err := s.repo.ListTerminalChunks(ctx, sessionID, models.TerminalChunkOutput, lastSeq, terminalReplayBatch)
+			if err != nil {
+				return err
+			}
+			for _, chunk := range chunks {
+				if err := sendOutput(chunk.Seq, chunk.Data); err != nil {
+					return err
+				}
+			}
+			if len(chunks) < terminalReplayBatch {
+				return nil
+			}
+		}
+	}
+	if err := catchUp(); err != nil {
+		return err
+	}
+	for _, chunk := range recent {
+		if err := sendOutput(chunk.Seq, chunk.Data); err != nil {
+			return err
+		}
+	}
+	if terminalSessionEnded(session.Status) {
+		ended = true
+		return conn.Send(models.TerminalFrame{Type: models.TerminalFrameClosed, Status: session.Status})
+	}
+
+	frames := make(chan models.TerminalFrame)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			frame, err := conn.Receive()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	recheck := time.NewTicker(terminalStreamRecheck)
+	defer recheck.Stop()
+	ping := time.NewTicker(TerminalStreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			return err
+		case frame, ok := <-live:
+			if !ok {
+				_ = conn.Send(models.TerminalFrame{Type: models.TerminalFrameError, Error: "terminal stream fell behind; reconnect"})
+				return errors.New("terminal stream fell behind")
+			}
+			if frame.Type == models.TerminalFrameClosed {
+				ended = true
+				return conn.Send(frame)
+			}
+			if frame.Type == models.TerminalFramePresence {
+				if err := conn.Send(frame); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := sendOutput(frame.Seq, frame.Data); err != nil {
+				return err
+			}
+		case <-recheck.C:
+			if err := catchUp(); err != nil {
+				return err
+			}
+		case <-ping.C:
+			current, _, err := s.viewTerminalSession(ctx, userID, sessionID)
+			if err != nil {
+				_ = conn.Send(models.TerminalFrame{Type: models.TerminalFrameError, Error: err.Error()})
+				return err
+			}
+			if terminalSessionEnded(current.Status) {
+				ended = true
+				return conn.Send(models.TerminalFrame{Type: models.TerminalFrameClosed, Status: current.Status})
+			}
+			session = current
+			if err := conn.Send(models.TerminalFrame{Type: models.TerminalFramePing}); err != nil {
+				return err
+			}
+		case frame := <-frames:
+			if reply, ok := s.handleTerminalFrame(ctx, userID, sessionID, frame); ok {
+				if err := conn.Send(reply); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// handleTerminalFrame applies one frame from a terminal client and returns
+// the frame to send back, if any. Input and resizes check drive access first,
+// as the REST input path does, so a revocation or demotion handled by any
+// instance applies to the next frame.
+func (s *ResourceService) handleTerminalFrame(ctx context.Context, userID string, sessionID string, frame models.TerminalFrame) (models.TerminalFrame, bool) {
+	var (
+		session models.TerminalSession
+		drive   resourceAccess
+		err     error
+	)
+	if frame.Type == models.TerminalFrameInput || frame.Type == models.TerminalFrameResize {
+		if session, drive, err = s.driveTerminalSession(ctx, userID, sessionID); err != nil {
+			err = errors.New("forbidden: only the renter and drivers can send input or resize")
+		} else if terminalSessionEnded(session.Status) {
+			err = errors.New("terminal session is closed")
+		}
+		if err != nil {
+			return models.TerminalFrame{Type: models.TerminalFrameError, Error: err.Error()}, true
+		}
+	}
+	switch frame.Type {
+	case models.TerminalFramePong:
+		return models.TerminalFrame{}, false
+	case models.TerminalFrameInput:
+		switch {
+		case frame.Data == "":
+			err = errors.New("input payload is empty")
+		case len(frame.Data) > terminalMaxInput:
+			err = errors.New("input payload is too large")
+		default:
+			var chunk models.TerminalChunk
+			if chunk, err = s.deliverTerminalInput(ctx, session, drive, userID, frame.Data); err == nil {
+				return models.TerminalFrame{Type: models.TerminalFrameInputAck, Seq: chunk.Seq}, true
+			}
+		}
+	case models.TerminalFrameResize:
+		_, err = s.resizeTerminal(ctx, session, drive, userID, frame.Rows, frame.Cols)
+	default:
+		err = errors.New("unsupported frame type")
+	}
+	if err == nil {
+		return models.TerminalFrame{}, false
+	}
+	return models.TerminalFrame{Type: models.TerminalFrameError, Error: err.Error()}, true
+}
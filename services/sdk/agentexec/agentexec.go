@@ -0,0 +1,33 @@
+package agentexec
+
+// Output streams of a running command.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Request is the payload of an exec agent command. Exactly one of Script and
+// Argv is set; a script runs under /bin/sh -c.
+type Request struct {
+	ExecID         string            `json:"exec_id"`
+	Script         string            `json:"script,omitempty"`
+	Argv           []string          `json:"argv,omitempty"`
+	WorkDir        string            `json:"work_dir,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	TimeoutSeconds int               `json:"timeout_seconds"`
+	RunAs          string            `json:"run_as,omitempty"`
+}
+
+// Result is what the agent reports as the command result once the process
+// has exited or could not be started.
+type Result struct {
+	ExitCode  int    `json:"exit_code"`
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Succeeded reports whether the command ran to completion with exit code 0.
+func (r Result) Succeeded() bool {
+	return r.Error == "" && !r.TimedOut && r.ExitCode == 0
+}
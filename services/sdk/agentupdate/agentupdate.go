@@ -0,0 +1,66 @@
+package agentupdate
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxArtifactBytes bounds the size of a downloaded release binary.
+const MaxArtifactBytes = 256 << 20
+
+// SignatureSuffix is appended to an artifact URL to fetch its signature.
+const SignatureSuffix = ".sig"
+
+var versionPattern = regexp.MustCompile(`^v?[0-9][0-9A-Za-z.+-]{0,63}$`)
+
+// Request is the payload of an agent_update command. URL may contain {os}
+// and {arch}, which the agent fills in for its own platform.
+type Request struct {
+	Version              string `json:"version"`
+	URL                  string `json:"url"`
+	HealthTimeoutSeconds int    `json:"health_timeout_seconds"`
+}
+
+// Result is reported by the version that ends up running: the new one once
+// it has delivered a heartbeat, or the previous one after a rollback.
+type Result struct {
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	Running     string `json:"running"`
+	RolledBack  bool   `json:"rolled_back,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ValidVersion reports whether v looks like a release tag such as v1.4.0.
+func ValidVersion(v string) bool {
+	return versionPattern.MatchString(v)
+}
+
+// ArtifactURL fills in the version and platform placeholders of a release
+// URL template.
+func ArtifactURL(template string, version string, goos string, goarch string) string {
+	return strings.NewReplacer("{version}", version, "{os}", goos, "{arch}", goarch).Replace(template)
+}
+
+// SignedMessage is what a release signature covers. Binding the version and
+// platform keeps a valid signature from being reused for another artifact.
+func SignedMessage(version string, platform string, digest []byte) []byte {
+	return []byte(fmt.Sprintf("sharemct-hostagent\n%s\n%s\n%s\n", version, platform, hex.EncodeToString(digest)))
+}
+
+// Verify checks a base64 ed25519 signature over SignedMessage.
+func Verify(publicKey ed25519.PublicKey, version string, platform string, digest []byte, signature string) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("release public key is not configured")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !ed25519.Verify(publicKey, SignedMessage(version, platform, digest), raw) {
+		return errors.New("release signature is invalid")
+	}
+	return nil
+}
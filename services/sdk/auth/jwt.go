@@ -26,6 +26,24 @@ func Sign(secret string, userID string, role string, ttl time.Duration) (string,
 	return token.SignedString([]byte(secret))
 }
 
+// SignHost issues an agent token bound to one enrolled host: the subject is
+// the host and the token ID names the credential, so a host can be revoked
+// and a rotated credential retired without touching other hosts.
+func SignHost(secret string, providerID string, hostID string, credentialID string, ttl time.Duration) (string, error) {
+	claims := Claims{
+		UserID: providerID,
+		Role:   RoleAgent,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   hostID,
+			ID:        credentialID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(secret))
+}
+
 func Parse(secret string, tokenRaw string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenRaw, &Claims{}, func(token *jwt.Token) (any, error) {
 		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
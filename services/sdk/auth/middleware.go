@@ -10,30 +10,85 @@ import (
 
 type claimsContextKey struct{}
 
+// RoleAgent is the role of host credentials. They are signed with the user
+// secret but only open the agent endpoints, behind RequireAgentAuth.
+const RoleAgent = "agent"
+
+// RequireAuth admits user tokens and refuses agent tokens.
 func RequireAuth(jwtSecret string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			rawHeader := r.Header.Get("Authorization")
-			if rawHeader == "" {
-				httpx.Error(w, http.StatusUnauthorized, "missing authorization header")
+			claims, status, message := authenticate(jwtSecret, r)
+			if claims == nil {
+				httpx.Error(w, status, message)
 				return
 			}
-			parts := strings.SplitN(rawHeader, " ", 2)
-			if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
-				httpx.Error(w, http.StatusUnauthorized, "invalid authorization header")
+			if claims.Role == RoleAgent {
+				httpx.Error(w, http.StatusForbidden, "agent tokens are limited to agent endpoints")
 				return
 			}
-			claims, err := Parse(jwtSecret, strings.TrimSpace(parts[1]))
-			if err != nil {
-				httpx.Error(w, http.StatusUnauthorized, "invalid token")
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+		})
+	}
+}
+
+// RequireAgentAuth guards the endpoints hosts call. Agent tokens must pass
+// authorize, which checks that the host and credential are still current;
+// other tokens pass through for the handlers to judge.
+func RequireAgentAuth(jwtSecret string, authorize func(ctx context.Context, claims *Claims) error) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, status, message := authenticate(jwtSecret, r)
+			if claims == nil {
+				httpx.Error(w, status, message)
 				return
 			}
-			ctx := context.WithValue(r.Context(), claimsContextKey{}, claims)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			if claims.Role == RoleAgent {
+				if err := authorize(r.Context(), claims); err != nil {
+					httpx.Error(w, http.StatusForbidden, err.Error())
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
 		})
 	}
 }
 
+func authenticate(jwtSecret string, r *http.Request) (*Claims, int, string) {
+	rawHeader := r.Header.Get("Authorization")
+	if rawHeader == "" {
+		rawHeader = websocketBearer(r)
+	}
+	if rawHeader == "" {
+		return nil, http.StatusUnauthorized, "missing authorization header"
+	}
+	parts := strings.SplitN(rawHeader, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
+		return nil, http.StatusUnauthorized, "invalid authorization header"
+	}
+	claims, err := Parse(jwtSecret, strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, http.StatusUnauthorized, "invalid token"
+	}
+	return claims, 0, ""
+}
+
+// websocketBearer reads a token offered as a "bearer.<token>" WebSocket
+// subprotocol, since browsers cannot set headers on a WebSocket.
+func websocketBearer(r *http.Request) string {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return ""
+	}
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), "bearer."); ok {
+				return "Bearer " + token
+			}
+		}
+	}
+	return ""
+}
+
 func RequireAnyRole(roles ...string) func(http.Handler) http.Handler {
 	allowed := make(map[string]struct{}, len(roles))
 	for _, role := range roles {
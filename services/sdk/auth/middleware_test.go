@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+func serve(t *testing.T, middleware func(http.Handler) http.Handler, token string) int {
+	t.Helper()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ClaimsFromContext(r.Context()) == nil {
+			t.Error("expected claims in context")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestRequireAuthRefusesAgentTokens(t *testing.T) {
+	userToken, err := Sign(testSecret, "user-1", "user", time.Hour)
+	if err != nil {
+		t.Fatalf("sign user token: %v", err)
+	}
+	agentToken, err := SignHost(testSecret, "user-1", "host-1", "cred-1", time.Hour)
+	if err != nil {
+		t.Fatalf("sign host token: %v", err)
+	}
+	userRoute := RequireAuth(testSecret)
+
+	if code := serve(t, userRoute, userToken); code != http.StatusNoContent {
+		t.Fatalf("expected user token admitted, got %d", code)
+	}
+	if code := serve(t, userRoute, agentToken); code != http.StatusForbidden {
+		t.Fatalf("expected agent token refused with 403, got %d", code)
+	}
+	if code := serve(t, userRoute, ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected missing token refused with 401, got %d", code)
+	}
+}
+
+func TestRequireAgentAuthChecksAgentCredentials(t *testing.T) {
+	current, _ := SignHost(testSecret, "provider-1", "host-1", "cred-2", time.Hour)
+	rotated, _ := SignHost(testSecret, "provider-1", "host-1", "cred-1", time.Hour)
+	admin, _ := Sign(testSecret, "admin-1", "admin", time.Hour)
+	checked := 0
+	agentRoute := RequireAgentAuth(testSecret, func(_ context.Context, claims *Claims) error {
+		checked++
+		if claims.ID != "cred-2" {
+			return errors.New("agent credential has been rotated out")
+		}
+		return nil
+	})
+
+	if code := serve(t, agentRoute, current); code != http.StatusNoContent {
+		t.Fatalf("expected current credential admitted, got %d", code)
+	}
+	if code := serve(t, agentRoute, rotated); code != http.StatusForbidden {
+		t.Fatalf("expected rotated credential refused with 403, got %d", code)
+	}
+	if code := serve(t, agentRoute, admin); code != http.StatusNoContent || checked != 2 {
+		t.Fatalf("expected admin token passed through unchecked, got %d after %d checks", code, checked)
+	}
+}
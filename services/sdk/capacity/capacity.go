@@ -0,0 +1,79 @@
+package capacity
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// Challenge kinds. A cpu_memory challenge proves the host can fill and
+// randomly walk a buffer of the requested size; a gpu_enum challenge asks the
+// host to list its GPU devices so they can be cross-checked with its claims.
+const (
+	KindCPUMemory = "cpu_memory"
+	KindGPUEnum   = "gpu_enum"
+)
+
+const (
+	MinMemoryMB = 16
+	MaxMemoryMB = 256
+	MaxPasses   = 4
+)
+
+// Challenge is the payload of a capacity_challenge agent command.
+type Challenge struct {
+	ID       string `json:"challenge_id"`
+	Kind     string `json:"kind"`
+	Nonce    string `json:"nonce"`
+	MemoryMB int    `json:"memory_mb,omitempty"`
+	Passes   int    `json:"passes,omitempty"`
+}
+
+type GPUDevice struct {
+	Index    int    `json:"index"`
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	MemoryMB int    `json:"memory_mb"`
+}
+
+// Response is what the agent reports back as the command result.
+type Response struct {
+	ChallengeID string      `json:"challenge_id"`
+	Digest      string      `json:"digest,omitempty"`
+	GPUs        []GPUDevice `json:"gpus,omitempty"`
+	ElapsedMS   int64       `json:"elapsed_ms"`
+}
+
+// Solve runs the cpu_memory workload: it fills memoryMB of SHA-256 blocks in
+// a chain seeded by nonce, then walks the buffer passes times in an order
+// only known while computing it, rewriting each block it visits. The digest
+// cannot be produced without holding the whole buffer, and the verifier
+// recomputes it the same way.
+func Solve(nonce string, memoryMB int, passes int) (string, error) {
+	if nonce == "" {
+		return "", errors.New("nonce is required")
+	}
+	if memoryMB < MinMemoryMB || memoryMB > MaxMemoryMB {
+		return "", errors.New("memory_mb is out of range")
+	}
+	if passes < 1 || passes > MaxPasses {
+		return "", errors.New("passes is out of range")
+	}
+	n := memoryMB * 1024 * 1024 / sha256.Size
+	buf := make([][sha256.Size]byte, n)
+	buf[0] = sha256.Sum256([]byte(nonce))
+	for i := 1; i < n; i++ {
+		buf[i] = sha256.Sum256(buf[i-1][:])
+	}
+	state := buf[n-1]
+	var mix [2 * sha256.Size]byte
+	for step := 0; step < passes*n; step++ {
+		idx := binary.LittleEndian.Uint64(state[:8]) % uint64(n)
+		copy(mix[:sha256.Size], state[:])
+		copy(mix[sha256.Size:], buf[idx][:])
+		state = sha256.Sum256(mix[:])
+		buf[idx] = state
+	}
+	return hex.EncodeToString(state[:]), nil
+}
@@ -0,0 +1,79 @@
+package filetransfer
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// ChunkSize is the largest chunk carried by one file_write command or one
+// file_chunk frame.
+const ChunkSize = 256 << 10
+
+const maxPathBytes = 1024
+
+// PodMountPath is where a local pod sees its sandbox directory. Transfers
+// for the pod read and write there.
+const PodMountPath = "/mnt/sharemtc-files"
+
+// WriteRequest is the payload of a file_write agent command. Chunks are
+// written in order to a partial file next to Path; the chunk that reaches
+// Size carries SHA256, and the agent moves the file into place only if the
+// whole file matches it.
+type WriteRequest struct {
+	TransferID string `json:"transfer_id"`
+	ResourceID string `json:"resource_id,omitempty"`
+	Path       string `json:"path"`
+	Offset     int64  `json:"offset"`
+	Data       []byte `json:"data"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256,omitempty"`
+}
+
+// WriteResult is the result of a file_write command. Written is the length
+// of the partial file after the chunk, so a retried transfer can resume from
+// it.
+type WriteResult struct {
+	Written  int64  `json:"written"`
+	Complete bool   `json:"complete,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ReadRequest is the payload of a file_read agent command. The agent streams
+// the file from Offset as file_chunk frames and fails without sending
+// anything if the file is larger than MaxBytes.
+type ReadRequest struct {
+	TransferID string `json:"transfer_id"`
+	ResourceID string `json:"resource_id,omitempty"`
+	Path       string `json:"path"`
+	Offset     int64  `json:"offset"`
+	MaxBytes   int64  `json:"max_bytes"`
+}
+
+// ReadResult is the result of a file_read command, sent after the last chunk.
+// SHA256 covers the whole file, not just the part read by this command.
+type ReadResult struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CleanPath validates a transfer path. Paths are relative to a sandbox
+// directory on the host and may not climb out of it.
+func CleanPath(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return "", errors.New("path is required")
+	}
+	if len(p) > maxPathBytes || strings.ContainsRune(p, 0) {
+		return "", errors.New("path is invalid")
+	}
+	if path.IsAbs(p) {
+		return "", errors.New("path must be relative to the sandbox directory")
+	}
+	cleaned := path.Clean(p)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errors.New("path must stay inside the sandbox directory")
+	}
+	return cleaned, nil
+}
@@ -1,6 +1,8 @@
 package httpx
 
 import (
+	"bufio"
+	"net"
 	"net/http"
 	"time"
 
@@ -29,6 +31,19 @@ func (c *responseCapture) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streaming handlers can flush through the logger.
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Hijack hands the connection over to WebSocket handlers; the request is
+// logged as 101 Switching Protocols.
+func (c *responseCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(c.ResponseWriter).Hijack()
+}
+
 // RequestLogger logs every HTTP request/response pair to stdout through zerolog.
 func RequestLogger(logger zerolog.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -0,0 +1,362 @@
+package logtail
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SourceContainer = "container"
+	SourceJournald  = "journald"
+	SourceFile      = "file"
+)
+
+const maxLineBytes = 16 * 1024
+
+type Source struct {
+	Kind string
+	Name string
+}
+
+type Entry struct {
+	SourceType string    `json:"source_type"`
+	Source     string    `json:"source"`
+	Stream     string    `json:"stream"`
+	Level      string    `json:"level"`
+	Message    string    `json:"message"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+type Sink func(Entry)
+
+// ParseSources reads a comma separated list such as
+// "journald:nginx.service,file:/var/log/app.log,container:web".
+func ParseSources(raw string) ([]Source, error) {
+	out := make([]Source, 0)
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kind, name, ok := strings.Cut(part, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("log source %q must be kind:name", part)
+		}
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		switch kind {
+		case SourceContainer, SourceJournald, SourceFile:
+		default:
+			return nil, fmt.Errorf("log source %q has unsupported kind", part)
+		}
+		out = append(out, Source{Kind: kind, Name: strings.TrimSpace(name)})
+	}
+	return out, nil
+}
+
+// Run tails every source until ctx is cancelled. Sources that fail are retried
+// after retryDelay so a unit or container that appears later is still picked up.
+func Run(ctx context.Context, sources []Source, retryDelay time.Duration, sink Sink) {
+	if retryDelay <= 0 {
+		retryDelay = 5 * time.Second
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	safeSink := func(entry Entry) {
+		mu.Lock()
+		defer mu.Unlock()
+		sink(entry)
+	}
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source Source) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				var err error
+				switch source.Kind {
+				case SourceFile:
+					err = TailFile(ctx, source.Name, time.Second, safeSink)
+				case SourceJournald:
+					err = TailJournald(ctx, source.Name, safeSink)
+				case SourceContainer:
+					err = TailContainer(ctx, "docker", source.Name, safeSink)
+				default:
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					safeSink(Entry{
+						SourceType: source.Kind,
+						Source:     source.Name,
+						Stream:     "system",
+						Level:      "warning",
+						Message:    "log source interrupted: " + err.Error(),
+						OccurredAt: time.Now().UTC(),
+					})
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(retryDelay):
+				}
+			}
+		}(source)
+	}
+	wg.Wait()
+}
+
+// TailFile follows a file from its current end, handling truncation and
+// rotation. When path is replaced, the rest of the old file is read first and
+// the new file is then followed from its start, so no line is lost in between.
+func TailFile(ctx context.Context, path string, pollInterval time.Duration, sink Sink) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	partial := ""
+	emit := func(line string) {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			return
+		}
+		sink(Entry{
+			SourceType: SourceFile,
+			Source:     path,
+			Stream:     "file",
+			Level:      DetectLevel(line),
+			Message:    truncate(line),
+			OccurredAt: time.Now().UTC(),
+		})
+	}
+	drain := func() error {
+		current, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if current.Size() < offset {
+			offset = 0
+			partial = ""
+		}
+		if current.Size() == offset {
+			return nil
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		raw, err := io.ReadAll(io.LimitReader(file, current.Size()-offset))
+		if err != nil {
+			return err
+		}
+		offset += int64(len(raw))
+		lines := strings.Split(partial+string(raw), "\n")
+		partial = lines[len(lines)-1]
+		if len(partial) > maxLineBytes {
+			lines = append(lines[:len(lines)-1], partial, "")
+			partial = ""
+		}
+		for _, line := range lines[:len(lines)-1] {
+			emit(line)
+		}
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		info, statErr := os.Stat(path)
+		if statErr != nil && !errors.Is(statErr, fs.ErrNotExist) {
+			return statErr
+		}
+		if err := drain(); err != nil {
+			return err
+		}
+		if statErr != nil {
+			// Moved away and not recreated yet; keep reading the old file.
+			continue
+		}
+		current, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(info, current) {
+			continue
+		}
+		next, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		emit(partial)
+		_ = file.Close()
+		file, offset, partial = next, 0, ""
+		if err := drain(); err != nil {
+			return err
+		}
+	}
+}
+
+// TailJournald follows a systemd unit through journalctl's JSON output.
+func TailJournald(ctx context.Context, unit string, sink Sink) error {
+	cmd := exec.CommandContext(ctx, "journalctl", "--follow", "--output", "json", "--lines", "0", "--unit", unit)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry, ok := ParseJournalLine(unit, scanner.Bytes())
+		if ok {
+			sink(entry)
+		}
+	}
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func ParseJournalLine(unit string, raw []byte) (Entry, bool) {
+	var record map[string]any
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return Entry{}, false
+	}
+	message, ok := record["MESSAGE"].(string)
+	if !ok || strings.TrimSpace(message) == "" {
+		return Entry{}, false
+	}
+	occurredAt := time.Now().UTC()
+	if ts, ok := record["__REALTIME_TIMESTAMP"].(string); ok {
+		if micros, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			occurredAt = time.UnixMicro(micros).UTC()
+		}
+	}
+	level := DetectLevel(message)
+	if prio, ok := record["PRIORITY"].(string); ok {
+		level = journalPriorityLevel(prio)
+	}
+	return Entry{
+		SourceType: SourceJournald,
+		Source:     unit,
+		Stream:     "journal",
+		Level:      level,
+		Message:    truncate(message),
+		OccurredAt: occurredAt,
+	}, true
+}
+
+// TailContainer follows stdout and stderr of a container through the engine CLI.
+func TailContainer(ctx context.Context, binary string, name string, sink Sink) error {
+	return TailContainerAs(ctx, binary, name, name, sink)
+}
+
+// TailContainerAs is TailContainer with a display name for the emitted entries.
+func TailContainerAs(ctx context.Context, binary string, name string, display string, sink Sink) error {
+	cmd := exec.CommandContext(ctx, binary, "logs", "--follow", "--tail", "0", name)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	pump := func(reader io.Reader, stream string) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			level := DetectLevel(line)
+			if stream == "stderr" && level == "info" {
+				level = "warning"
+			}
+			sink(Entry{
+				SourceType: SourceContainer,
+				Source:     display,
+				Stream:     stream,
+				Level:      level,
+				Message:    truncate(line),
+				OccurredAt: time.Now().UTC(),
+			})
+		}
+	}
+	wg.Add(2)
+	go pump(stdout, "stdout")
+	go pump(stderr, "stderr")
+	wg.Wait()
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// DetectLevel guesses a severity from common log prefixes.
+func DetectLevel(line string) string {
+	head := strings.ToLower(line)
+	if len(head) > 64 {
+		head = head[:64]
+	}
+	switch {
+	case strings.Contains(head, "fatal"), strings.Contains(head, "panic"), strings.Contains(head, "error"), strings.Contains(head, "crit"):
+		return "error"
+	case strings.Contains(head, "warn"):
+		return "warning"
+	case strings.Contains(head, "debug"), strings.Contains(head, "trace"):
+		return "debug"
+	default:
+		return "info"
+	}
+}
+
+func journalPriorityLevel(priority string) string {
+	switch priority {
+	case "0", "1", "2", "3":
+		return "error"
+	case "4":
+		return "warning"
+	case "7":
+		return "debug"
+	default:
+		return "info"
+	}
+}
+
+func truncate(line string) string {
+	if len(line) <= maxLineBytes {
+		return line
+	}
+	return line[:maxLineBytes]
+}
@@ -0,0 +1,92 @@
+package logtail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendFile(t *testing.T, path string, data string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer func() { _ = file.Close() }()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestTailFileFollowsRotationWithoutLosingLines(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "before start\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entries := make(chan Entry, 64)
+	done := make(chan error, 1)
+	go func() {
+		done <- TailFile(ctx, path, 10*time.Millisecond, func(entry Entry) { entries <- entry })
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case entry := <-entries:
+			return entry.Message
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a line")
+			return ""
+		}
+	}
+
+	// The tailer starts at the end, so keep writing until it reports a line.
+	ready := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ready:
+				return
+			case <-time.After(20 * time.Millisecond):
+				if file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0); err == nil {
+					_, _ = file.WriteString("ready\n")
+					_ = file.Close()
+				}
+			}
+		}
+	}()
+	if line := next(); line != "ready" {
+		close(ready)
+		t.Fatalf("expected the ready marker, got %q", line)
+	}
+	close(ready)
+	<-stopped
+
+	appendFile(t, path, "old last\nold partial")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	appendFile(t, path, "new first\n")
+	appendFile(t, path+".1", "\n")
+	appendFile(t, path, "new second\n")
+
+	got := make([]string, 0)
+	for len(got) < 4 {
+		if line := next(); line != "ready" {
+			got = append(got, line)
+		}
+	}
+	if strings.Join(got, "|") != "old last|old partial|new first|new second" {
+		t.Fatalf("unexpected lines across rotation: %q", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("expected the tail to survive rotation, got %v", err)
+	}
+}
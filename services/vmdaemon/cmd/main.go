@@ -13,6 +13,7 @@ import (
 
 	"github.com/IBM/sarama"
 	"github.com/MidasWR/ShareMTC/services/sdk/logging"
+	"github.com/MidasWR/ShareMTC/services/sdk/logtail"
 )
 
 type Config struct {
@@ -23,6 +24,7 @@ type Config struct {
 	ResourceType string
 	Interval     time.Duration
 	AuditLogPath string
+	LogSources   string
 }
 
 type Event struct {
@@ -60,6 +62,32 @@ func main() {
 	logger.Info().Msg("vmdaemon kafka producer initialized")
 	ctx := context.Background()
 
+	logSources, err := logtail.ParseSources(cfg.LogSources)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("vmdaemon invalid LOG_SOURCES")
+	}
+	if len(logSources) > 0 {
+		go logtail.Run(ctx, logSources, 10*time.Second, func(entry logtail.Entry) {
+			if err := publishEvent(ctx, producer, cfg.KafkaTopic, cfg.ResourceID, Event{
+				EventType:  "resource_log",
+				ProviderID: cfg.ProviderID,
+				ResourceID: cfg.ResourceID,
+				OccurredAt: entry.OccurredAt,
+				Payload: map[string]interface{}{
+					"resource_type": cfg.ResourceType,
+					"source_type":   entry.SourceType,
+					"source":        entry.Source,
+					"stream":        entry.Stream,
+					"level":         entry.Level,
+					"message":       entry.Message,
+				},
+			}); err != nil {
+				logger.Warn().Err(err).Str("source", entry.Source).Msg("vmdaemon resource log publish failed")
+			}
+		})
+		logger.Info().Int("log_source_count", len(logSources)).Msg("vmdaemon log tailing started")
+	}
+
 	lastAuditOffset := int64(0)
 	ticker := time.NewTicker(cfg.Interval)
 	defer ticker.Stop()
@@ -162,6 +190,7 @@ func loadConfig() Config {
 		ResourceType: env("RESOURCE_TYPE", "vm"),
 		Interval:     time.Duration(intervalSeconds) * time.Second,
 		AuditLogPath: env("VMDAEMON_AUDIT_LOG_PATH", "/var/log/audit/audit.log"),
+		LogSources:   env("LOG_SOURCES", ""),
 	}
 }
 